@@ -0,0 +1,97 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/rond-authz/rond/internal/config"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+// capabilitiesCache keeps the capabilities loaded from OPA_CAPABILITIES_PATH and restricted
+// by DISABLED_BUILTINS, so that the file is read once instead of at each rego construction.
+var capabilitiesCache = struct {
+	mtx     sync.Mutex
+	entries map[string]*ast.Capabilities
+}{entries: map[string]*ast.Capabilities{}}
+
+// regoCapabilities returns the OPA capabilities the policies are compiled with: the ones of
+// the OPA_CAPABILITIES_PATH file, or the ones of the embedded OPA version, without the
+// DISABLED_BUILTINS. The rond custom builtins are declared apart and are always available.
+func regoCapabilities(env config.EnvironmentVariables) (*ast.Capabilities, error) {
+	if env.OPACapabilitiesPath == "" && len(env.DisabledBuiltinsList) == 0 {
+		return ast.CapabilitiesForThisVersion(), nil
+	}
+
+	cacheKey := env.OPACapabilitiesPath + "\x00" + strings.Join(env.DisabledBuiltinsList, ",")
+	capabilitiesCache.mtx.Lock()
+	defer capabilitiesCache.mtx.Unlock()
+	if capabilities, ok := capabilitiesCache.entries[cacheKey]; ok {
+		return capabilities, nil
+	}
+
+	capabilities, err := loadRegoCapabilities(env)
+	if err != nil {
+		return nil, err
+	}
+	capabilitiesCache.entries[cacheKey] = capabilities
+	return capabilities, nil
+}
+
+func loadRegoCapabilities(env config.EnvironmentVariables) (*ast.Capabilities, error) {
+	capabilities := ast.CapabilitiesForThisVersion()
+	if env.OPACapabilitiesPath != "" {
+		var err error
+		if capabilities, err = ast.LoadCapabilitiesFile(env.OPACapabilitiesPath); err != nil {
+			return nil, fmt.Errorf("failed capabilities file load: %s", err.Error())
+		}
+	}
+	if len(env.DisabledBuiltinsList) == 0 {
+		return capabilities, nil
+	}
+
+	disabled := map[string]bool{}
+	for _, name := range env.DisabledBuiltinsList {
+		// a misspelled name would otherwise leave the builtin enabled
+		if _, ok := ast.BuiltinMap[name]; !ok {
+			return nil, fmt.Errorf("unknown builtin %s in %s", name, config.DisabledBuiltinsEnvKey)
+		}
+		disabled[name] = true
+	}
+	builtins := make([]*ast.Builtin, 0, len(capabilities.Builtins))
+	for _, builtin := range capabilities.Builtins {
+		if !disabled[builtin.Name] {
+			builtins = append(builtins, builtin)
+		}
+	}
+	capabilities.Builtins = builtins
+	return capabilities, nil
+}
+
+// regoCapabilitiesOrNone is like regoCapabilities for the rego constructions that cannot
+// report an error: without the configured capabilities no builtin is allowed, so that
+// the compilation fails instead of allowing the disabled builtins. The capabilities are
+// loaded on startup by SetupEvaluators, so this only happens if they failed there too.
+func regoCapabilitiesOrNone(env config.EnvironmentVariables) *ast.Capabilities {
+	capabilities, err := regoCapabilities(env)
+	if err != nil {
+		return &ast.Capabilities{}
+	}
+	return capabilities
+}
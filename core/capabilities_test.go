@@ -0,0 +1,154 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/openapi"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func hasBuiltin(capabilities *ast.Capabilities, name string) bool {
+	for _, builtin := range capabilities.Builtins {
+		if builtin.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRegoCapabilities(t *testing.T) {
+	t.Run("defaults to the capabilities of the OPA version", func(t *testing.T) {
+		capabilities, err := regoCapabilities(config.EnvironmentVariables{})
+		require.NoError(t, err)
+		require.Equal(t, ast.CapabilitiesForThisVersion(), capabilities)
+	})
+
+	t.Run("removes the disabled builtins", func(t *testing.T) {
+		capabilities, err := regoCapabilities(config.EnvironmentVariables{
+			DisabledBuiltinsList: []string{"http.send", "opa.runtime"},
+		})
+		require.NoError(t, err)
+		require.False(t, hasBuiltin(capabilities, "http.send"))
+		require.False(t, hasBuiltin(capabilities, "opa.runtime"))
+		require.True(t, hasBuiltin(capabilities, "count"))
+	})
+
+	t.Run("fails with an unknown disabled builtin", func(t *testing.T) {
+		_, err := regoCapabilities(config.EnvironmentVariables{
+			DisabledBuiltinsList: []string{"http.sendd"},
+		})
+		require.EqualError(t, err, "unknown builtin http.sendd in DISABLED_BUILTINS")
+	})
+
+	t.Run("loads the capabilities file", func(t *testing.T) {
+		capabilitiesPath := filepath.Join(t.TempDir(), "capabilities.json")
+		content := `{"builtins":[{"name":"eq","decl":{"type":"function","args":[{"type":"any"},{"type":"any"}],"result":{"type":"boolean"}},"infix":"="}]}`
+		require.NoError(t, os.WriteFile(capabilitiesPath, []byte(content), 0644))
+
+		capabilities, err := regoCapabilities(config.EnvironmentVariables{OPACapabilitiesPath: capabilitiesPath})
+		require.NoError(t, err)
+		require.Len(t, capabilities.Builtins, 1)
+		require.True(t, hasBuiltin(capabilities, "eq"))
+	})
+
+	t.Run("fails with an invalid capabilities file", func(t *testing.T) {
+		capabilitiesPath := filepath.Join(t.TempDir(), "capabilities.json")
+		require.NoError(t, os.WriteFile(capabilitiesPath, []byte("not json"), 0644))
+
+		_, err := regoCapabilities(config.EnvironmentVariables{OPACapabilitiesPath: capabilitiesPath})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failed capabilities file load")
+	})
+}
+
+func TestSetupEvaluatorsWithDisabledBuiltins(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+	env := config.EnvironmentVariables{DisabledBuiltinsList: []string{"http.send"}}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{
+						RequestFlow: openapi.RequestFlow{PolicyName: "allow"},
+					},
+				},
+			},
+		},
+	}
+
+	t.Run("rejects a policy using a disabled builtin", func(t *testing.T) {
+		opaModuleConfig := &OPAModuleConfig{
+			Name: "example.rego",
+			Content: `package policies
+			allow {
+				response := http.send({"method": "get", "url": "http://example.com"})
+				response.status_code == 200
+			}`,
+		}
+
+		_, setupErrors, err := SetupEvaluators(ctx, nil, oas, opaModuleConfig, env)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "undefined function http.send")
+		require.Len(t, setupErrors, 1)
+
+		for _, deferredEnv := range []config.EnvironmentVariables{
+			{DisabledBuiltinsList: env.DisabledBuiltinsList, LazyEvaluatorInit: true},
+			{DisabledBuiltinsList: env.DisabledBuiltinsList, PreWarmOnStartup: true},
+		} {
+			policyEvals, setupErrors, err := SetupEvaluators(ctx, nil, oas, opaModuleConfig, deferredEnv)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "undefined function http.send")
+			require.Len(t, setupErrors, 1)
+			require.Empty(t, policyEvals)
+		}
+	})
+
+	t.Run("keeps the rond builtins available", func(t *testing.T) {
+		opaModuleConfig := &OPAModuleConfig{
+			Name: "example.rego",
+			Content: `package policies
+			allow { get_header("x-role", input.request.headers) == "admin" }`,
+		}
+
+		evaluators, _, err := SetupEvaluators(ctx, nil, oas, opaModuleConfig, env)
+		require.NoError(t, err)
+		require.Len(t, evaluators, 1)
+	})
+
+	t.Run("fails with invalid capabilities", func(t *testing.T) {
+		opaModuleConfig := &OPAModuleConfig{
+			Name:    "example.rego",
+			Content: `package policies allow { true }`,
+		}
+
+		_, setupErrors, err := SetupEvaluators(ctx, nil, oas, opaModuleConfig, config.EnvironmentVariables{
+			DisabledBuiltinsList: []string{"unknown.builtin"},
+		})
+		require.EqualError(t, err, "invalid OPA capabilities: unknown builtin unknown.builtin in DISABLED_BUILTINS")
+		require.Empty(t, setupErrors)
+	})
+}
@@ -0,0 +1,325 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rond-authz/rond/internal/utils"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+type circuitBreakerKey struct{}
+
+const (
+	CircuitBreakerClosed   = "closed"
+	CircuitBreakerOpen     = "open"
+	CircuitBreakerHalfOpen = "half-open"
+)
+
+var circuitBreakerStates = []string{CircuitBreakerClosed, CircuitBreakerOpen, CircuitBreakerHalfOpen}
+
+// circuitBreakerProbeRetryAfter is the retry delay suggested to the requests rejected while
+// the half-open breaker waits for the result of its probe.
+const circuitBreakerProbeRetryAfter = time.Second
+
+// CircuitOpenError is returned instead of performing the target service request while the
+// circuit breaker is open. RetryAfter is the time left before a request probes the target
+// service again.
+type CircuitOpenError struct {
+	RetryAfter time.Duration
+}
+
+func (err *CircuitOpenError) Error() string {
+	return "target service circuit breaker is open"
+}
+
+// RetryAfterSeconds returns the Retry-After header value of the rejected requests.
+func (err *CircuitOpenError) RetryAfterSeconds() string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(err.RetryAfter.Seconds()))))
+}
+
+type CircuitBreakerOptions struct {
+	// ConsecutiveFailures opens the breaker after as many consecutive failed requests,
+	// zero disables the check.
+	ConsecutiveFailures int
+	// FailureRatio opens the breaker when the failed requests among the last WindowSize
+	// ones reach the ratio, zero disables the check.
+	FailureRatio float64
+	WindowSize   int
+	// OpenDuration is the time the breaker rejects the requests before letting a single
+	// request probe whether the target service is back.
+	OpenDuration time.Duration
+}
+
+// CircuitBreaker stops the requests to the target service while it is failing, so that an
+// outage is not amplified by the requests piling up on it. The breaker is closed until the
+// failures reach one of the thresholds, then it is open for OpenDuration and rejects all the
+// requests. After that, it is half-open: a single probe request is performed, closing the
+// breaker on success or opening it again on failure.
+//
+// The failures are the transport errors and the 502, 503 and 504 responses. The requests
+// closed by the client are not counted, since they tell nothing about the target service.
+type CircuitBreaker struct {
+	mtx        sync.Mutex
+	options    CircuitBreakerOptions
+	logger     *logrus.Entry
+	stateGauge *prometheus.GaugeVec
+	now        func() time.Time
+
+	state               string
+	consecutiveFailures int
+	// outcomes is the ring buffer of the last WindowSize results, true for the failures
+	outcomes         []bool
+	nextOutcome      int
+	recordedOutcomes int
+	windowFailures   int
+	openUntil        time.Time
+	probing          bool
+}
+
+func NewCircuitBreaker(options CircuitBreakerOptions, logger *logrus.Entry, stateGauge *prometheus.GaugeVec) *CircuitBreaker {
+	breaker := &CircuitBreaker{
+		options:    options,
+		logger:     logger,
+		stateGauge: stateGauge,
+		now:        time.Now,
+		state:      CircuitBreakerClosed,
+	}
+	if options.FailureRatio > 0 && options.WindowSize > 0 {
+		breaker.outcomes = make([]bool, options.WindowSize)
+	}
+	breaker.setStateGauge()
+	return breaker
+}
+
+// State returns the current state of the breaker.
+func (breaker *CircuitBreaker) State() string {
+	breaker.mtx.Lock()
+	defer breaker.mtx.Unlock()
+	return breaker.state
+}
+
+// Rejects returns the error of a request that the breaker would reject now, without changing
+// its state, so that the requests are rejected before their policies are evaluated.
+// It returns nil on a nil breaker.
+func (breaker *CircuitBreaker) Rejects() *CircuitOpenError {
+	if breaker == nil {
+		return nil
+	}
+	breaker.mtx.Lock()
+	defer breaker.mtx.Unlock()
+
+	switch {
+	case breaker.state == CircuitBreakerOpen && breaker.now().Before(breaker.openUntil):
+		return &CircuitOpenError{RetryAfter: breaker.openUntil.Sub(breaker.now())}
+	case breaker.state == CircuitBreakerHalfOpen && breaker.probing:
+		return &CircuitOpenError{RetryAfter: circuitBreakerProbeRetryAfter}
+	}
+	return nil
+}
+
+// Transport returns the RoundTripper performing the requests through transport while the
+// breaker allows them, or transport itself on a nil breaker.
+func (breaker *CircuitBreaker) Transport(transport http.RoundTripper) http.RoundTripper {
+	if breaker == nil {
+		return transport
+	}
+	return &circuitBreakerTransport{breaker: breaker, transport: transport}
+}
+
+type circuitBreakerTransport struct {
+	breaker   *CircuitBreaker
+	transport http.RoundTripper
+}
+
+func (t *circuitBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	probe, err := t.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.transport.RoundTrip(req)
+	t.breaker.record(probe, circuitBreakerOutcome(req, resp, err))
+	return resp, err
+}
+
+type requestOutcome int
+
+const (
+	requestSucceeded requestOutcome = iota
+	requestFailed
+	requestIgnored
+)
+
+func circuitBreakerOutcome(req *http.Request, resp *http.Response, err error) requestOutcome {
+	if err != nil {
+		if utils.IsClientClosedRequest(req.Context()) {
+			return requestIgnored
+		}
+		return requestFailed
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return requestFailed
+	}
+	return requestSucceeded
+}
+
+// allow reports whether the request can be performed, and whether it is the probe of the
+// half-open breaker.
+func (breaker *CircuitBreaker) allow() (bool, error) {
+	breaker.mtx.Lock()
+	defer breaker.mtx.Unlock()
+
+	switch breaker.state {
+	case CircuitBreakerClosed:
+		return false, nil
+	case CircuitBreakerOpen:
+		if now := breaker.now(); now.Before(breaker.openUntil) {
+			return false, &CircuitOpenError{RetryAfter: breaker.openUntil.Sub(now)}
+		}
+		breaker.transition(CircuitBreakerHalfOpen)
+	}
+	if breaker.probing {
+		return false, &CircuitOpenError{RetryAfter: circuitBreakerProbeRetryAfter}
+	}
+	breaker.probing = true
+	return true, nil
+}
+
+func (breaker *CircuitBreaker) record(probe bool, outcome requestOutcome) {
+	breaker.mtx.Lock()
+	defer breaker.mtx.Unlock()
+
+	if probe {
+		breaker.probing = false
+		switch outcome {
+		case requestSucceeded:
+			breaker.transition(CircuitBreakerClosed)
+		case requestFailed:
+			breaker.open()
+		}
+		return
+	}
+	// the requests started before the breaker opened do not change its state
+	if breaker.state != CircuitBreakerClosed || outcome == requestIgnored {
+		return
+	}
+
+	failed := outcome == requestFailed
+	if failed {
+		breaker.consecutiveFailures++
+	} else {
+		breaker.consecutiveFailures = 0
+	}
+	if breaker.outcomes != nil {
+		if breaker.recordedOutcomes == len(breaker.outcomes) && breaker.outcomes[breaker.nextOutcome] {
+			breaker.windowFailures--
+		}
+		breaker.outcomes[breaker.nextOutcome] = failed
+		breaker.nextOutcome = (breaker.nextOutcome + 1) % len(breaker.outcomes)
+		if breaker.recordedOutcomes < len(breaker.outcomes) {
+			breaker.recordedOutcomes++
+		}
+		if failed {
+			breaker.windowFailures++
+		}
+	}
+
+	if breaker.thresholdReached() {
+		breaker.open()
+	}
+}
+
+func (breaker *CircuitBreaker) thresholdReached() bool {
+	options := breaker.options
+	if options.ConsecutiveFailures > 0 && breaker.consecutiveFailures >= options.ConsecutiveFailures {
+		return true
+	}
+	// the ratio is evaluated once the window is full, so that a few failures on startup do
+	// not open the breaker
+	return breaker.outcomes != nil &&
+		breaker.recordedOutcomes == len(breaker.outcomes) &&
+		float64(breaker.windowFailures)/float64(len(breaker.outcomes)) >= options.FailureRatio
+}
+
+func (breaker *CircuitBreaker) open() {
+	breaker.openUntil = breaker.now().Add(breaker.options.OpenDuration)
+	breaker.transition(CircuitBreakerOpen)
+}
+
+func (breaker *CircuitBreaker) transition(state string) {
+	previousState := breaker.state
+	breaker.state = state
+	if state == CircuitBreakerClosed {
+		breaker.consecutiveFailures = 0
+		breaker.nextOutcome = 0
+		breaker.recordedOutcomes = 0
+		breaker.windowFailures = 0
+	}
+	breaker.setStateGauge()
+
+	logger := breaker.logger.WithFields(logrus.Fields{
+		"previousState": previousState,
+		"state":         state,
+	})
+	if state == CircuitBreakerOpen {
+		logger.WithField("openDuration", breaker.options.OpenDuration.String()).Warn("target service circuit breaker state changed")
+		return
+	}
+	logger.Info("target service circuit breaker state changed")
+}
+
+func (breaker *CircuitBreaker) setStateGauge() {
+	if breaker.stateGauge == nil {
+		return
+	}
+	for _, state := range circuitBreakerStates {
+		value := 0.0
+		if state == breaker.state {
+			value = 1
+		}
+		breaker.stateGauge.With(prometheus.Labels{"state": state}).Set(value)
+	}
+}
+
+// CircuitBreakerInjectorMiddleware will inject into request context the target service circuit breaker.
+func CircuitBreakerInjectorMiddleware(breaker *CircuitBreaker) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := WithCircuitBreaker(r.Context(), breaker)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func WithCircuitBreaker(requestContext context.Context, breaker *CircuitBreaker) context.Context {
+	return context.WithValue(requestContext, circuitBreakerKey{}, breaker)
+}
+
+// GetCircuitBreaker returns the circuit breaker from the request context, or nil if it is
+// not enabled.
+func GetCircuitBreaker(requestContext context.Context) *CircuitBreaker {
+	breaker, _ := requestContext.Value(circuitBreakerKey{}).(*CircuitBreaker)
+	return breaker
+}
@@ -0,0 +1,219 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rond-authz/rond/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+type circuitBreakerTest struct {
+	breaker   *CircuitBreaker
+	upstream  *MockRoundTrip
+	transport http.RoundTripper
+	metrics   metrics.Metrics
+	logs      *test.Hook
+	now       time.Time
+}
+
+func newCircuitBreakerTest(options CircuitBreakerOptions) *circuitBreakerTest {
+	log, hook := test.NewNullLogger()
+	m := metrics.SetupMetrics("test")
+	breakerTest := &circuitBreakerTest{
+		upstream: &MockRoundTrip{Response: &http.Response{StatusCode: http.StatusOK}},
+		metrics:  m,
+		logs:     hook,
+		now:      time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	breakerTest.breaker = NewCircuitBreaker(options, logrus.NewEntry(log), m.CircuitBreakerState)
+	breakerTest.breaker.now = func() time.Time { return breakerTest.now }
+	breakerTest.transport = breakerTest.breaker.Transport(breakerTest.upstream)
+	return breakerTest
+}
+
+func (breakerTest *circuitBreakerTest) roundTrip(t *testing.T) (*http.Response, error) {
+	t.Helper()
+	breakerTest.upstream.Request = nil
+	return breakerTest.transport.RoundTrip(httptest.NewRequest(http.MethodGet, "/users", nil))
+}
+
+func (breakerTest *circuitBreakerTest) upstreamFails() {
+	breakerTest.upstream.Response = nil
+	breakerTest.upstream.Error = errors.New("connection refused")
+}
+
+func (breakerTest *circuitBreakerTest) upstreamRecovers() {
+	breakerTest.upstream.Response = &http.Response{StatusCode: http.StatusOK}
+	breakerTest.upstream.Error = nil
+}
+
+func (breakerTest *circuitBreakerTest) requireState(t *testing.T, expectedState string) {
+	t.Helper()
+	require.Equal(t, expectedState, breakerTest.breaker.State())
+	for _, state := range circuitBreakerStates {
+		expectedValue := 0.0
+		if state == expectedState {
+			expectedValue = 1
+		}
+		require.Equal(t, expectedValue, testutil.ToFloat64(breakerTest.metrics.CircuitBreakerState.WithLabelValues(state)), "unexpected gauge of state %s", state)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Run("goes through closed, open, half-open and closed again", func(t *testing.T) {
+		breakerTest := newCircuitBreakerTest(CircuitBreakerOptions{ConsecutiveFailures: 3, OpenDuration: 10 * time.Second})
+		breakerTest.requireState(t, CircuitBreakerClosed)
+
+		breakerTest.upstreamFails()
+		for i := 0; i < 3; i++ {
+			_, err := breakerTest.roundTrip(t)
+			require.EqualError(t, err, "connection refused")
+		}
+		breakerTest.requireState(t, CircuitBreakerOpen)
+		require.Equal(t, "target service circuit breaker state changed", breakerTest.logs.LastEntry().Message)
+		require.Equal(t, logrus.WarnLevel, breakerTest.logs.LastEntry().Level)
+		require.Equal(t, CircuitBreakerClosed, breakerTest.logs.LastEntry().Data["previousState"])
+		require.Equal(t, CircuitBreakerOpen, breakerTest.logs.LastEntry().Data["state"])
+
+		breakerTest.upstreamRecovers()
+		breakerTest.now = breakerTest.now.Add(4 * time.Second)
+		_, err := breakerTest.roundTrip(t)
+		var circuitOpenError *CircuitOpenError
+		require.ErrorAs(t, err, &circuitOpenError)
+		require.Equal(t, 6*time.Second, circuitOpenError.RetryAfter)
+		require.Equal(t, "6", circuitOpenError.RetryAfterSeconds())
+		require.Nil(t, breakerTest.upstream.Request, "the target service must not be called while the breaker is open")
+		require.Equal(t, circuitOpenError, breakerTest.breaker.Rejects())
+
+		breakerTest.now = breakerTest.now.Add(6 * time.Second)
+		require.Nil(t, breakerTest.breaker.Rejects(), "a probe is allowed once the open duration expires")
+		resp, err := breakerTest.roundTrip(t)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NotNil(t, breakerTest.upstream.Request)
+		breakerTest.requireState(t, CircuitBreakerClosed)
+
+		entries := breakerTest.logs.AllEntries()
+		require.Equal(t, CircuitBreakerOpen, entries[len(entries)-2].Data["previousState"])
+		require.Equal(t, CircuitBreakerHalfOpen, entries[len(entries)-2].Data["state"])
+		require.Equal(t, CircuitBreakerHalfOpen, entries[len(entries)-1].Data["previousState"])
+		require.Equal(t, CircuitBreakerClosed, entries[len(entries)-1].Data["state"])
+	})
+
+	t.Run("opens again when the probe fails", func(t *testing.T) {
+		breakerTest := newCircuitBreakerTest(CircuitBreakerOptions{ConsecutiveFailures: 1, OpenDuration: 10 * time.Second})
+		breakerTest.upstream.Response = &http.Response{StatusCode: http.StatusServiceUnavailable}
+		_, err := breakerTest.roundTrip(t)
+		require.NoError(t, err)
+		breakerTest.requireState(t, CircuitBreakerOpen)
+
+		breakerTest.now = breakerTest.now.Add(10 * time.Second)
+		_, err = breakerTest.roundTrip(t)
+		require.NoError(t, err)
+		breakerTest.requireState(t, CircuitBreakerOpen)
+
+		_, err = breakerTest.roundTrip(t)
+		var circuitOpenError *CircuitOpenError
+		require.ErrorAs(t, err, &circuitOpenError)
+		require.Equal(t, 10*time.Second, circuitOpenError.RetryAfter, "the open duration restarts from the failed probe")
+	})
+
+	t.Run("rejects the other requests while probing", func(t *testing.T) {
+		breakerTest := newCircuitBreakerTest(CircuitBreakerOptions{ConsecutiveFailures: 1, OpenDuration: time.Second})
+		breakerTest.upstreamFails()
+		_, _ = breakerTest.roundTrip(t)
+		breakerTest.now = breakerTest.now.Add(time.Second)
+
+		probe, err := breakerTest.breaker.allow()
+		require.NoError(t, err)
+		require.True(t, probe)
+		breakerTest.requireState(t, CircuitBreakerHalfOpen)
+
+		_, err = breakerTest.roundTrip(t)
+		require.Equal(t, &CircuitOpenError{RetryAfter: circuitBreakerProbeRetryAfter}, err)
+		require.NotNil(t, breakerTest.breaker.Rejects())
+
+		breakerTest.breaker.record(true, requestSucceeded)
+		breakerTest.requireState(t, CircuitBreakerClosed)
+	})
+
+	t.Run("resets the consecutive failures on success", func(t *testing.T) {
+		breakerTest := newCircuitBreakerTest(CircuitBreakerOptions{ConsecutiveFailures: 2, OpenDuration: time.Second})
+		for i := 0; i < 3; i++ {
+			breakerTest.upstreamFails()
+			_, _ = breakerTest.roundTrip(t)
+			breakerTest.upstreamRecovers()
+			_, _ = breakerTest.roundTrip(t)
+		}
+		breakerTest.requireState(t, CircuitBreakerClosed)
+	})
+
+	t.Run("opens on the failure ratio of the window", func(t *testing.T) {
+		breakerTest := newCircuitBreakerTest(CircuitBreakerOptions{FailureRatio: 0.5, WindowSize: 4, OpenDuration: time.Second})
+		breakerTest.upstreamFails()
+		_, _ = breakerTest.roundTrip(t)
+		_, _ = breakerTest.roundTrip(t)
+		breakerTest.requireState(t, CircuitBreakerClosed)
+
+		breakerTest.upstreamRecovers()
+		_, _ = breakerTest.roundTrip(t)
+		breakerTest.requireState(t, CircuitBreakerClosed)
+		_, _ = breakerTest.roundTrip(t)
+		breakerTest.requireState(t, CircuitBreakerOpen)
+	})
+
+	t.Run("the failure ratio slides with the window", func(t *testing.T) {
+		breakerTest := newCircuitBreakerTest(CircuitBreakerOptions{FailureRatio: 0.5, WindowSize: 4, OpenDuration: time.Second})
+		breakerTest.upstreamFails()
+		_, _ = breakerTest.roundTrip(t)
+		breakerTest.upstreamRecovers()
+		for i := 0; i < 4; i++ {
+			_, _ = breakerTest.roundTrip(t)
+		}
+		breakerTest.upstreamFails()
+		_, _ = breakerTest.roundTrip(t)
+		breakerTest.requireState(t, CircuitBreakerClosed)
+	})
+
+	t.Run("ignores the requests closed by the client", func(t *testing.T) {
+		breakerTest := newCircuitBreakerTest(CircuitBreakerOptions{ConsecutiveFailures: 1, OpenDuration: time.Second})
+		breakerTest.upstream.Error = context.Canceled
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := breakerTest.transport.RoundTrip(httptest.NewRequest(http.MethodGet, "/users", nil).WithContext(ctx))
+		require.ErrorIs(t, err, context.Canceled)
+		breakerTest.requireState(t, CircuitBreakerClosed)
+	})
+
+	t.Run("nil breaker", func(t *testing.T) {
+		var breaker *CircuitBreaker
+		upstream := &MockRoundTrip{}
+		require.Same(t, upstream, breaker.Transport(upstream))
+		require.Nil(t, breaker.Rejects())
+		require.Nil(t, GetCircuitBreaker(context.Background()))
+	})
+}
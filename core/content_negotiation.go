@@ -0,0 +1,67 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/rond-authz/rond/custom_builtins"
+	"github.com/rond-authz/rond/internal/config"
+)
+
+// EvaluateContentNegotiationPolicy evaluates the content negotiation policy of a route and
+// returns the API version it selects for the request. The policy receives the request
+// headers as input, e.g. input.request.headersLower.accept, and must return a string;
+// an empty version is returned if the policy is undefined for the request.
+// The policy is identified by its evaluator key, see RequestEvaluatorKey.
+func EvaluateContentNegotiationPolicy(
+	ctx context.Context,
+	req *http.Request,
+	env config.EnvironmentVariables,
+	partialResultsEvaluators PartialResultsEvaluators,
+	key EvaluatorKey,
+) (string, error) {
+	input, err := Input{
+		Request: InputRequest{
+			Method:             req.Method,
+			Path:               req.URL.Path,
+			Headers:            req.Header,
+			HeadersLower:       firstHeaderValues(req.Header),
+			HeadersLowerJoined: joinedHeaderValues(req.Header),
+		},
+	}.astValue()
+	if err != nil {
+		return "", err
+	}
+
+	evaluator, err := partialResultsEvaluators.GetEvaluatorFromPolicyWithParsedInput(ctx, key, input, env)
+	if err != nil {
+		return "", err
+	}
+	results, err := evaluator.PolicyEvaluator.Eval(custom_builtins.WithMongoBuiltinCache(ctx))
+	if err != nil {
+		return "", fmt.Errorf("content negotiation policy evaluation has failed: %s", err.Error())
+	}
+	if len(results) != 1 || len(results[0].Expressions) != 1 {
+		return "", nil
+	}
+	version, ok := results[0].Expressions[0].Value.(string)
+	if !ok {
+		return "", fmt.Errorf("content negotiation policy %s must return a string", key.PolicyName)
+	}
+	return version, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/openapi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluateContentNegotiationPolicy(t *testing.T) {
+	env := config.EnvironmentVariables{}
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		api_version := "v2" {
+			contains(input.request.headersLower.accept, "vnd.example.v2+json")
+		} else := "v1" {
+			contains(input.request.headersLower.accept, "vnd.example.v1+json")
+		}
+		not_a_string := 42`,
+	}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/api": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{
+						RequestFlow:              openapi.RequestFlow{PolicyName: "not_a_string"},
+						ContentNegotiationPolicy: "api_version",
+					},
+				},
+			},
+		},
+	}
+	ctx := createContext(t, context.Background(), env, nil, &openapi.RondConfig{}, opaModuleConfig, nil)
+	partialResultsEvaluators, _, err := SetupEvaluators(ctx, nil, oas, opaModuleConfig, env)
+	require.NoError(t, err)
+
+	t.Run("returns the version selected by the policy", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api", nil)
+		req.Header.Set("Accept", "application/vnd.example.v2+json")
+
+		version, err := EvaluateContentNegotiationPolicy(ctx, req, env, partialResultsEvaluators, EvaluatorKey{PolicyName: "api_version"})
+		require.NoError(t, err)
+		require.Equal(t, "v2", version)
+	})
+
+	t.Run("returns empty version if the policy is undefined", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api", nil)
+		req.Header.Set("Accept", "application/json")
+
+		version, err := EvaluateContentNegotiationPolicy(ctx, req, env, partialResultsEvaluators, EvaluatorKey{PolicyName: "api_version"})
+		require.NoError(t, err)
+		require.Empty(t, version)
+	})
+
+	t.Run("fails if the policy does not return a string", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api", nil)
+
+		_, err := EvaluateContentNegotiationPolicy(ctx, req, env, partialResultsEvaluators, EvaluatorKey{PolicyName: "not_a_string"})
+		require.EqualError(t, err, "content negotiation policy not_a_string must return a string")
+	})
+
+	t.Run("fails if the policy evaluator is missing", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api", nil)
+
+		_, err := EvaluateContentNegotiationPolicy(ctx, req, env, partialResultsEvaluators, EvaluatorKey{PolicyName: "missing_policy"})
+		require.Error(t, err)
+	})
+}
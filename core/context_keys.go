@@ -0,0 +1,65 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/openapi"
+	"github.com/rond-authz/rond/types"
+)
+
+type contextKeyType struct {
+	key      interface{}
+	expected reflect.Type
+}
+
+// contextKeyTypes lists the context keys shared across packages, along with the type of the
+// value each of them is expected to hold.
+var contextKeyTypes = []contextKeyType{
+	{key: config.EnvKey{}, expected: reflect.TypeOf(config.EnvironmentVariables{})},
+	{key: OPAModuleConfigKey{}, expected: reflect.TypeOf(&OPAModuleConfig{})},
+	{key: PartialResultsEvaluatorConfigKey{}, expected: reflect.TypeOf(PartialResultsEvaluators{})},
+	{key: queryEvaluatorCacheKey{}, expected: reflect.TypeOf(&QueryEvaluatorCache{})},
+	{key: inputRecorderKey{}, expected: reflect.TypeOf(&InputRecorder{})},
+	{key: responseBodyCacheKey{}, expected: reflect.TypeOf(&ResponseBodyCache{})},
+	{key: circuitBreakerKey{}, expected: reflect.TypeOf(&CircuitBreaker{})},
+	{key: openapi.XPermissionKey{}, expected: reflect.TypeOf(&openapi.RondConfig{})},
+	{key: openapi.RouterInfoKey{}, expected: reflect.TypeOf(openapi.RouterInfo{})},
+	{key: types.MongoClientContextKey{}, expected: reflect.TypeOf((*types.IMongoClient)(nil)).Elem()},
+}
+
+// ValidateContextKeys verifies that the values stored in the context hold the type expected
+// for their key, so that a key accidentally shared by different values is detected instead
+// of silently shadowing the other value. Keys not set in the context are ignored.
+func ValidateContextKeys(ctx context.Context) error {
+	for _, keyType := range contextKeyTypes {
+		value := ctx.Value(keyType.key)
+		if value == nil {
+			continue
+		}
+		valueType := reflect.TypeOf(value)
+		if keyType.expected.Kind() == reflect.Interface && valueType.Implements(keyType.expected) {
+			continue
+		}
+		if valueType != keyType.expected {
+			return fmt.Errorf("context key %T holds a value of type %s, expected %s", keyType.key, valueType, keyType.expected)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/metrics"
+	"github.com/rond-authz/rond/internal/mocks"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/openapi"
+	"github.com/rond-authz/rond/types"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateContextKeys(t *testing.T) {
+	t.Run("empty context", func(t *testing.T) {
+		require.NoError(t, ValidateContextKeys(context.Background()))
+	})
+
+	t.Run("values with the expected types", func(t *testing.T) {
+		ctx := config.WithEnv(context.Background(), config.EnvironmentVariables{})
+		ctx = WithOPAModuleConfig(ctx, &OPAModuleConfig{})
+		ctx = WithPartialResultsEvaluators(ctx, PartialResultsEvaluators{})
+		ctx = openapi.WithXPermission(ctx, &openapi.RondConfig{})
+		ctx = context.WithValue(ctx, openapi.RouterInfoKey{}, openapi.RouterInfo{})
+		ctx = context.WithValue(ctx, types.MongoClientContextKey{}, &mocks.MongoClientMock{})
+
+		require.NoError(t, ValidateContextKeys(ctx))
+	})
+
+	t.Run("env key holding a wrong type", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), config.EnvKey{}, &config.EnvironmentVariables{})
+
+		err := ValidateContextKeys(ctx)
+		require.EqualError(t, err, "context key config.EnvKey holds a value of type *config.EnvironmentVariables, expected config.EnvironmentVariables")
+	})
+
+	t.Run("opa module config key holding a wrong type", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), OPAModuleConfigKey{}, "not a module config")
+
+		err := ValidateContextKeys(ctx)
+		require.EqualError(t, err, "context key core.OPAModuleConfigKey holds a value of type string, expected *core.OPAModuleConfig")
+	})
+
+	t.Run("mongo client key holding a value not implementing the client", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), types.MongoClientContextKey{}, 42)
+
+		err := ValidateContextKeys(ctx)
+		require.EqualError(t, err, "context key types.MongoClientContextKey holds a value of type int, expected types.IMongoClient")
+	})
+
+	t.Run("request context built by the middlewares", func(t *testing.T) {
+		log, _ := test.NewNullLogger()
+		env := config.EnvironmentVariables{}
+		opaModule := &OPAModuleConfig{Name: "example.rego", Content: "package policies\nallow { true }"}
+		oas := &openapi.OpenAPISpec{
+			Paths: openapi.OpenAPIPaths{
+				"/users": openapi.PathVerbs{
+					"get": openapi.VerbConfig{PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow"}}},
+				},
+			},
+		}
+
+		validated := false
+		router := mux.NewRouter()
+		router.Use(
+			config.RequestMiddlewareEnvironments(env),
+			mongoclient.MongoClientInjectorMiddleware(&mocks.MongoClientMock{}),
+			CircuitBreakerInjectorMiddleware(NewCircuitBreaker(CircuitBreakerOptions{ConsecutiveFailures: 1}, logrus.NewEntry(log), metrics.SetupMetrics("test").CircuitBreakerState)),
+			OPAMiddleware(opaModule, oas, &env, PartialResultsEvaluators{}, nil),
+			InputRecorderInjectorMiddleware(NewInputRecorder(1, nil)),
+			QueryEvaluatorCacheInjectorMiddleware(NewQueryEvaluatorCache(1)),
+			ResponseBodyCacheInjectorMiddleware(NewResponseBodyCache(1)),
+		)
+		router.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, ValidateContextKeys(r.Context()))
+			validated = true
+		})
+
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users", nil))
+		require.True(t, validated, "the request did not reach the handler")
+	})
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/utils"
+	"github.com/rond-authz/rond/openapi"
+
+	"github.com/uptrace/bunrouter"
+)
+
+const (
+	corsRequestMethodHeader = "Access-Control-Request-Method"
+	corsAllowOriginHeader   = "Access-Control-Allow-Origin"
+	corsAllowMethodsHeader  = "Access-Control-Allow-Methods"
+	corsAllowHeadersHeader  = "Access-Control-Allow-Headers"
+)
+
+// isCORSPreflight reports whether the request is a CORS preflight request.
+func isCORSPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get(corsRequestMethodHeader) != ""
+}
+
+// corsPassthroughMode returns how the preflight request must be handled, according to
+// the options of the route the preflight is sent for. The preflights sent for a method
+// not defined in the OAS are handled as any other request.
+func corsPassthroughMode(oas *openapi.OpenAPISpec, OASRouter *bunrouter.CompatRouter, path string, r *http.Request, env *config.EnvironmentVariables) string {
+	permission, err := oas.FindPermission(OASRouter, path, strings.ToUpper(r.Header.Get(corsRequestMethodHeader)))
+	if err != nil {
+		return config.CORSPassthroughOff
+	}
+	return permission.Options.CORSPassthroughMode(env.CORSPassthrough)
+}
+
+// respondToCORSPreflight answers the preflight request with the CORS headers configured
+// by the CORS_ALLOWED_* environment variables. The allowed methods default to the ones
+// defined in the OAS for the path. The CORS headers are not set if the origin or the
+// requested method are not allowed, so that the browser blocks the actual request.
+func respondToCORSPreflight(w http.ResponseWriter, r *http.Request, env *config.EnvironmentVariables, pathMethods []string) {
+	allowedMethods := env.CORSAllowedMethodsList
+	if len(allowedMethods) == 0 {
+		allowedMethods = pathMethods
+	}
+
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	requestedMethod := strings.ToUpper(r.Header.Get(corsRequestMethodHeader))
+	if origin != "" && corsOriginAllowed(env.CORSAllowedOriginsList, origin) && utils.Contains(allowedMethods, requestedMethod) {
+		allowedOrigin := origin
+		if utils.Contains(env.CORSAllowedOriginsList, "*") {
+			allowedOrigin = "*"
+		}
+		w.Header().Set(corsAllowOriginHeader, allowedOrigin)
+		w.Header().Set(corsAllowMethodsHeader, strings.Join(allowedMethods, ", "))
+		if len(env.CORSAllowedHeadersList) > 0 {
+			w.Header().Set(corsAllowHeadersHeader, strings.Join(env.CORSAllowedHeadersList, ", "))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func corsOriginAllowed(allowedOrigins []string, origin string) bool {
+	for _, allowedOrigin := range allowedOrigins {
+		if allowedOrigin == "*" || allowedOrigin == origin {
+			return true
+		}
+	}
+	return false
+}
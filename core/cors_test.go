@@ -0,0 +1,97 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRespondToCORSPreflight(t *testing.T) {
+	newPreflight := func(origin, method string) *http.Request {
+		req := httptest.NewRequest(http.MethodOptions, "/users", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		return req
+	}
+
+	t.Run("allows configured origin and path methods", func(t *testing.T) {
+		env := &config.EnvironmentVariables{
+			CORSAllowedOriginsList: []string{"https://app.example.com"},
+			CORSAllowedHeadersList: []string{"Authorization", "Content-Type"},
+		}
+		w := httptest.NewRecorder()
+		respondToCORSPreflight(w, newPreflight("https://app.example.com", "post"), env, []string{http.MethodGet, http.MethodPost})
+
+		require.Equal(t, http.StatusNoContent, w.Code)
+		require.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		require.Equal(t, "GET, POST", w.Header().Get("Access-Control-Allow-Methods"))
+		require.Equal(t, "Authorization, Content-Type", w.Header().Get("Access-Control-Allow-Headers"))
+		require.Equal(t, "Origin", w.Header().Get("Vary"))
+	})
+
+	t.Run("allows any origin with wildcard", func(t *testing.T) {
+		env := &config.EnvironmentVariables{
+			CORSAllowedOriginsList: []string{"*"},
+			CORSAllowedMethodsList: []string{http.MethodGet},
+		}
+		w := httptest.NewRecorder()
+		respondToCORSPreflight(w, newPreflight("https://other.example.com", http.MethodGet), env, []string{http.MethodGet, http.MethodPost})
+
+		require.Equal(t, http.StatusNoContent, w.Code)
+		require.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+		require.Equal(t, "GET", w.Header().Get("Access-Control-Allow-Methods"))
+		require.Empty(t, w.Header().Get("Access-Control-Allow-Headers"))
+	})
+
+	t.Run("omits CORS headers for origin not allowed", func(t *testing.T) {
+		env := &config.EnvironmentVariables{CORSAllowedOriginsList: []string{"https://app.example.com"}}
+		w := httptest.NewRecorder()
+		respondToCORSPreflight(w, newPreflight("https://evil.example.com", http.MethodGet), env, []string{http.MethodGet})
+
+		require.Equal(t, http.StatusNoContent, w.Code)
+		require.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+		require.Empty(t, w.Header().Get("Access-Control-Allow-Methods"))
+	})
+
+	t.Run("omits CORS headers for method not allowed", func(t *testing.T) {
+		env := &config.EnvironmentVariables{
+			CORSAllowedOriginsList: []string{"*"},
+			CORSAllowedMethodsList: []string{http.MethodGet},
+		}
+		w := httptest.NewRecorder()
+		respondToCORSPreflight(w, newPreflight("https://app.example.com", http.MethodDelete), env, []string{http.MethodGet, http.MethodDelete})
+
+		require.Equal(t, http.StatusNoContent, w.Code)
+		require.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	})
+}
+
+func TestIsCORSPreflight(t *testing.T) {
+	req := httptest.NewRequest(http.MethodOptions, "/users", nil)
+	require.False(t, isCORSPreflight(req))
+
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	require.True(t, isCORSPreflight(req))
+
+	req = httptest.NewRequest(http.MethodGet, "/users", nil)
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	require.False(t, isCORSPreflight(req))
+}
@@ -0,0 +1,216 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/rond-authz/rond/internal/config"
+
+	"github.com/gorilla/mux"
+	"github.com/mia-platform/glogger/v2"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown/print"
+	"github.com/sirupsen/logrus"
+)
+
+const queryEvaluatorCacheShardsCount = 16
+
+type queryEvaluatorCacheKey struct{}
+
+// QueryEvaluatorCache holds the compiled queries created by CreateQueryEvaluator
+// so that each policy is compiled only once. Entries are spread across shards
+// selected by the key hash prefix, each shard evicting its least recently used entry
+// when full.
+type QueryEvaluatorCache struct {
+	shards [queryEvaluatorCacheShardsCount]*queryEvaluatorCacheShard
+}
+
+type queryEvaluatorCacheShard struct {
+	mtx      sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+type queryEvaluatorCacheEntry struct {
+	key       string
+	evaluator *OPAEvaluator
+}
+
+// NewQueryEvaluatorCache returns a cache holding at most maxSize evaluators.
+func NewQueryEvaluatorCache(maxSize int) *QueryEvaluatorCache {
+	shardCapacity := maxSize / queryEvaluatorCacheShardsCount
+	if maxSize%queryEvaluatorCacheShardsCount != 0 {
+		shardCapacity++
+	}
+
+	cache := &QueryEvaluatorCache{}
+	for i := range cache.shards {
+		cache.shards[i] = &queryEvaluatorCacheShard{
+			capacity: shardCapacity,
+			entries:  make(map[string]*list.Element),
+			lru:      list.New(),
+		}
+	}
+	return cache
+}
+
+// buildQueryEvaluatorCacheKey returns the key of the evaluator of policy, which covers the
+// module and the environment options applied when the query is compiled, so that an evaluator
+// is not reused with a different print statements setting, capabilities or builtins.
+func buildQueryEvaluatorCacheKey(policy string, opaModuleConfig *OPAModuleConfig, env config.EnvironmentVariables) string {
+	moduleHash := sha256.New()
+	moduleHash.Write([]byte(opaModuleConfig.Name + opaModuleConfig.Content))
+	for _, module := range opaModuleConfig.Modules {
+		moduleHash.Write([]byte(module.Name + module.Content))
+	}
+	fmt.Fprintf(moduleHash, "\x00print=%t\x00verifyJWT=%t\x00capabilities=%s\x00disabledBuiltins=%s",
+		printStatementsEnabled(env),
+		env.EnableVerifyJWTBuiltin,
+		env.OPACapabilitiesPath,
+		env.DisabledBuiltins,
+	)
+	return fmt.Sprintf("%s%s", policy, hex.EncodeToString(moduleHash.Sum(nil)))
+}
+
+func (cache *QueryEvaluatorCache) shardFor(key string) *queryEvaluatorCacheShard {
+	keyHash := sha256.Sum256([]byte(key))
+	return cache.shards[keyHash[0]%queryEvaluatorCacheShardsCount]
+}
+
+func (cache *QueryEvaluatorCache) get(key string) (*OPAEvaluator, bool) {
+	shard := cache.shardFor(key)
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+
+	element, ok := shard.entries[key]
+	if !ok {
+		return nil, false
+	}
+	shard.lru.MoveToFront(element)
+	return element.Value.(*queryEvaluatorCacheEntry).evaluator, true
+}
+
+func (cache *QueryEvaluatorCache) set(key string, evaluator *OPAEvaluator) {
+	shard := cache.shardFor(key)
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+
+	if element, ok := shard.entries[key]; ok {
+		element.Value.(*queryEvaluatorCacheEntry).evaluator = evaluator
+		shard.lru.MoveToFront(element)
+		return
+	}
+
+	shard.entries[key] = shard.lru.PushFront(&queryEvaluatorCacheEntry{key: key, evaluator: evaluator})
+	if shard.lru.Len() > shard.capacity {
+		oldest := shard.lru.Back()
+		shard.lru.Remove(oldest)
+		delete(shard.entries, oldest.Value.(*queryEvaluatorCacheEntry).key)
+	}
+}
+
+// Len returns the number of evaluators currently stored in the cache.
+func (cache *QueryEvaluatorCache) Len() int {
+	length := 0
+	for _, shard := range cache.shards {
+		shard.mtx.Lock()
+		length += shard.lru.Len()
+		shard.mtx.Unlock()
+	}
+	return length
+}
+
+// preparedEvaluator runs queries compiled once and shared between requests,
+// the parsed input being the only per-request state.
+type preparedEvaluator struct {
+	evalQuery    rego.PreparedEvalQuery
+	partialQuery rego.PreparedPartialQuery
+	input        ast.Value
+	printHook    print.Hook
+}
+
+func (evaluator preparedEvaluator) Eval(ctx context.Context) (rego.ResultSet, error) {
+	return evaluator.evalQuery.Eval(ctx, rego.EvalParsedInput(evaluator.input), rego.EvalPrintHook(evaluator.printHook))
+}
+
+func (evaluator preparedEvaluator) Partial(ctx context.Context) (*rego.PartialQueries, error) {
+	return evaluator.partialQuery.Partial(ctx, rego.EvalParsedInput(evaluator.input), rego.EvalPrintHook(evaluator.printHook))
+}
+
+func newPreparedOPAEvaluator(ctx context.Context, policy string, opaModuleConfig *OPAModuleConfig, env config.EnvironmentVariables) (*OPAEvaluator, error) {
+	query := newRegoQuery(policy, opaModuleConfig, env)
+
+	evalQuery, err := query.PrepareForEval(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed query preparation: %s", err.Error())
+	}
+	partialQuery, err := query.PrepareForPartial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed partial query preparation: %s", err.Error())
+	}
+
+	return &OPAEvaluator{
+		PolicyEvaluator: preparedEvaluator{
+			evalQuery:    evalQuery,
+			partialQuery: partialQuery,
+		},
+		PolicyName: policy,
+		Context:    ctx,
+	}, nil
+}
+
+// withInput returns a copy of the cached evaluator bound to the provided input and context,
+// logging the print statements at the provided level.
+func (evaluator *OPAEvaluator) withInput(ctx context.Context, input ast.Value, printLevel logrus.Level) *OPAEvaluator {
+	prepared := evaluator.PolicyEvaluator.(preparedEvaluator)
+	prepared.input = input
+	prepared.printHook = NewPrintHook(glogger.Get(ctx), evaluator.PolicyName, input).WithLevel(printLevel)
+	return &OPAEvaluator{
+		PolicyEvaluator: prepared,
+		PolicyName:      evaluator.PolicyName,
+		Context:         ctx,
+	}
+}
+
+// QueryEvaluatorCacheInjectorMiddleware will inject into request context the
+// query evaluator cache.
+func QueryEvaluatorCacheInjectorMiddleware(cache *QueryEvaluatorCache) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := WithQueryEvaluatorCache(r.Context(), cache)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func WithQueryEvaluatorCache(requestContext context.Context, cache *QueryEvaluatorCache) context.Context {
+	return context.WithValue(requestContext, queryEvaluatorCacheKey{}, cache)
+}
+
+// GetQueryEvaluatorCache returns the query evaluator cache from the request context,
+// if any has been set.
+func GetQueryEvaluatorCache(requestContext context.Context) (*QueryEvaluatorCache, bool) {
+	cache, ok := requestContext.Value(queryEvaluatorCacheKey{}).(*QueryEvaluatorCache)
+	return cache, ok && cache != nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/openapi"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryEvaluatorCache(t *testing.T) {
+	env := config.EnvironmentVariables{}
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		allow { input.request.method == "GET" }`,
+	}
+	log, _ := test.NewNullLogger()
+	logger := logrus.NewEntry(log)
+
+	t.Run("cached evaluator is bound to the new input", func(t *testing.T) {
+		cache := NewQueryEvaluatorCache(10)
+		ctx := WithQueryEvaluatorCache(createContext(t, context.Background(), env, nil, &openapi.RondConfig{}, opaModuleConfig, nil), cache)
+		req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+
+		evaluator, err := CreateQueryEvaluator(ctx, logger, req, env, "allow", []byte(`{"request":{"method":"GET"}}`), nil)
+		require.NoError(t, err)
+		results, err := evaluator.PolicyEvaluator.Eval(ctx)
+		require.NoError(t, err)
+		require.True(t, results.Allowed())
+		require.Equal(t, 1, cache.Len())
+
+		evaluator, err = CreateQueryEvaluator(ctx, logger, req, env, "allow", []byte(`{"request":{"method":"POST"}}`), nil)
+		require.NoError(t, err)
+		results, err = evaluator.PolicyEvaluator.Eval(ctx)
+		require.NoError(t, err)
+		require.False(t, results.Allowed())
+		require.Equal(t, 1, cache.Len())
+	})
+
+	t.Run("cached evaluator is used for partial evaluation", func(t *testing.T) {
+		cache := NewQueryEvaluatorCache(10)
+		ctx := WithQueryEvaluatorCache(createContext(t, context.Background(), env, nil, &openapi.RondConfig{}, opaModuleConfig, nil), cache)
+		req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+
+		evaluator, err := CreateQueryEvaluator(ctx, logger, req, env, "allow", []byte(`{"request":{"method":"GET"}}`), nil)
+		require.NoError(t, err)
+		partialResults, err := evaluator.PolicyEvaluator.Partial(ctx)
+		require.NoError(t, err)
+		require.Len(t, partialResults.Queries, 1)
+	})
+
+	t.Run("fails on invalid input", func(t *testing.T) {
+		cache := NewQueryEvaluatorCache(10)
+		ctx := WithQueryEvaluatorCache(createContext(t, context.Background(), env, nil, &openapi.RondConfig{}, opaModuleConfig, nil), cache)
+		req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+
+		_, err := CreateQueryEvaluator(ctx, logger, req, env, "allow", []byte(`{notajson`), nil)
+		require.Error(t, err)
+		require.Equal(t, 0, cache.Len())
+	})
+
+	t.Run("least recently used entries are evicted", func(t *testing.T) {
+		cache := NewQueryEvaluatorCache(queryEvaluatorCacheShardsCount)
+		for i := 0; i < 100; i++ {
+			cache.set(fmt.Sprintf("policy%d", i), &OPAEvaluator{})
+		}
+		require.LessOrEqual(t, cache.Len(), queryEvaluatorCacheShardsCount)
+
+		_, found := cache.get("policy99")
+		require.True(t, found)
+		_, found = cache.get("policy0")
+		require.False(t, found)
+	})
+
+	t.Run("key covers the compile options of the environment", func(t *testing.T) {
+		key := buildQueryEvaluatorCacheKey("allow", opaModuleConfig, env)
+		require.Equal(t, key, buildQueryEvaluatorCacheKey("allow", opaModuleConfig, config.EnvironmentVariables{LogLevel: config.TraceLogLevel}), "the print hook level is applied per request")
+
+		differentEnvs := map[string]config.EnvironmentVariables{
+			"print statements":  {OPALogLevel: config.OPALogLevelDebug, LogLevel: config.TraceLogLevel},
+			"verify JWT":        {EnableVerifyJWTBuiltin: true},
+			"capabilities":      {OPACapabilitiesPath: "capabilities.json"},
+			"disabled builtins": {DisabledBuiltins: "http.send"},
+		}
+		for name, differentEnv := range differentEnvs {
+			require.NotEqual(t, key, buildQueryEvaluatorCacheKey("allow", opaModuleConfig, differentEnv), name)
+		}
+	})
+
+	t.Run("evaluator compiled without print statements is not reused with them", func(t *testing.T) {
+		cache := NewQueryEvaluatorCache(10)
+		ctx := WithQueryEvaluatorCache(createContext(t, context.Background(), env, nil, &openapi.RondConfig{}, opaModuleConfig, nil), cache)
+		req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		debugEnv := config.EnvironmentVariables{OPALogLevel: config.OPALogLevelDebug, LogLevel: config.TraceLogLevel}
+
+		_, err := CreateQueryEvaluator(ctx, logger, req, env, "allow", []byte(`{"request":{"method":"GET"}}`), nil)
+		require.NoError(t, err)
+		_, err = CreateQueryEvaluator(ctx, logger, req, debugEnv, "allow", []byte(`{"request":{"method":"GET"}}`), nil)
+		require.NoError(t, err)
+		require.Equal(t, 2, cache.Len())
+	})
+
+	t.Run("cache is not found in context", func(t *testing.T) {
+		_, ok := GetQueryEvaluatorCache(context.Background())
+		require.False(t, ok)
+	})
+}
+
+func BenchmarkCreateQueryEvaluator(b *testing.B) {
+	env := config.EnvironmentVariables{}
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		allow {
+			input.request.method == "GET"
+			resource := data.resources[_]
+			resource.name == input.request.path
+		}`,
+	}
+	log, _ := test.NewNullLogger()
+	logger := logrus.NewEntry(log)
+	input := []byte(`{"request":{"method":"GET","path":"/api"}}`)
+
+	run := func(b *testing.B, ctx context.Context) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			evaluator, err := CreateQueryEvaluator(ctx, logger, req, env, "allow", input, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := evaluator.PolicyEvaluator.Partial(ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("without cache", func(b *testing.B) {
+		ctx := WithOPAModuleConfig(context.Background(), opaModuleConfig)
+		run(b, ctx)
+	})
+
+	b.Run("with cache", func(b *testing.B) {
+		ctx := WithQueryEvaluatorCache(WithOPAModuleConfig(context.Background(), opaModuleConfig), NewQueryEvaluatorCache(1000))
+		run(b, ctx)
+	})
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/openapi"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+// validateIgnoreBodyResponsePolicies rejects the routes whose response flow ignores the body
+// while their response policy returns a filtered body, which would otherwise fail each request.
+// The modules that cannot be compiled are skipped, their errors are reported by the setup
+// of the evaluators.
+func validateIgnoreBodyResponsePolicies(oas *openapi.OpenAPISpec, opaModuleConfig *OPAModuleConfig, env config.EnvironmentVariables) error {
+	compilers := map[string]*ast.Compiler{}
+	check := func(path, verb string, rondConfig *openapi.RondConfig) error {
+		if rondConfig == nil || !rondConfig.ResponseFlow.IgnoreBody || rondConfig.ResponseFlow.PolicyName == "" {
+			return nil
+		}
+		policyModule := rondConfig.Options.PolicyModule
+		compiler, compiled := compilers[policyModule]
+		if !compiled {
+			if moduleConfig, err := opaModuleConfig.ForPolicyModule(policyModule); err == nil {
+				compiler, _ = compileModules(moduleConfig, env)
+			}
+			compilers[policyModule] = compiler
+		}
+		if compiler != nil && policyReturnsBody(compiler, rondConfig.ResponseFlow.PolicyName) {
+			return fmt.Errorf("%s %s: responseFlow.ignoreBody cannot be used with policy %s, which returns a filtered body", verb, path, rondConfig.ResponseFlow.PolicyName)
+		}
+		return nil
+	}
+
+	for path, pathConfig := range oas.Paths {
+		for verb, verbConfig := range pathConfig {
+			if err := check(path, verb, verbConfig.PermissionV2); err != nil {
+				return err
+			}
+			if verbConfig.PermissionV2 == nil {
+				continue
+			}
+			for _, versionConfig := range verbConfig.PermissionV2.Versions {
+				if err := check(path, verb, versionConfig); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// policyReturnsBody reports whether some rule of the policy produces a value other than a
+// boolean, that the response flow proxies as the filtered body.
+func policyReturnsBody(compiler *ast.Compiler, policy string) bool {
+	sanitizedPolicy := strings.Replace(policy, ".", "_", -1)
+	policyRef := ast.DefaultRootRef.Append(ast.StringTerm("policies")).Append(ast.StringTerm(sanitizedPolicy))
+	for _, rule := range compiler.GetRulesExact(policyRef) {
+		if rule.Head.Key != nil {
+			return true
+		}
+		if rule.Head.Value == nil {
+			continue
+		}
+		if _, isBoolean := rule.Head.Value.Value.(ast.Boolean); !isBoolean {
+			return true
+		}
+	}
+	return false
+}
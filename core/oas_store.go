@@ -0,0 +1,238 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/openapi"
+	"github.com/rond-authz/rond/types"
+
+	"github.com/sirupsen/logrus"
+	"github.com/uptrace/bunrouter"
+)
+
+type oasSetup struct {
+	oas              *openapi.OpenAPISpec
+	oasRouter        *bunrouter.CompatRouter
+	knownPathsRouter *bunrouter.CompatRouter
+	evaluators       PartialResultsEvaluators
+}
+
+// OASStore holds the OAS together with the evaluators of its policies. They are
+// replaced atomically when the OAS is refreshed, so that each request is evaluated
+// against a consistent pair.
+type OASStore struct {
+	setup atomic.Value
+	// mtx serializes the writers, the readers load the setup without locking
+	mtx sync.Mutex
+	// preWarm holds the preWarmState of the evaluators, see PreWarm
+	preWarm atomic.Value
+}
+
+type preWarmState struct {
+	done bool
+	err  error
+}
+
+func NewOASStore(oas *openapi.OpenAPISpec, evaluators PartialResultsEvaluators) *OASStore {
+	store := &OASStore{}
+	store.Replace(oas, evaluators)
+	return store
+}
+
+// Replace stores the new OAS and evaluators.
+func (store *OASStore) Replace(oas *openapi.OpenAPISpec, evaluators PartialResultsEvaluators) {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	store.setup.Store(oasSetup{
+		oas:              oas,
+		oasRouter:        oas.PrepareOASRouter(),
+		knownPathsRouter: oas.PrepareKnownPathsRouter(),
+		evaluators:       evaluators,
+	})
+}
+
+// ReloadEvaluators stores the evaluators of the policies compiled from a new version of the
+// policies, keyed on newFingerprint, removing the evaluators of the same policies compiled
+// from the previous versions. The evaluators of the other policies are preserved. A new
+// map is stored, so that the requests in flight keep reading the previous one.
+func (store *OASStore) ReloadEvaluators(reloaded PartialResultsEvaluators, newFingerprint string) {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	setup := store.load()
+	setup.evaluators = setup.evaluators.withReloaded(reloaded, newFingerprint)
+	store.setup.Store(setup)
+}
+
+// OAS returns the current OAS.
+func (store *OASStore) OAS() *openapi.OpenAPISpec {
+	return store.load().oas
+}
+
+// KnownPath reports whether the path is defined in the current OAS for any method.
+func (store *OASStore) KnownPath(path string) bool {
+	setup := store.load()
+	return setup.oas.IsKnownPath(setup.knownPathsRouter, path)
+}
+
+// Evaluators returns the evaluators of the policies of the current OAS.
+func (store *OASStore) Evaluators() PartialResultsEvaluators {
+	return store.load().evaluators
+}
+
+// PreWarm computes the deferred partial results of the current evaluators, recording its
+// outcome for PreWarmCheck.
+func (store *OASStore) PreWarm(workers int) error {
+	evaluators := store.Evaluators()
+	err := evaluators.PreWarm(workers)
+	// evaluators replaced meanwhile by a refresh are pre-warmed by the refresher
+	if reflect.ValueOf(store.Evaluators()).Pointer() == reflect.ValueOf(evaluators).Pointer() {
+		store.preWarm.Store(preWarmState{done: true, err: err})
+	}
+	return err
+}
+
+// PreWarmCheck is the readiness check of the evaluators pre-warm, failing until the
+// pre-warm completes and if it failed.
+func (store *OASStore) PreWarmCheck(ctx context.Context) error {
+	state, _ := store.preWarm.Load().(preWarmState)
+	if !state.done {
+		return fmt.Errorf("policy evaluators pre-warm in progress")
+	}
+	return state.err
+}
+
+func (store *OASStore) load() oasSetup {
+	return store.setup.Load().(oasSetup)
+}
+
+// OASFetcher fetches the OAS, returning false if it is not modified since the last fetch.
+type OASFetcher interface {
+	Fetch() (*openapi.OpenAPISpec, bool, error)
+}
+
+// OASRefresher periodically fetches the OAS and, when it changes, sets up the evaluators
+// of its policies and replaces them in the store.
+type OASRefresher struct {
+	logger          *logrus.Entry
+	store           *OASStore
+	fetcher         OASFetcher
+	mongoClient     types.IMongoClient
+	opaModuleConfig *OPAModuleConfig
+	env             config.EnvironmentVariables
+}
+
+func NewOASRefresher(
+	logger *logrus.Entry,
+	store *OASStore,
+	fetcher OASFetcher,
+	mongoClient types.IMongoClient,
+	opaModuleConfig *OPAModuleConfig,
+	env config.EnvironmentVariables,
+) *OASRefresher {
+	return &OASRefresher{
+		logger:          logger,
+		store:           store,
+		fetcher:         fetcher,
+		mongoClient:     mongoClient,
+		opaModuleConfig: opaModuleConfig,
+		env:             env,
+	}
+}
+
+// Start refreshes the OAS every interval, until the context is done.
+func (refresher *OASRefresher) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := refresher.Refresh(ctx); err != nil {
+					refresher.logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed OAS refresh, keeping the current one")
+				}
+			}
+		}
+	}()
+}
+
+// Refresh fetches the OAS and replaces the stored one if it changed, returning whether
+// it has been replaced. When the evaluators setup fails the current OAS is kept, as well
+// as when the pre-warm of the new evaluators fails if PRE_WARM_ON_STARTUP is set.
+func (refresher *OASRefresher) Refresh(ctx context.Context) (bool, error) {
+	oas, modified, err := refresher.fetcher.Fetch()
+	if err != nil || !modified {
+		return false, err
+	}
+	currentOAS := refresher.store.OAS()
+	if reflect.DeepEqual(currentOAS, oas) {
+		return false, nil
+	}
+
+	evaluators, setupErrors, err := SetupEvaluators(ctx, refresher.mongoClient, oas, refresher.opaModuleConfig, refresher.env)
+	if err != nil && (!refresher.env.AllowPartialSetup || len(setupErrors) == 0) {
+		return false, err
+	}
+	// the refresh runs in background, so the new evaluators are pre-warmed before serving them
+	if refresher.env.PreWarmOnStartup {
+		if err := evaluators.PreWarm(EvaluatorSetupWorkers(refresher.env)); err != nil {
+			return false, err
+		}
+	}
+	refresher.store.Replace(oas, evaluators)
+	if refresher.env.PreWarmOnStartup {
+		refresher.store.preWarm.Store(preWarmState{done: true})
+	}
+	oas.LogPathConflicts(refresher.logger)
+
+	addedRoutes, removedRoutes := diffRoutes(currentOAS.Routes(), oas.Routes())
+	refresher.logger.WithFields(logrus.Fields{
+		"addedRoutes":     addedRoutes,
+		"removedRoutes":   removedRoutes,
+		"policiesLength":  len(evaluators),
+		"setupErrorCount": len(setupErrors),
+	}).Info("OAS refreshed")
+	return true, nil
+}
+
+func diffRoutes(currentRoutes, newRoutes []string) ([]string, []string) {
+	current := make(map[string]bool, len(currentRoutes))
+	for _, route := range currentRoutes {
+		current[route] = true
+	}
+	added := []string{}
+	for _, route := range newRoutes {
+		if !current[route] {
+			added = append(added, route)
+		}
+		delete(current, route)
+	}
+	removed := []string{}
+	for _, route := range currentRoutes {
+		if current[route] {
+			removed = append(removed, route)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,284 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/openapi"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOASRefresher(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow_users { true }
+allow_projects { true }`,
+	}
+	oasV1 := `{"paths":{"/users":{"get":{"x-rond":{"requestFlow":{"policyName":"allow_users"}}}}}}`
+	oasV2 := `{"paths":{"/projects":{"get":{"x-rond":{"requestFlow":{"policyName":"allow_projects"}}}}}}`
+
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if r.Header.Get("If-None-Match") == `"v2"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if fetches == 1 {
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(oasV1))
+			return
+		}
+		w.Header().Set("ETag", `"v2"`)
+		w.Write([]byte(oasV2))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	env := config.EnvironmentVariables{
+		TargetServiceHost:    serverURL.Host,
+		TargetServiceOASPath: "/documentation/json",
+	}
+	fetcher := openapi.NewOASFetcher(env)
+	oas, modified, err := fetcher.Fetch()
+	require.NoError(t, err)
+	require.True(t, modified)
+
+	log, hook := test.NewNullLogger()
+	ctx := context.Background()
+	evaluators, _, err := SetupEvaluators(ctx, nil, oas, opaModule, env)
+	require.NoError(t, err)
+	store := NewOASStore(oas, evaluators)
+	refresher := NewOASRefresher(logrus.NewEntry(log), store, fetcher, nil, opaModule, env)
+
+	middleware := OPAMiddlewareWithOASStore(opaModule, store, &env, nil)
+	serve := func(path string) (int, PartialResultsEvaluators) {
+		var requestEvaluators PartialResultsEvaluators
+		handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestEvaluators, err = GetPartialResultsEvaluators(r.Context())
+			require.NoError(t, err)
+		}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Result().StatusCode, requestEvaluators
+	}
+
+	status, requestEvaluators := serve("/users")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, requestEvaluators, EvaluatorKey{PolicyName: "allow_users"})
+	status, _ = serve("/projects")
+	require.Equal(t, http.StatusNotFound, status)
+
+	t.Run("replaces the OAS and the evaluators when changed", func(t *testing.T) {
+		refreshed, err := refresher.Refresh(ctx)
+		require.NoError(t, err)
+		require.True(t, refreshed)
+		require.Contains(t, store.Evaluators(), EvaluatorKey{PolicyName: "allow_projects"})
+		require.NotContains(t, store.Evaluators(), EvaluatorKey{PolicyName: "allow_users"})
+
+		status, requestEvaluators := serve("/projects")
+		require.Equal(t, http.StatusOK, status)
+		require.Contains(t, requestEvaluators, EvaluatorKey{PolicyName: "allow_projects"})
+		status, _ = serve("/users")
+		require.Equal(t, http.StatusNotFound, status)
+
+		entry := hook.LastEntry()
+		require.Equal(t, "OAS refreshed", entry.Message)
+		require.Equal(t, []string{"GET /projects"}, entry.Data["addedRoutes"])
+		require.Equal(t, []string{"GET /users"}, entry.Data["removedRoutes"])
+	})
+
+	t.Run("keeps the OAS when not modified", func(t *testing.T) {
+		refreshed, err := refresher.Refresh(ctx)
+		require.NoError(t, err)
+		require.False(t, refreshed)
+		require.Equal(t, 3, fetches)
+		require.Contains(t, store.Evaluators(), EvaluatorKey{PolicyName: "allow_projects"})
+	})
+}
+
+func TestOASRefresherKeepsCurrentOASOnFailure(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow_users { true }`,
+	}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users": openapi.PathVerbs{
+				"get": openapi.VerbConfig{PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow_users"}}},
+			},
+		},
+	}
+	env := config.EnvironmentVariables{}
+	evaluators, _, err := SetupEvaluators(context.Background(), nil, oas, opaModule, env)
+	require.NoError(t, err)
+	store := NewOASStore(oas, evaluators)
+
+	t.Run("same OAS", func(t *testing.T) {
+		fetcher := &mockOASFetcher{oas: oas}
+		refreshed, err := NewOASRefresher(logrus.NewEntry(logrus.New()), store, fetcher, nil, opaModule, env).Refresh(context.Background())
+		require.NoError(t, err)
+		require.False(t, refreshed)
+	})
+
+	t.Run("fetch failure", func(t *testing.T) {
+		fetcher := &mockOASFetcher{err: fmt.Errorf("fetch failed")}
+		refreshed, err := NewOASRefresher(logrus.NewEntry(logrus.New()), store, fetcher, nil, opaModule, env).Refresh(context.Background())
+		require.EqualError(t, err, "fetch failed")
+		require.False(t, refreshed)
+		require.Equal(t, oas, store.OAS())
+	})
+
+	t.Run("evaluators setup failure", func(t *testing.T) {
+		fetcher := &mockOASFetcher{oas: &openapi.OpenAPISpec{
+			Paths: openapi.OpenAPIPaths{
+				"/users": openapi.PathVerbs{
+					"get": openapi.VerbConfig{PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "invalid policy!"}}},
+				},
+			},
+		}}
+		refreshed, err := NewOASRefresher(logrus.NewEntry(logrus.New()), store, fetcher, nil, opaModule, env).Refresh(context.Background())
+		require.Error(t, err)
+		require.False(t, refreshed)
+		require.Equal(t, oas, store.OAS())
+		require.Contains(t, store.Evaluators(), EvaluatorKey{PolicyName: "allow_users"})
+	})
+
+	t.Run("evaluators pre-warm failure", func(t *testing.T) {
+		preWarmEnv := config.EnvironmentVariables{PreWarmOnStartup: true}
+		fetcher := &mockOASFetcher{oas: &openapi.OpenAPISpec{
+			Paths: openapi.OpenAPIPaths{
+				"/users": openapi.PathVerbs{
+					"get": openapi.VerbConfig{PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "invalid policy!"}}},
+				},
+			},
+		}}
+		refreshed, err := NewOASRefresher(logrus.NewEntry(logrus.New()), store, fetcher, nil, opaModule, preWarmEnv).Refresh(context.Background())
+		require.ErrorContains(t, err, "error during evaluator creation: policy invalid policy!:")
+		require.False(t, refreshed)
+		require.Equal(t, oas, store.OAS())
+		require.Contains(t, store.Evaluators(), EvaluatorKey{PolicyName: "allow_users"})
+	})
+}
+
+func TestOASStorePreWarmCheck(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow_users { true }`,
+	}
+	setupStore := func(t *testing.T, policyName string) *OASStore {
+		t.Helper()
+		oas := &openapi.OpenAPISpec{
+			Paths: openapi.OpenAPIPaths{
+				"/users": openapi.PathVerbs{
+					"get": openapi.VerbConfig{PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: policyName}}},
+				},
+			},
+		}
+		evaluators, _, err := SetupEvaluators(context.Background(), nil, oas, opaModule, config.EnvironmentVariables{PreWarmOnStartup: true})
+		require.NoError(t, err)
+		return NewOASStore(oas, evaluators)
+	}
+
+	t.Run("fails until the evaluators are pre-warmed", func(t *testing.T) {
+		store := setupStore(t, "allow_users")
+		require.EqualError(t, store.PreWarmCheck(context.Background()), "policy evaluators pre-warm in progress")
+
+		require.NoError(t, store.PreWarm(1))
+		require.NoError(t, store.PreWarmCheck(context.Background()))
+	})
+
+	t.Run("reports the pre-warm failure", func(t *testing.T) {
+		store := setupStore(t, "invalid policy!")
+		require.Error(t, store.PreWarm(1))
+		require.ErrorContains(t, store.PreWarmCheck(context.Background()), "error during evaluator creation: policy invalid policy!:")
+	})
+}
+
+func TestOASStoreReloadEvaluators(t *testing.T) {
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users": openapi.PathVerbs{
+				"get": openapi.VerbConfig{PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow"}}},
+			},
+		},
+	}
+	loadEvaluators := func(t *testing.T, content, fingerprint string) (*OPAModuleConfig, PartialResultsEvaluators) {
+		t.Helper()
+		opaModuleConfig := &OPAModuleConfig{Name: "policies.rego", Content: content, Fingerprint: fingerprint}
+		evaluators, _, err := SetupEvaluators(context.Background(), nil, oas, opaModuleConfig, config.EnvironmentVariables{})
+		require.NoError(t, err)
+		return opaModuleConfig, evaluators
+	}
+	allowed := func(t *testing.T, evaluators PartialResultsEvaluators, opaModuleConfig *OPAModuleConfig) bool {
+		t.Helper()
+		ctx := WithOPAModuleConfig(context.Background(), opaModuleConfig)
+		evaluator, err := evaluators.GetEvaluatorFromPolicy(ctx, RequestEvaluatorKey(ctx, "", "allow"), []byte(`{}`), config.EnvironmentVariables{})
+		require.NoError(t, err)
+		results, err := evaluator.PolicyEvaluator.Eval(ctx)
+		require.NoError(t, err)
+		return isAllowedResult(results)
+	}
+
+	previousModuleConfig, evaluators := loadEvaluators(t, "package policies\nallow { false }", "v1")
+	unchangedKey := EvaluatorKey{PolicyName: "team.rego:allow", ModuleFingerprint: "v1"}
+	evaluators[unchangedKey] = PartialEvaluator{}
+	store := NewOASStore(oas, evaluators)
+	require.False(t, allowed(t, store.Evaluators(), previousModuleConfig))
+
+	inFlightEvaluators := store.Evaluators()
+	reloadedModuleConfig, reloadedEvaluators := loadEvaluators(t, "package policies\nallow { true }", "v2")
+	store.ReloadEvaluators(reloadedEvaluators, "v2")
+
+	require.Len(t, store.Evaluators(), 2)
+	require.NotContains(t, store.Evaluators(), EvaluatorKey{PolicyName: "allow", ModuleFingerprint: "v1"})
+	require.Contains(t, store.Evaluators(), EvaluatorKey{PolicyName: "allow", ModuleFingerprint: "v2"})
+	require.Contains(t, store.Evaluators(), unchangedKey)
+	require.True(t, allowed(t, store.Evaluators(), reloadedModuleConfig))
+	require.Equal(t, oas, store.OAS())
+
+	_, err := store.Evaluators().GetEvaluatorFromPolicy(context.Background(), EvaluatorKey{PolicyName: "allow", ModuleFingerprint: "v1"}, []byte(`{}`), config.EnvironmentVariables{})
+	require.EqualError(t, err, "policy evaluator not found")
+
+	// the requests in flight keep evaluating the previous policies
+	require.Len(t, inFlightEvaluators, 2)
+	require.False(t, allowed(t, inFlightEvaluators, previousModuleConfig))
+}
+
+type mockOASFetcher struct {
+	oas *openapi.OpenAPISpec
+	err error
+}
+
+func (f *mockOASFetcher) Fetch() (*openapi.OpenAPISpec, bool, error) {
+	if f.err != nil {
+		return nil, false, f.err
+	}
+	return f.oas, true, nil
+}
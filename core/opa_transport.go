@@ -16,12 +16,18 @@ package core
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
 	"strconv"
+	"strings"
 
 	"github.com/rond-authz/rond/internal/config"
 	"github.com/rond-authz/rond/internal/mongoclient"
@@ -29,12 +35,14 @@ import (
 	"github.com/rond-authz/rond/openapi"
 	"github.com/rond-authz/rond/types"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
 type OPATransport struct {
 	http.RoundTripper
-	// FIXME: this overlaps with the req.Context used during RoundTrip.
+	// context is the context of the client request: the request forwarded to the
+	// target service is bound to it, so that its deadline and cancellation are respected.
 	context                  context.Context
 	logger                   *logrus.Entry
 	request                  *http.Request
@@ -53,7 +61,7 @@ func NewOPATransport(
 	env config.EnvironmentVariables,
 ) *OPATransport {
 	return &OPATransport{
-		http.DefaultTransport,
+		defaultTransport,
 		req.Context(),
 		logger,
 		req,
@@ -67,16 +75,97 @@ func is2XX(statusCode int) bool {
 	return statusCode >= http.StatusOK && statusCode < http.StatusMultipleChoices
 }
 
+// RoundTrip forwards the request and evaluates the response policy. A panic is recovered
+// into a 500 response, since the reverse proxy would otherwise abort the client connection.
+// The request id is forwarded to the target service and echoed in the response.
 func (t *OPATransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	resp, err = t.RoundTripper.RoundTrip(req)
+	req, requestID := withRequestIDHeader(t.env, req)
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			resp, err = t.recoverRoundTrip(req, recovered), nil
+		}
+		setResponseRequestID(t.env, resp, requestID)
+	}()
+	return t.roundTrip(req)
+}
+
+func (t *OPATransport) recoverRoundTrip(req *http.Request, recovered interface{}) *http.Response {
+	if m, routeLabels, ok := routeMetrics(t.context); ok {
+		m.Panics.With(prometheus.Labels{"http_route": routeLabels["http_route"]}).Inc()
+	}
+	t.logger.WithFields(logrus.Fields{
+		"error": logrus.Fields{"message": fmt.Sprint(recovered)},
+		"stack": string(debug.Stack()),
+	}).Error("panic while evaluating response")
+
+	resp := &http.Response{Request: req, Header: http.Header{}}
+	t.responseWithError(resp, fmt.Errorf("response evaluation panicked"), http.StatusInternalServerError)
+	return resp
+}
+
+func (t *OPATransport) roundTrip(req *http.Request) (resp *http.Response, err error) {
+	if m, routeLabels, ok := routeMetrics(t.context); ok {
+		inflightRequests := m.ProxyInflightRequests.With(routeLabels)
+		inflightRequests.Inc()
+		defer inflightRequests.Dec()
+	}
+
+	// the body is consumed when the request is forwarded, so it is buffered to be
+	// provided to the response policy as well.
+	requestBody, err := bufferRequestBody(req)
 	if err != nil {
 		return nil, err
 	}
 
+	if t.context != nil {
+		req = req.WithContext(t.context)
+	}
+	resp, err = roundTripWithRetry(t.logger, t.env, t.RoundTripper, req)
+	if err != nil {
+		if errors.Is(err, context.Canceled) && utils.IsClientClosedRequest(req.Context()) {
+			utils.LogClientClosedRequest(t.logger, err)
+			resp = &http.Response{Request: req, Header: http.Header{}, StatusCode: utils.StatusClientClosedRequest, Body: http.NoBody}
+			return resp, nil
+		}
+		var circuitOpenError *CircuitOpenError
+		if errors.As(err, &circuitOpenError) {
+			resp = &http.Response{Request: req, Header: http.Header{}}
+			resp.Header.Set("Retry-After", circuitOpenError.RetryAfterSeconds())
+			t.responseWithError(resp, err, http.StatusServiceUnavailable)
+			return resp, nil
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			resp = &http.Response{Request: req, Header: http.Header{}}
+			t.responseWithError(resp, fmt.Errorf("target service request interrupted: %w", err), http.StatusGatewayTimeout)
+			return resp, nil
+		}
+		return nil, err
+	}
+
 	if !is2XX(resp.StatusCode) {
 		return resp, nil
 	}
 
+	// the request policy has already allowed the request, there is no response policy to evaluate.
+	if t.permission != nil && t.permission.ResponseFlow.PolicyName == "" {
+		// the body is passed through untouched, unless only JSON responses are allowed.
+		if !t.env.PassThroughNonJSON && resp.ContentLength != 0 && !hasJSONContentType(resp.Header) {
+			t.logger.WithField("foundContentType", resp.Header.Get(utils.ContentTypeHeaderKey)).Debug("found content type")
+			t.responseWithError(resp, fmt.Errorf("content-type is not application/json"), http.StatusInternalServerError)
+			return resp, nil
+		}
+		t.setPolicyResponseHeader(resp)
+		return resp, nil
+	}
+
+	policyMode := config.PolicyModeEnforce
+	if t.permission != nil {
+		policyMode = t.permission.Options.PolicyMode(t.env.DefaultPolicyMode)
+	}
+	if policyMode == config.PolicyModeOff {
+		return resp, nil
+	}
+
 	b, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
@@ -85,56 +174,237 @@ func (t *OPATransport) RoundTrip(req *http.Request) (resp *http.Response, err er
 		return nil, err
 	}
 
+	if policyMode == config.PolicyModeLogOnly {
+		resp.Body = io.NopCloser(bytes.NewReader(b))
+		t.evaluateResponseInLogOnlyMode(resp, requestBody, b)
+		return resp, nil
+	}
+
+	if t.permission != nil && t.permission.ResponseFlow.IgnoreBody {
+		resp.Body = io.NopCloser(bytes.NewReader(b))
+		bodyToProxy, ok := t.evaluateResponsePolicy(resp, requestBody, nil)
+		if ok && bodyToProxy != nil {
+			t.responseWithError(resp, fmt.Errorf("response policy returned a body while response body is ignored"), http.StatusInternalServerError)
+			return resp, nil
+		}
+		if ok {
+			t.setPolicyResponseHeader(resp)
+		}
+		return resp, nil
+	}
+
 	if len(b) == 0 {
 		return resp, nil
 	}
 
-	if !utils.HasApplicationJSONContentType(resp.Header) {
+	ndjson := utils.HasNDJSONContentType(resp.Header)
+	if !hasJSONContentType(resp.Header) {
 		t.logger.WithField("foundContentType", resp.Header.Get(utils.ContentTypeHeaderKey)).Debug("found content type")
 		t.responseWithError(resp, fmt.Errorf("content-type is not application/json"), http.StatusInternalServerError)
 		return resp, nil
 	}
 
-	var decodedBody interface{}
-	if err := json.Unmarshal(b, &decodedBody); err != nil {
-		return nil, fmt.Errorf("response body is not valid: %s", err.Error())
+	gzipEncoded := isGzipEncoded(resp.Header)
+	if gzipEncoded {
+		if b, err = gunzip(b); err != nil {
+			return nil, fmt.Errorf("failed response body decompression: %s", err.Error())
+		}
+	}
+
+	var marshalledBody []byte
+	if ndjson {
+		var ok bool
+		if marshalledBody, ok = t.filterNDJSONBody(resp, requestBody, b); !ok {
+			return resp, nil
+		}
+	} else {
+		var decodedBody interface{}
+		if err := json.Unmarshal(b, &decodedBody); err != nil {
+			return nil, fmt.Errorf("response body is not valid: %s", err.Error())
+		}
+
+		bodyToProxy, ok := t.evaluateResponsePolicy(resp, requestBody, decodedBody)
+		if !ok {
+			return resp, nil
+		}
+
+		if marshalledBody, err = json.Marshal(bodyToProxy); err != nil {
+			t.responseWithError(resp, err, http.StatusInternalServerError)
+			return resp, nil
+		}
+	}
+	if gzipEncoded {
+		if t.request != nil && acceptsGzip(t.request.Header) {
+			if marshalledBody, err = gzipBody(marshalledBody); err != nil {
+				t.responseWithError(resp, err, http.StatusInternalServerError)
+				return resp, nil
+			}
+		} else {
+			resp.Header.Del(contentEncodingHeaderKey)
+		}
 	}
+	overwriteResponse(resp, marshalledBody)
+	t.setPolicyResponseHeader(resp)
+	return resp, nil
+}
 
+// setPolicyResponseHeader reports the name of the evaluated policy in the response, using
+// the request policy name when the route has no response policy.
+func (t *OPATransport) setPolicyResponseHeader(resp *http.Response) {
+	if t.env.PolicyResponseHeader == "" || t.permission == nil {
+		return
+	}
+	policyName := t.permission.ResponseFlow.PolicyName
+	if policyName == "" {
+		policyName = t.permission.RequestFlow.PolicyName
+	}
+	if policyName == "" {
+		return
+	}
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	resp.Header.Set(t.env.PolicyResponseHeader, policyName)
+}
+
+// evaluateResponsePolicy runs the response policy against the provided body and returns
+// the body to proxy. When the evaluation fails, resp is overwritten with the error
+// and false is returned.
+func (t *OPATransport) evaluateResponsePolicy(resp *http.Response, requestBody []byte, responseBody interface{}) (interface{}, bool) {
 	userInfo, err := mongoclient.RetrieveUserBindingsAndRoles(t.logger, t.request, t.env)
 	if err != nil {
 		t.responseWithError(resp, err, http.StatusInternalServerError)
-		return resp, nil
+		return nil, false
 	}
+	return t.evaluateResponsePolicyForUser(resp, requestBody, responseBody, userInfo)
+}
 
-	input, err := CreateRegoQueryInput(t.request, t.env, t.permission.Options.EnableResourcePermissionsMapOptimization, userInfo, decodedBody)
+// filterNDJSONBody applies the response policy to each object of the newline-delimited
+// JSON body independently, joining the filtered objects back as NDJSON. Objects filtered
+// to an empty object are omitted, while lines that are not valid JSON are proxied as is.
+func (t *OPATransport) filterNDJSONBody(resp *http.Response, requestBody, body []byte) ([]byte, bool) {
+	userInfo, err := mongoclient.RetrieveUserBindingsAndRoles(t.logger, t.request, t.env)
 	if err != nil {
 		t.responseWithError(resp, err, http.StatusInternalServerError)
-		return resp, nil
+		return nil, false
 	}
 
-	evaluator, err := t.partialResultsEvaluators.GetEvaluatorFromPolicy(t.context, t.permission.ResponseFlow.PolicyName, input, t.env)
+	var filteredBody bytes.Buffer
+	for lineNumber, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var decodedLine interface{}
+		if err := json.Unmarshal(line, &decodedLine); err != nil {
+			t.logger.WithFields(logrus.Fields{
+				"error": logrus.Fields{"message": err.Error()},
+				"line":  lineNumber + 1,
+			}).Warn("invalid NDJSON line proxied without filtering")
+			filteredBody.Write(line)
+			filteredBody.WriteByte('\n')
+			continue
+		}
+
+		filteredLine, ok := t.evaluateResponsePolicyForUser(resp, requestBody, decodedLine, userInfo)
+		if !ok {
+			return nil, false
+		}
+		if object, isObject := filteredLine.(map[string]interface{}); isObject && len(object) == 0 {
+			continue
+		}
+		marshalledLine, err := json.Marshal(filteredLine)
+		if err != nil {
+			t.responseWithError(resp, err, http.StatusInternalServerError)
+			return nil, false
+		}
+		filteredBody.Write(marshalledLine)
+		filteredBody.WriteByte('\n')
+	}
+	return filteredBody.Bytes(), true
+}
+
+func (t *OPATransport) evaluateResponsePolicyForUser(resp *http.Response, requestBody []byte, responseBody interface{}, userInfo types.User) (interface{}, bool) {
+	evaluatorKey := RequestEvaluatorKey(t.context, t.permission.Options.PolicyModule, t.permission.ResponseFlow.PolicyName)
+	regoInput, err := buildRegoQueryInput(t.request, t.env, t.partialResultsEvaluators.NeedsResourcePermissionsMap(evaluatorKey, t.permission.Options, t.env), userInfo, requestBody, responseBody)
+	if err != nil {
+		t.responseWithError(resp, err, http.StatusInternalServerError)
+		return nil, false
+	}
+	regoInput.Response.StatusCode = resp.StatusCode
+
+	cache := GetResponseBodyCache(t.context)
+	var cacheKey [sha256.Size]byte
+	if cache != nil {
+		if cacheKey, err = buildResponseBodyCacheKey(evaluatorKey, *regoInput, t.env.RequestIDHeaderKey); err != nil {
+			t.logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response body cache key creation")
+			cache = nil
+		} else if bodyToProxy, found := cache.get(cacheKey); found {
+			t.logger.WithField("policyName", t.permission.ResponseFlow.PolicyName).Debug("response policy result found in cache")
+			return bodyToProxy, true
+		}
+	}
+
+	input, err := regoInput.astValue()
+	if err != nil {
+		t.responseWithError(resp, err, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	evaluator, err := t.partialResultsEvaluators.GetEvaluatorFromPolicyWithParsedInput(t.context, evaluatorKey, input, t.env)
 	if err != nil {
 		t.logger.WithField("error", logrus.Fields{
 			"policyName": t.permission.ResponseFlow.PolicyName,
 			"message":    err.Error(),
 		}).Error("RBAC policy evaluation on response failed")
 		t.responseWithError(resp, err, http.StatusInternalServerError)
-		return resp, nil
+		return nil, false
 	}
 
 	bodyToProxy, err := evaluator.Evaluate(t.logger)
 	if err != nil {
 		t.responseWithError(resp, err, http.StatusForbidden)
-		return resp, nil
+		return nil, false
 	}
+	cache.set(cacheKey, bodyToProxy)
+	return bodyToProxy, true
+}
 
-	marshalledBody, err := json.Marshal(bodyToProxy)
-	if err != nil {
-		t.responseWithError(resp, err, http.StatusInternalServerError)
-		return resp, nil
+// evaluateResponseInLogOnlyMode runs the response policy only to record its decision,
+// leaving the original response untouched.
+func (t *OPATransport) evaluateResponseInLogOnlyMode(resp *http.Response, requestBody, body []byte) {
+	var decodedBody interface{}
+	if !t.permission.ResponseFlow.IgnoreBody {
+		if len(body) == 0 {
+			return
+		}
+		if !utils.HasApplicationJSONContentType(resp.Header) {
+			t.logger.WithField("foundContentType", resp.Header.Get(utils.ContentTypeHeaderKey)).Warn("content-type is not application/json")
+			RecordLogOnlyDecision(t.context, t.logger, t.permission.ResponseFlow.PolicyName, false)
+			return
+		}
+		if isGzipEncoded(resp.Header) {
+			var err error
+			if body, err = gunzip(body); err != nil {
+				t.logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response body decompression")
+				RecordLogOnlyDecision(t.context, t.logger, t.permission.ResponseFlow.PolicyName, false)
+				return
+			}
+		}
+		if err := json.Unmarshal(body, &decodedBody); err != nil {
+			t.logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("response body is not valid")
+			RecordLogOnlyDecision(t.context, t.logger, t.permission.ResponseFlow.PolicyName, false)
+			return
+		}
 	}
-	overwriteResponse(resp, marshalledBody)
-	return resp, nil
+
+	shadowResponse := &http.Response{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+	}
+	_, allowed := t.evaluateResponsePolicy(shadowResponse, requestBody, decodedBody)
+	RecordLogOnlyDecision(t.context, t.logger, t.permission.ResponseFlow.PolicyName, allowed)
 }
 
 func (t *OPATransport) responseWithError(resp *http.Response, err error, statusCode int) {
@@ -143,12 +413,14 @@ func (t *OPATransport) responseWithError(resp *http.Response, err error, statusC
 	if statusCode != http.StatusForbidden {
 		message = utils.GENERIC_BUSINESS_ERROR_MESSAGE
 	}
-	content, _ := json.Marshal(types.RequestError{
-		StatusCode: statusCode,
-		Message:    message,
-		Error:      err.Error(),
-	})
-	overwriteResponseWithStatusCode(resp, content, statusCode)
+	errorResponse := httptest.NewRecorder()
+	utils.FailResponseWithCode(errorResponse, statusCode, err.Error(), message)
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	resp.Header.Set(utils.ContentTypeHeaderKey, errorResponse.Header().Get(utils.ContentTypeHeaderKey))
+	resp.Header.Del(contentEncodingHeaderKey)
+	overwriteResponseWithStatusCode(resp, errorResponse.Body.Bytes(), statusCode)
 }
 
 func overwriteResponseWithStatusCode(originalResponse *http.Response, newBody []byte, statusCode int) {
@@ -162,3 +434,54 @@ func overwriteResponse(originalResponse *http.Response, newBody []byte) {
 	originalResponse.ContentLength = int64(len(newBody))
 	originalResponse.Header.Set("Content-Length", strconv.Itoa(len(newBody)))
 }
+
+const contentEncodingHeaderKey = "Content-Encoding"
+
+// hasJSONContentType reports whether the response body is JSON or newline delimited JSON.
+func hasJSONContentType(headers http.Header) bool {
+	return utils.HasApplicationJSONContentType(headers) || utils.HasNDJSONContentType(headers)
+}
+
+func isGzipEncoded(headers http.Header) bool {
+	return strings.EqualFold(strings.TrimSpace(headers.Get(contentEncodingHeaderKey)), "gzip")
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows a gzip encoded response.
+func acceptsGzip(headers http.Header) bool {
+	for _, header := range headers.Values("Accept-Encoding") {
+		for _, encoding := range strings.Split(header, ",") {
+			coding, params, _ := strings.Cut(encoding, ";")
+			if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+				continue
+			}
+			name, value, _ := strings.Cut(params, "=")
+			if strings.EqualFold(strings.TrimSpace(name), "q") {
+				quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				return err == nil && quality > 0
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func gunzip(body []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func gzipBody(body []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
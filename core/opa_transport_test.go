@@ -16,6 +16,7 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -23,9 +24,14 @@ import (
 	"net/http/httptest"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/metrics"
 	"github.com/rond-authz/rond/internal/mocks"
 	"github.com/rond-authz/rond/internal/mongoclient"
 	"github.com/rond-authz/rond/internal/utils"
@@ -145,6 +151,33 @@ func TestOPATransportResponseWithError(t *testing.T) {
 		require.Equal(t, string(expectedBytes), string(bodyBytes))
 		require.Equal(t, strconv.Itoa(len(expectedBytes)), resp.Header.Get("content-length"))
 	})
+
+	t.Run("problem-json error format", func(t *testing.T) {
+		utils.SetErrorRenderer(utils.ProblemJSONErrorRenderer{})
+		t.Cleanup(func() { utils.SetErrorRenderer(utils.RondErrorRenderer{}) })
+
+		resp := &http.Response{
+			Body:          nil,
+			ContentLength: 0,
+			Header:        http.Header{},
+		}
+
+		transport.responseWithError(resp, fmt.Errorf("some error"), http.StatusForbidden)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		require.Equal(t, utils.ProblemJSONContentTypeHeader, resp.Header.Get(utils.ContentTypeHeaderKey))
+
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.Nil(t, err)
+		expectedBytes, err := json.Marshal(utils.ProblemDetails{
+			Type:   "about:blank",
+			Title:  http.StatusText(http.StatusForbidden),
+			Status: http.StatusForbidden,
+			Detail: utils.NO_PERMISSIONS_ERROR_MESSAGE,
+			Error:  "some error",
+		})
+		require.Nil(t, err)
+		require.Equal(t, string(expectedBytes), string(bodyBytes))
+	})
 }
 
 func TestOPATransportRoundTrip(t *testing.T) {
@@ -365,7 +398,7 @@ func TestOPATransportRoundTrip(t *testing.T) {
 			&openapi.RondConfig{
 				ResponseFlow: openapi.ResponseFlow{PolicyName: "my_policy"},
 			},
-			PartialResultsEvaluators{"my_policy": {}},
+			PartialResultsEvaluators{{PolicyName: "my_policy"}: {}},
 			envs,
 		}
 		resp, err := transport.RoundTrip(req)
@@ -377,12 +410,639 @@ func TestOPATransportRoundTrip(t *testing.T) {
 	})
 }
 
+func TestOPATransportRoundTripContextInterruption(t *testing.T) {
+	envs := config.EnvironmentVariables{}
+	logger, _ := test.NewNullLogger()
+
+	requestReceived := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestReceived <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	assertGatewayTimeout := func(t *testing.T, resp *http.Response, expectedError string) {
+		t.Helper()
+		require.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+
+		var requestError types.RequestError
+		err := json.NewDecoder(resp.Body).Decode(&requestError)
+		require.NoError(t, err)
+		require.Contains(t, requestError.Error, expectedError)
+		require.Equal(t, utils.GENERIC_BUSINESS_ERROR_MESSAGE, requestError.Message)
+	}
+
+	t.Run("responds 499 if the client cancels the request mid-flight", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req := httptest.NewRequest(http.MethodGet, server.URL, nil).WithContext(ctx)
+		transport := &OPATransport{
+			http.DefaultTransport,
+			req.Context(),
+			logrus.NewEntry(logger),
+			req,
+			nil,
+			nil,
+			envs,
+		}
+
+		go func() {
+			<-requestReceived
+			cancel()
+		}()
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, utils.StatusClientClosedRequest, resp.StatusCode)
+	})
+
+	t.Run("responds 504 if the context deadline is exceeded", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req := httptest.NewRequest(http.MethodGet, server.URL, nil).WithContext(ctx)
+		transport := &OPATransport{
+			http.DefaultTransport,
+			req.Context(),
+			logrus.NewEntry(logger),
+			req,
+			nil,
+			nil,
+			envs,
+		}
+
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		assertGatewayTimeout(t, resp, context.DeadlineExceeded.Error())
+	})
+
+	t.Run("forwards the request with the transport context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		clientReq := httptest.NewRequest(http.MethodGet, server.URL, nil).WithContext(ctx)
+		transport := &OPATransport{
+			http.DefaultTransport,
+			clientReq.Context(),
+			logrus.NewEntry(logger),
+			clientReq,
+			nil,
+			nil,
+			envs,
+		}
+
+		outgoingReq := httptest.NewRequest(http.MethodGet, server.URL, nil)
+		resp, err := transport.RoundTrip(outgoingReq)
+		require.NoError(t, err)
+		require.Equal(t, utils.StatusClientClosedRequest, resp.StatusCode)
+	})
+}
+
+func TestOPATransportRoundTripIgnoringBody(t *testing.T) {
+	envs := config.EnvironmentVariables{}
+	logger, _ := test.NewNullLogger()
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		allow_csv { input.request.method == "GET" }
+		deny_csv { false }
+		filter_csv [body] { body := {"filtered": true} }`,
+	}
+
+	partialEvaluators := PartialResultsEvaluators{}
+	for _, policy := range []string{"allow_csv", "deny_csv", "filter_csv"} {
+		partialEvaluator, err := createPartialEvaluator(policy, context.Background(), nil, nil, opaModuleConfig, envs)
+		require.NoError(t, err)
+		partialEvaluators[EvaluatorKey{PolicyName: policy}] = *partialEvaluator
+	}
+
+	roundTrip := func(t *testing.T, policy string) *http.Response {
+		t.Helper()
+
+		permission := &openapi.RondConfig{
+			ResponseFlow: openapi.ResponseFlow{PolicyName: policy, IgnoreBody: true},
+		}
+		ctx := createContext(t, context.Background(), envs, nil, permission, opaModuleConfig, partialEvaluators)
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil).WithContext(ctx)
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Body:          io.NopCloser(bytes.NewReader([]byte("a,b\n1,2\n"))),
+			ContentLength: 8,
+			Header:        http.Header{"Content-Type": []string{"text/csv"}},
+		}
+		transport := &OPATransport{
+			&MockRoundTrip{Response: resp},
+			ctx,
+			logrus.NewEntry(logger),
+			req,
+			permission,
+			partialEvaluators,
+			envs,
+		}
+
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("proxies the original body when policy allows", func(t *testing.T) {
+		resp := roundTrip(t, "allow_csv")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "a,b\n1,2\n", string(bodyBytes))
+		require.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+	})
+
+	t.Run("forbidden when policy denies", func(t *testing.T) {
+		resp := roundTrip(t, "deny_csv")
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("failure when policy returns a body", func(t *testing.T) {
+		resp := roundTrip(t, "filter_csv")
+		require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(bodyBytes), "response policy returned a body while response body is ignored")
+	})
+}
+
+func TestOPATransportRoundTripResponseStatusCode(t *testing.T) {
+	envs := config.EnvironmentVariables{}
+	logger, _ := test.NewNullLogger()
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		cache_allowed { input.response.statusCode == 200 }`,
+	}
+
+	partialEvaluator, err := createPartialEvaluator("cache_allowed", context.Background(), nil, nil, opaModuleConfig, envs)
+	require.NoError(t, err)
+	partialEvaluators := PartialResultsEvaluators{{PolicyName: "cache_allowed"}: *partialEvaluator}
+
+	roundTrip := func(t *testing.T, statusCode int) *http.Response {
+		t.Helper()
+
+		permission := &openapi.RondConfig{
+			ResponseFlow: openapi.ResponseFlow{PolicyName: "cache_allowed", IgnoreBody: true},
+		}
+		ctx := createContext(t, context.Background(), envs, nil, permission, opaModuleConfig, partialEvaluators)
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil).WithContext(ctx)
+		resp := &http.Response{
+			StatusCode:    statusCode,
+			Body:          io.NopCloser(bytes.NewReader([]byte(`{"hey":"there"}`))),
+			ContentLength: 15,
+			Header:        http.Header{"Content-Type": []string{"application/json"}},
+		}
+		transport := &OPATransport{
+			&MockRoundTrip{Response: resp},
+			ctx,
+			logrus.NewEntry(logger),
+			req,
+			permission,
+			partialEvaluators,
+			envs,
+		}
+
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("allows when the status code matches", func(t *testing.T) {
+		resp := roundTrip(t, http.StatusOK)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("forbidden when the status code does not match", func(t *testing.T) {
+		resp := roundTrip(t, http.StatusPartialContent)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+}
+
+func TestOPATransportPolicyResponseHeader(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		allow { true }
+		filter_response [body] { body := input.response.body }`,
+	}
+
+	partialEvaluators := PartialResultsEvaluators{}
+	for _, policy := range []string{"allow", "filter_response"} {
+		partialEvaluator, err := createPartialEvaluator(policy, context.Background(), nil, nil, opaModuleConfig, config.EnvironmentVariables{})
+		require.NoError(t, err)
+		partialEvaluators[EvaluatorKey{PolicyName: policy}] = *partialEvaluator
+	}
+
+	roundTrip := func(t *testing.T, envs config.EnvironmentVariables, permission *openapi.RondConfig) *http.Response {
+		t.Helper()
+
+		ctx := createContext(t, context.Background(), envs, nil, permission, opaModuleConfig, partialEvaluators)
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil).WithContext(ctx)
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader([]byte(`{"hello":"world"}`))),
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+		}
+		transport := &OPATransport{
+			&MockRoundTrip{Response: resp},
+			ctx,
+			logrus.NewEntry(logger),
+			req,
+			permission,
+			partialEvaluators,
+			envs,
+		}
+
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp
+	}
+
+	responsePolicyPermission := &openapi.RondConfig{
+		RequestFlow:  openapi.RequestFlow{PolicyName: "allow"},
+		ResponseFlow: openapi.ResponseFlow{PolicyName: "filter_response"},
+	}
+
+	t.Run("sets the response policy name", func(t *testing.T) {
+		resp := roundTrip(t, config.EnvironmentVariables{PolicyResponseHeader: "X-Rond-Policy"}, responsePolicyPermission)
+		require.Equal(t, "filter_response", resp.Header.Get("X-Rond-Policy"))
+	})
+
+	t.Run("header is not set when disabled", func(t *testing.T) {
+		resp := roundTrip(t, config.EnvironmentVariables{}, responsePolicyPermission)
+		require.NotContains(t, resp.Header, "X-Rond-Policy")
+	})
+
+	t.Run("sets the request policy name without response policy", func(t *testing.T) {
+		permission := &openapi.RondConfig{
+			RequestFlow: openapi.RequestFlow{PolicyName: "allow"},
+		}
+		resp := roundTrip(t, config.EnvironmentVariables{PolicyResponseHeader: "X-Rond-Policy"}, permission)
+		require.Equal(t, "allow", resp.Header.Get("X-Rond-Policy"))
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"hello":"world"}`, string(bodyBytes))
+	})
+}
+
+func TestOPATransportRoundTripNonJSON(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	pngBody := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x00, 0x01}
+	csvBody := []byte("id,name\n1,john\n")
+
+	roundTrip := func(t *testing.T, envs config.EnvironmentVariables, permission *openapi.RondConfig, contentType string, body []byte) *http.Response {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil)
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Header:        http.Header{"Content-Type": []string{contentType}},
+		}
+		transport := &OPATransport{
+			&MockRoundTrip{Response: resp},
+			req.Context(),
+			logrus.NewEntry(logger),
+			req,
+			permission,
+			nil,
+			envs,
+		}
+
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	withoutResponsePolicy := &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow"}}
+
+	for contentType, body := range map[string][]byte{"image/png": pngBody, "text/csv": csvBody} {
+		t.Run(fmt.Sprintf("passes through %s without response policy", contentType), func(t *testing.T) {
+			resp := roundTrip(t, config.EnvironmentVariables{PassThroughNonJSON: true}, withoutResponsePolicy, contentType, body)
+
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, contentType, resp.Header.Get(utils.ContentTypeHeaderKey))
+			bodyBytes, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, body, bodyBytes)
+		})
+	}
+
+	t.Run("rejects non-json responses when pass through is disabled", func(t *testing.T) {
+		resp := roundTrip(t, config.EnvironmentVariables{}, withoutResponsePolicy, "text/csv", csvBody)
+
+		require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(bodyBytes), "content-type is not application/json")
+	})
+
+	t.Run("passes through json responses when pass through is disabled", func(t *testing.T) {
+		resp := roundTrip(t, config.EnvironmentVariables{}, withoutResponsePolicy, "application/json", []byte(`{"hello":"world"}`))
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"hello":"world"}`, string(bodyBytes))
+	})
+
+	t.Run("rejects non-json responses with response policy", func(t *testing.T) {
+		permission := &openapi.RondConfig{
+			RequestFlow:  openapi.RequestFlow{PolicyName: "allow"},
+			ResponseFlow: openapi.ResponseFlow{PolicyName: "filter_response"},
+		}
+		resp := roundTrip(t, config.EnvironmentVariables{PassThroughNonJSON: true}, permission, "image/png", pngBody)
+
+		require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(bodyBytes), "content-type is not application/json")
+	})
+}
+
+func TestOPATransportRoundTripNDJSON(t *testing.T) {
+	envs := config.EnvironmentVariables{}
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		remove_secret [body] { body := json.remove(input.response.body, ["secret"]) }
+		remove_private [body] {
+			not input.response.body.private
+			body := input.response.body
+		}
+		remove_private [body] {
+			input.response.body.private
+			body := {}
+		}
+		deny_all [body] { false; body := input.response.body }`,
+	}
+
+	partialEvaluators := PartialResultsEvaluators{}
+	for _, policy := range []string{"remove_secret", "remove_private", "deny_all"} {
+		partialEvaluator, err := createPartialEvaluator(policy, context.Background(), nil, nil, opaModuleConfig, envs)
+		require.NoError(t, err)
+		partialEvaluators[EvaluatorKey{PolicyName: policy}] = *partialEvaluator
+	}
+
+	roundTrip := func(t *testing.T, policy, body string) (*http.Response, *test.Hook) {
+		t.Helper()
+
+		permission := &openapi.RondConfig{
+			ResponseFlow: openapi.ResponseFlow{PolicyName: policy},
+		}
+		ctx := createContext(t, context.Background(), envs, nil, permission, opaModuleConfig, partialEvaluators)
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil).WithContext(ctx)
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Body:          io.NopCloser(bytes.NewReader([]byte(body))),
+			ContentLength: int64(len(body)),
+			Header:        http.Header{"Content-Type": []string{"application/x-ndjson"}},
+		}
+		logger, hook := test.NewNullLogger()
+		transport := &OPATransport{
+			&MockRoundTrip{Response: resp},
+			ctx,
+			logrus.NewEntry(logger),
+			req,
+			permission,
+			partialEvaluators,
+			envs,
+		}
+
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		return resp, hook
+	}
+
+	readLines := func(t *testing.T, resp *http.Response) []string {
+		t.Helper()
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, strconv.Itoa(len(bodyBytes)), resp.Header.Get("Content-Length"))
+		return strings.Split(strings.TrimSuffix(string(bodyBytes), "\n"), "\n")
+	}
+
+	t.Run("filters each object independently", func(t *testing.T) {
+		var body strings.Builder
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(&body, "{\"id\":%d,\"secret\":\"s%d\"}\n", i, i)
+		}
+		resp, _ := roundTrip(t, "remove_secret", body.String())
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+		lines := readLines(t, resp)
+		require.Len(t, lines, 5)
+		for i, line := range lines {
+			require.JSONEq(t, fmt.Sprintf(`{"id":%d}`, i), line)
+		}
+	})
+
+	t.Run("omits objects filtered to empty objects", func(t *testing.T) {
+		resp, _ := roundTrip(t, "remove_private", "{\"id\":1}\n{\"id\":2,\"private\":true}\n\n{\"id\":3}")
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, []string{`{"id":1}`, `{"id":3}`}, readLines(t, resp))
+	})
+
+	t.Run("proxies invalid lines with a warning", func(t *testing.T) {
+		resp, hook := roundTrip(t, "remove_secret", "{\"id\":1,\"secret\":\"s\"}\nnot-json\n{\"id\":2}\n")
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, []string{`{"id":1}`, `not-json`, `{"id":2}`}, readLines(t, resp))
+
+		entry := hook.LastEntry()
+		require.NotNil(t, entry)
+		require.Equal(t, logrus.WarnLevel, entry.Level)
+		require.Equal(t, "invalid NDJSON line proxied without filtering", entry.Message)
+		require.Equal(t, 2, entry.Data["line"])
+	})
+
+	t.Run("forbidden when policy denies an object", func(t *testing.T) {
+		resp, _ := roundTrip(t, "deny_all", "{\"id\":1}\n")
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+}
+
+func TestOPATransportRoundTripPolicyModes(t *testing.T) {
+	envs := config.EnvironmentVariables{}
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		deny_response [body] { false; body := input.response.body }`,
+	}
+
+	partialEvaluator, err := createPartialEvaluator("deny_response", context.Background(), nil, nil, opaModuleConfig, envs)
+	require.NoError(t, err)
+	partialEvaluators := PartialResultsEvaluators{{PolicyName: "deny_response"}: *partialEvaluator}
+
+	roundTrip := func(t *testing.T, mode string) (*http.Response, context.Context) {
+		t.Helper()
+
+		permission := &openapi.RondConfig{
+			ResponseFlow: openapi.ResponseFlow{PolicyName: "deny_response"},
+			Options:      openapi.PermissionOptions{Mode: mode},
+		}
+		ctx := createContext(t, context.Background(), envs, nil, permission, opaModuleConfig, partialEvaluators)
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil).WithContext(ctx)
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Body:          io.NopCloser(bytes.NewReader([]byte(`{"hello":"world"}`))),
+			ContentLength: 17,
+			Header:        http.Header{"Content-Type": []string{"application/json"}},
+		}
+		logger, _ := test.NewNullLogger()
+		transport := &OPATransport{
+			&MockRoundTrip{Response: resp},
+			ctx,
+			logrus.NewEntry(logger),
+			req,
+			permission,
+			partialEvaluators,
+			envs,
+		}
+
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		return resp, ctx
+	}
+
+	t.Run("enforce mode blocks denied responses", func(t *testing.T) {
+		resp, _ := roundTrip(t, config.PolicyModeEnforce)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("log-only mode proxies denied responses and records the decision", func(t *testing.T) {
+		resp, ctx := roundTrip(t, config.PolicyModeLogOnly)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, `{"hello":"world"}`, string(bodyBytes))
+
+		m, err := metrics.GetFromContext(ctx)
+		require.NoError(t, err)
+		require.Equal(t, float64(1), testutil.ToFloat64(m.PolicyLogOnlyDecisions.WithLabelValues("deny_response", "false")))
+	})
+
+	t.Run("off mode skips policy evaluation", func(t *testing.T) {
+		resp, ctx := roundTrip(t, config.PolicyModeOff)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, `{"hello":"world"}`, string(bodyBytes))
+
+		m, err := metrics.GetFromContext(ctx)
+		require.NoError(t, err)
+		require.Equal(t, float64(0), testutil.ToFloat64(m.PolicyLogOnlyDecisions.WithLabelValues("deny_response", "false")))
+	})
+}
+
+func TestOPATransportInflightRequests(t *testing.T) {
+	envs := config.EnvironmentVariables{}
+	logger, _ := test.NewNullLogger()
+	ctx := createContext(t, context.Background(), envs, nil, &openapi.RondConfig{}, nil, nil)
+	m, err := metrics.GetFromContext(ctx)
+	require.NoError(t, err)
+	inflightRequests := m.ProxyInflightRequests.WithLabelValues("GET", "/matched/path")
+
+	slowRoundTrip := &SlowRoundTrip{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil).WithContext(ctx)
+	transport := &OPATransport{
+		slowRoundTrip,
+		ctx,
+		logrus.NewEntry(logger),
+		req,
+		&openapi.RondConfig{},
+		nil,
+		envs,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := transport.RoundTrip(req)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		}()
+	}
+
+	<-slowRoundTrip.started
+	<-slowRoundTrip.started
+	require.Equal(t, float64(2), testutil.ToFloat64(inflightRequests))
+
+	close(slowRoundTrip.release)
+	wg.Wait()
+	require.Equal(t, float64(0), testutil.ToFloat64(inflightRequests))
+}
+
+type SlowRoundTrip struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (m *SlowRoundTrip) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.started <- struct{}{}
+	<-m.release
+	return &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Body:       io.NopCloser(bytes.NewReader(nil)),
+		Header:     http.Header{},
+	}, nil
+}
+
+func TestOPATransportRoundTripPanic(t *testing.T) {
+	envs := config.EnvironmentVariables{}
+	logger, hook := test.NewNullLogger()
+	ctx := createContext(t, context.Background(), envs, nil, &openapi.RondConfig{}, nil, nil)
+	m, err := metrics.GetFromContext(ctx)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil).WithContext(ctx)
+	transport := &OPATransport{
+		&PanicRoundTrip{},
+		ctx,
+		logrus.NewEntry(logger),
+		req,
+		&openapi.RondConfig{},
+		nil,
+		envs,
+	}
+
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	bodyBytes, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(bodyBytes), "response evaluation panicked")
+
+	require.Equal(t, float64(1), testutil.ToFloat64(m.Panics.WithLabelValues("/matched/path")))
+	require.Equal(t, float64(0), testutil.ToFloat64(m.ProxyInflightRequests.WithLabelValues("GET", "/matched/path")))
+	require.Equal(t, "panic while evaluating response", hook.AllEntries()[0].Message)
+}
+
+type PanicRoundTrip struct{}
+
+func (m *PanicRoundTrip) RoundTrip(req *http.Request) (*http.Response, error) {
+	panic("round trip failure")
+}
+
 type MockRoundTrip struct {
 	Error    error
 	Response *http.Response
+	// Request is the last forwarded request.
+	Request *http.Request
 }
 
 func (m *MockRoundTrip) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	m.Request = req
 	return m.Response, m.Error
 }
 
@@ -399,3 +1059,369 @@ func (m *MockReader) Read(p []byte) (n int, err error) {
 func (m *MockReader) Close() error {
 	return m.CloseError
 }
+
+func TestTransportRequestID(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	envs := config.EnvironmentVariables{RequestIDHeaderKey: "x-request-id"}
+	okResponse := func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusNoContent,
+			Body:       http.NoBody,
+			Header:     http.Header{},
+		}
+	}
+	opaTransport := func(roundTripper http.RoundTripper, req *http.Request, envs config.EnvironmentVariables) http.RoundTripper {
+		return &OPATransport{roundTripper, req.Context(), logrus.NewEntry(logger), req, nil, nil, envs}
+	}
+	upstreamTransport := func(roundTripper http.RoundTripper, req *http.Request, envs config.EnvironmentVariables) http.RoundTripper {
+		return &UpstreamTransport{RoundTripper: roundTripper, Logger: logrus.NewEntry(logger), Env: envs}
+	}
+
+	transports := map[string]func(http.RoundTripper, *http.Request, config.EnvironmentVariables) http.RoundTripper{
+		"OPATransport":      opaTransport,
+		"UpstreamTransport": upstreamTransport,
+	}
+	for name, newTransport := range transports {
+		t.Run(name, func(t *testing.T) {
+			t.Run("forwards and echoes the request id", func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil)
+				req.Header.Set("x-request-id", "the-request-id")
+				roundTripper := &MockRoundTrip{Response: okResponse()}
+
+				resp, err := newTransport(roundTripper, req, envs).RoundTrip(req)
+				require.NoError(t, err)
+				require.Equal(t, "the-request-id", roundTripper.Request.Header.Get("x-request-id"))
+				require.Equal(t, "the-request-id", resp.Header.Get("x-request-id"))
+			})
+
+			t.Run("uses the request id of the context", func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil)
+				req = req.WithContext(utils.WithRequestID(req.Context(), "context-request-id"))
+				roundTripper := &MockRoundTrip{Response: okResponse()}
+
+				resp, err := newTransport(roundTripper, req, envs).RoundTrip(req)
+				require.NoError(t, err)
+				require.Equal(t, "context-request-id", roundTripper.Request.Header.Get("x-request-id"))
+				require.Equal(t, "context-request-id", resp.Header.Get("x-request-id"))
+				require.Empty(t, req.Header.Get("x-request-id"), "the original request must not be modified")
+			})
+
+			t.Run("generates a request id", func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil)
+				roundTripper := &MockRoundTrip{Response: okResponse()}
+
+				resp, err := newTransport(roundTripper, req, envs).RoundTrip(req)
+				require.NoError(t, err)
+				requestID := roundTripper.Request.Header.Get("x-request-id")
+				require.Len(t, requestID, 36)
+				require.Equal(t, requestID, resp.Header.Get("x-request-id"))
+			})
+
+			t.Run("does nothing without a request id header", func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil)
+				roundTripper := &MockRoundTrip{Response: okResponse()}
+
+				resp, err := newTransport(roundTripper, req, config.EnvironmentVariables{}).RoundTrip(req)
+				require.NoError(t, err)
+				require.Empty(t, roundTripper.Request.Header)
+				require.Empty(t, resp.Header)
+			})
+		})
+	}
+
+	t.Run("echoes the request id on the recovered panic", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil)
+		req.Header.Set("x-request-id", "the-request-id")
+
+		resp, err := opaTransport(&PanicRoundTrip{}, req, envs).RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		require.Equal(t, "the-request-id", resp.Header.Get("x-request-id"))
+	})
+}
+
+func TestOPATransportRoundTripPathParams(t *testing.T) {
+	envs := config.EnvironmentVariables{}
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		filter_response [body] {
+			input.request.pathParams.projectId == "p1"
+			input.request.pathParams["*"] == "docs/readme.md"
+			body := input.response.body
+		}`,
+	}
+
+	partialEvaluator, err := createPartialEvaluator("filter_response", context.Background(), nil, nil, opaModuleConfig, envs)
+	require.NoError(t, err)
+	partialEvaluators := PartialResultsEvaluators{{PolicyName: "filter_response"}: *partialEvaluator}
+	permission := &openapi.RondConfig{
+		ResponseFlow: openapi.ResponseFlow{PolicyName: "filter_response"},
+	}
+	ctx := createContext(t, context.Background(), envs, nil, permission, opaModuleConfig, partialEvaluators)
+
+	var resp *http.Response
+	router := mux.NewRouter().UseEncodedPath()
+	router.PathPrefix("/projects/{projectId}/files/").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		logger, _ := test.NewNullLogger()
+		transport := &OPATransport{
+			&MockRoundTrip{Response: &http.Response{
+				StatusCode:    http.StatusOK,
+				Body:          io.NopCloser(bytes.NewReader([]byte(`{"hello":"world"}`))),
+				ContentLength: 17,
+				Header:        http.Header{"Content-Type": []string{"application/json"}},
+			}},
+			req.Context(),
+			logrus.NewEntry(logger),
+			req,
+			permission,
+			partialEvaluators,
+			envs,
+		}
+
+		var err error
+		resp, err = transport.RoundTrip(req)
+		require.NoError(t, err)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/projects/p1/files/docs/readme.md", nil).WithContext(ctx)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.NotNil(t, resp)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	bodyBytes, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, `{"hello":"world"}`, string(bodyBytes))
+}
+
+func TestOPATransportRoundTripRequestBody(t *testing.T) {
+	envs := config.EnvironmentVariables{}
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		filter_response [body] {
+			input.request.body.name == "my-book"
+			body := input.response.body
+		}`,
+	}
+
+	partialEvaluator, err := createPartialEvaluator("filter_response", context.Background(), nil, nil, opaModuleConfig, envs)
+	require.NoError(t, err)
+	partialEvaluators := PartialResultsEvaluators{{PolicyName: "filter_response"}: *partialEvaluator}
+	permission := &openapi.RondConfig{
+		ResponseFlow: openapi.ResponseFlow{PolicyName: "filter_response"},
+	}
+
+	echoServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(utils.ContentTypeHeaderKey, req.Header.Get(utils.ContentTypeHeaderKey))
+		io.Copy(w, req.Body)
+	}))
+	defer echoServer.Close()
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch} {
+		t.Run(method, func(t *testing.T) {
+			requestBody := `{"name":"my-book","pages":42}`
+			ctx := createContext(t, context.Background(), envs, nil, permission, opaModuleConfig, partialEvaluators)
+			req := httptest.NewRequest(method, echoServer.URL+"/books", bytes.NewReader([]byte(requestBody))).WithContext(ctx)
+			req.Header.Set(utils.ContentTypeHeaderKey, "application/json")
+			req.RequestURI = ""
+
+			logger, _ := test.NewNullLogger()
+			transport := &OPATransport{
+				http.DefaultTransport,
+				req.Context(),
+				logrus.NewEntry(logger),
+				req,
+				permission,
+				partialEvaluators,
+				envs,
+			}
+
+			resp, err := transport.RoundTrip(req)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			bodyBytes, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.JSONEq(t, requestBody, string(bodyBytes))
+		})
+	}
+}
+
+func TestOPATransportRoundTripPatch(t *testing.T) {
+	envs := config.EnvironmentVariables{}
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		filter_patch_response [body] {
+			input.request.method == "PATCH"
+			body := json.remove(input.response.body, ["secret"])
+		}`,
+	}
+
+	partialEvaluator, err := createPartialEvaluator("filter_patch_response", context.Background(), nil, nil, opaModuleConfig, envs)
+	require.NoError(t, err)
+	partialEvaluators := PartialResultsEvaluators{{PolicyName: "filter_patch_response"}: *partialEvaluator}
+	permission := &openapi.RondConfig{
+		ResponseFlow: openapi.ResponseFlow{PolicyName: "filter_patch_response"},
+	}
+
+	// the upstream replies with the patched fields only
+	var upstreamMethod string
+	var upstreamBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamMethod = req.Method
+		upstreamBody, _ = io.ReadAll(req.Body)
+		w.Header().Set(utils.ContentTypeHeaderKey, "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"_id":"book-1","name":"my-book","secret":"s3cr3t"}`))
+	}))
+	defer upstream.Close()
+
+	ctx := createContext(t, context.Background(), envs, nil, permission, opaModuleConfig, partialEvaluators)
+	req := httptest.NewRequest(http.MethodPatch, upstream.URL+"/books/book-1", bytes.NewReader([]byte(`{"name":"my-book"}`))).WithContext(ctx)
+	req.Header.Set(utils.ContentTypeHeaderKey, "application/json")
+	req.RequestURI = ""
+
+	logger, _ := test.NewNullLogger()
+	transport := &OPATransport{
+		http.DefaultTransport,
+		req.Context(),
+		logrus.NewEntry(logger),
+		req,
+		permission,
+		partialEvaluators,
+		envs,
+	}
+
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.MethodPatch, upstreamMethod)
+	require.JSONEq(t, `{"name":"my-book"}`, string(upstreamBody))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	bodyBytes, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"_id":"book-1","name":"my-book"}`, string(bodyBytes))
+	require.NotContains(t, string(bodyBytes), "secret")
+	require.Equal(t, int64(len(bodyBytes)), resp.ContentLength)
+}
+
+func TestOPATransportRoundTripGzip(t *testing.T) {
+	envs := config.EnvironmentVariables{}
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		filter_response [body] {
+			input.response.body.hello == "world"
+			body := {"filtered": input.response.body.hello}
+		}`,
+	}
+
+	partialEvaluator, err := createPartialEvaluator("filter_response", context.Background(), nil, nil, opaModuleConfig, envs)
+	require.NoError(t, err)
+	partialEvaluators := PartialResultsEvaluators{{PolicyName: "filter_response"}: *partialEvaluator}
+	permission := &openapi.RondConfig{
+		ResponseFlow: openapi.ResponseFlow{PolicyName: "filter_response"},
+	}
+
+	gzipped := func(t *testing.T, body string) []byte {
+		t.Helper()
+		compressed, err := gzipBody([]byte(body))
+		require.NoError(t, err)
+		return compressed
+	}
+
+	roundTrip := func(t *testing.T, acceptEncoding string, body []byte) (*http.Response, error) {
+		t.Helper()
+		ctx := createContext(t, context.Background(), envs, nil, permission, opaModuleConfig, partialEvaluators)
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil).WithContext(ctx)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Header: http.Header{
+				"Content-Type":     []string{"application/json"},
+				"Content-Encoding": []string{"gzip"},
+				"Content-Length":   []string{strconv.Itoa(len(body))},
+			},
+		}
+		logger, _ := test.NewNullLogger()
+		transport := &OPATransport{
+			&MockRoundTrip{Response: resp},
+			ctx,
+			logrus.NewEntry(logger),
+			req,
+			permission,
+			partialEvaluators,
+			envs,
+		}
+		return transport.RoundTrip(req)
+	}
+
+	t.Run("filtered body is compressed again when the client accepts gzip", func(t *testing.T) {
+		resp, err := roundTrip(t, "gzip, deflate", gzipped(t, `{"hello":"world"}`))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(bodyBytes)), resp.ContentLength)
+		require.Equal(t, strconv.Itoa(len(bodyBytes)), resp.Header.Get("Content-Length"))
+
+		decompressed, err := gunzip(bodyBytes)
+		require.NoError(t, err, "response is not valid gzip")
+		require.JSONEq(t, `{"filtered":"world"}`, string(decompressed))
+	})
+
+	t.Run("filtered body is returned uncompressed when the client does not accept gzip", func(t *testing.T) {
+		resp, err := roundTrip(t, "", gzipped(t, `{"hello":"world"}`))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Empty(t, resp.Header.Get("Content-Encoding"))
+
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"filtered":"world"}`, string(bodyBytes))
+		require.Equal(t, strconv.Itoa(len(bodyBytes)), resp.Header.Get("Content-Length"))
+	})
+
+	t.Run("denied response is not marked as compressed", func(t *testing.T) {
+		resp, err := roundTrip(t, "gzip", gzipped(t, `{"hello":"there"}`))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		require.Empty(t, resp.Header.Get("Content-Encoding"))
+
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.True(t, json.Valid(bodyBytes))
+	})
+
+	t.Run("fails on invalid gzip body", func(t *testing.T) {
+		resp, err := roundTrip(t, "gzip", []byte(`{"hello":"world"}`))
+		require.Nil(t, resp)
+		require.ErrorContains(t, err, "failed response body decompression")
+	})
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	testCases := []struct {
+		acceptEncoding []string
+		expected       bool
+	}{
+		{acceptEncoding: nil, expected: false},
+		{acceptEncoding: []string{"gzip"}, expected: true},
+		{acceptEncoding: []string{"deflate, GZIP"}, expected: true},
+		{acceptEncoding: []string{"br", "gzip;q=0.5"}, expected: true},
+		{acceptEncoding: []string{"gzip; q=0"}, expected: false},
+		{acceptEncoding: []string{"deflate, br"}, expected: false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(strings.Join(testCase.acceptEncoding, "|"), func(t *testing.T) {
+			require.Equal(t, testCase.expected, acceptsGzip(http.Header{"Accept-Encoding": testCase.acceptEncoding}))
+		})
+	}
+}
@@ -17,14 +17,22 @@ package core
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -37,7 +45,6 @@ import (
 
 	"github.com/rond-authz/rond/custom_builtins"
 
-	"github.com/gorilla/mux"
 	"github.com/mia-platform/glogger/v2"
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/rego"
@@ -60,19 +67,186 @@ type OPAEvaluator struct {
 }
 type PartialResultsEvaluatorConfigKey struct{}
 
-type PartialResultsEvaluators map[string]PartialEvaluator
+// EvaluatorKey identifies the evaluator of a policy. PolicyName is the policy evaluator key,
+// see PolicyEvaluatorKey, and ModuleFingerprint is the fingerprint of the policies the
+// evaluator is compiled from, so that the evaluators of a previous version of the policies
+// can be told apart and evicted.
+type EvaluatorKey struct {
+	PolicyName        string
+	ModuleFingerprint string
+}
+
+// RequestEvaluatorKey returns the key of the evaluator of policy for a route using
+// policyModule, compiled from the policies stored in the request context.
+func RequestEvaluatorKey(ctx context.Context, policyModule, policy string) EvaluatorKey {
+	key := EvaluatorKey{PolicyName: PolicyEvaluatorKey(policyModule, policy)}
+	if opaModuleConfig, err := GetOPAModuleConfig(ctx); err == nil && opaModuleConfig != nil {
+		key.ModuleFingerprint = opaModuleConfig.Fingerprint
+	}
+	return key
+}
+
+// PartialResultsEvaluators holds the partial evaluators keyed by policy name and fingerprint
+// of the policies they are compiled from, see EvaluatorKey: routes sharing a policy of the same
+// module share its partial result, which is only read when a request input is evaluated, so
+// it is safe for concurrent use.
+type PartialResultsEvaluators map[EvaluatorKey]PartialEvaluator
 
 type PartialEvaluator struct {
 	PartialEvaluator *rego.PartialResult
+	// lazy compiles the partial result on first use, when the evaluators are set up
+	// with LAZY_EVALUATOR_INIT.
+	lazy *lazyPartialEvaluator
+	// resourcePermissionsMapUnused is set when the policy never reads the optimized
+	// resource permissions map, so that it is not built for its input.
+	resourcePermissionsMapUnused bool
+}
+
+type lazyPartialEvaluator struct {
+	once    sync.Once
+	compile func() (*rego.PartialResult, error)
+	result  *rego.PartialResult
+	err     error
+	// done is set once the compilation has been attempted
+	done uint32
+}
+
+// partialResult returns the partial result of the policy, compiling it on first use
+// if its creation has been deferred.
+func (evaluator PartialEvaluator) partialResult() (*rego.PartialResult, error) {
+	if evaluator.lazy == nil {
+		return evaluator.PartialEvaluator, nil
+	}
+	evaluator.lazy.once.Do(func() {
+		evaluator.lazy.result, evaluator.lazy.err = evaluator.lazy.compile()
+		atomic.StoreUint32(&evaluator.lazy.done, 1)
+	})
+	return evaluator.lazy.result, evaluator.lazy.err
+}
+
+func newLazyPartialEvaluator(policy string, ctx context.Context, mongoClient types.IMongoClient, oas *openapi.OpenAPISpec, opaModuleConfig *OPAModuleConfig, env config.EnvironmentVariables) PartialEvaluator {
+	glogger.Get(ctx).Debugf("deferring rego query computation for policy: %s", policy)
+	return PartialEvaluator{
+		lazy: &lazyPartialEvaluator{
+			compile: func() (*rego.PartialResult, error) {
+				evaluator, err := createPartialEvaluator(policy, ctx, mongoClient, oas, opaModuleConfig, env)
+				if err != nil {
+					glogger.Get(ctx).WithFields(logrus.Fields{
+						"error":      logrus.Fields{"message": err.Error()},
+						"policyName": policy,
+					}).Error("failed rego query computation")
+					return nil, err
+				}
+				return evaluator.PartialEvaluator, nil
+			},
+		},
+	}
+}
+
+// Compiled reports whether the partial result of the policy is available, without
+// triggering its deferred computation.
+func (partialEvaluators PartialResultsEvaluators) Compiled(key EvaluatorKey) bool {
+	evaluator, ok := partialEvaluators[key]
+	if !ok {
+		return false
+	}
+	if evaluator.lazy == nil {
+		return evaluator.PartialEvaluator != nil
+	}
+	return atomic.LoadUint32(&evaluator.lazy.done) == 1 && evaluator.lazy.err == nil
+}
+
+// withReloaded returns the evaluators merged with the ones compiled from a new version of
+// the policies, keyed on newFingerprint: for each reloaded policy, the evaluators of the same
+// policy keyed on another fingerprint are left out, while the evaluators of the other policies
+// are preserved. The receiver is not modified, since the requests in flight may read it.
+func (partialEvaluators PartialResultsEvaluators) withReloaded(reloaded PartialResultsEvaluators, newFingerprint string) PartialResultsEvaluators {
+	reloadedPolicies := map[string]bool{}
+	for key := range reloaded {
+		if key.ModuleFingerprint == newFingerprint {
+			reloadedPolicies[key.PolicyName] = true
+		}
+	}
+	merged := make(PartialResultsEvaluators, len(partialEvaluators)+len(reloaded))
+	for key, evaluator := range partialEvaluators {
+		if !reloadedPolicies[key.PolicyName] || key.ModuleFingerprint == newFingerprint {
+			merged[key] = evaluator
+		}
+	}
+	for key, evaluator := range reloaded {
+		merged[key] = evaluator
+	}
+	return merged
+}
+
+// Warmup computes the partial results whose computation has been deferred, returning
+// an error combining the failed ones.
+func (partialEvaluators PartialResultsEvaluators) Warmup() error {
+	return partialEvaluators.PreWarm(1)
 }
 
-func createPartialEvaluator(policy string, ctx context.Context, mongoClient types.IMongoClient, oas *openapi.OpenAPISpec, opaModuleConfig *OPAModuleConfig, env config.EnvironmentVariables) (*PartialEvaluator, error) {
-	glogger.Get(ctx).Infof("precomputing rego query for allow policy: %s", policy)
+// PreWarm is like Warmup, computing the deferred partial results with a bounded pool of
+// workers, so that the requests find them already compiled.
+func (partialEvaluators PartialResultsEvaluators) PreWarm(workers int) error {
+	policies := make([]EvaluatorKey, 0, len(partialEvaluators))
+	for key := range partialEvaluators {
+		policies = append(policies, key)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		if policies[i].PolicyName != policies[j].PolicyName {
+			return policies[i].PolicyName < policies[j].PolicyName
+		}
+		return policies[i].ModuleFingerprint < policies[j].ModuleFingerprint
+	})
+	if workers < 1 {
+		workers = 1
+	}
+
+	failures := make([]error, len(policies))
+	policyIndexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(policies); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for policyIndex := range policyIndexes {
+				_, failures[policyIndex] = partialEvaluators[policies[policyIndex]].partialResult()
+			}
+		}()
+	}
+	for policyIndex := range policies {
+		policyIndexes <- policyIndex
+	}
+	close(policyIndexes)
+	wg.Wait()
+
+	errorMessages := []string{}
+	for policyIndex, err := range failures {
+		if err != nil {
+			errorMessages = append(errorMessages, fmt.Sprintf("policy %s: %s", policies[policyIndex].PolicyName, err.Error()))
+		}
+	}
+	if len(errorMessages) > 0 {
+		return fmt.Errorf("error during evaluator creation: %s", strings.Join(errorMessages, "; "))
+	}
+	return nil
+}
+
+// createPartialEvaluator creates the evaluator of the policy identified by the evaluator key,
+// compiling it from the policy module of the key if any.
+func createPartialEvaluator(key string, ctx context.Context, mongoClient types.IMongoClient, oas *openapi.OpenAPISpec, opaModuleConfig *OPAModuleConfig, env config.EnvironmentVariables) (*PartialEvaluator, error) {
+	policyModule, policy := splitPolicyEvaluatorKey(key)
+	glogger.Get(ctx).Infof("precomputing rego query for allow policy: %s", key)
+
+	moduleConfig, err := opaModuleConfig.ForPolicyModule(policyModule)
+	if err != nil {
+		return nil, err
+	}
 
 	policyEvaluatorTime := time.Now()
-	partialResultEvaluator, err := NewPartialResultEvaluator(ctx, policy, opaModuleConfig, mongoClient, env)
+	partialResultEvaluator, err := NewPartialResultEvaluator(ctx, policy, moduleConfig, mongoClient, env)
 	if err == nil {
-		glogger.Get(ctx).Infof("computed rego query for policy: %s in %s", policy, time.Since(policyEvaluatorTime))
+		glogger.Get(ctx).Infof("computed rego query for policy: %s in %s", key, time.Since(policyEvaluatorTime))
 		return &PartialEvaluator{
 			PartialEvaluator: partialResultEvaluator,
 		}, nil
@@ -80,8 +254,50 @@ func createPartialEvaluator(policy string, ctx context.Context, mongoClient type
 	return nil, err
 }
 
-func SetupEvaluators(ctx context.Context, mongoClient types.IMongoClient, oas *openapi.OpenAPISpec, opaModuleConfig *OPAModuleConfig, env config.EnvironmentVariables) (PartialResultsEvaluators, error) {
-	policyEvaluators := PartialResultsEvaluators{}
+// EvaluatorSetupError reports the failed creation of the evaluator of a policy
+// configured on a route.
+type EvaluatorSetupError struct {
+	RoutePath  string
+	Method     string
+	PolicyName string
+	Cause      error
+}
+
+func (e EvaluatorSetupError) Error() string {
+	return fmt.Sprintf("%s %s: policy %s: %s", e.Method, e.RoutePath, e.PolicyName, e.Cause.Error())
+}
+
+func (e EvaluatorSetupError) Unwrap() error {
+	return e.Cause
+}
+
+// SetupEvaluators creates the partial evaluators of all the policies configured in the OAS.
+// On failures it returns the evaluators created successfully, a setup error for each route
+// whose policy evaluator could not be created and an error combining them, so that the
+// caller can decide whether a partial setup is acceptable.
+func SetupEvaluators(ctx context.Context, mongoClient types.IMongoClient, oas *openapi.OpenAPISpec, opaModuleConfig *OPAModuleConfig, env config.EnvironmentVariables) (PartialResultsEvaluators, []EvaluatorSetupError, error) {
+	// policyReference is a route referencing a policy, used to report the setup errors
+	// on each route using a policy whose evaluator could not be created.
+	// The evaluators are keyed on the policy module too, see EvaluatorKey.
+	type policyReference struct {
+		path, verb, policy, key string
+	}
+	// invalid capabilities would make every evaluator fail, so they are reported once
+	if _, err := regoCapabilities(env); err != nil {
+		return nil, nil, fmt.Errorf("invalid OPA capabilities: %s", err.Error())
+	}
+	references := []policyReference{}
+	policies := []string{}
+	referencedPolicies := map[string]bool{}
+	addReference := func(path, verb, policyModule, policy string) {
+		key := PolicyEvaluatorKey(policyModule, policy)
+		references = append(references, policyReference{path: path, verb: verb, policy: policy, key: key})
+		if !referencedPolicies[key] {
+			referencedPolicies[key] = true
+			policies = append(policies, key)
+		}
+	}
+
 	for path, OASContent := range oas.Paths {
 		for verb, verbConfig := range OASContent {
 			if verbConfig.PermissionV2 == nil {
@@ -97,95 +313,318 @@ func SetupEvaluators(ctx context.Context, mongoClient types.IMongoClient, oas *o
 				continue
 			}
 
-			if _, ok := policyEvaluators[allowPolicy]; !ok {
-				evaluator, err := createPartialEvaluator(allowPolicy, ctx, mongoClient, oas, opaModuleConfig, env)
+			policyModule := verbConfig.PermissionV2.Options.PolicyModule
+			addReference(path, verb, policyModule, allowPolicy)
+			if shadowPolicy := verbConfig.PermissionV2.RequestFlow.ShadowPolicy; shadowPolicy != "" {
+				addReference(path, verb, policyModule, shadowPolicy)
+			}
+			if responsePolicy != "" {
+				addReference(path, verb, policyModule, responsePolicy)
+			}
 
-				if err != nil {
-					return nil, fmt.Errorf("error during evaluator creation: %s", err.Error())
+			if negotiationPolicy := verbConfig.PermissionV2.ContentNegotiationPolicy; negotiationPolicy != "" {
+				addReference(path, verb, policyModule, negotiationPolicy)
+			}
+			for _, versionConfig := range verbConfig.PermissionV2.Versions {
+				versionPolicyModule := versionConfig.Options.PolicyModule
+				addReference(path, verb, versionPolicyModule, versionConfig.RequestFlow.PolicyName)
+				if versionConfig.RequestFlow.ShadowPolicy != "" {
+					addReference(path, verb, versionPolicyModule, versionConfig.RequestFlow.ShadowPolicy)
+				}
+				if versionConfig.ResponseFlow.PolicyName != "" {
+					addReference(path, verb, versionPolicyModule, versionConfig.ResponseFlow.PolicyName)
 				}
+			}
+		}
+	}
+
+	if err := validateIgnoreBodyResponsePolicies(oas, opaModuleConfig, env); err != nil {
+		return nil, nil, fmt.Errorf("invalid response flow: %s", err.Error())
+	}
 
-				policyEvaluators[allowPolicy] = *evaluator
+	policyEvaluators := PartialResultsEvaluators{}
+	var failedPolicies map[string]error
+	if env.LazyEvaluatorInit || env.PreWarmOnStartup {
+		// the evaluators pre-warmed on startup are computed after the setup, while the modules
+		// are compiled now so that invalid policies and disabled builtins are reported anyway
+		failedPolicies = compilePolicyModules(policies, opaModuleConfig, env)
+		for _, policy := range policies {
+			if _, failed := failedPolicies[policy]; !failed {
+				policyEvaluators[EvaluatorKey{PolicyName: policy, ModuleFingerprint: opaModuleConfig.Fingerprint}] = newLazyPartialEvaluator(policy, ctx, mongoClient, oas, opaModuleConfig, env)
 			}
+		}
+	} else {
+		failedPolicies = createPartialEvaluators(ctx, EvaluatorSetupWorkers(env), policies, mongoClient, oas, opaModuleConfig, env, policyEvaluators)
+	}
+	if len(policyEvaluators) > 0 {
+		markResourcePermissionsMapUsage(ctx, policyEvaluators, opaModuleConfig, env)
+	}
+	setupErrors := []EvaluatorSetupError{}
+	for _, reference := range references {
+		if err, failed := failedPolicies[reference.key]; failed {
+			setupErrors = append(setupErrors, EvaluatorSetupError{
+				RoutePath:  reference.path,
+				Method:     reference.verb,
+				PolicyName: reference.policy,
+				Cause:      err,
+			})
+		}
+	}
 
-			if responsePolicy != "" {
-				if _, ok := policyEvaluators[responsePolicy]; !ok {
-					evaluator, err := createPartialEvaluator(responsePolicy, ctx, mongoClient, oas, opaModuleConfig, env)
+	if len(setupErrors) == 0 {
+		return policyEvaluators, nil, nil
+	}
 
-					if err != nil {
-						return nil, fmt.Errorf("error during evaluator creation: %s", err.Error())
-					}
+	sort.Slice(setupErrors, func(i, j int) bool {
+		if setupErrors[i].RoutePath != setupErrors[j].RoutePath {
+			return setupErrors[i].RoutePath < setupErrors[j].RoutePath
+		}
+		if setupErrors[i].Method != setupErrors[j].Method {
+			return setupErrors[i].Method < setupErrors[j].Method
+		}
+		return setupErrors[i].PolicyName < setupErrors[j].PolicyName
+	})
+	errorMessages := make([]string, 0, len(setupErrors))
+	for _, setupError := range setupErrors {
+		errorMessages = append(errorMessages, setupError.Error())
+	}
+	return policyEvaluators, setupErrors, fmt.Errorf("error during evaluator creation: %s", strings.Join(errorMessages, "; "))
+}
 
-					policyEvaluators[responsePolicy] = *evaluator
-				}
+// EvaluatorSetupWorkers returns how many policies evaluators are computed concurrently,
+// defaulting to GOMAXPROCS.
+func EvaluatorSetupWorkers(env config.EnvironmentVariables) int {
+	if env.EvaluatorSetupWorkers > 0 {
+		return env.EvaluatorSetupWorkers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// compilePolicyModules compiles the policy modules referenced by the policies, without
+// computing their partial results. The returned map contains the compilation error of
+// each policy whose module is invalid.
+func compilePolicyModules(policies []string, opaModuleConfig *OPAModuleConfig, env config.EnvironmentVariables) map[string]error {
+	failedPolicies := map[string]error{}
+	moduleErrors := map[string]error{}
+	for _, policy := range policies {
+		policyModule, _ := splitPolicyEvaluatorKey(policy)
+		err, compiled := moduleErrors[policyModule]
+		if !compiled {
+			var moduleConfig *OPAModuleConfig
+			if moduleConfig, err = opaModuleConfig.ForPolicyModule(policyModule); err == nil {
+				_, err = compileModules(moduleConfig, env)
 			}
+			moduleErrors[policyModule] = err
+		}
+		if err != nil {
+			failedPolicies[policy] = err
 		}
 	}
-	return policyEvaluators, nil
+	return failedPolicies
+}
+
+// createPartialEvaluators compiles each of the distinct policies exactly once, using a bounded
+// pool of workers. The evaluators are added to policyEvaluators, while the
+// returned map contains the creation error of each failed policy.
+func createPartialEvaluators(ctx context.Context, workers int, policies []string, mongoClient types.IMongoClient, oas *openapi.OpenAPISpec, opaModuleConfig *OPAModuleConfig, env config.EnvironmentVariables, policyEvaluators PartialResultsEvaluators) map[string]error {
+	failedPolicies := map[string]error{}
+	var mutex sync.Mutex
+
+	if workers > len(policies) {
+		workers = len(policies)
+	}
+	policiesToCreate := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for policy := range policiesToCreate {
+				evaluator, err := createPartialEvaluator(policy, ctx, mongoClient, oas, opaModuleConfig, env)
+
+				mutex.Lock()
+				if err != nil {
+					failedPolicies[policy] = err
+				} else {
+					policyEvaluators[EvaluatorKey{PolicyName: policy, ModuleFingerprint: opaModuleConfig.Fingerprint}] = *evaluator
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, policy := range policies {
+		policiesToCreate <- policy
+	}
+	close(policiesToCreate)
+	wg.Wait()
+
+	return failedPolicies
 }
 
-func NewPrintHook(w io.Writer, policy string) print.Hook {
-	return printHook{
-		w:          w,
+// NewPrintHook returns the hook logging the output of the print statements through the
+// request logger, so that it can be correlated with the request that triggered it.
+// The input is the one the policy is evaluated with, used to report the user id.
+// Messages are logged at trace level, use WithLevel to change it.
+func NewPrintHook(logger *logrus.Entry, policy string, input ast.Value) *PrintHook {
+	return &PrintHook{
+		logger:     logger,
 		policyName: policy,
+		input:      input,
+		level:      logrus.TraceLevel,
 	}
 }
 
-type printHook struct {
-	w          io.Writer
+// PrintHook logs the output of the rego print statements.
+type PrintHook struct {
+	logger     *logrus.Entry
 	policyName string
+	input      ast.Value
+	level      logrus.Level
+}
+
+// WithLevel sets the level the print statements are logged at.
+func (h *PrintHook) WithLevel(level logrus.Level) *PrintHook {
+	h.level = level
+	return h
+}
+
+func (h *PrintHook) Print(printContext print.Context, message string) error {
+	// fields are built only when the message is actually logged
+	if !h.logger.Logger.IsLevelEnabled(h.level) {
+		return nil
+	}
+	fields := logrus.Fields{
+		"policyName": h.policyName,
+		"userId":     inputUserID(h.input),
+	}
+	if printContext.Context != nil {
+		if routerInfo, err := openapi.GetRouterInfo(printContext.Context); err == nil {
+			fields["matchedPath"] = routerInfo.MatchedPath
+		}
+	}
+	h.logger.WithFields(fields).Log(h.level, message)
+	return nil
 }
 
-type LogPrinter struct {
-	Level      int    `json:"level"`
-	Message    string `json:"msg"`
-	Time       int64  `json:"time"`
-	PolicyName string `json:"policyName"`
+// printHookLevel returns the level the print statements are logged at: debug,
+// unless the trace level is configured.
+func printHookLevel(env config.EnvironmentVariables) logrus.Level {
+	if env.LogLevel == config.TraceLogLevel {
+		return logrus.TraceLevel
+	}
+	return logrus.DebugLevel
 }
 
-func (h printHook) Print(_ print.Context, message string) error {
-	structMessage := LogPrinter{
-		Level:      10,
-		Message:    message,
-		Time:       time.Now().UnixNano() / 1000,
-		PolicyName: h.policyName,
+// printStatementsEnabled reports whether the output of the print statements is logged,
+// which requires the debug OPA log level and a log level showing the print hook messages.
+// Otherwise the print statements are removed at compile time.
+func printStatementsEnabled(env config.EnvironmentVariables) bool {
+	if env.OPALogLevel != config.OPALogLevelDebug {
+		return false
 	}
-	msg, err := json.Marshal(structMessage)
+	level, err := logrus.ParseLevel(env.LogLevel)
 	if err != nil {
-		return err
+		return false
 	}
-	_, err = fmt.Fprintln(h.w, string(msg))
-	return err
+	return level >= printHookLevel(env)
+}
+
+// inputUserID returns the user.id field of the policy input, if any.
+func inputUserID(input ast.Value) string {
+	inputObject, ok := input.(ast.Object)
+	if !ok {
+		return ""
+	}
+	user := inputObject.Get(ast.StringTerm("user"))
+	if user == nil {
+		return ""
+	}
+	userObject, ok := user.Value.(ast.Object)
+	if !ok {
+		return ""
+	}
+	userID := userObject.Get(ast.StringTerm("id"))
+	if userID == nil {
+		return ""
+	}
+	if id, ok := userID.Value.(ast.String); ok {
+		return string(id)
+	}
+	return ""
 }
 
 func NewOPAEvaluator(ctx context.Context, policy string, opaModuleConfig *OPAModuleConfig, input []byte, env config.EnvironmentVariables) (*OPAEvaluator, error) {
-	inputTerm, err := ast.ParseTerm(string(input))
+	inputValue, err := parseRegoInput(input)
 	if err != nil {
-		return nil, fmt.Errorf("failed input parse: %v", err)
+		return nil, err
+	}
+	return NewOPAEvaluatorWithParsedInput(ctx, policy, opaModuleConfig, inputValue, env), nil
+}
+
+// NewOPAEvaluatorWithParsedInput is like NewOPAEvaluator, with the input already
+// converted to its AST value.
+func NewOPAEvaluatorWithParsedInput(ctx context.Context, policy string, opaModuleConfig *OPAModuleConfig, input ast.Value, env config.EnvironmentVariables) *OPAEvaluator {
+	options := []func(*rego.Rego){rego.ParsedInput(input)}
+	if printStatementsEnabled(env) {
+		options = append(options, rego.PrintHook(NewPrintHook(glogger.Get(ctx), policy, input).WithLevel(printHookLevel(env))))
+	}
+	return &OPAEvaluator{
+		PolicyEvaluator: newRegoQuery(policy, opaModuleConfig, env, options...),
+		PolicyName:      policy,
+		Context:         ctx,
 	}
+}
 
+func newRegoQuery(policy string, opaModuleConfig *OPAModuleConfig, env config.EnvironmentVariables, options ...func(*rego.Rego)) *rego.Rego {
 	sanitizedPolicy := strings.Replace(policy, ".", "_", -1)
 	queryString := fmt.Sprintf("data.policies.%s", sanitizedPolicy)
-	query := rego.New(
+	options = append(append([]func(*rego.Rego){
 		rego.Query(queryString),
-		rego.Module(opaModuleConfig.Name, opaModuleConfig.Content),
-		rego.ParsedInput(inputTerm.Value),
 		rego.Unknowns(Unknowns),
-		rego.Capabilities(ast.CapabilitiesForThisVersion()),
-		rego.EnablePrintStatements(env.LogLevel == config.TraceLogLevel),
-		rego.PrintHook(NewPrintHook(os.Stdout, policy)),
-		custom_builtins.GetHeaderFunction,
-		custom_builtins.MongoFindOne,
-		custom_builtins.MongoFindMany,
-	)
+		rego.Capabilities(regoCapabilitiesOrNone(env)),
+		rego.EnablePrintStatements(printStatementsEnabled(env)),
+	}, opaModuleConfig.regoModules()...), options...)
+	for _, builtin := range regoBuiltins(env, true) {
+		options = append(options, builtin.function)
+	}
+	return rego.New(options...)
+}
 
-	return &OPAEvaluator{
-		PolicyEvaluator: query,
-		PolicyName:      policy,
-		Context:         ctx,
-	}, nil
+type regoBuiltin struct {
+	decl     *ast.Builtin
+	function func(*rego.Rego)
+}
+
+// regoBuiltins returns the custom builtins made available to the policies.
+func regoBuiltins(env config.EnvironmentVariables, withMongoBuiltins bool) []regoBuiltin {
+	builtins := []regoBuiltin{
+		{decl: custom_builtins.GetHeaderDecl, function: custom_builtins.GetHeaderFunction},
+	}
+	if withMongoBuiltins {
+		builtins = append(builtins,
+			regoBuiltin{decl: custom_builtins.MongoFindOneDecl, function: custom_builtins.MongoFindOne},
+			regoBuiltin{decl: custom_builtins.MongoFindManyDecl, function: custom_builtins.MongoFindMany},
+			regoBuiltin{decl: custom_builtins.MongoFindAggregateDecl, function: custom_builtins.MongoFindAggregate},
+		)
+	}
+	if env.EnableVerifyJWTBuiltin {
+		builtins = append(builtins, regoBuiltin{decl: custom_builtins.VerifyJWTDecl, function: custom_builtins.VerifyJWT})
+	}
+	return builtins
 }
 
 func CreateQueryEvaluator(ctx context.Context, logger *logrus.Entry, req *http.Request, env config.EnvironmentVariables, policy string, input []byte, responseBody interface{}) (*OPAEvaluator, error) {
+	inputValue, err := parseRegoInput(input)
+	if err != nil {
+		logger.WithError(err).Error("failed RBAC policy creation")
+		return nil, err
+	}
+	return CreateQueryEvaluatorWithParsedInput(ctx, logger, req, env, policy, inputValue)
+}
+
+// CreateQueryEvaluatorWithParsedInput is like CreateQueryEvaluator, with the input already
+// converted to its AST value.
+func CreateQueryEvaluatorWithParsedInput(ctx context.Context, logger *logrus.Entry, req *http.Request, env config.EnvironmentVariables, policy string, input ast.Value) (*OPAEvaluator, error) {
 	opaModuleConfig, err := GetOPAModuleConfig(req.Context())
 	if err != nil {
 		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("no OPA module configuration found in context")
@@ -197,30 +636,45 @@ func CreateQueryEvaluator(ctx context.Context, logger *logrus.Entry, req *http.R
 	}).Info("Policy to be evaluated")
 
 	opaEvaluatorInstanceTime := time.Now()
-	evaluator, err := NewOPAEvaluator(ctx, policy, opaModuleConfig, input, env)
-	if err != nil {
-		logger.WithError(err).Error("failed RBAC policy creation")
-		return nil, err
+	cache, ok := GetQueryEvaluatorCache(req.Context())
+	if !ok {
+		evaluator := NewOPAEvaluatorWithParsedInput(ctx, policy, opaModuleConfig, input, env)
+		logger.Tracef("OPA evaluator instantiated in: %+v", time.Since(opaEvaluatorInstanceTime))
+		return evaluator, nil
 	}
-	logger.Tracef("OPA evaluator instantiated in: %+v", time.Since(opaEvaluatorInstanceTime))
-	return evaluator, nil
+
+	cacheKey := buildQueryEvaluatorCacheKey(policy, opaModuleConfig, env)
+	evaluator, found := cache.get(cacheKey)
+	if !found {
+		evaluator, err = newPreparedOPAEvaluator(ctx, policy, opaModuleConfig, env)
+		if err != nil {
+			logger.WithError(err).Error("failed RBAC policy creation")
+			return nil, err
+		}
+		cache.set(cacheKey, evaluator)
+	}
+	logger.WithField("cacheHit", found).Tracef("OPA evaluator instantiated in: %+v", time.Since(opaEvaluatorInstanceTime))
+	return evaluator.withInput(ctx, input, printHookLevel(env)), nil
 }
 
 func NewPartialResultEvaluator(ctx context.Context, policy string, opaModuleConfig *OPAModuleConfig, mongoClient types.IMongoClient, env config.EnvironmentVariables) (*rego.PartialResult, error) {
 	sanitizedPolicy := strings.Replace(policy, ".", "_", -1)
 	queryString := fmt.Sprintf("data.policies.%s", sanitizedPolicy)
+	capabilities, err := regoCapabilities(env)
+	if err != nil {
+		return nil, err
+	}
 
 	options := []func(*rego.Rego){
 		rego.Query(queryString),
-		rego.Module(opaModuleConfig.Name, opaModuleConfig.Content),
 		rego.Unknowns(Unknowns),
-		rego.EnablePrintStatements(env.LogLevel == config.TraceLogLevel),
-		rego.PrintHook(NewPrintHook(os.Stdout, policy)),
-		rego.Capabilities(ast.CapabilitiesForThisVersion()),
-		custom_builtins.GetHeaderFunction,
+		rego.EnablePrintStatements(printStatementsEnabled(env)),
+		rego.PrintHook(NewPrintHook(glogger.Get(ctx), policy, nil).WithLevel(printHookLevel(env))),
+		rego.Capabilities(capabilities),
 	}
-	if mongoClient != nil {
-		options = append(options, custom_builtins.MongoFindOne, custom_builtins.MongoFindMany)
+	options = append(options, opaModuleConfig.regoModules()...)
+	for _, builtin := range regoBuiltins(env, mongoClient != nil) {
+		options = append(options, builtin.function)
 	}
 	regoInstance := rego.New(options...)
 
@@ -228,17 +682,31 @@ func NewPartialResultEvaluator(ctx context.Context, policy string, opaModuleConf
 	return &results, err
 }
 
-func (partialEvaluators PartialResultsEvaluators) GetEvaluatorFromPolicy(ctx context.Context, policy string, input []byte, env config.EnvironmentVariables) (*OPAEvaluator, error) {
-	if eval, ok := partialEvaluators[policy]; ok {
-		inputTerm, err := ast.ParseTerm(string(input))
+func (partialEvaluators PartialResultsEvaluators) GetEvaluatorFromPolicy(ctx context.Context, key EvaluatorKey, input []byte, env config.EnvironmentVariables) (*OPAEvaluator, error) {
+	if _, ok := partialEvaluators[key]; !ok {
+		return nil, fmt.Errorf("policy evaluator not found")
+	}
+	inputValue, err := parseRegoInput(input)
+	if err != nil {
+		return nil, err
+	}
+	return partialEvaluators.GetEvaluatorFromPolicyWithParsedInput(ctx, key, inputValue, env)
+}
+
+// GetEvaluatorFromPolicyWithParsedInput is like GetEvaluatorFromPolicy, with the input
+// already converted to its AST value.
+func (partialEvaluators PartialResultsEvaluators) GetEvaluatorFromPolicyWithParsedInput(ctx context.Context, key EvaluatorKey, input ast.Value, env config.EnvironmentVariables) (*OPAEvaluator, error) {
+	if eval, ok := partialEvaluators[key]; ok {
+		_, policy := splitPolicyEvaluatorKey(key.PolicyName)
+		partialResult, err := eval.partialResult()
 		if err != nil {
-			return nil, fmt.Errorf("failed input parse: %v", err)
+			return nil, fmt.Errorf("failed partial evaluator creation: %s", err.Error())
 		}
 
-		evaluator := eval.PartialEvaluator.Rego(
-			rego.ParsedInput(inputTerm.Value),
-			rego.EnablePrintStatements(env.LogLevel == config.TraceLogLevel),
-			rego.PrintHook(NewPrintHook(os.Stdout, policy)),
+		evaluator := partialResult.Rego(
+			rego.ParsedInput(input),
+			rego.EnablePrintStatements(printStatementsEnabled(env)),
+			rego.PrintHook(NewPrintHook(glogger.Get(ctx), policy, input).WithLevel(printHookLevel(env))),
 		)
 
 		return &OPAEvaluator{
@@ -252,7 +720,7 @@ func (partialEvaluators PartialResultsEvaluators) GetEvaluatorFromPolicy(ctx con
 
 func (evaluator *OPAEvaluator) partiallyEvaluate(logger *logrus.Entry) (primitive.M, error) {
 	opaEvaluationTimeStart := time.Now()
-	partialResults, err := evaluator.PolicyEvaluator.Partial(evaluator.Context)
+	partialResults, err := evaluator.PolicyEvaluator.Partial(custom_builtins.WithMongoBuiltinCache(evaluator.Context))
 	if err != nil {
 		return nil, fmt.Errorf("policy Evaluation has failed when partially evaluating the query: %s", err.Error())
 	}
@@ -297,7 +765,7 @@ func (evaluator *OPAEvaluator) partiallyEvaluate(logger *logrus.Entry) (primitiv
 
 func (evaluator *OPAEvaluator) Evaluate(logger *logrus.Entry) (interface{}, error) {
 	opaEvaluationTimeStart := time.Now()
-	results, err := evaluator.PolicyEvaluator.Eval(evaluator.Context)
+	results, err := evaluator.PolicyEvaluator.Eval(custom_builtins.WithMongoBuiltinCache(evaluator.Context))
 	if err != nil {
 		return nil, fmt.Errorf("policy Evaluation has failed when evaluating the query: %s", err.Error())
 	}
@@ -365,12 +833,149 @@ func (evaluator *OPAEvaluator) PolicyEvaluation(logger *logrus.Entry, permission
 	return dataFromEvaluation, nil, nil
 }
 
+// DenyReasonPolicyName returns the name of the companion rule listing the reasons
+// why the policy denied the request, e.g. allow_deny_reason for the allow policy.
+func DenyReasonPolicyName(policy string) string {
+	return fmt.Sprintf("%s_deny_reason", policy)
+}
+
+// EvaluateDenyReasons evaluates the companion deny reason rule of the policy and returns
+// the reasons it yields. The rule can be either a set of strings or a single string;
+// no reasons are returned if the module does not define it.
+func EvaluateDenyReasons(ctx context.Context, policy string, input []byte, env config.EnvironmentVariables) ([]string, error) {
+	inputValue, err := parseRegoInput(input)
+	if err != nil {
+		return nil, err
+	}
+	return EvaluateDenyReasonsWithParsedInput(ctx, policy, inputValue, env)
+}
+
+// EvaluateDenyReasonsWithParsedInput is like EvaluateDenyReasons, with the input already
+// converted to its AST value.
+func EvaluateDenyReasonsWithParsedInput(ctx context.Context, policy string, input ast.Value, env config.EnvironmentVariables) ([]string, error) {
+	opaModuleConfig, err := GetOPAModuleConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	evaluator := NewOPAEvaluatorWithParsedInput(ctx, DenyReasonPolicyName(policy), opaModuleConfig, input, env)
+	results, err := evaluator.PolicyEvaluator.Eval(custom_builtins.WithMongoBuiltinCache(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("deny reason evaluation has failed: %s", err.Error())
+	}
+	if len(results) != 1 || len(results[0].Expressions) != 1 {
+		return nil, nil
+	}
+
+	reasons := []string{}
+	switch value := results[0].Expressions[0].Value.(type) {
+	case string:
+		reasons = append(reasons, value)
+	case []interface{}:
+		for _, item := range value {
+			if reason, ok := item.(string); ok {
+				reasons = append(reasons, reason)
+			}
+		}
+	}
+	return reasons, nil
+}
+
+// RecordLogOnlyDecision logs and counts the decision taken by a policy evaluated
+// in log-only mode, whose outcome is never enforced.
+func RecordLogOnlyDecision(ctx context.Context, logger *logrus.Entry, policyName string, allowed bool) {
+	logger.WithFields(logrus.Fields{
+		"policyName": policyName,
+		"policyMode": config.PolicyModeLogOnly,
+		"allowed":    allowed,
+	}).Info("log-only policy decision")
+
+	m, err := metrics.GetFromContext(ctx)
+	if err != nil {
+		return
+	}
+	m.PolicyLogOnlyDecisions.With(prometheus.Labels{
+		"policy_name": policyName,
+		"allowed":     strconv.FormatBool(allowed),
+	}).Inc()
+}
+
 func CreateRegoQueryInput(req *http.Request, env config.EnvironmentVariables, enableResourcePermissionsMapOptimization bool, user types.User, responseBody interface{}) ([]byte, error) {
+	requestBody, err := bufferRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	return createRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, requestBody, responseBody)
+}
+
+// CreateParsedRegoQueryInput is like CreateRegoQueryInput, but returns the input converted
+// to the AST value the evaluators are created with, avoiding to encode it as JSON.
+func CreateParsedRegoQueryInput(req *http.Request, env config.EnvironmentVariables, enableResourcePermissionsMapOptimization bool, user types.User, responseBody interface{}) (ast.Value, error) {
+	requestBody, err := bufferRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	return createParsedRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, requestBody, responseBody)
+}
+
+// bufferRequestBody reads the request body that is provided to the policies, replacing
+// req.Body so that it can be read again when the request is forwarded.
+func bufferRequestBody(req *http.Request) ([]byte, error) {
+	if !(hasJSONBodyToParse(req) || hasFormBodyToParse(req)) || req.Body == nil {
+		return nil, nil
+	}
+	bodyBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed request body parse: %s", err.Error())
+	}
+	req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	return bodyBytes, nil
+}
+
+// hasJSONBodyToParse reports whether the request body is provided to the policies: GET and
+// HEAD requests are evaluated without body, even if the client sends one.
+func hasJSONBodyToParse(req *http.Request) bool {
+	return utils.HasApplicationJSONContentType(req.Header) && hasBodyToParse(req)
+}
+
+// hasFormBodyToParse reports whether the request body is a URL encoded form provided to the
+// policies as formFields, with the same rules of the JSON bodies.
+func hasFormBodyToParse(req *http.Request) bool {
+	return utils.HasFormURLEncodedContentType(req.Header) && hasBodyToParse(req)
+}
+
+func hasBodyToParse(req *http.Request) bool {
+	return req.ContentLength > 0 &&
+		(req.Method == http.MethodPatch || req.Method == http.MethodPost || req.Method == http.MethodPut || req.Method == http.MethodDelete)
+}
+
+// createRegoQueryInput builds the JSON encoded policy input using the already read request body.
+func createRegoQueryInput(req *http.Request, env config.EnvironmentVariables, enableResourcePermissionsMapOptimization bool, user types.User, requestBody []byte, responseBody interface{}) ([]byte, error) {
+	input, err := buildRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, requestBody, responseBody)
+	if err != nil {
+		return nil, err
+	}
+	inputBytes, err := json.Marshal(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed input JSON encode: %v", err)
+	}
+	return inputBytes, nil
+}
+
+// createParsedRegoQueryInput builds the policy input AST value using the already read request body.
+func createParsedRegoQueryInput(req *http.Request, env config.EnvironmentVariables, enableResourcePermissionsMapOptimization bool, user types.User, requestBody []byte, responseBody interface{}) (ast.Value, error) {
+	input, err := buildRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, requestBody, responseBody)
+	if err != nil {
+		return nil, err
+	}
+	return input.astValue()
+}
+
+func buildRegoQueryInput(req *http.Request, env config.EnvironmentVariables, enableResourcePermissionsMapOptimization bool, user types.User, requestBody []byte, responseBody interface{}) (*Input, error) {
 	requestContext := req.Context()
 	logger := glogger.Get(requestContext)
 	opaInputCreationTime := time.Now()
 	userProperties := make(map[string]interface{})
-	_, err := utils.UnmarshalHeader(req.Header, env.UserPropertiesHeader, &userProperties)
+	_, err := utils.UnmarshalHeader(req.Header, env.UserPropertiesHeader, env.UserPropertiesHeaderBase64, &userProperties)
 	if err != nil {
 		return nil, fmt.Errorf("user properties header is not valid: %s", err.Error())
 	}
@@ -379,6 +984,9 @@ func CreateRegoQueryInput(req *http.Request, env config.EnvironmentVariables, en
 	userGroupsNotSplitted := req.Header.Get(env.UserGroupsHeader)
 	if userGroupsNotSplitted != "" {
 		userGroup = strings.Split(userGroupsNotSplitted, ",")
+	} else if env.ParseJWTInput && len(user.UserGroups) > 0 {
+		// the groups read from the JWT claims, see PARSE_JWT_INPUT
+		userGroup = user.UserGroups
 	}
 
 	var permissionsMap PermissionsOnResourceMap
@@ -389,73 +997,134 @@ func CreateRegoQueryInput(req *http.Request, env config.EnvironmentVariables, en
 		logger.WithField("resourcePermissionMapCreationTime", fmt.Sprintf("%+v", time.Since(opaPermissionsMapTime))).Tracef("resource permission map creation")
 	}
 
+	headers := req.Header
+	if permission, err := openapi.GetXPermission(requestContext); err == nil && permission != nil {
+		headers = withoutHeaders(headers, permission.Options.ExcludedInputHeaders)
+	}
+	query := req.URL.Query()
+
 	input := Input{
 		ClientType: req.Header.Get(env.ClientTypeHeader),
 		Request: InputRequest{
-			Method:     req.Method,
-			Path:       req.URL.Path,
-			Headers:    req.Header,
-			Query:      req.URL.Query(),
-			PathParams: mux.Vars(req),
+			Method:             req.Method,
+			Path:               req.URL.Path,
+			Headers:            headers,
+			HeadersLower:       firstHeaderValues(headers),
+			HeadersLowerJoined: joinedHeaderValues(headers),
+			Query:              query,
+			QueryParams:        query,
+			PathParams:         openapi.PathParams(req),
+			ClientIP:           utils.ClientIP(req, env.TrustedProxiesNetworks),
+			ForwardedFor:       utils.ForwardedFor(req),
+			TLS:                req.TLS != nil,
+			RequestID:          utils.GetRequestID(req.Context()),
+			ClientType:         req.Header.Get(env.ClientTypeHeader),
+			UpstreamHost:       env.GetUpstreamHost(req.URL.Path),
 		},
 		Response: InputResponse{
 			Body: responseBody,
 		},
 		User: InputUser{
+			ID:                     user.UserID,
 			Bindings:               user.UserBindings,
 			Roles:                  user.UserRoles,
 			Properties:             userProperties,
 			Groups:                 userGroup,
 			ResourcePermissionsMap: permissionsMap,
+			IdentitySource:         user.IdentitySource,
 		},
 	}
 
-	shouldParseJSONBody := utils.HasApplicationJSONContentType(req.Header) &&
-		req.ContentLength > 0 &&
-		(req.Method == http.MethodPatch || req.Method == http.MethodPost || req.Method == http.MethodPut || req.Method == http.MethodDelete)
-
-	if shouldParseJSONBody {
-		bodyBytes, err := io.ReadAll(req.Body)
-		if err != nil {
-			return nil, fmt.Errorf("failed request body parse: %s", err.Error())
-		}
-		if err := json.Unmarshal(bodyBytes, &input.Request.Body); err != nil {
+	// the body is parsed according to the Content-Type, routes may accept both JSON and forms
+	if hasJSONBodyToParse(req) {
+		if err := json.Unmarshal(requestBody, &input.Request.Body); err != nil {
 			return nil, fmt.Errorf("failed request body deserialization: %s", err.Error())
 		}
-		req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-	}
-	inputBytes, err := json.Marshal(input)
-	if err != nil {
-		return nil, fmt.Errorf("failed input JSON encode: %v", err)
+	} else if hasFormBodyToParse(req) {
+		// the form is parsed from the buffered body, since req.ParseForm would consume the body
+		// forwarded to the target service and mix the query parameters with the form fields
+		formFields, err := url.ParseQuery(string(requestBody))
+		if err != nil {
+			return nil, fmt.Errorf("failed request form deserialization: %s", err.Error())
+		}
+		input.Request.FormFields = formFields
 	}
 	logger.Tracef("OPA input rego creation in: %+v", time.Since(opaInputCreationTime))
-	return inputBytes, nil
+	return &input, nil
+}
+
+// permissionKeyBuffers pools the buffers used to build the permission keys, so that the key
+// of a permission already in the map is looked up without allocating.
+var permissionKeyBuffers = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, 0, 128)
+		return &buffer
+	},
 }
 
 func buildOptimizedResourcePermissionsMap(user types.User) PermissionsOnResourceMap {
-	permissionsOnResourceMap := make(PermissionsOnResourceMap, 0)
 	rolesMap := buildRolesMap(user.UserRoles)
+	permissionsOnResourceMap := make(PermissionsOnResourceMap, estimatePermissionsOnResourceCount(user, rolesMap))
+	now := time.Now()
+
+	buffer := permissionKeyBuffers.Get().(*[]byte)
+	defer permissionKeyBuffers.Put(buffer)
+	// the user bindings include the ones of the user groups, whose roles are resolved among
+	// the ones of the user
+	addBindingsPermissions(permissionsOnResourceMap, user.UserBindings, rolesMap, now, buffer)
+	return permissionsOnResourceMap
+}
+
+// estimatePermissionsOnResourceCount estimates the size of the permissions map from the
+// bindings, assuming each bound role carries the average number of permissions of the roles.
+func estimatePermissionsOnResourceCount(user types.User, rolesMap map[string][]string) int {
+	rolePermissions := 0
+	for _, permissions := range rolesMap {
+		rolePermissions += len(permissions)
+	}
+	count := 0
 	for _, binding := range user.UserBindings {
+		count += len(binding.Permissions)
+		if len(rolesMap) > 0 {
+			count += len(binding.Roles) * rolePermissions / len(rolesMap)
+		}
+	}
+	return count
+}
+
+func addBindingsPermissions(permissionsOnResourceMap PermissionsOnResourceMap, bindings []types.Binding, rolesMap map[string][]string, now time.Time, buffer *[]byte) {
+	for _, binding := range bindings {
+		if binding.IsExpired(now) {
+			continue
+		}
 		for _, role := range binding.Roles {
 			rolePermissions, ok := rolesMap[role]
 			if !ok {
 				continue
 			}
 			for _, permission := range rolePermissions {
-				key := buildPermissionOnResourceKey(permission, binding.Resource.ResourceType, binding.Resource.ResourceID)
-				permissionsOnResourceMap[key] = true
+				addPermissionOnResource(permissionsOnResourceMap, buffer, permission, binding.Resource)
 			}
 		}
 		for _, permission := range binding.Permissions {
-			key := buildPermissionOnResourceKey(permission, binding.Resource.ResourceType, binding.Resource.ResourceID)
-			permissionsOnResourceMap[key] = true
+			addPermissionOnResource(permissionsOnResourceMap, buffer, permission, binding.Resource)
 		}
 	}
-	return permissionsOnResourceMap
+}
+
+// addPermissionOnResource adds the "permission:type:id" key to the map. The key is built in
+// the buffer and converted to a string only when it is not in the map yet.
+func addPermissionOnResource(permissionsOnResourceMap PermissionsOnResourceMap, buffer *[]byte, permission string, resource *types.Resource) {
+	key := appendPermissionOnResourceKey((*buffer)[:0], permission, resource.ResourceType, resource.ResourceID)
+	*buffer = key
+	if _, ok := permissionsOnResourceMap[PermissionOnResourceKey(key)]; ok {
+		return
+	}
+	permissionsOnResourceMap[PermissionOnResourceKey(key)] = true
 }
 
 func buildRolesMap(roles []types.Role) map[string][]string {
-	var rolesMap = make(map[string][]string, 0)
+	var rolesMap = make(map[string][]string, len(roles))
 	for _, role := range roles {
 		rolesMap[role.RoleID] = role.Permissions
 	}
@@ -482,6 +1151,29 @@ type OPAModuleConfigKey struct{}
 type OPAModuleConfig struct {
 	Name    string
 	Content string
+	// Modules are the other rego modules loaded along with the policies module, such as
+	// the ones found in the subdirectories of the modules directory.
+	Modules []RegoModule
+	// Fingerprint is the hex-encoded SHA-256 of the module content, it allows to
+	// detect policy changes without comparing the whole content.
+	Fingerprint string
+	// policyModules are the modules overriding the policies module for some routes, such
+	// as the other rego files of the modules directory. They are not compiled with it.
+	policyModules map[string]RegoModule
+}
+
+type RegoModule struct {
+	Name    string
+	Content string
+}
+
+// regoModules returns the options loading the policies module and the other modules.
+func (opaModuleConfig *OPAModuleConfig) regoModules() []func(*rego.Rego) {
+	options := []func(*rego.Rego){rego.Module(opaModuleConfig.Name, opaModuleConfig.Content)}
+	for _, module := range opaModuleConfig.Modules {
+		options = append(options, rego.Module(module.Name, module.Content))
+	}
+	return options
 }
 
 func WithOPAModuleConfig(requestContext context.Context, permission *OPAModuleConfig) context.Context {
@@ -505,24 +1197,77 @@ type Input struct {
 	User       InputUser     `json:"user"`
 }
 type InputRequest struct {
-	Body       interface{}       `json:"body,omitempty"`
-	Headers    http.Header       `json:"headers,omitempty"`
-	Query      url.Values        `json:"query,omitempty"`
-	PathParams map[string]string `json:"pathParams,omitempty"`
-	Method     string            `json:"method"`
-	Path       string            `json:"path"`
+	Body               interface{}       `json:"body,omitempty"`
+	Headers            http.Header       `json:"headers,omitempty"`
+	HeadersLower       map[string]string `json:"headersLower,omitempty"`
+	HeadersLowerJoined map[string]string `json:"headersLowerJoined,omitempty"`
+	Query              url.Values        `json:"query,omitempty"`
+	// QueryParams are the query parameters as Query, which is kept for compatibility,
+	// but always set so that policies can read them without checking their presence.
+	QueryParams  map[string][]string `json:"queryParams"`
+	PathParams   map[string]string   `json:"pathParams,omitempty"`
+	Method       string              `json:"method"`
+	Path         string              `json:"path"`
+	ClientIP     string              `json:"clientIP,omitempty"`
+	ForwardedFor []string            `json:"forwardedFor,omitempty"`
+	TLS          bool                `json:"tls"`
+	RequestID    string              `json:"requestId,omitempty"`
+	ClientType   string              `json:"clientType,omitempty"`
+	// UpstreamHost is the host the request is forwarded to, see UPSTREAM_ROUTING_MAP.
+	UpstreamHost string `json:"upstreamHost,omitempty"`
+	// FormFields are the fields of the application/x-www-form-urlencoded request bodies.
+	FormFields map[string][]string `json:"formFields,omitempty"`
+}
+
+// withoutHeaders returns a copy of the headers without the excluded ones, or the headers
+// themselves if there is nothing to exclude.
+func withoutHeaders(headers http.Header, excludedHeaders []string) http.Header {
+	if len(excludedHeaders) == 0 {
+		return headers
+	}
+	filteredHeaders := headers.Clone()
+	for _, excludedHeader := range excludedHeaders {
+		filteredHeaders.Del(excludedHeader)
+	}
+	return filteredHeaders
+}
+
+// firstHeaderValues maps each lower-cased header name to its first value.
+func firstHeaderValues(headers http.Header) map[string]string {
+	lowerHeaders := make(map[string]string, len(headers))
+	for name, values := range headers {
+		if len(values) > 0 {
+			lowerHeaders[strings.ToLower(name)] = values[0]
+		}
+	}
+	return lowerHeaders
+}
+
+// joinedHeaderValues maps each lower-cased header name to its values combined
+// in a comma separated list, as described in RFC 7230 section 3.2.2.
+func joinedHeaderValues(headers http.Header) map[string]string {
+	lowerHeaders := make(map[string]string, len(headers))
+	for name, values := range headers {
+		if len(values) > 0 {
+			lowerHeaders[strings.ToLower(name)] = strings.Join(values, ", ")
+		}
+	}
+	return lowerHeaders
 }
 
 type InputResponse struct {
-	Body interface{} `json:"body,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+	StatusCode int         `json:"statusCode,omitempty"`
 }
 
 type InputUser struct {
+	ID                     string                   `json:"id"`
 	Properties             map[string]interface{}   `json:"properties,omitempty"`
 	Groups                 []string                 `json:"groups,omitempty"`
 	Bindings               []types.Binding          `json:"bindings,omitempty"`
 	Roles                  []types.Role             `json:"roles,omitempty"`
 	ResourcePermissionsMap PermissionsOnResourceMap `json:"resourcePermissionsMap,omitempty"`
+	IdentitySource         string                   `json:"identitySource,omitempty"`
 }
 
 type PermissionOnResourceKey string
@@ -530,36 +1275,150 @@ type PermissionOnResourceKey string
 type PermissionsOnResourceMap map[PermissionOnResourceKey]bool
 
 func buildPermissionOnResourceKey(permission string, resourceType string, resourceId string) PermissionOnResourceKey {
-	return PermissionOnResourceKey(fmt.Sprintf("%s:%s:%s", permission, resourceType, resourceId))
+	key := make([]byte, 0, len(permission)+len(resourceType)+len(resourceId)+2)
+	return PermissionOnResourceKey(appendPermissionOnResourceKey(key, permission, resourceType, resourceId))
 }
 
-func LoadRegoModule(rootDirectory string) (*OPAModuleConfig, error) {
-	var regoModulePath string
-	//#nosec G104 -- Produces a false positive
-	filepath.Walk(rootDirectory, func(path string, info os.FileInfo, err error) error {
+func appendPermissionOnResourceKey(key []byte, permission string, resourceType string, resourceId string) []byte {
+	key = append(key, permission...)
+	key = append(key, ':')
+	key = append(key, resourceType...)
+	key = append(key, ':')
+	return append(key, resourceId...)
+}
+
+// LoadRegoModule loads the policies module, which is the first rego file found in rootDirectory.
+// The other rego files of rootDirectory are kept as the policy modules the routes can use in its
+// place through options.policyModule, and are compiled only for the routes referencing them.
+// The rego files found in the subdirectories up to maxDepth levels deep are loaded too and kept
+// in Modules, skipping the hidden directories. The files in a subdirectory must declare the
+// package derived from its path, so that policies/authz/allow.rego in the modules directory
+// declares the package policies.authz.
+func LoadRegoModule(rootDirectory string, maxDepth int) (*OPAModuleConfig, error) {
+	var rootModulePaths []string
+	var regoModulePaths []string
+	err := filepath.Walk(rootDirectory, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if regoModulePath != "" {
+		if info.IsDir() {
+			if path == rootDirectory {
+				return nil
+			}
+			if strings.HasPrefix(info.Name(), ".") || moduleDepth(rootDirectory, path) > maxDepth {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
-		if filepath.Ext(path) == ".rego" {
-			regoModulePath = path
+		if filepath.Ext(path) != ".rego" {
+			return nil
+		}
+		if moduleDepth(rootDirectory, filepath.Dir(path)) > 0 {
+			regoModulePaths = append(regoModulePaths, path)
+		} else {
+			rootModulePaths = append(rootModulePaths, path)
 		}
 		return nil
 	})
+	if err != nil {
+		return nil, fmt.Errorf("failed rego modules directory walk: %s", err.Error())
+	}
 
-	if regoModulePath == "" {
+	if len(rootModulePaths) == 0 {
 		return nil, fmt.Errorf("no rego module found in directory")
 	}
-	fileContent, err := utils.ReadFile(regoModulePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed rego file read: %s", err.Error())
+
+	modules := make([]RegoModule, 0, len(rootModulePaths)+len(regoModulePaths))
+	for _, regoModulePath := range append(rootModulePaths, regoModulePaths...) {
+		fileContent, err := utils.ReadFile(regoModulePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed rego file read: %s", err.Error())
+		}
+		name, err := filepath.Rel(rootDirectory, regoModulePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed rego file read: %s", err.Error())
+		}
+		name = filepath.ToSlash(name)
+
+		if err := validateRegoModule(name, string(fileContent)); err != nil {
+			return nil, err
+		}
+		if err := validateRegoModulePackage(name, string(fileContent)); err != nil {
+			return nil, err
+		}
+		modules = append(modules, RegoModule{Name: name, Content: string(fileContent)})
 	}
 
+	policyModules := map[string]RegoModule{}
+	for _, module := range modules[1:len(rootModulePaths)] {
+		policyModules[module.Name] = module
+	}
 	return &OPAModuleConfig{
-		Name:    filepath.Base(regoModulePath),
-		Content: string(fileContent),
+		Name:          modules[0].Name,
+		Content:       modules[0].Content,
+		Modules:       modules[len(rootModulePaths):],
+		Fingerprint:   modulesFingerprint(modules),
+		policyModules: policyModules,
 	}, nil
 }
+
+// moduleDepth returns how many levels directory is nested in rootDirectory.
+func moduleDepth(rootDirectory, directory string) int {
+	relativePath, err := filepath.Rel(rootDirectory, directory)
+	if err != nil || relativePath == "." {
+		return 0
+	}
+	return len(strings.Split(relativePath, string(filepath.Separator)))
+}
+
+// validateRegoModulePackage checks that the module found in a subdirectory of the modules
+// directory declares the package derived from the subdirectory path.
+func validateRegoModulePackage(name, content string) error {
+	directory := path.Dir(name)
+	if directory == "." {
+		return nil
+	}
+	module, err := ast.ParseModule(name, content)
+	if err != nil || module == nil {
+		return nil
+	}
+
+	expectedPackage := "policies." + strings.ReplaceAll(directory, "/", ".")
+	modulePackage := strings.TrimPrefix(module.Package.Path.String(), "data.")
+	if modulePackage != expectedPackage {
+		return fmt.Errorf("%s: package %s does not match the module directory, expected package %s", name, modulePackage, expectedPackage)
+	}
+	return nil
+}
+
+// validateRegoModule reports the errors of the module that can be detected before its
+// policies are evaluated. Syntax errors are left to the policies compilation.
+func validateRegoModule(name, content string) error {
+	module, err := ast.ParseModule(name, content)
+	if err != nil || module == nil {
+		return nil
+	}
+	return custom_builtins.ValidateFindAggregateCalls(module)
+}
+
+func moduleFingerprint(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// modulesFingerprint returns the fingerprint of the loaded modules, which is the one of
+// the module content when a single module is loaded.
+func modulesFingerprint(modules []RegoModule) string {
+	if len(modules) == 1 {
+		return moduleFingerprint([]byte(modules[0].Content))
+	}
+	hash := sha256.New()
+	for _, module := range modules {
+		hash.Write([]byte(module.Name))
+		hash.Write([]byte{0})
+		hash.Write([]byte(module.Content))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
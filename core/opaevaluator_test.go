@@ -17,13 +17,20 @@ package core
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
-	"regexp"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/rond-authz/rond/internal/config"
 	"github.com/rond-authz/rond/internal/metrics"
@@ -33,6 +40,7 @@ import (
 	"github.com/rond-authz/rond/types"
 
 	"github.com/mia-platform/glogger/v2"
+	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/topdown/print"
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
@@ -83,6 +91,152 @@ func TestCreateRegoInput(t *testing.T) {
 			_, err := CreateRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
 			require.Error(t, err)
 		})
+
+		t.Run("allow base64-encoded userproperties header", func(t *testing.T) {
+			env := config.EnvironmentVariables{
+				UserPropertiesHeader:       "userproperties",
+				UserPropertiesHeaderBase64: true,
+			}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("userproperties", base64.StdEncoding.EncodeToString([]byte(`{"name":"gianni"}`)))
+
+			inputBytes, err := CreateRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+			require.Nil(t, err, "Unexpected error")
+			require.Contains(t, string(inputBytes), `"properties":{"name":"gianni"}`)
+		})
+	})
+
+	t.Run("user identity source", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		user := types.User{UserID: "user1", IdentitySource: config.UserIDSourceAPIKey}
+
+		inputBytes, err := CreateRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+		require.Nil(t, err, "Unexpected error")
+		require.Contains(t, string(inputBytes), `"identitySource":"api_key"`)
+	})
+
+	t.Run("lower-cased headers", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Custom-Header", "value")
+		req.Header.Add("Accept", "text/html")
+		req.Header.Add("Accept", "application/json")
+
+		inputBytes, err := CreateRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+		require.Nil(t, err, "Unexpected error")
+		var input Input
+		require.NoError(t, json.Unmarshal(inputBytes, &input))
+		require.Equal(t, []string{"value"}, input.Request.Headers["X-Custom-Header"])
+		require.Equal(t, map[string]string{
+			"x-custom-header": "value",
+			"accept":          "text/html",
+		}, input.Request.HeadersLower)
+		require.Equal(t, map[string]string{
+			"x-custom-header": "value",
+			"accept":          "text/html, application/json",
+		}, input.Request.HeadersLowerJoined)
+	})
+
+	t.Run("client network information", func(t *testing.T) {
+		trustedProxies, err := utils.ParseTrustedProxies("10.0.0.0/8")
+		require.NoError(t, err)
+		env := config.EnvironmentVariables{TrustedProxiesNetworks: trustedProxies}
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", "1.2.3.4, 198.51.100.1")
+		req.TLS = &tls.ConnectionState{}
+
+		inputBytes, err := CreateRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+		require.Nil(t, err, "Unexpected error")
+		var input Input
+		require.NoError(t, json.Unmarshal(inputBytes, &input))
+		require.Equal(t, "198.51.100.1", input.Request.ClientIP)
+		require.Equal(t, []string{"1.2.3.4", "198.51.100.1"}, input.Request.ForwardedFor)
+		require.True(t, input.Request.TLS)
+	})
+
+	t.Run("request id from context", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(utils.WithRequestID(req.Context(), "my-request-id"))
+
+		inputBytes, err := CreateRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+		require.Nil(t, err, "Unexpected error")
+		var input Input
+		require.NoError(t, json.Unmarshal(inputBytes, &input))
+		require.Equal(t, "my-request-id", input.Request.RequestID)
+	})
+
+	t.Run("client type from header", func(t *testing.T) {
+		env := config.EnvironmentVariables{ClientTypeHeader: "Client-Type"}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Client-Type", "mobile")
+
+		inputBytes, err := CreateRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+		require.Nil(t, err, "Unexpected error")
+		require.Contains(t, string(inputBytes), `"clientType":"mobile"`)
+		var input Input
+		require.NoError(t, json.Unmarshal(inputBytes, &input))
+		require.Equal(t, "mobile", input.Request.ClientType)
+		require.Equal(t, "mobile", input.ClientType)
+	})
+
+	t.Run("headers excluded by the route options", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		req.Header.Set("X-Other", "value")
+		permission := &openapi.RondConfig{Options: openapi.PermissionOptions{ExcludedInputHeaders: []string{"authorization"}}}
+		req = req.WithContext(openapi.WithXPermission(req.Context(), permission))
+
+		inputBytes, err := CreateRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+		require.Nil(t, err, "Unexpected error")
+		require.NotContains(t, string(inputBytes), "Bearer token")
+		var input Input
+		require.NoError(t, json.Unmarshal(inputBytes, &input))
+		require.Equal(t, "value", input.Request.Headers.Get("X-Other"))
+		require.Equal(t, "Bearer token", req.Header.Get("Authorization"), "the request must not be modified")
+	})
+
+	t.Run("query params", func(t *testing.T) {
+		queryParams := func(t *testing.T, target string) json.RawMessage {
+			t.Helper()
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			inputBytes, err := CreateRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+			require.NoError(t, err)
+			var input struct {
+				Request struct {
+					QueryParams json.RawMessage `json:"queryParams"`
+				} `json:"request"`
+			}
+			require.NoError(t, json.Unmarshal(inputBytes, &input))
+
+			expected, err := parseRegoInput(inputBytes)
+			require.NoError(t, err)
+			parsed, err := CreateParsedRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+			require.NoError(t, err)
+			require.Equal(t, 0, parsed.Compare(expected), "parsed input:\n%s\nJSON input:\n%s", parsed, expected)
+			return input.Request.QueryParams
+		}
+
+		require.JSONEq(t, `{"scope":["admin"],"tag":["a","b"]}`, string(queryParams(t, "/?scope=admin&tag=a&tag=b")))
+		require.Equal(t, "{}", string(queryParams(t, "/")))
+	})
+
+	t.Run("user groups from JWT claims when header is missing", func(t *testing.T) {
+		env := config.EnvironmentVariables{UserGroupsHeader: "thegroupsheader", ParseJWTInput: true}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		user := types.User{UserID: "user42", UserGroups: []string{"editors"}}
+
+		inputBytes, err := CreateRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+		require.Nil(t, err, "Unexpected error")
+		var input Input
+		require.NoError(t, json.Unmarshal(inputBytes, &input))
+		require.Equal(t, []string{"editors"}, input.User.Groups)
+
+		req.Header.Set("thegroupsheader", "admins")
+		inputBytes, err = CreateRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+		require.Nil(t, err, "Unexpected error")
+		require.NoError(t, json.Unmarshal(inputBytes, &input))
+		require.Equal(t, []string{"admins"}, input.User.Groups)
 	})
 
 	t.Run("body integration", func(t *testing.T) {
@@ -101,6 +255,17 @@ func TestCreateRegoInput(t *testing.T) {
 			require.True(t, !strings.Contains(string(inputBytes), fmt.Sprintf(`"body":%s`, expectedRequestBody)))
 		})
 
+		t.Run("ignored on methods GET and HEAD with json content-type", func(t *testing.T) {
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				req := httptest.NewRequest(method, "/", bytes.NewReader(reqBodyBytes))
+				req.Header.Set(utils.ContentTypeHeaderKey, "application/json")
+
+				inputBytes, err := CreateRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+				require.Nil(t, err, "Unexpected error")
+				require.True(t, !strings.Contains(string(inputBytes), fmt.Sprintf(`"body":%s`, expectedRequestBody)), "Unexpected body for method %s", method)
+			}
+		})
+
 		t.Run("ignore nil body on method POST", func(t *testing.T) {
 			req := httptest.NewRequest(http.MethodPost, "/", nil)
 			req.Header.Set(utils.ContentTypeHeaderKey, "application/json")
@@ -148,6 +313,109 @@ func TestCreateRegoInput(t *testing.T) {
 			require.True(t, !strings.Contains(string(inputBytes), fmt.Sprintf(`"body":%s`, expectedRequestBody)))
 		})
 	})
+
+	t.Run("form fields", func(t *testing.T) {
+		formBody := "username=alice&role=admin&scope=read&scope=write"
+
+		t.Run("added on URL encoded bodies", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/login?role=guest", strings.NewReader(formBody))
+			req.Header.Set(utils.ContentTypeHeaderKey, "application/x-www-form-urlencoded")
+
+			inputBytes, err := CreateRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+			require.NoError(t, err)
+			input := map[string]interface{}{}
+			require.NoError(t, json.Unmarshal(inputBytes, &input))
+			request := input["request"].(map[string]interface{})
+			require.Equal(t, map[string]interface{}{
+				"username": []interface{}{"alice"},
+				"role":     []interface{}{"admin"},
+				"scope":    []interface{}{"read", "write"},
+			}, request["formFields"], "the query parameters must not be mixed with the form fields")
+			require.NotContains(t, request, "body")
+
+			forwardedBody, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			require.Equal(t, formBody, string(forwardedBody), "the body must still be forwarded")
+		})
+
+		t.Run("ignored on method GET", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/login", strings.NewReader(formBody))
+			req.Header.Set(utils.ContentTypeHeaderKey, "application/x-www-form-urlencoded")
+
+			inputBytes, err := CreateRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+			require.NoError(t, err)
+			require.NotContains(t, string(inputBytes), "formFields")
+		})
+
+		t.Run("ignored on JSON bodies", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"alice"}`))
+			req.Header.Set(utils.ContentTypeHeaderKey, "application/json")
+
+			inputBytes, err := CreateRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+			require.NoError(t, err)
+			require.NotContains(t, string(inputBytes), "formFields")
+			require.Contains(t, string(inputBytes), `"body":{"username":"alice"}`)
+		})
+
+		t.Run("reject invalid URL encoded bodies", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("username=%zz"))
+			req.Header.Set(utils.ContentTypeHeaderKey, "application/x-www-form-urlencoded")
+
+			_, err := CreateRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+			require.ErrorContains(t, err, "failed request form deserialization")
+		})
+
+		t.Run("parsed input", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(formBody))
+			req.Header.Set(utils.ContentTypeHeaderKey, "application/x-www-form-urlencoded")
+			inputBytes, err := CreateRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+			require.NoError(t, err)
+			expected, err := parseRegoInput(inputBytes)
+			require.NoError(t, err)
+
+			req = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(formBody))
+			req.Header.Set(utils.ContentTypeHeaderKey, "application/x-www-form-urlencoded")
+			parsed, err := CreateParsedRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+			require.NoError(t, err)
+			require.Equal(t, 0, parsed.Compare(expected), "parsed input:\n%s\nJSON input:\n%s", parsed, expected)
+		})
+	})
+}
+
+func TestClientTypePolicy(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	logger := logrus.NewEntry(log)
+	env := config.EnvironmentVariables{ClientTypeHeader: "Client-Type"}
+
+	opaModuleConfig, err := LoadRegoModule("../mocks/rego-policies", 5)
+	require.NoError(t, err)
+	partialEvaluator, err := createPartialEvaluator("is_mobile_client", context.Background(), nil, nil, opaModuleConfig, env)
+	require.NoError(t, err)
+	partialEvaluators := PartialResultsEvaluators{{PolicyName: "is_mobile_client"}: *partialEvaluator}
+
+	evaluate := func(t *testing.T, clientType string) error {
+		t.Helper()
+		ctx := createContext(t, context.Background(), env, nil, &openapi.RondConfig{
+			RequestFlow: openapi.RequestFlow{PolicyName: "is_mobile_client"},
+		}, opaModuleConfig, partialEvaluators)
+		req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		req.Header.Set("Client-Type", clientType)
+
+		inputBytes, err := CreateRegoQueryInput(req, env, false, types.User{}, nil)
+		require.NoError(t, err)
+		evaluator, err := partialEvaluators.GetEvaluatorFromPolicy(ctx, EvaluatorKey{PolicyName: "is_mobile_client"}, inputBytes, env)
+		require.NoError(t, err)
+		_, err = evaluator.Evaluate(logger)
+		return err
+	}
+
+	t.Run("allows mobile clients", func(t *testing.T) {
+		require.NoError(t, evaluate(t, "mobile"))
+	})
+
+	t.Run("denies other clients", func(t *testing.T) {
+		require.Error(t, evaluate(t, "web"))
+	})
 }
 
 func TestCreatePolicyEvaluators(t *testing.T) {
@@ -162,10 +430,10 @@ func TestCreatePolicyEvaluators(t *testing.T) {
 		openApiSpec, err := openapi.LoadOASFromFileOrNetwork(log, envs)
 		require.NoError(t, err, "unexpected error")
 
-		opaModuleConfig, err := LoadRegoModule(envs.OPAModulesDirectory)
+		opaModuleConfig, err := LoadRegoModule(envs.OPAModulesDirectory, envs.OPAMaxModuleDepth)
 		require.NoError(t, err, "unexpected error")
 
-		policyEvals, err := SetupEvaluators(ctx, nil, openApiSpec, opaModuleConfig, envs)
+		policyEvals, _, err := SetupEvaluators(ctx, nil, openApiSpec, opaModuleConfig, envs)
 		require.NoError(t, err, "unexpected error creating evaluators")
 		require.Len(t, policyEvals, 4, "unexpected length")
 	})
@@ -181,13 +449,544 @@ func TestCreatePolicyEvaluators(t *testing.T) {
 		openApiSpec, err := openapi.LoadOASFromFileOrNetwork(log, envs)
 		require.NoError(t, err, "unexpected error")
 
-		opaModuleConfig, err := LoadRegoModule(envs.OPAModulesDirectory)
+		opaModuleConfig, err := LoadRegoModule(envs.OPAModulesDirectory, envs.OPAMaxModuleDepth)
 		require.NoError(t, err, "unexpected error")
 
-		policyEvals, err := SetupEvaluators(ctx, nil, openApiSpec, opaModuleConfig, envs)
+		policyEvals, _, err := SetupEvaluators(ctx, nil, openApiSpec, opaModuleConfig, envs)
 		require.NoError(t, err, "unexpected error creating evaluators")
 		require.Len(t, policyEvals, 4, "unexpected length")
 	})
+
+	t.Run("returns setup errors of the failed policies", func(t *testing.T) {
+		log, _ := test.NewNullLogger()
+		ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+
+		openApiSpec := &openapi.OpenAPISpec{
+			Paths: openapi.OpenAPIPaths{
+				"/users": openapi.PathVerbs{
+					"get": openapi.VerbConfig{
+						PermissionV2: &openapi.RondConfig{
+							RequestFlow: openapi.RequestFlow{PolicyName: "allow"},
+						},
+					},
+				},
+				"/books": openapi.PathVerbs{
+					"post": openapi.VerbConfig{
+						PermissionV2: &openapi.RondConfig{
+							RequestFlow: openapi.RequestFlow{PolicyName: "invalid-policy"},
+						},
+					},
+				},
+			},
+		}
+		opaModuleConfig := &OPAModuleConfig{
+			Name: "example.rego",
+			Content: `package policies
+			allow { true }`,
+		}
+
+		policyEvals, setupErrors, err := SetupEvaluators(ctx, nil, openApiSpec, opaModuleConfig, config.EnvironmentVariables{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "error during evaluator creation: post /books: policy invalid-policy:")
+
+		require.Len(t, setupErrors, 1)
+		require.Equal(t, "/books", setupErrors[0].RoutePath)
+		require.Equal(t, "post", setupErrors[0].Method)
+		require.Equal(t, "invalid-policy", setupErrors[0].PolicyName)
+		require.Error(t, setupErrors[0].Cause)
+		require.ErrorIs(t, setupErrors[0], setupErrors[0].Cause)
+
+		require.Len(t, policyEvals, 1)
+		require.Contains(t, policyEvals, EvaluatorKey{PolicyName: "allow"})
+	})
+}
+
+func TestSetupEvaluatorsLazyInit(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+	env := config.EnvironmentVariables{LazyEvaluatorInit: true}
+
+	openApiSpec := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow"}},
+				},
+			},
+			"/books": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{
+						RequestFlow:  openapi.RequestFlow{PolicyName: "allow_books"},
+						ResponseFlow: openapi.ResponseFlow{PolicyName: "invalid-policy"},
+					},
+				},
+			},
+		},
+	}
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		allow { true }
+		allow_books { true }`,
+	}
+
+	t.Run("defers compilation to first use", func(t *testing.T) {
+		policyEvals, setupErrors, err := SetupEvaluators(ctx, nil, openApiSpec, opaModuleConfig, env)
+		require.NoError(t, err)
+		require.Empty(t, setupErrors)
+		require.Len(t, policyEvals, 3)
+		require.False(t, policyEvals.Compiled(EvaluatorKey{PolicyName: "allow"}))
+		require.False(t, policyEvals.Compiled(EvaluatorKey{PolicyName: "allow_books"}))
+
+		errs := make([]error, 4)
+		var wg sync.WaitGroup
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = policyEvals.GetEvaluatorFromPolicy(ctx, EvaluatorKey{PolicyName: "allow"}, []byte(`{}`), env)
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			require.NoError(t, err)
+		}
+		require.True(t, policyEvals.Compiled(EvaluatorKey{PolicyName: "allow"}))
+		require.False(t, policyEvals.Compiled(EvaluatorKey{PolicyName: "allow_books"}))
+	})
+
+	t.Run("reports failed compilation on first use", func(t *testing.T) {
+		policyEvals, _, err := SetupEvaluators(ctx, nil, openApiSpec, opaModuleConfig, env)
+		require.NoError(t, err)
+
+		_, err = policyEvals.GetEvaluatorFromPolicy(ctx, EvaluatorKey{PolicyName: "invalid-policy"}, []byte(`{}`), env)
+		require.ErrorContains(t, err, "failed partial evaluator creation")
+		require.False(t, policyEvals.Compiled(EvaluatorKey{PolicyName: "invalid-policy"}))
+	})
+
+	t.Run("warmup compiles all the evaluators", func(t *testing.T) {
+		policyEvals, _, err := SetupEvaluators(ctx, nil, openApiSpec, opaModuleConfig, env)
+		require.NoError(t, err)
+
+		err = policyEvals.Warmup()
+		require.ErrorContains(t, err, "error during evaluator creation: policy invalid-policy:")
+		require.True(t, policyEvals.Compiled(EvaluatorKey{PolicyName: "allow"}))
+		require.True(t, policyEvals.Compiled(EvaluatorKey{PolicyName: "allow_books"}))
+	})
+
+	t.Run("evaluators are compiled at setup by default", func(t *testing.T) {
+		policyEvals, _, err := SetupEvaluators(ctx, nil, openApiSpec, opaModuleConfig, config.EnvironmentVariables{})
+		require.Error(t, err)
+		require.True(t, policyEvals.Compiled(EvaluatorKey{PolicyName: "allow"}))
+		require.NoError(t, policyEvals.Warmup())
+	})
+}
+
+func TestPartialResultsEvaluatorsPreWarm(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+	oas, opaModuleConfig := syntheticOASAndPolicies(10, 10)
+
+	t.Run("pre-warm on startup defers the compilation", func(t *testing.T) {
+		env := config.EnvironmentVariables{PreWarmOnStartup: true, EvaluatorSetupWorkers: 4}
+		policyEvals, _, err := SetupEvaluators(ctx, nil, oas, opaModuleConfig, env)
+		require.NoError(t, err)
+		require.False(t, policyEvals.Compiled(EvaluatorKey{PolicyName: "allow_0"}))
+
+		require.NoError(t, policyEvals.PreWarm(EvaluatorSetupWorkers(env)))
+		for policy := range policyEvals {
+			require.True(t, policyEvals.Compiled(policy), policy)
+		}
+	})
+
+	t.Run("reports the failed evaluators", func(t *testing.T) {
+		invalidOAS := &openapi.OpenAPISpec{Paths: openapi.OpenAPIPaths{
+			"/invalid": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "invalid-policy"}},
+				},
+			},
+		}}
+		policyEvals, _, err := SetupEvaluators(ctx, nil, invalidOAS, opaModuleConfig, config.EnvironmentVariables{PreWarmOnStartup: true})
+		require.NoError(t, err)
+
+		err = policyEvals.PreWarm(0)
+		require.ErrorContains(t, err, "error during evaluator creation: policy invalid-policy:")
+	})
+
+	t.Run("first request is faster when pre-warmed", func(t *testing.T) {
+		firstRequestDuration := func(t *testing.T, preWarm bool) time.Duration {
+			t.Helper()
+			env := config.EnvironmentVariables{LazyEvaluatorInit: true}
+			policyEvals, _, err := SetupEvaluators(ctx, nil, oas, opaModuleConfig, env)
+			require.NoError(t, err)
+			if preWarm {
+				require.NoError(t, policyEvals.PreWarm(EvaluatorSetupWorkers(env)))
+			}
+
+			start := time.Now()
+			evaluator, err := policyEvals.GetEvaluatorFromPolicy(ctx, EvaluatorKey{PolicyName: "allow_3"}, []byte(`{"request":{"headers":{"x-policy":["3"]}}}`), env)
+			require.NoError(t, err)
+			_, err = evaluator.PolicyEvaluator.Partial(ctx)
+			require.NoError(t, err)
+			return time.Since(start)
+		}
+
+		lazyDuration := firstRequestDuration(t, false)
+		preWarmedDuration := firstRequestDuration(t, true)
+		require.Less(t, preWarmedDuration, lazyDuration)
+	})
+}
+
+// syntheticOASAndPolicies builds a spec with the given number of paths, each referencing one
+// of policiesCount allow policies and sharing the same response policy.
+func syntheticOASAndPolicies(paths, policiesCount int) (*openapi.OpenAPISpec, *OPAModuleConfig) {
+	oas := &openapi.OpenAPISpec{Paths: openapi.OpenAPIPaths{}}
+	for i := 0; i < paths; i++ {
+		oas.Paths[fmt.Sprintf("/resource-%d/{id}", i)] = openapi.PathVerbs{
+			"get": openapi.VerbConfig{
+				PermissionV2: &openapi.RondConfig{
+					RequestFlow:  openapi.RequestFlow{PolicyName: fmt.Sprintf("allow_%d", i%policiesCount)},
+					ResponseFlow: openapi.ResponseFlow{PolicyName: "filter_response"},
+				},
+			},
+		}
+	}
+
+	var content strings.Builder
+	content.WriteString("package policies\n")
+	for i := 0; i < policiesCount; i++ {
+		fmt.Fprintf(&content, "allow_%d { input.request.headers[\"x-policy\"][0] == \"%d\" }\n", i, i)
+	}
+	content.WriteString("filter_response [body] { body := input.response.body }\n")
+	return oas, &OPAModuleConfig{Name: "example.rego", Content: content.String()}
+}
+
+func TestSetupEvaluatorsParallel(t *testing.T) {
+	t.Run("compiles each distinct policy exactly once", func(t *testing.T) {
+		log, hook := test.NewNullLogger()
+		ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+		oas, opaModuleConfig := syntheticOASAndPolicies(200, 20)
+
+		policyEvals, setupErrors, err := SetupEvaluators(ctx, nil, oas, opaModuleConfig, config.EnvironmentVariables{})
+		require.NoError(t, err)
+		require.Empty(t, setupErrors)
+		require.Len(t, policyEvals, 21)
+
+		compilations := map[string]int{}
+		for _, entry := range hook.AllEntries() {
+			if policy := strings.TrimPrefix(entry.Message, "precomputing rego query for allow policy: "); policy != entry.Message {
+				compilations[policy]++
+			}
+		}
+		require.Len(t, compilations, 21)
+		for policy, count := range compilations {
+			require.Equal(t, 1, count, policy)
+		}
+
+		_, err = policyEvals.GetEvaluatorFromPolicy(ctx, EvaluatorKey{PolicyName: "allow_3"}, []byte(`{}`), config.EnvironmentVariables{})
+		require.NoError(t, err)
+	})
+
+	t.Run("collects all the failures deterministically", func(t *testing.T) {
+		log, _ := test.NewNullLogger()
+		ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+		oas, opaModuleConfig := syntheticOASAndPolicies(10, 5)
+		for i := 0; i < 4; i++ {
+			oas.Paths[fmt.Sprintf("/missing-%d", i)] = openapi.PathVerbs{
+				"post": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{
+						RequestFlow: openapi.RequestFlow{PolicyName: fmt.Sprintf("invalid-policy-%d", i%2)},
+					},
+				},
+			}
+		}
+
+		policyEvals, setupErrors, err := SetupEvaluators(ctx, nil, oas, opaModuleConfig, config.EnvironmentVariables{})
+		require.Error(t, err)
+		require.Len(t, policyEvals, 6)
+		require.Len(t, setupErrors, 4)
+		for i, setupError := range setupErrors {
+			require.Equal(t, fmt.Sprintf("/missing-%d", i), setupError.RoutePath)
+			require.Equal(t, fmt.Sprintf("invalid-policy-%d", i%2), setupError.PolicyName)
+		}
+
+		for i := 0; i < 5; i++ {
+			_, _, otherErr := SetupEvaluators(ctx, nil, oas, opaModuleConfig, config.EnvironmentVariables{})
+			require.EqualError(t, otherErr, err.Error())
+		}
+	})
+}
+
+func TestSetupEvaluatorsSharedPolicy(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+	env := config.EnvironmentVariables{}
+
+	sharedPermission := &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow_owner"}}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users": openapi.PathVerbs{"get": openapi.VerbConfig{PermissionV2: sharedPermission}},
+			"/books": openapi.PathVerbs{"get": openapi.VerbConfig{PermissionV2: sharedPermission}},
+		},
+	}
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		allow_owner { input.request.headersLower["x-owner"] == input.user.id }`,
+	}
+
+	policyEvals, _, err := SetupEvaluators(ctx, nil, oas, opaModuleConfig, env)
+	require.NoError(t, err)
+	require.Len(t, policyEvals, 1)
+
+	type evaluation struct {
+		path, owner, user string
+		err               error
+	}
+	evaluations := make([]evaluation, 40)
+	var wg sync.WaitGroup
+	for i := range evaluations {
+		evaluations[i] = evaluation{
+			path:  []string{"/users", "/books"}[i%2],
+			owner: fmt.Sprintf("user-%d", i),
+			user:  fmt.Sprintf("user-%d", i-i%3),
+		}
+		requestCtx := createContext(t, context.Background(), env, nil, sharedPermission, opaModuleConfig, policyEvals)
+		wg.Add(1)
+		go func(e *evaluation) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, e.path, nil).WithContext(requestCtx)
+			req.Header.Set("x-owner", e.owner)
+			input, err := CreateRegoQueryInput(req, env, false, types.User{UserID: e.user}, nil)
+			if err != nil {
+				e.err = err
+				return
+			}
+			evaluator, err := policyEvals.GetEvaluatorFromPolicy(requestCtx, EvaluatorKey{PolicyName: "allow_owner"}, input, env)
+			if err != nil {
+				e.err = err
+				return
+			}
+			_, e.err = evaluator.Evaluate(logrus.NewEntry(log))
+		}(&evaluations[i])
+	}
+	wg.Wait()
+
+	for _, e := range evaluations {
+		if e.owner == e.user {
+			require.NoError(t, e.err, "%s %s", e.path, e.owner)
+		} else {
+			require.Error(t, e.err, "%s %s", e.path, e.owner)
+		}
+	}
+}
+
+func BenchmarkSetupEvaluatorsSharedPolicy(b *testing.B) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+	oas, opaModuleConfig := syntheticOASAndPolicies(500, 1)
+
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		policyEvals, _, err := SetupEvaluators(ctx, nil, oas, opaModuleConfig, config.EnvironmentVariables{})
+		require.NoError(b, err)
+		require.Len(b, policyEvals, 2)
+	}
+}
+
+func BenchmarkSetupEvaluators(b *testing.B) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+	oas, opaModuleConfig := syntheticOASAndPolicies(500, 50)
+	policies := make([]string, 0, 51)
+	for i := 0; i < 50; i++ {
+		policies = append(policies, fmt.Sprintf("allow_%d", i))
+	}
+	policies = append(policies, "filter_response")
+
+	for name, workers := range map[string]int{"sequential": 1, "parallel": runtime.GOMAXPROCS(0)} {
+		workers := workers
+		b.Run(name, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				failedPolicies := createPartialEvaluators(ctx, workers, policies, nil, oas, opaModuleConfig, config.EnvironmentVariables{}, PartialResultsEvaluators{})
+				require.Empty(b, failedPolicies)
+			}
+		})
+	}
+}
+
+func TestLoadRegoModuleFingerprint(t *testing.T) {
+	directory := t.TempDir()
+	regoPath := filepath.Join(directory, "policies.rego")
+	require.NoError(t, os.WriteFile(regoPath, []byte("package policies\nallow { true }\n"), 0600))
+
+	first, err := LoadRegoModule(directory, 0)
+	require.NoError(t, err)
+	require.Len(t, first.Fingerprint, 64)
+
+	second, err := LoadRegoModule(directory, 0)
+	require.NoError(t, err)
+	require.Equal(t, first.Fingerprint, second.Fingerprint)
+
+	require.NoError(t, os.WriteFile(regoPath, []byte("package policies\nallow { false }\n"), 0600))
+	changed, err := LoadRegoModule(directory, 0)
+	require.NoError(t, err)
+	require.NotEqual(t, first.Fingerprint, changed.Fingerprint)
+}
+
+func TestLoadRegoModuleFindAggregateValidation(t *testing.T) {
+	directory := t.TempDir()
+	regoPath := filepath.Join(directory, "policies.rego")
+
+	t.Run("loads module with allowed stages", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(regoPath, []byte(`package policies
+allow {
+	members := find_aggregate("projects", [{"$match": {"projectId": input.request.pathParams.projectId}}, {"$lookup": {"from": "teams", "localField": "teamId", "foreignField": "teamId", "as": "team"}}])
+	count(members) > 0
+}
+`), 0600))
+		_, err := LoadRegoModule(directory, 0)
+		require.NoError(t, err)
+	})
+
+	t.Run("fails with disallowed stages", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(regoPath, []byte(`package policies
+allow {
+	docs := find_aggregate("projects", [{"$match": {}}, {"$out": "copy"}])
+	count(docs) > 0
+}
+`), 0600))
+		_, err := LoadRegoModule(directory, 0)
+		require.EqualError(t, err, "policies.rego:3: invalid find_aggregate pipeline: stage 1: $out is not allowed")
+	})
+}
+
+func TestLoadRegoModuleSubdirectories(t *testing.T) {
+	directory := t.TempDir()
+	writeModule := func(t *testing.T, name, content string) {
+		t.Helper()
+		modulePath := filepath.Join(directory, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(modulePath), 0700))
+		require.NoError(t, os.WriteFile(modulePath, []byte(content), 0600))
+	}
+	writeModule(t, "policies.rego", `package policies
+allow {
+	data.policies.authz.is_admin
+	data.policies.authz.rules.is_get
+}
+`)
+	writeModule(t, "authz/admin.rego", `package policies.authz
+is_admin {
+	input.user.id == "admin"
+}
+`)
+	writeModule(t, "authz/rules/method.rego", `package policies.authz.rules
+is_get {
+	input.request.method == "GET"
+}
+`)
+	writeModule(t, ".hidden/broken.rego", `package policies.hidden`)
+
+	evaluate := func(t *testing.T, opaModuleConfig *OPAModuleConfig, input string) error {
+		t.Helper()
+		ctx := createContext(t, context.Background(), config.EnvironmentVariables{}, nil, &openapi.RondConfig{}, opaModuleConfig, nil)
+		evaluator, err := NewOPAEvaluator(ctx, "allow", opaModuleConfig, []byte(input), config.EnvironmentVariables{})
+		require.NoError(t, err)
+		_, err = evaluator.Evaluate(logrus.NewEntry(logrus.New()))
+		return err
+	}
+
+	t.Run("loads the modules of the subdirectories", func(t *testing.T) {
+		opaModuleConfig, err := LoadRegoModule(directory, 5)
+		require.NoError(t, err)
+		require.Equal(t, "policies.rego", opaModuleConfig.Name)
+		require.Equal(t, []string{"authz/admin.rego", "authz/rules/method.rego"}, []string{opaModuleConfig.Modules[0].Name, opaModuleConfig.Modules[1].Name})
+
+		require.NoError(t, evaluate(t, opaModuleConfig, `{"user":{"id":"admin"},"request":{"method":"GET"}}`))
+		require.Error(t, evaluate(t, opaModuleConfig, `{"user":{"id":"admin"},"request":{"method":"POST"}}`))
+		require.Error(t, evaluate(t, opaModuleConfig, `{"user":{"id":"user1"},"request":{"method":"GET"}}`))
+	})
+
+	t.Run("skips the directories deeper than the limit", func(t *testing.T) {
+		opaModuleConfig, err := LoadRegoModule(directory, 1)
+		require.NoError(t, err)
+		require.Len(t, opaModuleConfig.Modules, 1)
+		require.Equal(t, "authz/admin.rego", opaModuleConfig.Modules[0].Name)
+
+		opaModuleConfig, err = LoadRegoModule(directory, 0)
+		require.NoError(t, err)
+		require.Empty(t, opaModuleConfig.Modules)
+	})
+
+	t.Run("fingerprint changes with the modules of the subdirectories", func(t *testing.T) {
+		first, err := LoadRegoModule(directory, 5)
+		require.NoError(t, err)
+
+		writeModule(t, "authz/rules/method.rego", `package policies.authz.rules
+is_get {
+	input.request.method == "HEAD"
+}
+`)
+		changed, err := LoadRegoModule(directory, 5)
+		require.NoError(t, err)
+		require.NotEqual(t, first.Fingerprint, changed.Fingerprint)
+	})
+
+	t.Run("keeps the other modules of the root directory as policy modules", func(t *testing.T) {
+		withoutOther, err := LoadRegoModule(directory, 5)
+		require.NoError(t, err)
+
+		writeModule(t, "z_other.rego", `package other
+other { true }
+`)
+		defer os.Remove(filepath.Join(directory, "z_other.rego"))
+
+		for _, maxDepth := range []int{0, 5} {
+			opaModuleConfig, err := LoadRegoModule(directory, maxDepth)
+			require.NoError(t, err)
+			require.Equal(t, "policies.rego", opaModuleConfig.Name)
+			for _, module := range opaModuleConfig.Modules {
+				require.NotEqual(t, "z_other.rego", module.Name, "policy modules are not compiled with the policies module")
+			}
+			require.Contains(t, opaModuleConfig.policyModules, "z_other.rego")
+		}
+
+		withOther, err := LoadRegoModule(directory, 5)
+		require.NoError(t, err)
+		require.NotEqual(t, withoutOther.Fingerprint, withOther.Fingerprint)
+	})
+
+	t.Run("fails with package not matching the directory", func(t *testing.T) {
+		writeModule(t, "authz/other.rego", `package policies.other
+other { true }
+`)
+		defer os.Remove(filepath.Join(directory, "authz", "other.rego"))
+
+		_, err := LoadRegoModule(directory, 5)
+		require.EqualError(t, err, "authz/other.rego: package policies.other does not match the module directory, expected package policies.authz")
+	})
+}
+
+func TestVerifyJWTBuiltinRegistration(t *testing.T) {
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		allow {
+			claims := verify_jwt(input.request.headers["X-Secondary-Token"][0], "my-secret")
+			claims.sub == "secondary-user"
+		}`,
+	}
+
+	t.Run("builtin is disabled by default", func(t *testing.T) {
+		_, err := NewPartialResultEvaluator(context.Background(), "allow", opaModuleConfig, nil, config.EnvironmentVariables{})
+		require.ErrorContains(t, err, "undefined function verify_jwt")
+	})
+
+	t.Run("builtin is registered when enabled", func(t *testing.T) {
+		_, err := NewPartialResultEvaluator(context.Background(), "allow", opaModuleConfig, nil, config.EnvironmentVariables{EnableVerifyJWTBuiltin: true})
+		require.NoError(t, err)
+	})
 }
 
 func TestBuildRolesMap(t *testing.T) {
@@ -263,6 +1062,109 @@ func TestBuildOptimizedResourcePermissionsMap(t *testing.T) {
 	}
 	require.Equal(t, expected, result)
 }
+
+func TestBuildOptimizedResourcePermissionsMapWithDuplicatedPermissions(t *testing.T) {
+	user := types.User{
+		UserRoles: []types.Role{{RoleID: "role1", Permissions: []string{"permission1"}}},
+		UserBindings: []types.Binding{
+			{Resource: &types.Resource{ResourceType: "type1", ResourceID: "resource1"}, Roles: []string{"role1"}, Permissions: []string{"permission1"}},
+			{Resource: &types.Resource{ResourceType: "type1"}, Permissions: []string{"permission1"}},
+			{Resource: &types.Resource{ResourceType: "type1", ResourceID: "resource1"}, Groups: []string{"group1"}, Roles: []string{"role1"}},
+		},
+	}
+	require.Equal(t, PermissionsOnResourceMap{
+		"permission1:type1:resource1": true,
+		"permission1:type1:":          true,
+	}, buildOptimizedResourcePermissionsMap(user))
+	require.Equal(t, PermissionOnResourceKey("permission1:type1:resource1"), buildPermissionOnResourceKey("permission1", "type1", "resource1"))
+}
+
+func TestBuildOptimizedResourcePermissionsMapWithExpiredBindings(t *testing.T) {
+	expiredAt := time.Now().Add(-time.Hour)
+	expiresAt := time.Now().Add(time.Hour)
+	user := types.User{
+		UserRoles: []types.Role{
+			{
+				RoleID:      "role1",
+				Permissions: []string{"permission1"},
+			},
+		},
+		UserBindings: []types.Binding{
+			{
+				Resource: &types.Resource{
+					ResourceType: "type1",
+					ResourceID:   "resource1",
+				},
+				Roles:       []string{"role1"},
+				Permissions: []string{"permission2"},
+				ExpiresAt:   &expiresAt,
+			},
+			{
+				Resource: &types.Resource{
+					ResourceType: "type2",
+					ResourceID:   "resource2",
+				},
+				Roles:       []string{"role1"},
+				Permissions: []string{"permission3"},
+				ExpiresAt:   &expiredAt,
+			},
+		},
+	}
+	result := buildOptimizedResourcePermissionsMap(user)
+	expected := PermissionsOnResourceMap{
+		"permission1:type1:resource1": true,
+		"permission2:type1:resource1": true,
+	}
+	require.Equal(t, expected, result)
+}
+
+func TestBuildOptimizedResourcePermissionsMapWithGroupBindings(t *testing.T) {
+	expiredAt := time.Now().Add(-time.Hour)
+	user := types.User{
+		UserGroups: []string{"group1"},
+		UserRoles: []types.Role{
+			{
+				RoleID:      "reader",
+				Permissions: []string{"read"},
+			},
+		},
+		UserBindings: []types.Binding{
+			{
+				Resource: &types.Resource{
+					ResourceType: "document",
+					ResourceID:   "doc1",
+				},
+				Groups: []string{"group1"},
+				Roles:  []string{"reader"},
+			},
+			{
+				Resource: &types.Resource{
+					ResourceType: "document",
+					ResourceID:   "doc2",
+				},
+				Groups:      []string{"group1"},
+				Roles:       []string{"unknown-role"},
+				Permissions: []string{"write"},
+			},
+			{
+				Resource: &types.Resource{
+					ResourceType: "document",
+					ResourceID:   "doc3",
+				},
+				Groups:      []string{"group1"},
+				Permissions: []string{"delete"},
+				ExpiresAt:   &expiredAt,
+			},
+		},
+	}
+	result := buildOptimizedResourcePermissionsMap(user)
+	expected := PermissionsOnResourceMap{
+		"read:document:doc1":  true,
+		"write:document:doc2": true,
+	}
+	require.Equal(t, expected, result)
+}
+
 func TestCreateQueryEvaluator(t *testing.T) {
 	envs := config.EnvironmentVariables{}
 	policy := `package policies
@@ -342,23 +1244,271 @@ func BenchmarkBuildOptimizedResourcePermissionsMap(b *testing.B) {
 		UserBindings: bindings,
 	}
 
+	b.ReportAllocs()
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		b.StartTimer()
 		buildOptimizedResourcePermissionsMap(user)
-		b.StopTimer()
 	}
 }
 
-func TestPrint(t *testing.T) {
-	var buf bytes.Buffer
-	h := NewPrintHook(&buf, "policy-name")
+func TestEvaluateDenyReasons(t *testing.T) {
+	env := config.EnvironmentVariables{}
+	input := []byte(`{"request":{"method":"GET"}}`)
+
+	t.Run("returns the reasons of a set rule", func(t *testing.T) {
+		opaModuleConfig := &OPAModuleConfig{
+			Name: "example.rego",
+			Content: `package policies
+			allow { input.request.method == "POST" }
+			allow_deny_reason["method not allowed"] { input.request.method != "POST" }
+			allow_deny_reason["missing role"] { true }`,
+		}
+		ctx := createContext(t, context.Background(), env, nil, &openapi.RondConfig{}, opaModuleConfig, nil)
+
+		reasons, err := EvaluateDenyReasons(ctx, "allow", input, env)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"method not allowed", "missing role"}, reasons)
+	})
+
+	t.Run("returns the reason of a single string rule", func(t *testing.T) {
+		opaModuleConfig := &OPAModuleConfig{
+			Name: "example.rego",
+			Content: `package policies
+			allow { input.request.method == "POST" }
+			allow_deny_reason := "method not allowed"`,
+		}
+		ctx := createContext(t, context.Background(), env, nil, &openapi.RondConfig{}, opaModuleConfig, nil)
+
+		reasons, err := EvaluateDenyReasons(ctx, "allow", input, env)
+		require.NoError(t, err)
+		require.Equal(t, []string{"method not allowed"}, reasons)
+	})
+
+	t.Run("returns no reasons without companion rule", func(t *testing.T) {
+		opaModuleConfig := &OPAModuleConfig{
+			Name: "example.rego",
+			Content: `package policies
+			allow { input.request.method == "POST" }`,
+		}
+		ctx := createContext(t, context.Background(), env, nil, &openapi.RondConfig{}, opaModuleConfig, nil)
 
-	err := h.Print(print.Context{}, "the print message")
+		reasons, err := EvaluateDenyReasons(ctx, "allow", input, env)
+		require.NoError(t, err)
+		require.Empty(t, reasons)
+	})
+
+	t.Run("fails without OPA module config in context", func(t *testing.T) {
+		_, err := EvaluateDenyReasons(context.Background(), "allow", input, env)
+		require.Error(t, err)
+	})
+}
+
+func TestPrint(t *testing.T) {
+	input, err := ast.ParseTerm(`{"user":{"id":"user1"},"request":{"method":"GET"}}`)
 	require.NoError(t, err)
+	printContext := print.Context{
+		Context: context.WithValue(context.Background(), openapi.RouterInfoKey{}, openapi.RouterInfo{
+			MatchedPath: "/matched/path",
+		}),
+	}
+
+	t.Run("logs through the request logger", func(t *testing.T) {
+		log, hook := test.NewNullLogger()
+		log.SetLevel(logrus.TraceLevel)
+		h := NewPrintHook(logrus.NewEntry(log).WithField("reqId", "request-id"), "policy-name", input.Value)
+
+		err := h.Print(printContext, "the print message")
+		require.NoError(t, err)
+
+		require.Len(t, hook.AllEntries(), 1)
+		entry := hook.LastEntry()
+		require.Equal(t, logrus.TraceLevel, entry.Level)
+		require.Equal(t, "the print message", entry.Message)
+		require.Equal(t, logrus.Fields{
+			"reqId":       "request-id",
+			"policyName":  "policy-name",
+			"userId":      "user1",
+			"matchedPath": "/matched/path",
+		}, entry.Data)
+	})
+
+	t.Run("without input and router info", func(t *testing.T) {
+		log, hook := test.NewNullLogger()
+		log.SetLevel(logrus.TraceLevel)
+		h := NewPrintHook(logrus.NewEntry(log), "policy-name", nil)
+
+		err := h.Print(print.Context{}, "the print message")
+		require.NoError(t, err)
+
+		require.Len(t, hook.AllEntries(), 1)
+		require.Equal(t, logrus.Fields{"policyName": "policy-name", "userId": ""}, hook.LastEntry().Data)
+	})
+
+	t.Run("skipped when trace level is disabled", func(t *testing.T) {
+		log, hook := test.NewNullLogger()
+		log.SetLevel(logrus.DebugLevel)
+		h := NewPrintHook(logrus.NewEntry(log), "policy-name", input.Value)
+
+		err := h.Print(printContext, "the print message")
+		require.NoError(t, err)
+		require.Empty(t, hook.AllEntries())
+	})
+
+	t.Run("logs at the configured level", func(t *testing.T) {
+		for _, level := range []logrus.Level{logrus.DebugLevel, logrus.TraceLevel} {
+			log, hook := test.NewNullLogger()
+			log.SetLevel(level)
+			h := NewPrintHook(logrus.NewEntry(log), "policy-name", input.Value).WithLevel(level)
+
+			err := h.Print(printContext, "the print message")
+			require.NoError(t, err)
+
+			require.Len(t, hook.AllEntries(), 1)
+			require.Equal(t, level, hook.LastEntry().Level)
+		}
+	})
 
-	var re = regexp.MustCompile(`"time":\d+`)
-	require.JSONEq(t, `{"level":10,"msg":"the print message","time":123,"policyName":"policy-name"}`, string(re.ReplaceAll(buf.Bytes(), []byte("\"time\":123"))))
+	t.Run("skipped when the configured level is disabled", func(t *testing.T) {
+		log, hook := test.NewNullLogger()
+		log.SetLevel(logrus.InfoLevel)
+		h := NewPrintHook(logrus.NewEntry(log), "policy-name", input.Value).WithLevel(logrus.DebugLevel)
+
+		err := h.Print(printContext, "the print message")
+		require.NoError(t, err)
+		require.Empty(t, hook.AllEntries())
+	})
+
+	t.Run("level depends on the configured log level", func(t *testing.T) {
+		require.Equal(t, logrus.TraceLevel, printHookLevel(config.EnvironmentVariables{LogLevel: config.TraceLogLevel}))
+		require.Equal(t, logrus.DebugLevel, printHookLevel(config.EnvironmentVariables{LogLevel: "debug"}))
+		require.Equal(t, logrus.DebugLevel, printHookLevel(config.EnvironmentVariables{LogLevel: "info"}))
+
+		require.True(t, printStatementsEnabled(config.EnvironmentVariables{LogLevel: config.TraceLogLevel, OPALogLevel: config.OPALogLevelDebug}))
+		require.True(t, printStatementsEnabled(config.EnvironmentVariables{LogLevel: "debug", OPALogLevel: config.OPALogLevelDebug}))
+		require.False(t, printStatementsEnabled(config.EnvironmentVariables{LogLevel: "info", OPALogLevel: config.OPALogLevelDebug}))
+		require.False(t, printStatementsEnabled(config.EnvironmentVariables{LogLevel: "not-a-level", OPALogLevel: config.OPALogLevelDebug}))
+	})
+
+	t.Run("print statements require the debug OPA log level", func(t *testing.T) {
+		for _, opaLogLevel := range []string{"", config.OPALogLevelOff, config.OPALogLevelError, config.OPALogLevelWarn, config.OPALogLevelInfo} {
+			require.False(t, printStatementsEnabled(config.EnvironmentVariables{LogLevel: config.TraceLogLevel, OPALogLevel: opaLogLevel}), opaLogLevel)
+		}
+	})
+}
+
+func TestPrintDuringEvaluation(t *testing.T) {
+	env := config.EnvironmentVariables{LogLevel: config.TraceLogLevel, OPALogLevel: config.OPALogLevelDebug}
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		allow {
+			print("evaluating request of", input.user.id)
+			input.request.method == "GET"
+		}`,
+	}
+	input := []byte(`{"user":{"id":"user1"},"request":{"method":"GET"}}`)
+
+	createLoggingContext := func(t *testing.T, partialEvaluators PartialResultsEvaluators) (context.Context, *test.Hook) {
+		t.Helper()
+		log, hook := test.NewNullLogger()
+		log.SetLevel(logrus.TraceLevel)
+		ctx := createContext(t, context.Background(), env, nil, &openapi.RondConfig{}, opaModuleConfig, partialEvaluators)
+		return glogger.WithLogger(ctx, logrus.NewEntry(log).WithField("reqId", "request-id")), hook
+	}
+
+	requirePrintLog := func(t *testing.T, hook *test.Hook) {
+		t.Helper()
+		logs := []logrus.Entry{}
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "evaluating request of user1" {
+				logs = append(logs, *entry)
+			}
+		}
+		require.Len(t, logs, 1)
+		require.Equal(t, logrus.TraceLevel, logs[0].Level)
+		require.Equal(t, "request-id", logs[0].Data["reqId"])
+		require.Equal(t, "allow", logs[0].Data["policyName"])
+		require.Equal(t, "user1", logs[0].Data["userId"])
+		require.Equal(t, "/matched/path", logs[0].Data["matchedPath"])
+	}
+
+	t.Run("with partial results evaluator", func(t *testing.T) {
+		partialEvaluator, err := createPartialEvaluator("allow", context.Background(), nil, nil, opaModuleConfig, env)
+		require.NoError(t, err)
+		partialEvaluators := PartialResultsEvaluators{{PolicyName: "allow"}: *partialEvaluator}
+		ctx, hook := createLoggingContext(t, partialEvaluators)
+
+		evaluator, err := partialEvaluators.GetEvaluatorFromPolicy(ctx, EvaluatorKey{PolicyName: "allow"}, input, env)
+		require.NoError(t, err)
+		_, err = evaluator.Evaluate(logrus.NewEntry(logrus.New()))
+		require.NoError(t, err)
+		requirePrintLog(t, hook)
+	})
+
+	t.Run("with OPA evaluator", func(t *testing.T) {
+		ctx, hook := createLoggingContext(t, nil)
+
+		evaluator, err := NewOPAEvaluator(ctx, "allow", opaModuleConfig, input, env)
+		require.NoError(t, err)
+		_, err = evaluator.Evaluate(logrus.NewEntry(logrus.New()))
+		require.NoError(t, err)
+		requirePrintLog(t, hook)
+	})
+
+	t.Run("with cached evaluator shared between requests", func(t *testing.T) {
+		cachedEvaluator, err := newPreparedOPAEvaluator(context.Background(), "allow", opaModuleConfig, env)
+		require.NoError(t, err)
+		inputTerm, err := ast.ParseTerm(string(input))
+		require.NoError(t, err)
+
+		for i := 0; i < 2; i++ {
+			ctx, hook := createLoggingContext(t, nil)
+			_, err = cachedEvaluator.withInput(ctx, inputTerm.Value, logrus.TraceLevel).Evaluate(logrus.NewEntry(logrus.New()))
+			require.NoError(t, err)
+			requirePrintLog(t, hook)
+		}
+	})
+}
+
+func TestOPALogLevel(t *testing.T) {
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		allow {
+			print("evaluating request of", input.user.id)
+			input.request.method == "GET"
+		}`,
+	}
+	input := []byte(`{"user":{"id":"user1"},"request":{"method":"GET"}}`)
+
+	evaluate := func(t *testing.T, env config.EnvironmentVariables) *test.Hook {
+		t.Helper()
+		log, hook := test.NewNullLogger()
+		log.SetLevel(logrus.DebugLevel)
+		ctx := createContext(t, context.Background(), env, nil, &openapi.RondConfig{}, opaModuleConfig, nil)
+		ctx = glogger.WithLogger(ctx, logrus.NewEntry(log))
+
+		evaluator, err := NewOPAEvaluator(ctx, "allow", opaModuleConfig, input, env)
+		require.NoError(t, err)
+		_, err = evaluator.Evaluate(logrus.NewEntry(logrus.New()))
+		require.NoError(t, err)
+		return hook
+	}
+
+	t.Run("logs the print statements at debug level", func(t *testing.T) {
+		hook := evaluate(t, config.EnvironmentVariables{LogLevel: "debug", OPALogLevel: config.OPALogLevelDebug})
+
+		require.Len(t, hook.AllEntries(), 1)
+		entry := hook.LastEntry()
+		require.Equal(t, "evaluating request of user1", entry.Message)
+		require.Equal(t, logrus.DebugLevel, entry.Level)
+		require.Equal(t, "allow", entry.Data["policyName"])
+	})
+
+	t.Run("print statements are removed with the default OPA log level", func(t *testing.T) {
+		hook := evaluate(t, config.EnvironmentVariables{LogLevel: "debug", OPALogLevel: config.OPALogLevelWarn})
+		require.Empty(t, hook.AllEntries())
+	})
 }
 
 func createContext(
@@ -478,3 +1628,75 @@ func TestGetPolicyEvaluators(t *testing.T) {
 		require.True(t, opaEval != nil, "OPA Module config not found.")
 	})
 }
+
+func TestSetupEvaluatorsIgnoreBody(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		allow { true }
+		check_headers { input.response.headers["Content-Type"][0] == "text/csv" }
+		filter_response = body { body := input.response.body }
+		filter_items[item] { item := input.response.body[_] }`,
+	}
+	oasWithResponsePolicy := func(responseFlow openapi.ResponseFlow, versioned bool) *openapi.OpenAPISpec {
+		rondConfig := &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow"}, ResponseFlow: responseFlow}
+		if versioned {
+			rondConfig = &openapi.RondConfig{
+				RequestFlow:              openapi.RequestFlow{PolicyName: "allow"},
+				ContentNegotiationPolicy: "allow",
+				Versions:                 map[string]*openapi.RondConfig{"v2": rondConfig},
+			}
+		}
+		return &openapi.OpenAPISpec{
+			Paths: openapi.OpenAPIPaths{
+				"/reports": openapi.PathVerbs{"get": openapi.VerbConfig{PermissionV2: rondConfig}},
+			},
+		}
+	}
+
+	testCases := []struct {
+		name          string
+		responseFlow  openapi.ResponseFlow
+		versioned     bool
+		env           config.EnvironmentVariables
+		expectedError string
+	}{
+		{name: "boolean policy", responseFlow: openapi.ResponseFlow{PolicyName: "check_headers", IgnoreBody: true}},
+		{name: "filtering policy with the body", responseFlow: openapi.ResponseFlow{PolicyName: "filter_response"}},
+		{
+			name:          "filtering policy",
+			responseFlow:  openapi.ResponseFlow{PolicyName: "filter_response", IgnoreBody: true},
+			expectedError: "invalid response flow: get /reports: responseFlow.ignoreBody cannot be used with policy filter_response, which returns a filtered body",
+		},
+		{
+			name:          "partial set policy",
+			responseFlow:  openapi.ResponseFlow{PolicyName: "filter_items", IgnoreBody: true},
+			expectedError: "invalid response flow: get /reports: responseFlow.ignoreBody cannot be used with policy filter_items, which returns a filtered body",
+		},
+		{
+			name:          "filtering policy of a version",
+			responseFlow:  openapi.ResponseFlow{PolicyName: "filter_response", IgnoreBody: true},
+			versioned:     true,
+			expectedError: "invalid response flow: get /reports: responseFlow.ignoreBody cannot be used with policy filter_response, which returns a filtered body",
+		},
+		{
+			name:          "filtering policy with lazy evaluators",
+			responseFlow:  openapi.ResponseFlow{PolicyName: "filter_response", IgnoreBody: true},
+			env:           config.EnvironmentVariables{LazyEvaluatorInit: true},
+			expectedError: "invalid response flow: get /reports: responseFlow.ignoreBody cannot be used with policy filter_response, which returns a filtered body",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, _, err := SetupEvaluators(ctx, nil, oasWithResponsePolicy(testCase.responseFlow, testCase.versioned), opaModuleConfig, testCase.env)
+			if testCase.expectedError != "" {
+				require.EqualError(t, err, testCase.expectedError)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
@@ -35,8 +35,17 @@ func OPAMiddleware(
 	policyEvaluators PartialResultsEvaluators,
 	routesToNotProxy []string,
 ) mux.MiddlewareFunc {
-	OASrouter := openAPISpec.PrepareOASRouter()
+	return OPAMiddlewareWithOASStore(opaModuleConfig, NewOASStore(openAPISpec, policyEvaluators), envs, routesToNotProxy)
+}
 
+// OPAMiddlewareWithOASStore is the OPAMiddleware reading the OAS and the policies evaluators
+// from the store at each request, so that they follow the OAS refreshes.
+func OPAMiddlewareWithOASStore(
+	opaModuleConfig *OPAModuleConfig,
+	oasStore *OASStore,
+	envs *config.EnvironmentVariables,
+	routesToNotProxy []string,
+) mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if utils.Contains(routesToNotProxy, r.URL.RequestURI()) {
@@ -44,10 +53,16 @@ func OPAMiddleware(
 				return
 			}
 
+			oasSetup := oasStore.load()
+			openAPISpec, OASrouter, policyEvaluators := oasSetup.oas, oasSetup.oasRouter, oasSetup.evaluators
+
 			path := r.URL.EscapedPath()
 			if envs.Standalone {
 				path = strings.Replace(r.URL.EscapedPath(), envs.PathPrefixStandalone, "", 1)
 			}
+			if envs.CaseInsensitiveRouting {
+				path = strings.ToLower(path)
+			}
 
 			logger := glogger.Get(r.Context())
 
@@ -62,7 +77,43 @@ func OPAMiddleware(
 				return
 			}
 
-			if err != nil || permission.RequestFlow.PolicyName == "" {
+			proxyWithoutEvaluation := false
+			// the CORS preflight requests are handled here only if OPTIONS is not defined in the OAS
+			if errors.Is(err, openapi.ErrNotFoundOASDefinition) && isCORSPreflight(r) {
+				switch corsPassthroughMode(openAPISpec, OASrouter, path, r, envs) {
+				case config.CORSPassthroughRespond:
+					allowedMethods, _ := openAPISpec.AllowedMethods(OASrouter, path)
+					logger.WithField("origin", utils.SanitizeString(r.Header.Get("Origin"))).Debug("responding to CORS preflight request")
+					respondToCORSPreflight(w, r, envs, allowedMethods)
+					return
+				case config.CORSPassthroughProxy:
+					logger.Debug("proxying CORS preflight request without policy evaluation")
+					permission = openapi.RondConfig{Options: openapi.PermissionOptions{Mode: config.PolicyModeOff}}
+					proxyWithoutEvaluation = true
+				}
+			}
+
+			if !proxyWithoutEvaluation && errors.Is(err, openapi.ErrNotFoundOASDefinition) {
+				allowedMethods, proxyUnknownMethods := openAPISpec.AllowedMethods(OASrouter, path)
+				if len(allowedMethods) > 0 && !proxyUnknownMethods {
+					logger.WithFields(logrus.Fields{
+						"originalRequestPath": utils.SanitizeString(r.URL.Path),
+						"method":              utils.SanitizeString(r.Method),
+						"allowedMethods":      allowedMethods,
+					}).Warn("request method not allowed")
+					w.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+					utils.FailResponseWithCode(w, http.StatusMethodNotAllowed, err.Error(), "The request method is not allowed for the API")
+					return
+				}
+				if len(allowedMethods) > 0 {
+					logger.WithField("method", utils.SanitizeString(r.Method)).Info("proxying request with method not defined in OAS")
+					// the policy evaluation is skipped by the policy mode off
+					permission = openapi.RondConfig{Options: openapi.PermissionOptions{Mode: config.PolicyModeOff}}
+					proxyWithoutEvaluation = true
+				}
+			}
+
+			if !proxyWithoutEvaluation && (err != nil || permission.RequestFlow.PolicyName == "") {
 				errorMessage := "User is not allowed to request the API"
 				statusCode := http.StatusForbidden
 				fields := logrus.Fields{
@@ -84,13 +135,23 @@ func OPAMiddleware(
 				return
 			}
 
+			routeModuleConfig, err := opaModuleConfig.ForPolicyModule(permission.Options.PolicyModule)
+			if err != nil {
+				logger.WithFields(logrus.Fields{
+					"error":        logrus.Fields{"message": err.Error()},
+					"policyModule": permission.Options.PolicyModule,
+				}).Error("failed policy module retrieval")
+				utils.FailResponseWithCode(w, http.StatusInternalServerError, "failed policy module retrieval", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+				return
+			}
+
 			ctx := openapi.WithXPermission(
 				WithOPAModuleConfig(
 					WithPartialResultsEvaluators(
 						openapi.WithRouterInfo(logger, r.Context(), r),
 						policyEvaluators,
 					),
-					opaModuleConfig,
+					routeModuleConfig,
 				),
 				&permission,
 			)
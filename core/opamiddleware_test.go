@@ -258,6 +258,80 @@ very_very_composed_permission_with_eval { true }`,
 	})
 }
 
+func TestOPAMiddlewareMethodNotAllowed(t *testing.T) {
+	envs := config.EnvironmentVariables{}
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+todo { true }`,
+	}
+
+	t.Run("responds 405 with the allowed methods of the path", func(t *testing.T) {
+		openAPISpec, err := openapi.LoadOASFile("../mocks/simplifiedMock.json")
+		require.NoError(t, err)
+		middleware := OPAMiddleware(opaModule, openAPISpec, &envs, PartialResultsEvaluators{}, nil)
+		builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Fail()
+		}))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodDelete, "http://example.com/users/", nil)
+		builtHandler.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusMethodNotAllowed, w.Result().StatusCode, "Unexpected status code.")
+		require.Equal(t, "GET, POST, HEAD", w.Result().Header.Get("Allow"))
+		require.Equal(t, &types.RequestError{
+			Message:    "The request method is not allowed for the API",
+			Error:      "not found oas definition: DELETE /users/",
+			StatusCode: http.StatusMethodNotAllowed,
+		}, getJSONResponseBody[types.RequestError](t, w))
+	})
+
+	t.Run("responds 404 on unknown paths", func(t *testing.T) {
+		openAPISpec, err := openapi.LoadOASFile("../mocks/simplifiedMock.json")
+		require.NoError(t, err)
+		middleware := OPAMiddleware(opaModule, openAPISpec, &envs, PartialResultsEvaluators{}, nil)
+		builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Fail()
+		}))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodDelete, "http://example.com/not-existing-path", nil)
+		builtHandler.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusNotFound, w.Result().StatusCode, "Unexpected status code.")
+		require.Empty(t, w.Result().Header.Get("Allow"))
+	})
+
+	t.Run("proxies unknown methods of paths opted out", func(t *testing.T) {
+		openAPISpec := &openapi.OpenAPISpec{
+			Paths: openapi.OpenAPIPaths{
+				"/users": openapi.PathVerbs{
+					"get": openapi.VerbConfig{
+						PermissionV2: &openapi.RondConfig{
+							RequestFlow: openapi.RequestFlow{PolicyName: "todo"},
+							Options:     openapi.PermissionOptions{ProxyUnknownMethods: true},
+						},
+					},
+				},
+			},
+		}
+		middleware := OPAMiddleware(opaModule, openAPISpec, &envs, PartialResultsEvaluators{}, nil)
+		builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			permission, err := openapi.GetXPermission(r.Context())
+			require.NoError(t, err)
+			require.Equal(t, &openapi.RondConfig{Options: openapi.PermissionOptions{Mode: config.PolicyModeOff}}, permission)
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodDelete, "http://example.com/users", nil)
+		builtHandler.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode, "Unexpected status code.")
+	})
+}
+
 func TestOPAMiddlewareStandaloneIntegration(t *testing.T) {
 	var partialEvaluators = PartialResultsEvaluators{}
 	var routesNotToProxy = []string{}
@@ -0,0 +1,226 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/rond-authz/rond/internal/config"
+
+	"github.com/gorilla/mux"
+	"github.com/open-policy-agent/opa/ast"
+)
+
+// RecordedInput is an input document evaluated by a request flow policy.
+type RecordedInput struct {
+	Policy string          `json:"policy"`
+	Input  json.RawMessage `json:"input"`
+}
+
+// InputRecorder keeps the last inputs evaluated by the request flow policies, with the
+// request and response bodies, the sensitive headers and the user properties stripped, to
+// replay them against a candidate policies module.
+type InputRecorder struct {
+	mtx              sync.Mutex
+	inputs           []RecordedInput
+	next             int
+	full             bool
+	sensitiveHeaders []string
+}
+
+// NewInputRecorder returns a recorder keeping the last size inputs, or nil if size is not
+// positive. Recording on a nil recorder is a no-op.
+func NewInputRecorder(size int, sensitiveHeaders []string) *InputRecorder {
+	if size <= 0 {
+		return nil
+	}
+	return &InputRecorder{inputs: make([]RecordedInput, size), sensitiveHeaders: sensitiveHeaders}
+}
+
+// Record stores the input evaluated by the policy, replacing the oldest one when the
+// recorder is full.
+func (recorder *InputRecorder) Record(policy string, input ast.Value) error {
+	if recorder == nil {
+		return nil
+	}
+	inputJSON, err := stripRecordedInput(input, recorder.sensitiveHeaders)
+	if err != nil {
+		return err
+	}
+
+	recorder.mtx.Lock()
+	defer recorder.mtx.Unlock()
+	recorder.inputs[recorder.next] = RecordedInput{Policy: policy, Input: inputJSON}
+	recorder.next = (recorder.next + 1) % len(recorder.inputs)
+	if recorder.next == 0 {
+		recorder.full = true
+	}
+	return nil
+}
+
+// Inputs returns the recorded inputs, from the oldest to the newest.
+func (recorder *InputRecorder) Inputs() []RecordedInput {
+	if recorder == nil {
+		return nil
+	}
+	recorder.mtx.Lock()
+	defer recorder.mtx.Unlock()
+	if !recorder.full {
+		return append([]RecordedInput{}, recorder.inputs[:recorder.next]...)
+	}
+	return append(append([]RecordedInput{}, recorder.inputs[recorder.next:]...), recorder.inputs[:recorder.next]...)
+}
+
+type inputRecorderKey struct{}
+
+// InputRecorderInjectorMiddleware will inject into request context the input recorder.
+func InputRecorderInjectorMiddleware(recorder *InputRecorder) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := WithInputRecorder(r.Context(), recorder)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func WithInputRecorder(requestContext context.Context, recorder *InputRecorder) context.Context {
+	return context.WithValue(requestContext, inputRecorderKey{}, recorder)
+}
+
+// GetInputRecorder returns the input recorder from the request context, or nil if
+// recording is not enabled.
+func GetInputRecorder(requestContext context.Context) *InputRecorder {
+	recorder, _ := requestContext.Value(inputRecorderKey{}).(*InputRecorder)
+	return recorder
+}
+
+// stripRecordedInput returns the input without the data that must not be kept in memory:
+// the bodies, the sensitive headers in all their forms and the user properties.
+func stripRecordedInput(input ast.Value, sensitiveHeaders []string) ([]byte, error) {
+	document, err := ast.JSON(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed input conversion: %s", err.Error())
+	}
+	if documentMap, ok := document.(map[string]interface{}); ok {
+		for _, key := range []string{"request", "response"} {
+			if section, ok := documentMap[key].(map[string]interface{}); ok {
+				// the fields of the form bodies are as sensitive as the JSON ones
+				delete(section, "body")
+				delete(section, "formFields")
+			}
+		}
+		if request, ok := documentMap["request"].(map[string]interface{}); ok {
+			for _, key := range []string{"headers", "headersLower", "headersLowerJoined"} {
+				if headers, ok := request[key].(map[string]interface{}); ok {
+					deleteHeaders(headers, sensitiveHeaders)
+				}
+			}
+		}
+		if user, ok := documentMap["user"].(map[string]interface{}); ok {
+			delete(user, "properties")
+		}
+	}
+	return json.Marshal(document)
+}
+
+func deleteHeaders(headers map[string]interface{}, headerNames []string) {
+	for name := range headers {
+		for _, headerName := range headerNames {
+			if strings.EqualFold(name, headerName) {
+				delete(headers, name)
+				break
+			}
+		}
+	}
+}
+
+// PolicyDecision is the outcome of a policy evaluation.
+type PolicyDecision struct {
+	Allowed bool   `json:"allowed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// PolicyDecisionDiff reports an input on which the live and the candidate policies
+// modules take different decisions.
+type PolicyDecisionDiff struct {
+	Policy      string         `json:"policy"`
+	InputDigest string         `json:"inputDigest"`
+	Live        PolicyDecision `json:"live"`
+	Candidate   PolicyDecision `json:"candidate"`
+}
+
+// PolicyDiff is the result of the comparison of two policies modules.
+type PolicyDiff struct {
+	Evaluated   int                  `json:"evaluated"`
+	Differences []PolicyDecisionDiff `json:"differences"`
+}
+
+// CandidatePolicyModule returns the module config replacing the policies module of live
+// with content, the other modules are kept so that the candidate can use them.
+func CandidatePolicyModule(live *OPAModuleConfig, content string) *OPAModuleConfig {
+	modules := append([]RegoModule{{Name: live.Name, Content: content}}, live.Modules...)
+	return &OPAModuleConfig{
+		Name:        live.Name,
+		Content:     content,
+		Modules:     live.Modules,
+		Fingerprint: modulesFingerprint(modules),
+	}
+}
+
+// DiffPolicies evaluates each input with its policy against both the live and the
+// candidate modules, and returns the inputs whose decisions differ. The candidate module
+// is compiled first, so that an invalid module is reported once instead of per input.
+func DiffPolicies(ctx context.Context, live, candidate *OPAModuleConfig, inputs []RecordedInput, env config.EnvironmentVariables) (PolicyDiff, error) {
+	if _, err := compileModules(candidate, env); err != nil {
+		return PolicyDiff{}, fmt.Errorf("invalid candidate module: %s", err.Error())
+	}
+
+	diff := PolicyDiff{Differences: []PolicyDecisionDiff{}}
+	for _, input := range inputs {
+		liveDecision := evaluatePolicyDecision(ctx, input, live, env)
+		candidateDecision := evaluatePolicyDecision(ctx, input, candidate, env)
+		diff.Evaluated++
+		if liveDecision == candidateDecision {
+			continue
+		}
+		digest := sha256.Sum256(input.Input)
+		diff.Differences = append(diff.Differences, PolicyDecisionDiff{
+			Policy:      input.Policy,
+			InputDigest: hex.EncodeToString(digest[:]),
+			Live:        liveDecision,
+			Candidate:   candidateDecision,
+		})
+	}
+	return diff, nil
+}
+
+func evaluatePolicyDecision(ctx context.Context, input RecordedInput, opaModuleConfig *OPAModuleConfig, env config.EnvironmentVariables) PolicyDecision {
+	evaluator, err := NewOPAEvaluator(ctx, input.Policy, opaModuleConfig, input.Input, env)
+	if err != nil {
+		return PolicyDecision{Error: err.Error()}
+	}
+	results, err := evaluator.PolicyEvaluator.Eval(ctx)
+	if err != nil {
+		return PolicyDecision{Error: err.Error()}
+	}
+	return PolicyDecision{Allowed: isAllowedResult(results)}
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInputRecorder(t *testing.T) {
+	recordInput := func(t *testing.T, recorder *InputRecorder, policy, input string) {
+		t.Helper()
+		value, err := parseRegoInput([]byte(input))
+		require.NoError(t, err)
+		require.NoError(t, recorder.Record(policy, value))
+	}
+
+	t.Run("nil recorder is disabled", func(t *testing.T) {
+		recorder := NewInputRecorder(0, nil)
+		require.Nil(t, recorder)
+		recordInput(t, recorder, "allow", `{}`)
+		require.Empty(t, recorder.Inputs())
+	})
+
+	t.Run("keeps the last inputs in order", func(t *testing.T) {
+		recorder := NewInputRecorder(2, nil)
+		recordInput(t, recorder, "first", `{}`)
+		require.Equal(t, []RecordedInput{{Policy: "first", Input: json.RawMessage(`{}`)}}, recorder.Inputs())
+
+		recordInput(t, recorder, "second", `{}`)
+		recordInput(t, recorder, "third", `{}`)
+		inputs := recorder.Inputs()
+		require.Len(t, inputs, 2)
+		require.Equal(t, "second", inputs[0].Policy)
+		require.Equal(t, "third", inputs[1].Policy)
+	})
+
+	t.Run("strips the request and response bodies", func(t *testing.T) {
+		recorder := NewInputRecorder(1, nil)
+		recordInput(t, recorder, "allow", `{"request":{"method":"POST","body":{"secret":"value"}},"response":{"body":{"secret":"value"}}}`)
+		require.JSONEq(t, `{"request":{"method":"POST"},"response":{}}`, string(recorder.Inputs()[0].Input))
+	})
+
+	t.Run("strips the sensitive headers and the user properties", func(t *testing.T) {
+		recorder := NewInputRecorder(1, []string{"Authorization", "cookie"})
+		recordInput(t, recorder, "allow", `{
+			"request":{
+				"headers":{"Authorization":["Bearer token"],"Cookie":["sid=secret"],"Accept":["*/*"]},
+				"headersLower":{"authorization":"Bearer token","cookie":"sid=secret","accept":"*/*"},
+				"headersLowerJoined":{"authorization":"Bearer token","cookie":"sid=secret","accept":"*/*"}
+			},
+			"user":{"id":"user1","properties":{"email":"user@example.com"}}
+		}`)
+		require.JSONEq(t, `{
+			"request":{
+				"headers":{"Accept":["*/*"]},
+				"headersLower":{"accept":"*/*"},
+				"headersLowerJoined":{"accept":"*/*"}
+			},
+			"user":{"id":"user1"}
+		}`, string(recorder.Inputs()[0].Input))
+	})
+
+	t.Run("strips the request form fields", func(t *testing.T) {
+		recorder := NewInputRecorder(1, nil)
+		recordInput(t, recorder, "allow", `{"request":{"method":"POST","formFields":{"password":["value"]}}}`)
+		require.JSONEq(t, `{"request":{"method":"POST"}}`, string(recorder.Inputs()[0].Input))
+	})
+}
+
+func TestDiffPolicies(t *testing.T) {
+	live := &OPAModuleConfig{
+		Name: "policies.rego",
+		Content: `package policies
+allow { input.request.method == "GET" }
+other { true }`,
+	}
+	inputs := []RecordedInput{
+		{Policy: "allow", Input: json.RawMessage(`{"request":{"method":"GET"}}`)},
+		{Policy: "allow", Input: json.RawMessage(`{"request":{"method":"POST"}}`)},
+		{Policy: "other", Input: json.RawMessage(`{"request":{"method":"POST"}}`)},
+	}
+
+	t.Run("reports the changed decisions", func(t *testing.T) {
+		candidate := CandidatePolicyModule(live, `package policies
+allow { input.request.method != "DELETE" }
+other { true }`)
+		require.Equal(t, live.Name, candidate.Name)
+		require.NotEmpty(t, candidate.Fingerprint)
+
+		diff, err := DiffPolicies(context.Background(), live, candidate, inputs, config.EnvironmentVariables{})
+		require.NoError(t, err)
+		require.Equal(t, 3, diff.Evaluated)
+		require.Len(t, diff.Differences, 1)
+		require.Equal(t, "allow", diff.Differences[0].Policy)
+		require.Len(t, diff.Differences[0].InputDigest, 64)
+		require.Equal(t, PolicyDecision{Allowed: false}, diff.Differences[0].Live)
+		require.Equal(t, PolicyDecision{Allowed: true}, diff.Differences[0].Candidate)
+	})
+
+	t.Run("reports the policies missing in the candidate", func(t *testing.T) {
+		candidate := CandidatePolicyModule(live, `package policies
+allow { input.request.method == "GET" }`)
+
+		diff, err := DiffPolicies(context.Background(), live, candidate, inputs, config.EnvironmentVariables{})
+		require.NoError(t, err)
+		require.Len(t, diff.Differences, 1)
+		require.Equal(t, "other", diff.Differences[0].Policy)
+		require.True(t, diff.Differences[0].Live.Allowed)
+		require.False(t, diff.Differences[0].Candidate.Allowed)
+	})
+
+	t.Run("fails on invalid candidate module", func(t *testing.T) {
+		candidate := CandidatePolicyModule(live, "package policies\nallow {")
+
+		_, err := DiffPolicies(context.Background(), live, candidate, inputs, config.EnvironmentVariables{})
+		require.ErrorContains(t, err, "invalid candidate module")
+	})
+}
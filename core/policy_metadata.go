@@ -0,0 +1,117 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rond-authz/rond/internal/config"
+)
+
+// policyMetadataRule is the rule of the policies module declaring the metadata of the
+// policies, e.g. __rond_metadata := {"minVersion": "1.6.0"}.
+const policyMetadataRule = "__rond_metadata"
+
+// PolicyMetadata is the metadata declared by the policies module.
+type PolicyMetadata struct {
+	// MinVersion is the minimum rond version required by the policies, e.g. because
+	// they use builtins not available in the previous versions.
+	MinVersion string `json:"minVersion,omitempty"`
+}
+
+// PolicyVersionError reports that the policies require a rond version newer than the
+// running one.
+type PolicyVersionError struct {
+	ServiceVersion string
+	MinVersion     string
+}
+
+func (e PolicyVersionError) Error() string {
+	return fmt.Sprintf("policies require rond version %s or later, running version %s", e.MinVersion, e.ServiceVersion)
+}
+
+// LoadPolicyMetadata evaluates the metadata rule of the policies module, the metadata
+// is empty if the rule is not defined.
+func LoadPolicyMetadata(ctx context.Context, opaModuleConfig *OPAModuleConfig, env config.EnvironmentVariables) (PolicyMetadata, error) {
+	results, err := newRegoQuery(policyMetadataRule, opaModuleConfig, env).Eval(ctx)
+	if err != nil {
+		return PolicyMetadata{}, fmt.Errorf("failed policies metadata evaluation: %s", err.Error())
+	}
+	if len(results) != 1 || len(results[0].Expressions) != 1 {
+		return PolicyMetadata{}, nil
+	}
+
+	metadataJSON, err := json.Marshal(results[0].Expressions[0].Value)
+	if err != nil {
+		return PolicyMetadata{}, fmt.Errorf("failed policies metadata encode: %s", err.Error())
+	}
+	var metadata PolicyMetadata
+	if err := json.Unmarshal(metadataJSON, &metadata); err != nil {
+		return PolicyMetadata{}, fmt.Errorf("invalid %s rule: %s", policyMetadataRule, err.Error())
+	}
+	return metadata, nil
+}
+
+// CheckServiceVersion returns a PolicyVersionError if serviceVersion is lower than the
+// minimum version required by the policies. Service versions that are not semantic
+// versions, such as latest, are assumed to be compatible.
+func (metadata PolicyMetadata) CheckServiceVersion(serviceVersion string) error {
+	if metadata.MinVersion == "" {
+		return nil
+	}
+	minVersion, ok := parseVersion(metadata.MinVersion)
+	if !ok {
+		return fmt.Errorf("invalid %s rule: minVersion %s is not a semantic version", policyMetadataRule, metadata.MinVersion)
+	}
+	version, ok := parseVersion(serviceVersion)
+	if !ok {
+		return nil
+	}
+	for i := range version {
+		if version[i] != minVersion[i] {
+			if version[i] < minVersion[i] {
+				return PolicyVersionError{ServiceVersion: serviceVersion, MinVersion: metadata.MinVersion}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// parseVersion returns the major, minor and patch numbers of a semantic version, with
+// an optional v prefix. The pre-release and build suffixes are ignored.
+func parseVersion(version string) ([3]int, bool) {
+	var numbers [3]int
+	version = strings.TrimPrefix(version, "v")
+	if suffixIndex := strings.IndexAny(version, "-+"); suffixIndex >= 0 {
+		version = version[:suffixIndex]
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) > len(numbers) {
+		return numbers, false
+	}
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return numbers, false
+		}
+		numbers[i] = number
+	}
+	return numbers, true
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadPolicyMetadata(t *testing.T) {
+	t.Run("evaluates the metadata rule", func(t *testing.T) {
+		opaModuleConfig := &OPAModuleConfig{
+			Name: "policies.rego",
+			Content: `package policies
+__rond_metadata := {"minVersion": "1.6.0"}
+allow { true }`,
+		}
+
+		metadata, err := LoadPolicyMetadata(context.Background(), opaModuleConfig, config.EnvironmentVariables{})
+		require.NoError(t, err)
+		require.Equal(t, PolicyMetadata{MinVersion: "1.6.0"}, metadata)
+	})
+
+	t.Run("empty metadata without rule", func(t *testing.T) {
+		opaModuleConfig := &OPAModuleConfig{Name: "policies.rego", Content: "package policies\nallow { true }"}
+
+		metadata, err := LoadPolicyMetadata(context.Background(), opaModuleConfig, config.EnvironmentVariables{})
+		require.NoError(t, err)
+		require.Equal(t, PolicyMetadata{}, metadata)
+	})
+
+	t.Run("fails on invalid metadata", func(t *testing.T) {
+		opaModuleConfig := &OPAModuleConfig{Name: "policies.rego", Content: "package policies\n__rond_metadata := {\"minVersion\": 1}"}
+
+		_, err := LoadPolicyMetadata(context.Background(), opaModuleConfig, config.EnvironmentVariables{})
+		require.ErrorContains(t, err, "invalid __rond_metadata rule")
+	})
+}
+
+func TestPolicyMetadataCheckServiceVersion(t *testing.T) {
+	testCases := []struct {
+		minVersion     string
+		serviceVersion string
+		compatible     bool
+	}{
+		{minVersion: "", serviceVersion: "1.0.0", compatible: true},
+		{minVersion: "1.6.0", serviceVersion: "1.6.0", compatible: true},
+		{minVersion: "1.6.0", serviceVersion: "v1.7.2", compatible: true},
+		{minVersion: "1.6.0", serviceVersion: "2.0.0-rc.1", compatible: true},
+		{minVersion: "1.6", serviceVersion: "1.6.1", compatible: true},
+		{minVersion: "1.6.0", serviceVersion: "latest", compatible: true},
+		{minVersion: "1.6.0", serviceVersion: "1.5.9", compatible: false},
+		{minVersion: "1.6.1", serviceVersion: "1.6.0", compatible: false},
+		{minVersion: "v2.0.0", serviceVersion: "1.9.0", compatible: false},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.minVersion+" "+testCase.serviceVersion, func(t *testing.T) {
+			err := PolicyMetadata{MinVersion: testCase.minVersion}.CheckServiceVersion(testCase.serviceVersion)
+			if testCase.compatible {
+				require.NoError(t, err)
+				return
+			}
+			require.Equal(t, PolicyVersionError{ServiceVersion: testCase.serviceVersion, MinVersion: testCase.minVersion}, err)
+		})
+	}
+
+	t.Run("fails on invalid min version", func(t *testing.T) {
+		err := PolicyMetadata{MinVersion: "next"}.CheckServiceVersion("1.6.0")
+		require.EqualError(t, err, "invalid __rond_metadata rule: minVersion next is not a semantic version")
+	})
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// policyModuleKeySeparator separates the policy module from the policy name in the key of
+// the evaluators of the routes overriding the default policies module. Rule names cannot
+// contain it, so the policy name is always the part following its last occurrence.
+const policyModuleKeySeparator = ":"
+
+// PolicyEvaluatorKey returns the policy name of the EvaluatorKey of policy compiled from
+// policyModule, which is the policy itself for the default policies module. Keying the
+// evaluators on both avoids collisions between the policies with the same name defined in
+// different modules.
+func PolicyEvaluatorKey(policyModule, policy string) string {
+	if policyModule == "" {
+		return policy
+	}
+	return policyModule + policyModuleKeySeparator + policy
+}
+
+// splitPolicyEvaluatorKey returns the policy module and the policy name of an evaluator key.
+func splitPolicyEvaluatorKey(key string) (string, string) {
+	separatorIndex := strings.LastIndex(key, policyModuleKeySeparator)
+	if separatorIndex < 0 {
+		return "", key
+	}
+	return key[:separatorIndex], key[separatorIndex+len(policyModuleKeySeparator):]
+}
+
+// ForPolicyModule returns the module configuration the policies of the routes using
+// policyModule are compiled from: the module itself along with the shared modules found
+// in the subdirectories of the modules directory. The configuration itself is returned
+// when policyModule is empty. The fingerprint is the one of all the loaded policies, so that
+// the evaluators of every route are keyed on the same policies version.
+func (opaModuleConfig *OPAModuleConfig) ForPolicyModule(policyModule string) (*OPAModuleConfig, error) {
+	if policyModule == "" || policyModule == opaModuleConfig.Name {
+		return opaModuleConfig, nil
+	}
+
+	module, found := opaModuleConfig.policyModules[policyModule]
+	if !found {
+		return nil, fmt.Errorf("policy module %s not found in modules directory", policyModule)
+	}
+	return &OPAModuleConfig{
+		Name:        module.Name,
+		Content:     module.Content,
+		Modules:     opaModuleConfig.Modules,
+		Fingerprint: opaModuleConfig.Fingerprint,
+	}, nil
+}
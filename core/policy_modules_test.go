@@ -0,0 +1,178 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/openapi"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyEvaluatorKey(t *testing.T) {
+	t.Run("policy name for the default module", func(t *testing.T) {
+		key := PolicyEvaluatorKey("", "allow")
+		require.Equal(t, "allow", key)
+
+		policyModule, policy := splitPolicyEvaluatorKey(key)
+		require.Empty(t, policyModule)
+		require.Equal(t, "allow", policy)
+	})
+
+	t.Run("policy module and name for the overriding modules", func(t *testing.T) {
+		key := PolicyEvaluatorKey("team-a.rego", "allow")
+		require.Equal(t, "team-a.rego:allow", key)
+
+		policyModule, policy := splitPolicyEvaluatorKey(key)
+		require.Equal(t, "team-a.rego", policyModule)
+		require.Equal(t, "allow", policy)
+	})
+}
+
+func TestSetupEvaluatorsPolicyModules(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+	env := config.EnvironmentVariables{}
+
+	loadModules := func(t *testing.T, modules map[string]string) *OPAModuleConfig {
+		t.Helper()
+		directory := t.TempDir()
+		for name, content := range modules {
+			modulePath := filepath.Join(directory, filepath.FromSlash(name))
+			require.NoError(t, os.MkdirAll(filepath.Dir(modulePath), 0700))
+			require.NoError(t, os.WriteFile(modulePath, []byte(content), 0600))
+		}
+		opaModuleConfig, err := LoadRegoModule(directory, 5)
+		require.NoError(t, err)
+		return opaModuleConfig
+	}
+	modules := map[string]string{
+		"policies.rego":       "package policies\nallow { data.policies.helpers.is_get; input.user.id == \"admin\" }",
+		"team-a.rego":         "package policies\nallow { data.policies.helpers.is_get; input.user.id == \"team-a\" }",
+		"helpers/method.rego": "package policies.helpers\nis_get { input.request.method == \"GET\" }",
+	}
+	route := func(policyModule string) openapi.PathVerbs {
+		return openapi.PathVerbs{
+			"get": openapi.VerbConfig{
+				PermissionV2: &openapi.RondConfig{
+					RequestFlow: openapi.RequestFlow{PolicyName: "allow"},
+					Options:     openapi.PermissionOptions{PolicyModule: policyModule},
+				},
+			},
+		}
+	}
+	evaluate := func(t *testing.T, evaluators PartialResultsEvaluators, opaModuleConfig *OPAModuleConfig, key, input string) bool {
+		t.Helper()
+		evaluator, err := evaluators.GetEvaluatorFromPolicy(ctx, EvaluatorKey{PolicyName: key, ModuleFingerprint: opaModuleConfig.Fingerprint}, []byte(input), env)
+		require.NoError(t, err)
+		results, err := evaluator.PolicyEvaluator.Eval(ctx)
+		require.NoError(t, err)
+		return isAllowedResult(results)
+	}
+
+	t.Run("compiles the policies of the routes from their module", func(t *testing.T) {
+		opaModuleConfig := loadModules(t, modules)
+		require.Equal(t, "policies.rego", opaModuleConfig.Name)
+		oas := &openapi.OpenAPISpec{Paths: openapi.OpenAPIPaths{
+			"/default": route(""),
+			"/team-a":  route("team-a.rego"),
+		}}
+
+		evaluators, setupErrors, err := SetupEvaluators(ctx, nil, oas, opaModuleConfig, env)
+		require.NoError(t, err)
+		require.Empty(t, setupErrors)
+		require.Len(t, evaluators, 2)
+
+		require.True(t, evaluate(t, evaluators, opaModuleConfig, "allow", `{"user":{"id":"admin"},"request":{"method":"GET"}}`))
+		require.False(t, evaluate(t, evaluators, opaModuleConfig, "allow", `{"user":{"id":"team-a"},"request":{"method":"GET"}}`))
+		require.True(t, evaluate(t, evaluators, opaModuleConfig, "team-a.rego:allow", `{"user":{"id":"team-a"},"request":{"method":"GET"}}`))
+		require.False(t, evaluate(t, evaluators, opaModuleConfig, "team-a.rego:allow", `{"user":{"id":"admin"},"request":{"method":"GET"}}`))
+		require.False(t, evaluate(t, evaluators, opaModuleConfig, "team-a.rego:allow", `{"user":{"id":"team-a"},"request":{"method":"POST"}}`))
+	})
+
+	t.Run("unreferenced modules are not compiled", func(t *testing.T) {
+		withBrokenModule := map[string]string{"team-b.rego": "package policies\nallow {"}
+		for name, content := range modules {
+			withBrokenModule[name] = content
+		}
+		opaModuleConfig := loadModules(t, withBrokenModule)
+		oas := &openapi.OpenAPISpec{Paths: openapi.OpenAPIPaths{
+			"/default": route(""),
+			"/team-a":  route("team-a.rego"),
+		}}
+
+		evaluators, setupErrors, err := SetupEvaluators(ctx, nil, oas, opaModuleConfig, env)
+		require.NoError(t, err)
+		require.Empty(t, setupErrors)
+		require.Len(t, evaluators, 2)
+	})
+
+	t.Run("errors of a policy module only affect its routes", func(t *testing.T) {
+		withBrokenModule := map[string]string{"team-b.rego": "package policies\nallow {"}
+		for name, content := range modules {
+			withBrokenModule[name] = content
+		}
+		opaModuleConfig := loadModules(t, withBrokenModule)
+		oas := &openapi.OpenAPISpec{Paths: openapi.OpenAPIPaths{
+			"/default": route(""),
+			"/team-a":  route("team-a.rego"),
+			"/team-b":  route("team-b.rego"),
+		}}
+
+		evaluators, setupErrors, err := SetupEvaluators(ctx, nil, oas, opaModuleConfig, env)
+		require.Error(t, err)
+		require.Len(t, setupErrors, 1)
+		require.Equal(t, "/team-b", setupErrors[0].RoutePath)
+		require.Equal(t, "get", setupErrors[0].Method)
+		require.Contains(t, evaluators, EvaluatorKey{PolicyName: "allow", ModuleFingerprint: opaModuleConfig.Fingerprint})
+		require.Contains(t, evaluators, EvaluatorKey{PolicyName: "team-a.rego:allow", ModuleFingerprint: opaModuleConfig.Fingerprint})
+	})
+
+	t.Run("fails on missing policy module", func(t *testing.T) {
+		opaModuleConfig := loadModules(t, modules)
+		oas := &openapi.OpenAPISpec{Paths: openapi.OpenAPIPaths{
+			"/missing": route("missing.rego"),
+		}}
+
+		_, setupErrors, err := SetupEvaluators(ctx, nil, oas, opaModuleConfig, env)
+		require.EqualError(t, err, "error during evaluator creation: get /missing: policy allow: policy module missing.rego not found in modules directory")
+		require.Len(t, setupErrors, 1)
+	})
+
+	t.Run("modules of the subdirectories are not policy modules", func(t *testing.T) {
+		opaModuleConfig := loadModules(t, modules)
+
+		_, err := opaModuleConfig.ForPolicyModule("helpers/method.rego")
+		require.EqualError(t, err, "policy module helpers/method.rego not found in modules directory")
+
+		teamModuleConfig, err := opaModuleConfig.ForPolicyModule("team-a.rego")
+		require.NoError(t, err)
+		require.Equal(t, "team-a.rego", teamModuleConfig.Name)
+		require.Equal(t, opaModuleConfig.Modules, teamModuleConfig.Modules)
+		require.Equal(t, opaModuleConfig.Fingerprint, teamModuleConfig.Fingerprint)
+
+		defaultModuleConfig, err := opaModuleConfig.ForPolicyModule("")
+		require.NoError(t, err)
+		require.Same(t, opaModuleConfig, defaultModuleConfig)
+	})
+}
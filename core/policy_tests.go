@@ -0,0 +1,121 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/tester"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/internal/utils"
+	"github.com/rond-authz/rond/types"
+)
+
+// RunPolicyTests runs the test rules of the rego files found in testsDirectory against the
+// policies module, with the same custom builtins used to evaluate the policies. The mongo
+// builtins are backed by mongoClient and are not available when it is nil.
+// The results are reported to w, the returned bool is false if any test did not pass.
+func RunPolicyTests(ctx context.Context, w io.Writer, opaModuleConfig *OPAModuleConfig, testsDirectory string, mongoClient types.IMongoClient, env config.EnvironmentVariables) (bool, error) {
+	modules, err := loadPolicyTestModules(opaModuleConfig, testsDirectory)
+	if err != nil {
+		return false, err
+	}
+
+	builtins := []*tester.Builtin{}
+	for _, builtin := range regoBuiltins(env, mongoClient != nil) {
+		builtins = append(builtins, &tester.Builtin{Decl: builtin.decl, Func: builtin.function})
+	}
+	if mongoClient != nil {
+		ctx = mongoclient.WithMongoClient(ctx, mongoClient)
+	}
+
+	results, err := tester.NewRunner().
+		AddCustomBuiltins(builtins).
+		CapturePrintOutput(true).
+		SetModules(modules).
+		RunTests(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed policies tests setup: %s", err.Error())
+	}
+
+	passed := true
+	reportedResults := make(chan *tester.Result)
+	go func() {
+		defer close(reportedResults)
+		for result := range results {
+			if !result.Pass() && !result.Skip {
+				passed = false
+			}
+			reportedResults <- result
+		}
+	}()
+	reporter := tester.PrettyReporter{Output: w, Verbose: true, FailureLine: true}
+	if err := reporter.Report(reportedResults); err != nil {
+		return false, err
+	}
+	return passed, nil
+}
+
+func loadPolicyTestModules(opaModuleConfig *OPAModuleConfig, testsDirectory string) (map[string]*ast.Module, error) {
+	policiesModule, err := ast.ParseModule(opaModuleConfig.Name, opaModuleConfig.Content)
+	if err != nil {
+		return nil, err
+	}
+	modules := map[string]*ast.Module{opaModuleConfig.Name: policiesModule}
+	loadedFingerprints := map[string]bool{moduleFingerprint([]byte(opaModuleConfig.Content)): true}
+	for _, regoModule := range opaModuleConfig.Modules {
+		module, err := ast.ParseModule(regoModule.Name, regoModule.Content)
+		if err != nil {
+			return nil, err
+		}
+		modules[regoModule.Name] = module
+		loadedFingerprints[moduleFingerprint([]byte(regoModule.Content))] = true
+	}
+
+	testFilesCount := 0
+	err = filepath.Walk(testsDirectory, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".rego" {
+			return err
+		}
+		fileContent, err := utils.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed rego test file read: %s", err.Error())
+		}
+		// the policies modules themselves may be kept with their tests
+		if loadedFingerprints[moduleFingerprint(fileContent)] {
+			return nil
+		}
+		module, err := ast.ParseModule(path, string(fileContent))
+		if err != nil {
+			return err
+		}
+		modules[path] = module
+		testFilesCount++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if testFilesCount == 0 {
+		return nil, fmt.Errorf("no rego test file found in %s", testsDirectory)
+	}
+	return modules, nil
+}
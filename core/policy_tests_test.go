@@ -0,0 +1,158 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunPolicyTests(t *testing.T) {
+	policies := `package policies
+	allow_with_header {
+		get_header("x-role", input.request.headers) == "admin"
+	}
+	allow_with_find_one {
+		project := find_one("projects", {"projectId": input.request.pathParams.projectId})
+		project.tenantId == "1234"
+	}`
+	opaModuleConfig := &OPAModuleConfig{
+		Name:        "example.rego",
+		Content:     policies,
+		Fingerprint: moduleFingerprint([]byte(policies)),
+	}
+	env := config.EnvironmentVariables{}
+
+	writeTestFiles := func(t *testing.T, files map[string]string) string {
+		t.Helper()
+		testsDirectory := t.TempDir()
+		for name, content := range files {
+			require.NoError(t, os.WriteFile(filepath.Join(testsDirectory, name), []byte(content), 0600))
+		}
+		return testsDirectory
+	}
+
+	t.Run("passes with custom builtins", func(t *testing.T) {
+		testsDirectory := writeTestFiles(t, map[string]string{
+			"example.rego": policies,
+			"example_test.rego": `package policies
+			test_allow_with_header {
+				allow_with_header with input as {"request": {"headers": {"X-Role": ["admin"]}}}
+			}
+			test_allow_with_find_one {
+				allow_with_find_one with input as {"request": {"pathParams": {"projectId": "p1"}}}
+			}`,
+			"README.md": "not a rego file",
+		})
+		mongoClient := mocks.MongoClientMock{
+			FindOneExpectation: func(collectionName string, query interface{}) {
+				require.Equal(t, "projects", collectionName)
+				require.Equal(t, map[string]interface{}{"projectId": "p1"}, query)
+			},
+			FindOneResult: map[string]interface{}{"tenantId": "1234"},
+		}
+
+		output := &bytes.Buffer{}
+		passed, err := RunPolicyTests(context.Background(), output, opaModuleConfig, testsDirectory, mongoClient, env)
+		require.NoError(t, err)
+		require.True(t, passed, output.String())
+		require.Contains(t, output.String(), "test_allow_with_header: PASS")
+		require.Contains(t, output.String(), "test_allow_with_find_one: PASS")
+		require.Contains(t, output.String(), "PASS: 2/2")
+	})
+
+	t.Run("reports failed tests", func(t *testing.T) {
+		testsDirectory := writeTestFiles(t, map[string]string{
+			"example_test.rego": `package policies
+			test_allow_with_header {
+				allow_with_header with input as {"request": {"headers": {"X-Role": ["admin"]}}}
+			}
+			test_allow_with_wrong_header {
+				allow_with_header with input as {"request": {"headers": {"X-Role": ["guest"]}}}
+			}
+			todo_test_skipped {
+				false
+			}`,
+		})
+
+		output := &bytes.Buffer{}
+		passed, err := RunPolicyTests(context.Background(), output, opaModuleConfig, testsDirectory, mocks.MongoClientMock{}, env)
+		require.NoError(t, err)
+		require.False(t, passed)
+		require.Contains(t, output.String(), "test_allow_with_wrong_header: FAIL")
+		require.Contains(t, output.String(), "PASS: 1/3")
+		require.Contains(t, output.String(), "FAIL: 1/3")
+		require.Contains(t, output.String(), "SKIPPED: 1/3")
+	})
+
+	t.Run("runs tests against the other loaded modules", func(t *testing.T) {
+		authzModule := `package policies.authz
+		is_admin {
+			input.user.id == "admin"
+		}`
+		testsDirectory := writeTestFiles(t, map[string]string{
+			"admin.rego": authzModule,
+			"authz_test.rego": `package policies.authz
+			test_is_admin {
+				is_admin with input as {"user": {"id": "admin"}}
+			}`,
+		})
+		moduleConfig := *opaModuleConfig
+		moduleConfig.Modules = []RegoModule{{Name: "authz/admin.rego", Content: authzModule}}
+
+		output := &bytes.Buffer{}
+		passed, err := RunPolicyTests(context.Background(), output, &moduleConfig, testsDirectory, mocks.MongoClientMock{}, env)
+		require.NoError(t, err)
+		require.True(t, passed, output.String())
+		require.Contains(t, output.String(), "PASS: 1/1")
+	})
+
+	t.Run("mongo builtins are not available without mongo client", func(t *testing.T) {
+		testsDirectory := writeTestFiles(t, map[string]string{
+			"example_test.rego": `package policies
+			test_allow_with_find_one {
+				allow_with_find_one with input as {"request": {"pathParams": {"projectId": "p1"}}}
+			}`,
+		})
+
+		passed, err := RunPolicyTests(context.Background(), &bytes.Buffer{}, opaModuleConfig, testsDirectory, nil, env)
+		require.ErrorContains(t, err, "failed policies tests setup")
+		require.ErrorContains(t, err, "undefined function find_one")
+		require.False(t, passed)
+	})
+
+	t.Run("fails without test files", func(t *testing.T) {
+		testsDirectory := writeTestFiles(t, map[string]string{"example.rego": policies})
+
+		passed, err := RunPolicyTests(context.Background(), &bytes.Buffer{}, opaModuleConfig, testsDirectory, nil, env)
+		require.EqualError(t, err, "no rego test file found in "+testsDirectory)
+		require.False(t, passed)
+	})
+
+	t.Run("fails with invalid test file", func(t *testing.T) {
+		testsDirectory := writeTestFiles(t, map[string]string{"example_test.rego": "package policies\ntest_invalid {"})
+
+		passed, err := RunPolicyTests(context.Background(), &bytes.Buffer{}, opaModuleConfig, testsDirectory, nil, env)
+		require.ErrorContains(t, err, "example_test.rego")
+		require.False(t, passed)
+	})
+}
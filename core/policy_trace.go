@@ -0,0 +1,125 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown"
+	"github.com/rond-authz/rond/custom_builtins"
+	"github.com/rond-authz/rond/internal/config"
+)
+
+// PolicyTrace is the debug report of a single policy evaluation.
+type PolicyTrace struct {
+	PolicyName string          `json:"policyName"`
+	Allowed    bool            `json:"allowed"`
+	Result     interface{}     `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Input      json.RawMessage `json:"input"`
+	Trace      []string        `json:"trace"`
+}
+
+// TracePolicyEvaluation evaluates the policy with the OPA tracer enabled. The policy is
+// compiled from scratch so that the trace covers the whole module: it is meant to debug
+// single requests and must never run in the normal request flow.
+// The evaluation error is reported in the trace, while the returned error is set only
+// if the trace cannot be produced.
+func TracePolicyEvaluation(ctx context.Context, policy string, generateQuery bool, input []byte, env config.EnvironmentVariables) (*PolicyTrace, error) {
+	inputValue, err := parseRegoInput(input)
+	if err != nil {
+		return nil, err
+	}
+	return tracePolicyEvaluation(ctx, policy, generateQuery, inputValue, json.RawMessage(input), env)
+}
+
+// TracePolicyEvaluationWithParsedInput is like TracePolicyEvaluation, with the input already
+// converted to its AST value.
+func TracePolicyEvaluationWithParsedInput(ctx context.Context, policy string, generateQuery bool, input ast.Value, env config.EnvironmentVariables) (*PolicyTrace, error) {
+	inputJSON, err := ast.JSON(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed input conversion: %v", err)
+	}
+	inputBytes, err := json.Marshal(inputJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed input JSON encode: %v", err)
+	}
+	return tracePolicyEvaluation(ctx, policy, generateQuery, input, json.RawMessage(inputBytes), env)
+}
+
+func tracePolicyEvaluation(ctx context.Context, policy string, generateQuery bool, input ast.Value, inputJSON json.RawMessage, env config.EnvironmentVariables) (*PolicyTrace, error) {
+	opaModuleConfig, err := GetOPAModuleConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tracer := topdown.NewBufferTracer()
+	query := newRegoQuery(policy, opaModuleConfig, env,
+		rego.ParsedInput(input),
+		rego.PrintHook(NewPrintHook(glogger.Get(ctx), policy, input).WithLevel(printHookLevel(env))),
+		rego.QueryTracer(tracer),
+	)
+
+	policyTrace := &PolicyTrace{
+		PolicyName: policy,
+		Input:      inputJSON,
+	}
+	evaluationContext := custom_builtins.WithMongoBuiltinCache(ctx)
+	if generateQuery {
+		queries, err := query.Partial(evaluationContext)
+		if err != nil {
+			policyTrace.Error = err.Error()
+		} else {
+			policyTrace.Allowed = len(queries.Queries) > 0
+			policyTrace.Result = queries
+		}
+	} else {
+		results, err := query.Eval(evaluationContext)
+		if err != nil {
+			policyTrace.Error = err.Error()
+		} else {
+			policyTrace.Allowed = isAllowedResult(results)
+			policyTrace.Result = results
+		}
+	}
+
+	var prettyTrace bytes.Buffer
+	topdown.PrettyTraceWithLocation(&prettyTrace, *tracer)
+	policyTrace.Trace = []string{}
+	if prettyTrace.Len() > 0 {
+		policyTrace.Trace = strings.Split(strings.TrimSuffix(prettyTrace.String(), "\n"), "\n")
+	}
+	return policyTrace, nil
+}
+
+// isAllowedResult reports whether the results allow the request, following the same
+// rules of Evaluate: either the policy is true or it returns a non empty value.
+func isAllowedResult(results rego.ResultSet) bool {
+	if results.Allowed() {
+		return true
+	}
+	if len(results) == 1 && len(results[0].Expressions) == 1 {
+		value, ok := results[0].Expressions[0].Value.([]interface{})
+		return ok && len(value) != 0
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracePolicyEvaluation(t *testing.T) {
+	env := config.EnvironmentVariables{}
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		allow {
+			input.request.method == "GET"
+		}
+		filter_response [body] {
+			body := json.remove(input.response.body, ["secret"])
+		}
+		filter_projects {
+			project := data.resources[_]
+			project.tenantId == input.user.properties.tenantId
+		}`,
+	}
+	ctx := WithOPAModuleConfig(context.Background(), opaModuleConfig)
+
+	traceContains := func(t *testing.T, trace []string, text string) {
+		t.Helper()
+		for _, line := range trace {
+			if strings.Contains(line, text) {
+				return
+			}
+		}
+		require.Failf(t, "text not found in trace", "%s not found in %v", text, trace)
+	}
+
+	t.Run("traces the allowed evaluation", func(t *testing.T) {
+		input := []byte(`{"request":{"method":"GET"}}`)
+		policyTrace, err := TracePolicyEvaluation(ctx, "allow", false, input, env)
+		require.NoError(t, err)
+		require.Equal(t, "allow", policyTrace.PolicyName)
+		require.True(t, policyTrace.Allowed)
+		require.Empty(t, policyTrace.Error)
+		require.JSONEq(t, string(input), string(policyTrace.Input))
+		traceContains(t, policyTrace.Trace, "Enter data.policies.allow")
+		traceContains(t, policyTrace.Trace, `input.request.method = "GET"`)
+	})
+
+	t.Run("traces the denied evaluation", func(t *testing.T) {
+		policyTrace, err := TracePolicyEvaluation(ctx, "allow", false, []byte(`{"request":{"method":"POST"}}`), env)
+		require.NoError(t, err)
+		require.False(t, policyTrace.Allowed)
+		traceContains(t, policyTrace.Trace, "Fail")
+	})
+
+	t.Run("traces the policy returning a body", func(t *testing.T) {
+		policyTrace, err := TracePolicyEvaluation(ctx, "filter_response", false, []byte(`{"response":{"body":{"name":"n","secret":"s"}}}`), env)
+		require.NoError(t, err)
+		require.True(t, policyTrace.Allowed)
+		traceContains(t, policyTrace.Trace, "Enter data.policies.filter_response")
+	})
+
+	t.Run("traces the query generation", func(t *testing.T) {
+		policyTrace, err := TracePolicyEvaluation(ctx, "filter_projects", true, []byte(`{"user":{"properties":{"tenantId":"t1"}}}`), env)
+		require.NoError(t, err)
+		require.True(t, policyTrace.Allowed)
+		require.NotNil(t, policyTrace.Result)
+		traceContains(t, policyTrace.Trace, "Enter data.policies.filter_projects")
+	})
+
+	t.Run("reports the evaluation error", func(t *testing.T) {
+		ctx := WithOPAModuleConfig(context.Background(), &OPAModuleConfig{
+			Name:    "example.rego",
+			Content: `package policies allow { undefined_function(input) }`,
+		})
+		policyTrace, err := TracePolicyEvaluation(ctx, "allow", false, []byte(`{}`), env)
+		require.NoError(t, err)
+		require.False(t, policyTrace.Allowed)
+		require.Contains(t, policyTrace.Error, "undefined function undefined_function")
+		require.Empty(t, policyTrace.Trace)
+	})
+
+	t.Run("fails without module config", func(t *testing.T) {
+		_, err := TracePolicyEvaluation(context.Background(), "allow", false, []byte(`{}`), env)
+		require.Error(t, err)
+	})
+
+	t.Run("fails with invalid input", func(t *testing.T) {
+		_, err := TracePolicyEvaluation(ctx, "allow", false, []byte(`{`), env)
+		require.ErrorContains(t, err, "failed input parse")
+	})
+}
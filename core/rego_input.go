@@ -0,0 +1,279 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/rond-authz/rond/types"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+// parseRegoInput parses the JSON encoded input, it is used by the functions accepting the
+// input as bytes.
+func parseRegoInput(input []byte) (ast.Value, error) {
+	inputTerm, err := ast.ParseTerm(string(input))
+	if err != nil {
+		return nil, fmt.Errorf("failed input parse: %v", err)
+	}
+	return inputTerm.Value, nil
+}
+
+// astValue converts the input to the AST value provided to the policies, without the JSON
+// encoding round trip. The resulting document has the same shape as the JSON encoding of
+// the input, omitted empty fields included.
+func (input Input) astValue() (ast.Value, error) {
+	request, err := input.Request.astValue()
+	if err != nil {
+		return nil, err
+	}
+	response := ast.NewObject()
+	if err := insertInterface(response, "body", input.Response.Body); err != nil {
+		return nil, err
+	}
+	if input.Response.StatusCode != 0 {
+		insert(response, "statusCode", ast.IntNumberTerm(input.Response.StatusCode).Value)
+	}
+	user, err := input.User.astValue()
+	if err != nil {
+		return nil, err
+	}
+
+	object := ast.NewObject(
+		ast.Item(ast.StringTerm("request"), ast.NewTerm(request)),
+		ast.Item(ast.StringTerm("response"), ast.NewTerm(response)),
+		ast.Item(ast.StringTerm("user"), ast.NewTerm(user)),
+	)
+	insertString(object, "clientType", input.ClientType)
+	return object, nil
+}
+
+func (request InputRequest) astValue() (ast.Value, error) {
+	object := ast.NewObject(
+		ast.Item(ast.StringTerm("method"), ast.StringTerm(request.Method)),
+		ast.Item(ast.StringTerm("path"), ast.StringTerm(request.Path)),
+		ast.Item(ast.StringTerm("tls"), ast.BooleanTerm(request.TLS)),
+	)
+	if err := insertInterface(object, "body", request.Body); err != nil {
+		return nil, err
+	}
+	if len(request.Headers) > 0 {
+		insert(object, "headers", stringSlicesMapValue(request.Headers))
+	}
+	if len(request.HeadersLower) > 0 {
+		insert(object, "headersLower", stringMapValue(request.HeadersLower))
+	}
+	if len(request.HeadersLowerJoined) > 0 {
+		insert(object, "headersLowerJoined", stringMapValue(request.HeadersLowerJoined))
+	}
+	if len(request.Query) > 0 {
+		insert(object, "query", stringSlicesMapValue(request.Query))
+	}
+	insert(object, "queryParams", stringSlicesMapValue(request.QueryParams))
+	if len(request.FormFields) > 0 {
+		insert(object, "formFields", stringSlicesMapValue(request.FormFields))
+	}
+	if len(request.PathParams) > 0 {
+		insert(object, "pathParams", stringMapValue(request.PathParams))
+	}
+	if len(request.ForwardedFor) > 0 {
+		insert(object, "forwardedFor", stringSliceValue(request.ForwardedFor))
+	}
+	insertString(object, "clientIP", request.ClientIP)
+	insertString(object, "requestId", request.RequestID)
+	insertString(object, "clientType", request.ClientType)
+	insertString(object, "upstreamHost", request.UpstreamHost)
+	return object, nil
+}
+
+func (user InputUser) astValue() (ast.Value, error) {
+	object := ast.NewObject(ast.Item(ast.StringTerm("id"), ast.StringTerm(user.ID)))
+	if len(user.Properties) > 0 {
+		if err := insertInterface(object, "properties", user.Properties); err != nil {
+			return nil, err
+		}
+	}
+	if len(user.Groups) > 0 {
+		insert(object, "groups", stringSliceValue(user.Groups))
+	}
+	if len(user.Bindings) > 0 {
+		bindings := make([]*ast.Term, 0, len(user.Bindings))
+		for _, binding := range user.Bindings {
+			bindings = append(bindings, ast.NewTerm(bindingValue(binding)))
+		}
+		insert(object, "bindings", ast.NewArray(bindings...))
+	}
+	if len(user.Roles) > 0 {
+		roles := make([]*ast.Term, 0, len(user.Roles))
+		for _, role := range user.Roles {
+			roles = append(roles, ast.ObjectTerm(
+				ast.Item(ast.StringTerm("roleId"), ast.StringTerm(role.RoleID)),
+				ast.Item(ast.StringTerm("permissions"), ast.NewTerm(stringSliceValue(role.Permissions))),
+			))
+		}
+		insert(object, "roles", ast.NewArray(roles...))
+	}
+	if len(user.ResourcePermissionsMap) > 0 {
+		permissions := ast.NewObject()
+		for key, value := range user.ResourcePermissionsMap {
+			permissions.Insert(ast.StringTerm(string(key)), ast.BooleanTerm(value))
+		}
+		insert(object, "resourcePermissionsMap", permissions)
+	}
+	insertString(object, "identitySource", user.IdentitySource)
+	return object, nil
+}
+
+func bindingValue(binding types.Binding) ast.Value {
+	object := ast.NewObject(ast.Item(ast.StringTerm("bindingId"), ast.StringTerm(binding.BindingID)))
+	if binding.Resource != nil {
+		resource := ast.NewObject()
+		insertString(resource, "resourceType", binding.Resource.ResourceType)
+		insertString(resource, "resourceId", binding.Resource.ResourceID)
+		insert(object, "resource", resource)
+	}
+	if len(binding.Groups) > 0 {
+		insert(object, "groups", stringSliceValue(binding.Groups))
+	}
+	if len(binding.Subjects) > 0 {
+		insert(object, "subjects", stringSliceValue(binding.Subjects))
+	}
+	if len(binding.Permissions) > 0 {
+		insert(object, "permissions", stringSliceValue(binding.Permissions))
+	}
+	if len(binding.Roles) > 0 {
+		insert(object, "roles", stringSliceValue(binding.Roles))
+	}
+	if binding.ExpiresAt != nil {
+		insert(object, "expiresAt", ast.String(binding.ExpiresAt.Format(time.RFC3339Nano)))
+	}
+	return object
+}
+
+func insert(object ast.Object, key string, value ast.Value) {
+	object.Insert(ast.StringTerm(key), ast.NewTerm(value))
+}
+
+// insertString adds the string value, omitting it if empty.
+func insertString(object ast.Object, key, value string) {
+	if value != "" {
+		insert(object, key, ast.String(value))
+	}
+}
+
+// insertInterface adds the value decoded from JSON, omitting it if nil.
+func insertInterface(object ast.Object, key string, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	converted, err := interfaceToValue(value)
+	if err != nil {
+		return fmt.Errorf("failed input %s conversion: %s", key, err.Error())
+	}
+	insert(object, key, converted)
+	return nil
+}
+
+func stringSliceValue(values []string) ast.Value {
+	if values == nil {
+		return ast.Null{}
+	}
+	terms := make([]*ast.Term, 0, len(values))
+	for _, value := range values {
+		terms = append(terms, ast.StringTerm(value))
+	}
+	return ast.NewArray(terms...)
+}
+
+func stringMapValue(values map[string]string) ast.Value {
+	object := ast.NewObject()
+	for key, value := range values {
+		object.Insert(ast.StringTerm(key), ast.StringTerm(value))
+	}
+	return object
+}
+
+func stringSlicesMapValue[T ~map[string][]string](values T) ast.Value {
+	object := ast.NewObject()
+	for key, value := range values {
+		object.Insert(ast.StringTerm(key), ast.NewTerm(stringSliceValue(value)))
+	}
+	return object
+}
+
+// interfaceToValue converts the values decoded from JSON. Numbers are formatted as the
+// JSON encoding does, so that policies see the same numbers of the encoded input.
+func interfaceToValue(value interface{}) (ast.Value, error) {
+	switch value := value.(type) {
+	case nil:
+		return ast.Null{}, nil
+	case bool:
+		return ast.Boolean(value), nil
+	case string:
+		return ast.String(value), nil
+	case float64:
+		return floatNumber(value)
+	case json.Number:
+		return ast.Number(value), nil
+	case []interface{}:
+		terms := make([]*ast.Term, 0, len(value))
+		for _, item := range value {
+			itemValue, err := interfaceToValue(item)
+			if err != nil {
+				return nil, err
+			}
+			terms = append(terms, ast.NewTerm(itemValue))
+		}
+		return ast.NewArray(terms...), nil
+	case map[string]interface{}:
+		object := ast.NewObject()
+		for key, item := range value {
+			itemValue, err := interfaceToValue(item)
+			if err != nil {
+				return nil, err
+			}
+			object.Insert(ast.StringTerm(key), ast.NewTerm(itemValue))
+		}
+		return object, nil
+	default:
+		return ast.InterfaceToValue(value)
+	}
+}
+
+// floatNumber formats the number as encoding/json does.
+func floatNumber(value float64) (ast.Value, error) {
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return nil, fmt.Errorf("unsupported number value: %v", value)
+	}
+	format := byte('f')
+	if abs := math.Abs(value); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	number := strconv.AppendFloat(nil, value, format, -1, 64)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		n := len(number)
+		if n >= 4 && number[n-4] == 'e' && number[n-3] == '-' && number[n-2] == '0' {
+			number[n-2] = number[n-1]
+			number = number[:n-1]
+		}
+	}
+	return ast.Number(number), nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/utils"
+	"github.com/rond-authz/rond/openapi"
+	"github.com/rond-authz/rond/types"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown/print"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func richRegoInputRequest(t testing.TB) (*http.Request, config.EnvironmentVariables, types.User) {
+	t.Helper()
+	env := config.EnvironmentVariables{
+		UserPropertiesHeader:       "userproperties",
+		UserPropertiesHeaderBase64: true,
+		ClientTypeHeader:           "client-type",
+		TargetServiceHost:          "target:3000",
+		UpstreamRoutes:             []config.UpstreamRoute{{PathPrefix: "/users", Host: "users:8080"}},
+	}
+	body := `{"count":1234567,"ratio":1e-7,"big":12345678901234567890,"nested":{"list":[1,"two",true,null]},"empty":{}}`
+	req := httptest.NewRequest(http.MethodPost, "/users/42?filter=a&filter=b&sort=name", bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", utils.JSONContentTypeHeader)
+	req.Header.Add("Accept", "text/html")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Set("client-type", "mobile")
+	req.Header.Set("userproperties", base64.StdEncoding.EncodeToString([]byte(`{"name":"gianni","age":42,"tags":["a","b"]}`)))
+
+	expiresAt := time.Date(2030, time.January, 2, 3, 4, 5, 6, time.UTC)
+	user := types.User{
+		UserID:         "user1",
+		UserGroups:     []string{"group1"},
+		IdentitySource: config.UserIDSourceAPIKey,
+		UserRoles: []types.Role{
+			{RoleID: "admin", Permissions: []string{"users.read", "users.write"}},
+			{RoleID: "empty"},
+		},
+		UserBindings: []types.Binding{
+			{
+				BindingID: "binding1",
+				Subjects:  []string{"user1"},
+				Roles:     []string{"admin"},
+				Resource:  &types.Resource{ResourceType: "project", ResourceID: "p1"},
+				ExpiresAt: &expiresAt,
+			},
+			{BindingID: "binding2", Permissions: []string{"users.delete"}, Resource: &types.Resource{ResourceType: "project", ResourceID: "p2"}},
+			{BindingID: "binding3", Groups: []string{"group1"}, Roles: []string{"admin"}, Resource: &types.Resource{ResourceType: "project", ResourceID: "p3"}},
+		},
+	}
+	return req, env, user
+}
+
+func TestParsedRegoQueryInput(t *testing.T) {
+	responseBody := map[string]interface{}{"items": []interface{}{float64(1), "x"}, "total": float64(0.5)}
+
+	for _, optimization := range []bool{false, true} {
+		req, env, user := richRegoInputRequest(t)
+		inputBytes, err := CreateRegoQueryInput(req, env, optimization, user, responseBody)
+		require.NoError(t, err)
+		expected, err := parseRegoInput(inputBytes)
+		require.NoError(t, err)
+
+		req, env, user = richRegoInputRequest(t)
+		parsed, err := CreateParsedRegoQueryInput(req, env, optimization, user, responseBody)
+		require.NoError(t, err)
+		require.Equal(t, 0, parsed.Compare(expected), "parsed input:\n%s\nJSON input:\n%s", parsed, expected)
+	}
+
+	t.Run("builtins see the same input", func(t *testing.T) {
+		req, env, user := richRegoInputRequest(t)
+		inputBytes, err := CreateRegoQueryInput(req, env, true, user, nil)
+		require.NoError(t, err)
+		expected, err := parseRegoInput(inputBytes)
+		require.NoError(t, err)
+		req, env, user = richRegoInputRequest(t)
+		parsed, err := CreateParsedRegoQueryInput(req, env, true, user, nil)
+		require.NoError(t, err)
+
+		marshal := func(input ast.Value) interface{} {
+			results, err := rego.New(rego.Query("json.marshal(input)"), rego.ParsedInput(input)).Eval(context.Background())
+			require.NoError(t, err)
+			require.Len(t, results, 1)
+			return results[0].Expressions[0].Value
+		}
+		require.Equal(t, marshal(expected), marshal(parsed))
+	})
+
+	t.Run("print hook sees the same user", func(t *testing.T) {
+		req, env, user := richRegoInputRequest(t)
+		parsed, err := CreateParsedRegoQueryInput(req, env, false, user, nil)
+		require.NoError(t, err)
+
+		log, hook := test.NewNullLogger()
+		log.SetLevel(logrus.TraceLevel)
+		err = NewPrintHook(logrus.NewEntry(log), "policy-name", parsed).Print(print.Context{}, "message")
+		require.NoError(t, err)
+		require.Equal(t, "user1", hook.LastEntry().Data["userId"])
+	})
+
+	t.Run("fails on invalid userproperties header", func(t *testing.T) {
+		env := config.EnvironmentVariables{UserPropertiesHeader: "userproperties"}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("userproperties", "1")
+
+		_, err := CreateParsedRegoQueryInput(req, env, false, types.User{}, nil)
+		require.Error(t, err)
+	})
+}
+
+func BenchmarkRegoQueryInput(b *testing.B) {
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		allow {
+			input.request.method == "POST"
+			input.user.properties.name == "gianni"
+		}`,
+	}
+	env := config.EnvironmentVariables{}
+	partialEvaluator, err := createPartialEvaluator("allow", context.Background(), nil, nil, opaModuleConfig, env)
+	require.NoError(b, err)
+	partialEvaluators := PartialResultsEvaluators{{PolicyName: "allow"}: *partialEvaluator}
+	ctx := context.WithValue(context.Background(), openapi.RouterInfoKey{}, openapi.RouterInfo{})
+
+	b.Run("bytes", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			req, env, user := richRegoInputRequest(b)
+			input, err := CreateRegoQueryInput(req, env, true, user, nil)
+			require.NoError(b, err)
+			_, err = partialEvaluators.GetEvaluatorFromPolicy(ctx, EvaluatorKey{PolicyName: "allow"}, input, env)
+			require.NoError(b, err)
+		}
+	})
+
+	b.Run("parsed", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			req, env, user := richRegoInputRequest(b)
+			input, err := CreateParsedRegoQueryInput(req, env, true, user, nil)
+			require.NoError(b, err)
+			_, err = partialEvaluators.GetEvaluatorFromPolicyWithParsedInput(ctx, EvaluatorKey{PolicyName: "allow"}, input, env)
+			require.NoError(b, err)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"net/http"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/utils"
+
+	"github.com/google/uuid"
+)
+
+// withRequestIDHeader makes sure the request forwarded to the target service carries the
+// request id with the REQUEST_ID_HEADER_KEY header, so that the upstream access log can be
+// correlated to the rond one. The id set by the request id middleware is reused; when the
+// transport is used without it, a new id is generated. The request is cloned before being
+// modified, as required to round trippers.
+func withRequestIDHeader(env config.EnvironmentVariables, req *http.Request) (*http.Request, string) {
+	if env.RequestIDHeaderKey == "" {
+		return req, ""
+	}
+	if requestID := req.Header.Get(env.RequestIDHeaderKey); requestID != "" {
+		return req, requestID
+	}
+	requestID := utils.GetRequestID(req.Context())
+	if requestID == "" {
+		requestID = uuid.NewString()
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set(env.RequestIDHeaderKey, requestID)
+	return req, requestID
+}
+
+// setResponseRequestID echoes the request id to the client with the REQUEST_ID_HEADER_KEY header.
+func setResponseRequestID(env config.EnvironmentVariables, resp *http.Response, requestID string) {
+	if requestID == "" || resp == nil {
+		return
+	}
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	resp.Header.Set(env.RequestIDHeaderKey, requestID)
+}
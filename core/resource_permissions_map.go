@@ -0,0 +1,165 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"strings"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/openapi"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/sirupsen/logrus"
+)
+
+// resourcePermissionsMapPath is the path of the optimized permissions map in the input.
+var resourcePermissionsMapPath = []string{"user", "resourcePermissionsMap"}
+
+// NeedsResourcePermissionsMap reports whether the input of the policy must contain the
+// optimized resource permissions map: the route option, defaulting to the environment
+// variable, enables it, and it is skipped for the policies known not to read it.
+func (partialEvaluators PartialResultsEvaluators) NeedsResourcePermissionsMap(key EvaluatorKey, options openapi.PermissionOptions, env config.EnvironmentVariables) bool {
+	if !options.ResourcePermissionsMapOptimization(env.EnableResourcePermissionsMapOptimization) {
+		return false
+	}
+	evaluator, ok := partialEvaluators[key]
+	return !ok || !evaluator.resourcePermissionsMapUnused
+}
+
+// markResourcePermissionsMapUsage flags the evaluators whose policies never read the optimized
+// permissions map, so that building it can be skipped. If the modules of a policy cannot be
+// analyzed the policy is assumed to read it.
+func markResourcePermissionsMapUsage(ctx context.Context, partialEvaluators PartialResultsEvaluators, opaModuleConfig *OPAModuleConfig, env config.EnvironmentVariables) {
+	// the modules are compiled once for all the policies using them
+	compilers := map[string]*ast.Compiler{}
+	for key, evaluator := range partialEvaluators {
+		policyModule, policy := splitPolicyEvaluatorKey(key.PolicyName)
+		compiler, compiled := compilers[policyModule]
+		if !compiled {
+			compiler = compilePolicyModule(ctx, opaModuleConfig, policyModule, env)
+			compilers[policyModule] = compiler
+		}
+		if compiler == nil {
+			continue
+		}
+		evaluator.resourcePermissionsMapUnused = !policyReadsResourcePermissionsMap(compiler, policy)
+		partialEvaluators[key] = evaluator
+	}
+}
+
+// compilePolicyModule compiles the modules of policyModule, returning nil if they cannot
+// be analyzed.
+func compilePolicyModule(ctx context.Context, opaModuleConfig *OPAModuleConfig, policyModule string, env config.EnvironmentVariables) *ast.Compiler {
+	moduleConfig, err := opaModuleConfig.ForPolicyModule(policyModule)
+	if err == nil {
+		var compiler *ast.Compiler
+		if compiler, err = compileModules(moduleConfig, env); err == nil {
+			return compiler
+		}
+	}
+	glogger.Get(ctx).WithFields(logrus.Fields{
+		"error":        logrus.Fields{"message": err.Error()},
+		"policyModule": policyModule,
+	}).Warn("failed policies analysis, the resource permissions map is built for all policies of the module")
+	return nil
+}
+
+func compileModules(opaModuleConfig *OPAModuleConfig, env config.EnvironmentVariables) (*ast.Compiler, error) {
+	modules := map[string]*ast.Module{}
+	regoModules := append([]RegoModule{{Name: opaModuleConfig.Name, Content: opaModuleConfig.Content}}, opaModuleConfig.Modules...)
+	for _, regoModule := range regoModules {
+		module, err := ast.ParseModule(regoModule.Name, regoModule.Content)
+		if err != nil {
+			return nil, err
+		}
+		modules[regoModule.Name] = module
+	}
+
+	capabilities, err := regoCapabilities(env)
+	if err != nil {
+		return nil, err
+	}
+	builtins := map[string]*ast.Builtin{}
+	for _, builtin := range regoBuiltins(env, true) {
+		builtins[builtin.decl.Name] = builtin.decl
+	}
+	compiler := ast.NewCompiler().WithCapabilities(capabilities).WithBuiltins(builtins).WithEnablePrintStatements(true)
+	if compiler.Compile(modules); compiler.Failed() {
+		return nil, compiler.Errors
+	}
+	return compiler, nil
+}
+
+// policyReadsResourcePermissionsMap walks the rules of the policy, of its deny reasons and of
+// all the rules and functions they depend on, looking for a reference to the map in the input.
+func policyReadsResourcePermissionsMap(compiler *ast.Compiler, policy string) bool {
+	sanitizedPolicy := strings.Replace(policy, ".", "_", -1)
+	policiesRef := ast.DefaultRootRef.Append(ast.StringTerm("policies"))
+
+	rules := []*ast.Rule{}
+	for _, rule := range []string{sanitizedPolicy, DenyReasonPolicyName(sanitizedPolicy)} {
+		rules = append(rules, compiler.GetRulesExact(policiesRef.Append(ast.StringTerm(rule)))...)
+	}
+	visited := map[*ast.Rule]bool{}
+	for len(rules) > 0 {
+		rule := rules[0]
+		rules = rules[1:]
+		if visited[rule] {
+			continue
+		}
+		visited[rule] = true
+		if ruleReadsResourcePermissionsMap(rule) {
+			return true
+		}
+		for dependency := range compiler.Graph.Dependencies(rule) {
+			if dependencyRule, ok := dependency.(*ast.Rule); ok {
+				rules = append(rules, dependencyRule)
+			}
+		}
+	}
+	return false
+}
+
+func ruleReadsResourcePermissionsMap(rule *ast.Rule) bool {
+	found := false
+	ast.WalkRefs(rule, func(ref ast.Ref) bool {
+		if !found && ref.HasPrefix(ast.InputRootRef) {
+			found = inputRefReadsResourcePermissionsMap(ref)
+		}
+		return found
+	})
+	return found
+}
+
+// inputRefReadsResourcePermissionsMap reports whether the input reference may read the map:
+// besides the map itself and its content, the references to its parents, such as the whole
+// input or user, and the ones with a variable key are assumed to read it.
+func inputRefReadsResourcePermissionsMap(ref ast.Ref) bool {
+	for i, key := range resourcePermissionsMapPath {
+		if len(ref) <= i+1 {
+			return true
+		}
+		refKey, ok := ref[i+1].Value.(ast.String)
+		if !ok {
+			return true
+		}
+		if string(refKey) != key {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/openapi"
+	"github.com/rond-authz/rond/types"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInputRefReadsResourcePermissionsMap(t *testing.T) {
+	testCases := map[string]bool{
+		"input":                                   true,
+		"input.user":                              true,
+		"input.user.resourcePermissionsMap":       true,
+		`input.user.resourcePermissionsMap["x"]`:  true,
+		"input.user[x]":                           true,
+		"input[x]":                                true,
+		"input.user.id":                           false,
+		"input.request.method":                    false,
+		`input.request.headers["x-user"]`:         false,
+		"input.response.body.resourcePermissions": false,
+	}
+	for ref, expected := range testCases {
+		t.Run(ref, func(t *testing.T) {
+			require.Equal(t, expected, inputRefReadsResourcePermissionsMap(ast.MustParseRef(ref)))
+		})
+	}
+}
+
+func TestSetupEvaluatorsResourcePermissionsMapUsage(t *testing.T) {
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		import data.helpers
+
+		reads_map { input.user.resourcePermissionsMap["read:project:p1"] }
+		reads_map_through_rule { helpers.has_permission }
+		reads_map_through_function { has_project_permission("read") }
+		reads_whole_user { user := input.user; user.resourcePermissionsMap["read:project:p1"] }
+		reads_map_in_deny_reason { input.request.method == "GET" }
+		reads_map_in_deny_reason_deny_reason["missing permission"] { not input.user.resourcePermissionsMap["read:project:p1"] }
+		ignores_map { input.user.id == "user1" }
+		ignores_map_through_rule { helpers.is_get }
+
+		has_project_permission(permission) {
+			input.user.resourcePermissionsMap[concat(":", [permission, "project", "p1"])]
+		}`,
+		Modules: []RegoModule{
+			{
+				Name: "helpers/helpers.rego",
+				Content: `package helpers
+				has_permission { input.user.resourcePermissionsMap["read:project:p1"] }
+				is_get { input.request.method == "GET" }`,
+			},
+		},
+	}
+	policies := []string{
+		"reads_map",
+		"reads_map_through_rule",
+		"reads_map_through_function",
+		"reads_whole_user",
+		"reads_map_in_deny_reason",
+		"ignores_map",
+		"ignores_map_through_rule",
+	}
+	oas := &openapi.OpenAPISpec{Paths: openapi.OpenAPIPaths{}}
+	for _, policy := range policies {
+		oas.Paths["/"+policy] = openapi.PathVerbs{
+			"get": openapi.VerbConfig{PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: policy}}},
+		}
+	}
+	enabled := true
+	options := openapi.PermissionOptions{EnableResourcePermissionsMapOptimization: &enabled}
+
+	for _, env := range []config.EnvironmentVariables{{}, {LazyEvaluatorInit: true}} {
+		partialEvaluators, _, err := SetupEvaluators(context.Background(), nil, oas, opaModuleConfig, env)
+		require.NoError(t, err)
+
+		for _, policy := range policies {
+			expected := policy != "ignores_map" && policy != "ignores_map_through_rule"
+			require.Equal(t, expected, partialEvaluators.NeedsResourcePermissionsMap(EvaluatorKey{PolicyName: policy}, options, env), "policy %s, lazy %t", policy, env.LazyEvaluatorInit)
+		}
+	}
+
+	t.Run("route option defaults to the environment variable", func(t *testing.T) {
+		partialEvaluators, _, err := SetupEvaluators(context.Background(), nil, oas, opaModuleConfig, config.EnvironmentVariables{})
+		require.NoError(t, err)
+		disabled := false
+
+		require.False(t, partialEvaluators.NeedsResourcePermissionsMap(EvaluatorKey{PolicyName: "reads_map"}, openapi.PermissionOptions{}, config.EnvironmentVariables{}))
+		require.True(t, partialEvaluators.NeedsResourcePermissionsMap(EvaluatorKey{PolicyName: "reads_map"}, openapi.PermissionOptions{}, config.EnvironmentVariables{EnableResourcePermissionsMapOptimization: true}))
+		require.False(t, partialEvaluators.NeedsResourcePermissionsMap(EvaluatorKey{PolicyName: "reads_map"}, openapi.PermissionOptions{EnableResourcePermissionsMapOptimization: &disabled}, config.EnvironmentVariables{EnableResourcePermissionsMapOptimization: true}))
+		require.False(t, partialEvaluators.NeedsResourcePermissionsMap(EvaluatorKey{PolicyName: "ignores_map"}, openapi.PermissionOptions{}, config.EnvironmentVariables{EnableResourcePermissionsMapOptimization: true}))
+	})
+
+	t.Run("policies not analyzed are assumed to read the map", func(t *testing.T) {
+		require.True(t, PartialResultsEvaluators{}.NeedsResourcePermissionsMap(EvaluatorKey{PolicyName: "unknown"}, options, config.EnvironmentVariables{}))
+	})
+
+	t.Run("map is in the input only when read", func(t *testing.T) {
+		partialEvaluators, _, err := SetupEvaluators(context.Background(), nil, oas, opaModuleConfig, config.EnvironmentVariables{})
+		require.NoError(t, err)
+		user := types.User{
+			UserID:    "user1",
+			UserRoles: []types.Role{{RoleID: "reader", Permissions: []string{"read"}}},
+			UserBindings: []types.Binding{
+				{BindingID: "b1", Roles: []string{"reader"}, Resource: &types.Resource{ResourceType: "project", ResourceID: "p1"}},
+			},
+		}
+		mapRef := ast.MustParseRef("input.user.resourcePermissionsMap")[1:]
+
+		for policy, expected := range map[string]bool{"reads_map": true, "ignores_map": false} {
+			req := httptest.NewRequest(http.MethodGet, "/"+policy, nil)
+			input, err := CreateParsedRegoQueryInput(req, config.EnvironmentVariables{}, partialEvaluators.NeedsResourcePermissionsMap(EvaluatorKey{PolicyName: policy}, options, config.EnvironmentVariables{}), user, nil)
+			require.NoError(t, err)
+
+			_, err = input.Find(mapRef)
+			require.Equal(t, expected, err == nil, "policy %s", policy)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+type responseBodyCacheKey struct{}
+
+// ResponseBodyCache holds the bodies returned by the response policies, so that a response
+// policy is not evaluated again on an input already seen. The least recently used entry is
+// evicted when the cache is full.
+//
+// The entries are keyed on the whole policy input, not only on the response body, since the
+// response policies depend on the user and the request as well; the request id is the only
+// part of the input left out. The policies module fingerprint is part of the key too, so that
+// the entries of a replaced module are never used and are evicted over time.
+type ResponseBodyCache struct {
+	mtx      sync.Mutex
+	capacity int
+	entries  map[[sha256.Size]byte]*list.Element
+	lru      *list.List
+}
+
+type responseBodyCacheEntry struct {
+	key  [sha256.Size]byte
+	body interface{}
+}
+
+// NewResponseBodyCache returns a cache holding at most maxSize response bodies, or nil
+// if maxSize is not positive. Lookups on a nil cache always miss.
+func NewResponseBodyCache(maxSize int) *ResponseBodyCache {
+	if maxSize <= 0 {
+		return nil
+	}
+	return &ResponseBodyCache{
+		capacity: maxSize,
+		entries:  make(map[[sha256.Size]byte]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (cache *ResponseBodyCache) get(key [sha256.Size]byte) (interface{}, bool) {
+	if cache == nil {
+		return nil, false
+	}
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	cache.lru.MoveToFront(element)
+	return element.Value.(*responseBodyCacheEntry).body, true
+}
+
+func (cache *ResponseBodyCache) set(key [sha256.Size]byte, body interface{}) {
+	if cache == nil {
+		return
+	}
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	if element, ok := cache.entries[key]; ok {
+		element.Value.(*responseBodyCacheEntry).body = body
+		cache.lru.MoveToFront(element)
+		return
+	}
+
+	cache.entries[key] = cache.lru.PushFront(&responseBodyCacheEntry{key: key, body: body})
+	if cache.lru.Len() > cache.capacity {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*responseBodyCacheEntry).key)
+	}
+}
+
+// Len returns the number of response bodies currently stored in the cache.
+func (cache *ResponseBodyCache) Len() int {
+	if cache == nil {
+		return 0
+	}
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	return cache.lru.Len()
+}
+
+// buildResponseBodyCacheKey hashes the response policy evaluator key together with its input,
+// leaving out the request id, which changes on every request.
+func buildResponseBodyCacheKey(evaluatorKey EvaluatorKey, input Input, requestIDHeaderKey string) ([sha256.Size]byte, error) {
+	input.Request.RequestID = ""
+	if requestIDHeaderKey != "" {
+		input.Request.Headers = withoutHeaders(input.Request.Headers, []string{requestIDHeaderKey})
+		input.Request.HeadersLower = withoutKey(input.Request.HeadersLower, strings.ToLower(requestIDHeaderKey))
+		input.Request.HeadersLowerJoined = withoutKey(input.Request.HeadersLowerJoined, strings.ToLower(requestIDHeaderKey))
+	}
+	inputJSON, err := json.Marshal(input)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(evaluatorKey.ModuleFingerprint))
+	hash.Write([]byte{0})
+	hash.Write([]byte(evaluatorKey.PolicyName))
+	hash.Write([]byte{0})
+	hash.Write(inputJSON)
+	var key [sha256.Size]byte
+	copy(key[:], hash.Sum(nil))
+	return key, nil
+}
+
+func withoutKey(values map[string]string, excludedKey string) map[string]string {
+	if _, ok := values[excludedKey]; !ok {
+		return values
+	}
+	filtered := make(map[string]string, len(values))
+	for key, value := range values {
+		if key != excludedKey {
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
+
+// ResponseBodyCacheInjectorMiddleware will inject into request context the response body cache.
+func ResponseBodyCacheInjectorMiddleware(cache *ResponseBodyCache) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := WithResponseBodyCache(r.Context(), cache)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func WithResponseBodyCache(requestContext context.Context, cache *ResponseBodyCache) context.Context {
+	return context.WithValue(requestContext, responseBodyCacheKey{}, cache)
+}
+
+// GetResponseBodyCache returns the response body cache from the request context, or nil
+// if caching is not enabled.
+func GetResponseBodyCache(requestContext context.Context) *ResponseBodyCache {
+	cache, _ := requestContext.Value(responseBodyCacheKey{}).(*ResponseBodyCache)
+	return cache
+}
@@ -0,0 +1,195 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/openapi"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseBodyCache(t *testing.T) {
+	t.Run("is disabled without a positive size", func(t *testing.T) {
+		require.Nil(t, NewResponseBodyCache(0))
+
+		var cache *ResponseBodyCache
+		cache.set([sha256.Size]byte{1}, "body")
+		_, found := cache.get([sha256.Size]byte{1})
+		require.False(t, found)
+		require.Equal(t, 0, cache.Len())
+	})
+
+	t.Run("evicts the least recently used body", func(t *testing.T) {
+		cache := NewResponseBodyCache(2)
+		cache.set([sha256.Size]byte{1}, "first")
+		cache.set([sha256.Size]byte{2}, "second")
+		_, found := cache.get([sha256.Size]byte{1})
+		require.True(t, found)
+
+		cache.set([sha256.Size]byte{3}, "third")
+		require.Equal(t, 2, cache.Len())
+		_, found = cache.get([sha256.Size]byte{2})
+		require.False(t, found)
+		body, found := cache.get([sha256.Size]byte{1})
+		require.True(t, found)
+		require.Equal(t, "first", body)
+	})
+
+	t.Run("key ignores the request id only", func(t *testing.T) {
+		evaluatorKey := EvaluatorKey{PolicyName: "filter", ModuleFingerprint: "v1"}
+		input := func(requestID, userID string) Input {
+			return Input{
+				Request: InputRequest{
+					RequestID:          requestID,
+					Headers:            http.Header{"X-Request-Id": []string{requestID}},
+					HeadersLower:       map[string]string{"x-request-id": requestID},
+					HeadersLowerJoined: map[string]string{"x-request-id": requestID},
+				},
+				Response: InputResponse{Body: map[string]interface{}{"hello": "world"}},
+				User:     InputUser{ID: userID},
+			}
+		}
+		key, err := buildResponseBodyCacheKey(evaluatorKey, input("request-1", "user-1"), "x-request-id")
+		require.NoError(t, err)
+
+		otherRequestKey, err := buildResponseBodyCacheKey(evaluatorKey, input("request-2", "user-1"), "x-request-id")
+		require.NoError(t, err)
+		require.Equal(t, key, otherRequestKey)
+
+		otherUserKey, err := buildResponseBodyCacheKey(evaluatorKey, input("request-1", "user-2"), "x-request-id")
+		require.NoError(t, err)
+		require.NotEqual(t, key, otherUserKey)
+
+		otherModuleKey, err := buildResponseBodyCacheKey(EvaluatorKey{PolicyName: "filter", ModuleFingerprint: "v2"}, input("request-1", "user-1"), "x-request-id")
+		require.NoError(t, err)
+		require.NotEqual(t, key, otherModuleKey)
+
+		requestInput := input("request-1", "user-1")
+		_, err = buildResponseBodyCacheKey(evaluatorKey, requestInput, "x-request-id")
+		require.NoError(t, err)
+		require.Equal(t, "request-1", requestInput.Request.HeadersLower["x-request-id"], "the input must not be modified")
+	})
+}
+
+func TestOPATransportResponseBodyCache(t *testing.T) {
+	envs := config.EnvironmentVariables{UserIdHeader: "miauserid", RequestIDHeaderKey: "x-request-id"}
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		filter_response [body] {
+			body := {"user": input.user.id, "data": input.response.body}
+		}`,
+	}
+	partialEvaluator, err := createPartialEvaluator("filter_response", context.Background(), nil, nil, opaModuleConfig, envs)
+	require.NoError(t, err)
+	partialEvaluators := PartialResultsEvaluators{
+		{PolicyName: "filter_response", ModuleFingerprint: "v1"}: *partialEvaluator,
+		{PolicyName: "filter_response", ModuleFingerprint: "v2"}: *partialEvaluator,
+	}
+	permission := &openapi.RondConfig{
+		ResponseFlow: openapi.ResponseFlow{PolicyName: "filter_response"},
+	}
+
+	roundTrip := func(t *testing.T, cache *ResponseBodyCache, fingerprint, userID, requestID string) (string, int) {
+		t.Helper()
+		moduleConfig := *opaModuleConfig
+		moduleConfig.Fingerprint = fingerprint
+		ctx := createContext(t, context.Background(), envs, nil, permission, &moduleConfig, partialEvaluators)
+		if cache != nil {
+			ctx = WithResponseBodyCache(ctx, cache)
+		}
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil).WithContext(ctx)
+		req.Header.Set("miauserid", userID)
+		req.Header.Set("x-request-id", requestID)
+		logger, hook := test.NewNullLogger()
+		logger.Level = logrus.DebugLevel
+		transport := &OPATransport{
+			&MockRoundTrip{Response: &http.Response{
+				StatusCode:    http.StatusOK,
+				Body:          io.NopCloser(bytes.NewReader([]byte(`{"hello":"world"}`))),
+				ContentLength: 17,
+				Header:        http.Header{"Content-Type": []string{"application/json"}},
+			}},
+			ctx,
+			logrus.NewEntry(logger),
+			req,
+			permission,
+			partialEvaluators,
+			envs,
+		}
+
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		evaluations := 0
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "policy evaluation completed" {
+				evaluations++
+			}
+		}
+		return string(body), evaluations
+	}
+
+	t.Run("evaluates the policy once for the same input", func(t *testing.T) {
+		cache := NewResponseBodyCache(10)
+
+		body, evaluations := roundTrip(t, cache, "v1", "user-1", "request-1")
+		require.Equal(t, 1, evaluations)
+		require.JSONEq(t, `{"user":"user-1","data":{"hello":"world"}}`, body)
+
+		cachedBody, evaluations := roundTrip(t, cache, "v1", "user-1", "request-2")
+		require.Equal(t, 0, evaluations)
+		require.Equal(t, body, cachedBody)
+		require.Equal(t, 1, cache.Len())
+	})
+
+	t.Run("evaluates the policy for another user", func(t *testing.T) {
+		cache := NewResponseBodyCache(10)
+
+		roundTrip(t, cache, "v1", "user-1", "request-1")
+		body, evaluations := roundTrip(t, cache, "v1", "user-2", "request-2")
+		require.Equal(t, 1, evaluations)
+		require.JSONEq(t, `{"user":"user-2","data":{"hello":"world"}}`, body)
+	})
+
+	t.Run("evaluates the policy after the module is reloaded", func(t *testing.T) {
+		cache := NewResponseBodyCache(10)
+
+		roundTrip(t, cache, "v1", "user-1", "request-1")
+		_, evaluations := roundTrip(t, cache, "v2", "user-1", "request-2")
+		require.Equal(t, 1, evaluations)
+	})
+
+	t.Run("evaluates the policy every time without cache", func(t *testing.T) {
+		_, evaluations := roundTrip(t, nil, "v1", "user-1", "request-1")
+		require.Equal(t, 1, evaluations)
+		_, evaluations = roundTrip(t, nil, "v1", "user-1", "request-1")
+		require.Equal(t, 1, evaluations)
+	})
+}
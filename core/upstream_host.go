@@ -0,0 +1,37 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"net/http"
+
+	"github.com/rond-authz/rond/internal/discovery"
+)
+
+// withResolvedTargetHost returns the request directed to the target service host resolved by
+// service discovery, if any. The request is copied, since a round tripper must not modify it.
+// The requests forwarded to the host of an upstream route are left untouched.
+func withResolvedTargetHost(req *http.Request) *http.Request {
+	host, ok := discovery.ResolvedHost(req.Context(), req.URL.Host)
+	if !ok || host == "" || host == req.URL.Host {
+		return req
+	}
+	outreq := new(http.Request)
+	*outreq = *req
+	targetURL := *req.URL
+	targetURL.Host = host
+	outreq.URL = &targetURL
+	return outreq
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/discovery"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/h2non/gock.v1"
+)
+
+func TestUpstreamTransportResolvedTargetHost(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+
+	t.Run("without resolver the request host is kept", func(t *testing.T) {
+		roundTripper := &SequenceRoundTrip{StatusCodes: []int{http.StatusOK}}
+		transport := &UpstreamTransport{RoundTripper: roundTripper, Logger: logrus.NewEntry(logger)}
+
+		req := httptest.NewRequest(http.MethodGet, "http://target-service:3000/some-api", nil)
+		_, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, []string{"target-service:3000"}, roundTripper.Hosts)
+	})
+
+	t.Run("follows the host resolved from consul", func(t *testing.T) {
+		defer gock.Off()
+		consulAddress := "http://consul.example.org:8500"
+		mockConsul := func(address string) {
+			gock.New(consulAddress).
+				Get("/v1/health/service/my-service").
+				Reply(http.StatusOK).
+				JSON([]map[string]interface{}{{"Service": map[string]interface{}{"Address": address, "Port": 8080}}})
+		}
+		resolver := discovery.NewConsulResolver(logrus.NewEntry(logger), consulAddress, "my-service", "target-service:3000")
+		ctx := discovery.WithResolver(context.Background(), resolver)
+		roundTripper := &SequenceRoundTrip{StatusCodes: []int{http.StatusOK, http.StatusOK, http.StatusOK}}
+		transport := &UpstreamTransport{RoundTripper: roundTripper, Logger: logrus.NewEntry(logger)}
+		roundTrip := func() {
+			req := httptest.NewRequest(http.MethodGet, "http://target-service:3000/some-api", nil).WithContext(ctx)
+			_, err := transport.RoundTrip(req)
+			require.NoError(t, err)
+			require.Equal(t, "target-service:3000", req.URL.Host, "the original request must not be modified")
+		}
+
+		roundTrip()
+		mockConsul("10.0.0.2")
+		require.NoError(t, resolver.Refresh(context.Background()))
+		roundTrip()
+		mockConsul("10.0.0.3")
+		require.NoError(t, resolver.Refresh(context.Background()))
+		roundTrip()
+
+		require.Equal(t, []string{"target-service:3000", "10.0.0.2:8080", "10.0.0.3:8080"}, roundTripper.Hosts)
+	})
+}
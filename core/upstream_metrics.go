@@ -0,0 +1,118 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/metrics"
+	"github.com/rond-authz/rond/internal/utils"
+	"github.com/rond-authz/rond/openapi"
+
+	"github.com/sirupsen/logrus"
+)
+
+// UpstreamTransport forwards the request to the target service recording the
+// upstream metrics and retrying server errors as configured, without any response
+// policy evaluation.
+type UpstreamTransport struct {
+	http.RoundTripper
+	Logger *logrus.Entry
+	Env    config.EnvironmentVariables
+}
+
+func (t *UpstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, requestID := withRequestIDHeader(t.Env, req)
+	resp, err := roundTripWithRetry(t.Logger, t.Env, t.RoundTripper, req)
+	setResponseRequestID(t.Env, resp, requestID)
+	return resp, err
+}
+
+// upstreamRoundTrip performs the request to the target service recording the request
+// and response body sizes and the round-trip duration, which is also reported in the
+// access log. The target service host resolved by service discovery is read at each
+// attempt, so that retries follow the moved upstream.
+func upstreamRoundTrip(transport http.RoundTripper, req *http.Request) (*http.Response, error) {
+	req = withResolvedTargetHost(req)
+	m, routeLabels, ok := routeMetrics(req.Context())
+	if ok && req.ContentLength >= 0 {
+		m.RequestSizeBytes.With(routeLabels).Observe(float64(req.ContentLength))
+	}
+	upstreamStart := time.Now()
+	resp, err := transport.RoundTrip(req)
+	upstreamDuration := time.Since(upstreamStart)
+	utils.RecordUpstreamDuration(req.Context(), upstreamDuration)
+	if !ok {
+		return resp, err
+	}
+
+	m.UpstreamDurationMilliseconds.With(routeLabels).Observe(float64(upstreamDuration.Milliseconds()))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Body != nil {
+		resp.Body = &sizeObserverBody{
+			ReadCloser: resp.Body,
+			observer:   m.ResponseSizeBytes.With(routeLabels),
+		}
+	}
+	return resp, nil
+}
+
+// routeMetrics returns the metrics together with the labels identifying the matched
+// route: the OAS path template is used instead of the raw path to bound cardinality.
+func routeMetrics(ctx context.Context) (metrics.Metrics, prometheus.Labels, bool) {
+	m, err := metrics.GetFromContext(ctx)
+	if err != nil {
+		return metrics.Metrics{}, nil, false
+	}
+	routerInfo, err := openapi.GetRouterInfo(ctx)
+	if err != nil {
+		return metrics.Metrics{}, nil, false
+	}
+	return m, prometheus.Labels{
+		"http_method": routerInfo.Method,
+		"http_route":  routerInfo.MatchedPath,
+	}, true
+}
+
+// sizeObserverBody counts the bytes read from the upstream response body and
+// records them once the body is closed.
+type sizeObserverBody struct {
+	io.ReadCloser
+	observer prometheus.Observer
+	size     int
+	once     sync.Once
+}
+
+func (b *sizeObserverBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += n
+	return n, err
+}
+
+func (b *sizeObserverBody) Close() error {
+	b.once.Do(func() {
+		b.observer.Observe(float64(b.size))
+	})
+	return b.ReadCloser.Close()
+}
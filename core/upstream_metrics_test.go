@@ -0,0 +1,83 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/metrics"
+	"github.com/rond-authz/rond/openapi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamTransportMetrics(t *testing.T) {
+	t.Run("records request size, response size and upstream duration", func(t *testing.T) {
+		ctx := createContext(t, context.Background(), config.EnvironmentVariables{}, nil, &openapi.RondConfig{}, nil, nil)
+		m, err := metrics.GetFromContext(ctx)
+		require.NoError(t, err)
+
+		transport := &UpstreamTransport{
+			RoundTripper: &MockRoundTrip{Response: &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewReader([]byte(`{"hello":"world"}`))),
+			}},
+		}
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/matched/path", bytes.NewReader([]byte(`{"a":1}`))).WithContext(ctx)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, `{"hello":"world"}`, string(body))
+		require.NoError(t, resp.Body.Close())
+		require.NoError(t, resp.Body.Close())
+
+		require.Equal(t, 1, testutil.CollectAndCount(m.RequestSizeBytes, "test_rond_request_size_bytes"))
+		require.Equal(t, 1, testutil.CollectAndCount(m.ResponseSizeBytes, "test_rond_response_size_bytes"))
+		require.Equal(t, 1, testutil.CollectAndCount(m.UpstreamDurationMilliseconds, "test_rond_upstream_duration_milliseconds"))
+	})
+
+	t.Run("upstream errors are returned and duration recorded", func(t *testing.T) {
+		ctx := createContext(t, context.Background(), config.EnvironmentVariables{}, nil, &openapi.RondConfig{}, nil, nil)
+		m, err := metrics.GetFromContext(ctx)
+		require.NoError(t, err)
+
+		transport := &UpstreamTransport{RoundTripper: &MockRoundTrip{Error: fmt.Errorf("some error")}}
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/matched/path", nil).WithContext(ctx)
+		resp, err := transport.RoundTrip(req)
+		require.EqualError(t, err, "some error")
+		require.Nil(t, resp)
+		require.Equal(t, 1, testutil.CollectAndCount(m.UpstreamDurationMilliseconds, "test_rond_upstream_duration_milliseconds"))
+		require.Equal(t, 0, testutil.CollectAndCount(m.ResponseSizeBytes, "test_rond_response_size_bytes"))
+	})
+
+	t.Run("without metrics in context the request is forwarded", func(t *testing.T) {
+		transport := &UpstreamTransport{
+			RoundTripper: &MockRoundTrip{Response: &http.Response{StatusCode: http.StatusNoContent}},
+		}
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	})
+}
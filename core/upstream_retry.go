@@ -0,0 +1,85 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rond-authz/rond/internal/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// upstreamRetryBaseBackoff is the wait before the first retry, doubled at each subsequent one.
+var upstreamRetryBaseBackoff = 100 * time.Millisecond
+
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// roundTripWithRetry forwards the request to the target service and, when UPSTREAM_RETRY_ON_5XX
+// is enabled, retries idempotent requests answered with a 5xx status code with an exponential
+// backoff, up to UPSTREAM_RETRY_MAX_ATTEMPTS attempts. The response of the last attempt is returned.
+func roundTripWithRetry(logger *logrus.Entry, env config.EnvironmentVariables, transport http.RoundTripper, req *http.Request) (*http.Response, error) {
+	if !env.UpstreamRetryOn5xx || env.UpstreamRetryMaxAttempts <= 1 || !isIdempotentMethod(req.Method) {
+		return upstreamRoundTrip(transport, req)
+	}
+
+	// the body is consumed by each attempt, so it is buffered to be sent again.
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, fmt.Errorf("failed request body read: %s", err.Error())
+		}
+		req.Body.Close()
+	}
+
+	backoff := upstreamRetryBaseBackoff
+	for attempt := 1; ; attempt++ {
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := upstreamRoundTrip(transport, req)
+		if err != nil || resp.StatusCode < http.StatusInternalServerError || attempt >= env.UpstreamRetryMaxAttempts {
+			return resp, err
+		}
+
+		logger.WithFields(logrus.Fields{
+			"attempt":    attempt,
+			"statusCode": resp.StatusCode,
+			"method":     req.Method,
+		}).Warn("upstream service responded with server error, retrying request")
+		if resp.Body != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
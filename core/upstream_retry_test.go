@@ -0,0 +1,172 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/openapi"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+type SequenceRoundTrip struct {
+	StatusCodes []int
+	Bodies      []string
+	Hosts       []string
+}
+
+func (m *SequenceRoundTrip) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.Hosts = append(m.Hosts, req.URL.Host)
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		m.Bodies = append(m.Bodies, string(body))
+	}
+	statusCode := m.StatusCodes[0]
+	m.StatusCodes = m.StatusCodes[1:]
+	return &http.Response{
+		StatusCode: statusCode,
+		Body:       io.NopCloser(bytes.NewReader(nil)),
+		Header:     http.Header{},
+	}, nil
+}
+
+func TestOPATransportRetryOn5xx(t *testing.T) {
+	defaultBackoff := upstreamRetryBaseBackoff
+	upstreamRetryBaseBackoff = time.Millisecond
+	defer func() { upstreamRetryBaseBackoff = defaultBackoff }()
+
+	envs := config.EnvironmentVariables{UpstreamRetryOn5xx: true, UpstreamRetryMaxAttempts: 3}
+	permission := &openapi.RondConfig{
+		ResponseFlow: openapi.ResponseFlow{PolicyName: "deny_response"},
+		Options:      openapi.PermissionOptions{Mode: config.PolicyModeOff},
+	}
+
+	roundTrip := func(t *testing.T, env config.EnvironmentVariables, method string, upstream *SequenceRoundTrip) (*http.Response, *test.Hook) {
+		t.Helper()
+		ctx := createContext(t, context.Background(), env, nil, permission, nil, nil)
+		req := httptest.NewRequest(method, "http://example.com/some-api", bytes.NewReader([]byte(`{"hello":"world"}`))).WithContext(ctx)
+		logger, hook := test.NewNullLogger()
+		transport := &OPATransport{
+			upstream,
+			ctx,
+			logrus.NewEntry(logger),
+			req,
+			permission,
+			nil,
+			env,
+		}
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		return resp, hook
+	}
+
+	t.Run("idempotent request is retried until success", func(t *testing.T) {
+		upstream := &SequenceRoundTrip{StatusCodes: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK}}
+		resp, hook := roundTrip(t, envs, http.MethodPut, upstream)
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Empty(t, upstream.StatusCodes)
+		require.Equal(t, []string{`{"hello":"world"}`, `{"hello":"world"}`, `{"hello":"world"}`}, upstream.Bodies)
+
+		entries := hook.AllEntries()
+		require.Len(t, entries, 2)
+		for i, entry := range entries {
+			require.Equal(t, "upstream service responded with server error, retrying request", entry.Message)
+			require.Equal(t, i+1, entry.Data["attempt"])
+			require.Equal(t, http.StatusServiceUnavailable, entry.Data["statusCode"])
+		}
+	})
+
+	t.Run("last server error is returned when attempts are exhausted", func(t *testing.T) {
+		upstream := &SequenceRoundTrip{StatusCodes: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusOK}}
+		resp, _ := roundTrip(t, envs, http.MethodGet, upstream)
+
+		require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		require.Equal(t, []int{http.StatusOK}, upstream.StatusCodes)
+	})
+
+	t.Run("client errors are not retried", func(t *testing.T) {
+		upstream := &SequenceRoundTrip{StatusCodes: []int{http.StatusNotFound, http.StatusOK}}
+		resp, _ := roundTrip(t, envs, http.MethodGet, upstream)
+
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+		require.Len(t, upstream.StatusCodes, 1)
+	})
+
+	t.Run("non-idempotent methods are not retried", func(t *testing.T) {
+		for _, method := range []string{http.MethodPost, http.MethodPatch} {
+			upstream := &SequenceRoundTrip{StatusCodes: []int{http.StatusServiceUnavailable, http.StatusOK}}
+			resp, hook := roundTrip(t, envs, method, upstream)
+
+			require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, method)
+			require.Len(t, upstream.StatusCodes, 1, method)
+			require.Empty(t, hook.AllEntries(), method)
+		}
+	})
+
+	t.Run("retry is disabled by default", func(t *testing.T) {
+		upstream := &SequenceRoundTrip{StatusCodes: []int{http.StatusServiceUnavailable, http.StatusOK}}
+		resp, _ := roundTrip(t, config.EnvironmentVariables{UpstreamRetryMaxAttempts: 3}, http.MethodGet, upstream)
+
+		require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		require.Len(t, upstream.StatusCodes, 1)
+	})
+}
+
+func TestUpstreamTransportRetryOn5xx(t *testing.T) {
+	defaultBackoff := upstreamRetryBaseBackoff
+	upstreamRetryBaseBackoff = time.Millisecond
+	defer func() { upstreamRetryBaseBackoff = defaultBackoff }()
+
+	logger, _ := test.NewNullLogger()
+	upstream := &SequenceRoundTrip{StatusCodes: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK}}
+	transport := &UpstreamTransport{
+		RoundTripper: upstream,
+		Logger:       logrus.NewEntry(logger),
+		Env:          config.EnvironmentVariables{UpstreamRetryOn5xx: true, UpstreamRetryMaxAttempts: 3},
+	}
+
+	resp, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, upstream.StatusCodes)
+}
+
+func TestRoundTripWithRetryContextCanceled(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	upstream := &SequenceRoundTrip{StatusCodes: []int{http.StatusServiceUnavailable, http.StatusOK}}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil).WithContext(ctx)
+	env := config.EnvironmentVariables{UpstreamRetryOn5xx: true, UpstreamRetryMaxAttempts: 3}
+
+	resp, err := roundTripWithRetry(logrus.NewEntry(logger), env, upstream, req)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Nil(t, resp)
+	require.Len(t, upstream.StatusCodes, 1)
+}
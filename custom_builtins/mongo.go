@@ -15,6 +15,8 @@
 package custom_builtins
 
 import (
+	"context"
+
 	"github.com/rond-authz/rond/internal/mongoclient"
 
 	"github.com/open-policy-agent/opa/ast"
@@ -54,7 +56,9 @@ var MongoFindOne = rego.Function2(
 			return nil, err
 		}
 
-		result, err := mongoClient.FindOne(ctx.Context, collectionName, query)
+		result, err := cachedMongoQuery(ctx.Context, MongoFindOneDecl.Name, collectionName, query, func() (interface{}, error) {
+			return mongoClient.FindOne(ctx.Context, collectionName, query)
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -100,7 +104,65 @@ var MongoFindMany = rego.Function2(
 			return nil, err
 		}
 
-		result, err := mongoClient.FindMany(ctx.Context, collectionName, query)
+		result, err := cachedMongoQuery(ctx.Context, MongoFindManyDecl.Name, collectionName, query, func() (interface{}, error) {
+			return mongoClient.FindMany(ctx.Context, collectionName, query)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		t, err := ast.InterfaceToValue(result)
+		if err != nil {
+			return nil, err
+		}
+
+		return ast.NewTerm(t), nil
+	},
+)
+
+var MongoFindAggregateDecl = &ast.Builtin{
+	Name: "find_aggregate",
+	Decl: types.NewFunction(
+		types.Args(
+			types.S, // collectionName
+			types.A, // pipeline, as array of stages or JSON string
+		),
+		types.NewArray(nil, types.A), // found documents
+	),
+}
+
+var MongoFindAggregate = rego.Function2(
+	&rego.Function{
+		Name: MongoFindAggregateDecl.Name,
+		Decl: MongoFindAggregateDecl.Decl,
+	},
+	func(ctx rego.BuiltinContext, collectionNameTerm, pipelineTerm *ast.Term) (*ast.Term, error) {
+		mongoClient, err := mongoclient.GetMongoClientFromContext(ctx.Context)
+		if err != nil {
+			return nil, err
+		}
+
+		var collectionName string
+		if err := ast.As(collectionNameTerm.Value, &collectionName); err != nil {
+			return nil, err
+		}
+
+		pipeline, err := pipelineFromTerm(pipelineTerm)
+		if err != nil {
+			return nil, err
+		}
+		if err := ValidateAggregationPipeline(pipeline); err != nil {
+			return nil, err
+		}
+		limitedPipeline := make([]interface{}, 0, len(pipeline)+1)
+		limitedPipeline = append(limitedPipeline, pipeline...)
+		limitedPipeline = append(limitedPipeline, map[string]interface{}{"$limit": FindAggregateMaxDocuments})
+
+		result, err := cachedMongoQuery(ctx.Context, MongoFindAggregateDecl.Name, collectionName, pipeline, func() (interface{}, error) {
+			aggregationContext, cancel := context.WithTimeout(ctx.Context, FindAggregateTimeout)
+			defer cancel()
+			return mongoClient.FindAggregate(aggregationContext, collectionName, limitedPipeline)
+		})
 		if err != nil {
 			return nil, err
 		}
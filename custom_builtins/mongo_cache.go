@@ -0,0 +1,94 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package custom_builtins
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// MongoBuiltinCacheMaxEntries is the maximum number of results held by the cache
+// of a single policy evaluation.
+const MongoBuiltinCacheMaxEntries = 100
+
+type mongoBuiltinCacheKey struct{}
+
+// mongoBuiltinCache holds the results of the mongo builtins calls done during a
+// single policy evaluation, so that identical lookups query MongoDB only once.
+type mongoBuiltinCache struct {
+	mtx        sync.Mutex
+	maxEntries int
+	results    map[string]interface{}
+	// keys holds the cached keys in insertion order, the oldest is evicted first.
+	keys []string
+}
+
+// WithMongoBuiltinCache returns a context holding a new, empty cache for the results
+// of the find_one and find_many builtins. It is meant to wrap the context of a single
+// policy evaluation, so that cached results never outlive the request.
+func WithMongoBuiltinCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, mongoBuiltinCacheKey{}, &mongoBuiltinCache{
+		maxEntries: MongoBuiltinCacheMaxEntries,
+		results:    map[string]interface{}{},
+	})
+}
+
+// cachedMongoQuery returns the result of the query from the cache in context, running
+// fetch and caching its result on miss. Without a cache in context fetch is always run.
+func cachedMongoQuery(ctx context.Context, builtinName, collectionName string, query interface{}, fetch func() (interface{}, error)) (interface{}, error) {
+	cache, ok := ctx.Value(mongoBuiltinCacheKey{}).(*mongoBuiltinCache)
+	if !ok {
+		return fetch()
+	}
+
+	// map keys are sorted by encoding/json, so equal filters produce the same key
+	canonicalQuery, err := json.Marshal(query)
+	if err != nil {
+		return fetch()
+	}
+	key := builtinName + "\x00" + collectionName + "\x00" + string(canonicalQuery)
+
+	if result, found := cache.get(key); found {
+		return result, nil
+	}
+	result, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	cache.set(key, result)
+	return result, nil
+}
+
+func (cache *mongoBuiltinCache) get(key string) (interface{}, bool) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	result, found := cache.results[key]
+	return result, found
+}
+
+func (cache *mongoBuiltinCache) set(key string, result interface{}) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	if _, found := cache.results[key]; found {
+		return
+	}
+	if len(cache.keys) >= cache.maxEntries {
+		delete(cache.results, cache.keys[0])
+		cache.keys = cache.keys[1:]
+	}
+	cache.results[key] = result
+	cache.keys = append(cache.keys, key)
+}
@@ -0,0 +1,239 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package custom_builtins
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/rond-authz/rond/internal/mocks"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedMongoQuery(t *testing.T) {
+	countingFetch := func(calls *int, result interface{}, err error) func() (interface{}, error) {
+		return func() (interface{}, error) {
+			*calls++
+			return result, err
+		}
+	}
+
+	t.Run("without cache in context always fetches", func(t *testing.T) {
+		calls := 0
+		fetch := countingFetch(&calls, "doc", nil)
+		for i := 0; i < 3; i++ {
+			result, err := cachedMongoQuery(context.Background(), "find_one", "books", map[string]interface{}{"a": 1}, fetch)
+			require.NoError(t, err)
+			require.Equal(t, "doc", result)
+		}
+		require.Equal(t, 3, calls)
+	})
+
+	t.Run("returns cached result for equal filters", func(t *testing.T) {
+		ctx := WithMongoBuiltinCache(context.Background())
+		calls := 0
+		fetch := countingFetch(&calls, "doc", nil)
+
+		result, err := cachedMongoQuery(ctx, "find_one", "books", map[string]interface{}{"a": 1, "b": "x"}, fetch)
+		require.NoError(t, err)
+		require.Equal(t, "doc", result)
+
+		result, err = cachedMongoQuery(ctx, "find_one", "books", map[string]interface{}{"b": "x", "a": 1}, fetch)
+		require.NoError(t, err)
+		require.Equal(t, "doc", result)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("keys on builtin, collection and filter", func(t *testing.T) {
+		ctx := WithMongoBuiltinCache(context.Background())
+		calls := 0
+		fetch := countingFetch(&calls, "doc", nil)
+		query := map[string]interface{}{"a": 1}
+
+		_, err := cachedMongoQuery(ctx, "find_one", "books", query, fetch)
+		require.NoError(t, err)
+		_, err = cachedMongoQuery(ctx, "find_many", "books", query, fetch)
+		require.NoError(t, err)
+		_, err = cachedMongoQuery(ctx, "find_one", "authors", query, fetch)
+		require.NoError(t, err)
+		_, err = cachedMongoQuery(ctx, "find_one", "books", map[string]interface{}{"a": 2}, fetch)
+		require.NoError(t, err)
+		require.Equal(t, 4, calls)
+	})
+
+	t.Run("does not share entries between contexts", func(t *testing.T) {
+		calls := 0
+		fetch := countingFetch(&calls, "doc", nil)
+		query := map[string]interface{}{"a": 1}
+
+		_, err := cachedMongoQuery(WithMongoBuiltinCache(context.Background()), "find_one", "books", query, fetch)
+		require.NoError(t, err)
+		_, err = cachedMongoQuery(WithMongoBuiltinCache(context.Background()), "find_one", "books", query, fetch)
+		require.NoError(t, err)
+		require.Equal(t, 2, calls)
+	})
+
+	t.Run("does not cache errors", func(t *testing.T) {
+		ctx := WithMongoBuiltinCache(context.Background())
+		calls := 0
+		query := map[string]interface{}{"a": 1}
+
+		_, err := cachedMongoQuery(ctx, "find_one", "books", query, countingFetch(&calls, nil, fmt.Errorf("some error")))
+		require.EqualError(t, err, "some error")
+
+		result, err := cachedMongoQuery(ctx, "find_one", "books", query, countingFetch(&calls, "doc", nil))
+		require.NoError(t, err)
+		require.Equal(t, "doc", result)
+		require.Equal(t, 2, calls)
+	})
+
+	t.Run("evicts the oldest entry when full", func(t *testing.T) {
+		ctx := WithMongoBuiltinCache(context.Background())
+		calls := 0
+		fetch := countingFetch(&calls, "doc", nil)
+
+		for i := 0; i <= MongoBuiltinCacheMaxEntries; i++ {
+			_, err := cachedMongoQuery(ctx, "find_one", "books", map[string]interface{}{"i": i}, fetch)
+			require.NoError(t, err)
+		}
+		require.Equal(t, MongoBuiltinCacheMaxEntries+1, calls)
+
+		cache := ctx.Value(mongoBuiltinCacheKey{}).(*mongoBuiltinCache)
+		require.Len(t, cache.results, MongoBuiltinCacheMaxEntries)
+
+		_, err := cachedMongoQuery(ctx, "find_one", "books", map[string]interface{}{"i": MongoBuiltinCacheMaxEntries}, fetch)
+		require.NoError(t, err)
+		require.Equal(t, MongoBuiltinCacheMaxEntries+1, calls, "newest entry is still cached")
+
+		_, err = cachedMongoQuery(ctx, "find_one", "books", map[string]interface{}{"i": 0}, fetch)
+		require.NoError(t, err)
+		require.Equal(t, MongoBuiltinCacheMaxEntries+2, calls, "oldest entry has been evicted")
+	})
+}
+
+func TestMongoBuiltinsCache(t *testing.T) {
+	module := `package policies
+
+	book := find_one("books", {"author": input.author})
+	same_book := find_one("books", {"author": input.author})
+	books := find_many("books", {"author": input.author})
+	same_books := find_many("books", {"author": input.author})
+
+	allow {
+		book.title == same_book.title
+		count(books) == count(same_books)
+	}`
+
+	var findOneCalls, findManyCalls int32
+	mongoClientMock := mocks.MongoClientMock{
+		FindOneResult:  map[string]interface{}{"title": "The Hobbit"},
+		FindManyResult: []interface{}{map[string]interface{}{"title": "The Hobbit"}},
+		FindOneExpectation: func(collectionName string, query interface{}) {
+			atomic.AddInt32(&findOneCalls, 1)
+		},
+		FindManyExpectation: func(collectionName string, query interface{}) {
+			atomic.AddInt32(&findManyCalls, 1)
+		},
+	}
+
+	query, err := rego.New(
+		rego.Query("data.policies.allow"),
+		rego.Module("example.rego", module),
+		MongoFindOne,
+		MongoFindMany,
+	).PrepareForEval(context.Background())
+	require.NoError(t, err)
+
+	ctx := mongoclient.WithMongoClient(context.Background(), mongoClientMock)
+	input := rego.EvalInput(map[string]interface{}{"author": "Tolkien"})
+
+	results, err := query.Eval(WithMongoBuiltinCache(ctx), input)
+	require.NoError(t, err)
+	require.True(t, results.Allowed())
+	require.Equal(t, int32(1), atomic.LoadInt32(&findOneCalls))
+	require.Equal(t, int32(1), atomic.LoadInt32(&findManyCalls))
+
+	results, err = query.Eval(WithMongoBuiltinCache(ctx), input)
+	require.NoError(t, err)
+	require.True(t, results.Allowed())
+	require.Equal(t, int32(2), atomic.LoadInt32(&findOneCalls), "cache must not leak across evaluations")
+	require.Equal(t, int32(2), atomic.LoadInt32(&findManyCalls), "cache must not leak across evaluations")
+}
+
+func BenchmarkMongoBuiltinsCache(b *testing.B) {
+	module := `package policies
+
+	user_book := find_one("books", {"owner": input.user})
+	user_can_read { user_book.readable == true }
+	user_can_write { user_book.writable == true }
+	user_is_owner { find_one("books", {"owner": input.user}).owner == input.user }
+
+	allow {
+		user_can_read
+		user_can_write
+		user_is_owner
+		find_one("books", {"owner": input.user}).title == user_book.title
+	}`
+
+	var calls int64
+	mongoClientMock := mocks.MongoClientMock{
+		FindOneResult: map[string]interface{}{"owner": "bob", "title": "The Hobbit", "readable": true, "writable": true},
+		FindOneExpectation: func(collectionName string, query interface{}) {
+			atomic.AddInt64(&calls, 1)
+		},
+	}
+
+	query, err := rego.New(
+		rego.Query("data.policies.allow"),
+		rego.Module("example.rego", module),
+		MongoFindOne,
+	).PrepareForEval(context.Background())
+	if err != nil {
+		b.Fatal(err)
+	}
+	input := rego.EvalInput(map[string]interface{}{"user": "bob"})
+
+	run := func(b *testing.B, withCache bool) {
+		atomic.StoreInt64(&calls, 0)
+		ctx := mongoclient.WithMongoClient(context.Background(), mongoClientMock)
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			evalCtx := ctx
+			if withCache {
+				evalCtx = WithMongoBuiltinCache(ctx)
+			}
+			results, err := query.Eval(evalCtx, input)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if !results.Allowed() {
+				b.Fatal("policy not allowed")
+			}
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&calls))/float64(b.N), "mongo-calls/op")
+	}
+
+	b.Run("without cache", func(b *testing.B) {
+		run(b, false)
+	})
+
+	b.Run("with cache", func(b *testing.B) {
+		run(b, true)
+	})
+}
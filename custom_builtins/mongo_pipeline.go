@@ -0,0 +1,197 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package custom_builtins
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+const (
+	// FindAggregateMaxDocuments is the maximum number of documents returned by find_aggregate.
+	FindAggregateMaxDocuments = 1000
+	// FindAggregateTimeout is the maximum duration of the aggregation run by find_aggregate.
+	FindAggregateTimeout = 5 * time.Second
+)
+
+// allowedAggregationStages are the read-only stages that can be used in a find_aggregate pipeline.
+var allowedAggregationStages = map[string]bool{
+	"$match":   true,
+	"$project": true,
+	"$lookup":  true,
+	"$unwind":  true,
+	"$limit":   true,
+}
+
+// unknownValue marks the parts of a pipeline that are known only at evaluation time.
+type unknownValue struct{}
+
+// ValidateAggregationPipeline checks that every stage of the pipeline, including the
+// sub-pipelines of $lookup stages, is an allowed stage.
+func ValidateAggregationPipeline(pipeline []interface{}) error {
+	for i, rawStage := range pipeline {
+		if _, unknown := rawStage.(unknownValue); unknown {
+			continue
+		}
+		stage, ok := rawStage.(map[string]interface{})
+		if !ok || len(stage) != 1 {
+			return fmt.Errorf("stage %d must be an object with a single key", i)
+		}
+		for stageName, stageSpec := range stage {
+			if !allowedAggregationStages[stageName] {
+				return fmt.Errorf("stage %d: %s is not allowed", i, stageName)
+			}
+			if stageName != "$lookup" {
+				continue
+			}
+			if err := validateLookupPipeline(stageSpec); err != nil {
+				return fmt.Errorf("stage %d: %s", i, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func validateLookupPipeline(lookupSpec interface{}) error {
+	if _, unknown := lookupSpec.(unknownValue); unknown {
+		return nil
+	}
+	lookup, ok := lookupSpec.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("$lookup must be an object")
+	}
+	subPipeline, found := lookup["pipeline"]
+	if !found {
+		return nil
+	}
+	if _, unknown := subPipeline.(unknownValue); unknown {
+		return nil
+	}
+	subPipelineStages, ok := subPipeline.([]interface{})
+	if !ok {
+		return fmt.Errorf("$lookup pipeline must be an array")
+	}
+	if err := ValidateAggregationPipeline(subPipelineStages); err != nil {
+		return fmt.Errorf("$lookup pipeline: %s", err.Error())
+	}
+	return nil
+}
+
+// ValidateFindAggregateCalls validates the pipelines of the find_aggregate calls of the
+// module that are known before evaluation, so that disallowed stages are reported when
+// the policies are loaded instead of when they are evaluated.
+func ValidateFindAggregateCalls(module *ast.Module) error {
+	var validationError error
+	validateCall := func(terms []*ast.Term) {
+		if validationError != nil || len(terms) != 3 || !terms[0].Equal(ast.NewTerm(MongoFindAggregateDecl.Ref())) {
+			return
+		}
+		pipelineTerm := terms[2]
+		var err error
+		switch pipeline := staticValue(pipelineTerm.Value).(type) {
+		case []interface{}:
+			err = ValidateAggregationPipeline(pipeline)
+		case string:
+			var parsedPipeline []interface{}
+			if parsedPipeline, err = parsePipelineJSON(pipeline); err == nil {
+				err = ValidateAggregationPipeline(parsedPipeline)
+			}
+		case unknownValue:
+			return
+		default:
+			err = fmt.Errorf("pipeline must be an array of stages")
+		}
+		if err != nil {
+			validationError = fmt.Errorf("%s: invalid %s pipeline: %s", pipelineTerm.Location, MongoFindAggregateDecl.Name, err.Error())
+		}
+	}
+
+	ast.WalkExprs(module, func(expr *ast.Expr) bool {
+		if terms, ok := expr.Terms.([]*ast.Term); ok {
+			validateCall(terms)
+		}
+		return false
+	})
+	ast.WalkTerms(module, func(term *ast.Term) bool {
+		if call, ok := term.Value.(ast.Call); ok {
+			validateCall(call)
+		}
+		return false
+	})
+	return validationError
+}
+
+// pipelineFromTerm reads a pipeline given either as an array of stages or as a JSON string.
+func pipelineFromTerm(pipelineTerm *ast.Term) ([]interface{}, error) {
+	rawPipeline, err := ast.JSON(pipelineTerm.Value)
+	if err != nil {
+		return nil, err
+	}
+	if pipelineJSON, ok := rawPipeline.(string); ok {
+		return parsePipelineJSON(pipelineJSON)
+	}
+	pipeline, ok := rawPipeline.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("pipeline must be an array of stages")
+	}
+	return pipeline, nil
+}
+
+func parsePipelineJSON(pipelineJSON string) ([]interface{}, error) {
+	var pipeline []interface{}
+	if err := json.Unmarshal([]byte(pipelineJSON), &pipeline); err != nil {
+		return nil, fmt.Errorf("invalid pipeline JSON: %s", err.Error())
+	}
+	return pipeline, nil
+}
+
+// staticValue converts a policy value to its Go representation, replacing with unknownValue
+// the parts that depend on the evaluation, such as references and function calls.
+func staticValue(value ast.Value) interface{} {
+	switch v := value.(type) {
+	case *ast.Array:
+		result := make([]interface{}, 0, v.Len())
+		v.Foreach(func(item *ast.Term) {
+			result = append(result, staticValue(item.Value))
+		})
+		return result
+	case ast.Object:
+		result := make(map[string]interface{}, v.Len())
+		known := true
+		v.Foreach(func(key, item *ast.Term) {
+			keyString, ok := key.Value.(ast.String)
+			if !ok {
+				known = false
+				return
+			}
+			result[string(keyString)] = staticValue(item.Value)
+		})
+		if !known {
+			return unknownValue{}
+		}
+		return result
+	case ast.String, ast.Number, ast.Boolean, ast.Null:
+		result, err := ast.JSON(v)
+		if err != nil {
+			return unknownValue{}
+		}
+		return result
+	default:
+		return unknownValue{}
+	}
+}
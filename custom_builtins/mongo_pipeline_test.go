@@ -0,0 +1,226 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package custom_builtins
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/rond-authz/rond/internal/mocks"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateAggregationPipeline(t *testing.T) {
+	parsePipeline := func(t *testing.T, pipelineJSON string) []interface{} {
+		t.Helper()
+		var pipeline []interface{}
+		require.NoError(t, json.Unmarshal([]byte(pipelineJSON), &pipeline))
+		return pipeline
+	}
+
+	t.Run("accepts allowed stages", func(t *testing.T) {
+		pipeline := parsePipeline(t, `[
+			{"$match": {"projectId": "p1"}},
+			{"$lookup": {"from": "teams", "localField": "teamId", "foreignField": "_id", "as": "team"}},
+			{"$unwind": "$team"},
+			{"$lookup": {"from": "members", "let": {"teamId": "$team._id"}, "pipeline": [{"$match": {"userId": "u1"}}, {"$limit": 1}], "as": "members"}},
+			{"$project": {"members": 1}},
+			{"$limit": 10}
+		]`)
+		require.NoError(t, ValidateAggregationPipeline(pipeline))
+	})
+
+	t.Run("accepts empty pipeline", func(t *testing.T) {
+		require.NoError(t, ValidateAggregationPipeline([]interface{}{}))
+	})
+
+	testCases := map[string]struct {
+		pipeline      string
+		expectedError string
+	}{
+		"write stage": {
+			pipeline:      `[{"$match": {}}, {"$out": "other"}]`,
+			expectedError: "stage 1: $out is not allowed",
+		},
+		"merge stage": {
+			pipeline:      `[{"$merge": {"into": "other"}}]`,
+			expectedError: "stage 0: $merge is not allowed",
+		},
+		"disallowed stage in $lookup pipeline": {
+			pipeline:      `[{"$lookup": {"from": "teams", "pipeline": [{"$unionWith": "secrets"}], "as": "team"}}]`,
+			expectedError: "stage 0: $lookup pipeline: stage 0: $unionWith is not allowed",
+		},
+		"stage with many keys": {
+			pipeline:      `[{"$match": {}, "$limit": 1}]`,
+			expectedError: "stage 0 must be an object with a single key",
+		},
+		"stage not an object": {
+			pipeline:      `["$match"]`,
+			expectedError: "stage 0 must be an object with a single key",
+		},
+		"$lookup pipeline not an array": {
+			pipeline:      `[{"$lookup": {"from": "teams", "pipeline": {}, "as": "team"}}]`,
+			expectedError: "stage 0: $lookup pipeline must be an array",
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			require.EqualError(t, ValidateAggregationPipeline(parsePipeline(t, testCase.pipeline)), testCase.expectedError)
+		})
+	}
+}
+
+func TestValidateFindAggregateCalls(t *testing.T) {
+	testCases := map[string]struct {
+		module        string
+		expectedError string
+	}{
+		"allowed stages": {
+			module: `package policies
+			allow {
+				teams := find_aggregate("projects", [{"$match": {"projectId": input.projectId}}, {"$lookup": {"from": "teams", "localField": "teamId", "foreignField": "_id", "as": "team"}}])
+				count(teams) > 0
+			}`,
+		},
+		"disallowed stage in array pipeline": {
+			module: `package policies
+			allow {
+				docs := find_aggregate("projects", [{"$match": {}}, {"$out": "copy"}])
+				count(docs) > 0
+			}`,
+			expectedError: "example.rego:3: invalid find_aggregate pipeline: stage 1: $out is not allowed",
+		},
+		"disallowed stage in JSON pipeline": {
+			module: `package policies
+			allow {
+				count(find_aggregate("projects", "[{\"$group\": {\"_id\": null}}]")) > 0
+			}`,
+			expectedError: "example.rego:3: invalid find_aggregate pipeline: stage 0: $group is not allowed",
+		},
+		"disallowed stage in call expression": {
+			module: `package policies
+			allow {
+				find_aggregate("projects", [{"$merge": {"into": "copy"}}])
+			}`,
+			expectedError: "example.rego:3: invalid find_aggregate pipeline: stage 0: $merge is not allowed",
+		},
+		"invalid JSON pipeline": {
+			module: `package policies
+			allow {
+				count(find_aggregate("projects", "not json")) > 0
+			}`,
+			expectedError: "example.rego:3: invalid find_aggregate pipeline: invalid pipeline JSON: invalid character 'o' in literal null (expecting 'u')",
+		},
+		"disallowed stage in pipeline with values known at evaluation": {
+			module: `package policies
+			allow {
+				count(find_aggregate("projects", [{"$match": {"projectId": input.projectId}}, {"$lookup": {"from": "teams", "pipeline": [{"$match": {"userId": input.user.id}}, {"$group": {"_id": null}}], "as": "team"}}])) > 0
+			}`,
+			expectedError: "example.rego:3: invalid find_aggregate pipeline: stage 1: $lookup pipeline: stage 1: $group is not allowed",
+		},
+		"pipeline known only at evaluation": {
+			module: `package policies
+			allow {
+				count(find_aggregate("projects", input.pipeline)) > 0
+			}`,
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			module, err := ast.ParseModule("example.rego", testCase.module)
+			require.NoError(t, err)
+
+			err = ValidateFindAggregateCalls(module)
+			if testCase.expectedError == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, testCase.expectedError)
+		})
+	}
+}
+
+func TestFindAggregateBuiltin(t *testing.T) {
+	module := `package policies
+	members := find_aggregate("projects", input.pipeline)
+	allow {
+		members[0].team.name == "core"
+	}`
+
+	query, err := rego.New(
+		rego.Query("data.policies.allow"),
+		rego.Module("example.rego", module),
+		MongoFindAggregate,
+		rego.StrictBuiltinErrors(true),
+	).PrepareForEval(context.Background())
+	require.NoError(t, err)
+
+	t.Run("runs the pipeline with the document limit", func(t *testing.T) {
+		var invokedPipeline interface{}
+		mongoClientMock := mocks.MongoClientMock{
+			FindAggregateResult: []interface{}{map[string]interface{}{"team": map[string]interface{}{"name": "core"}}},
+			FindAggregateExpectation: func(collectionName string, pipeline interface{}) {
+				require.Equal(t, "projects", collectionName)
+				invokedPipeline = pipeline
+			},
+		}
+		ctx := mongoclient.WithMongoClient(context.Background(), mongoClientMock)
+
+		results, err := query.Eval(ctx, rego.EvalInput(map[string]interface{}{
+			"pipeline": `[{"$match": {"projectId": "p1"}}, {"$unwind": "$team"}]`,
+		}))
+		require.NoError(t, err)
+		require.True(t, results.Allowed())
+		require.Equal(t, []interface{}{
+			map[string]interface{}{"$match": map[string]interface{}{"projectId": "p1"}},
+			map[string]interface{}{"$unwind": "$team"},
+			map[string]interface{}{"$limit": FindAggregateMaxDocuments},
+		}, invokedPipeline)
+	})
+
+	t.Run("fails evaluation with disallowed stage", func(t *testing.T) {
+		mongoClientMock := mocks.MongoClientMock{
+			FindAggregateExpectation: func(collectionName string, pipeline interface{}) {
+				require.Fail(t, "unexpected aggregation")
+			},
+		}
+		ctx := mongoclient.WithMongoClient(context.Background(), mongoClientMock)
+
+		_, err := query.Eval(ctx, rego.EvalInput(map[string]interface{}{
+			"pipeline": []interface{}{map[string]interface{}{"$out": "copy"}},
+		}))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "stage 0: $out is not allowed")
+	})
+
+	t.Run("fails evaluation on mongo error", func(t *testing.T) {
+		mongoClientMock := mocks.MongoClientMock{
+			FindAggregateError:       fmt.Errorf("some error"),
+			FindAggregateExpectation: func(collectionName string, pipeline interface{}) {},
+		}
+		ctx := mongoclient.WithMongoClient(context.Background(), mongoClientMock)
+
+		_, err := query.Eval(ctx, rego.EvalInput(map[string]interface{}{
+			"pipeline": []interface{}{},
+		}))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "some error")
+	})
+}
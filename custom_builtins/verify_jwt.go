@@ -0,0 +1,71 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package custom_builtins
+
+import (
+	"time"
+
+	"github.com/rond-authz/rond/internal/jwt"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+	"github.com/sirupsen/logrus"
+)
+
+// VerifyJWT verifies the signature and the exp and nbf claims of a JWT and returns its
+// claims, otherwise it is undefined. The second argument is either the url of a JWKS,
+// used for RS, PS and ES algorithms, or the secret of HS algorithms.
+var VerifyJWTDecl = &ast.Builtin{
+	Name: "verify_jwt",
+	Decl: types.NewFunction(
+		types.Args(
+			types.S, // token
+			types.S, // jwksUrlOrSecret
+		),
+		types.NewObject(nil, types.NewDynamicProperty(types.S, types.A)), // token claims
+	),
+}
+
+var VerifyJWT = rego.Function2(
+	&rego.Function{
+		Name: VerifyJWTDecl.Name,
+		Decl: VerifyJWTDecl.Decl,
+		// the result depends on the current time and on the fetched JWKS
+		Nondeterministic: true,
+	},
+	func(ctx rego.BuiltinContext, tokenTerm, keyTerm *ast.Term) (*ast.Term, error) {
+		var token, jwksURLOrSecret string
+		if err := ast.As(tokenTerm.Value, &token); err != nil {
+			return nil, err
+		}
+		if err := ast.As(keyTerm.Value, &jwksURLOrSecret); err != nil {
+			return nil, err
+		}
+
+		claims, err := jwt.Verify(token, jwksURLOrSecret, time.Now())
+		if err != nil {
+			glogger.Get(ctx.Context).WithField("error", logrus.Fields{"message": err.Error()}).Debug("JWT verification failed")
+			return nil, nil
+		}
+
+		value, err := ast.InterfaceToValue(claims)
+		if err != nil {
+			return nil, err
+		}
+		return ast.NewTerm(value), nil
+	},
+)
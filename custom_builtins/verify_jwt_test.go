@@ -0,0 +1,64 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package custom_builtins
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rond-authz/rond/internal/testutils"
+
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyJWTBuiltin(t *testing.T) {
+	secret := "my-secret"
+	evaluate := func(t *testing.T, token string) []interface{} {
+		t.Helper()
+		results, err := rego.New(
+			rego.Query(fmt.Sprintf(`claims := verify_jwt(%q, %q)`, token, secret)),
+			VerifyJWT,
+		).Eval(context.Background())
+		require.NoError(t, err)
+		values := []interface{}{}
+		for _, result := range results {
+			values = append(values, result.Bindings["claims"])
+		}
+		return values
+	}
+
+	t.Run("returns the claims of a valid token", func(t *testing.T) {
+		token := testutils.SignJWT(t, map[string]interface{}{"alg": "HS256"}, map[string]interface{}{
+			"sub": "secondary-user",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}, testutils.HS256Signer(secret))
+
+		values := evaluate(t, token)
+		require.Len(t, values, 1)
+		require.Equal(t, "secondary-user", values[0].(map[string]interface{})["sub"])
+	})
+
+	t.Run("is undefined for an invalid token", func(t *testing.T) {
+		token := testutils.SignJWT(t, map[string]interface{}{"alg": "HS256"}, map[string]interface{}{
+			"sub": "secondary-user",
+			"exp": time.Now().Add(-time.Hour).Unix(),
+		}, testutils.HS256Signer(secret))
+
+		require.Empty(t, evaluate(t, token))
+	})
+}
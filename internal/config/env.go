@@ -16,10 +16,17 @@ package config
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
 	"strings"
 
+	"github.com/rond-authz/rond/internal/utils"
+
 	"github.com/gorilla/mux"
 	"github.com/mia-platform/configlib"
 )
@@ -27,36 +34,246 @@ import (
 const (
 	APIPermissionsFilePathEnvKey = "API_PERMISSIONS_FILE_PATH"
 	TargetServiceOASPathEnvKey   = "TARGET_SERVICE_OAS_PATH"
+	OASRefreshIntervalEnvKey     = "OAS_REFRESH_INTERVAL_SECONDS"
+	OASFetchMaxRetriesEnvKey     = "OAS_FETCH_MAX_RETRIES"
+	OASFetchBackoffEnvKey        = "OAS_FETCH_BACKOFF_MS"
+	OASCachePathEnvKey           = "OAS_CACHE_PATH"
+	StrictOASSourceEnvKey        = "STRICT_OAS_SOURCE"
+	OASFetchHeadersEnvKey        = "TARGET_SERVICE_OAS_HEADERS"
 	StandaloneEnvKey             = "STANDALONE"
+	StandaloneGRPCEnvKey         = "STANDALONE_GRPC"
+	GRPCPortEnvKey               = "GRPC_PORT"
+	JWTVerificationKeyEnvKey     = "JWT_VERIFICATION_KEY"
+	JWTVerifiedUpstreamEnvKey    = "JWT_VERIFIED_UPSTREAM"
 	TargetServiceHostEnvKey      = "TARGET_SERVICE_HOST"
+	ConsulAddressEnvKey          = "CONSUL_ADDRESS"
+	ConsulServiceNameEnvKey      = "CONSUL_SERVICE_NAME"
 	BindingsCrudServiceURL       = "BINDINGS_CRUD_SERVICE_URL"
+	DefaultPolicyModeEnvKey      = "DEFAULT_POLICY_MODE"
+	ErrorResponseFormatEnvKey    = "ERROR_RESPONSE_FORMAT"
+	TrustedProxiesEnvKey         = "TRUSTED_PROXIES"
+	PoliciesTestDirEnvKey        = "POLICIES_TEST_DIR"
+	MongoMaxPoolSizeEnvKey       = "MONGO_MAX_POOL_SIZE"
+	MongoMinPoolSizeEnvKey       = "MONGO_MIN_POOL_SIZE"
+	PolicyTraceHeaderKeyEnvKey   = "POLICY_TRACE_HEADER_KEY"
+	PolicyTraceSecretEnvKey      = "POLICY_TRACE_SECRET"
+	PolicyTraceSecretFileEnvKey  = "POLICY_TRACE_SECRET_FILE"
+	MongoDBUrlFileEnvKey         = "MONGODB_URL_FILE"
+	RequestIDHeaderKeyEnvKey     = "REQUEST_ID_HEADER_KEY"
+	PolicyResponseHeaderEnvKey   = "POLICY_RESPONSE_HEADER"
+	BindingsProjectionEnvKey     = "MONGO_BINDINGS_PROJECTION_FIELDS"
+	ReadinessCheckMongoEnvKey    = "READINESS_CHECK_MONGO"
+	ReadinessCheckTargetEnvKey   = "READINESS_CHECK_TARGET_SERVICE"
+	MongoDBUrlEnvKey             = "MONGODB_URL"
+	GrantPolicyEnvKey            = "GRANT_POLICY"
+	RevokePolicyEnvKey           = "REVOKE_POLICY"
+	AllowedPathsEnvKey           = "ALLOWED_PATHS"
+	CORSPassthroughEnvKey        = "CORS_PASSTHROUGH"
+	AccessLogFormatEnvKey        = "ACCESS_LOG_FORMAT"
+	AccessLogExcludedPathsEnvKey = "ACCESS_LOG_EXCLUDED_PATHS"
+	SensitiveHeadersEnvKey       = "SENSITIVE_HEADERS"
+	PolicyVersionCheckEnvKey     = "POLICY_VERSION_CHECK"
+	PolicyDiffSecretEnvKey       = "POLICY_DIFF_SECRET"
+	PolicyDiffSecretFileEnvKey   = "POLICY_DIFF_SECRET_FILE"
+	PolicyDiffRecordedInputsKey  = "POLICY_DIFF_RECORDED_INPUTS"
+	OPALogLevelEnvKey            = "OPA_LOG_LEVEL"
+	TargetServiceHostHeaderKey   = "TARGET_SERVICE_HOST_HEADER"
+	CircuitBreakerFailuresEnvKey = "CIRCUIT_BREAKER_CONSECUTIVE_FAILURES"
+	CircuitBreakerRatioEnvKey    = "CIRCUIT_BREAKER_FAILURE_RATIO"
+	CircuitBreakerWindowEnvKey   = "CIRCUIT_BREAKER_WINDOW_SIZE"
+	CircuitBreakerOpenEnvKey     = "CIRCUIT_BREAKER_OPEN_DURATION_MS"
+	PathRewriteFromEnvKey        = "PATH_REWRITE_FROM"
+	PathRewriteToEnvKey          = "PATH_REWRITE_TO"
+	SignatureSecretEnvKey        = "USER_SIGNATURE_SECRET"
+	SignatureSecretFileEnvKey    = "USER_SIGNATURE_SECRET_FILE"
+	SignatureSecondaryEnvKey     = "USER_SIGNATURE_SECONDARY_SECRET"
+	SignatureSecondaryFileEnvKey = "USER_SIGNATURE_SECONDARY_SECRET_FILE"
+	OPACapabilitiesPathEnvKey    = "OPA_CAPABILITIES_PATH"
+	DisabledBuiltinsEnvKey       = "DISABLED_BUILTINS"
 
 	TraceLogLevel = "trace"
+
+	// PolicyModeEnforce evaluates policies and rejects the denied requests.
+	PolicyModeEnforce = "enforce"
+	// PolicyModeLogOnly evaluates policies and logs their decision, but always proxies.
+	PolicyModeLogOnly = "log-only"
+	// PolicyModeOff skips policies evaluation.
+	PolicyModeOff = "off"
+)
+
+var PolicyModes = []string{PolicyModeEnforce, PolicyModeLogOnly, PolicyModeOff}
+
+const (
+	// CORSPassthroughOff handles the CORS preflight requests as any other request.
+	CORSPassthroughOff = "off"
+	// CORSPassthroughProxy proxies the CORS preflight requests without policy evaluation.
+	CORSPassthroughProxy = "proxy"
+	// CORSPassthroughRespond answers the CORS preflight requests with the configured CORS headers.
+	CORSPassthroughRespond = "respond"
+)
+
+var CORSPassthroughModes = []string{CORSPassthroughOff, CORSPassthroughProxy, CORSPassthroughRespond}
+
+const (
+	// AccessLogFormatOff disables the access log.
+	AccessLogFormatOff = "off"
+	// AccessLogFormatJSON logs each request with its details as structured fields.
+	AccessLogFormatJSON = "json"
+	// AccessLogFormatCombined logs each request as a line in the Apache combined log format.
+	AccessLogFormatCombined = "combined"
+)
+
+var AccessLogFormats = []string{AccessLogFormatOff, AccessLogFormatJSON, AccessLogFormatCombined}
+
+const (
+	// PolicyVersionCheckFail refuses to start when the policies require a newer rond version.
+	PolicyVersionCheckFail = "fail"
+	// PolicyVersionCheckWarn logs a warning when the policies require a newer rond version.
+	PolicyVersionCheckWarn = "warn"
 )
 
+var PolicyVersionCheckModes = []string{PolicyVersionCheckFail, PolicyVersionCheckWarn}
+
+const (
+	// OPALogLevelOff disables the OPA logs.
+	OPALogLevelOff = "off"
+	// OPALogLevelError only logs the OPA errors.
+	OPALogLevelError = "error"
+	// OPALogLevelWarn logs the OPA errors and warnings.
+	OPALogLevelWarn = "warn"
+	// OPALogLevelInfo logs the OPA errors, warnings and informational messages.
+	OPALogLevelInfo = "info"
+	// OPALogLevelDebug also logs the output of the rego print statements.
+	OPALogLevelDebug = "debug"
+)
+
+var OPALogLevels = []string{OPALogLevelOff, OPALogLevelError, OPALogLevelWarn, OPALogLevelInfo, OPALogLevelDebug}
+
 // EnvironmentVariables struct with the mapping of desired
 // environment variables.
 type EnvironmentVariables struct {
-	LogLevel                 string
-	HTTPPort                 string
-	ServiceVersion           string
-	TargetServiceHost        string
-	TargetServiceOASPath     string
-	OPAModulesDirectory      string
-	APIPermissionsFilePath   string
-	UserPropertiesHeader     string
-	UserGroupsHeader         string
-	UserIdHeader             string
-	ClientTypeHeader         string
-	BindingsCrudServiceURL   string
-	MongoDBUrl               string
-	RolesCollectionName      string
-	BindingsCollectionName   string
-	PathPrefixStandalone     string
-	DelayShutdownSeconds     int
-	Standalone               bool
-	AdditionalHeadersToProxy string
-	ExposeMetrics            bool
+	LogLevel                   string
+	HTTPPort                   string
+	ServiceVersion             string
+	TargetServiceHost          string
+	TargetServiceOASPath       string
+	OPAModulesDirectory        string
+	OPAMaxModuleDepth          int
+	OPALogLevel                string
+	APIPermissionsFilePath     string
+	StrictOASSource            bool
+	UserPropertiesHeader       string
+	UserPropertiesHeaderBase64 bool
+	UserGroupsHeader           string
+	UserIdHeader               string
+	ClientTypeHeader           string
+	BindingsCrudServiceURL     string
+	MongoDBUrl                 string
+	MongoDBUrlFile             string
+	RolesCollectionName        string
+	BindingsCollectionName     string
+	// EnableResourcePermissionsMapOptimization is the default of the route option building
+	// the optimized resource permissions map in the policies input.
+	EnableResourcePermissionsMapOptimization bool
+	AuditCollectionName                      string
+	PathPrefixStandalone                     string
+	DelayShutdownSeconds                     int
+	Standalone                               bool
+	StandaloneGRPC                           bool
+	GRPCPort                                 string
+	AdditionalHeadersToProxy                 string
+	ExposeMetrics                            bool
+	EvaluatorCacheMaxSize                    int
+	ResponseBodyCacheSize                    int
+	LazyEvaluatorInit                        bool
+	PreWarmOnStartup                         bool
+	EvaluatorSetupWorkers                    int
+	RequestsPerSecond                        float64
+	Burst                                    int
+	UpstreamRetryOn5xx                       bool
+	UpstreamRetryMaxAttempts                 int
+	DefaultRequestTimeoutMs                  int
+	CircuitBreakerConsecutiveFailures        int
+	CircuitBreakerFailureRatio               float64
+	CircuitBreakerWindowSize                 int
+	CircuitBreakerOpenDurationMs             int
+	ConsulAddress                            string
+	ConsulServiceName                        string
+	ConsulRefreshInterval                    int
+	OASRefreshInterval                       int
+	OASFetchMaxRetries                       int
+	OASFetchBackoffMs                        int
+	OASCachePath                             string
+	TargetServiceOASHeadersConfig            string
+	TargetServiceOASHeaders                  map[string]string
+	DefaultPolicyMode                        string
+	ExposeDenyReasons                        bool
+	ErrorResponseFormat                      string
+	CaseInsensitiveRouting                   bool
+	StrictRouting                            bool
+	CORSPassthrough                          string
+	AccessLogFormat                          string
+	AccessLogExcludedPaths                   string
+	AccessLogExcludedPathsList               []string
+	CORSAllowedOrigins                       string
+	CORSAllowedOriginsList                   []string
+	CORSAllowedMethods                       string
+	CORSAllowedMethodsList                   []string
+	CORSAllowedHeaders                       string
+	CORSAllowedHeadersList                   []string
+	UserIDSourcesConfig                      string
+	UserIDSources                            []UserIDSource
+	JWTVerificationKey                       string
+	JWTVerifiedUpstream                      bool
+	UpstreamRoutingMap                       string
+	UpstreamRoutes                           []UpstreamRoute
+	TargetServiceHostHeader                  string
+	PreserveHost                             bool
+	PathRewriteFrom                          string
+	PathRewriteTo                            string
+	TrustedProxies                           string
+	TrustedProxiesNetworks                   []*net.IPNet
+	EnableVerifyJWTBuiltin                   bool
+	ParseJWTInput                            bool
+	JWTUserIDClaim                           string
+	JWTUserGroupsClaim                       string
+	AuthenticationRequired                   bool
+	AllowPartialSetup                        bool
+	PoliciesTestDir                          string
+	PoliciesTestFixturesPath                 string
+	MongoMaxPoolSize                         uint64
+	MongoMinPoolSize                         uint64
+	MongoMaxConnecting                       uint64
+	MongoSocketTimeoutMs                     int
+	MongoRetryOnNetworkError                 bool
+	PolicyTraceHeaderKey                     string
+	PolicyTraceSecret                        string
+	PolicyTraceSecretFile                    string
+	RequestIDHeaderKey                       string
+	PolicyResponseHeader                     string
+	MongoBindingsProjection                  string
+	BindingProjectionFields                  []string
+	ReadinessCheckMongo                      bool
+	ReadinessCheckTarget                     bool
+	GrantPolicy                              string
+	RevokePolicy                             string
+	AllowedPaths                             string
+	AllowedPathPatterns                      []string
+	PassThroughNonJSON                       bool
+	SensitiveHeaders                         string
+	SensitiveHeadersList                     []string
+	PolicyVersionCheck                       string
+	PolicyDiffSecret                         string
+	PolicyDiffSecretFile                     string
+	PolicyDiffRecordedInputs                 int
+	UserSignatureHeader                      string
+	UserSignatureSecret                      string
+	UserSignatureSecretFile                  string
+	UserSignatureSecondarySecret             string
+	UserSignatureSecondarySecretFile         string
+	OPACapabilitiesPath                      string
+	DisabledBuiltins                         string
+	DisabledBuiltinsList                     []string
 }
 
 var EnvVariablesConfig = []configlib.EnvConfig{
@@ -88,15 +305,35 @@ var EnvVariablesConfig = []configlib.EnvConfig{
 		Variable: "OPAModulesDirectory",
 		Required: true,
 	},
+	{
+		Key:          "OPA_MAX_MODULE_DEPTH",
+		Variable:     "OPAMaxModuleDepth",
+		DefaultValue: "5",
+	},
+	{
+		Key:          OPALogLevelEnvKey,
+		Variable:     "OPALogLevel",
+		DefaultValue: OPALogLevelWarn,
+	},
 	{
 		Key:      APIPermissionsFilePathEnvKey,
 		Variable: "APIPermissionsFilePath",
 	},
+	{
+		Key:          StrictOASSourceEnvKey,
+		Variable:     "StrictOASSource",
+		DefaultValue: "false",
+	},
 	{
 		Key:          "USER_PROPERTIES_HEADER_KEY",
 		Variable:     "UserPropertiesHeader",
 		DefaultValue: "miauserproperties",
 	},
+	{
+		Key:          "USER_PROPERTIES_HEADER_BASE64",
+		Variable:     "UserPropertiesHeaderBase64",
+		DefaultValue: "false",
+	},
 	{
 		Key:          "USER_GROUPS_HEADER_KEY",
 		Variable:     "UserGroupsHeader",
@@ -107,6 +344,35 @@ var EnvVariablesConfig = []configlib.EnvConfig{
 		Variable:     "UserIdHeader",
 		DefaultValue: "miauserid",
 	},
+	{
+		Key:      UserIDSourcesEnvKey,
+		Variable: "UserIDSourcesConfig",
+	},
+	{
+		Key:      UpstreamRoutingMapEnvKey,
+		Variable: "UpstreamRoutingMap",
+	},
+	{
+		Key:      TargetServiceHostHeaderKey,
+		Variable: "TargetServiceHostHeader",
+	},
+	{
+		Key:          "PRESERVE_HOST",
+		Variable:     "PreserveHost",
+		DefaultValue: "true",
+	},
+	{
+		Key:      PathRewriteFromEnvKey,
+		Variable: "PathRewriteFrom",
+	},
+	{
+		Key:      PathRewriteToEnvKey,
+		Variable: "PathRewriteTo",
+	},
+	{
+		Key:      TrustedProxiesEnvKey,
+		Variable: "TrustedProxies",
+	},
 	{
 		Key:          "CLIENT_TYPE_HEADER_KEY",
 		Variable:     "ClientTypeHeader",
@@ -118,9 +384,13 @@ var EnvVariablesConfig = []configlib.EnvConfig{
 		DefaultValue: "10",
 	},
 	{
-		Key:      "MONGODB_URL",
+		Key:      MongoDBUrlEnvKey,
 		Variable: "MongoDBUrl",
 	},
+	{
+		Key:      MongoDBUrlFileEnvKey,
+		Variable: "MongoDBUrlFile",
+	},
 	{
 		Key:      "BINDINGS_COLLECTION_NAME",
 		Variable: "BindingsCollectionName",
@@ -129,10 +399,29 @@ var EnvVariablesConfig = []configlib.EnvConfig{
 		Key:      "ROLES_COLLECTION_NAME",
 		Variable: "RolesCollectionName",
 	},
+	{
+		Key:          "ENABLE_RESOURCE_PERMISSIONS_MAP_OPTIMIZATION",
+		Variable:     "EnableResourcePermissionsMapOptimization",
+		DefaultValue: "false",
+	},
+	{
+		Key:          "AUDIT_COLLECTION_NAME",
+		Variable:     "AuditCollectionName",
+		DefaultValue: "bindings_audit",
+	},
 	{
 		Key:      StandaloneEnvKey,
 		Variable: "Standalone",
 	},
+	{
+		Key:      StandaloneGRPCEnvKey,
+		Variable: "StandaloneGRPC",
+	},
+	{
+		Key:          GRPCPortEnvKey,
+		Variable:     "GRPCPort",
+		DefaultValue: "9090",
+	},
 	{
 		Key:          "PATH_PREFIX_STANDALONE",
 		Variable:     "PathPrefixStandalone",
@@ -152,6 +441,336 @@ var EnvVariablesConfig = []configlib.EnvConfig{
 		Variable:     "ExposeMetrics",
 		DefaultValue: "true",
 	},
+	{
+		Key:          "EVALUATOR_CACHE_MAX_SIZE",
+		Variable:     "EvaluatorCacheMaxSize",
+		DefaultValue: "1000",
+	},
+	{
+		Key:      OPACapabilitiesPathEnvKey,
+		Variable: "OPACapabilitiesPath",
+	},
+	{
+		Key:      DisabledBuiltinsEnvKey,
+		Variable: "DisabledBuiltins",
+	},
+	{
+		Key:          "RESPONSE_BODY_CACHE_SIZE",
+		Variable:     "ResponseBodyCacheSize",
+		DefaultValue: "0",
+	},
+	{
+		Key:          "LAZY_EVALUATOR_INIT",
+		Variable:     "LazyEvaluatorInit",
+		DefaultValue: "false",
+	},
+	{
+		Key:          "PRE_WARM_ON_STARTUP",
+		Variable:     "PreWarmOnStartup",
+		DefaultValue: "false",
+	},
+	{
+		Key:          "EVALUATOR_SETUP_WORKERS",
+		Variable:     "EvaluatorSetupWorkers",
+		DefaultValue: "0",
+	},
+	{
+		Key:          "REQUESTS_PER_SECOND",
+		Variable:     "RequestsPerSecond",
+		DefaultValue: "0",
+	},
+	{
+		Key:          "BURST",
+		Variable:     "Burst",
+		DefaultValue: "0",
+	},
+	{
+		Key:          "UPSTREAM_RETRY_ON_5XX",
+		Variable:     "UpstreamRetryOn5xx",
+		DefaultValue: "false",
+	},
+	{
+		Key:          "UPSTREAM_RETRY_MAX_ATTEMPTS",
+		Variable:     "UpstreamRetryMaxAttempts",
+		DefaultValue: "3",
+	},
+	{
+		Key:      "DEFAULT_REQUEST_TIMEOUT_MS",
+		Variable: "DefaultRequestTimeoutMs",
+	},
+	{
+		Key:      CircuitBreakerFailuresEnvKey,
+		Variable: "CircuitBreakerConsecutiveFailures",
+	},
+	{
+		Key:      CircuitBreakerRatioEnvKey,
+		Variable: "CircuitBreakerFailureRatio",
+	},
+	{
+		Key:          CircuitBreakerWindowEnvKey,
+		Variable:     "CircuitBreakerWindowSize",
+		DefaultValue: "20",
+	},
+	{
+		Key:          CircuitBreakerOpenEnvKey,
+		Variable:     "CircuitBreakerOpenDurationMs",
+		DefaultValue: "30000",
+	},
+	{
+		Key:      ConsulAddressEnvKey,
+		Variable: "ConsulAddress",
+	},
+	{
+		Key:      ConsulServiceNameEnvKey,
+		Variable: "ConsulServiceName",
+	},
+	{
+		Key:          "CONSUL_REFRESH_INTERVAL_SECONDS",
+		Variable:     "ConsulRefreshInterval",
+		DefaultValue: "30",
+	},
+	{
+		Key:      OASRefreshIntervalEnvKey,
+		Variable: "OASRefreshInterval",
+	},
+	{
+		Key:          OASFetchMaxRetriesEnvKey,
+		Variable:     "OASFetchMaxRetries",
+		DefaultValue: "0",
+	},
+	{
+		Key:          OASFetchBackoffEnvKey,
+		Variable:     "OASFetchBackoffMs",
+		DefaultValue: "1000",
+	},
+	{
+		Key:      OASCachePathEnvKey,
+		Variable: "OASCachePath",
+	},
+	{
+		Key:      OASFetchHeadersEnvKey,
+		Variable: "TargetServiceOASHeadersConfig",
+	},
+	{
+		Key:          DefaultPolicyModeEnvKey,
+		Variable:     "DefaultPolicyMode",
+		DefaultValue: PolicyModeEnforce,
+	},
+	{
+		Key:          "EXPOSE_DENY_REASONS",
+		Variable:     "ExposeDenyReasons",
+		DefaultValue: "false",
+	},
+	{
+		Key:          ErrorResponseFormatEnvKey,
+		Variable:     "ErrorResponseFormat",
+		DefaultValue: utils.ErrorResponseFormatRond,
+	},
+	{
+		Key:          "CASE_INSENSITIVE_ROUTING",
+		Variable:     "CaseInsensitiveRouting",
+		DefaultValue: "false",
+	},
+	{
+		Key:          "STRICT_ROUTING",
+		Variable:     "StrictRouting",
+		DefaultValue: "false",
+	},
+	{
+		Key:          CORSPassthroughEnvKey,
+		Variable:     "CORSPassthrough",
+		DefaultValue: CORSPassthroughOff,
+	},
+	{
+		Key:          AccessLogFormatEnvKey,
+		Variable:     "AccessLogFormat",
+		DefaultValue: AccessLogFormatOff,
+	},
+	{
+		Key:          AccessLogExcludedPathsEnvKey,
+		Variable:     "AccessLogExcludedPaths",
+		DefaultValue: "/-/",
+	},
+	{
+		Key:      "CORS_ALLOWED_ORIGINS",
+		Variable: "CORSAllowedOrigins",
+	},
+	{
+		Key:      "CORS_ALLOWED_METHODS",
+		Variable: "CORSAllowedMethods",
+	},
+	{
+		Key:      "CORS_ALLOWED_HEADERS",
+		Variable: "CORSAllowedHeaders",
+	},
+	{
+		Key:      JWTVerificationKeyEnvKey,
+		Variable: "JWTVerificationKey",
+	},
+	{
+		Key:          JWTVerifiedUpstreamEnvKey,
+		Variable:     "JWTVerifiedUpstream",
+		DefaultValue: "false",
+	},
+	{
+		Key:          "ENABLE_VERIFY_JWT_BUILTIN",
+		Variable:     "EnableVerifyJWTBuiltin",
+		DefaultValue: "false",
+	},
+	{
+		Key:          "PARSE_JWT_INPUT",
+		Variable:     "ParseJWTInput",
+		DefaultValue: "false",
+	},
+	{
+		Key:          "JWT_USER_ID_CLAIM",
+		Variable:     "JWTUserIDClaim",
+		DefaultValue: "sub",
+	},
+	{
+		Key:          "JWT_USER_GROUPS_CLAIM",
+		Variable:     "JWTUserGroupsClaim",
+		DefaultValue: "groups",
+	},
+	{
+		Key:          "AUTHENTICATION_REQUIRED",
+		Variable:     "AuthenticationRequired",
+		DefaultValue: "true",
+	},
+	{
+		Key:          "ALLOW_PARTIAL_SETUP",
+		Variable:     "AllowPartialSetup",
+		DefaultValue: "false",
+	},
+	{
+		Key:      PoliciesTestDirEnvKey,
+		Variable: "PoliciesTestDir",
+	},
+	{
+		Key:      "POLICIES_TEST_FIXTURES_PATH",
+		Variable: "PoliciesTestFixturesPath",
+	},
+	{
+		Key:          MongoMaxPoolSizeEnvKey,
+		Variable:     "MongoMaxPoolSize",
+		DefaultValue: "100",
+	},
+	{
+		Key:          MongoMinPoolSizeEnvKey,
+		Variable:     "MongoMinPoolSize",
+		DefaultValue: "0",
+	},
+	{
+		Key:          "MONGO_MAX_CONNECTING",
+		Variable:     "MongoMaxConnecting",
+		DefaultValue: "2",
+	},
+	{
+		Key:      "MONGO_SOCKET_TIMEOUT_MS",
+		Variable: "MongoSocketTimeoutMs",
+	},
+	{
+		Key:          "MONGO_RETRY_ON_NETWORK_ERROR",
+		Variable:     "MongoRetryOnNetworkError",
+		DefaultValue: "true",
+	},
+	{
+		Key:      PolicyTraceHeaderKeyEnvKey,
+		Variable: "PolicyTraceHeaderKey",
+	},
+	{
+		Key:      PolicyTraceSecretEnvKey,
+		Variable: "PolicyTraceSecret",
+	},
+	{
+		Key:      PolicyTraceSecretFileEnvKey,
+		Variable: "PolicyTraceSecretFile",
+	},
+	{
+		Key:          RequestIDHeaderKeyEnvKey,
+		Variable:     "RequestIDHeaderKey",
+		DefaultValue: "x-request-id",
+	},
+	{
+		Key:          PolicyResponseHeaderEnvKey,
+		Variable:     "PolicyResponseHeader",
+		DefaultValue: "X-Rond-Policy",
+	},
+	{
+		Key:          BindingsProjectionEnvKey,
+		Variable:     "MongoBindingsProjection",
+		DefaultValue: "bindingId,subjects,groups,roles,permissions,resource,expiresAt",
+	},
+	{
+		Key:          ReadinessCheckMongoEnvKey,
+		Variable:     "ReadinessCheckMongo",
+		DefaultValue: "true",
+	},
+	{
+		Key:      ReadinessCheckTargetEnvKey,
+		Variable: "ReadinessCheckTarget",
+	},
+	{
+		Key:      GrantPolicyEnvKey,
+		Variable: "GrantPolicy",
+	},
+	{
+		Key:      RevokePolicyEnvKey,
+		Variable: "RevokePolicy",
+	},
+	{
+		Key:      AllowedPathsEnvKey,
+		Variable: "AllowedPaths",
+	},
+	{
+		Key:          "PASS_THROUGH_NON_JSON",
+		Variable:     "PassThroughNonJSON",
+		DefaultValue: "true",
+	},
+	{
+		Key:          SensitiveHeadersEnvKey,
+		Variable:     "SensitiveHeaders",
+		DefaultValue: "authorization,cookie,set-cookie",
+	},
+	{
+		Key:          PolicyVersionCheckEnvKey,
+		Variable:     "PolicyVersionCheck",
+		DefaultValue: PolicyVersionCheckFail,
+	},
+	{
+		Key:      PolicyDiffSecretEnvKey,
+		Variable: "PolicyDiffSecret",
+	},
+	{
+		Key:      PolicyDiffSecretFileEnvKey,
+		Variable: "PolicyDiffSecretFile",
+	},
+	{
+		Key:          PolicyDiffRecordedInputsKey,
+		Variable:     "PolicyDiffRecordedInputs",
+		DefaultValue: "0",
+	},
+	{
+		Key:          "USER_SIGNATURE_HEADER",
+		Variable:     "UserSignatureHeader",
+		DefaultValue: "x-rond-user-signature",
+	},
+	{
+		Key:      SignatureSecretEnvKey,
+		Variable: "UserSignatureSecret",
+	},
+	{
+		Key:      SignatureSecretFileEnvKey,
+		Variable: "UserSignatureSecretFile",
+	},
+	{
+		Key:      SignatureSecondaryEnvKey,
+		Variable: "UserSignatureSecondarySecret",
+	},
+	{
+		Key:      SignatureSecondaryFileEnvKey,
+		Variable: "UserSignatureSecondarySecretFile",
+	},
 }
 
 type EnvKey struct{}
@@ -161,12 +780,16 @@ type EnvKey struct{}
 func RequestMiddlewareEnvironments(env EnvironmentVariables) mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx := context.WithValue(r.Context(), EnvKey{}, env)
-			next.ServeHTTP(w, r.WithContext(ctx))
+			next.ServeHTTP(w, r.WithContext(WithEnv(r.Context(), env)))
 		})
 	}
 }
 
+// WithEnv stores the environment variables in the context.
+func WithEnv(ctx context.Context, env EnvironmentVariables) context.Context {
+	return context.WithValue(ctx, EnvKey{}, env)
+}
+
 // GetEnv can be used by a request handler to get environment variables from its context.
 func GetEnv(requestContext context.Context) (EnvironmentVariables, error) {
 	env, ok := requestContext.Value(EnvKey{}).(EnvironmentVariables)
@@ -182,18 +805,136 @@ func GetEnvOrDie() EnvironmentVariables {
 	if err := configlib.GetEnvVariables(EnvVariablesConfig, &env); err != nil {
 		panic(err.Error())
 	}
+	if err := env.loadSecretFiles(); err != nil {
+		panic(err)
+	}
+
+	if !utils.Contains(PolicyModes, env.DefaultPolicyMode) {
+		panic(fmt.Errorf("invalid environment variable %s: %s, must be one of %s", DefaultPolicyModeEnvKey, env.DefaultPolicyMode, strings.Join(PolicyModes, ", ")))
+	}
+
+	if !utils.Contains(CORSPassthroughModes, env.CORSPassthrough) {
+		panic(fmt.Errorf("invalid environment variable %s: %s, must be one of %s", CORSPassthroughEnvKey, env.CORSPassthrough, strings.Join(CORSPassthroughModes, ", ")))
+	}
+
+	if !utils.Contains(AccessLogFormats, env.AccessLogFormat) {
+		panic(fmt.Errorf("invalid environment variable %s: %s, must be one of %s", AccessLogFormatEnvKey, env.AccessLogFormat, strings.Join(AccessLogFormats, ", ")))
+	}
+
+	if !utils.Contains(PolicyVersionCheckModes, env.PolicyVersionCheck) {
+		panic(fmt.Errorf("invalid environment variable %s: %s, must be one of %s", PolicyVersionCheckEnvKey, env.PolicyVersionCheck, strings.Join(PolicyVersionCheckModes, ", ")))
+	}
+	if !utils.Contains(OPALogLevels, env.OPALogLevel) {
+		panic(fmt.Errorf("invalid environment variable %s: %s, must be one of %s", OPALogLevelEnvKey, env.OPALogLevel, strings.Join(OPALogLevels, ", ")))
+	}
+
+	if !utils.Contains(utils.ErrorResponseFormats, env.ErrorResponseFormat) {
+		panic(fmt.Errorf("invalid environment variable %s: %s, must be one of %s", ErrorResponseFormatEnvKey, env.ErrorResponseFormat, strings.Join(utils.ErrorResponseFormats, ", ")))
+	}
+
+	userIDSources, err := parseUserIDSources(env.UserIDSourcesConfig)
+	if err != nil {
+		panic(fmt.Errorf("invalid environment variable %s: %s", UserIDSourcesEnvKey, err.Error()))
+	}
+	env.UserIDSources = userIDSources
+
+	upstreamRoutes, err := parseUpstreamRoutingMap(env.UpstreamRoutingMap)
+	if err != nil {
+		panic(fmt.Errorf("invalid environment variable %s: %s", UpstreamRoutingMapEnvKey, err.Error()))
+	}
+	env.UpstreamRoutes = upstreamRoutes
+
+	trustedProxiesNetworks, err := utils.ParseTrustedProxies(env.TrustedProxies)
+	if err != nil {
+		panic(fmt.Errorf("invalid environment variable %s: %s", TrustedProxiesEnvKey, err.Error()))
+	}
+	env.TrustedProxiesNetworks = trustedProxiesNetworks
+	env.BindingProjectionFields = splitCommaSeparated(env.MongoBindingsProjection)
+
+	allowedPathPatterns, err := parseAllowedPaths(env.AllowedPaths)
+	if err != nil {
+		panic(fmt.Errorf("invalid environment variable %s: %s", AllowedPathsEnvKey, err.Error()))
+	}
+	env.AllowedPathPatterns = allowedPathPatterns
 
-	if env.TargetServiceHost == "" && !env.Standalone {
-		panic(fmt.Errorf("missing environment variables, one of %s or %s set to true is required", TargetServiceHostEnvKey, StandaloneEnvKey))
+	oasHeaders, err := parseHeaders(env.TargetServiceOASHeadersConfig)
+	if err != nil {
+		panic(fmt.Errorf("invalid environment variable %s: %s", OASFetchHeadersEnvKey, err.Error()))
 	}
+	env.TargetServiceOASHeaders = oasHeaders
+	env.CORSAllowedOriginsList = splitCommaSeparated(env.CORSAllowedOrigins)
+	env.CORSAllowedMethodsList = splitCommaSeparated(strings.ToUpper(env.CORSAllowedMethods))
+	env.CORSAllowedHeadersList = splitCommaSeparated(env.CORSAllowedHeaders)
+	env.AccessLogExcludedPathsList = splitCommaSeparated(env.AccessLogExcludedPaths)
+	env.SensitiveHeadersList = splitCommaSeparated(env.SensitiveHeaders)
+	env.DisabledBuiltinsList = splitCommaSeparated(env.DisabledBuiltins)
 
-	if env.Standalone && env.BindingsCrudServiceURL == "" {
-		panic(fmt.Errorf("missing environment variables, %s must be set if mode is standalone", BindingsCrudServiceURL))
+	// empty env variables are ignored in favour of the default value, while an empty
+	// policy response header explicitly disables the header.
+	if value, ok := os.LookupEnv(PolicyResponseHeaderEnvKey); ok && value == "" {
+		env.PolicyResponseHeader = ""
 	}
 
 	return env
 }
 
+// parseAllowedPaths parses the comma separated glob patterns of the paths proxied
+// without policy evaluation. The patterns follow the path.Match syntax, while a
+// trailing /* matches all the paths under the prefix.
+func parseAllowedPaths(list string) ([]string, error) {
+	patterns := splitCommaSeparated(list)
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("pattern %s must start with /", pattern)
+		}
+		if _, err := path.Match(pattern, "/"); err != nil {
+			return nil, fmt.Errorf("pattern %s is not valid: %s", pattern, err.Error())
+		}
+	}
+	return patterns, nil
+}
+
+// parseHeaders parses the headers set as a JSON object or as comma separated
+// key:value pairs.
+func parseHeaders(rawHeaders string) (map[string]string, error) {
+	rawHeaders = strings.TrimSpace(rawHeaders)
+	if rawHeaders == "" {
+		return nil, nil
+	}
+
+	headers := map[string]string{}
+	if strings.HasPrefix(rawHeaders, "{") {
+		if err := json.Unmarshal([]byte(rawHeaders), &headers); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, entry := range splitCommaSeparated(rawHeaders) {
+			name, value, found := strings.Cut(entry, ":")
+			if !found {
+				return nil, fmt.Errorf("header %s must be in the key:value format", entry)
+			}
+			headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	for name := range headers {
+		if name == "" {
+			return nil, fmt.Errorf("header name must not be empty")
+		}
+	}
+	return headers, nil
+}
+
+// splitCommaSeparated splits a comma separated list, ignoring the empty entries.
+func splitCommaSeparated(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
 var extraHeadersKeys = []string{"x-request-id", "x-forwarded-for", "x-forwarded-proto", "x-forwarded-host"}
 
 func (env EnvironmentVariables) GetAdditionalHeadersToProxy() []string {
@@ -215,3 +956,31 @@ func (env EnvironmentVariables) GetAdditionalHeadersToProxy() []string {
 	}
 	return customHeaders
 }
+
+const fileURIScheme = "file://"
+
+// GetLocalOASFilePath returns the file the OAS is read from when TARGET_SERVICE_OAS_PATH is
+// a file:// URI or a relative path, which is resolved against the working directory.
+// The paths starting with / are fetched from the target service instead.
+func (env EnvironmentVariables) GetLocalOASFilePath() (string, bool) {
+	oasPath := env.TargetServiceOASPath
+	switch {
+	case oasPath == "":
+		return "", false
+	case strings.HasPrefix(oasPath, fileURIScheme):
+		oasPath = strings.TrimPrefix(oasPath, fileURIScheme)
+	case strings.HasPrefix(oasPath, "/"):
+		return "", false
+	}
+	absolutePath, err := filepath.Abs(oasPath)
+	if err != nil {
+		return oasPath, true
+	}
+	return absolutePath, true
+}
+
+// CircuitBreakerEnabled reports whether the requests to the target service go through the
+// circuit breaker, which is opened by consecutive failures, by a failure ratio, or both.
+func (env EnvironmentVariables) CircuitBreakerEnabled() bool {
+	return env.CircuitBreakerConsecutiveFailures > 0 || env.CircuitBreakerFailureRatio > 0
+}
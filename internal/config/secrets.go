@@ -0,0 +1,68 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ReadSecretFile reads the value of a secret mounted as a file, trimming the
+// surrounding whitespace, as the trailing newline left by most editors.
+func ReadSecretFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed secret file read: %s", err.Error())
+	}
+	value := strings.TrimSpace(string(content))
+	if value == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return value, nil
+}
+
+// loadSecretFiles sets the sensitive variables from the files set with their *_FILE
+// companion variables, so that the secrets are not exposed in the process environment.
+// The value set directly in the environment takes precedence, and the file variable is
+// cleared in that case so that the file is not read again on rotation.
+func (env *EnvironmentVariables) loadSecretFiles() error {
+	secrets := []struct {
+		fileKey string
+		path    *string
+		value   *string
+	}{
+		{fileKey: MongoDBUrlFileEnvKey, path: &env.MongoDBUrlFile, value: &env.MongoDBUrl},
+		{fileKey: PolicyTraceSecretFileEnvKey, path: &env.PolicyTraceSecretFile, value: &env.PolicyTraceSecret},
+		{fileKey: PolicyDiffSecretFileEnvKey, path: &env.PolicyDiffSecretFile, value: &env.PolicyDiffSecret},
+		{fileKey: SignatureSecretFileEnvKey, path: &env.UserSignatureSecretFile, value: &env.UserSignatureSecret},
+		{fileKey: SignatureSecondaryFileEnvKey, path: &env.UserSignatureSecondarySecretFile, value: &env.UserSignatureSecondarySecret},
+	}
+	for _, secret := range secrets {
+		if *secret.path == "" {
+			continue
+		}
+		if *secret.value != "" {
+			*secret.path = ""
+			continue
+		}
+		value, err := ReadSecretFile(*secret.path)
+		if err != nil {
+			return fmt.Errorf("invalid environment variable %s: %s", secret.fileKey, err.Error())
+		}
+		*secret.value = value
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const UpstreamRoutingMapEnvKey = "UPSTREAM_ROUTING_MAP"
+
+// UpstreamRoute directs the requests whose path is under PathPrefix to Host instead of
+// the target service host.
+type UpstreamRoute struct {
+	PathPrefix string
+	Host       string
+}
+
+// parseUpstreamRoutingMap parses the JSON object mapping the path prefixes to their upstream
+// host. The routes are sorted by descending prefix length, so that the first matching route
+// is the one with the longest prefix.
+func parseUpstreamRoutingMap(rawRoutingMap string) ([]UpstreamRoute, error) {
+	if rawRoutingMap == "" {
+		return nil, nil
+	}
+
+	var routingMap map[string]string
+	if err := json.Unmarshal([]byte(rawRoutingMap), &routingMap); err != nil {
+		return nil, err
+	}
+	routes := make([]UpstreamRoute, 0, len(routingMap))
+	for pathPrefix, host := range routingMap {
+		if !strings.HasPrefix(pathPrefix, "/") {
+			return nil, fmt.Errorf("path prefix %s must start with /", pathPrefix)
+		}
+		if host == "" {
+			return nil, fmt.Errorf("upstream host of path prefix %s must not be empty", pathPrefix)
+		}
+		routes = append(routes, UpstreamRoute{PathPrefix: strings.TrimSuffix(pathPrefix, "/"), Host: host})
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if len(routes[i].PathPrefix) != len(routes[j].PathPrefix) {
+			return len(routes[i].PathPrefix) > len(routes[j].PathPrefix)
+		}
+		return routes[i].PathPrefix < routes[j].PathPrefix
+	})
+	return routes, nil
+}
+
+// GetUpstreamHost returns the host the request with the given path is forwarded to: the
+// one of the upstream route with the longest prefix matching the path, or the target
+// service host if no route matches.
+func (env EnvironmentVariables) GetUpstreamHost(path string) string {
+	for _, route := range env.UpstreamRoutes {
+		if route.PathPrefix == "" || path == route.PathPrefix || strings.HasPrefix(path, route.PathPrefix+"/") {
+			return route.Host
+		}
+	}
+	return env.TargetServiceHost
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rond-authz/rond/internal/utils"
+)
+
+const (
+	UserIDSourcesEnvKey = "USER_ID_SOURCES"
+
+	// UserIDSourceHeader reads the user id from a request header.
+	// Config: name (defaults to USER_ID_HEADER_KEY).
+	UserIDSourceHeader = "header"
+	// UserIDSourceJWTClaim reads the user id from a claim of a bearer JWT. The token is
+	// verified with JWT_VERIFICATION_KEY, or trusted as is when JWT_VERIFIED_UPSTREAM is set.
+	// Config: header (defaults to Authorization), claim (defaults to sub).
+	UserIDSourceJWTClaim = "jwt_claim"
+	// UserIDSourceAPIKey looks up the SHA-256 hash of the API key sent in a request
+	// header in a MongoDB collection holding the owner of each key.
+	// Config: header (defaults to x-api-key), collection (defaults to api_keys),
+	// hashField (defaults to keyHash), userIdField (defaults to userId).
+	UserIDSourceAPIKey = "api_key"
+)
+
+var UserIDSourceTypes = []string{UserIDSourceHeader, UserIDSourceJWTClaim, UserIDSourceAPIKey}
+
+// UserIDSource is a way of resolving the id of the user performing the request.
+type UserIDSource struct {
+	Type   string            `json:"type"`
+	Config map[string]string `json:"config,omitempty"`
+}
+
+// ConfigOrDefault returns the configuration value of key, or defaultValue if it is not set.
+func (source UserIDSource) ConfigOrDefault(key, defaultValue string) string {
+	if value := source.Config[key]; value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func parseUserIDSources(rawSources string) ([]UserIDSource, error) {
+	if rawSources == "" {
+		return nil, nil
+	}
+
+	var sources []UserIDSource
+	if err := json.Unmarshal([]byte(rawSources), &sources); err != nil {
+		return nil, err
+	}
+	for _, source := range sources {
+		if !utils.Contains(UserIDSourceTypes, source.Type) {
+			return nil, fmt.Errorf("unknown source type %s, must be one of %s", source.Type, strings.Join(UserIDSourceTypes, ", "))
+		}
+	}
+	return sources, nil
+}
+
+// GetUserIDSources returns the configured user id sources, in resolution order. If
+// none is configured, the user id is read from the USER_ID_HEADER_KEY header.
+func (env EnvironmentVariables) GetUserIDSources() []UserIDSource {
+	if len(env.UserIDSources) == 0 {
+		return []UserIDSource{{Type: UserIDSourceHeader}}
+	}
+	return env.UserIDSources
+}
+
+// UsesUserIDSource reports whether a source of type sourceType is configured.
+func (env EnvironmentVariables) UsesUserIDSource(sourceType string) bool {
+	for _, source := range env.UserIDSources {
+		if source.Type == sourceType {
+			return true
+		}
+	}
+	return false
+}
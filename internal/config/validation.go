@@ -0,0 +1,280 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ValidationError is a failed check on the value of an environment variable.
+type ValidationError struct {
+	Key string
+	Err error
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Err.Error())
+}
+
+func (e ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors lists all the failed checks of the environment variables.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, validationError := range e {
+		messages = append(messages, validationError.Error())
+	}
+	return fmt.Sprintf("invalid environment variables: %s", strings.Join(messages, "; "))
+}
+
+// Validate checks the environment variables values and their combinations, so that
+// misconfigurations are reported at startup with the name of the offending variable.
+// All the failed checks are reported in the returned error, as ValidationErrors.
+func (env EnvironmentVariables) Validate() error {
+	var validationErrors ValidationErrors
+	check := func(key string, err error) {
+		if err != nil {
+			validationErrors = append(validationErrors, ValidationError{Key: key, Err: err})
+		}
+	}
+
+	// the policies tests mode does not proxy any request
+	if env.TargetServiceHost == "" && !env.Standalone && env.PoliciesTestDir == "" {
+		check(TargetServiceHostEnvKey, fmt.Errorf("is required unless %s is set to true", StandaloneEnvKey))
+	}
+	// in standalone mode the bindings are written through the CRUD service, or directly on MongoDB
+	if env.Standalone && env.BindingsCrudServiceURL == "" && env.MongoDBUrl == "" {
+		check(StandaloneEnvKey, fmt.Errorf("requires one of %s or %s to be set", BindingsCrudServiceURL, MongoDBUrlEnvKey))
+	}
+	if env.StandaloneGRPC && !env.Standalone {
+		check(StandaloneGRPCEnvKey, fmt.Errorf("requires %s to be set to true", StandaloneEnvKey))
+	}
+	if env.StandaloneGRPC && env.GRPCPort == env.HTTPPort {
+		check(GRPCPortEnvKey, fmt.Errorf("must differ from the HTTP port %s", env.HTTPPort))
+	}
+	if env.PoliciesTestDir == "" {
+		if env.APIPermissionsFilePath == "" && env.TargetServiceOASPath == "" {
+			check(APIPermissionsFilePathEnvKey, fmt.Errorf("one of %s or %s is required", APIPermissionsFilePathEnvKey, TargetServiceOASPathEnvKey))
+		}
+		// the permissions file takes precedence over the OAS path, unless a single source is required
+		if env.StrictOASSource && env.APIPermissionsFilePath != "" && env.TargetServiceOASPath != "" {
+			check(APIPermissionsFilePathEnvKey, fmt.Errorf("must not be set together with %s when %s is set to true", TargetServiceOASPathEnvKey, StrictOASSourceEnvKey))
+		}
+	}
+	// the claims of a token not verified by rond are trusted only on explicit request
+	if env.JWTVerificationKey == "" && !env.JWTVerifiedUpstream {
+		if env.UsesUserIDSource(UserIDSourceJWTClaim) {
+			check(JWTVerificationKeyEnvKey, fmt.Errorf("is required by the %s user id source unless %s is set to true", UserIDSourceJWTClaim, JWTVerifiedUpstreamEnvKey))
+		}
+		if env.ParseJWTInput {
+			check(JWTVerificationKeyEnvKey, fmt.Errorf("is required by PARSE_JWT_INPUT unless %s is set to true", JWTVerifiedUpstreamEnvKey))
+		}
+	}
+	_, localOAS := env.GetLocalOASFilePath()
+	fetchesOAS := env.TargetServiceOASPath != "" && !localOAS && env.APIPermissionsFilePath == ""
+	if env.TargetServiceOASPath != "" && !localOAS && env.TargetServiceHost == "" {
+		check(TargetServiceOASPathEnvKey, fmt.Errorf("requires %s to be set", TargetServiceHostEnvKey))
+	}
+
+	check("HTTP_PORT", validatePort(env.HTTPPort))
+	check("OPA_MODULES_DIRECTORY", validateReadableDirectory(env.OPAModulesDirectory))
+	check("OPA_MAX_MODULE_DEPTH", validateNonNegative(env.OPAMaxModuleDepth))
+	if env.APIPermissionsFilePath != "" {
+		check(APIPermissionsFilePathEnvKey, validateReadableFile(env.APIPermissionsFilePath))
+	}
+	if env.TargetServiceHost != "" {
+		check(TargetServiceHostEnvKey, validateHost(env.TargetServiceHost))
+	}
+	if env.BindingsCrudServiceURL != "" {
+		check(BindingsCrudServiceURL, validateURL(env.BindingsCrudServiceURL))
+	}
+	if env.MongoDBUrl != "" {
+		check("MONGODB_URL", validateURL(env.MongoDBUrl))
+	}
+	if env.PoliciesTestDir != "" {
+		check(PoliciesTestDirEnvKey, validateReadableDirectory(env.PoliciesTestDir))
+	}
+	if env.PoliciesTestFixturesPath != "" {
+		check("POLICIES_TEST_FIXTURES_PATH", validateReadableFile(env.PoliciesTestFixturesPath))
+	}
+	if env.OPACapabilitiesPath != "" {
+		check(OPACapabilitiesPathEnvKey, validateReadableFile(env.OPACapabilitiesPath))
+	}
+	check("DELAY_SHUTDOWN_SECONDS", validateNonNegative(env.DelayShutdownSeconds))
+	check("EVALUATOR_CACHE_MAX_SIZE", validateNonNegative(env.EvaluatorCacheMaxSize))
+	check("RESPONSE_BODY_CACHE_SIZE", validateNonNegative(env.ResponseBodyCacheSize))
+	if env.RequestsPerSecond < 0 {
+		check("REQUESTS_PER_SECOND", fmt.Errorf("%g must not be negative", env.RequestsPerSecond))
+	}
+	check("BURST", validateNonNegative(env.Burst))
+	check("DEFAULT_REQUEST_TIMEOUT_MS", validateNonNegative(env.DefaultRequestTimeoutMs))
+	check(CircuitBreakerFailuresEnvKey, validateNonNegative(env.CircuitBreakerConsecutiveFailures))
+	if env.CircuitBreakerFailureRatio < 0 || env.CircuitBreakerFailureRatio > 1 {
+		check(CircuitBreakerRatioEnvKey, fmt.Errorf("%g must be between 0 and 1", env.CircuitBreakerFailureRatio))
+	}
+	if env.CircuitBreakerFailureRatio > 0 && env.CircuitBreakerWindowSize < 1 {
+		check(CircuitBreakerWindowEnvKey, fmt.Errorf("%d must be at least 1 when %s is set", env.CircuitBreakerWindowSize, CircuitBreakerRatioEnvKey))
+	}
+	if env.CircuitBreakerEnabled() && env.CircuitBreakerOpenDurationMs < 1 {
+		check(CircuitBreakerOpenEnvKey, fmt.Errorf("%d must be at least 1 when the circuit breaker is enabled", env.CircuitBreakerOpenDurationMs))
+	}
+	if env.UpstreamRetryOn5xx && env.UpstreamRetryMaxAttempts < 1 {
+		check("UPSTREAM_RETRY_MAX_ATTEMPTS", fmt.Errorf("%d must be at least 1 when UPSTREAM_RETRY_ON_5XX is enabled", env.UpstreamRetryMaxAttempts))
+	}
+	if env.PathRewriteFrom != "" && !strings.HasPrefix(env.PathRewriteFrom, "/") {
+		check(PathRewriteFromEnvKey, fmt.Errorf("%s must start with /", env.PathRewriteFrom))
+	}
+	if env.PathRewriteTo != "" {
+		if !strings.HasPrefix(env.PathRewriteTo, "/") {
+			check(PathRewriteToEnvKey, fmt.Errorf("%s must start with /", env.PathRewriteTo))
+		}
+		if env.PathRewriteFrom == "" {
+			check(PathRewriteToEnvKey, fmt.Errorf("requires %s to be set", PathRewriteFromEnvKey))
+		}
+	}
+	if env.ConsulAddress != "" {
+		check(ConsulAddressEnvKey, validateURL(env.ConsulAddress))
+		if env.ConsulServiceName == "" {
+			check(ConsulServiceNameEnvKey, fmt.Errorf("must be set when %s is set", ConsulAddressEnvKey))
+		}
+		if env.ConsulRefreshInterval < 1 {
+			check("CONSUL_REFRESH_INTERVAL_SECONDS", fmt.Errorf("%d must be at least 1 when %s is set", env.ConsulRefreshInterval, ConsulAddressEnvKey))
+		}
+	}
+	check(OASRefreshIntervalEnvKey, validateNonNegative(env.OASRefreshInterval))
+	if env.OASRefreshInterval > 0 && !fetchesOAS {
+		check(OASRefreshIntervalEnvKey, fmt.Errorf("requires the OAS to be fetched from %s", TargetServiceOASPathEnvKey))
+	}
+	check(OASFetchMaxRetriesEnvKey, validateNonNegative(env.OASFetchMaxRetries))
+	check(OASFetchBackoffEnvKey, validateNonNegative(env.OASFetchBackoffMs))
+	if env.OASCachePath != "" && !fetchesOAS {
+		check(OASCachePathEnvKey, fmt.Errorf("requires the OAS to be fetched from %s", TargetServiceOASPathEnvKey))
+	}
+	// with unbounded retries the fetch never fails, so the cached OAS would never be read
+	if env.OASCachePath != "" && fetchesOAS && env.OASFetchMaxRetries == 0 {
+		check(OASCachePathEnvKey, fmt.Errorf("requires %s to be greater than 0", OASFetchMaxRetriesEnvKey))
+	}
+	check("MONGO_SOCKET_TIMEOUT_MS", validateNonNegative(env.MongoSocketTimeoutMs))
+	// a max pool size of 0 means the pool is unbounded
+	if env.MongoMaxPoolSize != 0 && env.MongoMinPoolSize > env.MongoMaxPoolSize {
+		check(MongoMinPoolSizeEnvKey, fmt.Errorf("%d must not be greater than %s %d", env.MongoMinPoolSize, MongoMaxPoolSizeEnvKey, env.MongoMaxPoolSize))
+	}
+
+	// policy tracing exposes the whole input document, so it is never enabled without a secret
+	if env.PolicyTraceHeaderKey != "" && env.PolicyTraceSecret == "" {
+		check(PolicyTraceSecretEnvKey, fmt.Errorf("is required when %s is set", PolicyTraceHeaderKeyEnvKey))
+	}
+	// the recorded inputs are only readable through the policy diff route
+	check(PolicyDiffRecordedInputsKey, validateNonNegative(env.PolicyDiffRecordedInputs))
+	if env.PolicyDiffRecordedInputs > 0 && env.PolicyDiffSecret == "" {
+		check(PolicyDiffSecretEnvKey, fmt.Errorf("is required when %s is set", PolicyDiffRecordedInputsKey))
+	}
+	// the secondary key is only used while rotating the primary one
+	if env.UserSignatureSecondarySecret != "" && env.UserSignatureSecret == "" {
+		check(SignatureSecretEnvKey, fmt.Errorf("is required when %s is set", SignatureSecondaryEnvKey))
+	}
+
+	// the collections are set together with MongoDB
+	for _, collection := range []struct{ key, name string }{
+		{key: "BINDINGS_COLLECTION_NAME", name: env.BindingsCollectionName},
+		{key: "ROLES_COLLECTION_NAME", name: env.RolesCollectionName},
+	} {
+		if env.MongoDBUrl == "" && collection.name != "" {
+			check(collection.key, fmt.Errorf("requires %s to be set", MongoDBUrlEnvKey))
+		}
+		if env.MongoDBUrl != "" && collection.name == "" {
+			check(collection.key, fmt.Errorf("is required when %s is set", MongoDBUrlEnvKey))
+		}
+	}
+
+	if len(validationErrors) > 0 {
+		return validationErrors
+	}
+	return nil
+}
+
+func validatePort(port string) error {
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", port)
+	}
+	if portNumber < 1 || portNumber > 65535 {
+		return fmt.Errorf("%d is not in range 1-65535", portNumber)
+	}
+	return nil
+}
+
+func validateReadableDirectory(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%s does not exist", path)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	if _, err := os.ReadDir(path); err != nil {
+		return fmt.Errorf("%s is not readable", path)
+	}
+	return nil
+}
+
+func validateReadableFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%s does not exist", path)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("%s is not readable", path)
+	}
+	return file.Close()
+}
+
+func validateURL(rawURL string) error {
+	if _, err := url.Parse(rawURL); err != nil {
+		return fmt.Errorf("invalid url: %s", err.Error())
+	}
+	return nil
+}
+
+// validateHost checks a host with an optional port, as used to build the url of the target service.
+func validateHost(host string) error {
+	parsedURL, err := url.Parse(fmt.Sprintf("http://%s", host))
+	if err != nil {
+		return fmt.Errorf("invalid host: %s", err.Error())
+	}
+	if parsedURL.Host != host {
+		return fmt.Errorf("invalid host %s", host)
+	}
+	return nil
+}
+
+func validateNonNegative(value int) error {
+	if value < 0 {
+		return fmt.Errorf("%d must not be negative", value)
+	}
+	return nil
+}
@@ -0,0 +1,402 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	directory := t.TempDir()
+	filePath := filepath.Join(directory, "oas.json")
+	require.NoError(t, os.WriteFile(filePath, []byte("{}"), 0600))
+
+	validEnv := func() EnvironmentVariables {
+		return EnvironmentVariables{
+			HTTPPort:             "8080",
+			OPAModulesDirectory:  directory,
+			TargetServiceHost:    "localhost:3000",
+			TargetServiceOASPath: "/documentation/json",
+		}
+	}
+
+	t.Run("valid configuration", func(t *testing.T) {
+		env := validEnv()
+		env.APIPermissionsFilePath = filePath
+		env.TargetServiceOASPath = ""
+		env.BindingsCrudServiceURL = "http://crud-service/bindings"
+		env.MongoDBUrl = "mongodb://localhost:27017/db"
+		env.BindingsCollectionName = "bindings"
+		env.RolesCollectionName = "roles"
+		env.DelayShutdownSeconds = 10
+		env.EvaluatorCacheMaxSize = 0
+		require.NoError(t, env.Validate())
+	})
+
+	t.Run("HTTP_PORT", func(t *testing.T) {
+		testCases := map[string]string{
+			"":      `invalid environment variables: HTTP_PORT: "" is not a number`,
+			"abc":   `invalid environment variables: HTTP_PORT: "abc" is not a number`,
+			"0":     "invalid environment variables: HTTP_PORT: 0 is not in range 1-65535",
+			"65536": "invalid environment variables: HTTP_PORT: 65536 is not in range 1-65535",
+		}
+		for port, expectedError := range testCases {
+			env := validEnv()
+			env.HTTPPort = port
+			require.EqualError(t, env.Validate(), expectedError)
+		}
+
+		for _, port := range []string{"1", "3000", "65535"} {
+			env := validEnv()
+			env.HTTPPort = port
+			require.NoError(t, env.Validate())
+		}
+	})
+
+	t.Run("OPA_MODULES_DIRECTORY", func(t *testing.T) {
+		env := validEnv()
+		env.OPAModulesDirectory = filepath.Join(directory, "missing")
+		require.EqualError(t, env.Validate(), "invalid environment variables: OPA_MODULES_DIRECTORY: "+env.OPAModulesDirectory+" does not exist")
+
+		env.OPAModulesDirectory = filePath
+		require.EqualError(t, env.Validate(), "invalid environment variables: OPA_MODULES_DIRECTORY: "+filePath+" is not a directory")
+	})
+
+	t.Run("API_PERMISSIONS_FILE_PATH", func(t *testing.T) {
+		env := validEnv()
+		env.APIPermissionsFilePath = filePath
+		env.TargetServiceOASPath = ""
+		require.NoError(t, env.Validate())
+
+		env.APIPermissionsFilePath = filepath.Join(directory, "missing.json")
+		require.EqualError(t, env.Validate(), "invalid environment variables: API_PERMISSIONS_FILE_PATH: "+env.APIPermissionsFilePath+" does not exist")
+
+		env.APIPermissionsFilePath = directory
+		require.EqualError(t, env.Validate(), "invalid environment variables: API_PERMISSIONS_FILE_PATH: "+directory+" is a directory")
+	})
+
+	t.Run("TARGET_SERVICE_HOST", func(t *testing.T) {
+		env := validEnv()
+		env.TargetServiceHost = "my-service:3000"
+		require.NoError(t, env.Validate())
+
+		env.TargetServiceHost = "http://my-service"
+		require.EqualError(t, env.Validate(), "invalid environment variables: TARGET_SERVICE_HOST: invalid host http://my-service")
+	})
+
+	t.Run("URLs", func(t *testing.T) {
+		env := validEnv()
+		env.BindingsCrudServiceURL = "http://crud service\n"
+		err := env.Validate()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "BINDINGS_CRUD_SERVICE_URL: invalid url")
+
+		env = validEnv()
+		env.MongoDBUrl = "mongodb://%zz"
+		env.BindingsCollectionName = "bindings"
+		env.RolesCollectionName = "roles"
+		err = env.Validate()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "MONGODB_URL: invalid url")
+	})
+
+	t.Run("policies tests variables", func(t *testing.T) {
+		env := validEnv()
+		env.PoliciesTestDir = directory
+		env.PoliciesTestFixturesPath = filePath
+		require.NoError(t, env.Validate())
+
+		env.PoliciesTestDir = filePath
+		env.PoliciesTestFixturesPath = directory
+		require.EqualError(t, env.Validate(), "invalid environment variables: POLICIES_TEST_DIR: "+filePath+" is not a directory; POLICIES_TEST_FIXTURES_PATH: "+directory+" is a directory")
+	})
+
+	t.Run("integer fields", func(t *testing.T) {
+		env := validEnv()
+		env.DelayShutdownSeconds = -1
+		require.EqualError(t, env.Validate(), "invalid environment variables: DELAY_SHUTDOWN_SECONDS: -1 must not be negative")
+
+		env = validEnv()
+		env.EvaluatorCacheMaxSize = -5
+		require.EqualError(t, env.Validate(), "invalid environment variables: EVALUATOR_CACHE_MAX_SIZE: -5 must not be negative")
+
+		env = validEnv()
+		env.ResponseBodyCacheSize = -1
+		require.EqualError(t, env.Validate(), "invalid environment variables: RESPONSE_BODY_CACHE_SIZE: -1 must not be negative")
+
+		env = validEnv()
+		env.DefaultRequestTimeoutMs = -1
+		require.EqualError(t, env.Validate(), "invalid environment variables: DEFAULT_REQUEST_TIMEOUT_MS: -1 must not be negative")
+
+		env = validEnv()
+		env.OPAMaxModuleDepth = -1
+		require.EqualError(t, env.Validate(), "invalid environment variables: OPA_MAX_MODULE_DEPTH: -1 must not be negative")
+
+		env = validEnv()
+		env.RequestsPerSecond = -0.5
+		env.Burst = -1
+		require.EqualError(t, env.Validate(), "invalid environment variables: REQUESTS_PER_SECOND: -0.5 must not be negative; BURST: -1 must not be negative")
+
+		env = validEnv()
+		env.UpstreamRetryMaxAttempts = 0
+		require.NoError(t, env.Validate())
+		env.UpstreamRetryOn5xx = true
+		require.EqualError(t, env.Validate(), "invalid environment variables: UPSTREAM_RETRY_MAX_ATTEMPTS: 0 must be at least 1 when UPSTREAM_RETRY_ON_5XX is enabled")
+	})
+
+	t.Run("circuit breaker variables", func(t *testing.T) {
+		env := validEnv()
+		env.CircuitBreakerConsecutiveFailures = -1
+		require.EqualError(t, env.Validate(), "invalid environment variables: CIRCUIT_BREAKER_CONSECUTIVE_FAILURES: -1 must not be negative")
+
+		env = validEnv()
+		env.CircuitBreakerFailureRatio = 1.5
+		env.CircuitBreakerWindowSize = 20
+		env.CircuitBreakerOpenDurationMs = 30000
+		require.EqualError(t, env.Validate(), "invalid environment variables: CIRCUIT_BREAKER_FAILURE_RATIO: 1.5 must be between 0 and 1")
+
+		env = validEnv()
+		env.CircuitBreakerFailureRatio = 0.5
+		require.EqualError(t, env.Validate(), "invalid environment variables: CIRCUIT_BREAKER_WINDOW_SIZE: 0 must be at least 1 when CIRCUIT_BREAKER_FAILURE_RATIO is set; CIRCUIT_BREAKER_OPEN_DURATION_MS: 0 must be at least 1 when the circuit breaker is enabled")
+
+		env.CircuitBreakerWindowSize = 20
+		env.CircuitBreakerOpenDurationMs = 30000
+		require.NoError(t, env.Validate())
+	})
+
+	t.Run("path rewrite variables", func(t *testing.T) {
+		env := validEnv()
+		env.PathRewriteFrom = "/api/v1"
+		env.PathRewriteTo = "/v1"
+		require.NoError(t, env.Validate())
+
+		env.PathRewriteTo = ""
+		require.NoError(t, env.Validate())
+
+		env.PathRewriteFrom = "api"
+		env.PathRewriteTo = "v1"
+		require.EqualError(t, env.Validate(), "invalid environment variables: PATH_REWRITE_FROM: api must start with /; PATH_REWRITE_TO: v1 must start with /")
+
+		env.PathRewriteFrom = ""
+		env.PathRewriteTo = "/v1"
+		require.EqualError(t, env.Validate(), "invalid environment variables: PATH_REWRITE_TO: requires PATH_REWRITE_FROM to be set")
+	})
+
+	t.Run("consul variables", func(t *testing.T) {
+		env := validEnv()
+		env.ConsulAddress = "http://consul:8500"
+		env.ConsulServiceName = "my-service"
+		env.ConsulRefreshInterval = 30
+		require.NoError(t, env.Validate())
+
+		env.ConsulAddress = "http://consul:port"
+		env.ConsulServiceName = ""
+		env.ConsulRefreshInterval = 0
+		require.EqualError(t, env.Validate(), "invalid environment variables: CONSUL_ADDRESS: invalid url: parse \"http://consul:port\": invalid port \":port\" after host; CONSUL_SERVICE_NAME: must be set when CONSUL_ADDRESS is set; CONSUL_REFRESH_INTERVAL_SECONDS: 0 must be at least 1 when CONSUL_ADDRESS is set")
+	})
+
+	t.Run("OAS refresh interval", func(t *testing.T) {
+		env := validEnv()
+		env.TargetServiceOASPath = "/documentation/json"
+		env.OASRefreshInterval = 60
+		require.NoError(t, env.Validate())
+
+		env.OASRefreshInterval = -1
+		require.EqualError(t, env.Validate(), "invalid environment variables: OAS_REFRESH_INTERVAL_SECONDS: -1 must not be negative")
+
+		env.OASRefreshInterval = 60
+		env.TargetServiceOASPath = ""
+		env.APIPermissionsFilePath = filePath
+		require.EqualError(t, env.Validate(), "invalid environment variables: OAS_REFRESH_INTERVAL_SECONDS: requires the OAS to be fetched from TARGET_SERVICE_OAS_PATH")
+	})
+
+	t.Run("MongoDB variables", func(t *testing.T) {
+		env := validEnv()
+		env.MongoSocketTimeoutMs = -1
+		require.EqualError(t, env.Validate(), "invalid environment variables: MONGO_SOCKET_TIMEOUT_MS: -1 must not be negative")
+
+		env = validEnv()
+		env.MongoMinPoolSize = 20
+		env.MongoMaxPoolSize = 10
+		require.EqualError(t, env.Validate(), "invalid environment variables: MONGO_MIN_POOL_SIZE: 20 must not be greater than MONGO_MAX_POOL_SIZE 10")
+
+		env.MongoMaxPoolSize = 20
+		require.NoError(t, env.Validate())
+
+		env.MongoMaxPoolSize = 0
+		require.NoError(t, env.Validate(), "min pool size is not bounded with unlimited pool")
+
+		env = validEnv()
+		env.BindingsCollectionName = "bindings"
+		env.RolesCollectionName = "roles"
+		require.EqualError(t, env.Validate(), "invalid environment variables: BINDINGS_COLLECTION_NAME: requires MONGODB_URL to be set; ROLES_COLLECTION_NAME: requires MONGODB_URL to be set")
+
+		env = validEnv()
+		env.MongoDBUrl = "mongodb://localhost:27017/db"
+		require.EqualError(t, env.Validate(), "invalid environment variables: BINDINGS_COLLECTION_NAME: is required when MONGODB_URL is set; ROLES_COLLECTION_NAME: is required when MONGODB_URL is set")
+	})
+
+	t.Run("policy trace variables", func(t *testing.T) {
+		env := validEnv()
+		env.PolicyTraceHeaderKey = "x-rond-trace"
+		require.EqualError(t, env.Validate(), "invalid environment variables: POLICY_TRACE_SECRET: is required when POLICY_TRACE_HEADER_KEY is set")
+
+		env.PolicyTraceSecret = "some-secret"
+		require.NoError(t, env.Validate())
+	})
+
+	t.Run("OPA capabilities file", func(t *testing.T) {
+		env := validEnv()
+		env.OPACapabilitiesPath = filepath.Join(t.TempDir(), "missing.json")
+		err := env.Validate()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "OPA_CAPABILITIES_PATH")
+	})
+
+	t.Run("user signature variables", func(t *testing.T) {
+		env := validEnv()
+		env.UserSignatureSecondarySecret = "old-secret"
+		require.EqualError(t, env.Validate(), "invalid environment variables: USER_SIGNATURE_SECRET: is required when USER_SIGNATURE_SECONDARY_SECRET is set")
+
+		env.UserSignatureSecret = "new-secret"
+		require.NoError(t, env.Validate())
+	})
+
+	t.Run("JWT verification variables", func(t *testing.T) {
+		env := validEnv()
+		env.UserIDSources = []UserIDSource{{Type: UserIDSourceHeader}, {Type: UserIDSourceJWTClaim}}
+		require.EqualError(t, env.Validate(), "invalid environment variables: JWT_VERIFICATION_KEY: is required by the jwt_claim user id source unless JWT_VERIFIED_UPSTREAM is set to true")
+
+		env.JWTVerificationKey = "https://auth.example.com/.well-known/jwks.json"
+		require.NoError(t, env.Validate())
+
+		env.JWTVerificationKey = ""
+		env.JWTVerifiedUpstream = true
+		require.NoError(t, env.Validate())
+
+		env = validEnv()
+		env.ParseJWTInput = true
+		require.EqualError(t, env.Validate(), "invalid environment variables: JWT_VERIFICATION_KEY: is required by PARSE_JWT_INPUT unless JWT_VERIFIED_UPSTREAM is set to true")
+
+		env.JWTVerificationKey = "my-secret"
+		require.NoError(t, env.Validate())
+	})
+
+	t.Run("OAS fetch variables", func(t *testing.T) {
+		env := validEnv()
+		env.OASFetchMaxRetries = -1
+		env.OASFetchBackoffMs = -1
+		require.EqualError(t, env.Validate(), "invalid environment variables: OAS_FETCH_MAX_RETRIES: -1 must not be negative; OAS_FETCH_BACKOFF_MS: -1 must not be negative")
+
+		env = validEnv()
+		env.OASCachePath = "/tmp/oas.json"
+		env.TargetServiceOASPath = ""
+		env.APIPermissionsFilePath = filePath
+		require.EqualError(t, env.Validate(), "invalid environment variables: OAS_CACHE_PATH: requires the OAS to be fetched from TARGET_SERVICE_OAS_PATH")
+
+		env = validEnv()
+		env.OASCachePath = "/tmp/oas.json"
+		require.EqualError(t, env.Validate(), "invalid environment variables: OAS_CACHE_PATH: requires OAS_FETCH_MAX_RETRIES to be greater than 0")
+
+		env.OASFetchMaxRetries = 3
+		require.NoError(t, env.Validate())
+	})
+
+	t.Run("policy diff variables", func(t *testing.T) {
+		env := validEnv()
+		env.PolicyDiffRecordedInputs = 100
+		require.EqualError(t, env.Validate(), "invalid environment variables: POLICY_DIFF_SECRET: is required when POLICY_DIFF_RECORDED_INPUTS is set")
+
+		env.PolicyDiffSecret = "some-secret"
+		require.NoError(t, env.Validate())
+
+		env.PolicyDiffRecordedInputs = -1
+		require.ErrorContains(t, env.Validate(), "POLICY_DIFF_RECORDED_INPUTS")
+	})
+
+	t.Run("service mode", func(t *testing.T) {
+		env := validEnv()
+		env.TargetServiceHost = ""
+		env.TargetServiceOASPath = ""
+		env.APIPermissionsFilePath = filePath
+		require.EqualError(t, env.Validate(), "invalid environment variables: TARGET_SERVICE_HOST: is required unless STANDALONE is set to true")
+
+		env.Standalone = true
+		require.EqualError(t, env.Validate(), "invalid environment variables: STANDALONE: requires one of BINDINGS_CRUD_SERVICE_URL or MONGODB_URL to be set")
+
+		env.BindingsCrudServiceURL = "http://crud-service/bindings"
+		require.NoError(t, env.Validate())
+
+		env.StandaloneGRPC = true
+		env.GRPCPort = "8080"
+		require.EqualError(t, env.Validate(), "invalid environment variables: GRPC_PORT: must differ from the HTTP port 8080")
+		env.GRPCPort = "9090"
+		require.NoError(t, env.Validate())
+		env.Standalone = false
+		env.TargetServiceHost = "localhost:3000"
+		require.EqualError(t, env.Validate(), "invalid environment variables: STANDALONE_GRPC: requires STANDALONE to be set to true")
+
+		env = validEnv()
+		env.TargetServiceHost = ""
+		env.TargetServiceOASPath = ""
+		env.PoliciesTestDir = directory
+		require.NoError(t, env.Validate(), "policies tests mode does not need the target service and the OAS")
+	})
+
+	t.Run("OAS source", func(t *testing.T) {
+		env := validEnv()
+		env.TargetServiceOASPath = ""
+		require.EqualError(t, env.Validate(), "invalid environment variables: API_PERMISSIONS_FILE_PATH: one of API_PERMISSIONS_FILE_PATH or TARGET_SERVICE_OAS_PATH is required")
+
+		env = validEnv()
+		env.APIPermissionsFilePath = filePath
+		require.NoError(t, env.Validate(), "the permissions file takes precedence over the OAS path")
+
+		env.StrictOASSource = true
+		require.EqualError(t, env.Validate(), "invalid environment variables: API_PERMISSIONS_FILE_PATH: must not be set together with TARGET_SERVICE_OAS_PATH when STRICT_OAS_SOURCE is set to true")
+
+		env = validEnv()
+		env.TargetServiceHost = ""
+		env.Standalone = true
+		env.BindingsCrudServiceURL = "http://crud-service/bindings"
+		require.EqualError(t, env.Validate(), "invalid environment variables: TARGET_SERVICE_OAS_PATH: requires TARGET_SERVICE_HOST to be set")
+
+		env.TargetServiceOASPath = "file://" + filePath
+		require.NoError(t, env.Validate())
+
+		env.OASRefreshInterval = 60
+		env.OASCachePath = "/tmp/oas.json"
+		require.EqualError(t, env.Validate(), "invalid environment variables: OAS_REFRESH_INTERVAL_SECONDS: requires the OAS to be fetched from TARGET_SERVICE_OAS_PATH; OAS_CACHE_PATH: requires the OAS to be fetched from TARGET_SERVICE_OAS_PATH")
+	})
+
+	t.Run("reports all the errors", func(t *testing.T) {
+		env := validEnv()
+		env.HTTPPort = "0"
+		env.DelayShutdownSeconds = -1
+		require.EqualError(t, env.Validate(), "invalid environment variables: HTTP_PORT: 0 is not in range 1-65535; DELAY_SHUTDOWN_SECONDS: -1 must not be negative")
+
+		var validationErrors ValidationErrors
+		require.True(t, errors.As(env.Validate(), &validationErrors))
+		require.Len(t, validationErrors, 2)
+		require.Equal(t, "HTTP_PORT", validationErrors[0].Key)
+		require.EqualError(t, validationErrors[0].Err, "0 is not in range 1-65535")
+		require.Equal(t, "DELAY_SHUTDOWN_SECONDS", validationErrors[1].Key)
+	})
+}
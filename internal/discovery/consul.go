@@ -0,0 +1,189 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const consulRequestTimeout = 5 * time.Second
+
+type consulServiceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+	} `json:"Service"`
+}
+
+// ConsulResolver resolves the target service host from the passing instances registered in
+// Consul. Until an instance is resolved, or whenever Consul is unavailable, the fallback host
+// is used.
+type ConsulResolver struct {
+	httpClient   *http.Client
+	healthURL    string
+	serviceName  string
+	fallbackHost string
+	logger       *logrus.Entry
+
+	host atomic.Value
+}
+
+// NewConsulResolver creates a resolver of the service registered in the Consul agent at
+// consulAddress.
+func NewConsulResolver(logger *logrus.Entry, consulAddress, serviceName, fallbackHost string) *ConsulResolver {
+	resolver := &ConsulResolver{
+		httpClient:   &http.Client{Timeout: consulRequestTimeout},
+		healthURL:    fmt.Sprintf("%s/v1/health/service/%s?passing=true", strings.TrimSuffix(consulAddress, "/"), url.PathEscape(serviceName)),
+		serviceName:  serviceName,
+		fallbackHost: fallbackHost,
+		logger:       logger,
+	}
+	resolver.host.Store(fallbackHost)
+	return resolver
+}
+
+// Host returns the last resolved host of the target service.
+func (r *ConsulResolver) Host() string {
+	return r.host.Load().(string)
+}
+
+// Refresh queries Consul for the passing instances of the service and stores the host of the
+// first one. On failure the fallback host is restored and the error is returned.
+func (r *ConsulResolver) Refresh(ctx context.Context) error {
+	host, err := r.resolve(ctx)
+	if err != nil {
+		r.host.Store(r.fallbackHost)
+		return err
+	}
+	r.host.Store(host)
+	return nil
+}
+
+// Start resolves the host and keeps it refreshed every interval until the context is done.
+func (r *ConsulResolver) Start(ctx context.Context, interval time.Duration) {
+	r.refreshAndLog(ctx)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.refreshAndLog(ctx)
+			}
+		}
+	}()
+}
+
+func (r *ConsulResolver) refreshAndLog(ctx context.Context) {
+	previousHost := r.Host()
+	if err := r.Refresh(ctx); err != nil {
+		r.logger.WithFields(logrus.Fields{
+			"error":        logrus.Fields{"message": err.Error()},
+			"serviceName":  r.serviceName,
+			"fallbackHost": r.fallbackHost,
+		}).Warn("consul service resolution failed, using fallback host")
+		return
+	}
+	if host := r.Host(); host != previousHost {
+		r.logger.WithFields(logrus.Fields{
+			"serviceName": r.serviceName,
+			"host":        host,
+		}).Info("target service host resolved from consul")
+	}
+}
+
+func (r *ConsulResolver) resolve(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.healthURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("consul responded with status code %d", resp.StatusCode)
+	}
+
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return "", fmt.Errorf("failed consul response decode: %s", err.Error())
+	}
+	if len(entries) == 0 {
+		return "", fmt.Errorf("no passing instances of service %s", r.serviceName)
+	}
+
+	address := entries[0].Service.Address
+	if address == "" {
+		address = entries[0].Node.Address
+	}
+	return net.JoinHostPort(address, strconv.Itoa(entries[0].Service.Port)), nil
+}
+
+type resolverKey struct{}
+
+// WithResolver stores the target service host resolver in the context.
+func WithResolver(ctx context.Context, resolver *ConsulResolver) context.Context {
+	return context.WithValue(ctx, resolverKey{}, resolver)
+}
+
+// TargetHost returns the target service host resolved by the resolver stored in the context,
+// false is returned when no resolver is set.
+func TargetHost(ctx context.Context) (string, bool) {
+	resolver, ok := ctx.Value(resolverKey{}).(*ConsulResolver)
+	if !ok || resolver == nil {
+		return "", false
+	}
+	return resolver.Host(), true
+}
+
+// ResolvedHost returns the host resolved by the resolver stored in the context for the requests
+// directed to host, false is returned when no resolver is set or host is not the one of the
+// resolved service, such as the hosts of the upstream routes.
+func ResolvedHost(ctx context.Context, host string) (string, bool) {
+	resolver, ok := ctx.Value(resolverKey{}).(*ConsulResolver)
+	if !ok || resolver == nil || host != resolver.fallbackHost {
+		return "", false
+	}
+	return resolver.Host(), true
+}
+
+// ResolverInjectorMiddleware is a gorilla/mux middleware used to inject the target service
+// host resolver into requests.
+func ResolverInjectorMiddleware(resolver *ConsulResolver) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(WithResolver(r.Context(), resolver)))
+		})
+	}
+}
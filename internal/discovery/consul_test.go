@@ -0,0 +1,163 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/h2non/gock.v1"
+)
+
+const consulAddress = "http://consul.example.org:8500"
+
+func mockConsulService(address string, port int) *gock.Response {
+	return mockConsulServiceRequest(gock.New(consulAddress), address, port)
+}
+
+func mockConsulServiceRequest(request *gock.Request, address string, port int) *gock.Response {
+	return request.
+		Get("/v1/health/service/my-service").
+		MatchParam("passing", "true").
+		Reply(http.StatusOK).
+		JSON([]map[string]interface{}{
+			{
+				"Node":    map[string]interface{}{"Address": "10.0.0.1"},
+				"Service": map[string]interface{}{"Address": address, "Port": port},
+			},
+		})
+}
+
+func TestConsulResolver(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	log := logrus.NewEntry(logger)
+
+	t.Run("uses the fallback host before resolution", func(t *testing.T) {
+		resolver := NewConsulResolver(log, consulAddress, "my-service", "fallback:3000")
+		require.Equal(t, "fallback:3000", resolver.Host())
+	})
+
+	t.Run("resolved address changes with the consul response", func(t *testing.T) {
+		defer gock.Off()
+		resolver := NewConsulResolver(log, consulAddress, "my-service", "fallback:3000")
+
+		mockConsulService("10.0.0.2", 8080)
+		require.NoError(t, resolver.Refresh(context.Background()))
+		require.Equal(t, "10.0.0.2:8080", resolver.Host())
+
+		mockConsulService("10.0.0.3", 9090)
+		require.NoError(t, resolver.Refresh(context.Background()))
+		require.Equal(t, "10.0.0.3:9090", resolver.Host())
+		require.True(t, gock.IsDone())
+	})
+
+	t.Run("uses the node address when the service has none", func(t *testing.T) {
+		defer gock.Off()
+		resolver := NewConsulResolver(log, consulAddress, "my-service", "fallback:3000")
+
+		mockConsulService("", 8080)
+		require.NoError(t, resolver.Refresh(context.Background()))
+		require.Equal(t, "10.0.0.1:8080", resolver.Host())
+	})
+
+	t.Run("falls back when consul is unavailable", func(t *testing.T) {
+		defer gock.Off()
+		resolver := NewConsulResolver(log, consulAddress, "my-service", "fallback:3000")
+
+		mockConsulService("10.0.0.2", 8080)
+		require.NoError(t, resolver.Refresh(context.Background()))
+		require.Equal(t, "10.0.0.2:8080", resolver.Host())
+
+		gock.New(consulAddress).Get("/v1/health/service/my-service").Reply(http.StatusInternalServerError)
+		err := resolver.Refresh(context.Background())
+		require.EqualError(t, err, "consul responded with status code 500")
+		require.Equal(t, "fallback:3000", resolver.Host())
+	})
+
+	t.Run("falls back without passing instances", func(t *testing.T) {
+		defer gock.Off()
+		resolver := NewConsulResolver(log, consulAddress, "my-service", "fallback:3000")
+
+		gock.New(consulAddress).Get("/v1/health/service/my-service").Reply(http.StatusOK).JSON([]interface{}{})
+		err := resolver.Refresh(context.Background())
+		require.EqualError(t, err, "no passing instances of service my-service")
+		require.Equal(t, "fallback:3000", resolver.Host())
+	})
+
+	t.Run("start refreshes the host periodically", func(t *testing.T) {
+		defer gock.Off()
+		resolver := NewConsulResolver(log, consulAddress, "my-service", "fallback:3000")
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		mockConsulService("10.0.0.2", 8080)
+		mockConsulServiceRequest(gock.New(consulAddress).Persist(), "10.0.0.3", 9090)
+		resolver.Start(ctx, 10*time.Millisecond)
+		require.Equal(t, "10.0.0.2:8080", resolver.Host())
+		require.Eventually(t, func() bool {
+			return resolver.Host() == "10.0.0.3:9090"
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestTargetHost(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+
+	t.Run("without resolver", func(t *testing.T) {
+		_, ok := TargetHost(context.Background())
+		require.False(t, ok)
+	})
+
+	t.Run("injected by the middleware", func(t *testing.T) {
+		resolver := NewConsulResolver(logrus.NewEntry(logger), consulAddress, "my-service", "fallback:3000")
+		var host string
+		handler := ResolverInjectorMiddleware(resolver)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var ok bool
+			host, ok = TargetHost(r.Context())
+			require.True(t, ok)
+		}))
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, "fallback:3000", host)
+	})
+}
+
+func TestResolvedHost(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	resolver := NewConsulResolver(logrus.NewEntry(logger), consulAddress, "my-service", "fallback:3000")
+	ctx := WithResolver(context.Background(), resolver)
+
+	t.Run("without resolver", func(t *testing.T) {
+		_, ok := ResolvedHost(context.Background(), "fallback:3000")
+		require.False(t, ok)
+	})
+
+	t.Run("resolves the host of the service", func(t *testing.T) {
+		host, ok := ResolvedHost(ctx, "fallback:3000")
+		require.True(t, ok)
+		require.Equal(t, "fallback:3000", host)
+	})
+
+	t.Run("ignores the other hosts", func(t *testing.T) {
+		_, ok := ResolvedHost(ctx, "other:8080")
+		require.False(t, ok)
+	})
+}
@@ -0,0 +1,124 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	jwksFetchTimeout   = 5 * time.Second
+	jwksMaxBodyBytes   = 1 << 20
+	jwksRefreshBackoff = 10 * time.Second
+)
+
+type cachedKeySet struct {
+	// jwks is the key set as served by the endpoint, in the format of the OPA cert constraint
+	jwks      string
+	kids      map[string]bool
+	fetchedAt time.Time
+}
+
+// jwksCache holds the key sets used to verify the tokens, shared by the whole process and
+// keyed by JWKS url. The key sets are fetched outside of the lock, the concurrent fetches of
+// the same key set being collapsed into one.
+type jwksCache struct {
+	mtx        sync.Mutex
+	httpClient *http.Client
+	keySets    map[string]cachedKeySet
+	fetches    singleflight.Group
+	// refreshBackoff is the minimum time between two fetches of the same key set,
+	// so that tokens with unknown kids can not be used to flood the JWKS endpoint.
+	refreshBackoff time.Duration
+}
+
+var defaultJWKSCache = newJWKSCache(&http.Client{Timeout: jwksFetchTimeout}, jwksRefreshBackoff)
+
+func newJWKSCache(httpClient *http.Client, refreshBackoff time.Duration) *jwksCache {
+	return &jwksCache{
+		httpClient:     httpClient,
+		keySets:        map[string]cachedKeySet{},
+		refreshBackoff: refreshBackoff,
+	}
+}
+
+// keySet returns the key set of jwksURL, fetching it again when kid is unknown.
+func (c *jwksCache) keySet(jwksURL, kid string) (string, error) {
+	c.mtx.Lock()
+	keySet, found := c.keySets[jwksURL]
+	c.mtx.Unlock()
+	if found && (kid == "" || keySet.kids[kid] || time.Since(keySet.fetchedAt) < c.refreshBackoff) {
+		return keySet.jwks, nil
+	}
+
+	fetched, err, _ := c.fetches.Do(jwksURL, func() (interface{}, error) {
+		keySet, err := c.fetch(jwksURL)
+		if err != nil {
+			return nil, err
+		}
+		c.mtx.Lock()
+		c.keySets[jwksURL] = keySet
+		c.mtx.Unlock()
+		return keySet, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fetched.(cachedKeySet).jwks, nil
+}
+
+// fetch retrieves the key set. The request is not bound to the context of the request
+// verifying the token, since the fetch is shared with the other requests waiting for it.
+func (c *jwksCache) fetch(jwksURL string) (cachedKeySet, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, jwksURL, nil)
+	if err != nil {
+		return cachedKeySet{}, fmt.Errorf("failed JWKS request creation: %s", err.Error())
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return cachedKeySet{}, fmt.Errorf("failed JWKS fetch: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return cachedKeySet{}, fmt.Errorf("failed JWKS fetch: unexpected status code %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, jwksMaxBodyBytes))
+	if err != nil {
+		return cachedKeySet{}, fmt.Errorf("failed JWKS fetch: %s", err.Error())
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &jwks); err != nil {
+		return cachedKeySet{}, fmt.Errorf("failed JWKS decode: %s", err.Error())
+	}
+
+	kids := make(map[string]bool, len(jwks.Keys))
+	for _, key := range jwks.Keys {
+		kids[key.Kid] = true
+	}
+	return cachedKeySet{jwks: string(body), kids: kids, fetchedAt: time.Now()}, nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/topdown"
+)
+
+var supportedAlgorithms = map[string]bool{
+	"HS256": true, "HS384": true, "HS512": true,
+	"RS256": true, "RS384": true, "RS512": true,
+	"PS256": true, "PS384": true, "PS512": true,
+	"ES256": true, "ES384": true, "ES512": true,
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify verifies the signature and the exp and nbf claims of the token and returns its
+// claims. jwksURLOrSecret is either the url of a JWKS, used for RS, PS and ES algorithms,
+// or the secret of HS algorithms. The verification is performed by the OPA io.jwt.decode_verify
+// builtin, the key sets being fetched and cached by rond.
+func Verify(token, jwksURLOrSecret string, now time.Time) (map[string]interface{}, error) {
+	return verify(defaultJWKSCache, token, jwksURLOrSecret, now)
+}
+
+func verify(cache *jwksCache, token, jwksURLOrSecret string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var tokenHeader header
+	if err := decodeSegment(parts[0], &tokenHeader); err != nil {
+		return nil, fmt.Errorf("invalid token header: %s", err.Error())
+	}
+	if !supportedAlgorithms[tokenHeader.Alg] {
+		return nil, fmt.Errorf("unsupported algorithm %s", tokenHeader.Alg)
+	}
+
+	constraints := ast.NewObject(ast.Item(ast.StringTerm("time"), ast.IntNumberTerm(int(now.UnixNano()))))
+	if isJWKSURL(jwksURLOrSecret) {
+		if strings.HasPrefix(tokenHeader.Alg, "HS") {
+			return nil, fmt.Errorf("algorithm %s can not be used with a JWKS", tokenHeader.Alg)
+		}
+		jwks, err := cache.keySet(jwksURLOrSecret, tokenHeader.Kid)
+		if err != nil {
+			return nil, err
+		}
+		constraints.Insert(ast.StringTerm("cert"), ast.StringTerm(jwks))
+	} else {
+		if jwksURLOrSecret == "" {
+			return nil, fmt.Errorf("empty secret")
+		}
+		if !strings.HasPrefix(tokenHeader.Alg, "HS") {
+			return nil, fmt.Errorf("algorithm %s can not be used with a secret", tokenHeader.Alg)
+		}
+		constraints.Insert(ast.StringTerm("secret"), ast.StringTerm(jwksURLOrSecret))
+	}
+
+	var result *ast.Array
+	err := topdown.GetBuiltin(ast.JWTDecodeVerify.Name)(
+		topdown.BuiltinContext{Context: context.Background()},
+		[]*ast.Term{ast.StringTerm(token), ast.NewTerm(constraints)},
+		func(term *ast.Term) error {
+			result, _ = term.Value.(*ast.Array)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %s", err.Error())
+	}
+	if result == nil || result.Len() != 3 || !result.Elem(0).Equal(ast.BooleanTerm(true)) {
+		return nil, fmt.Errorf("invalid token signature or time claims")
+	}
+
+	claims, err := ast.JSON(result.Elem(2).Value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token claims: %s", err.Error())
+	}
+	claimsObject, ok := claims.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid token claims")
+	}
+	return claimsObject, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(decoded))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+func isJWKSURL(jwksURLOrSecret string) bool {
+	return strings.HasPrefix(jwksURLOrSecret, "https://") || strings.HasPrefix(jwksURLOrSecret, "http://")
+}
@@ -0,0 +1,253 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rond-authz/rond/internal/testutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+type jwksServer struct {
+	*httptest.Server
+	keys    atomic.Value
+	fetches int32
+	delay   time.Duration
+}
+
+func newJWKSServer(t *testing.T, keys ...map[string]interface{}) *jwksServer {
+	t.Helper()
+	server := &jwksServer{}
+	server.setKeys(keys...)
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&server.fetches, 1)
+		time.Sleep(server.delay)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": server.keys.Load()})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *jwksServer) setKeys(keys ...map[string]interface{}) {
+	s.keys.Store(keys)
+}
+
+func (s *jwksServer) fetchCount() int {
+	return int(atomic.LoadInt32(&s.fetches))
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	claims := map[string]interface{}{
+		"sub": "secondary-user",
+		"exp": now.Add(time.Hour).Unix(),
+		"nbf": now.Add(-time.Hour).Unix(),
+	}
+	rs256Header := map[string]interface{}{"alg": "RS256", "kid": "rsa-key"}
+
+	t.Run("RS256 token verified with JWKS", func(t *testing.T) {
+		server := newJWKSServer(t, testutils.RSAJWK("rsa-key", &rsaKey.PublicKey))
+		cache := newJWKSCache(server.Client(), time.Minute)
+		token := testutils.SignJWT(t, rs256Header, claims, testutils.RS256Signer(t, rsaKey))
+
+		verifiedClaims, err := verify(cache, token, server.URL, now)
+		require.NoError(t, err)
+		require.Equal(t, "secondary-user", verifiedClaims["sub"])
+		require.Equal(t, json.Number("1700003600"), verifiedClaims["exp"])
+
+		_, err = verify(cache, token, server.URL, now)
+		require.NoError(t, err)
+		require.Equal(t, 1, server.fetchCount(), "JWKS should be cached")
+	})
+
+	t.Run("ES256 token verified with JWKS", func(t *testing.T) {
+		server := newJWKSServer(t, testutils.ECJWK("ec-key", &ecKey.PublicKey))
+		cache := newJWKSCache(server.Client(), time.Minute)
+		token := testutils.SignJWT(t, map[string]interface{}{"alg": "ES256", "kid": "ec-key"}, claims, testutils.ES256Signer(t, ecKey))
+
+		verifiedClaims, err := verify(cache, token, server.URL, now)
+		require.NoError(t, err)
+		require.Equal(t, "secondary-user", verifiedClaims["sub"])
+	})
+
+	t.Run("token without kid is verified with any key", func(t *testing.T) {
+		server := newJWKSServer(t, testutils.RSAJWK("other-key", &otherRSAKey.PublicKey), testutils.RSAJWK("rsa-key", &rsaKey.PublicKey))
+		cache := newJWKSCache(server.Client(), time.Minute)
+		token := testutils.SignJWT(t, map[string]interface{}{"alg": "RS256"}, claims, testutils.RS256Signer(t, rsaKey))
+
+		_, err := verify(cache, token, server.URL, now)
+		require.NoError(t, err)
+	})
+
+	t.Run("fails with invalid signature", func(t *testing.T) {
+		server := newJWKSServer(t, testutils.RSAJWK("rsa-key", &rsaKey.PublicKey))
+		cache := newJWKSCache(server.Client(), time.Minute)
+		token := testutils.SignJWT(t, rs256Header, claims, testutils.RS256Signer(t, otherRSAKey))
+
+		_, err := verify(cache, token, server.URL, now)
+		require.EqualError(t, err, "invalid token signature or time claims")
+	})
+
+	t.Run("fails with expired token", func(t *testing.T) {
+		server := newJWKSServer(t, testutils.RSAJWK("rsa-key", &rsaKey.PublicKey))
+		cache := newJWKSCache(server.Client(), time.Minute)
+		token := testutils.SignJWT(t, rs256Header, claims, testutils.RS256Signer(t, rsaKey))
+
+		_, err := verify(cache, token, server.URL, now.Add(2*time.Hour))
+		require.EqualError(t, err, "invalid token signature or time claims")
+	})
+
+	t.Run("fails with token not valid yet", func(t *testing.T) {
+		server := newJWKSServer(t, testutils.RSAJWK("rsa-key", &rsaKey.PublicKey))
+		cache := newJWKSCache(server.Client(), time.Minute)
+		token := testutils.SignJWT(t, rs256Header, claims, testutils.RS256Signer(t, rsaKey))
+
+		_, err := verify(cache, token, server.URL, now.Add(-2*time.Hour))
+		require.EqualError(t, err, "invalid token signature or time claims")
+	})
+
+	t.Run("unknown kid refreshes the JWKS", func(t *testing.T) {
+		server := newJWKSServer(t, testutils.RSAJWK("old-key", &otherRSAKey.PublicKey))
+		cache := newJWKSCache(server.Client(), 0)
+		oldToken := testutils.SignJWT(t, map[string]interface{}{"alg": "RS256", "kid": "old-key"}, claims, testutils.RS256Signer(t, otherRSAKey))
+		_, err := verify(cache, oldToken, server.URL, now)
+		require.NoError(t, err)
+
+		server.setKeys(testutils.RSAJWK("rsa-key", &rsaKey.PublicKey))
+		token := testutils.SignJWT(t, rs256Header, claims, testutils.RS256Signer(t, rsaKey))
+		_, err = verify(cache, token, server.URL, now)
+		require.NoError(t, err)
+		require.Equal(t, 2, server.fetchCount())
+	})
+
+	t.Run("unknown kid does not refresh the JWKS during backoff", func(t *testing.T) {
+		server := newJWKSServer(t, testutils.RSAJWK("rsa-key", &rsaKey.PublicKey))
+		cache := newJWKSCache(server.Client(), time.Minute)
+		token := testutils.SignJWT(t, rs256Header, claims, testutils.RS256Signer(t, rsaKey))
+		_, err := verify(cache, token, server.URL, now)
+		require.NoError(t, err)
+
+		unknownKidToken := testutils.SignJWT(t, map[string]interface{}{"alg": "RS256", "kid": "unknown"}, claims, testutils.RS256Signer(t, otherRSAKey))
+		_, err = verify(cache, unknownKidToken, server.URL, now)
+		require.EqualError(t, err, "invalid token signature or time claims")
+		require.Equal(t, 1, server.fetchCount())
+	})
+
+	t.Run("concurrent verifications share a single fetch", func(t *testing.T) {
+		server := newJWKSServer(t, testutils.RSAJWK("rsa-key", &rsaKey.PublicKey))
+		server.delay = 50 * time.Millisecond
+		cache := newJWKSCache(server.Client(), time.Minute)
+		token := testutils.SignJWT(t, rs256Header, claims, testutils.RS256Signer(t, rsaKey))
+
+		var wg sync.WaitGroup
+		errs := make([]error, 10)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = verify(cache, token, server.URL, now)
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			require.NoError(t, err)
+		}
+		require.Equal(t, 1, server.fetchCount())
+	})
+
+	t.Run("a slow fetch does not block the cached key sets", func(t *testing.T) {
+		cachedServer := newJWKSServer(t, testutils.RSAJWK("rsa-key", &rsaKey.PublicKey))
+		slowServer := newJWKSServer(t, testutils.RSAJWK("rsa-key", &rsaKey.PublicKey))
+		slowServer.delay = time.Second
+		cache := newJWKSCache(&http.Client{}, time.Minute)
+		token := testutils.SignJWT(t, rs256Header, claims, testutils.RS256Signer(t, rsaKey))
+		_, err := verify(cache, token, cachedServer.URL, now)
+		require.NoError(t, err)
+
+		go verify(cache, token, slowServer.URL, now)
+		require.Eventually(t, func() bool { return slowServer.fetchCount() == 1 }, time.Second, time.Millisecond)
+
+		start := time.Now()
+		_, err = verify(cache, token, cachedServer.URL, now)
+		require.NoError(t, err)
+		require.Less(t, time.Since(start), 500*time.Millisecond)
+	})
+
+	t.Run("fails when JWKS endpoint does not answer in time", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+		}))
+		defer server.Close()
+		cache := newJWKSCache(&http.Client{Timeout: 20 * time.Millisecond}, time.Minute)
+		token := testutils.SignJWT(t, rs256Header, claims, testutils.RS256Signer(t, rsaKey))
+
+		_, err := verify(cache, token, server.URL, now)
+		require.ErrorContains(t, err, "failed JWKS fetch")
+	})
+
+	t.Run("HS256 token verified with secret", func(t *testing.T) {
+		token := testutils.SignJWT(t, map[string]interface{}{"alg": "HS256"}, claims, testutils.HS256Signer("my-secret"))
+
+		verifiedClaims, err := verify(nil, token, "my-secret", now)
+		require.NoError(t, err)
+		require.Equal(t, "secondary-user", verifiedClaims["sub"])
+
+		_, err = verify(nil, token, "other-secret", now)
+		require.EqualError(t, err, "invalid token signature or time claims")
+	})
+
+	t.Run("algorithms can not be mixed up", func(t *testing.T) {
+		server := newJWKSServer(t, testutils.RSAJWK("rsa-key", &rsaKey.PublicKey))
+		cache := newJWKSCache(server.Client(), time.Minute)
+
+		hsToken := testutils.SignJWT(t, map[string]interface{}{"alg": "HS256"}, claims, testutils.HS256Signer(server.URL))
+		_, err := verify(cache, hsToken, server.URL, now)
+		require.EqualError(t, err, "algorithm HS256 can not be used with a JWKS")
+
+		rsToken := testutils.SignJWT(t, rs256Header, claims, testutils.RS256Signer(t, rsaKey))
+		_, err = verify(cache, rsToken, "my-secret", now)
+		require.EqualError(t, err, "algorithm RS256 can not be used with a secret")
+
+		noneToken := testutils.EncodeJWTSegment(t, map[string]interface{}{"alg": "none"}) + "." + testutils.EncodeJWTSegment(t, claims) + "."
+		_, err = verify(cache, noneToken, server.URL, now)
+		require.EqualError(t, err, "unsupported algorithm none")
+	})
+
+	t.Run("fails with malformed token", func(t *testing.T) {
+		_, err := verify(nil, "not-a-token", "my-secret", now)
+		require.EqualError(t, err, "malformed token")
+	})
+}
@@ -21,8 +21,21 @@ import (
 
 type Metrics struct {
 	PolicyEvaluationDurationMilliseconds *prometheus.HistogramVec
+	ProxyInflightRequests                *prometheus.GaugeVec
+	PolicyLogOnlyDecisions               *prometheus.CounterVec
+	PolicyShadowDecisions                *prometheus.CounterVec
+	AllowedPathRequests                  *prometheus.CounterVec
+	ThrottledRequests                    *prometheus.CounterVec
+	RequestSizeBytes                     *prometheus.HistogramVec
+	ResponseSizeBytes                    *prometheus.HistogramVec
+	UpstreamDurationMilliseconds         *prometheus.HistogramVec
+	Panics                               *prometheus.CounterVec
+	PolicyModuleInfo                     *prometheus.GaugeVec
+	CircuitBreakerState                  *prometheus.GaugeVec
 }
 
+var sizeBuckets = prometheus.ExponentialBuckets(64, 4, 8)
+
 func SetupMetrics(prefix string) Metrics {
 	m := Metrics{
 		PolicyEvaluationDurationMilliseconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
@@ -31,6 +44,64 @@ func SetupMetrics(prefix string) Metrics {
 			Help:      "A histogram of the policy evaluation durations in milliseconds.",
 			Buckets:   []float64{1, 5, 10, 50, 100, 250, 500},
 		}, []string{"policy_name"}),
+		ProxyInflightRequests: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: prefix,
+			Name:      "proxy_inflight_requests",
+			Help:      "The number of requests currently proxied to the target service.",
+		}, []string{"http_method", "http_route"}),
+		PolicyLogOnlyDecisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Name:      "policy_log_only_decisions_total",
+			Help:      "A counter of the decisions taken by policies evaluated in log-only mode.",
+		}, []string{"policy_name", "allowed"}),
+		PolicyShadowDecisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Name:      "policy_shadow_decisions_total",
+			Help:      "A counter of the shadow policy evaluations, by whether their decision agrees with the request policy one.",
+		}, []string{"http_route", "policy_name", "shadow_policy", "outcome"}),
+		AllowedPathRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Name:      "allowed_path_requests_total",
+			Help:      "A counter of the requests proxied without policy evaluation, by allowed path pattern.",
+		}, []string{"pattern"}),
+		ThrottledRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Name:      "throttled_requests_total",
+			Help:      "A counter of the requests rejected by the rate limiter, by type of client key.",
+		}, []string{"key_type"}),
+		RequestSizeBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: prefix,
+			Name:      "request_size_bytes",
+			Help:      "A histogram of the body sizes of the requests proxied to the target service.",
+			Buckets:   sizeBuckets,
+		}, []string{"http_method", "http_route"}),
+		ResponseSizeBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: prefix,
+			Name:      "response_size_bytes",
+			Help:      "A histogram of the body sizes of the responses returned by the target service.",
+			Buckets:   sizeBuckets,
+		}, []string{"http_method", "http_route"}),
+		UpstreamDurationMilliseconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: prefix,
+			Name:      "upstream_duration_milliseconds",
+			Help:      "A histogram of the round-trip durations of the requests to the target service in milliseconds.",
+			Buckets:   []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000},
+		}, []string{"http_method", "http_route"}),
+		Panics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Name:      "panics_total",
+			Help:      "A counter of the panics recovered while serving requests, by matched route.",
+		}, []string{"http_route"}),
+		PolicyModuleInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: prefix,
+			Name:      "policy_module_info",
+			Help:      "The loaded rego module, labelled with its fingerprint, always set to 1.",
+		}, []string{"fingerprint"}),
+		CircuitBreakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: prefix,
+			Name:      "circuit_breaker_state",
+			Help:      "The state of the target service circuit breaker, set to 1 for the current state and 0 for the others.",
+		}, []string{"state"}),
 	}
 
 	return m
@@ -41,6 +112,17 @@ func (m Metrics) MustRegister(reg prometheus.Registerer) Metrics {
 		collectors.NewGoCollector(),
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 		m.PolicyEvaluationDurationMilliseconds,
+		m.ProxyInflightRequests,
+		m.PolicyLogOnlyDecisions,
+		m.PolicyShadowDecisions,
+		m.AllowedPathRequests,
+		m.ThrottledRequests,
+		m.RequestSizeBytes,
+		m.ResponseSizeBytes,
+		m.UpstreamDurationMilliseconds,
+		m.Panics,
+		m.PolicyModuleInfo,
+		m.CircuitBreakerState,
 	)
 
 	return m
@@ -51,5 +51,75 @@ func TestMetrics(t *testing.T) {
 
 			require.NoError(t, testutil.CollectAndCompare(m.PolicyEvaluationDurationMilliseconds, strings.NewReader(metadata+expected), "test_prefix_policy_evaluation_duration_milliseconds"))
 		})
+
+		t.Run("ProxyInflightRequests", func(t *testing.T) {
+			m.ProxyInflightRequests.WithLabelValues("GET", "/users/{id}").Inc()
+
+			metadata := `
+			# HELP test_prefix_proxy_inflight_requests The number of requests currently proxied to the target service.
+			# TYPE test_prefix_proxy_inflight_requests gauge
+`
+			expected := `
+			test_prefix_proxy_inflight_requests{http_method="GET",http_route="/users/{id}"} 1
+`
+
+			require.NoError(t, testutil.CollectAndCompare(m.ProxyInflightRequests, strings.NewReader(metadata+expected), "test_prefix_proxy_inflight_requests"))
+		})
+
+		t.Run("PolicyLogOnlyDecisions", func(t *testing.T) {
+			m.PolicyLogOnlyDecisions.WithLabelValues("myPolicyName", "false").Inc()
+
+			metadata := `
+			# HELP test_prefix_policy_log_only_decisions_total A counter of the decisions taken by policies evaluated in log-only mode.
+			# TYPE test_prefix_policy_log_only_decisions_total counter
+`
+			expected := `
+			test_prefix_policy_log_only_decisions_total{allowed="false",policy_name="myPolicyName"} 1
+`
+
+			require.NoError(t, testutil.CollectAndCompare(m.PolicyLogOnlyDecisions, strings.NewReader(metadata+expected), "test_prefix_policy_log_only_decisions_total"))
+		})
+
+		t.Run("PolicyShadowDecisions", func(t *testing.T) {
+			m.PolicyShadowDecisions.WithLabelValues("/users/{id}", "allow", "new_allow", "disagree").Inc()
+
+			metadata := `
+			# HELP test_prefix_policy_shadow_decisions_total A counter of the shadow policy evaluations, by whether their decision agrees with the request policy one.
+			# TYPE test_prefix_policy_shadow_decisions_total counter
+`
+			expected := `
+			test_prefix_policy_shadow_decisions_total{http_route="/users/{id}",outcome="disagree",policy_name="allow",shadow_policy="new_allow"} 1
+`
+
+			require.NoError(t, testutil.CollectAndCompare(m.PolicyShadowDecisions, strings.NewReader(metadata+expected), "test_prefix_policy_shadow_decisions_total"))
+		})
+
+		t.Run("PolicyModuleInfo", func(t *testing.T) {
+			m.PolicyModuleInfo.WithLabelValues("some-fingerprint").Set(1)
+
+			metadata := `
+			# HELP test_prefix_policy_module_info The loaded rego module, labelled with its fingerprint, always set to 1.
+			# TYPE test_prefix_policy_module_info gauge
+`
+			expected := `
+			test_prefix_policy_module_info{fingerprint="some-fingerprint"} 1
+`
+
+			require.NoError(t, testutil.CollectAndCompare(m.PolicyModuleInfo, strings.NewReader(metadata+expected), "test_prefix_policy_module_info"))
+		})
+
+		t.Run("CircuitBreakerState", func(t *testing.T) {
+			m.CircuitBreakerState.WithLabelValues("open").Set(1)
+
+			metadata := `
+			# HELP test_prefix_circuit_breaker_state The state of the target service circuit breaker, set to 1 for the current state and 0 for the others.
+			# TYPE test_prefix_circuit_breaker_state gauge
+`
+			expected := `
+			test_prefix_circuit_breaker_state{state="open"} 1
+`
+
+			require.NoError(t, testutil.CollectAndCompare(m.CircuitBreakerState, strings.NewReader(metadata+expected), "test_prefix_circuit_breaker_state"))
+		})
 	})
 }
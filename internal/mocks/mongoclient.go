@@ -26,16 +26,34 @@ type FindOneExpectation struct {
 }
 
 type MongoClientMock struct {
-	FindOneError        error
-	UserBindingsError   error
-	UserRolesError      error
-	FindOneResult       interface{}
-	FindManyError       error
-	FindOneExpectation  func(collectionName string, query interface{})
-	FindManyExpectation func(collectionName string, query interface{})
-	UserRoles           []types.Role
-	UserBindings        []types.Binding
-	FindManyResult      []interface{}
+	FindOneError             error
+	UserBindingsError        error
+	UserRolesError           error
+	FindOneResult            interface{}
+	FindManyError            error
+	FindOneExpectation       func(collectionName string, query interface{})
+	FindManyExpectation      func(collectionName string, query interface{})
+	FindAggregateError       error
+	FindAggregateExpectation func(collectionName string, pipeline interface{})
+	FindAggregateResult      []interface{}
+	UserRoles                []types.Role
+	UserBindings             []types.Binding
+	FindManyResult           []interface{}
+
+	FindBindingsResult                []types.Binding
+	FindBindingsError                 error
+	FindBindingsExpectation           func(filter map[string]interface{})
+	UpsertBindingError                error
+	UpsertBindingExpectation          func(binding types.Binding)
+	DeleteBindingsError               error
+	DeleteBindingsExpectation         func(bindingIDs []string)
+	UpdateBindingsSubjectsError       error
+	UpdateBindingsSubjectsExpectation func(bindings []types.Binding)
+	RetrieveUserBindingsExpectation   func(user *types.User)
+	RetrieveUserBindingsContext       func(ctx context.Context)
+	RetrieveUserRolesExpectation      func(userRolesId []string)
+	InsertAuditEntriesError           error
+	InsertAuditEntriesExpectation     func(entries []types.AuditEntry)
 }
 
 func (mongoClient MongoClientMock) Disconnect() error {
@@ -47,6 +65,12 @@ func (mongoClient MongoClientMock) RetrieveRoles(ctx context.Context) ([]types.R
 }
 
 func (mongoClient MongoClientMock) RetrieveUserBindings(ctx context.Context, user *types.User) ([]types.Binding, error) {
+	if mongoClient.RetrieveUserBindingsExpectation != nil {
+		mongoClient.RetrieveUserBindingsExpectation(user)
+	}
+	if mongoClient.RetrieveUserBindingsContext != nil {
+		mongoClient.RetrieveUserBindingsContext(ctx)
+	}
 	if mongoClient.UserBindings != nil {
 		return mongoClient.UserBindings, nil
 	}
@@ -54,6 +78,9 @@ func (mongoClient MongoClientMock) RetrieveUserBindings(ctx context.Context, use
 }
 
 func (mongoClient MongoClientMock) RetrieveUserRolesByRolesID(ctx context.Context, userRolesId []string) ([]types.Role, error) {
+	if mongoClient.RetrieveUserRolesExpectation != nil {
+		mongoClient.RetrieveUserRolesExpectation(userRolesId)
+	}
 	if mongoClient.UserRoles != nil {
 		return mongoClient.UserRoles, nil
 	}
@@ -77,3 +104,56 @@ func (mongoClient MongoClientMock) FindMany(ctx context.Context, collectionName
 
 	return mongoClient.FindManyResult, nil
 }
+
+func (mongoClient MongoClientMock) FindAggregate(ctx context.Context, collectionName string, pipeline []interface{}) ([]interface{}, error) {
+	mongoClient.FindAggregateExpectation(collectionName, pipeline)
+	if mongoClient.FindAggregateError != nil {
+		return nil, mongoClient.FindAggregateError
+	}
+
+	return mongoClient.FindAggregateResult, nil
+}
+
+func (mongoClient MongoClientMock) FindBindings(ctx context.Context, filter map[string]interface{}) ([]types.Binding, error) {
+	if mongoClient.FindBindingsExpectation != nil {
+		mongoClient.FindBindingsExpectation(filter)
+	}
+	if mongoClient.FindBindingsError != nil {
+		return nil, mongoClient.FindBindingsError
+	}
+	return mongoClient.FindBindingsResult, nil
+}
+
+func (mongoClient MongoClientMock) UpsertBinding(ctx context.Context, binding types.Binding) error {
+	if mongoClient.UpsertBindingExpectation != nil {
+		mongoClient.UpsertBindingExpectation(binding)
+	}
+	return mongoClient.UpsertBindingError
+}
+
+func (mongoClient MongoClientMock) DeleteBindings(ctx context.Context, bindingIDs []string) (int64, error) {
+	if mongoClient.DeleteBindingsExpectation != nil {
+		mongoClient.DeleteBindingsExpectation(bindingIDs)
+	}
+	if mongoClient.DeleteBindingsError != nil {
+		return 0, mongoClient.DeleteBindingsError
+	}
+	return int64(len(bindingIDs)), nil
+}
+
+func (mongoClient MongoClientMock) UpdateBindingsSubjects(ctx context.Context, bindings []types.Binding) (int64, error) {
+	if mongoClient.UpdateBindingsSubjectsExpectation != nil {
+		mongoClient.UpdateBindingsSubjectsExpectation(bindings)
+	}
+	if mongoClient.UpdateBindingsSubjectsError != nil {
+		return 0, mongoClient.UpdateBindingsSubjectsError
+	}
+	return int64(len(bindings)), nil
+}
+
+func (mongoClient MongoClientMock) InsertAuditEntries(ctx context.Context, entries []types.AuditEntry) error {
+	if mongoClient.InsertAuditEntriesExpectation != nil {
+		mongoClient.InsertAuditEntriesExpectation(entries)
+	}
+	return mongoClient.InsertAuditEntriesError
+}
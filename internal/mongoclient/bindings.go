@@ -0,0 +1,104 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongoclient
+
+import (
+	"context"
+
+	"github.com/rond-authz/rond/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FindBindings returns the public bindings matching the filter.
+func (mongoClient *MongoClient) FindBindings(ctx context.Context, filter map[string]interface{}) ([]types.Binding, error) {
+	mongoClient.mu.RLock()
+	defer mongoClient.mu.RUnlock()
+	cursor, err := mongoClient.bindings.Find(ctx, bson.M{
+		"$and": []interface{}{filter, bson.M{STATE: PUBLIC}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	bindingsResult := make([]types.Binding, 0)
+	if err = cursor.All(ctx, &bindingsResult); err != nil {
+		return nil, err
+	}
+	return bindingsResult, nil
+}
+
+// UpsertBinding creates the binding as public, replacing the one with the same bindingId if any.
+func (mongoClient *MongoClient) UpsertBinding(ctx context.Context, binding types.Binding) error {
+	mongoClient.mu.RLock()
+	defer mongoClient.mu.RUnlock()
+	binding.CRUDDocumentState = PUBLIC
+	_, err := mongoClient.bindings.ReplaceOne(
+		ctx,
+		bson.M{"bindingId": binding.BindingID},
+		binding,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// DeleteBindings deletes the bindings with the given ids, returning the number of deleted bindings.
+func (mongoClient *MongoClient) DeleteBindings(ctx context.Context, bindingIDs []string) (int64, error) {
+	mongoClient.mu.RLock()
+	defer mongoClient.mu.RUnlock()
+	result, err := mongoClient.bindings.DeleteMany(ctx, bson.M{"bindingId": bson.M{"$in": bindingIDs}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// InsertAuditEntries writes the audit entries of the bindings changes. Nothing is written if the
+// audit collection is not configured.
+func (mongoClient *MongoClient) InsertAuditEntries(ctx context.Context, entries []types.AuditEntry) error {
+	mongoClient.mu.RLock()
+	defer mongoClient.mu.RUnlock()
+	if mongoClient.audit == nil || len(entries) == 0 {
+		return nil
+	}
+	documents := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		documents = append(documents, entry)
+	}
+	_, err := mongoClient.audit.InsertMany(ctx, documents)
+	return err
+}
+
+// UpdateBindingsSubjects sets the subjects and groups of the given bindings, returning the
+// number of modified bindings.
+func (mongoClient *MongoClient) UpdateBindingsSubjects(ctx context.Context, bindings []types.Binding) (int64, error) {
+	mongoClient.mu.RLock()
+	defer mongoClient.mu.RUnlock()
+	if len(bindings) == 0 {
+		return 0, nil
+	}
+	updates := make([]mongo.WriteModel, 0, len(bindings))
+	for _, binding := range bindings {
+		updates = append(updates, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"bindingId": binding.BindingID}).
+			SetUpdate(bson.M{"$set": bson.M{"subjects": binding.Subjects, "groups": binding.Groups}}),
+		)
+	}
+	result, err := mongoClient.bindings.BulkWrite(ctx, updates)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongoclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/testutils"
+	"github.com/rond-authz/rond/types"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMongoBindingsWrites(t *testing.T) {
+	mongoHost := os.Getenv("MONGO_HOST_CI")
+	if mongoHost == "" {
+		mongoHost = testutils.LocalhostMongoDB
+		t.Logf("Connection to localhost MongoDB, on CI env this is a problem!")
+	}
+
+	env := config.EnvironmentVariables{
+		MongoDBUrl:             fmt.Sprintf("mongodb://%s/test", mongoHost),
+		RolesCollectionName:    "roles",
+		BindingsCollectionName: "bindings",
+	}
+
+	log, _ := test.NewNullLogger()
+	mongoClient, err := NewMongoClient(env, log)
+	require.NoError(t, err, "setup mongo returns error")
+	defer mongoClient.Disconnect()
+
+	client, _, rolesCollection, bindingsCollection := testutils.GetAndDisposeTestClientsAndCollections(t)
+	mongoClient.client = client
+	mongoClient.roles = rolesCollection
+	mongoClient.bindings = bindingsCollection
+
+	ctx := context.Background()
+
+	t.Run("upserts, updates and deletes bindings", func(t *testing.T) {
+		binding := types.Binding{
+			BindingID: "standalone-binding",
+			Subjects:  []string{"piero", "ignazio"},
+			Roles:     []string{"editor"},
+			Resource:  &types.Resource{ResourceType: "project", ResourceID: "projectID"},
+		}
+		require.NoError(t, mongoClient.UpsertBinding(ctx, binding))
+		require.NoError(t, mongoClient.UpsertBinding(ctx, binding))
+
+		filter := map[string]interface{}{"subjects": map[string]interface{}{"$in": []string{"piero"}}}
+		bindings, err := mongoClient.FindBindings(ctx, filter)
+		require.NoError(t, err)
+		binding.CRUDDocumentState = PUBLIC
+		require.Equal(t, []types.Binding{binding}, bindings)
+
+		binding.Subjects = []string{"ignazio"}
+		modified, err := mongoClient.UpdateBindingsSubjects(ctx, []types.Binding{binding})
+		require.NoError(t, err)
+		require.Equal(t, int64(1), modified)
+
+		bindings, err = mongoClient.FindBindings(ctx, filter)
+		require.NoError(t, err)
+		require.Empty(t, bindings)
+
+		deleted, err := mongoClient.DeleteBindings(ctx, []string{binding.BindingID})
+		require.NoError(t, err)
+		require.Equal(t, int64(1), deleted)
+	})
+
+	t.Run("audit entries are skipped without audit collection", func(t *testing.T) {
+		require.NoError(t, mongoClient.InsertAuditEntries(ctx, []types.AuditEntry{{Operation: types.AuditOperationGrant}}))
+	})
+
+	t.Run("inserts audit entries", func(t *testing.T) {
+		mongoClient.audit = bindingsCollection.Database().Collection("bindings_audit")
+		defer mongoClient.audit.Drop(ctx)
+
+		binding := types.Binding{BindingID: "audited-binding", Subjects: []string{"piero"}}
+		entry := types.AuditEntry{
+			Operation:     types.AuditOperationGrant,
+			Actor:         "the-actor",
+			After:         &binding,
+			Timestamp:     time.Now().UTC().Truncate(time.Millisecond),
+			CorrelationID: "request-id",
+		}
+		require.NoError(t, mongoClient.InsertAuditEntries(ctx, []types.AuditEntry{entry}))
+
+		var stored types.AuditEntry
+		require.NoError(t, mongoClient.audit.FindOne(ctx, bson.M{"correlationId": "request-id"}).Decode(&stored))
+		require.Equal(t, entry, stored)
+	})
+}
@@ -0,0 +1,504 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongoclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/rond-authz/rond/internal/utils"
+	"github.com/rond-authz/rond/types"
+)
+
+// FixtureMongoClient serves the documents of a fixtures file in place of MongoDB, so that
+// the policies using the mongo builtins can be tested without a database.
+// The fixtures file is a JSON object mapping each collection name to its documents.
+//
+// Queries support field equality, dotted paths and the $eq, $ne, $in, $nin, $exists,
+// $and and $or operators. Aggregations support the $match, $project, $lookup (with
+// localField and foreignField), $unwind and $limit stages.
+type FixtureMongoClient struct {
+	collections map[string][]map[string]interface{}
+}
+
+func NewFixtureMongoClient(fixturesPath string) (*FixtureMongoClient, error) {
+	fileContent, err := utils.ReadFile(fixturesPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed fixtures file read: %s", err.Error())
+	}
+	collections := map[string][]map[string]interface{}{}
+	if err := json.Unmarshal(fileContent, &collections); err != nil {
+		return nil, fmt.Errorf("failed fixtures file deserialization: %s", err.Error())
+	}
+	return &FixtureMongoClient{collections: collections}, nil
+}
+
+func (client *FixtureMongoClient) Disconnect() error {
+	return nil
+}
+
+func (client *FixtureMongoClient) RetrieveUserBindings(ctx context.Context, user *types.User) ([]types.Binding, error) {
+	return nil, nil
+}
+
+func (client *FixtureMongoClient) RetrieveRoles(ctx context.Context) ([]types.Role, error) {
+	return nil, nil
+}
+
+func (client *FixtureMongoClient) RetrieveUserRolesByRolesID(ctx context.Context, userRolesId []string) ([]types.Role, error) {
+	return nil, nil
+}
+
+// the fixtures are read only: the policies tests never write the bindings.
+var errReadOnlyFixtures = fmt.Errorf("fixtures are read only")
+
+func (client *FixtureMongoClient) FindBindings(ctx context.Context, filter map[string]interface{}) ([]types.Binding, error) {
+	return nil, nil
+}
+
+func (client *FixtureMongoClient) UpsertBinding(ctx context.Context, binding types.Binding) error {
+	return errReadOnlyFixtures
+}
+
+func (client *FixtureMongoClient) DeleteBindings(ctx context.Context, bindingIDs []string) (int64, error) {
+	return 0, errReadOnlyFixtures
+}
+
+func (client *FixtureMongoClient) UpdateBindingsSubjects(ctx context.Context, bindings []types.Binding) (int64, error) {
+	return 0, errReadOnlyFixtures
+}
+
+func (client *FixtureMongoClient) InsertAuditEntries(ctx context.Context, entries []types.AuditEntry) error {
+	return errReadOnlyFixtures
+}
+
+func (client *FixtureMongoClient) FindOne(ctx context.Context, collectionName string, query map[string]interface{}) (interface{}, error) {
+	results, err := client.FindMany(ctx, collectionName, query)
+	if err != nil || len(results) == 0 {
+		return nil, err
+	}
+	return results[0], nil
+}
+
+func (client *FixtureMongoClient) FindMany(ctx context.Context, collectionName string, query map[string]interface{}) ([]interface{}, error) {
+	normalizedQuery, _ := normalizeValue(query).(map[string]interface{})
+	results := make([]interface{}, 0)
+	for _, document := range client.collections[collectionName] {
+		matches, err := matchesQuery(document, normalizedQuery)
+		if err != nil {
+			return nil, err
+		}
+		if matches {
+			results = append(results, copyValue(document))
+		}
+	}
+	return results, nil
+}
+
+func (client *FixtureMongoClient) FindAggregate(ctx context.Context, collectionName string, pipeline []interface{}) ([]interface{}, error) {
+	documents := make([]map[string]interface{}, 0, len(client.collections[collectionName]))
+	for _, document := range client.collections[collectionName] {
+		documents = append(documents, copyValue(document).(map[string]interface{}))
+	}
+
+	normalizedPipeline, _ := normalizeValue(pipeline).([]interface{})
+	for i, rawStage := range normalizedPipeline {
+		stage, ok := rawStage.(map[string]interface{})
+		if !ok || len(stage) != 1 {
+			return nil, fmt.Errorf("stage %d must be an object with a single key", i)
+		}
+		for stageName, stageSpec := range stage {
+			var err error
+			if documents, err = client.runStage(documents, stageName, stageSpec); err != nil {
+				return nil, fmt.Errorf("stage %d: %s", i, err.Error())
+			}
+		}
+	}
+
+	results := make([]interface{}, 0, len(documents))
+	for _, document := range documents {
+		results = append(results, document)
+	}
+	return results, nil
+}
+
+func (client *FixtureMongoClient) runStage(documents []map[string]interface{}, stageName string, stageSpec interface{}) ([]map[string]interface{}, error) {
+	switch stageName {
+	case "$match":
+		query, ok := stageSpec.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("$match must be an object")
+		}
+		matched := make([]map[string]interface{}, 0, len(documents))
+		for _, document := range documents {
+			matches, err := matchesQuery(document, query)
+			if err != nil {
+				return nil, err
+			}
+			if matches {
+				matched = append(matched, document)
+			}
+		}
+		return matched, nil
+	case "$limit":
+		limit, ok := stageSpec.(float64)
+		if !ok || limit < 0 {
+			return nil, fmt.Errorf("$limit must be a non negative number")
+		}
+		if int(limit) < len(documents) {
+			return documents[:int(limit)], nil
+		}
+		return documents, nil
+	case "$unwind":
+		path, ok := stageSpec.(string)
+		if spec, isObject := stageSpec.(map[string]interface{}); isObject {
+			path, ok = spec["path"].(string)
+		}
+		if !ok || !strings.HasPrefix(path, "$") {
+			return nil, fmt.Errorf("$unwind path must be a string starting with $")
+		}
+		return unwindDocuments(documents, strings.TrimPrefix(path, "$")), nil
+	case "$lookup":
+		return client.lookupDocuments(documents, stageSpec)
+	case "$project":
+		projection, ok := stageSpec.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("$project must be an object")
+		}
+		projected := make([]map[string]interface{}, 0, len(documents))
+		for _, document := range documents {
+			projectedDocument, err := projectDocument(document, projection)
+			if err != nil {
+				return nil, err
+			}
+			projected = append(projected, projectedDocument)
+		}
+		return projected, nil
+	default:
+		return nil, fmt.Errorf("%s is not supported by fixtures", stageName)
+	}
+}
+
+func (client *FixtureMongoClient) lookupDocuments(documents []map[string]interface{}, stageSpec interface{}) ([]map[string]interface{}, error) {
+	lookup, ok := stageSpec.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("$lookup must be an object")
+	}
+	if _, found := lookup["pipeline"]; found {
+		return nil, fmt.Errorf("$lookup with pipeline is not supported by fixtures")
+	}
+	from, _ := lookup["from"].(string)
+	localField, _ := lookup["localField"].(string)
+	foreignField, _ := lookup["foreignField"].(string)
+	as, _ := lookup["as"].(string)
+	if from == "" || localField == "" || foreignField == "" || as == "" {
+		return nil, fmt.Errorf("$lookup requires from, localField, foreignField and as")
+	}
+
+	for _, document := range documents {
+		localValues := []interface{}{}
+		for _, value := range fieldValues(document, localField) {
+			if items, isArray := value.([]interface{}); isArray {
+				localValues = append(localValues, items...)
+				continue
+			}
+			localValues = append(localValues, value)
+		}
+		if len(localValues) == 0 {
+			localValues = []interface{}{nil}
+		}
+		joined := make([]interface{}, 0)
+		for _, foreignDocument := range client.collections[from] {
+			if matchesAnyValue(fieldValues(foreignDocument, foreignField), localValues) {
+				joined = append(joined, copyValue(foreignDocument))
+			}
+		}
+		document[as] = joined
+	}
+	return documents, nil
+}
+
+func unwindDocuments(documents []map[string]interface{}, path string) []map[string]interface{} {
+	unwound := make([]map[string]interface{}, 0, len(documents))
+	for _, document := range documents {
+		value, found := getPath(document, path)
+		values, isArray := value.([]interface{})
+		if !found || value == nil || (isArray && len(values) == 0) {
+			continue
+		}
+		if !isArray {
+			unwound = append(unwound, document)
+			continue
+		}
+		for _, item := range values {
+			unwoundDocument := copyValue(document).(map[string]interface{})
+			setPath(unwoundDocument, path, item)
+			unwound = append(unwound, unwoundDocument)
+		}
+	}
+	return unwound
+}
+
+func projectDocument(document map[string]interface{}, projection map[string]interface{}) (map[string]interface{}, error) {
+	excludeID := false
+	inclusion := map[string]interface{}{}
+	exclusion := []string{}
+	for field, spec := range projection {
+		switch value := spec.(type) {
+		case bool, float64:
+			included := value == true || value == float64(1)
+			if field == "_id" && !included {
+				excludeID = true
+			} else if included {
+				inclusion[field] = nil
+			} else {
+				exclusion = append(exclusion, field)
+			}
+		case string:
+			if !strings.HasPrefix(value, "$") {
+				return nil, fmt.Errorf("$project of %s is not supported by fixtures", field)
+			}
+			inclusion[field] = value
+		default:
+			return nil, fmt.Errorf("$project of %s is not supported by fixtures", field)
+		}
+	}
+	if len(inclusion) > 0 && len(exclusion) > 0 {
+		return nil, fmt.Errorf("$project cannot mix inclusion and exclusion")
+	}
+
+	if len(inclusion) == 0 {
+		projected := copyValue(document).(map[string]interface{})
+		for _, field := range exclusion {
+			delete(projected, field)
+		}
+		if excludeID {
+			delete(projected, "_id")
+		}
+		return projected, nil
+	}
+
+	projected := map[string]interface{}{}
+	if id, found := document["_id"]; found && !excludeID {
+		projected["_id"] = id
+	}
+	for field, expression := range inclusion {
+		path := field
+		if expression != nil {
+			path = strings.TrimPrefix(expression.(string), "$")
+		}
+		if value, found := getPath(document, path); found {
+			setPath(projected, field, copyValue(value))
+		}
+	}
+	return projected, nil
+}
+
+func matchesQuery(document map[string]interface{}, query map[string]interface{}) (bool, error) {
+	for key, condition := range query {
+		var matches bool
+		var err error
+		switch key {
+		case "$and", "$or":
+			subQueries, ok := condition.([]interface{})
+			if !ok {
+				return false, fmt.Errorf("%s must be an array", key)
+			}
+			matches, err = matchesLogicalOperator(document, key, subQueries)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, fmt.Errorf("operator %s is not supported by fixtures", key)
+			}
+			matches, err = matchesCondition(fieldValues(document, key), condition)
+		}
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchesLogicalOperator(document map[string]interface{}, operator string, subQueries []interface{}) (bool, error) {
+	for _, rawSubQuery := range subQueries {
+		subQuery, ok := rawSubQuery.(map[string]interface{})
+		if !ok {
+			return false, fmt.Errorf("%s must contain objects", operator)
+		}
+		matches, err := matchesQuery(document, subQuery)
+		if err != nil {
+			return false, err
+		}
+		if operator == "$or" && matches {
+			return true, nil
+		}
+		if operator == "$and" && !matches {
+			return false, nil
+		}
+	}
+	return operator == "$and", nil
+}
+
+func matchesCondition(values []interface{}, condition interface{}) (bool, error) {
+	operators, ok := condition.(map[string]interface{})
+	if !ok || !hasOnlyOperators(operators) {
+		return matchesAnyValue(values, []interface{}{condition}), nil
+	}
+
+	for operator, operand := range operators {
+		var matches bool
+		switch operator {
+		case "$eq":
+			matches = matchesAnyValue(values, []interface{}{operand})
+		case "$ne":
+			matches = !matchesAnyValue(values, []interface{}{operand})
+		case "$in", "$nin":
+			operands, ok := operand.([]interface{})
+			if !ok {
+				return false, fmt.Errorf("%s must be an array", operator)
+			}
+			matches = matchesAnyValue(values, operands) == (operator == "$in")
+		case "$exists":
+			matches = (len(values) > 0) == (operand == true)
+		default:
+			return false, fmt.Errorf("operator %s is not supported by fixtures", operator)
+		}
+		if !matches {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func hasOnlyOperators(condition map[string]interface{}) bool {
+	if len(condition) == 0 {
+		return false
+	}
+	for key := range condition {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAnyValue reports whether any of the field values, or any of their items when
+// they are arrays, is equal to one of the expected values.
+func matchesAnyValue(values []interface{}, expectedValues []interface{}) bool {
+	for _, expected := range expectedValues {
+		if expected == nil && len(values) == 0 {
+			return true
+		}
+		for _, value := range values {
+			if reflect.DeepEqual(value, expected) {
+				return true
+			}
+			if items, ok := value.([]interface{}); ok {
+				for _, item := range items {
+					if reflect.DeepEqual(item, expected) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// fieldValues returns the values found at the dotted path, traversing arrays of documents.
+func fieldValues(value interface{}, path string) []interface{} {
+	if path == "" {
+		return []interface{}{value}
+	}
+	key, rest, _ := strings.Cut(path, ".")
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		child, found := typedValue[key]
+		if !found {
+			return nil
+		}
+		return fieldValues(child, rest)
+	case []interface{}:
+		values := []interface{}{}
+		for _, item := range typedValue {
+			values = append(values, fieldValues(item, path)...)
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+func getPath(document map[string]interface{}, path string) (interface{}, bool) {
+	key, rest, nested := strings.Cut(path, ".")
+	value, found := document[key]
+	if !found || !nested {
+		return value, found
+	}
+	child, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return getPath(child, rest)
+}
+
+func setPath(document map[string]interface{}, path string, value interface{}) {
+	key, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		document[key] = value
+		return
+	}
+	child, ok := document[key].(map[string]interface{})
+	if !ok {
+		child = map[string]interface{}{}
+		document[key] = child
+	}
+	setPath(child, rest, value)
+}
+
+// normalizeValue converts the value to the types produced by JSON decoding, so that
+// values coming from the policies can be compared with the fixtures documents.
+func normalizeValue(value interface{}) interface{} {
+	marshalled, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var normalized interface{}
+	if err := json.Unmarshal(marshalled, &normalized); err != nil {
+		return value
+	}
+	return normalized
+}
+
+func copyValue(value interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(typedValue))
+		for key, item := range typedValue {
+			copied[key] = copyValue(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, 0, len(typedValue))
+		for _, item := range typedValue {
+			copied = append(copied, copyValue(item))
+		}
+		return copied
+	default:
+		return value
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongoclient
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFixtureMongoClient(t *testing.T) {
+	fixturesPath := filepath.Join(t.TempDir(), "fixtures.json")
+	require.NoError(t, os.WriteFile(fixturesPath, []byte(`{
+		"projects": [
+			{"projectId": "p1", "tenantId": "t1", "teamId": "team1", "tags": ["a", "b"], "owner": {"name": "bob"}, "pages": 10},
+			{"projectId": "p2", "tenantId": "t1", "teamId": "team2", "tags": ["c"], "pages": 20},
+			{"projectId": "p3", "tenantId": "t2", "teamId": "team1"}
+		],
+		"teams": [
+			{"teamId": "team1", "members": ["user1", "user2"]},
+			{"teamId": "team2", "members": ["user3"]}
+		]
+	}`), 0600))
+
+	client, err := NewFixtureMongoClient(fixturesPath)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	projectIDs := func(t *testing.T, documents []interface{}) []string {
+		t.Helper()
+		ids := []string{}
+		for _, document := range documents {
+			ids = append(ids, document.(map[string]interface{})["projectId"].(string))
+		}
+		return ids
+	}
+
+	t.Run("fails with missing file", func(t *testing.T) {
+		_, err := NewFixtureMongoClient(filepath.Join(t.TempDir(), "missing.json"))
+		require.ErrorContains(t, err, "failed fixtures file read")
+	})
+
+	t.Run("fails with invalid file", func(t *testing.T) {
+		invalidPath := filepath.Join(t.TempDir(), "fixtures.json")
+		require.NoError(t, os.WriteFile(invalidPath, []byte(`["not", "collections"]`), 0600))
+		_, err := NewFixtureMongoClient(invalidPath)
+		require.ErrorContains(t, err, "failed fixtures file deserialization")
+	})
+
+	t.Run("FindMany", func(t *testing.T) {
+		testCases := map[string]struct {
+			query    string
+			expected []string
+		}{
+			"equality":             {query: `{"tenantId": "t1"}`, expected: []string{"p1", "p2"}},
+			"number equality":      {query: `{"pages": 10}`, expected: []string{"p1"}},
+			"dotted path":          {query: `{"owner.name": "bob"}`, expected: []string{"p1"}},
+			"array contains":       {query: `{"tags": "c"}`, expected: []string{"p2"}},
+			"$eq":                  {query: `{"projectId": {"$eq": "p3"}}`, expected: []string{"p3"}},
+			"$ne":                  {query: `{"tenantId": {"$ne": "t1"}}`, expected: []string{"p3"}},
+			"$in":                  {query: `{"projectId": {"$in": ["p1", "p3"]}}`, expected: []string{"p1", "p3"}},
+			"$nin":                 {query: `{"projectId": {"$nin": ["p1", "p3"]}}`, expected: []string{"p2"}},
+			"$exists":              {query: `{"tags": {"$exists": false}}`, expected: []string{"p3"}},
+			"null matches missing": {query: `{"tags": null}`, expected: []string{"p3"}},
+			"$or":                  {query: `{"$or": [{"projectId": "p1"}, {"tenantId": "t2"}]}`, expected: []string{"p1", "p3"}},
+			"$and":                 {query: `{"$and": [{"tenantId": "t1"}, {"teamId": "team2"}]}`, expected: []string{"p2"}},
+			"no match":             {query: `{"projectId": "missing"}`, expected: []string{}},
+			"empty query":          {query: `{}`, expected: []string{"p1", "p2", "p3"}},
+		}
+		for name, testCase := range testCases {
+			t.Run(name, func(t *testing.T) {
+				var query map[string]interface{}
+				require.NoError(t, json.Unmarshal([]byte(testCase.query), &query))
+				results, err := client.FindMany(ctx, "projects", query)
+				require.NoError(t, err)
+				require.Equal(t, testCase.expected, projectIDs(t, results))
+			})
+		}
+
+		t.Run("fails with unsupported operator", func(t *testing.T) {
+			_, err := client.FindMany(ctx, "projects", map[string]interface{}{"pages": map[string]interface{}{"$gt": 1}})
+			require.EqualError(t, err, "operator $gt is not supported by fixtures")
+		})
+
+		t.Run("unknown collection is empty", func(t *testing.T) {
+			results, err := client.FindMany(ctx, "unknown", map[string]interface{}{})
+			require.NoError(t, err)
+			require.Empty(t, results)
+		})
+	})
+
+	t.Run("FindOne", func(t *testing.T) {
+		result, err := client.FindOne(ctx, "projects", map[string]interface{}{"tenantId": "t1"})
+		require.NoError(t, err)
+		require.Equal(t, "p1", result.(map[string]interface{})["projectId"])
+
+		result, err = client.FindOne(ctx, "projects", map[string]interface{}{"tenantId": "missing"})
+		require.NoError(t, err)
+		require.Nil(t, result)
+	})
+
+	t.Run("FindAggregate", func(t *testing.T) {
+		t.Run("joins the owning team members", func(t *testing.T) {
+			var pipeline []interface{}
+			require.NoError(t, json.Unmarshal([]byte(`[
+				{"$match": {"tenantId": "t1"}},
+				{"$lookup": {"from": "teams", "localField": "teamId", "foreignField": "teamId", "as": "team"}},
+				{"$unwind": "$team"},
+				{"$match": {"team.members": "user1"}},
+				{"$project": {"_id": 0, "projectId": 1, "members": "$team.members"}},
+				{"$limit": 10}
+			]`), &pipeline))
+
+			results, err := client.FindAggregate(ctx, "projects", pipeline)
+			require.NoError(t, err)
+			require.Equal(t, []interface{}{
+				map[string]interface{}{"projectId": "p1", "members": []interface{}{"user1", "user2"}},
+			}, results)
+		})
+
+		t.Run("unwinds arrays and limits documents", func(t *testing.T) {
+			results, err := client.FindAggregate(ctx, "projects", []interface{}{
+				map[string]interface{}{"$unwind": map[string]interface{}{"path": "$tags"}},
+				map[string]interface{}{"$project": map[string]interface{}{"owner": 0, "pages": 0, "teamId": 0, "tenantId": 0}},
+				map[string]interface{}{"$limit": 2},
+			})
+			require.NoError(t, err)
+			require.Equal(t, []interface{}{
+				map[string]interface{}{"projectId": "p1", "tags": "a"},
+				map[string]interface{}{"projectId": "p1", "tags": "b"},
+			}, results)
+		})
+
+		t.Run("does not modify the fixtures", func(t *testing.T) {
+			_, err := client.FindAggregate(ctx, "projects", []interface{}{
+				map[string]interface{}{"$lookup": map[string]interface{}{"from": "teams", "localField": "teamId", "foreignField": "teamId", "as": "team"}},
+			})
+			require.NoError(t, err)
+
+			result, err := client.FindOne(ctx, "projects", map[string]interface{}{"projectId": "p1"})
+			require.NoError(t, err)
+			require.NotContains(t, result, "team")
+		})
+
+		t.Run("fails with unsupported stage", func(t *testing.T) {
+			_, err := client.FindAggregate(ctx, "projects", []interface{}{
+				map[string]interface{}{"$match": map[string]interface{}{}},
+				map[string]interface{}{"$group": map[string]interface{}{"_id": nil}},
+			})
+			require.EqualError(t, err, "stage 1: $group is not supported by fixtures")
+		})
+	})
+}
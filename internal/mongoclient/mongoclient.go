@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -34,13 +35,23 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+	"golang.org/x/sync/errgroup"
 )
 
 type MongoClient struct {
+	// mu guards the connection fields, which are replaced on Reconnect.
+	mu sync.RWMutex
+
 	client       *mongo.Client
 	bindings     *mongo.Collection
 	roles        *mongo.Collection
+	audit        *mongo.Collection
 	databaseName string
+	pool         *poolMonitor
+
+	bindingProjectionFields []string
+	// env is the configuration of the current connection.
+	env config.EnvironmentVariables
 }
 
 const STATE string = "__STATE__"
@@ -78,11 +89,63 @@ func GetMongoClientFromContext(ctx context.Context) (types.IMongoClient, error)
 
 func (mongoClient *MongoClient) Disconnect() error {
 	if mongoClient != nil {
+		mongoClient.mu.RLock()
+		defer mongoClient.mu.RUnlock()
 		return mongoClient.client.Disconnect(context.Background())
 	}
 	return nil
 }
 
+// Reconnect sets up a new connection with the given configuration, e.g. when the
+// connection string credentials are rotated, and replaces the current one, which is
+// then closed. The current connection is kept if the new one cannot be set up.
+func (mongoClient *MongoClient) Reconnect(env config.EnvironmentVariables, logger *logrus.Logger) error {
+	newClient, err := NewMongoClient(env, logger)
+	if err != nil {
+		return err
+	}
+	if newClient == nil {
+		return fmt.Errorf("missing MongoDB url")
+	}
+
+	mongoClient.mu.Lock()
+	previousClient := mongoClient.client
+	mongoClient.client = newClient.client
+	mongoClient.databaseName = newClient.databaseName
+	mongoClient.roles = newClient.roles
+	mongoClient.bindings = newClient.bindings
+	mongoClient.audit = newClient.audit
+	mongoClient.pool = newClient.pool
+	mongoClient.bindingProjectionFields = newClient.bindingProjectionFields
+	mongoClient.env = newClient.env
+	mongoClient.mu.Unlock()
+
+	// the lock waits for the running operations, so the previous connection is no longer in use
+	if previousClient == nil {
+		return nil
+	}
+	if err := previousClient.Disconnect(context.Background()); err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed previous MongoDB connection close")
+	}
+	return nil
+}
+
+// RenewConnection sets up a new connection with the configuration of the current one,
+// e.g. after it has been lost, and replaces the current one as Reconnect does.
+func (mongoClient *MongoClient) RenewConnection(logger *logrus.Logger) error {
+	mongoClient.mu.RLock()
+	env := mongoClient.env
+	mongoClient.mu.RUnlock()
+	return mongoClient.Reconnect(env, logger)
+}
+
+// Ping verifies that the MongoDB server is reachable.
+func (mongoClient *MongoClient) Ping(ctx context.Context) error {
+	mongoClient.mu.RLock()
+	defer mongoClient.mu.RUnlock()
+	return mongoClient.client.Ping(ctx, readpref.Primary())
+}
+
 // NewMongoClient tries to setup a new MongoClient instance.
 // The function returns a `nil` client if the environment variable `MongoDBUrl` is not specified.
 func NewMongoClient(env config.EnvironmentVariables, logger *logrus.Logger) (*MongoClient, error) {
@@ -105,8 +168,8 @@ func NewMongoClient(env config.EnvironmentVariables, logger *logrus.Logger) (*Mo
 		return nil, fmt.Errorf("failed MongoDB connection string validation: %s", err.Error())
 	}
 
-	clientOpts := options.Client().ApplyURI(env.MongoDBUrl)
-	client, err := mongo.Connect(context.Background(), clientOpts)
+	pool := &poolMonitor{}
+	client, err := mongo.Connect(context.Background(), clientOptions(env, pool))
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to MongoDB: %s", err.Error())
 	}
@@ -122,27 +185,50 @@ func NewMongoClient(env config.EnvironmentVariables, logger *logrus.Logger) (*Mo
 		databaseName: parsedConnectionString.Database,
 		roles:        client.Database(parsedConnectionString.Database).Collection(env.RolesCollectionName),
 		bindings:     client.Database(parsedConnectionString.Database).Collection(env.BindingsCollectionName),
+		pool:         pool,
+
+		bindingProjectionFields: env.BindingProjectionFields,
+		env:                     env,
+	}
+	if env.AuditCollectionName != "" {
+		mongoClient.audit = client.Database(parsedConnectionString.Database).Collection(env.AuditCollectionName)
+	}
+
+	if err := mongoClient.EnsureIndexes(ctx); err != nil {
+		return nil, fmt.Errorf("error creating MongoDB indexes: %s", err.Error())
 	}
 
 	logger.Info("MongoDB client set up completed")
 	return &mongoClient, nil
 }
 
+// RetrieveUserBindings returns the bindings of the user, either direct or of one of their
+// groups, querying the direct and the group bindings in parallel.
 func (mongoClient *MongoClient) RetrieveUserBindings(ctx context.Context, user *types.User) ([]types.Binding, error) {
-	filter := bson.M{
-		"$and": []bson.M{
-			{
-				"$or": []bson.M{
-					{"subjects": bson.M{"$elemMatch": bson.M{"$eq": user.UserID}}},
-					{"groups": bson.M{"$elemMatch": bson.M{"$in": user.UserGroups}}},
-				},
-			},
-			{STATE: PUBLIC},
-		},
+	return retrieveUserBindings(ctx, user, mongoClient.GetDirectBindings, mongoClient.GetGroupBindings)
+}
+
+// GetDirectBindings returns the bindings having the user among their subjects.
+func (mongoClient *MongoClient) GetDirectBindings(ctx context.Context, userID string) ([]types.Binding, error) {
+	return mongoClient.findPublicBindings(ctx, bson.M{"subjects": userID})
+}
+
+// GetGroupBindings returns the bindings of the groups, no query is performed without groups.
+func (mongoClient *MongoClient) GetGroupBindings(ctx context.Context, groupIDs []string) ([]types.Binding, error) {
+	if len(groupIDs) == 0 {
+		return []types.Binding{}, nil
 	}
+	return mongoClient.findPublicBindings(ctx, bson.M{"groups": bson.M{"$in": groupIDs}})
+}
+
+func (mongoClient *MongoClient) findPublicBindings(ctx context.Context, filter bson.M) ([]types.Binding, error) {
+	mongoClient.mu.RLock()
+	defer mongoClient.mu.RUnlock()
+	filter[STATE] = PUBLIC
 	cursor, err := mongoClient.bindings.Find(
 		ctx,
 		filter,
+		bindingsFindOptions(mongoClient.bindingProjectionFields),
 	)
 	if err != nil {
 		return nil, err
@@ -151,10 +237,95 @@ func (mongoClient *MongoClient) RetrieveUserBindings(ctx context.Context, user *
 	if err = cursor.All(ctx, &bindingsResult); err != nil {
 		return nil, err
 	}
-	return bindingsResult, nil
+	return filterExpiredBindings(bindingsResult, time.Now()), nil
+}
+
+// retrieveUserBindings runs the direct and group bindings queries in parallel, cancelling
+// the other one as soon as one fails. The bindings matching both the user and one of their
+// groups are returned once.
+func retrieveUserBindings(
+	ctx context.Context,
+	user *types.User,
+	getDirectBindings func(ctx context.Context, userID string) ([]types.Binding, error),
+	getGroupBindings func(ctx context.Context, groupIDs []string) ([]types.Binding, error),
+) ([]types.Binding, error) {
+	var directBindings, groupBindings []types.Binding
+	group, groupContext := errgroup.WithContext(ctx)
+	group.Go(func() (err error) {
+		directBindings, err = getDirectBindings(groupContext, user.UserID)
+		return err
+	})
+	group.Go(func() (err error) {
+		groupBindings, err = getGroupBindings(groupContext, user.UserGroups)
+		return err
+	})
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	bindings := make([]types.Binding, 0, len(directBindings)+len(groupBindings))
+	bindings = append(bindings, directBindings...)
+	directBindingIDs := make(map[string]bool, len(directBindings))
+	for _, binding := range directBindings {
+		directBindingIDs[binding.BindingID] = true
+	}
+	for _, binding := range groupBindings {
+		if binding.BindingID == "" || !directBindingIDs[binding.BindingID] {
+			bindings = append(bindings, binding)
+		}
+	}
+	return bindings, nil
+}
+
+// bindingsFindOptions returns the options of the user bindings query: if projection fields
+// are set, only those fields are fetched, to avoid transferring unused data such as metadata.
+// The bindingId field is always fetched, since the user bindings are deduplicated on it.
+func bindingsFindOptions(projectionFields []string) *options.FindOptions {
+	findOptions := options.Find()
+	if len(projectionFields) == 0 {
+		return findOptions
+	}
+	projection := bson.D{}
+	for _, field := range projectionFields {
+		projection = append(projection, bson.E{Key: field, Value: 1})
+	}
+	if !utils.Contains(projectionFields, "bindingId") {
+		projection = append(projection, bson.E{Key: "bindingId", Value: 1})
+	}
+	// the _id field is always returned, unless explicitly excluded
+	if !utils.Contains(projectionFields, "_id") {
+		projection = append(projection, bson.E{Key: "_id", Value: 0})
+	}
+	return findOptions.SetProjection(projection)
+}
+
+// filterExpiredBindings removes the bindings expired but not yet deleted
+// by the MongoDB TTL monitor, which runs only periodically.
+func filterExpiredBindings(bindings []types.Binding, now time.Time) []types.Binding {
+	validBindings := make([]types.Binding, 0, len(bindings))
+	for _, binding := range bindings {
+		if !binding.IsExpired(now) {
+			validBindings = append(validBindings, binding)
+		}
+	}
+	return validBindings
+}
+
+// EnsureIndexes creates the indexes required on the bindings collection, such as
+// the TTL index removing bindings once their expiresAt date is reached.
+func (mongoClient *MongoClient) EnsureIndexes(ctx context.Context) error {
+	mongoClient.mu.RLock()
+	defer mongoClient.mu.RUnlock()
+	_, err := mongoClient.bindings.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
 }
 
 func (mongoClient *MongoClient) RetrieveRoles(ctx context.Context) ([]types.Role, error) {
+	mongoClient.mu.RLock()
+	defer mongoClient.mu.RUnlock()
 	filter := bson.M{
 		STATE: PUBLIC,
 	}
@@ -173,6 +344,8 @@ func (mongoClient *MongoClient) RetrieveRoles(ctx context.Context) ([]types.Role
 }
 
 func (mongoClient *MongoClient) RetrieveUserRolesByRolesID(ctx context.Context, userRolesId []string) ([]types.Role, error) {
+	mongoClient.mu.RLock()
+	defer mongoClient.mu.RUnlock()
 	filter := bson.M{
 		"$and": []bson.M{
 			{
@@ -196,6 +369,8 @@ func (mongoClient *MongoClient) RetrieveUserRolesByRolesID(ctx context.Context,
 }
 
 func (mongoClient *MongoClient) FindOne(ctx context.Context, collectionName string, query map[string]interface{}) (interface{}, error) {
+	mongoClient.mu.RLock()
+	defer mongoClient.mu.RUnlock()
 	collection := mongoClient.client.Database(mongoClient.databaseName).Collection(collectionName)
 	glogger.Get(ctx).WithFields(logrus.Fields{
 		"mongoQuery":     query,
@@ -231,6 +406,8 @@ func (mongoClient *MongoClient) FindOne(ctx context.Context, collectionName stri
 }
 
 func (mongoClient *MongoClient) FindMany(ctx context.Context, collectionName string, query map[string]interface{}) ([]interface{}, error) {
+	mongoClient.mu.RLock()
+	defer mongoClient.mu.RUnlock()
 	collection := mongoClient.client.Database(mongoClient.databaseName).Collection(collectionName)
 	glogger.Get(ctx).WithFields(logrus.Fields{
 		"mongoQuery":     query,
@@ -244,6 +421,28 @@ func (mongoClient *MongoClient) FindMany(ctx context.Context, collectionName str
 		return nil, err
 	}
 
+	return decodeCursorResults(ctx, resultCursor)
+}
+
+func (mongoClient *MongoClient) FindAggregate(ctx context.Context, collectionName string, pipeline []interface{}) ([]interface{}, error) {
+	mongoClient.mu.RLock()
+	defer mongoClient.mu.RUnlock()
+	collection := mongoClient.client.Database(mongoClient.databaseName).Collection(collectionName)
+	glogger.Get(ctx).WithFields(logrus.Fields{
+		"mongoPipeline":  pipeline,
+		"dbName":         mongoClient.databaseName,
+		"collectionName": collectionName,
+	}).Debug("performing aggregation")
+
+	resultCursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		glogger.Get(ctx).WithField("error", logrus.Fields{"message": err.Error()}).Error("failed aggregation execution")
+		return nil, err
+	}
+	return decodeCursorResults(ctx, resultCursor)
+}
+
+func decodeCursorResults(ctx context.Context, resultCursor *mongo.Cursor) ([]interface{}, error) {
 	results := make([]interface{}, 0)
 	if err := resultCursor.All(ctx, &results); err != nil {
 		glogger.Get(ctx).WithField("error", logrus.Fields{"message": err.Error()}).Error("failed complete query result deserialization")
@@ -282,7 +481,24 @@ func RolesIDsFromBindings(bindings []types.Binding) []string {
 	return rolesIds
 }
 
+// RetrieveUserBindingsAndRoles resolves the user of the request together with its bindings
+// and roles. If the request context holds a user cache, the user is retrieved only once.
 func RetrieveUserBindingsAndRoles(logger *logrus.Entry, req *http.Request, env config.EnvironmentVariables) (types.User, error) {
+	return cachedUser(req.Context(), func() (types.User, error) {
+		return retrieveUserBindingsAndRoles(logger, req, env)
+	})
+}
+
+// logRetrievalError logs the retrieval failure, unless it is caused by the client closing
+// the request, which is reported by the caller.
+func logRetrievalError(ctx context.Context, logger *logrus.Entry, err error, message string) {
+	if utils.IsClientClosedRequest(ctx) {
+		return
+	}
+	logger.WithField("error", logrus.Fields{"message": err.Error()}).Error(message)
+}
+
+func retrieveUserBindingsAndRoles(logger *logrus.Entry, req *http.Request, env config.EnvironmentVariables) (types.User, error) {
 	requestContext := req.Context()
 	mongoClient, err := GetMongoClientFromContext(requestContext)
 	if err != nil {
@@ -292,20 +508,24 @@ func RetrieveUserBindingsAndRoles(logger *logrus.Entry, req *http.Request, env c
 	var user types.User
 
 	user.UserGroups = strings.Split(req.Header.Get(env.UserGroupsHeader), ",")
-	user.UserID = req.Header.Get(env.UserIdHeader)
+	user.UserID, user.IdentitySource, err = ResolveUserID(requestContext, req, env, mongoClient)
+	if err != nil {
+		logRetrievalError(requestContext, logger, err, "something went wrong while resolving user id")
+		return types.User{}, fmt.Errorf("Error while resolving user id: %s", err.Error())
+	}
+	userFromJWTClaims(requestContext, req, env, &user)
 
 	if mongoClient != nil && user.UserID != "" {
 		user.UserBindings, err = mongoClient.RetrieveUserBindings(requestContext, &user)
 		if err != nil {
-			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("something went wrong while retrieving user bindings")
+			logRetrievalError(requestContext, logger, err, "something went wrong while retrieving user bindings")
 			return types.User{}, fmt.Errorf("Error while retrieving user bindings: %s", err.Error())
 		}
 
 		userRolesIds := RolesIDsFromBindings(user.UserBindings)
 		user.UserRoles, err = mongoClient.RetrieveUserRolesByRolesID(requestContext, userRolesIds)
 		if err != nil {
-			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("something went wrong while retrieving user roles")
-
+			logRetrievalError(requestContext, logger, err, "something went wrong while retrieving user roles")
 			return types.User{}, fmt.Errorf("Error while retrieving user Roles: %s", err.Error())
 		}
 		logger.WithFields(logrus.Fields{
@@ -21,7 +21,9 @@ import (
 	"net/http/httptest"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/rond-authz/rond/internal/config"
 	"github.com/rond-authz/rond/internal/mocks"
@@ -30,6 +32,9 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func TestMongoCollectionInjectorMiddleware(t *testing.T) {
@@ -129,6 +134,67 @@ func TestSetupMongoCollection(t *testing.T) {
 		defer mongoClient.Disconnect()
 		require.True(t, err == nil, "setup mongo returns error")
 		require.True(t, mongoClient != nil)
+		require.NoError(t, mongoClient.Ping(context.Background()))
+	})
+}
+
+func TestMongoClientPing(t *testing.T) {
+	t.Run("fails if MongoDB is not reachable", func(t *testing.T) {
+		ctx := context.Background()
+		client, err := mongo.Connect(ctx, options.Client().
+			ApplyURI("mongodb://127.0.0.1:1/test").
+			SetServerSelectionTimeout(100*time.Millisecond))
+		require.NoError(t, err)
+		defer client.Disconnect(ctx)
+
+		mongoClient := &MongoClient{client: client}
+		require.Error(t, mongoClient.Ping(ctx))
+	})
+}
+
+func TestMongoClientReconnect(t *testing.T) {
+	t.Run("keeps the current connection if the new one fails", func(t *testing.T) {
+		ctx := context.Background()
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://127.0.0.1:1/test"))
+		require.NoError(t, err)
+		defer client.Disconnect(ctx)
+
+		mongoClient := &MongoClient{client: client, databaseName: "test"}
+		log, _ := test.NewNullLogger()
+		err = mongoClient.Reconnect(config.EnvironmentVariables{
+			MongoDBUrl:             "not-valid-mongo-url",
+			RolesCollectionName:    "roles",
+			BindingsCollectionName: "bindings",
+		}, log)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failed MongoDB connection string validation:")
+		require.Equal(t, client, mongoClient.client)
+		require.Equal(t, "test", mongoClient.databaseName)
+	})
+
+	t.Run("replaces the connection", func(t *testing.T) {
+		mongoHost := os.Getenv("MONGO_HOST_CI")
+		if mongoHost == "" {
+			mongoHost = testutils.LocalhostMongoDB
+			t.Logf("Connection to localhost MongoDB, on CI env this is a problem!")
+		}
+
+		env := config.EnvironmentVariables{
+			MongoDBUrl:             fmt.Sprintf("mongodb://%s/test", mongoHost),
+			RolesCollectionName:    "roles",
+			BindingsCollectionName: "bindings",
+		}
+		log, _ := test.NewNullLogger()
+		mongoClient, err := NewMongoClient(env, log)
+		require.NoError(t, err)
+		defer mongoClient.Disconnect()
+		previousClient := mongoClient.client
+
+		env.MongoDBUrl = fmt.Sprintf("mongodb://%s/rotated", mongoHost)
+		require.NoError(t, mongoClient.Reconnect(env, log))
+		require.NotEqual(t, previousClient, mongoClient.client)
+		require.Equal(t, "rotated", mongoClient.databaseName)
+		require.NoError(t, mongoClient.Ping(context.Background()))
 	})
 }
 
@@ -221,6 +287,108 @@ func TestMongoCollections(t *testing.T) {
 			"Error while getting permissions")
 	})
 
+	t.Run("retrieves only the projected binding fields", func(t *testing.T) {
+		mongoHost := os.Getenv("MONGO_HOST_CI")
+		if mongoHost == "" {
+			mongoHost = testutils.LocalhostMongoDB
+			t.Logf("Connection to localhost MongoDB, on CI env this is a problem!")
+		}
+
+		env := config.EnvironmentVariables{
+			MongoDBUrl:              fmt.Sprintf("mongodb://%s/test", mongoHost),
+			RolesCollectionName:     "roles",
+			BindingsCollectionName:  "bindings",
+			BindingProjectionFields: []string{"subjects", "roles", "permissions", "resource", "expiresAt"},
+		}
+
+		log, _ := test.NewNullLogger()
+		mongoClient, err := NewMongoClient(env, log)
+		defer mongoClient.Disconnect()
+		require.True(t, err == nil, "setup mongo returns error")
+		client, _, rolesCollection, bindingsCollection := testutils.GetAndDisposeTestClientsAndCollections(t)
+		mongoClient.client = client
+		mongoClient.roles = rolesCollection
+		mongoClient.bindings = bindingsCollection
+
+		ctx := context.Background()
+		_, err = bindingsCollection.InsertOne(ctx, bson.M{
+			"bindingId":   "bindingWithMetadata",
+			"subjects":    []string{"projectionUser"},
+			"groups":      []string{"projectionGroup"},
+			"roles":       []string{"role1"},
+			"permissions": []string{"permission1"},
+			"resource":    bson.M{"resourceType": "project", "resourceId": "1234"},
+			"metadata":    bson.M{"blob": strings.Repeat("x", 1024*1024)},
+			"__STATE__":   "PUBLIC",
+		})
+		require.NoError(t, err)
+
+		result, err := mongoClient.RetrieveUserBindings(ctx, &types.User{UserID: "projectionUser"})
+		require.NoError(t, err)
+		require.Equal(t, []types.Binding{
+			{
+				BindingID:   "bindingWithMetadata",
+				Subjects:    []string{"projectionUser"},
+				Roles:       []string{"role1"},
+				Permissions: []string{"permission1"},
+				Resource:    &types.Resource{ResourceType: "project", ResourceID: "1234"},
+			},
+		}, result)
+
+		cursor, err := bindingsCollection.Find(ctx, bson.M{"subjects": "projectionUser"}, bindingsFindOptions(env.BindingProjectionFields))
+		require.NoError(t, err)
+		var documents []bson.M
+		require.NoError(t, cursor.All(ctx, &documents))
+		require.Len(t, documents, 1)
+		require.NotContains(t, documents[0], "metadata")
+		require.NotContains(t, documents[0], "_id")
+	})
+
+	t.Run("returns once the bindings of both the user and a group with the default projection", func(t *testing.T) {
+		mongoHost := os.Getenv("MONGO_HOST_CI")
+		if mongoHost == "" {
+			mongoHost = testutils.LocalhostMongoDB
+			t.Logf("Connection to localhost MongoDB, on CI env this is a problem!")
+		}
+
+		env := config.EnvironmentVariables{
+			MongoDBUrl:              fmt.Sprintf("mongodb://%s/test", mongoHost),
+			RolesCollectionName:     "roles",
+			BindingsCollectionName:  "bindings",
+			BindingProjectionFields: defaultBindingProjectionFields(t),
+		}
+
+		log, _ := test.NewNullLogger()
+		mongoClient, err := NewMongoClient(env, log)
+		defer mongoClient.Disconnect()
+		require.True(t, err == nil, "setup mongo returns error")
+		client, _, rolesCollection, bindingsCollection := testutils.GetAndDisposeTestClientsAndCollections(t)
+		mongoClient.client = client
+		mongoClient.roles = rolesCollection
+		mongoClient.bindings = bindingsCollection
+
+		ctx := context.Background()
+		_, err = bindingsCollection.InsertOne(ctx, bson.M{
+			"bindingId": "userAndGroupBinding",
+			"subjects":  []string{"dedupUser"},
+			"groups":    []string{"dedupGroup"},
+			"roles":     []string{"role1"},
+			"__STATE__": "PUBLIC",
+		})
+		require.NoError(t, err)
+
+		result, err := mongoClient.RetrieveUserBindings(ctx, &types.User{UserID: "dedupUser", UserGroups: []string{"dedupGroup"}})
+		require.NoError(t, err)
+		require.Equal(t, []types.Binding{
+			{
+				BindingID: "userAndGroupBinding",
+				Subjects:  []string{"dedupUser"},
+				Groups:    []string{"dedupGroup"},
+				Roles:     []string{"role1"},
+			},
+		}, result)
+	})
+
 	t.Run("retrieve all roles from mongo", func(t *testing.T) {
 		mongoHost := os.Getenv("MONGO_HOST_CI")
 		if mongoHost == "" {
@@ -452,6 +620,187 @@ func TestMongoFindMany(t *testing.T) {
 	})
 }
 
+func TestMongoFindAggregate(t *testing.T) {
+	mongoHost := os.Getenv("MONGO_HOST_CI")
+	if mongoHost == "" {
+		mongoHost = testutils.LocalhostMongoDB
+		t.Logf("Connection to localhost MongoDB, on CI env this is a problem!")
+	}
+
+	env := config.EnvironmentVariables{
+		MongoDBUrl:             fmt.Sprintf("mongodb://%s/test", mongoHost),
+		RolesCollectionName:    "roles",
+		BindingsCollectionName: "bindings",
+	}
+	log, _ := test.NewNullLogger()
+	mongoClient, err := NewMongoClient(env, log)
+	defer mongoClient.Disconnect()
+	require.True(t, err == nil, "setup mongo returns error")
+
+	client, dbName, rolesCollection, bindingsCollection := testutils.GetAndDisposeTestClientsAndCollections(t)
+	mongoClient.client = client
+	mongoClient.databaseName = dbName
+	mongoClient.roles = rolesCollection
+	mongoClient.bindings = bindingsCollection
+
+	ctx := context.Background()
+
+	testutils.PopulateDBForTesting(t, ctx, rolesCollection, bindingsCollection)
+
+	t.Run("joins documents of two collections", func(t *testing.T) {
+		result, err := mongoClient.FindAggregate(context.Background(), "bindings", []interface{}{
+			map[string]interface{}{"$match": map[string]interface{}{"bindingId": "binding1"}},
+			map[string]interface{}{"$unwind": "$roles"},
+			map[string]interface{}{"$lookup": map[string]interface{}{
+				"from":         "roles",
+				"localField":   "roles",
+				"foreignField": "roleId",
+				"as":           "role",
+			}},
+			map[string]interface{}{"$unwind": "$role"},
+			map[string]interface{}{"$project": map[string]interface{}{"_id": 0, "roleId": "$role.roleId"}},
+		})
+		require.NoError(t, err)
+		// role2 has no role document, so it is dropped by $unwind
+		require.Equal(t, []interface{}{
+			map[string]interface{}{"roleId": "role1"},
+		}, result)
+	})
+
+	t.Run("does not find any document", func(t *testing.T) {
+		result, err := mongoClient.FindAggregate(context.Background(), "roles", []interface{}{
+			map[string]interface{}{"$match": map[string]interface{}{"roleId": "role9999"}},
+		})
+		require.NoError(t, err)
+		require.Len(t, result, 0)
+	})
+
+	t.Run("returns error on invalid pipeline", func(t *testing.T) {
+		result, err := mongoClient.FindAggregate(context.Background(), "roles", []interface{}{
+			map[string]interface{}{"$UNKNOWN": map[string]interface{}{}},
+		})
+		require.Error(t, err)
+		require.Len(t, result, 0)
+	})
+}
+
+func TestFilterExpiredBindings(t *testing.T) {
+	now := time.Now()
+	expiredAt := now.Add(-time.Minute)
+	expiresAt := now.Add(time.Minute)
+
+	bindings := []types.Binding{
+		{BindingID: "noExpiration"},
+		{BindingID: "expired", ExpiresAt: &expiredAt},
+		{BindingID: "notExpired", ExpiresAt: &expiresAt},
+	}
+
+	require.Equal(t, []types.Binding{
+		{BindingID: "noExpiration"},
+		{BindingID: "notExpired", ExpiresAt: &expiresAt},
+	}, filterExpiredBindings(bindings, now))
+}
+
+func TestRetrieveUserBindingsQueries(t *testing.T) {
+	user := &types.User{UserID: "user1", UserGroups: []string{"group1", "group2"}}
+
+	t.Run("runs the queries in parallel and merges their results", func(t *testing.T) {
+		var queriedUserID string
+		var queriedGroupIDs []string
+		directStarted := make(chan struct{})
+		groupStarted := make(chan struct{})
+		waitFor := func(started chan struct{}) error {
+			select {
+			case <-started:
+				return nil
+			case <-time.After(time.Second):
+				return fmt.Errorf("queries not run in parallel")
+			}
+		}
+
+		bindings, err := retrieveUserBindings(context.Background(), user,
+			func(ctx context.Context, userID string) ([]types.Binding, error) {
+				queriedUserID = userID
+				close(directStarted)
+				if err := waitFor(groupStarted); err != nil {
+					return nil, err
+				}
+				return []types.Binding{{BindingID: "direct"}, {BindingID: "both"}}, nil
+			},
+			func(ctx context.Context, groupIDs []string) ([]types.Binding, error) {
+				queriedGroupIDs = groupIDs
+				close(groupStarted)
+				if err := waitFor(directStarted); err != nil {
+					return nil, err
+				}
+				return []types.Binding{{BindingID: "both"}, {BindingID: "group"}}, nil
+			},
+		)
+		require.NoError(t, err)
+		require.Equal(t, "user1", queriedUserID)
+		require.Equal(t, []string{"group1", "group2"}, queriedGroupIDs)
+		require.Equal(t, []types.Binding{{BindingID: "direct"}, {BindingID: "both"}, {BindingID: "group"}}, bindings)
+	})
+
+	t.Run("fails cancelling the other query", func(t *testing.T) {
+		var groupContextErr error
+		_, err := retrieveUserBindings(context.Background(), user,
+			func(ctx context.Context, userID string) ([]types.Binding, error) {
+				return nil, fmt.Errorf("direct bindings query failed")
+			},
+			func(ctx context.Context, groupIDs []string) ([]types.Binding, error) {
+				<-ctx.Done()
+				groupContextErr = ctx.Err()
+				return nil, ctx.Err()
+			},
+		)
+		require.EqualError(t, err, "direct bindings query failed")
+		require.ErrorIs(t, groupContextErr, context.Canceled)
+	})
+}
+
+func TestBindingsFindOptions(t *testing.T) {
+	t.Run("without projection fields fetches the whole documents", func(t *testing.T) {
+		require.Nil(t, bindingsFindOptions(nil).Projection)
+	})
+
+	t.Run("fetches only the projection fields", func(t *testing.T) {
+		findOptions := bindingsFindOptions([]string{"subjects", "roles"})
+		require.Equal(t, bson.D{
+			{Key: "subjects", Value: 1},
+			{Key: "roles", Value: 1},
+			{Key: "bindingId", Value: 1},
+			{Key: "_id", Value: 0},
+		}, findOptions.Projection)
+	})
+
+	t.Run("keeps _id if explicitly requested", func(t *testing.T) {
+		findOptions := bindingsFindOptions([]string{"_id", "roles"})
+		require.Equal(t, bson.D{
+			{Key: "_id", Value: 1},
+			{Key: "roles", Value: 1},
+			{Key: "bindingId", Value: 1},
+		}, findOptions.Projection)
+	})
+
+	t.Run("fetches bindingId with the default projection", func(t *testing.T) {
+		findOptions := bindingsFindOptions(defaultBindingProjectionFields(t))
+		require.Contains(t, findOptions.Projection, bson.E{Key: "bindingId", Value: 1})
+		require.Contains(t, findOptions.Projection, bson.E{Key: "groups", Value: 1})
+	})
+}
+
+func defaultBindingProjectionFields(t *testing.T) []string {
+	t.Helper()
+	for _, variable := range config.EnvVariablesConfig {
+		if variable.Key == config.BindingsProjectionEnvKey {
+			return strings.Split(variable.DefaultValue, ",")
+		}
+	}
+	require.FailNow(t, "missing default of "+config.BindingsProjectionEnvKey)
+	return nil
+}
+
 func TestRolesIDSFromBindings(t *testing.T) {
 	result := RolesIDsFromBindings([]types.Binding{
 		{Roles: []string{"a", "b"}},
@@ -486,11 +835,107 @@ func TestRetrieveUserBindingsAndRoles(t *testing.T) {
 		user, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logger), req, env)
 		require.NoError(t, err)
 		require.Equal(t, types.User{
-			UserID:     "userId",
-			UserGroups: []string{"group1", "group2"},
+			UserID:         "userId",
+			UserGroups:     []string{"group1", "group2"},
+			IdentitySource: "header",
 		}, user)
 	})
 
+	t.Run("extract user from JWT claims", func(t *testing.T) {
+		jwtEnv := env
+		jwtEnv.ParseJWTInput = true
+		jwtEnv.JWTVerificationKey = testJWTSecret
+		jwtEnv.JWTUserIDClaim = "sub"
+		jwtEnv.JWTUserGroupsClaim = "groups"
+		token := "Bearer " + buildJWT(t, `{"sub":"user42","groups":["editors"]}`)
+
+		t.Run("without user id and groups headers", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", token)
+
+			user, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logger), req, jwtEnv)
+			require.NoError(t, err)
+			require.Equal(t, types.User{
+				UserID:         "user42",
+				UserGroups:     []string{"editors"},
+				IdentitySource: "jwt_claim",
+			}, user)
+		})
+
+		t.Run("headers take precedence", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", token)
+			req.Header.Set("thegroupsheader", "group1,group2")
+			req.Header.Set("theuserheader", "userId")
+
+			user, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logger), req, jwtEnv)
+			require.NoError(t, err)
+			require.Equal(t, types.User{
+				UserID:         "userId",
+				UserGroups:     []string{"group1", "group2"},
+				IdentitySource: "header",
+			}, user)
+		})
+
+		t.Run("custom claims", func(t *testing.T) {
+			customEnv := jwtEnv
+			customEnv.JWTUserIDClaim = "uid"
+			customEnv.JWTUserGroupsClaim = "roles"
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+buildJWT(t, `{"sub":"user42","uid":"u1","roles":"admins,editors"}`))
+
+			user, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logger), req, customEnv)
+			require.NoError(t, err)
+			require.Equal(t, "u1", user.UserID)
+			require.Equal(t, []string{"admins", "editors"}, user.UserGroups)
+		})
+
+		t.Run("claims of a token with an invalid signature are ignored", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+signJWTPayload(t, `{"sub":"user42","groups":["admins"]}`, "forged-secret"))
+			req.Header.Set("theuserheader", "userId")
+
+			user, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logger), req, jwtEnv)
+			require.NoError(t, err)
+			require.Equal(t, "userId", user.UserID)
+			require.Equal(t, []string{""}, user.UserGroups, "the groups of a forged token must not be merged")
+		})
+
+		t.Run("claims are ignored without verification key nor upstream verification", func(t *testing.T) {
+			unverifiedEnv := jwtEnv
+			unverifiedEnv.JWTVerificationKey = ""
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", token)
+
+			user, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logger), req, unverifiedEnv)
+			require.NoError(t, err)
+			require.Empty(t, user.UserID)
+			require.Equal(t, []string{""}, user.UserGroups)
+		})
+
+		t.Run("claims of a token verified upstream", func(t *testing.T) {
+			upstreamEnv := jwtEnv
+			upstreamEnv.JWTVerificationKey = ""
+			upstreamEnv.JWTVerifiedUpstream = true
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+signJWTPayload(t, `{"sub":"user42","groups":["editors"]}`, "upstream-secret"))
+
+			user, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logger), req, upstreamEnv)
+			require.NoError(t, err)
+			require.Equal(t, "user42", user.UserID)
+			require.Equal(t, []string{"editors"}, user.UserGroups)
+		})
+
+		t.Run("claims are ignored when JWT input parsing is disabled", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", token)
+
+			user, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logger), req, env)
+			require.NoError(t, err)
+			require.Empty(t, user.UserID)
+		})
+	})
+
 	t.Run("extract user with no id in headers does not perform queries", func(t *testing.T) {
 		mock := mocks.MongoClientMock{
 			UserBindingsError: fmt.Errorf("some error"),
@@ -551,8 +996,9 @@ func TestRetrieveUserBindingsAndRoles(t *testing.T) {
 		user, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logrus.New()), req, env)
 		require.NoError(t, err)
 		require.Equal(t, types.User{
-			UserID:     "userId",
-			UserGroups: []string{"group1", "group2"},
+			UserID:         "userId",
+			UserGroups:     []string{"group1", "group2"},
+			IdentitySource: "header",
 			UserBindings: []types.Binding{
 				{Roles: []string{"r1", "r2"}},
 				{Roles: []string{"r3"}},
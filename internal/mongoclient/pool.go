@@ -0,0 +1,85 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongoclient
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/rond-authz/rond/internal/config"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PoolStats reports the usage of the MongoDB connection pool.
+type PoolStats struct {
+	CheckedOut int64 `json:"checkedOut"`
+	Available  int64 `json:"available"`
+}
+
+// poolMonitor keeps track of the connections of the pool through the driver pool events.
+type poolMonitor struct {
+	open       int64
+	checkedOut int64
+}
+
+func (monitor *poolMonitor) event(poolEvent *event.PoolEvent) {
+	switch poolEvent.Type {
+	case event.ConnectionCreated:
+		atomic.AddInt64(&monitor.open, 1)
+	case event.ConnectionClosed:
+		atomic.AddInt64(&monitor.open, -1)
+	case event.GetSucceeded:
+		atomic.AddInt64(&monitor.checkedOut, 1)
+	case event.ConnectionReturned:
+		atomic.AddInt64(&monitor.checkedOut, -1)
+	}
+}
+
+func (monitor *poolMonitor) stats() PoolStats {
+	checkedOut := atomic.LoadInt64(&monitor.checkedOut)
+	return PoolStats{
+		CheckedOut: checkedOut,
+		Available:  atomic.LoadInt64(&monitor.open) - checkedOut,
+	}
+}
+
+// clientOptions builds the MongoDB client options, tuning the connection pool
+// with the configured environment variables.
+func clientOptions(env config.EnvironmentVariables, monitor *poolMonitor) *options.ClientOptions {
+	clientOpts := options.Client().
+		ApplyURI(env.MongoDBUrl).
+		SetMaxPoolSize(env.MongoMaxPoolSize).
+		SetMinPoolSize(env.MongoMinPoolSize).
+		SetMaxConnecting(env.MongoMaxConnecting).
+		SetPoolMonitor(&event.PoolMonitor{Event: monitor.event})
+	if env.MongoSocketTimeoutMs > 0 {
+		clientOpts.SetSocketTimeout(time.Duration(env.MongoSocketTimeoutMs) * time.Millisecond)
+	}
+	return clientOpts
+}
+
+// PoolStats returns the current usage of the connection pool.
+func (mongoClient *MongoClient) PoolStats() PoolStats {
+	if mongoClient == nil {
+		return PoolStats{}
+	}
+	mongoClient.mu.RLock()
+	defer mongoClient.mu.RUnlock()
+	if mongoClient.pool == nil {
+		return PoolStats{}
+	}
+	return mongoClient.pool.stats()
+}
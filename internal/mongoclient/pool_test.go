@@ -0,0 +1,92 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongoclient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+func TestClientOptions(t *testing.T) {
+	env := config.EnvironmentVariables{
+		MongoDBUrl:           "mongodb://localhost:27017/test",
+		MongoMaxPoolSize:     500,
+		MongoMinPoolSize:     10,
+		MongoMaxConnecting:   5,
+		MongoSocketTimeoutMs: 3000,
+	}
+
+	t.Run("applies the pool configuration", func(t *testing.T) {
+		clientOpts := clientOptions(env, &poolMonitor{})
+		require.NoError(t, clientOpts.Validate())
+		require.Equal(t, []string{"localhost:27017"}, clientOpts.Hosts)
+		require.Equal(t, uint64(500), *clientOpts.MaxPoolSize)
+		require.Equal(t, uint64(10), *clientOpts.MinPoolSize)
+		require.Equal(t, uint64(5), *clientOpts.MaxConnecting)
+		require.Equal(t, 3*time.Second, *clientOpts.SocketTimeout)
+		require.NotNil(t, clientOpts.PoolMonitor)
+	})
+
+	t.Run("socket timeout is not set by default", func(t *testing.T) {
+		env := env
+		env.MongoSocketTimeoutMs = 0
+		clientOpts := clientOptions(env, &poolMonitor{})
+		require.Nil(t, clientOpts.SocketTimeout)
+	})
+
+	t.Run("pool monitor receives the pool events", func(t *testing.T) {
+		monitor := &poolMonitor{}
+		clientOpts := clientOptions(env, monitor)
+		clientOpts.PoolMonitor.Event(&event.PoolEvent{Type: event.ConnectionCreated})
+		clientOpts.PoolMonitor.Event(&event.PoolEvent{Type: event.GetSucceeded})
+		require.Equal(t, PoolStats{CheckedOut: 1, Available: 0}, monitor.stats())
+	})
+}
+
+func TestPoolMonitor(t *testing.T) {
+	monitor := &poolMonitor{}
+	for _, eventType := range []string{
+		event.PoolCreated,
+		event.ConnectionCreated,
+		event.ConnectionCreated,
+		event.ConnectionCreated,
+		event.GetStarted,
+		event.GetSucceeded,
+		event.GetStarted,
+		event.GetSucceeded,
+		event.GetStarted,
+		event.GetFailed,
+		event.ConnectionReturned,
+	} {
+		monitor.event(&event.PoolEvent{Type: eventType})
+	}
+	require.Equal(t, PoolStats{CheckedOut: 1, Available: 2}, monitor.stats())
+
+	monitor.event(&event.PoolEvent{Type: event.ConnectionClosed})
+	require.Equal(t, PoolStats{CheckedOut: 1, Available: 1}, monitor.stats())
+
+	t.Run("MongoClient exposes the pool stats", func(t *testing.T) {
+		require.Equal(t, PoolStats{CheckedOut: 1, Available: 1}, (&MongoClient{pool: monitor}).PoolStats())
+	})
+
+	t.Run("empty stats without MongoClient", func(t *testing.T) {
+		var mongoClient *MongoClient
+		require.Equal(t, PoolStats{}, mongoClient.PoolStats())
+	})
+}
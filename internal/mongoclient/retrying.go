@@ -0,0 +1,174 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongoclient
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rond-authz/rond/types"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RetryingMongoClient decorates a MongoDB client retrying once the operations failed with
+// a network error, after reconnecting. When the retry fails too, the original error is
+// returned.
+type RetryingMongoClient struct {
+	client    types.IMongoClient
+	reconnect func() error
+	logger    *logrus.Logger
+
+	// mu serializes the reconnections, attempts counts them so that the operations failed
+	// while a reconnection was in progress do not reconnect again.
+	mu       sync.Mutex
+	attempts uint64
+}
+
+func NewRetryingMongoClient(client types.IMongoClient, reconnect func() error, logger *logrus.Logger) *RetryingMongoClient {
+	return &RetryingMongoClient{
+		client:    client,
+		reconnect: reconnect,
+		logger:    logger,
+	}
+}
+
+// retry runs the operation, running it once more after reconnecting when it fails with a
+// network error.
+func (retrying *RetryingMongoClient) retry(ctx context.Context, operation func() error) error {
+	retrying.mu.Lock()
+	attempts := retrying.attempts
+	retrying.mu.Unlock()
+
+	err := operation()
+	if err == nil || !mongo.IsNetworkError(err) || ctx.Err() != nil {
+		return err
+	}
+
+	retrying.mu.Lock()
+	if retrying.attempts == attempts {
+		retrying.attempts++
+		retrying.logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("MongoDB network error, reconnecting")
+		if reconnectErr := retrying.reconnect(); reconnectErr != nil {
+			retrying.mu.Unlock()
+			retrying.logger.WithField("error", logrus.Fields{"message": reconnectErr.Error()}).Error("failed MongoDB reconnection")
+			return err
+		}
+	}
+	retrying.mu.Unlock()
+
+	if retryErr := operation(); retryErr != nil {
+		return err
+	}
+	return nil
+}
+
+func (retrying *RetryingMongoClient) Disconnect() error {
+	return retrying.client.Disconnect()
+}
+
+func (retrying *RetryingMongoClient) RetrieveUserBindings(ctx context.Context, user *types.User) ([]types.Binding, error) {
+	var bindings []types.Binding
+	err := retrying.retry(ctx, func() (err error) {
+		bindings, err = retrying.client.RetrieveUserBindings(ctx, user)
+		return err
+	})
+	return bindings, err
+}
+
+func (retrying *RetryingMongoClient) RetrieveRoles(ctx context.Context) ([]types.Role, error) {
+	var roles []types.Role
+	err := retrying.retry(ctx, func() (err error) {
+		roles, err = retrying.client.RetrieveRoles(ctx)
+		return err
+	})
+	return roles, err
+}
+
+func (retrying *RetryingMongoClient) RetrieveUserRolesByRolesID(ctx context.Context, userRolesId []string) ([]types.Role, error) {
+	var roles []types.Role
+	err := retrying.retry(ctx, func() (err error) {
+		roles, err = retrying.client.RetrieveUserRolesByRolesID(ctx, userRolesId)
+		return err
+	})
+	return roles, err
+}
+
+func (retrying *RetryingMongoClient) FindOne(ctx context.Context, collectionName string, query map[string]interface{}) (interface{}, error) {
+	var result interface{}
+	err := retrying.retry(ctx, func() (err error) {
+		result, err = retrying.client.FindOne(ctx, collectionName, query)
+		return err
+	})
+	return result, err
+}
+
+func (retrying *RetryingMongoClient) FindMany(ctx context.Context, collectionName string, query map[string]interface{}) ([]interface{}, error) {
+	var results []interface{}
+	err := retrying.retry(ctx, func() (err error) {
+		results, err = retrying.client.FindMany(ctx, collectionName, query)
+		return err
+	})
+	return results, err
+}
+
+func (retrying *RetryingMongoClient) FindAggregate(ctx context.Context, collectionName string, pipeline []interface{}) ([]interface{}, error) {
+	var results []interface{}
+	err := retrying.retry(ctx, func() (err error) {
+		results, err = retrying.client.FindAggregate(ctx, collectionName, pipeline)
+		return err
+	})
+	return results, err
+}
+
+func (retrying *RetryingMongoClient) FindBindings(ctx context.Context, filter map[string]interface{}) ([]types.Binding, error) {
+	var bindings []types.Binding
+	err := retrying.retry(ctx, func() (err error) {
+		bindings, err = retrying.client.FindBindings(ctx, filter)
+		return err
+	})
+	return bindings, err
+}
+
+func (retrying *RetryingMongoClient) UpsertBinding(ctx context.Context, binding types.Binding) error {
+	return retrying.retry(ctx, func() error {
+		return retrying.client.UpsertBinding(ctx, binding)
+	})
+}
+
+func (retrying *RetryingMongoClient) DeleteBindings(ctx context.Context, bindingIDs []string) (int64, error) {
+	var deletedCount int64
+	err := retrying.retry(ctx, func() (err error) {
+		deletedCount, err = retrying.client.DeleteBindings(ctx, bindingIDs)
+		return err
+	})
+	return deletedCount, err
+}
+
+func (retrying *RetryingMongoClient) UpdateBindingsSubjects(ctx context.Context, bindings []types.Binding) (int64, error) {
+	var updatedCount int64
+	err := retrying.retry(ctx, func() (err error) {
+		updatedCount, err = retrying.client.UpdateBindingsSubjects(ctx, bindings)
+		return err
+	})
+	return updatedCount, err
+}
+
+// InsertAuditEntries is not retried, since the entries may have been written even if the
+// connection was lost before the reply.
+func (retrying *RetryingMongoClient) InsertAuditEntries(ctx context.Context, entries []types.AuditEntry) error {
+	return retrying.client.InsertAuditEntries(ctx, entries)
+}
@@ -0,0 +1,180 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongoclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/rond-authz/rond/types"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// failingMongoClient returns the queued errors, a nil one meaning success, on the first
+// calls, then succeeds.
+type failingMongoClient struct {
+	types.IMongoClient
+	errs  []error
+	calls int
+}
+
+func (client *failingMongoClient) nextError() error {
+	client.calls++
+	if len(client.errs) == 0 {
+		return nil
+	}
+	err := client.errs[0]
+	client.errs = client.errs[1:]
+	return err
+}
+
+func (client *failingMongoClient) RetrieveUserBindings(ctx context.Context, user *types.User) ([]types.Binding, error) {
+	if err := client.nextError(); err != nil {
+		return nil, err
+	}
+	return []types.Binding{{BindingID: "binding1", Subjects: []string{user.UserID}}}, nil
+}
+
+func (client *failingMongoClient) FindMany(ctx context.Context, collectionName string, query map[string]interface{}) ([]interface{}, error) {
+	if err := client.nextError(); err != nil {
+		return nil, err
+	}
+	return []interface{}{map[string]interface{}{"collection": collectionName}}, nil
+}
+
+func (client *failingMongoClient) InsertAuditEntries(ctx context.Context, entries []types.AuditEntry) error {
+	return client.nextError()
+}
+
+// concurrentOperationMongoClient runs an operation during the first RetrieveUserBindings call.
+type concurrentOperationMongoClient struct {
+	*failingMongoClient
+	concurrentOperation func()
+}
+
+func (client *concurrentOperationMongoClient) RetrieveUserBindings(ctx context.Context, user *types.User) ([]types.Binding, error) {
+	if client.concurrentOperation != nil {
+		concurrentOperation := client.concurrentOperation
+		client.concurrentOperation = nil
+		concurrentOperation()
+	}
+	return client.failingMongoClient.RetrieveUserBindings(ctx, user)
+}
+
+func TestRetryingMongoClient(t *testing.T) {
+	networkError := mongo.CommandError{Message: "connection reset by peer", Labels: []string{"NetworkError"}}
+	log, _ := test.NewNullLogger()
+	user := &types.User{UserID: "user1"}
+
+	t.Run("retries after reconnecting on network errors", func(t *testing.T) {
+		client := &failingMongoClient{errs: []error{networkError}}
+		reconnections := 0
+		retrying := NewRetryingMongoClient(client, func() error {
+			reconnections++
+			return nil
+		}, log)
+
+		bindings, err := retrying.RetrieveUserBindings(context.Background(), user)
+		require.NoError(t, err)
+		require.Equal(t, []types.Binding{{BindingID: "binding1", Subjects: []string{"user1"}}}, bindings)
+		require.Equal(t, 2, client.calls)
+		require.Equal(t, 1, reconnections)
+
+		client.errs = []error{networkError}
+		results, err := retrying.FindMany(context.Background(), "projects", nil)
+		require.NoError(t, err)
+		require.Equal(t, []interface{}{map[string]interface{}{"collection": "projects"}}, results)
+		require.Equal(t, 4, client.calls)
+		require.Equal(t, 2, reconnections)
+	})
+
+	t.Run("operations failed during a reconnection do not reconnect again", func(t *testing.T) {
+		client := &failingMongoClient{errs: []error{networkError, nil, networkError}}
+		reconnections := 0
+		retrying := NewRetryingMongoClient(client, func() error {
+			reconnections++
+			return nil
+		}, log)
+
+		// the FindMany fails and reconnects while the RetrieveUserBindings is running
+		concurrentClient := &concurrentOperationMongoClient{failingMongoClient: client, concurrentOperation: func() {
+			_, err := retrying.FindMany(context.Background(), "projects", nil)
+			require.NoError(t, err)
+		}}
+		retrying.client = concurrentClient
+
+		bindings, err := retrying.RetrieveUserBindings(context.Background(), user)
+		require.NoError(t, err)
+		require.Len(t, bindings, 1)
+		require.Equal(t, 1, reconnections)
+	})
+
+	t.Run("returns the original error when the retry fails", func(t *testing.T) {
+		client := &failingMongoClient{errs: []error{networkError, errors.New("retry error")}}
+		retrying := NewRetryingMongoClient(client, func() error { return nil }, log)
+
+		_, err := retrying.RetrieveUserBindings(context.Background(), user)
+		require.Equal(t, networkError, err)
+		require.Equal(t, 2, client.calls)
+	})
+
+	t.Run("does not retry when the reconnection fails", func(t *testing.T) {
+		client := &failingMongoClient{errs: []error{networkError}}
+		retrying := NewRetryingMongoClient(client, func() error { return errors.New("server selection timeout") }, log)
+
+		_, err := retrying.RetrieveUserBindings(context.Background(), user)
+		require.Equal(t, networkError, err)
+		require.Equal(t, 1, client.calls)
+	})
+
+	t.Run("does not retry the other errors", func(t *testing.T) {
+		otherError := mongo.CommandError{Message: "unauthorized", Code: 13}
+		client := &failingMongoClient{errs: []error{otherError}}
+		reconnections := 0
+		retrying := NewRetryingMongoClient(client, func() error {
+			reconnections++
+			return nil
+		}, log)
+
+		_, err := retrying.RetrieveUserBindings(context.Background(), user)
+		require.Equal(t, otherError, err)
+		require.Equal(t, 1, client.calls)
+		require.Zero(t, reconnections)
+	})
+
+	t.Run("does not retry when the context is done", func(t *testing.T) {
+		client := &failingMongoClient{errs: []error{networkError}}
+		retrying := NewRetryingMongoClient(client, func() error { return nil }, log)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := retrying.RetrieveUserBindings(ctx, user)
+		require.Equal(t, networkError, err)
+		require.Equal(t, 1, client.calls)
+	})
+
+	t.Run("does not retry the audit entries insert", func(t *testing.T) {
+		client := &failingMongoClient{errs: []error{networkError}}
+		retrying := NewRetryingMongoClient(client, func() error { return nil }, log)
+
+		err := retrying.InsertAuditEntries(context.Background(), []types.AuditEntry{{}})
+		require.Equal(t, networkError, err)
+		require.Equal(t, 1, client.calls)
+	})
+}
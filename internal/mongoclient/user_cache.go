@@ -0,0 +1,113 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongoclient
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/rond-authz/rond/types"
+)
+
+type userCacheKey struct{}
+
+// userCache holds the user retrieved for a request, so that the request and the response
+// flows share the same bindings and roles instead of querying MongoDB twice.
+type userCache struct {
+	mtx   sync.Mutex
+	user  types.User
+	found bool
+
+	// the user id is resolved before the user is retrieved, e.g. by the rate limiter, so it
+	// has its own lock: the user retrieval resolves it while holding mtx
+	identityMtx    sync.Mutex
+	userID         string
+	identitySource string
+	identityFound  bool
+}
+
+// WithUserCache returns a context holding a new, empty cache for the user of the request,
+// unless the context already holds one.
+func WithUserCache(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(userCacheKey{}).(*userCache); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, userCacheKey{}, &userCache{})
+}
+
+// UserCacheMiddleware injects into the request context the cache of the user, so that the
+// user retrieved evaluating the policies is available to the middlewares wrapping them.
+func UserCacheMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(WithUserCache(r.Context())))
+	})
+}
+
+// cachedUser returns the user from the cache in context, running fetch and caching its result
+// when the user has not been retrieved yet. Without a cache in context fetch is always run.
+func cachedUser(ctx context.Context, fetch func() (types.User, error)) (types.User, error) {
+	cache, ok := ctx.Value(userCacheKey{}).(*userCache)
+	if !ok {
+		return fetch()
+	}
+
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	if cache.found {
+		return cache.user, nil
+	}
+	user, err := fetch()
+	if err != nil {
+		return types.User{}, err
+	}
+	cache.user, cache.found = user, true
+	return user, nil
+}
+
+// cachedUserID returns the user id and its source from the cache in context, running resolve
+// and caching its result when the user id has not been resolved yet. Without a cache in
+// context resolve is always run.
+func cachedUserID(ctx context.Context, resolve func() (string, string, error)) (string, string, error) {
+	cache, ok := ctx.Value(userCacheKey{}).(*userCache)
+	if !ok {
+		return resolve()
+	}
+
+	cache.identityMtx.Lock()
+	defer cache.identityMtx.Unlock()
+	if cache.identityFound {
+		return cache.userID, cache.identitySource, nil
+	}
+	userID, identitySource, err := resolve()
+	if err != nil {
+		return "", "", err
+	}
+	cache.userID, cache.identitySource, cache.identityFound = userID, identitySource, true
+	return userID, identitySource, nil
+}
+
+// ResolvedUser returns the user already retrieved for the request, reporting false when the
+// request context holds no cache or the user has not been retrieved, e.g. because no policy
+// has been evaluated.
+func ResolvedUser(ctx context.Context) (types.User, bool) {
+	cache, ok := ctx.Value(userCacheKey{}).(*userCache)
+	if !ok {
+		return types.User{}, false
+	}
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	return cache.user, cache.found
+}
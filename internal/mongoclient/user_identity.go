@@ -0,0 +1,193 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongoclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/jwt"
+	"github.com/rond-authz/rond/types"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const bearerPrefix = "bearer "
+
+// ResolveUserID returns the id of the user performing the request and the type of
+// the source it has been read from. Sources are tried in the configured order and
+// the first non-empty user id wins. If the request context holds a user cache, the
+// user id is resolved only once.
+func ResolveUserID(ctx context.Context, req *http.Request, env config.EnvironmentVariables, mongoClient types.IMongoClient) (string, string, error) {
+	return cachedUserID(ctx, func() (string, string, error) {
+		for _, source := range env.GetUserIDSources() {
+			userID, err := resolveUserIDFromSource(ctx, req, env, mongoClient, source)
+			if err != nil {
+				return "", "", err
+			}
+			if userID != "" {
+				return userID, source.Type, nil
+			}
+		}
+		return "", "", nil
+	})
+}
+
+func resolveUserIDFromSource(ctx context.Context, req *http.Request, env config.EnvironmentVariables, mongoClient types.IMongoClient, source config.UserIDSource) (string, error) {
+	switch source.Type {
+	case config.UserIDSourceHeader:
+		return req.Header.Get(source.ConfigOrDefault("name", env.UserIdHeader)), nil
+	case config.UserIDSourceJWTClaim:
+		token := req.Header.Get(source.ConfigOrDefault("header", "Authorization"))
+		return userIDFromJWTClaim(ctx, env, token, source.ConfigOrDefault("claim", "sub")), nil
+	case config.UserIDSourceAPIKey:
+		apiKey := req.Header.Get(source.ConfigOrDefault("header", "x-api-key"))
+		return userIDFromAPIKey(ctx, mongoClient, apiKey, source)
+	}
+	return "", fmt.Errorf("unknown user id source type %s", source.Type)
+}
+
+func userIDFromJWTClaim(ctx context.Context, env config.EnvironmentVariables, token, claim string) string {
+	userID, _ := jwtClaims(ctx, env, token)[claim].(string)
+	return userID
+}
+
+// userFromJWTClaims completes the user with the claims of the bearer JWT when PARSE_JWT_INPUT
+// is enabled, once the token is verified, see jwtClaims. The user id and groups read from the
+// request headers take precedence.
+func userFromJWTClaims(ctx context.Context, req *http.Request, env config.EnvironmentVariables, user *types.User) {
+	if !env.ParseJWTInput {
+		return
+	}
+	claims := jwtClaims(ctx, env, req.Header.Get("Authorization"))
+	if claims == nil {
+		return
+	}
+
+	if user.UserID == "" {
+		if userID, _ := claims[env.JWTUserIDClaim].(string); userID != "" {
+			user.UserID = userID
+			user.IdentitySource = config.UserIDSourceJWTClaim
+		}
+	}
+	if req.Header.Get(env.UserGroupsHeader) == "" {
+		if groups := groupsFromJWTClaim(claims[env.JWTUserGroupsClaim]); len(groups) > 0 {
+			user.UserGroups = groups
+		}
+	}
+}
+
+// groupsFromJWTClaim reads the groups from a claim holding either an array of strings or
+// a comma separated string, as the groups header.
+func groupsFromJWTClaim(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		if value == "" {
+			return nil
+		}
+		return strings.Split(value, ",")
+	case []interface{}:
+		groups := make([]string, 0, len(value))
+		for _, group := range value {
+			if group, ok := group.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+// jwtClaims returns the claims of the bearer JWT verified with JWT_VERIFICATION_KEY, or
+// decoded without verification when JWT_VERIFIED_UPSTREAM states that the token is verified
+// upstream. It returns nil if the token is missing, malformed or not valid, and when neither
+// is set, so that the claims of a token nobody verified are never trusted.
+func jwtClaims(ctx context.Context, env config.EnvironmentVariables, token string) map[string]interface{} {
+	if len(token) > len(bearerPrefix) && strings.EqualFold(token[:len(bearerPrefix)], bearerPrefix) {
+		token = token[len(bearerPrefix):]
+	}
+	if token == "" {
+		return nil
+	}
+
+	switch {
+	case env.JWTVerificationKey != "":
+		claims, err := jwt.Verify(token, env.JWTVerificationKey, time.Now())
+		if err != nil {
+			glogger.Get(ctx).WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed JWT verification")
+			return nil
+		}
+		return claims
+	case env.JWTVerifiedUpstream:
+		return decodeJWTClaims(ctx, token)
+	}
+	return nil
+}
+
+// decodeJWTClaims decodes the claims of the token, without verifying its signature.
+func decodeJWTClaims(ctx context.Context, token string) map[string]interface{} {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		glogger.Get(ctx).WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed JWT payload decode")
+		return nil
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		glogger.Get(ctx).WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed JWT claims unmarshal")
+		return nil
+	}
+	return claims
+}
+
+// HashAPIKey returns the hex-encoded SHA-256 hash of the API key, as stored in the api keys collection.
+func HashAPIKey(apiKey string) string {
+	hash := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(hash[:])
+}
+
+func userIDFromAPIKey(ctx context.Context, mongoClient types.IMongoClient, apiKey string, source config.UserIDSource) (string, error) {
+	if apiKey == "" || mongoClient == nil {
+		return "", nil
+	}
+
+	collectionName := source.ConfigOrDefault("collection", "api_keys")
+	result, err := mongoClient.FindOne(ctx, collectionName, map[string]interface{}{
+		source.ConfigOrDefault("hashField", "keyHash"): HashAPIKey(apiKey),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed API key retrieval: %s", err.Error())
+	}
+
+	apiKeyDocument, ok := result.(map[string]interface{})
+	if !ok {
+		return "", nil
+	}
+	userID, _ := apiKeyDocument[source.ConfigOrDefault("userIdField", "userId")].(string)
+	return userID, nil
+}
@@ -0,0 +1,278 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongoclient
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mocks"
+	"github.com/rond-authz/rond/internal/testutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testJWTSecret = "test-jwt-secret"
+
+// buildJWT returns a token with payload signed with testJWTSecret.
+func buildJWT(t *testing.T, payload string) string {
+	t.Helper()
+	return signJWTPayload(t, payload, testJWTSecret)
+}
+
+func signJWTPayload(t *testing.T, payload, secret string) string {
+	t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	signingInput := fmt.Sprintf("%s.%s", header, base64.RawURLEncoding.EncodeToString([]byte(payload)))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(testutils.HS256Signer(secret)([]byte(signingInput)))
+}
+
+func TestResolveUserID(t *testing.T) {
+	ctx := context.Background()
+	apiKeyMock := func(t *testing.T) mocks.MongoClientMock {
+		return mocks.MongoClientMock{
+			FindOneResult: map[string]interface{}{"userId": "api-key-user"},
+			FindOneExpectation: func(collectionName string, query interface{}) {
+				require.Equal(t, "api_keys", collectionName)
+				require.Equal(t, map[string]interface{}{"keyHash": HashAPIKey("my-api-key")}, query)
+			},
+		}
+	}
+
+	t.Run("header source", func(t *testing.T) {
+		env := config.EnvironmentVariables{
+			UserIdHeader:  "miauserid",
+			UserIDSources: []config.UserIDSource{{Type: config.UserIDSourceHeader}},
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("miauserid", "header-user")
+
+		userID, sourceType, err := ResolveUserID(ctx, req, env, nil)
+		require.NoError(t, err)
+		require.Equal(t, "header-user", userID)
+		require.Equal(t, config.UserIDSourceHeader, sourceType)
+	})
+
+	t.Run("header source with custom header name", func(t *testing.T) {
+		env := config.EnvironmentVariables{
+			UserIDSources: []config.UserIDSource{{Type: config.UserIDSourceHeader, Config: map[string]string{"name": "x-user"}}},
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("x-user", "header-user")
+
+		userID, _, err := ResolveUserID(ctx, req, env, nil)
+		require.NoError(t, err)
+		require.Equal(t, "header-user", userID)
+	})
+
+	t.Run("header source is used by default", func(t *testing.T) {
+		env := config.EnvironmentVariables{UserIdHeader: "miauserid"}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("miauserid", "header-user")
+
+		userID, sourceType, err := ResolveUserID(ctx, req, env, nil)
+		require.NoError(t, err)
+		require.Equal(t, "header-user", userID)
+		require.Equal(t, config.UserIDSourceHeader, sourceType)
+	})
+
+	t.Run("jwt_claim source", func(t *testing.T) {
+		env := config.EnvironmentVariables{
+			UserIDSources:      []config.UserIDSource{{Type: config.UserIDSourceJWTClaim}},
+			JWTVerificationKey: testJWTSecret,
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+buildJWT(t, `{"sub":"jwt-user"}`))
+
+		userID, sourceType, err := ResolveUserID(ctx, req, env, nil)
+		require.NoError(t, err)
+		require.Equal(t, "jwt-user", userID)
+		require.Equal(t, config.UserIDSourceJWTClaim, sourceType)
+	})
+
+	t.Run("jwt_claim source with custom header and claim", func(t *testing.T) {
+		env := config.EnvironmentVariables{
+			UserIDSources:      []config.UserIDSource{{Type: config.UserIDSourceJWTClaim, Config: map[string]string{"header": "x-token", "claim": "uid"}}},
+			JWTVerificationKey: testJWTSecret,
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("x-token", buildJWT(t, `{"sub":"jwt-user","uid":"custom-user"}`))
+
+		userID, _, err := ResolveUserID(ctx, req, env, nil)
+		require.NoError(t, err)
+		require.Equal(t, "custom-user", userID)
+	})
+
+	t.Run("jwt_claim source with malformed token", func(t *testing.T) {
+		env := config.EnvironmentVariables{
+			UserIDSources:      []config.UserIDSource{{Type: config.UserIDSourceJWTClaim}},
+			JWTVerificationKey: testJWTSecret,
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer not.a-valid!.token")
+
+		userID, sourceType, err := ResolveUserID(ctx, req, env, nil)
+		require.NoError(t, err)
+		require.Empty(t, userID)
+		require.Empty(t, sourceType)
+	})
+
+	t.Run("jwt_claim source ignores a token with an invalid signature", func(t *testing.T) {
+		env := config.EnvironmentVariables{
+			UserIDSources:      []config.UserIDSource{{Type: config.UserIDSourceJWTClaim}},
+			JWTVerificationKey: testJWTSecret,
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+signJWTPayload(t, `{"sub":"admin"}`, "forged-secret"))
+
+		userID, sourceType, err := ResolveUserID(ctx, req, env, nil)
+		require.NoError(t, err)
+		require.Empty(t, userID)
+		require.Empty(t, sourceType)
+	})
+
+	t.Run("jwt_claim source trusts the token verified upstream", func(t *testing.T) {
+		env := config.EnvironmentVariables{
+			UserIDSources:       []config.UserIDSource{{Type: config.UserIDSourceJWTClaim}},
+			JWTVerifiedUpstream: true,
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+signJWTPayload(t, `{"sub":"jwt-user"}`, "upstream-secret"))
+
+		userID, _, err := ResolveUserID(ctx, req, env, nil)
+		require.NoError(t, err)
+		require.Equal(t, "jwt-user", userID)
+	})
+
+	t.Run("jwt_claim source without verification key nor upstream verification", func(t *testing.T) {
+		env := config.EnvironmentVariables{
+			UserIDSources: []config.UserIDSource{{Type: config.UserIDSourceJWTClaim}},
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+buildJWT(t, `{"sub":"jwt-user"}`))
+
+		userID, _, err := ResolveUserID(ctx, req, env, nil)
+		require.NoError(t, err)
+		require.Empty(t, userID)
+	})
+
+	t.Run("api_key source", func(t *testing.T) {
+		env := config.EnvironmentVariables{
+			UserIDSources: []config.UserIDSource{{Type: config.UserIDSourceAPIKey}},
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("x-api-key", "my-api-key")
+
+		userID, sourceType, err := ResolveUserID(ctx, req, env, apiKeyMock(t))
+		require.NoError(t, err)
+		require.Equal(t, "api-key-user", userID)
+		require.Equal(t, config.UserIDSourceAPIKey, sourceType)
+	})
+
+	t.Run("api_key source with unknown key", func(t *testing.T) {
+		env := config.EnvironmentVariables{
+			UserIDSources: []config.UserIDSource{{Type: config.UserIDSourceAPIKey}},
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("x-api-key", "my-api-key")
+		mock := apiKeyMock(t)
+		mock.FindOneResult = nil
+
+		userID, _, err := ResolveUserID(ctx, req, env, mock)
+		require.NoError(t, err)
+		require.Empty(t, userID)
+	})
+
+	t.Run("api_key source fails on MongoDB error", func(t *testing.T) {
+		env := config.EnvironmentVariables{
+			UserIDSources: []config.UserIDSource{{Type: config.UserIDSourceAPIKey}},
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("x-api-key", "my-api-key")
+		mock := apiKeyMock(t)
+		mock.FindOneError = fmt.Errorf("some error")
+
+		_, _, err := ResolveUserID(ctx, req, env, mock)
+		require.EqualError(t, err, "failed API key retrieval: some error")
+	})
+
+	t.Run("api_key source is resolved once with the user cache", func(t *testing.T) {
+		env := config.EnvironmentVariables{
+			UserIDSources: []config.UserIDSource{{Type: config.UserIDSourceAPIKey}},
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("x-api-key", "my-api-key")
+		cacheCtx := WithUserCache(ctx)
+		mock := apiKeyMock(t)
+
+		userID, _, err := ResolveUserID(cacheCtx, req, env, mock)
+		require.NoError(t, err)
+		require.Equal(t, "api-key-user", userID)
+
+		mock.FindOneError = fmt.Errorf("some error")
+		userID, sourceType, err := ResolveUserID(cacheCtx, req, env, mock)
+		require.NoError(t, err)
+		require.Equal(t, "api-key-user", userID)
+		require.Equal(t, config.UserIDSourceAPIKey, sourceType)
+	})
+
+	t.Run("sources are resolved in priority order", func(t *testing.T) {
+		env := config.EnvironmentVariables{
+			UserIdHeader: "miauserid",
+			UserIDSources: []config.UserIDSource{
+				{Type: config.UserIDSourceAPIKey},
+				{Type: config.UserIDSourceJWTClaim},
+				{Type: config.UserIDSourceHeader},
+			},
+			JWTVerificationKey: testJWTSecret,
+		}
+
+		t.Run("first source wins", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("x-api-key", "my-api-key")
+			req.Header.Set("Authorization", "Bearer "+buildJWT(t, `{"sub":"jwt-user"}`))
+			req.Header.Set("miauserid", "header-user")
+
+			userID, sourceType, err := ResolveUserID(ctx, req, env, apiKeyMock(t))
+			require.NoError(t, err)
+			require.Equal(t, "api-key-user", userID)
+			require.Equal(t, config.UserIDSourceAPIKey, sourceType)
+		})
+
+		t.Run("empty sources are skipped", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("miauserid", "header-user")
+
+			userID, sourceType, err := ResolveUserID(ctx, req, env, apiKeyMock(t))
+			require.NoError(t, err)
+			require.Equal(t, "header-user", userID)
+			require.Equal(t, config.UserIDSourceHeader, sourceType)
+		})
+
+		t.Run("no source resolves the user", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+			userID, sourceType, err := ResolveUserID(ctx, req, env, apiKeyMock(t))
+			require.NoError(t, err)
+			require.Empty(t, userID)
+			require.Empty(t, sourceType)
+		})
+	})
+}
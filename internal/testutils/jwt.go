@@ -0,0 +1,96 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// EncodeJWTSegment returns the base64url encoding of the JSON of v, as a JWT segment.
+func EncodeJWTSegment(t *testing.T, v interface{}) string {
+	t.Helper()
+	bytes, err := json.Marshal(v)
+	require.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// SignJWT returns the token with header and claims, signed by sign.
+func SignJWT(t *testing.T, header, claims map[string]interface{}, sign func(signingInput []byte) []byte) string {
+	t.Helper()
+	signingInput := EncodeJWTSegment(t, header) + "." + EncodeJWTSegment(t, claims)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signingInput)))
+}
+
+func RS256Signer(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+	return func(signingInput []byte) []byte {
+		hashed := crypto.SHA256.New()
+		hashed.Write(signingInput)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed.Sum(nil))
+		require.NoError(t, err)
+		return signature
+	}
+}
+
+func ES256Signer(t *testing.T, key *ecdsa.PrivateKey) func([]byte) []byte {
+	return func(signingInput []byte) []byte {
+		hashed := crypto.SHA256.New()
+		hashed.Write(signingInput)
+		r, s, err := ecdsa.Sign(rand.Reader, key, hashed.Sum(nil))
+		require.NoError(t, err)
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature
+	}
+}
+
+func HS256Signer(secret string) func([]byte) []byte {
+	return func(signingInput []byte) []byte {
+		mac := hmac.New(crypto.SHA256.New, []byte(secret))
+		mac.Write(signingInput)
+		return mac.Sum(nil)
+	}
+}
+
+func RSAJWK(kid string, key *rsa.PublicKey) map[string]interface{} {
+	return map[string]interface{}{
+		"kid": kid,
+		"kty": "RSA",
+		"alg": "RS256",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ECJWK(kid string, key *ecdsa.PublicKey) map[string]interface{} {
+	return map[string]interface{}{
+		"kid": kid,
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
@@ -149,6 +149,7 @@ func PopulateDBForTesting(
 	rolesCollection.DeleteMany(ctx, bson.D{})
 	rolesCollection.InsertMany(ctx, roles)
 
+	expiredAt := time.Now().Add(-time.Hour)
 	bindings := []interface{}{
 		types.Binding{
 			BindingID:         "binding1",
@@ -216,6 +217,14 @@ func PopulateDBForTesting(
 			Permissions:       []string{"permissionNotUsed"},
 			CRUDDocumentState: "PUBLIC",
 		},
+		types.Binding{
+			BindingID:         "expiredBinding",
+			Subjects:          []string{"user1"},
+			Roles:             []string{"role1"},
+			Permissions:       []string{"permissionExpired"},
+			CRUDDocumentState: "PUBLIC",
+			ExpiresAt:         &expiredAt,
+		},
 		types.Binding{
 			BindingID:         "notUsedByAnyone2",
 			Subjects:          []string{"user1"},
@@ -75,7 +75,15 @@ type IMongoClient interface {
 }
 
 type RequestError struct {
-	Error      string `json:"error"`
-	Message    string `json:"message"`
-	StatusCode int    `json:"statusCode"`
+	Error            string                  `json:"error"`
+	Message          string                  `json:"message"`
+	StatusCode       int                     `json:"statusCode"`
+	ValidationErrors []ValidationErrorDetail `json:"validationErrors,omitempty"`
+}
+
+// ValidationErrorDetail describes why a field of the request body is not valid.
+type ValidationErrorDetail struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+	Code    string `json:"code"`
 }
@@ -0,0 +1,119 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const XForwardedForHeaderKey = "X-Forwarded-For"
+
+// ParseTrustedProxies parses a comma separated list of CIDRs. Plain IP addresses are
+// accepted as single host networks.
+func ParseTrustedProxies(trustedProxies string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(trustedProxies, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ForwardedFor returns the addresses listed in the X-Forwarded-For headers of the request,
+// from the original client to the last proxy.
+func ForwardedFor(req *http.Request) []string {
+	chain := []string{}
+	for _, header := range req.Header.Values(XForwardedForHeaderKey) {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				chain = append(chain, hop)
+			}
+		}
+	}
+	return chain
+}
+
+// ClientIP returns the IP address of the client performing the request. The
+// X-Forwarded-For chain is walked from the right, skipping the hops of trusted
+// proxies, and only if the request comes from a trusted proxy: addresses added by
+// untrusted peers can be spoofed and are ignored.
+func ClientIP(req *http.Request, trustedProxies []*net.IPNet) string {
+	clientIP := remoteIP(req.RemoteAddr)
+	if !isTrustedProxy(clientIP, trustedProxies) {
+		return clientIP
+	}
+
+	chain := ForwardedFor(req)
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := chain[i]
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		clientIP = hop
+		if !isTrustedProxy(hop, trustedProxies) {
+			break
+		}
+	}
+	return clientIP
+}
+
+// FromTrustedProxy reports whether the request comes from one of the trusted proxies.
+func FromTrustedProxy(req *http.Request, trustedProxies []*net.IPNet) bool {
+	return isTrustedProxy(remoteIP(req.RemoteAddr), trustedProxies)
+}
+
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+func isTrustedProxy(address string, trustedProxies []*net.IPNet) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
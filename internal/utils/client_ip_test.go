@@ -0,0 +1,107 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	t.Run("parses CIDRs and plain addresses", func(t *testing.T) {
+		networks, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1,::1")
+		require.NoError(t, err)
+		require.Len(t, networks, 3)
+		require.Equal(t, "10.0.0.0/8", networks[0].String())
+		require.Equal(t, "192.168.1.1/32", networks[1].String())
+		require.Equal(t, "::1/128", networks[2].String())
+	})
+
+	t.Run("empty list", func(t *testing.T) {
+		networks, err := ParseTrustedProxies("")
+		require.NoError(t, err)
+		require.Empty(t, networks)
+	})
+
+	t.Run("fails on invalid CIDR", func(t *testing.T) {
+		_, err := ParseTrustedProxies("10.0.0.0/99")
+		require.Error(t, err)
+	})
+
+	t.Run("fails on invalid address", func(t *testing.T) {
+		_, err := ParseTrustedProxies("not-an-ip")
+		require.EqualError(t, err, "invalid IP address not-an-ip")
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	trustedProxies, err := ParseTrustedProxies("10.0.0.0/8")
+	require.NoError(t, err)
+
+	newRequest := func(remoteAddr string, forwardedFor ...string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		for _, value := range forwardedFor {
+			req.Header.Add(XForwardedForHeaderKey, value)
+		}
+		return req
+	}
+
+	t.Run("remote address without forwarded headers", func(t *testing.T) {
+		req := newRequest("203.0.113.7:1234")
+		require.Equal(t, "203.0.113.7", ClientIP(req, trustedProxies))
+		require.Empty(t, ForwardedFor(req))
+	})
+
+	t.Run("forwarded header from untrusted peer is ignored", func(t *testing.T) {
+		req := newRequest("203.0.113.7:1234", "1.2.3.4")
+		require.Equal(t, "203.0.113.7", ClientIP(req, trustedProxies))
+		require.Equal(t, []string{"1.2.3.4"}, ForwardedFor(req))
+	})
+
+	t.Run("forwarded header is ignored without trusted proxies", func(t *testing.T) {
+		req := newRequest("10.0.0.1:1234", "1.2.3.4")
+		require.Equal(t, "10.0.0.1", ClientIP(req, nil))
+	})
+
+	t.Run("client address added by trusted proxy", func(t *testing.T) {
+		req := newRequest("10.0.0.1:1234", "198.51.100.1")
+		require.Equal(t, "198.51.100.1", ClientIP(req, trustedProxies))
+	})
+
+	t.Run("spoofed addresses before the first untrusted hop are ignored", func(t *testing.T) {
+		req := newRequest("10.0.0.1:1234", "1.2.3.4, 198.51.100.1, 10.0.0.2")
+		require.Equal(t, "198.51.100.1", ClientIP(req, trustedProxies))
+		require.Equal(t, []string{"1.2.3.4", "198.51.100.1", "10.0.0.2"}, ForwardedFor(req))
+	})
+
+	t.Run("chain spread across multiple headers", func(t *testing.T) {
+		req := newRequest("10.0.0.1:1234", "1.2.3.4", "198.51.100.1, 10.0.0.2")
+		require.Equal(t, "198.51.100.1", ClientIP(req, trustedProxies))
+	})
+
+	t.Run("invalid hop stops the walk at the last trusted proxy", func(t *testing.T) {
+		req := newRequest("10.0.0.1:1234", "1.2.3.4, garbage, 10.0.0.2")
+		require.Equal(t, "10.0.0.2", ClientIP(req, trustedProxies))
+	})
+
+	t.Run("leftmost address when every hop is trusted", func(t *testing.T) {
+		req := newRequest("10.0.0.1:1234", "10.0.0.3, 10.0.0.2")
+		require.Equal(t, "10.0.0.3", ClientIP(req, trustedProxies))
+	})
+}
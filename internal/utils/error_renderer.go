@@ -0,0 +1,121 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/rond-authz/rond/internal/types"
+)
+
+const (
+	ErrorResponseFormatRond        = "rond"
+	ErrorResponseFormatProblemJSON = "problem-json"
+
+	ProblemJSONContentTypeHeader = "application/problem+json"
+)
+
+var ErrorResponseFormats = []string{ErrorResponseFormatRond, ErrorResponseFormatProblemJSON}
+
+// ErrorRenderer writes the body of the error responses returned by rond.
+// The validation errors are set only for invalid request bodies.
+type ErrorRenderer interface {
+	Render(w http.ResponseWriter, statusCode int, err, message string, validationErrors []types.ValidationErrorDetail)
+}
+
+// RondErrorRenderer renders errors as types.RequestError.
+type RondErrorRenderer struct{}
+
+func (RondErrorRenderer) Render(w http.ResponseWriter, statusCode int, err, message string, validationErrors []types.ValidationErrorDetail) {
+	w.Header().Set(ContentTypeHeaderKey, JSONContentTypeHeader)
+	w.WriteHeader(statusCode)
+	content, marshalErr := json.Marshal(types.RequestError{
+		StatusCode:       statusCode,
+		Error:            err,
+		Message:          message,
+		ValidationErrors: validationErrors,
+	})
+	if marshalErr != nil {
+		return
+	}
+
+	//#nosec G104 -- Intended to avoid disruptive code changes
+	w.Write(content)
+}
+
+// ProblemDetails is the RFC 7807 problem+json error body. The technical error
+// is kept in the error extension member.
+type ProblemDetails struct {
+	Type             string                        `json:"type"`
+	Title            string                        `json:"title"`
+	Status           int                           `json:"status"`
+	Detail           string                        `json:"detail"`
+	Error            string                        `json:"error,omitempty"`
+	ValidationErrors []types.ValidationErrorDetail `json:"validationErrors,omitempty"`
+}
+
+// ProblemJSONErrorRenderer renders errors as RFC 7807 problem details.
+type ProblemJSONErrorRenderer struct{}
+
+func (ProblemJSONErrorRenderer) Render(w http.ResponseWriter, statusCode int, err, message string, validationErrors []types.ValidationErrorDetail) {
+	w.Header().Set(ContentTypeHeaderKey, ProblemJSONContentTypeHeader)
+	w.WriteHeader(statusCode)
+	content, marshalErr := json.Marshal(ProblemDetails{
+		Type:             "about:blank",
+		Title:            http.StatusText(statusCode),
+		Status:           statusCode,
+		Detail:           message,
+		Error:            err,
+		ValidationErrors: validationErrors,
+	})
+	if marshalErr != nil {
+		return
+	}
+
+	//#nosec G104 -- Intended to avoid disruptive code changes
+	w.Write(content)
+}
+
+// NewErrorRenderer returns the renderer for the given ERROR_RESPONSE_FORMAT value.
+func NewErrorRenderer(format string) (ErrorRenderer, error) {
+	switch format {
+	case "", ErrorResponseFormatRond:
+		return RondErrorRenderer{}, nil
+	case ErrorResponseFormatProblemJSON:
+		return ProblemJSONErrorRenderer{}, nil
+	}
+	return nil, fmt.Errorf("unknown error response format: %s", format)
+}
+
+var (
+	errorRendererMtx sync.RWMutex
+	errorRenderer    ErrorRenderer = RondErrorRenderer{}
+)
+
+// SetErrorRenderer sets the renderer used by FailResponseWithCode for every error response.
+func SetErrorRenderer(renderer ErrorRenderer) {
+	errorRendererMtx.Lock()
+	defer errorRendererMtx.Unlock()
+	errorRenderer = renderer
+}
+
+func getErrorRenderer() ErrorRenderer {
+	errorRendererMtx.RLock()
+	defer errorRendererMtx.RUnlock()
+	return errorRenderer
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewErrorRenderer(t *testing.T) {
+	t.Run("rond format", func(t *testing.T) {
+		renderer, err := NewErrorRenderer(ErrorResponseFormatRond)
+		require.NoError(t, err)
+		require.Equal(t, RondErrorRenderer{}, renderer)
+	})
+
+	t.Run("rond format by default", func(t *testing.T) {
+		renderer, err := NewErrorRenderer("")
+		require.NoError(t, err)
+		require.Equal(t, RondErrorRenderer{}, renderer)
+	})
+
+	t.Run("problem-json format", func(t *testing.T) {
+		renderer, err := NewErrorRenderer(ErrorResponseFormatProblemJSON)
+		require.NoError(t, err)
+		require.Equal(t, ProblemJSONErrorRenderer{}, renderer)
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		_, err := NewErrorRenderer("xml")
+		require.EqualError(t, err, "unknown error response format: xml")
+	})
+}
+
+func TestErrorRenderers(t *testing.T) {
+	t.Run("rond renderer", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		RondErrorRenderer{}.Render(w, http.StatusForbidden, "The Error", "The Message", nil)
+
+		require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+		require.Equal(t, JSONContentTypeHeader, w.Result().Header.Get(ContentTypeHeaderKey))
+
+		var response types.RequestError
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.Equal(t, types.RequestError{
+			Error:      "The Error",
+			Message:    "The Message",
+			StatusCode: http.StatusForbidden,
+		}, response)
+	})
+
+	t.Run("problem-json renderer", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ProblemJSONErrorRenderer{}.Render(w, http.StatusForbidden, "The Error", "The Message", nil)
+
+		require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+		require.Equal(t, ProblemJSONContentTypeHeader, w.Result().Header.Get(ContentTypeHeaderKey))
+
+		var response ProblemDetails
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.Equal(t, ProblemDetails{
+			Type:   "about:blank",
+			Title:  "Forbidden",
+			Status: http.StatusForbidden,
+			Detail: "The Message",
+			Error:  "The Error",
+		}, response)
+	})
+
+	t.Run("rond renderer with validation errors", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		validationErrors := []types.ValidationErrorDetail{{Field: "subjects", Message: "expected array, got string", Code: "invalid_type"}}
+		RondErrorRenderer{}.Render(w, http.StatusBadRequest, "The Error", "The Message", validationErrors)
+
+		require.JSONEq(t, `{
+			"error": "The Error",
+			"message": "The Message",
+			"statusCode": 400,
+			"validationErrors": [{"field": "subjects", "message": "expected array, got string", "code": "invalid_type"}]
+		}`, w.Body.String())
+	})
+
+	t.Run("problem-json renderer with validation errors", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		validationErrors := []types.ValidationErrorDetail{{Field: "subjects", Message: "expected array, got string", Code: "invalid_type"}}
+		ProblemJSONErrorRenderer{}.Render(w, http.StatusBadRequest, "The Error", "The Message", validationErrors)
+
+		var response ProblemDetails
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.Equal(t, validationErrors, response.ValidationErrors)
+	})
+
+	t.Run("FailResponseWithCode uses the configured renderer", func(t *testing.T) {
+		SetErrorRenderer(ProblemJSONErrorRenderer{})
+		t.Cleanup(func() { SetErrorRenderer(RondErrorRenderer{}) })
+
+		w := httptest.NewRecorder()
+		FailResponseWithCode(w, http.StatusInternalServerError, "The Error", "The Message")
+
+		require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+		require.Equal(t, ProblemJSONContentTypeHeader, w.Result().Header.Get(ContentTypeHeaderKey))
+	})
+}
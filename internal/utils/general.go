@@ -25,6 +25,7 @@ import (
 
 const GENERIC_BUSINESS_ERROR_MESSAGE = "Internal server error, please try again later"
 const NO_PERMISSIONS_ERROR_MESSAGE = "You do not have permissions to access this feature, contact the administrator for more information."
+const AUTHENTICATION_REQUIRED_ERROR_MESSAGE = "You must be authenticated to access this feature."
 
 var ErrFileLoadFailed = errors.New("file loading failed")
 
@@ -15,45 +15,104 @@
 package utils
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/rond-authz/rond/internal/types"
+
+	"github.com/sirupsen/logrus"
 )
 
 const ContentTypeHeaderKey = "content-type"
 const JSONContentTypeHeader = "application/json"
+const NDJSONContentTypeHeader = "application/x-ndjson"
+const FormURLEncodedContentTypeHeader = "application/x-www-form-urlencoded"
+
+// StatusClientClosedRequest is the non-standard status code, borrowed from nginx, of the
+// requests interrupted because the client went away before the response was sent.
+const StatusClientClosedRequest = 499
+
+// IsClientClosedRequest reports whether the request context has been cancelled, i.e. the
+// client disconnected or cancelled the request.
+func IsClientClosedRequest(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.Canceled)
+}
+
+// LogClientClosedRequest logs the interruption of the request by the client, which is not
+// a failure of the service.
+func LogClientClosedRequest(logger *logrus.Entry, err error) {
+	logger.WithFields(logrus.Fields{
+		"statusCode": StatusClientClosedRequest,
+		"error":      logrus.Fields{"message": err.Error()},
+	}).Info("client closed request")
+}
+
+// HeaderDecodeError is returned by UnmarshalHeader when the header value is
+// neither valid JSON nor base64-encoded JSON.
+type HeaderDecodeError struct {
+	HeaderKey   string
+	JSONError   error
+	Base64Error error
+}
+
+func (e *HeaderDecodeError) Error() string {
+	return fmt.Sprintf("header %s decode failed: json: %s, base64: %s", e.HeaderKey, e.JSONError, e.Base64Error)
+}
+
+func (e *HeaderDecodeError) Unwrap() error {
+	return e.JSONError
+}
 
-func UnmarshalHeader(headers http.Header, headerKey string, v interface{}) (bool, error) {
+// UnmarshalHeader unmarshals the JSON value of the header into v. When tryBase64 is set
+// and the value is not valid JSON, it is decoded as base64-encoded JSON.
+func UnmarshalHeader(headers http.Header, headerKey string, tryBase64 bool, v interface{}) (bool, error) {
 	headerValueStringified := headers.Get(headerKey)
-	if headerValueStringified != "" {
-		err := json.Unmarshal([]byte(headerValueStringified), &v)
+	if headerValueStringified == "" {
+		return false, nil
+	}
+
+	err := json.Unmarshal([]byte(headerValueStringified), &v)
+	var syntaxErr *json.SyntaxError
+	if err == nil || !tryBase64 || !errors.As(err, &syntaxErr) {
 		return err == nil, err
 	}
-	return false, nil
+
+	decodedValue, base64Err := base64.StdEncoding.DecodeString(headerValueStringified)
+	if base64Err == nil {
+		base64Err = json.Unmarshal(decodedValue, &v)
+	}
+	if base64Err != nil {
+		return false, &HeaderDecodeError{HeaderKey: headerKey, JSONError: err, Base64Error: base64Err}
+	}
+	return true, nil
 }
 
 func HasApplicationJSONContentType(headers http.Header) bool {
 	return strings.HasPrefix(headers.Get(ContentTypeHeaderKey), JSONContentTypeHeader)
 }
 
+func HasNDJSONContentType(headers http.Header) bool {
+	return strings.HasPrefix(headers.Get(ContentTypeHeaderKey), NDJSONContentTypeHeader)
+}
+
+func HasFormURLEncodedContentType(headers http.Header) bool {
+	return strings.HasPrefix(headers.Get(ContentTypeHeaderKey), FormURLEncodedContentTypeHeader)
+}
+
 func FailResponse(w http.ResponseWriter, technicalError, businessError string) {
 	FailResponseWithCode(w, http.StatusInternalServerError, technicalError, businessError)
 }
 
 func FailResponseWithCode(w http.ResponseWriter, statusCode int, technicalError, businessError string) {
-	w.Header().Set(ContentTypeHeaderKey, JSONContentTypeHeader)
-	w.WriteHeader(statusCode)
-	content, err := json.Marshal(types.RequestError{
-		StatusCode: statusCode,
-		Error:      technicalError,
-		Message:    businessError,
-	})
-	if err != nil {
-		return
-	}
+	getErrorRenderer().Render(w, statusCode, technicalError, businessError, nil)
+}
 
-	//#nosec G104 -- Intended to avoid disruptive code changes
-	w.Write(content)
+// FailResponseWithValidationErrors writes a bad request response detailing the invalid fields of the request body.
+func FailResponseWithValidationErrors(w http.ResponseWriter, technicalError, businessError string, validationErrors []types.ValidationErrorDetail) {
+	getErrorRenderer().Render(w, http.StatusBadRequest, technicalError, businessError, validationErrors)
 }
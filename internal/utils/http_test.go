@@ -15,6 +15,7 @@
 package utils
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -38,7 +39,7 @@ func TestUnmarshalHeader(t *testing.T) {
 		headers := http.Header{}
 		var userProperties map[string]interface{}
 
-		ok, err := UnmarshalHeader(headers, userPropertiesHeaderKey, &userProperties)
+		ok, err := UnmarshalHeader(headers, userPropertiesHeaderKey, false, &userProperties)
 
 		require.True(t, !ok, "Unmarshal not existing header")
 		require.NoError(t, err, "Unexpected error if doesn't exist header")
@@ -49,7 +50,7 @@ func TestUnmarshalHeader(t *testing.T) {
 		headers.Set(userPropertiesHeaderKey, string(mockedUserPropertiesStringified))
 		var userProperties string
 
-		ok, err := UnmarshalHeader(headers, userPropertiesHeaderKey, &userProperties)
+		ok, err := UnmarshalHeader(headers, userPropertiesHeaderKey, false, &userProperties)
 		require.False(t, ok, "Unexpected success during unmarshalling")
 		var unmarshalErr = &json.UnmarshalTypeError{}
 		require.ErrorAs(t, err, &unmarshalErr, "Unexpected error on unmarshalling")
@@ -60,10 +61,59 @@ func TestUnmarshalHeader(t *testing.T) {
 		headers.Set(userPropertiesHeaderKey, string(mockedUserPropertiesStringified))
 		var userProperties map[string]interface{}
 
-		ok, err := UnmarshalHeader(headers, userPropertiesHeaderKey, &userProperties)
+		ok, err := UnmarshalHeader(headers, userPropertiesHeaderKey, false, &userProperties)
 		require.True(t, ok, "Unexpected failure")
 		require.NoError(t, err, "Unexpected error")
 	})
+
+	t.Run("raw JSON header with base64 fallback", func(t *testing.T) {
+		headers := http.Header{}
+		headers.Set(userPropertiesHeaderKey, string(mockedUserPropertiesStringified))
+		var userProperties map[string]interface{}
+
+		ok, err := UnmarshalHeader(headers, userPropertiesHeaderKey, true, &userProperties)
+		require.True(t, ok, "Unexpected failure")
+		require.NoError(t, err, "Unexpected error")
+		require.Equal(t, "other", userProperties["my"])
+	})
+
+	t.Run("base64-encoded JSON header", func(t *testing.T) {
+		headers := http.Header{}
+		headers.Set(userPropertiesHeaderKey, base64.StdEncoding.EncodeToString(mockedUserPropertiesStringified))
+		var userProperties map[string]interface{}
+
+		ok, err := UnmarshalHeader(headers, userPropertiesHeaderKey, true, &userProperties)
+		require.True(t, ok, "Unexpected failure")
+		require.NoError(t, err, "Unexpected error")
+		require.Equal(t, "other", userProperties["my"])
+	})
+
+	t.Run("base64-encoded JSON header without base64 fallback", func(t *testing.T) {
+		headers := http.Header{}
+		headers.Set(userPropertiesHeaderKey, base64.StdEncoding.EncodeToString(mockedUserPropertiesStringified))
+		var userProperties map[string]interface{}
+
+		ok, err := UnmarshalHeader(headers, userPropertiesHeaderKey, false, &userProperties)
+		require.False(t, ok, "Unexpected success during unmarshalling")
+		var syntaxErr = &json.SyntaxError{}
+		require.ErrorAs(t, err, &syntaxErr, "Unexpected error on unmarshalling")
+	})
+
+	t.Run("invalid base64 header", func(t *testing.T) {
+		headers := http.Header{}
+		headers.Set(userPropertiesHeaderKey, "not-base64!")
+		var userProperties map[string]interface{}
+
+		ok, err := UnmarshalHeader(headers, userPropertiesHeaderKey, true, &userProperties)
+		require.False(t, ok, "Unexpected success during unmarshalling")
+		var decodeErr = &HeaderDecodeError{}
+		require.ErrorAs(t, err, &decodeErr, "Unexpected error on unmarshalling")
+		require.Equal(t, userPropertiesHeaderKey, decodeErr.HeaderKey)
+		require.Error(t, decodeErr.JSONError)
+		require.Error(t, decodeErr.Base64Error)
+		var syntaxErr = &json.SyntaxError{}
+		require.ErrorAs(t, err, &syntaxErr, "JSON error is not wrapped")
+	})
 }
 
 func TestFailResponseWithCode(t *testing.T) {
@@ -0,0 +1,32 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+// SecretMatches reports whether the provided secret is the expected one, never matching
+// an empty secret. The SHA-256 digests of the secrets are compared in constant time, so
+// that the comparison leaks neither the secret nor its length.
+func SecretMatches(provided, expected string) bool {
+	if provided == "" || expected == "" {
+		return false
+	}
+	providedDigest := sha256.Sum256([]byte(provided))
+	expectedDigest := sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(providedDigest[:], expectedDigest[:]) == 1
+}
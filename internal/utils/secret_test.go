@@ -0,0 +1,29 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretMatches(t *testing.T) {
+	require.True(t, SecretMatches("my-secret", "my-secret"))
+	require.False(t, SecretMatches("other-secret", "my-secret"))
+	require.False(t, SecretMatches("my-secret-longer", "my-secret"))
+	require.False(t, SecretMatches("", "my-secret"), "empty secrets never match")
+	require.False(t, SecretMatches("", ""), "empty secrets never match")
+}
@@ -0,0 +1,49 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+type upstreamDurationContextKey struct{}
+
+// UpstreamDuration accumulates the time spent waiting for the target service while
+// serving a request, including every retry attempt.
+type UpstreamDuration struct {
+	nanoseconds int64
+}
+
+// Get returns the accumulated upstream duration.
+func (d *UpstreamDuration) Get() time.Duration {
+	return time.Duration(atomic.LoadInt64(&d.nanoseconds))
+}
+
+// WithUpstreamDuration saves into the context a new UpstreamDuration, that is returned
+// to be read once the request is served.
+func WithUpstreamDuration(ctx context.Context) (context.Context, *UpstreamDuration) {
+	upstreamDuration := &UpstreamDuration{}
+	return context.WithValue(ctx, upstreamDurationContextKey{}, upstreamDuration), upstreamDuration
+}
+
+// RecordUpstreamDuration adds the duration of a request to the target service to the
+// UpstreamDuration saved into the context, if any.
+func RecordUpstreamDuration(ctx context.Context, duration time.Duration) {
+	if upstreamDuration, ok := ctx.Value(upstreamDurationContextKey{}).(*UpstreamDuration); ok {
+		atomic.AddInt64(&upstreamDuration.nanoseconds, int64(duration))
+	}
+}
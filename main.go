@@ -16,7 +16,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -26,21 +29,79 @@ import (
 	"github.com/rond-authz/rond/core"
 	"github.com/rond-authz/rond/helpers"
 	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/discovery"
 	"github.com/rond-authz/rond/internal/mongoclient"
 	"github.com/rond-authz/rond/openapi"
 	"github.com/rond-authz/rond/service"
+	"github.com/rond-authz/rond/types"
 
 	"github.com/mia-platform/glogger/v2"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
+	env := config.GetEnvOrDie()
+	if env.PoliciesTestDir != "" {
+		os.Exit(runPolicyTests(env, os.Stdout))
+	}
 	entrypoint(make(chan os.Signal, 1))
 	os.Exit(0)
 }
 
+// runPolicyTests runs the rego tests of the policies instead of starting the service
+// and returns the exit code of the process.
+func runPolicyTests(env config.EnvironmentVariables, w io.Writer) int {
+	if err := env.Validate(); err != nil {
+		panic(err.Error())
+	}
+
+	log, err := glogger.InitHelper(glogger.InitOptions{Level: env.LogLevel})
+	if err != nil {
+		panic(err.Error())
+	}
+
+	opaModuleConfig, err := core.LoadRegoModule(env.OPAModulesDirectory, env.OPAMaxModuleDepth)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error":        logrus.Fields{"message": err.Error()},
+			"opaDirectory": env.OPAModulesDirectory,
+		}).Errorf("failed rego file read")
+		return 1
+	}
+
+	var mongoClient types.IMongoClient
+	if env.PoliciesTestFixturesPath != "" {
+		fixtureMongoClient, err := mongoclient.NewFixtureMongoClient(env.PoliciesTestFixturesPath)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error":        logrus.Fields{"message": err.Error()},
+				"fixturesPath": env.PoliciesTestFixturesPath,
+			}).Errorf("failed policies tests fixtures load")
+			return 1
+		}
+		mongoClient = fixtureMongoClient
+	}
+
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+	passed, err := core.RunPolicyTests(ctx, w, opaModuleConfig, env.PoliciesTestDir, mongoClient, env)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error":    logrus.Fields{"message": err.Error()},
+			"testsDir": env.PoliciesTestDir,
+		}).Errorf("failed policies tests run")
+		return 1
+	}
+	if !passed {
+		return 1
+	}
+	return 0
+}
+
 func entrypoint(shutdown chan os.Signal) {
 	env := config.GetEnvOrDie()
+	if err := env.Validate(); err != nil {
+		panic(err.Error())
+	}
 
 	// Init logger instance.
 	log, err := glogger.InitHelper(glogger.InitOptions{Level: env.LogLevel})
@@ -48,6 +109,24 @@ func entrypoint(shutdown chan os.Signal) {
 		panic(err.Error())
 	}
 
+	startupStart := time.Now()
+
+	// the server answers the probes while the service is set up, reporting it as not
+	// ready until the OAS is loaded and the router is set up.
+	startupHandler := service.NewStartupHandler(env.ServiceVersion)
+	srv := &http.Server{
+		Addr:              fmt.Sprintf("0.0.0.0:%s", env.HTTPPort),
+		Handler:           startupHandler,
+		ReadHeaderTimeout: time.Second,
+	}
+	go func() {
+		log.WithField("port", env.HTTPPort).Info("Starting server")
+		if err := srv.ListenAndServe(); err != nil {
+			log.Println(err)
+		}
+	}()
+	defer srv.Close()
+
 	if _, err := os.Stat(env.OPAModulesDirectory); err != nil {
 		log.WithFields(logrus.Fields{
 			"error":        logrus.Fields{"message": err.Error()},
@@ -56,7 +135,7 @@ func entrypoint(shutdown chan os.Signal) {
 		return
 	}
 
-	opaModuleConfig, err := core.LoadRegoModule(env.OPAModulesDirectory)
+	opaModuleConfig, err := core.LoadRegoModule(env.OPAModulesDirectory, env.OPAMaxModuleDepth)
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"error":        logrus.Fields{"message": err.Error()},
@@ -64,8 +143,6 @@ func entrypoint(shutdown chan os.Signal) {
 		}).Errorf("failed rego file read")
 		return
 	}
-	log.WithField("opaModuleFileName", opaModuleConfig.Name).Trace("rego module successfully loaded")
-
 	oas, err := openapi.LoadOASFromFileOrNetwork(log, env)
 	if err != nil {
 		log.WithFields(logrus.Fields{
@@ -75,10 +152,9 @@ func entrypoint(shutdown chan os.Signal) {
 		}).Errorf("failed to load oas")
 		return
 	}
-	log.WithFields(logrus.Fields{
-		"oasFilePath": env.APIPermissionsFilePath,
-		"oasApiPath":  env.TargetServiceOASPath,
-	}).Trace("OAS successfully loaded")
+	if !checkPoliciesVersion(log, opaModuleConfig, env) {
+		return
+	}
 
 	mongoClient, err := mongoclient.NewMongoClient(env, log)
 	if err != nil {
@@ -93,17 +169,30 @@ func entrypoint(shutdown chan os.Signal) {
 		logrus.NewEntry(log),
 	)
 
-	policiesEvaluators, err := core.SetupEvaluators(ctx, mongoClient, oas, opaModuleConfig, env)
+	policiesEvaluators, setupErrors, err := core.SetupEvaluators(ctx, mongoClient, oas, opaModuleConfig, env)
 	if err != nil {
-		log.WithFields(logrus.Fields{
-			"error": logrus.Fields{"message": err.Error()},
-		}).Errorf("failed to create evaluators")
-		return
+		if !env.AllowPartialSetup || len(setupErrors) == 0 {
+			log.WithFields(logrus.Fields{
+				"error": logrus.Fields{"message": err.Error()},
+			}).Errorf("failed to create evaluators")
+			return
+		}
+		for _, setupError := range setupErrors {
+			log.WithFields(logrus.Fields{
+				"error":      logrus.Fields{"message": setupError.Cause.Error()},
+				"routePath":  setupError.RoutePath,
+				"method":     setupError.Method,
+				"policyName": setupError.PolicyName,
+			}).Warn("failed to create evaluator, requests to the route will fail")
+		}
 	}
-	log.WithField("policiesLength", len(policiesEvaluators)).Debug("policies evaluators partial results computed")
 
 	// Routing
-	router, err := service.SetupRouter(log, env, opaModuleConfig, oas, policiesEvaluators, mongoClient)
+	oasStore := core.NewOASStore(oas, policiesEvaluators)
+	if env.PreWarmOnStartup {
+		go preWarmEvaluators(log, oasStore, env)
+	}
+	router, err := service.SetupRouterWithOASStore(log, env, opaModuleConfig, oasStore, mongoClient)
 	if mongoClient != nil {
 		defer mongoClient.Disconnect()
 	}
@@ -113,20 +202,56 @@ func entrypoint(shutdown chan os.Signal) {
 		}).Errorf("failed router setup")
 		return
 	}
-	log.Trace("router setup completed")
+	if env.OASRefreshInterval > 0 {
+		refreshContext, cancelRefresh := context.WithCancel(ctx)
+		defer cancelRefresh()
+		refresher := core.NewOASRefresher(logrus.NewEntry(log), oasStore, openapi.NewOASFetcher(env), mongoClient, opaModuleConfig, env)
+		refresher.Start(refreshContext, time.Duration(env.OASRefreshInterval)*time.Second)
+	}
 
-	srv := &http.Server{
-		Addr:              fmt.Sprintf("0.0.0.0:%s", env.HTTPPort),
-		Handler:           router,
-		ReadHeaderTimeout: time.Second,
+	if mongoClient != nil && env.MongoDBUrlFile != "" {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		defer signal.Stop(reload)
+		reloadContext, cancelReload := context.WithCancel(context.Background())
+		defer cancelReload()
+		go reconnectOnMongoDBUrlRotation(reloadContext, log, env, mongoClient, reload)
 	}
 
-	go func() {
-		log.WithField("port", env.HTTPPort).Info("Starting server")
-		if err := srv.ListenAndServe(); err != nil {
-			log.Println(err)
+	if env.ConsulAddress != "" {
+		discoveryContext, cancelDiscovery := context.WithCancel(context.Background())
+		defer cancelDiscovery()
+		resolver := discovery.NewConsulResolver(logrus.NewEntry(log), env.ConsulAddress, env.ConsulServiceName, env.TargetServiceHost)
+		resolver.Start(discoveryContext, time.Duration(env.ConsulRefreshInterval)*time.Second)
+		router.Use(discovery.ResolverInjectorMiddleware(resolver))
+	}
+
+	var handler http.Handler = router
+	if env.CaseInsensitiveRouting {
+		handler = service.CaseInsensitiveRoutingHandler(router)
+	}
+
+	if env.Standalone && env.StandaloneGRPC {
+		listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%s", env.GRPCPort))
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error": logrus.Fields{"message": err.Error()},
+				"port":  env.GRPCPort,
+			}).Errorf("failed gRPC server listen")
+			return
 		}
-	}()
+		grpcServer := service.NewGRPCServer(env, handler)
+		go func() {
+			log.WithField("port", env.GRPCPort).Info("Starting gRPC server")
+			if err := grpcServer.Serve(listener); err != nil {
+				log.Println(err)
+			}
+		}()
+		defer grpcServer.GracefulStop()
+	}
+
+	startupHandler.Ready(handler)
+	logStartupSummary(log, oas, opaModuleConfig, policiesEvaluators, mongoClient != nil, startupStart)
 
 	// sigterm signal sent from kubernetes
 	signal.Notify(shutdown, syscall.SIGTERM)
@@ -134,3 +259,100 @@ func entrypoint(shutdown chan os.Signal) {
 	// SIGINT (Ctrl+C), SIGKILL or SIGQUIT will not be caught.
 	helpers.GracefulShutdown(srv, shutdown, log, env.DelayShutdownSeconds)
 }
+
+// logStartupSummary logs what the service loaded during its setup in a single entry.
+func logStartupSummary(log *logrus.Logger, oas *openapi.OpenAPISpec, opaModuleConfig *core.OPAModuleConfig, policiesEvaluators core.PartialResultsEvaluators, mongoConnected bool, startupStart time.Time) {
+	routeCount := 0
+	for _, verbs := range oas.Paths {
+		routeCount += len(verbs)
+	}
+	log.WithFields(logrus.Fields{
+		"routeCount":        routeCount,
+		"policyCount":       len(policiesEvaluators),
+		"opaModuleCount":    1 + len(opaModuleConfig.Modules),
+		"mongoConnected":    mongoConnected,
+		"startupDurationMs": time.Since(startupStart).Milliseconds(),
+		"regoFingerprint":   opaModuleConfig.Fingerprint,
+	}).Info("service setup completed")
+}
+
+// preWarmEvaluators computes the partial results of the policies evaluators in background,
+// so that the service starts without waiting for them. The readiness check reports the
+// service as ready once they are computed.
+func preWarmEvaluators(log *logrus.Logger, oasStore *core.OASStore, env config.EnvironmentVariables) {
+	preWarmStart := time.Now()
+	if err := oasStore.PreWarm(core.EvaluatorSetupWorkers(env)); err != nil {
+		log.WithField("error", logrus.Fields{"message": err.Error()}).Error("policy evaluators pre-warm failed")
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"policiesLength": len(oasStore.Evaluators()),
+		"durationMs":     time.Since(preWarmStart).Milliseconds(),
+	}).Info("policy evaluators pre-warmed")
+}
+
+// checkPoliciesVersion checks the running version against the minimum version declared
+// by the policies metadata, returning false if the service must not start.
+func checkPoliciesVersion(log *logrus.Logger, opaModuleConfig *core.OPAModuleConfig, env config.EnvironmentVariables) bool {
+	metadata, err := core.LoadPolicyMetadata(context.Background(), opaModuleConfig, env)
+	if err != nil {
+		log.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed policies metadata load, version check skipped")
+		return true
+	}
+
+	fields := logrus.Fields{
+		"serviceVersion":   env.ServiceVersion,
+		"policyMinVersion": metadata.MinVersion,
+	}
+	err = metadata.CheckServiceVersion(env.ServiceVersion)
+	if err == nil {
+		log.WithFields(fields).Debug("policies version check passed")
+		return true
+	}
+	fields["error"] = logrus.Fields{"message": err.Error()}
+
+	var versionError core.PolicyVersionError
+	if errors.As(err, &versionError) && env.PolicyVersionCheck == config.PolicyVersionCheckWarn {
+		log.WithFields(fields).Warn("policies require a newer rond version")
+		return true
+	}
+	log.WithFields(fields).Error("incompatible policies version")
+	return false
+}
+
+// reconnectOnMongoDBUrlRotation reads the MongoDB connection string file again on each
+// reload signal, reconnecting the client when the value changed, so that the rotated
+// credentials are used without restarting the service.
+func reconnectOnMongoDBUrlRotation(ctx context.Context, log *logrus.Logger, env config.EnvironmentVariables, mongoClient *mongoclient.MongoClient, reload <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+		}
+
+		mongoDBUrl, err := config.ReadSecretFile(env.MongoDBUrlFile)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error": logrus.Fields{"message": err.Error()},
+				"path":  env.MongoDBUrlFile,
+			}).Error("failed MongoDB url file read, keeping the current connection")
+			continue
+		}
+		if mongoDBUrl == env.MongoDBUrl {
+			log.Debug("MongoDB url unchanged, skipping reconnection")
+			continue
+		}
+
+		reconnectEnv := env
+		reconnectEnv.MongoDBUrl = mongoDBUrl
+		if err := mongoClient.Reconnect(reconnectEnv, log); err != nil {
+			log.WithFields(logrus.Fields{
+				"error": logrus.Fields{"message": err.Error()},
+			}).Error("failed MongoDB reconnection, keeping the current connection")
+			continue
+		}
+		env = reconnectEnv
+		log.Info("MongoDB client reconnected with the rotated url")
+	}
+}
@@ -38,6 +38,7 @@ import (
 	"github.com/rond-authz/rond/service"
 	"github.com/rond-authz/rond/types"
 
+	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
@@ -158,6 +159,7 @@ func TestProxyOASPath(t *testing.T) {
 			{name: "TARGET_SERVICE_HOST", value: "localhost:3008"},
 			{name: "TARGET_SERVICE_OAS_PATH", value: "/documentation/json"},
 			{name: "OPA_MODULES_DIRECTORY", value: "./mocks/rego-policies"},
+			{name: "AUTHENTICATION_REQUIRED", value: "false"},
 			{name: "LOG_LEVEL", value: "fatal"},
 		})
 		go func() {
@@ -190,6 +192,21 @@ func TestEntrypoint(t *testing.T) {
 		require.True(t, true, "If we get here the service has not started")
 	})
 
+	t.Run("fails for invalid environment variables", func(t *testing.T) {
+		setEnvs(t, []env{
+			{name: "HTTP_PORT", value: "not-a-port"},
+			{name: "TARGET_SERVICE_HOST", value: "localhost:3001"},
+			{name: "TARGET_SERVICE_OAS_PATH", value: "/documentation/json"},
+			{name: "OPA_MODULES_DIRECTORY", value: "./mocks/rego-policies"},
+			{name: "LOG_LEVEL", value: "fatal"},
+		})
+		shutdown := make(chan os.Signal, 1)
+
+		require.PanicsWithValue(t, `invalid environment variables: HTTP_PORT: "not-a-port" is not a number`, func() {
+			entrypoint(shutdown)
+		})
+	})
+
 	t.Run("opens server on port 3000", func(t *testing.T) {
 		shutdown := make(chan os.Signal, 1)
 		defer gock.Off()
@@ -282,10 +299,11 @@ func TestEntrypoint(t *testing.T) {
 			File("./mocks/simplifiedMock.json")
 
 		setEnvs(t, []env{
-			{name: "HTTP_PORT", value: "3000"},
+			{name: "HTTP_PORT", value: "3010"},
 			{name: "TARGET_SERVICE_HOST", value: "localhost:3001"},
 			{name: "TARGET_SERVICE_OAS_PATH", value: "/documentation/json"},
 			{name: "OPA_MODULES_DIRECTORY", value: "./mocks/rego-policies"},
+			{name: "AUTHENTICATION_REQUIRED", value: "false"},
 			{name: "LOG_LEVEL", value: "fatal"},
 		})
 
@@ -302,7 +320,7 @@ func TestEntrypoint(t *testing.T) {
 			gock.New("http://localhost:3001/users/").
 				Get("/users/").
 				Reply(200)
-			resp, err := http.DefaultClient.Get("http://localhost:3000/users/")
+			resp, err := http.DefaultClient.Get("http://localhost:3010/users/")
 
 			require.Equal(t, nil, err)
 			require.Equal(t, http.StatusOK, resp.StatusCode)
@@ -314,13 +332,84 @@ func TestEntrypoint(t *testing.T) {
 			gock.New("http://localhost:3001/").
 				Post("/users/").
 				Reply(200)
-			resp, err := http.DefaultClient.Post("http://localhost:3000/users/", "text/plain", nil)
+			resp, err := http.DefaultClient.Post("http://localhost:3010/users/", "text/plain", nil)
 			require.Equal(t, nil, err)
 			require.Equal(t, http.StatusForbidden, resp.StatusCode, "unexpected status code.")
 			require.False(t, gock.IsDone(), "the proxy forwards the request when the permissions aren't granted.")
 		})
 	})
 
+	t.Run("strict routing integration", func(t *testing.T) {
+		shutdown := make(chan os.Signal, 1)
+
+		defer gock.Off()
+		defer gock.DisableNetworkingFilters()
+		defer gock.DisableNetworking()
+		gock.EnableNetworking()
+		gock.NetworkingFilter(func(r *http.Request) bool {
+			return r.URL.Host != "localhost:3001"
+		})
+
+		gock.New("http://localhost:3001").
+			Get("/documentation/json").
+			Reply(200).
+			File("./mocks/simplifiedMock.json")
+
+		setEnvs(t, []env{
+			{name: "HTTP_PORT", value: "3012"},
+			{name: "TARGET_SERVICE_HOST", value: "localhost:3001"},
+			{name: "TARGET_SERVICE_OAS_PATH", value: "/documentation/json"},
+			{name: "OPA_MODULES_DIRECTORY", value: "./mocks/rego-policies"},
+			{name: "AUTHENTICATION_REQUIRED", value: "false"},
+			{name: "STRICT_ROUTING", value: "true"},
+			{name: "LOG_LEVEL", value: "fatal"},
+		})
+
+		go func() {
+			entrypoint(shutdown)
+		}()
+		defer func() {
+			shutdown <- syscall.SIGTERM
+		}()
+		time.Sleep(1 * time.Second)
+
+		t.Run("ok - known path is proxied", func(t *testing.T) {
+			gock.Flush()
+			gock.New("http://localhost:3001").
+				Get("/users/").
+				Reply(200)
+			resp, err := http.DefaultClient.Get("http://localhost:3012/users/")
+
+			require.Equal(t, nil, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.True(t, gock.IsDone(), "the proxy blocks the request on a known path.")
+		})
+
+		t.Run("not found - unknown path never reaches the target service", func(t *testing.T) {
+			gock.Flush()
+			gock.New("http://localhost:3001").
+				Get("/not-in-oas").
+				Reply(200)
+			resp, err := http.DefaultClient.Get("http://localhost:3012/not-in-oas")
+
+			require.Equal(t, nil, err)
+			require.Equal(t, http.StatusNotFound, resp.StatusCode)
+			require.False(t, gock.IsDone(), "the proxy forwards the request on an unknown path.")
+		})
+
+		t.Run("ok - documentation path is proxied", func(t *testing.T) {
+			gock.Flush()
+			gock.New("http://localhost:3001").
+				Get("/documentation/json").
+				Reply(200)
+			resp, err := http.DefaultClient.Get("http://localhost:3012/documentation/json")
+
+			require.Equal(t, nil, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.True(t, gock.IsDone(), "the proxy blocks the documentation path.")
+		})
+	})
+
 	t.Run("standalone integration", func(t *testing.T) {
 		shutdown := make(chan os.Signal, 1)
 
@@ -349,6 +438,7 @@ func TestEntrypoint(t *testing.T) {
 			{name: "TARGET_SERVICE_HOST", value: "localhost:3001"},
 			{name: "TARGET_SERVICE_OAS_PATH", value: "/documentation/json"},
 			{name: "OPA_MODULES_DIRECTORY", value: "./mocks/rego-policies"},
+			{name: "AUTHENTICATION_REQUIRED", value: "false"},
 			{name: "STANDALONE", value: "true"},
 			{name: "BINDINGS_CRUD_SERVICE_URL", value: "http://crud-service"},
 		})
@@ -441,6 +531,7 @@ func TestEntrypoint(t *testing.T) {
 			{name: "TARGET_SERVICE_HOST", value: "localhost:4000"},
 			{name: "API_PERMISSIONS_FILE_PATH", value: "./mocks/nestedPathsConfig.json"},
 			{name: "OPA_MODULES_DIRECTORY", value: "./mocks/rego-policies"},
+			{name: "AUTHENTICATION_REQUIRED", value: "false"},
 			{name: "LOG_LEVEL", value: "fatal"},
 		})
 
@@ -489,6 +580,7 @@ func TestEntrypoint(t *testing.T) {
 			{name: "TARGET_SERVICE_HOST", value: "localhost:6000"},
 			{name: "API_PERMISSIONS_FILE_PATH", value: "./mocks/mockForEncodedTest.json"},
 			{name: "OPA_MODULES_DIRECTORY", value: "./mocks/rego-policies"},
+			{name: "AUTHENTICATION_REQUIRED", value: "false"},
 			{name: "LOG_LEVEL", value: "fatal"},
 		})
 
@@ -537,6 +629,7 @@ func TestEntrypoint(t *testing.T) {
 			{name: "TARGET_SERVICE_HOST", value: "localhost:6000"},
 			{name: "API_PERMISSIONS_FILE_PATH", value: "./mocks/mockForEncodedTest.json"},
 			{name: "OPA_MODULES_DIRECTORY", value: "./mocks/rego-policies"},
+			{name: "AUTHENTICATION_REQUIRED", value: "false"},
 			{name: "LOG_LEVEL", value: "fatal"},
 		})
 
@@ -585,6 +678,7 @@ func TestEntrypoint(t *testing.T) {
 			{name: "TARGET_SERVICE_HOST", value: "localhost:6000"},
 			{name: "API_PERMISSIONS_FILE_PATH", value: "./mocks/mockForEncodedTest.json"},
 			{name: "OPA_MODULES_DIRECTORY", value: "./mocks/rego-policies"},
+			{name: "AUTHENTICATION_REQUIRED", value: "false"},
 			{name: "LOG_LEVEL", value: "fatal"},
 		})
 
@@ -626,6 +720,9 @@ func TestEntrypoint(t *testing.T) {
 			if r.URL.Path == "/with-mongo-find-many/some-project" && r.URL.Host == "localhost:3002" {
 				return false
 			}
+			if r.URL.Path == "/with-mongo-find-aggregate/some-project" && r.URL.Host == "localhost:3002" {
+				return false
+			}
 			return true
 		})
 
@@ -647,6 +744,7 @@ func TestEntrypoint(t *testing.T) {
 			{name: "TARGET_SERVICE_HOST", value: "localhost:3002"},
 			{name: "TARGET_SERVICE_OAS_PATH", value: "/documentation/json"},
 			{name: "OPA_MODULES_DIRECTORY", value: "./mocks/rego-policies-with-mongo-builtins"},
+			{name: "AUTHENTICATION_REQUIRED", value: "false"},
 			{name: "MONGODB_URL", value: fmt.Sprintf("mongodb://%s/%s", mongoHost, mongoDBName)},
 			{name: "BINDINGS_COLLECTION_NAME", value: "bindings"},
 			{name: "ROLES_COLLECTION_NAME", value: "roles"},
@@ -792,6 +890,50 @@ func TestEntrypoint(t *testing.T) {
 			require.Equal(t, nil, err)
 			require.Equal(t, http.StatusOK, resp.StatusCode)
 		})
+
+		t.Run("integration find_aggregate builtin", func(t *testing.T) {
+			type Project struct {
+				ProjectID string `bson:"projectId"`
+				TeamID    string `bson:"teamId"`
+			}
+			type Team struct {
+				TeamID  string   `bson:"teamId"`
+				Members []string `bson:"members"`
+			}
+			_, err = client.Database(mongoDBName).Collection("projects").InsertOne(ctx, Project{ProjectID: "some-project", TeamID: "team1"})
+			require.NoError(t, err)
+			defer client.Database(mongoDBName).Collection("projects").Drop(context.Background())
+			_, err = client.Database(mongoDBName).Collection("teams").InsertOne(ctx, Team{TeamID: "team1", Members: []string{"user1", "user2"}})
+			require.NoError(t, err)
+			defer client.Database(mongoDBName).Collection("teams").Drop(context.Background())
+
+			doRequest := func(t *testing.T, userID string) *http.Response {
+				t.Helper()
+				gock.Flush()
+				gock.New("http://localhost:3002/").
+					Get("/with-mongo-find-aggregate").
+					Reply(200).
+					JSON(map[string]string{"foo": "bar"})
+
+				req, err := http.NewRequest("GET", "http://localhost:3003/with-mongo-find-aggregate/some-project", nil)
+				require.NoError(t, err)
+				req.Header.Set("miauserid", userID)
+				req.Header.Set(utils.ContentTypeHeaderKey, "application/json")
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				return resp
+			}
+
+			t.Run("200 - user is member of the owning team", func(t *testing.T) {
+				resp := doRequest(t, "user1")
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+			})
+
+			t.Run("403 - user is not member of the owning team", func(t *testing.T) {
+				resp := doRequest(t, "user3")
+				require.Equal(t, http.StatusForbidden, resp.StatusCode)
+			})
+		})
 	})
 
 	t.Run("200 - integration passed with query generation", func(t *testing.T) {
@@ -971,7 +1113,7 @@ func TestEntrypoint(t *testing.T) {
 		require.Equal(t, http.StatusOK, resp.StatusCode)
 	})
 
-	t.Run("403 - integration not passed with query generation and without user authenticated", func(t *testing.T) {
+	t.Run("401 - integration not passed with query generation and without user authenticated", func(t *testing.T) {
 		shutdown := make(chan os.Signal, 1)
 
 		defer gock.Off()
@@ -1052,7 +1194,8 @@ func TestEntrypoint(t *testing.T) {
 		client1 := &http.Client{}
 		resp, err := client1.Do(req)
 		require.Equal(t, nil, err)
-		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		require.Equal(t, `Bearer realm="rond"`, resp.Header.Get("WWW-Authenticate"))
 	})
 
 	t.Run("200 - test correcting routing", func(t *testing.T) {
@@ -1425,6 +1568,7 @@ func TestEntrypointWithResponseFiltering(t *testing.T) {
 		{name: "TARGET_SERVICE_HOST", value: "localhost:3040"},
 		{name: "TARGET_SERVICE_OAS_PATH", value: "/documentation/json"},
 		{name: "OPA_MODULES_DIRECTORY", value: "./mocks/rego-policies"},
+		{name: "AUTHENTICATION_REQUIRED", value: "false"},
 		{name: "LOG_LEVEL", value: "fatal"},
 	})
 	mongoHost := os.Getenv("MONGO_HOST_CI")
@@ -1559,6 +1703,7 @@ func TestIntegrationWithOASParamsInBrackets(t *testing.T) {
 		{name: "TARGET_SERVICE_HOST", value: "localhost:3050"},
 		{name: "TARGET_SERVICE_OAS_PATH", value: "/documentation/json"},
 		{name: "OPA_MODULES_DIRECTORY", value: "./mocks/rego-policies"},
+		{name: "AUTHENTICATION_REQUIRED", value: "false"},
 		{name: "LOG_LEVEL", value: "fatal"},
 	})
 	mongoHost := os.Getenv("MONGO_HOST_CI")
@@ -1638,6 +1783,8 @@ func TestSetupRouterStandaloneMode(t *testing.T) {
 		ServiceVersion:           "my-version",
 		BindingsCrudServiceURL:   "http://crud:3030",
 		AdditionalHeadersToProxy: "miauserid",
+		GrantPolicy:              "test_policy",
+		RevokePolicy:             "test_policy",
 	}
 	opa := &core.OPAModuleConfig{
 		Name: "policies",
@@ -1674,7 +1821,7 @@ filter_policy {
 	}
 
 	var mongoClient *mongoclient.MongoClient
-	evaluatorsMap, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, env)
+	evaluatorsMap, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, env)
 	require.NoError(t, err, "unexpected error")
 
 	router, err := service.SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
@@ -1704,13 +1851,13 @@ filter_policy {
 		router.ServeHTTP(w, req)
 
 		// Bad request expected for missing body and so decoder fails!
-		require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+		require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
 
 		var requestError types.RequestError
 		err := json.Unmarshal(w.Body.Bytes(), &requestError)
 		require.NoError(t, err, "unexpected error")
 		require.Equal(t, "Internal server error, please try again later", requestError.Message)
-		require.Equal(t, "EOF", requestError.Error)
+		require.Equal(t, "invalid request body: EOF", requestError.Error)
 	})
 
 	t.Run("grant API", func(t *testing.T) {
@@ -1719,13 +1866,29 @@ filter_policy {
 		router.ServeHTTP(w, req)
 
 		// Bad request expected for missing body and so decoder fails!
-		require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+		require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
 
 		var requestError types.RequestError
 		err := json.Unmarshal(w.Body.Bytes(), &requestError)
 		require.NoError(t, err, "unexpected error")
 		require.Equal(t, "Internal server error, please try again later", requestError.Message)
-		require.Equal(t, "EOF", requestError.Error)
+		require.Equal(t, "invalid request body: EOF", requestError.Error)
+	})
+
+	t.Run("grant and revoke APIs are rejected without policies", func(t *testing.T) {
+		envWithoutPolicies := env
+		envWithoutPolicies.GrantPolicy = ""
+		envWithoutPolicies.RevokePolicy = ""
+		router, err := service.SetupRouter(log, envWithoutPolicies, opa, oas, evaluatorsMap, mongoClient)
+		require.NoError(t, err, "unexpected error")
+
+		for _, path := range []string{"/grant/bindings/resource/some-resource", "/revoke/bindings/resource/some-resource", "/grant/bindings", "/revoke/bindings"} {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte(`{}`)))
+			router.ServeHTTP(w, req)
+
+			require.Equal(t, http.StatusForbidden, w.Result().StatusCode, path)
+		}
 	})
 
 	t.Run("grant API with headers to proxy", func(t *testing.T) {
@@ -1829,7 +1992,7 @@ filter_policy {
 	}
 
 	var mongoClient *mongoclient.MongoClient
-	evaluatorsMap, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, env)
+	evaluatorsMap, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, env)
 	require.NoError(t, err, "unexpected error")
 
 	router, err := service.SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
@@ -1847,6 +2010,252 @@ filter_policy {
 	})
 }
 
+func TestSetupRouterProxyMetrics(t *testing.T) {
+	defer gock.Off()
+	defer gock.Flush()
+
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+
+	env := config.EnvironmentVariables{
+		TargetServiceHost:  "my-service:4444",
+		ExposeMetrics:      true,
+		PassThroughNonJSON: true,
+	}
+	opa := &core.OPAModuleConfig{
+		Name: "policies",
+		Content: `package policies
+test_policy { true }
+`,
+	}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users/{id}": openapi.PathVerbs{
+				"post": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{
+						RequestFlow: openapi.RequestFlow{PolicyName: "test_policy"},
+					},
+				},
+			},
+		},
+	}
+
+	var mongoClient *mongoclient.MongoClient
+	evaluatorsMap, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, env)
+	require.NoError(t, err, "unexpected error")
+
+	router, err := service.SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+	require.NoError(t, err, "unexpected error")
+
+	gock.New("http://my-service:4444").
+		Post("/users/42").
+		Reply(http.StatusOK).
+		BodyString(`{"id":"42"}`)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/users/42", bytes.NewReader([]byte(`{"name":"john"}`)))
+	req.Header.Set("content-type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.True(t, gock.IsDone(), "upstream not invoked")
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/-/rond/metrics", nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	responseBody := string(getResponseBody(t, w))
+	require.Contains(t, responseBody, `rond_request_size_bytes_sum{http_method="POST",http_route="/users/{id}"} 15`)
+	require.Contains(t, responseBody, `rond_response_size_bytes_sum{http_method="POST",http_route="/users/{id}"} 11`)
+	require.Contains(t, responseBody, `rond_upstream_duration_milliseconds_count{http_method="POST",http_route="/users/{id}"} 1`)
+	require.NotContains(t, responseBody, `http_route="/users/42"`)
+}
+
+func TestSetupRouterRequestID(t *testing.T) {
+	defer gock.Off()
+	defer gock.DisableNetworkingFilters()
+	defer gock.Flush()
+
+	opa := &core.OPAModuleConfig{
+		Name: "policies",
+		Content: `package policies
+test_policy { input.request.requestId != "" }
+`,
+	}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/api": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{
+						RequestFlow: openapi.RequestFlow{PolicyName: "test_policy"},
+					},
+				},
+			},
+		},
+	}
+
+	setupRouter := func(t *testing.T, env config.EnvironmentVariables) (*mux.Router, *test.Hook) {
+		t.Helper()
+		log, hook := test.NewNullLogger()
+		log.SetLevel(logrus.DebugLevel)
+		ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+
+		var mongoClient *mongoclient.MongoClient
+		evaluatorsMap, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, env)
+		require.NoError(t, err, "unexpected error")
+
+		router, err := service.SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+		require.NoError(t, err, "unexpected error")
+		return router, hook
+	}
+
+	decisionLogRequestID := func(t *testing.T, hook *test.Hook) string {
+		t.Helper()
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "policy evaluation completed" {
+				return entry.Data["reqId"].(string)
+			}
+		}
+		require.FailNow(t, "decision log not found")
+		return ""
+	}
+
+	t.Run("generated request id is logged and proxied", func(t *testing.T) {
+		defer gock.Flush()
+
+		var upstreamRequestID string
+		gock.New("http://my-service:4444").
+			Get("/api").
+			AddMatcher(func(req *http.Request, _ *gock.Request) (bool, error) {
+				upstreamRequestID = req.Header.Get("x-request-id")
+				return true, nil
+			}).
+			Reply(http.StatusOK)
+
+		router, hook := setupRouter(t, config.EnvironmentVariables{
+			TargetServiceHost:  "my-service:4444",
+			RequestIDHeaderKey: "x-request-id",
+		})
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api", nil)
+		router.ServeHTTP(w, req)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.True(t, gock.IsDone(), "upstream not invoked")
+		require.NotEmpty(t, upstreamRequestID)
+		require.Equal(t, upstreamRequestID, decisionLogRequestID(t, hook))
+	})
+
+	t.Run("inbound request id is honored with configured header", func(t *testing.T) {
+		defer gock.Flush()
+
+		var upstreamHeaders http.Header
+		gock.New("http://my-service:4444").
+			Get("/api").
+			AddMatcher(func(req *http.Request, _ *gock.Request) (bool, error) {
+				upstreamHeaders = req.Header
+				return true, nil
+			}).
+			Reply(http.StatusOK)
+
+		router, hook := setupRouter(t, config.EnvironmentVariables{
+			TargetServiceHost:  "my-service:4444",
+			RequestIDHeaderKey: "x-correlation-id",
+		})
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api", nil)
+		req.Header.Set("x-correlation-id", "my-request-id")
+		router.ServeHTTP(w, req)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.True(t, gock.IsDone(), "upstream not invoked")
+		require.Equal(t, "my-request-id", upstreamHeaders.Get("x-correlation-id"))
+		require.Empty(t, upstreamHeaders.Get("x-request-id"))
+		require.Equal(t, "my-request-id", decisionLogRequestID(t, hook))
+	})
+}
+
+func TestRunPolicyTests(t *testing.T) {
+	env := config.EnvironmentVariables{
+		LogLevel:                 "fatal",
+		HTTPPort:                 "8080",
+		OPAModulesDirectory:      "./mocks/rego-policies-with-mongo-builtins",
+		PoliciesTestDir:          "./mocks/policies-tests",
+		PoliciesTestFixturesPath: "./mocks/policies-tests/fixtures.json",
+	}
+
+	t.Run("exits with 0 when all tests pass", func(t *testing.T) {
+		output := &bytes.Buffer{}
+		require.Equal(t, 0, runPolicyTests(env, output))
+		require.Contains(t, output.String(), "PASS: 5/5")
+	})
+
+	t.Run("exits with 1 when a test fails", func(t *testing.T) {
+		testsDirectory := t.TempDir()
+		err := os.WriteFile(testsDirectory+"/failing_test.rego", []byte(`package policies
+		test_allow_with_find_one_for_other_tenant {
+			allow_with_find_one with input as {"request": {"pathParams": {"projectId": "some-project2"}}}
+		}`), 0600)
+		require.NoError(t, err)
+
+		env := env
+		env.PoliciesTestDir = testsDirectory
+		output := &bytes.Buffer{}
+		require.Equal(t, 1, runPolicyTests(env, output))
+		require.Contains(t, output.String(), "FAIL: 1/1")
+	})
+
+	t.Run("exits with 1 without mongo builtins", func(t *testing.T) {
+		env := env
+		env.PoliciesTestFixturesPath = ""
+		require.Equal(t, 1, runPolicyTests(env, &bytes.Buffer{}))
+	})
+}
+
+func TestReconnectOnMongoDBUrlRotation(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	log.SetLevel(logrus.DebugLevel)
+	mongoDBUrlPath := t.TempDir() + "/mongodb-url"
+	env := config.EnvironmentVariables{
+		MongoDBUrl:     "mongodb://localhost:27017/db",
+		MongoDBUrlFile: mongoDBUrlPath,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload := make(chan os.Signal)
+	go reconnectOnMongoDBUrlRotation(ctx, log, env, &mongoclient.MongoClient{}, reload)
+
+	lastMessage := func(message string) func() bool {
+		return func() bool {
+			entry := hook.LastEntry()
+			return entry != nil && entry.Message == message
+		}
+	}
+
+	t.Run("keeps the connection if the file cannot be read", func(t *testing.T) {
+		hook.Reset()
+		reload <- syscall.SIGHUP
+		require.Eventually(t, lastMessage("failed MongoDB url file read, keeping the current connection"), time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("skips the reconnection if the url is unchanged", func(t *testing.T) {
+		hook.Reset()
+		require.NoError(t, os.WriteFile(mongoDBUrlPath, []byte("mongodb://localhost:27017/db\n"), 0600))
+		reload <- syscall.SIGHUP
+		require.Eventually(t, lastMessage("MongoDB url unchanged, skipping reconnection"), time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("keeps the connection if the reconnection fails", func(t *testing.T) {
+		hook.Reset()
+		require.NoError(t, os.WriteFile(mongoDBUrlPath, []byte("not-valid-mongo-url\n"), 0600))
+		reload <- syscall.SIGHUP
+		require.Eventually(t, lastMessage("failed MongoDB reconnection, keeping the current connection"), time.Second, 10*time.Millisecond)
+	})
+}
+
 func getResponseBody(t *testing.T, w *httptest.ResponseRecorder) []byte {
 	t.Helper()
 
@@ -1855,3 +2264,61 @@ func getResponseBody(t *testing.T, w *httptest.ResponseRecorder) []byte {
 
 	return responseBody
 }
+
+func TestCheckPoliciesVersion(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	opaModuleConfig := &core.OPAModuleConfig{
+		Name: "policies.rego",
+		Content: `package policies
+__rond_metadata := {"minVersion": "1.6.0"}`,
+	}
+
+	t.Run("passes with a compatible version", func(t *testing.T) {
+		hook.Reset()
+		require.True(t, checkPoliciesVersion(log, opaModuleConfig, config.EnvironmentVariables{ServiceVersion: "1.6.0", PolicyVersionCheck: config.PolicyVersionCheckFail}))
+		require.Empty(t, hook.AllEntries())
+	})
+
+	t.Run("fails with an older version", func(t *testing.T) {
+		hook.Reset()
+		require.False(t, checkPoliciesVersion(log, opaModuleConfig, config.EnvironmentVariables{ServiceVersion: "1.5.0", PolicyVersionCheck: config.PolicyVersionCheckFail}))
+		entry := hook.LastEntry()
+		require.Equal(t, logrus.ErrorLevel, entry.Level)
+		require.Equal(t, "1.5.0", entry.Data["serviceVersion"])
+		require.Equal(t, "1.6.0", entry.Data["policyMinVersion"])
+	})
+
+	t.Run("warns with an older version in warn mode", func(t *testing.T) {
+		hook.Reset()
+		require.True(t, checkPoliciesVersion(log, opaModuleConfig, config.EnvironmentVariables{ServiceVersion: "1.5.0", PolicyVersionCheck: config.PolicyVersionCheckWarn}))
+		entry := hook.LastEntry()
+		require.Equal(t, logrus.WarnLevel, entry.Level)
+		require.Equal(t, "policies require a newer rond version", entry.Message)
+	})
+}
+
+func TestLogStartupSummary(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	env := config.EnvironmentVariables{OPAModulesDirectory: "./mocks/rego-policies"}
+
+	oas, err := openapi.LoadOASFile("./mocks/simplifiedMock.json")
+	require.NoError(t, err)
+	opaModuleConfig, err := core.LoadRegoModule(env.OPAModulesDirectory, env.OPAMaxModuleDepth)
+	require.NoError(t, err)
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+	policiesEvaluators, _, err := core.SetupEvaluators(ctx, nil, oas, opaModuleConfig, env)
+	require.NoError(t, err)
+
+	logStartupSummary(log, oas, opaModuleConfig, policiesEvaluators, false, time.Now())
+
+	entry := hook.LastEntry()
+	require.Equal(t, logrus.InfoLevel, entry.Level)
+	require.Equal(t, "service setup completed", entry.Message)
+	require.Equal(t, 7, entry.Data["routeCount"])
+	require.Equal(t, 4, entry.Data["policyCount"])
+	require.Equal(t, 1, entry.Data["opaModuleCount"])
+	require.Equal(t, false, entry.Data["mongoConnected"])
+	require.Contains(t, entry.Data, "startupDurationMs")
+	require.Equal(t, opaModuleConfig.Fingerprint, entry.Data["regoFingerprint"])
+	require.NotEmpty(t, entry.Data["regoFingerprint"])
+}
@@ -0,0 +1,27 @@
+package policies
+
+test_allow_with_find_one {
+	allow_with_find_one with input as {"request": {"pathParams": {"projectId": "some-project"}}}
+}
+
+test_deny_with_find_one_for_other_tenant {
+	not allow_with_find_one with input as {"request": {"pathParams": {"projectId": "some-project2"}}}
+}
+
+test_allow_with_find_many {
+	allow_with_find_many with input as {"request": {"pathParams": {"projectId": "some-project"}}}
+}
+
+test_allow_with_find_aggregate {
+	allow_with_find_aggregate with input as {
+		"request": {"pathParams": {"projectId": "some-project"}},
+		"user": {"id": "user1"},
+	}
+}
+
+test_deny_with_find_aggregate_for_non_members {
+	not allow_with_find_aggregate with input as {
+		"request": {"pathParams": {"projectId": "some-project"}},
+		"user": {"id": "user3"},
+	}
+}
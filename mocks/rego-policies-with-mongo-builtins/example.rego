@@ -58,3 +58,15 @@ allow_with_find_many {
 	projects[0].tenantId == "some-tenant"
 	projects[1].tenantId == "some-tenant2"
 }
+
+allow_with_find_aggregate {
+	projectId := input.request.pathParams.projectId
+	members := find_aggregate("projects", [
+		{"$match": {"projectId": projectId}},
+		{"$lookup": {"from": "teams", "localField": "teamId", "foreignField": "teamId", "as": "team"}},
+		{"$unwind": "$team"},
+		{"$match": {"team.members": input.user.id}},
+		{"$project": {"_id": 0, "projectId": 1}},
+	])
+	count(members) == 1
+}
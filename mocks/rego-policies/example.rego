@@ -82,3 +82,7 @@ allow_view {
     id :=  object.get(input,["request","pathParams", "id"], false)
     id
 }
+
+is_mobile_client {
+	input.request.clientType == "mobile"
+}
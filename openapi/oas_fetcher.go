@@ -0,0 +1,95 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/rond-authz/rond/internal/config"
+)
+
+// OASFetcher fetches the OAS exposed by the target service with conditional requests,
+// sending back the ETag and Last-Modified headers of the last fetched spec.
+type OASFetcher struct {
+	url          string
+	env          config.EnvironmentVariables
+	etag         string
+	lastModified string
+}
+
+func NewOASFetcher(env config.EnvironmentVariables) *OASFetcher {
+	return &OASFetcher{
+		url: fmt.Sprintf("%s://%s%s", HTTPScheme, env.TargetServiceHost, env.TargetServiceOASPath),
+		env: env,
+	}
+}
+
+// Fetch returns the OAS, or false if it is not modified since the last fetch.
+func (f *OASFetcher) Fetch() (*OpenAPISpec, bool, error) {
+	req, err := newOASRequest(f.url, f.env.TargetServiceOASHeaders)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %s", ErrRequestFailed, err)
+	}
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	if f.lastModified != "" {
+		req.Header.Set("If-Modified-Since", f.lastModified)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %s", ErrRequestFailed, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("%w: invalid status code %d", ErrRequestFailed, resp.StatusCode)
+	}
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %s", ErrRequestFailed, err)
+	}
+	oas, err := deserializeSpec(bodyBytes, ErrRequestFailed)
+	if err != nil {
+		return nil, false, err
+	}
+	if oas, err = normalizeOASPathsCase(oas, f.env); err != nil {
+		return nil, false, err
+	}
+	f.etag = resp.Header.Get("ETag")
+	f.lastModified = resp.Header.Get("Last-Modified")
+	return oas, true, nil
+}
+
+// Routes returns the method and path of each route defined in the OAS.
+func (oas *OpenAPISpec) Routes() []string {
+	routes := []string{}
+	for path, verbs := range oas.Paths {
+		for method := range verbs {
+			routes = append(routes, fmt.Sprintf("%s %s", strings.ToUpper(method), path))
+		}
+	}
+	sort.Strings(routes)
+	return routes
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/h2non/gock.v1"
+)
+
+func TestOASFetcher(t *testing.T) {
+	env := config.EnvironmentVariables{
+		TargetServiceHost:    "localhost:3000",
+		TargetServiceOASPath: "/documentation/json",
+	}
+
+	t.Run("sends back ETag and Last-Modified of the last fetched OAS", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://localhost:3000").
+			Get("/documentation/json").
+			Reply(200).
+			SetHeader("ETag", `"v1"`).
+			SetHeader("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT").
+			File("../mocks/simplifiedMock.json")
+		gock.New("http://localhost:3000").
+			Get("/documentation/json").
+			MatchHeader("If-None-Match", `"v1"`).
+			MatchHeader("If-Modified-Since", "Wed, 21 Oct 2015 07:28:00 GMT").
+			Reply(304)
+
+		fetcher := NewOASFetcher(env)
+		oas, modified, err := fetcher.Fetch()
+		require.NoError(t, err)
+		require.True(t, modified)
+		require.Contains(t, oas.Routes(), "GET /users/")
+
+		oas, modified, err = fetcher.Fetch()
+		require.NoError(t, err)
+		require.False(t, modified)
+		require.Nil(t, oas)
+		require.True(t, gock.IsDone())
+	})
+
+	t.Run("sends the configured headers", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://localhost:3000").
+			Get("/documentation/json").
+			MatchHeader("Accept", "application/json").
+			MatchHeader("X-Internal-Auth", "my-token").
+			Reply(200).
+			File("../mocks/simplifiedMock.json")
+
+		headersEnv := env
+		headersEnv.TargetServiceOASHeaders = map[string]string{"X-Internal-Auth": "my-token"}
+		_, modified, err := NewOASFetcher(headersEnv).Fetch()
+		require.NoError(t, err)
+		require.True(t, modified)
+		require.True(t, gock.IsDone())
+	})
+
+	t.Run("fails on unexpected status code", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://localhost:3000").
+			Get("/documentation/json").
+			Reply(500)
+
+		_, modified, err := NewOASFetcher(env).Fetch()
+		require.True(t, errors.Is(err, ErrRequestFailed))
+		require.False(t, modified)
+	})
+}
+
+func TestRoutes(t *testing.T) {
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/users":    PathVerbs{"post": VerbConfig{}, "get": VerbConfig{}},
+			"/projects": PathVerbs{"all": VerbConfig{}},
+		},
+	}
+	require.Equal(t, []string{"ALL /projects", "GET /users", "POST /users"}, oas.Routes())
+}
@@ -22,10 +22,14 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/rond-authz/rond/internal/config"
 	"github.com/rond-authz/rond/internal/utils"
@@ -55,7 +59,67 @@ var ErrNotFoundOASDefinition = errors.New("not found oas definition")
 type XPermissionKey struct{}
 
 type PermissionOptions struct {
-	EnableResourcePermissionsMapOptimization bool `json:"enableResourcePermissionsMapOptimization"`
+	// EnableResourcePermissionsMapOptimization overrides ENABLE_RESOURCE_PERMISSIONS_MAP_OPTIMIZATION
+	// for the route.
+	EnableResourcePermissionsMapOptimization *bool  `json:"enableResourcePermissionsMapOptimization,omitempty"`
+	Mode                                     string `json:"mode,omitempty"`
+	// ProxyUnknownMethods makes the requests to the path with a method not defined
+	// in the OAS always proxied, instead of rejected as not allowed.
+	ProxyUnknownMethods bool `json:"proxyUnknownMethods,omitempty"`
+	// CORSPassthrough overrides the CORS_PASSTHROUGH mode for the preflight requests
+	// of the route.
+	CORSPassthrough string `json:"corsPassthrough,omitempty"`
+	// ExcludedInputHeaders lists the request headers removed from the policies input
+	// of the route, e.g. the credentials the policies do not need.
+	ExcludedInputHeaders []string `json:"excludedInputHeaders,omitempty"`
+	// PolicyModule is the rego file of the modules directory the policies of the route
+	// are compiled from, instead of the default policies module.
+	PolicyModule string `json:"policyModule,omitempty"`
+	// RequestTimeoutMs overrides DEFAULT_REQUEST_TIMEOUT_MS for the requests proxied
+	// to the route.
+	RequestTimeoutMs int `json:"requestTimeoutMs,omitempty"`
+}
+
+// PolicyMode returns the policy mode configured for the route, or defaultMode
+// if the route does not set one. Policies are enforced when neither is set.
+func (options PermissionOptions) PolicyMode(defaultMode string) string {
+	if options.Mode != "" {
+		return options.Mode
+	}
+	if defaultMode != "" {
+		return defaultMode
+	}
+	return config.PolicyModeEnforce
+}
+
+// ResourcePermissionsMapOptimization reports whether the optimized resource permissions map
+// is enabled for the route, or defaultEnabled if the route does not set it.
+func (options PermissionOptions) ResourcePermissionsMapOptimization(defaultEnabled bool) bool {
+	if options.EnableResourcePermissionsMapOptimization != nil {
+		return *options.EnableResourcePermissionsMapOptimization
+	}
+	return defaultEnabled
+}
+
+// RequestTimeout returns the timeout of the requests proxied to the route, or the one of
+// defaultTimeoutMs if the route does not set one. Zero means no timeout.
+func (options PermissionOptions) RequestTimeout(defaultTimeoutMs int) time.Duration {
+	if options.RequestTimeoutMs > 0 {
+		return time.Duration(options.RequestTimeoutMs) * time.Millisecond
+	}
+	return time.Duration(defaultTimeoutMs) * time.Millisecond
+}
+
+// CORSPassthroughMode returns the CORS passthrough mode configured for the route, or
+// defaultMode if the route does not set one.
+func (options PermissionOptions) CORSPassthroughMode(defaultMode string) string {
+	if options.CORSPassthrough != "" {
+		return options.CORSPassthrough
+	}
+	if defaultMode != "" {
+		return defaultMode
+	}
+	return config.CORSPassthroughOff
 }
 
 // Config v1 //
@@ -90,16 +154,38 @@ type RequestFlow struct {
 	PolicyName    string       `json:"policyName"`
 	GenerateQuery bool         `json:"generateQuery"`
 	QueryOptions  QueryOptions `json:"queryOptions"`
+	// ShadowPolicy is evaluated with the same input of PolicyName after the response,
+	// only to compare their decisions: it never affects the request.
+	ShadowPolicy string `json:"shadowPolicy,omitempty"`
 }
 
 type ResponseFlow struct {
 	PolicyName string `json:"policyName"`
+	// IgnoreBody makes the response policy run without the response body, which
+	// is proxied untouched whatever its content type.
+	IgnoreBody bool `json:"ignoreBody"`
 }
 
 type RondConfig struct {
 	RequestFlow  RequestFlow       `json:"requestFlow"`
 	ResponseFlow ResponseFlow      `json:"responseFlow"`
 	Options      PermissionOptions `json:"options"`
+	// ContentNegotiationPolicy is the policy returning the API version requested,
+	// e.g. through the Accept header, used to select the configuration in Versions.
+	ContentNegotiationPolicy string                 `json:"contentNegotiationPolicy,omitempty"`
+	Versions                 map[string]*RondConfig `json:"versions,omitempty"`
+	// Priority is the x-rond-priority of the operation: the routes with a higher priority
+	// are registered first, so that they match before the overlapping ones.
+	Priority int `json:"-"`
+}
+
+// ForVersion returns the configuration of the API version, or the default
+// configuration if the version has none.
+func (rondConfig *RondConfig) ForVersion(version string) *RondConfig {
+	if versionConfig, ok := rondConfig.Versions[version]; ok && versionConfig != nil {
+		return versionConfig
+	}
+	return rondConfig
 }
 
 // END Config v2 //
@@ -107,14 +193,90 @@ type RondConfig struct {
 type VerbConfig struct {
 	PermissionV1 *XPermission `json:"x-permission"`
 	PermissionV2 *RondConfig  `json:"x-rond"`
+	Priority     int          `json:"x-rond-priority,omitempty"`
 }
 
 type PathVerbs map[string]VerbConfig
 
+// rondExtension is the OAS extension holding the x-rond configuration, either of an
+// operation or of a whole path item.
+const rondExtension = "x-rond"
+
+// UnmarshalJSON parses the operations of a path item, applying the x-rond configuration of
+// the path item to all of its operations. The top level fields of the x-rond configuration
+// of an operation, such as requestFlow, responseFlow and options, override the ones of the
+// path item, while an operation with the legacy x-permission configuration ignores it.
+func (pathVerbs *PathVerbs) UnmarshalJSON(data []byte) error {
+	var rawVerbs map[string]json.RawMessage
+	if err := json.Unmarshal(data, &rawVerbs); err != nil {
+		return err
+	}
+
+	var pathRondConfig map[string]json.RawMessage
+	if rawPathRondConfig, ok := rawVerbs[rondExtension]; ok {
+		if err := json.Unmarshal(rawPathRondConfig, &pathRondConfig); err != nil {
+			return fmt.Errorf("path item %s: %s", rondExtension, err.Error())
+		}
+		delete(rawVerbs, rondExtension)
+	}
+	delete(rawVerbs, matchTypeField)
+
+	verbs := make(PathVerbs, len(rawVerbs))
+	for verb, rawVerb := range rawVerbs {
+		var verbConfig VerbConfig
+		if err := json.Unmarshal(rawVerb, &verbConfig); err != nil {
+			return err
+		}
+		if pathRondConfig != nil && verbConfig.PermissionV1 == nil {
+			rondConfig, err := mergePathRondConfig(pathRondConfig, rawVerb)
+			if err != nil {
+				return fmt.Errorf("%s %s: %s", verb, rondExtension, err.Error())
+			}
+			verbConfig.PermissionV2 = rondConfig
+		}
+		verbs[verb] = verbConfig
+	}
+	*pathVerbs = verbs
+	return nil
+}
+
+// mergePathRondConfig returns the x-rond configuration of the operation, with the top level
+// fields it does not set taken from the configuration of the path item.
+func mergePathRondConfig(pathRondConfig map[string]json.RawMessage, rawVerb json.RawMessage) (*RondConfig, error) {
+	var verbExtensions struct {
+		RondConfig map[string]json.RawMessage `json:"x-rond"`
+	}
+	if err := json.Unmarshal(rawVerb, &verbExtensions); err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string]json.RawMessage, len(pathRondConfig)+len(verbExtensions.RondConfig))
+	for field, value := range pathRondConfig {
+		merged[field] = value
+	}
+	for field, value := range verbExtensions.RondConfig {
+		merged[field] = value
+	}
+	rawMerged, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	var rondConfig RondConfig
+	if err := json.Unmarshal(rawMerged, &rondConfig); err != nil {
+		return nil, err
+	}
+	return &rondConfig, nil
+}
+
 type OpenAPIPaths map[string]PathVerbs
 
 type OpenAPISpec struct {
 	Paths OpenAPIPaths `json:"paths"`
+	// MatchTypes are the matchType of the paths not matched exactly, see PathPatterns.
+	MatchTypes map[string]string `json:"-"`
+
+	pathPatterns   []PathPattern
+	priorityRoutes []priorityRoute
 }
 
 func cleanWildcard(path string) string {
@@ -130,6 +292,9 @@ type RoutesMap map[string]bool
 func (oas *OpenAPISpec) createRoutesMap() RoutesMap {
 	routesMap := make(RoutesMap)
 	for OASPath, OASContent := range oas.Paths {
+		if oas.IsPathPattern(OASPath) {
+			continue
+		}
 		for method := range OASContent {
 			route := OASPath + "/" + strings.ToUpper(method)
 			routesMap[route] = true
@@ -151,30 +316,77 @@ func createOasHandler(scopedMethodContent VerbConfig) func(http.ResponseWriter,
 		header.Set("allow", permission.RequestFlow.PolicyName)
 		header.Set("resourceFilter.rowFilter.enabled", strconv.FormatBool(permission.RequestFlow.GenerateQuery))
 		header.Set("resourceFilter.rowFilter.headerKey", permission.RequestFlow.QueryOptions.HeaderName)
+		header.Set("shadowPolicy", permission.RequestFlow.ShadowPolicy)
 		header.Set("responseFilter.policy", permission.ResponseFlow.PolicyName)
-		header.Set("options.enableResourcePermissionsMapOptimization", strconv.FormatBool(permission.Options.EnableResourcePermissionsMapOptimization))
+		header.Set("responseFilter.ignoreBody", strconv.FormatBool(permission.ResponseFlow.IgnoreBody))
+		if permission.Options.EnableResourcePermissionsMapOptimization != nil {
+			header.Set("options.enableResourcePermissionsMapOptimization", strconv.FormatBool(*permission.Options.EnableResourcePermissionsMapOptimization))
+		}
+		header.Set("options.mode", permission.Options.Mode)
+		header.Set("options.proxyUnknownMethods", strconv.FormatBool(permission.Options.ProxyUnknownMethods))
+		header.Set("options.corsPassthrough", permission.Options.CORSPassthrough)
+		header.Set("options.excludedInputHeaders", strings.Join(permission.Options.ExcludedInputHeaders, ","))
+		header.Set("options.policyModule", permission.Options.PolicyModule)
+		header.Set("contentNegotiationPolicy", permission.ContentNegotiationPolicy)
+		if len(permission.Versions) > 0 {
+			versions, err := json.Marshal(permission.Versions)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			header.Set("versions", string(versions))
+		}
 	}
 }
 
+// routePriorityHeaderKey reports the priority of the route matched by the OAS router.
+const routePriorityHeaderKey = "routePriority"
+
 func (oas *OpenAPISpec) PrepareOASRouter() *bunrouter.CompatRouter {
 	OASRouter := bunrouter.New().Compat()
 	routeMap := oas.createRoutesMap()
-	for OASPath, OASContent := range oas.Paths {
+	priorities := oas.routePriorities()
+	oas.priorityRoutes = oas.prioritizedRoutes()
+	// the paths differing only in the names of their parameters would make the router panic,
+	// as in the service router only the first one in route order is registered
+	registered := map[string]bool{}
+	handle := func(method, path string, handler http.HandlerFunc) {
+		key := method + " " + NormalizePathTemplate(path)
+		if registered[key] {
+			return
+		}
+		registered[key] = true
+		OASRouter.Handle(method, path, handler)
+	}
+	for _, OASPath := range oas.RoutePaths() {
+		// the paths not matched exactly are looked up by FindPermission, see PathPatterns
+		if oas.IsPathPattern(OASPath) {
+			continue
+		}
 
 		OASPathCleaned := ConvertPathVariablesToColons(cleanWildcard(OASPath))
-		for method, methodContent := range OASContent {
+		for method, methodContent := range oas.Paths[OASPath] {
 			scopedMethod := strings.ToUpper(method)
 
-			handler := createOasHandler(methodContent)
+			oasHandler := createOasHandler(methodContent)
+			routePriority := strconv.Itoa(priorities[OASPath])
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(routePriorityHeaderKey, routePriority)
+				oasHandler(w, r)
+			}
 
 			if scopedMethod != strings.ToUpper(AllHTTPMethod) {
-				OASRouter.Handle(scopedMethod, OASPathCleaned, handler)
+				handle(scopedMethod, OASPathCleaned, handler)
+				// HEAD requests are authorized as GET ones, unless explicitly defined
+				if scopedMethod == http.MethodGet && !routeMap.contains(OASPath, http.MethodHead) && !routeMap.contains(OASPath, strings.ToUpper(AllHTTPMethod)) {
+					handle(http.MethodHead, OASPathCleaned, handler)
+				}
 				continue
 			}
 
 			for _, method := range OasSupportedHTTPMethods {
 				if !routeMap.contains(OASPath, method) {
-					OASRouter.Handle(method, OASPathCleaned, handler)
+					handle(method, OASPathCleaned, handler)
 				}
 			}
 		}
@@ -183,6 +395,44 @@ func (oas *OpenAPISpec) PrepareOASRouter() *bunrouter.CompatRouter {
 	return OASRouter
 }
 
+// PrepareKnownPathsRouter returns a router matching the paths of the OAS whatever the method,
+// so that IsKnownPath recognizes them with a single lookup instead of one for each method.
+func (oas *OpenAPISpec) PrepareKnownPathsRouter() *bunrouter.CompatRouter {
+	knownPathsRouter := bunrouter.New().Compat()
+	registered := map[string]bool{}
+	for _, OASPath := range oas.RoutePaths() {
+		if oas.IsPathPattern(OASPath) || len(oas.Paths[OASPath]) == 0 {
+			continue
+		}
+		key := NormalizePathTemplate(OASPath)
+		if registered[key] {
+			continue
+		}
+		registered[key] = true
+		knownPathsRouter.Handle(http.MethodGet, ConvertPathVariablesToColons(cleanWildcard(OASPath)), func(w http.ResponseWriter, r *http.Request) {})
+	}
+	return knownPathsRouter
+}
+
+// IsKnownPath reports whether the path is defined in the OAS for any method.
+func (oas *OpenAPISpec) IsKnownPath(knownPathsRouter *bunrouter.CompatRouter, path string) bool {
+	request, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return false
+	}
+	recorder := httptest.NewRecorder()
+	knownPathsRouter.ServeHTTP(recorder, request)
+	if recorder.Code == http.StatusOK {
+		return true
+	}
+	for _, pattern := range oas.pathPatterns {
+		if pattern.Match(path) {
+			return true
+		}
+	}
+	return false
+}
+
 // FIXME: This is not a logic method of OAS, but could be a method of OASRouter
 func (oas *OpenAPISpec) FindPermission(OASRouter *bunrouter.CompatRouter, path string, method string) (RondConfig, error) {
 	recorder := httptest.NewRecorder()
@@ -190,8 +440,21 @@ func (oas *OpenAPISpec) FindPermission(OASRouter *bunrouter.CompatRouter, path s
 	request, _ := http.NewRequest(method, path, responseReader)
 	OASRouter.ServeHTTP(recorder, request)
 
+	if recorder.Code == http.StatusOK && len(oas.priorityRoutes) > 0 {
+		routedPriority, _ := strconv.Atoi(recorder.Header().Get(routePriorityHeaderKey))
+		if verbConfig, ok := oas.findPriorityVerbConfig(path, method, routedPriority); ok {
+			recorder = httptest.NewRecorder()
+			createOasHandler(verbConfig)(recorder, request)
+		}
+	}
+
 	if recorder.Code != http.StatusOK {
-		return RondConfig{}, fmt.Errorf("%w: %s %s", ErrNotFoundOASDefinition, utils.SanitizeString(method), utils.SanitizeString(path))
+		verbConfig, ok := oas.findPatternVerbConfig(path, method)
+		if !ok {
+			return RondConfig{}, fmt.Errorf("%w: %s %s", ErrNotFoundOASDefinition, utils.SanitizeString(method), utils.SanitizeString(path))
+		}
+		recorder = httptest.NewRecorder()
+		createOasHandler(verbConfig)(recorder, request)
 	}
 
 	recorderResult := recorder.Result()
@@ -199,9 +462,31 @@ func (oas *OpenAPISpec) FindPermission(OASRouter *bunrouter.CompatRouter, path s
 	if err != nil {
 		return RondConfig{}, fmt.Errorf("error while parsing rowFilter.enabled: %s", err)
 	}
-	enableResourcePermissionsMapOptimization, err := strconv.ParseBool(recorderResult.Header.Get("options.enableResourcePermissionsMapOptimization"))
+	var enableResourcePermissionsMapOptimization *bool
+	if optimizationHeader := recorderResult.Header.Get("options.enableResourcePermissionsMapOptimization"); optimizationHeader != "" {
+		enabled, err := strconv.ParseBool(optimizationHeader)
+		if err != nil {
+			return RondConfig{}, fmt.Errorf("error while parsing options.enableResourcePermissionsMapOptimization: %s", err)
+		}
+		enableResourcePermissionsMapOptimization = &enabled
+	}
+	ignoreResponseBody, err := strconv.ParseBool(recorderResult.Header.Get("responseFilter.ignoreBody"))
 	if err != nil {
-		return RondConfig{}, fmt.Errorf("error while parsing rowFilter.enabled: %s", err)
+		return RondConfig{}, fmt.Errorf("error while parsing responseFilter.ignoreBody: %s", err)
+	}
+	proxyUnknownMethods, err := strconv.ParseBool(recorderResult.Header.Get("options.proxyUnknownMethods"))
+	if err != nil {
+		return RondConfig{}, fmt.Errorf("error while parsing options.proxyUnknownMethods: %s", err)
+	}
+	var excludedInputHeaders []string
+	if excludedInputHeadersHeader := recorderResult.Header.Get("options.excludedInputHeaders"); excludedInputHeadersHeader != "" {
+		excludedInputHeaders = strings.Split(excludedInputHeadersHeader, ",")
+	}
+	var versions map[string]*RondConfig
+	if versionsHeader := recorderResult.Header.Get("versions"); versionsHeader != "" {
+		if err := json.Unmarshal([]byte(versionsHeader), &versions); err != nil {
+			return RondConfig{}, fmt.Errorf("error while parsing versions: %s", err)
+		}
 	}
 	return RondConfig{
 		RequestFlow: RequestFlow{
@@ -210,16 +495,41 @@ func (oas *OpenAPISpec) FindPermission(OASRouter *bunrouter.CompatRouter, path s
 			QueryOptions: QueryOptions{
 				HeaderName: recorderResult.Header.Get("resourceFilter.rowFilter.headerKey"),
 			},
+			ShadowPolicy: recorderResult.Header.Get("shadowPolicy"),
 		},
 		ResponseFlow: ResponseFlow{
 			PolicyName: recorderResult.Header.Get("responseFilter.policy"),
+			IgnoreBody: ignoreResponseBody,
 		},
 		Options: PermissionOptions{
 			EnableResourcePermissionsMapOptimization: enableResourcePermissionsMapOptimization,
+			Mode:                                     recorderResult.Header.Get("options.mode"),
+			ProxyUnknownMethods:                      proxyUnknownMethods,
+			CORSPassthrough:                          recorderResult.Header.Get("options.corsPassthrough"),
+			ExcludedInputHeaders:                     excludedInputHeaders,
+			PolicyModule:                             recorderResult.Header.Get("options.policyModule"),
 		},
+		ContentNegotiationPolicy: recorderResult.Header.Get("contentNegotiationPolicy"),
+		Versions:                 versions,
 	}, nil
 }
 
+// AllowedMethods returns the methods defined for the path, and whether the requests
+// with the other methods must be proxied as set by the proxyUnknownMethods option.
+func (oas *OpenAPISpec) AllowedMethods(OASRouter *bunrouter.CompatRouter, path string) ([]string, bool) {
+	allowedMethods := []string{}
+	proxyUnknownMethods := false
+	for _, method := range OasSupportedHTTPMethods {
+		permission, err := oas.FindPermission(OASRouter, path, method)
+		if err != nil {
+			continue
+		}
+		allowedMethods = append(allowedMethods, method)
+		proxyUnknownMethods = proxyUnknownMethods || permission.Options.ProxyUnknownMethods
+	}
+	return allowedMethods, proxyUnknownMethods
+}
+
 func newRondConfigFromPermissionV1(v1Permission *XPermission) *RondConfig {
 	return &RondConfig{
 		RequestFlow: RequestFlow{
@@ -250,12 +560,71 @@ func adaptOASSpec(spec *OpenAPISpec) {
 				}
 				verbConfig.PermissionV1 = nil
 			}
+			if verbConfig.PermissionV2 != nil {
+				verbConfig.PermissionV2.Priority = verbConfig.Priority
+			}
 			pathConfig[verb] = verbConfig
 		}
 		spec.Paths[path] = pathConfig
 	}
 }
 
+var ErrInvalidRondConfig = errors.New("invalid x-rond configuration")
+
+// validateOASSpec checks the x-rond configurations that cannot be detected
+// while unmarshalling the spec.
+func validateOASSpec(spec *OpenAPISpec) error {
+	for path, pathConfig := range spec.Paths {
+		for verb, verbConfig := range pathConfig {
+			if verbConfig.PermissionV2 == nil {
+				continue
+			}
+			if err := validateRondConfig(verbConfig.PermissionV2); err != nil {
+				return fmt.Errorf("%w: %s %s: %s", ErrInvalidRondConfig, verb, path, err.Error())
+			}
+			if len(verbConfig.PermissionV2.Versions) > 0 && verbConfig.PermissionV2.ContentNegotiationPolicy == "" {
+				return fmt.Errorf("%w: %s %s: versions require contentNegotiationPolicy", ErrInvalidRondConfig, verb, path)
+			}
+			for version, versionConfig := range verbConfig.PermissionV2.Versions {
+				if versionConfig == nil || versionConfig.RequestFlow.PolicyName == "" {
+					return fmt.Errorf("%w: %s %s: versions.%s requires requestFlow.policyName", ErrInvalidRondConfig, verb, path, version)
+				}
+				if versionConfig.ContentNegotiationPolicy != "" || len(versionConfig.Versions) > 0 {
+					return fmt.Errorf("%w: %s %s: versions.%s cannot be versioned", ErrInvalidRondConfig, verb, path, version)
+				}
+				if err := validateRondConfig(versionConfig); err != nil {
+					return fmt.Errorf("%w: %s %s: versions.%s: %s", ErrInvalidRondConfig, verb, path, version, err.Error())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func validateRondConfig(rondConfig *RondConfig) error {
+	requestFlow := rondConfig.RequestFlow
+	if requestFlow.ShadowPolicy != "" && requestFlow.GenerateQuery {
+		return fmt.Errorf("requestFlow.shadowPolicy is not supported with requestFlow.generateQuery")
+	}
+	responseFlow := rondConfig.ResponseFlow
+	if responseFlow.IgnoreBody && responseFlow.PolicyName == "" {
+		return fmt.Errorf("responseFlow.ignoreBody requires responseFlow.policyName")
+	}
+	if mode := rondConfig.Options.Mode; mode != "" && !utils.Contains(config.PolicyModes, mode) {
+		return fmt.Errorf("unknown options.mode %s", mode)
+	}
+	if corsPassthrough := rondConfig.Options.CORSPassthrough; corsPassthrough != "" && !utils.Contains(config.CORSPassthroughModes, corsPassthrough) {
+		return fmt.Errorf("unknown options.corsPassthrough %s", corsPassthrough)
+	}
+	if policyModule := rondConfig.Options.PolicyModule; policyModule != "" && path.Ext(policyModule) != ".rego" {
+		return fmt.Errorf("options.policyModule %s is not a rego file", policyModule)
+	}
+	if rondConfig.Options.RequestTimeoutMs < 0 {
+		return fmt.Errorf("options.requestTimeoutMs %d must not be negative", rondConfig.Options.RequestTimeoutMs)
+	}
+	return nil
+}
+
 func deserializeSpec(spec []byte, errorWrapper error) (*OpenAPISpec, error) {
 	var oas OpenAPISpec
 	if err := json.Unmarshal(spec, &oas); err != nil {
@@ -264,22 +633,114 @@ func deserializeSpec(spec []byte, errorWrapper error) (*OpenAPISpec, error) {
 
 	adaptOASSpec(&oas)
 
+	if err := validateOASSpec(&oas); err != nil {
+		return nil, fmt.Errorf("%w: %s", errorWrapper, err.Error())
+	}
+
+	matchTypes, err := parsePathMatchTypes(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unmarshal error: %s", errorWrapper, err.Error())
+	}
+	oas.MatchTypes = matchTypes
+	if err := oas.compilePathPatterns(false); err != nil {
+		return nil, fmt.Errorf("%w: %s", errorWrapper, err.Error())
+	}
+
 	return &oas, nil
 }
 
 func fetchOpenAPI(url string) (*OpenAPISpec, error) {
-	resp, err := http.DefaultClient.Get(url)
+	oas, _, err := fetchOpenAPIDocument(url, nil)
+	return oas, err
+}
+
+// newOASRequest returns the request fetching the OAS, sending the configured headers
+// along with an explicit Accept header, since some frameworks serve the documentation
+// as HTML by default.
+func newOASRequest(url string, headers map[string]string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
+
+// fetchOpenAPIDocument is like fetchOpenAPI, returning the fetched document as well.
+func fetchOpenAPIDocument(url string, headers map[string]string) (*OpenAPISpec, []byte, error) {
+	req, err := newOASRequest(url, headers)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %s", ErrRequestFailed, err)
+		return nil, nil, fmt.Errorf("%w: %s", ErrRequestFailed, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrRequestFailed, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%w: invalid status code %d", ErrRequestFailed, resp.StatusCode)
+		return nil, nil, fmt.Errorf("%w: invalid status code %d", ErrRequestFailed, resp.StatusCode)
 	}
 
 	bodyBytes, _ := io.ReadAll(resp.Body)
-	return deserializeSpec(bodyBytes, ErrRequestFailed)
+	oas, err := deserializeSpec(bodyBytes, ErrRequestFailed)
+	if err != nil {
+		return nil, nil, err
+	}
+	return oas, bodyBytes, nil
+}
+
+// maxOASFetchBackoff bounds the exponential backoff between the OAS fetch attempts.
+const maxOASFetchBackoff = 30 * time.Second
+
+// fetchOpenAPIWithRetry fetches the OAS from the target service, retrying with an exponential
+// backoff starting from OAS_FETCH_BACKOFF_MS. OAS_FETCH_MAX_RETRIES bounds the retries, the
+// fetch is retried until it succeeds when it is 0. The fetched document is persisted to
+// OAS_CACHE_PATH, if set.
+func fetchOpenAPIWithRetry(log *logrus.Logger, documentationURL string, env config.EnvironmentVariables) (*OpenAPISpec, error) {
+	backoff := time.Duration(env.OASFetchBackoffMs) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		oas, document, err := fetchOpenAPIDocument(documentationURL, env.TargetServiceOASHeaders)
+		if err == nil {
+			if env.OASCachePath != "" {
+				if err := writeOASCache(env.OASCachePath, document); err != nil {
+					log.WithFields(logrus.Fields{
+						"oasCachePath": env.OASCachePath,
+						"error":        logrus.Fields{"message": err.Error()},
+					}).Warn("failed OAS cache write")
+				}
+			}
+			return oas, nil
+		}
+		if env.OASFetchMaxRetries > 0 && attempt > env.OASFetchMaxRetries {
+			return nil, err
+		}
+
+		log.WithFields(logrus.Fields{
+			"targetServiceHost": env.TargetServiceHost,
+			"targetOASPath":     env.TargetServiceOASPath,
+			"attempt":           attempt,
+			"retryIn":           backoff.String(),
+			"error":             logrus.Fields{"message": err.Error()},
+		}).Warn("failed OAS fetch, retrying")
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxOASFetchBackoff {
+			backoff = maxOASFetchBackoff
+		}
+	}
+}
+
+// writeOASCache persists the OAS document, replacing the previous one atomically so that
+// a partially written cache is never read.
+func writeOASCache(path string, document []byte) error {
+	temporaryPath := path + ".tmp"
+	if err := os.WriteFile(temporaryPath, document, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, path)
 }
 
 func LoadOASFile(APIPermissionsFilePath string) (*OpenAPISpec, error) {
@@ -301,33 +762,114 @@ func LoadOASFromFileOrNetwork(log *logrus.Logger, env config.EnvironmentVariable
 			return nil, err
 		}
 
-		return oas, nil
+		return normalizeOASPathsCase(oas, env)
+	}
+
+	if oasFilePath, ok := env.GetLocalOASFilePath(); ok {
+		log.WithField("oasFilePath", oasFilePath).Debug("Attempt to load OAS from file")
+		oas, err := LoadOASFile(oasFilePath)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"oasFilePath": oasFilePath,
+			}).Warn("failed OAS file read")
+			return nil, err
+		}
+
+		return normalizeOASPathsCase(oas, env)
 	}
 
 	if env.TargetServiceOASPath != "" {
-		log.WithField("oasApiPath", env.TargetServiceOASPath).Debug("Attempt to load OAS from target service")
-		var oas *OpenAPISpec
+		// only the names of the headers are logged, since their values are usually credentials
+		log.WithFields(logrus.Fields{
+			"oasApiPath":    env.TargetServiceOASPath,
+			"oasHeaderKeys": oasHeaderNames(env.TargetServiceOASHeaders),
+		}).Debug("Attempt to load OAS from target service")
 		documentationURL := fmt.Sprintf("%s://%s%s", HTTPScheme, env.TargetServiceHost, env.TargetServiceOASPath)
-		for {
-			fetchedOAS, err := fetchOpenAPI(documentationURL)
-			if err != nil {
-				log.WithFields(logrus.Fields{
-					"targetServiceHost": env.TargetServiceHost,
-					"targetOASPath":     env.TargetServiceOASPath,
-					"error":             logrus.Fields{"message": err.Error()},
-				}).Warn("failed OAS fetch, retry in 1s")
-				time.Sleep(1 * time.Second)
-				continue
+		oas, err := fetchOpenAPIWithRetry(log, documentationURL, env)
+		if err != nil {
+			if env.OASCachePath == "" {
+				return nil, err
 			}
-			oas = fetchedOAS
-			break
+			cachedOAS, cacheErr := LoadOASFile(env.OASCachePath)
+			if cacheErr != nil {
+				return nil, fmt.Errorf("%s, cached OAS not available: %s", err.Error(), cacheErr.Error())
+			}
+			log.WithFields(logrus.Fields{
+				"oasCachePath": env.OASCachePath,
+				"error":        logrus.Fields{"message": err.Error()},
+			}).Warn("failed OAS fetch, using the cached OAS")
+			oas = cachedOAS
 		}
-		return oas, nil
+		return normalizeOASPathsCase(oas, env)
 	}
 
 	return nil, fmt.Errorf("missing environment variables one of %s or %s is required", config.TargetServiceOASPathEnvKey, config.APIPermissionsFilePathEnvKey)
 }
 
+// oasHeaderNames returns the sorted names of the headers sent fetching the OAS.
+func oasHeaderNames(headers map[string]string) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// normalizeOASPathsCase lowercases the OAS paths when case-insensitive routing is
+// enabled, leaving the path parameter names untouched.
+func normalizeOASPathsCase(oas *OpenAPISpec, env config.EnvironmentVariables) (*OpenAPISpec, error) {
+	if !env.CaseInsensitiveRouting {
+		return oas, nil
+	}
+
+	paths := make(OpenAPIPaths, len(oas.Paths))
+	var matchTypes map[string]string
+	for path, verbs := range oas.Paths {
+		lowercasePath := LowercasePathTemplate(path)
+		matchType, isPattern := oas.MatchTypes[path]
+		// the regular expressions are not lowercased, they are compiled ignoring the case
+		if matchType == PathMatchTypeRegex {
+			lowercasePath = path
+		}
+		if _, ok := paths[lowercasePath]; ok {
+			return nil, fmt.Errorf("%w: path %s conflicts with another path when routing is case-insensitive", ErrInvalidRondConfig, path)
+		}
+		paths[lowercasePath] = verbs
+		if isPattern {
+			if matchTypes == nil {
+				matchTypes = map[string]string{}
+			}
+			matchTypes[lowercasePath] = matchType
+		}
+	}
+	oas.Paths = paths
+	oas.MatchTypes = matchTypes
+	if err := oas.compilePathPatterns(true); err != nil {
+		return nil, err
+	}
+	return oas, nil
+}
+
+// LowercasePathTemplate lowercases the path, except for the names of the path parameters.
+func LowercasePathTemplate(path string) string {
+	var builder strings.Builder
+	builder.Grow(len(path))
+	insideParam := false
+	for _, char := range path {
+		switch {
+		case char == '{':
+			insideParam = true
+		case char == '}':
+			insideParam = false
+		case !insideParam:
+			char = unicode.ToLower(char)
+		}
+		builder.WriteRune(char)
+	}
+	return builder.String()
+}
+
 func WithXPermission(requestContext context.Context, permission *RondConfig) context.Context {
 	return context.WithValue(requestContext, XPermissionKey{}, permission)
 }
@@ -342,10 +884,26 @@ func GetXPermission(requestContext context.Context) (*RondConfig, error) {
 	return permission, nil
 }
 
-var matchColons = regexp.MustCompile(`\/:(\w+)`)
+// matchPathVariables matches both the OpenAPI {param} and the Express.js /:param path
+// variables, as well as the braces that are not part of a path variable.
+var matchPathVariables = regexp.MustCompile(`\{\w+\}|/:\w+|[{}]`)
 
+// ConvertPathVariablesToBrackets converts the path to the gorilla/mux template format,
+// normalizing both {param} and :param variables to {param}. Literal braces are
+// percent-encoded, since routes are matched against the encoded request path.
 func ConvertPathVariablesToBrackets(path string) string {
-	return matchColons.ReplaceAllString(path, "/{$1}")
+	return matchPathVariables.ReplaceAllStringFunc(path, func(match string) string {
+		switch {
+		case match == "{":
+			return "%7B"
+		case match == "}":
+			return "%7D"
+		case strings.HasPrefix(match, "/:"):
+			return fmt.Sprintf("/{%s}", match[2:])
+		default:
+			return match
+		}
+	})
 }
 
 var matchBrackets = regexp.MustCompile(`\/{(\w+)}`)
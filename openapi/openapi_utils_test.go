@@ -18,9 +18,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/utils"
+	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/h2non/gock.v1"
@@ -161,6 +167,69 @@ func TestLoadOASFile(t *testing.T) {
 		}, openAPIFile.Paths)
 	})
 
+	t.Run("applies the path level x-rond configuration", func(t *testing.T) {
+		openAPIFile, err := LoadOASFile("../mocks/pathLevelRondConfig.json")
+		require.NoError(t, err)
+		require.Equal(t, OpenAPIPaths{
+			"/projects/": PathVerbs{
+				"get": VerbConfig{
+					PermissionV2: &RondConfig{
+						RequestFlow: RequestFlow{PolicyName: "allow_projects"},
+						Options:     PermissionOptions{Mode: "log-only"},
+					},
+				},
+				"post": VerbConfig{
+					PermissionV2: &RondConfig{
+						RequestFlow: RequestFlow{PolicyName: "create_project"},
+						Options:     PermissionOptions{Mode: "log-only"},
+					},
+				},
+				"put": VerbConfig{
+					PermissionV2: &RondConfig{
+						RequestFlow:  RequestFlow{PolicyName: "allow_projects"},
+						ResponseFlow: ResponseFlow{PolicyName: "filter_project"},
+						Options:      PermissionOptions{ExcludedInputHeaders: []string{"authorization"}},
+					},
+				},
+			},
+			"/projects/{projectId}/members": PathVerbs{
+				"all": VerbConfig{
+					PermissionV2: &RondConfig{
+						RequestFlow:  RequestFlow{PolicyName: "allow_members"},
+						ResponseFlow: ResponseFlow{PolicyName: "filter_members"},
+					},
+				},
+				"get": VerbConfig{
+					PermissionV2: &RondConfig{
+						RequestFlow: RequestFlow{PolicyName: "allow_members"},
+					},
+				},
+			},
+			"/legacy": PathVerbs{
+				"get": VerbConfig{
+					PermissionV2: &RondConfig{
+						RequestFlow: RequestFlow{PolicyName: "legacy_permission"},
+					},
+				},
+				"delete": VerbConfig{
+					PermissionV2: &RondConfig{
+						RequestFlow: RequestFlow{PolicyName: "allow_legacy"},
+					},
+				},
+			},
+		}, openAPIFile.Paths)
+
+		OASRouter := openAPIFile.PrepareOASRouter()
+		found, err := openAPIFile.FindPermission(OASRouter, "/projects/p1/members", http.MethodPatch)
+		require.NoError(t, err)
+		require.Equal(t, "allow_members", found.RequestFlow.PolicyName)
+		require.Equal(t, "filter_members", found.ResponseFlow.PolicyName)
+		found, err = openAPIFile.FindPermission(OASRouter, "/projects/p1/members", http.MethodGet)
+		require.NoError(t, err)
+		require.Equal(t, "allow_members", found.RequestFlow.PolicyName)
+		require.Empty(t, found.ResponseFlow.PolicyName)
+	})
+
 	t.Run("fail for invalid filePath", func(t *testing.T) {
 		_, err := LoadOASFile("./notExistingFilePath.json")
 
@@ -169,6 +238,38 @@ func TestLoadOASFile(t *testing.T) {
 	})
 }
 
+func TestNormalizeOASPathsCase(t *testing.T) {
+	newSpec := func(paths ...string) *OpenAPISpec {
+		oas := &OpenAPISpec{Paths: OpenAPIPaths{}}
+		for _, path := range paths {
+			oas.Paths[path] = PathVerbs{"get": VerbConfig{}}
+		}
+		return oas
+	}
+
+	t.Run("paths are left untouched with case-sensitive routing", func(t *testing.T) {
+		oas, err := normalizeOASPathsCase(newSpec("/Users/{userId}"), config.EnvironmentVariables{})
+		require.NoError(t, err)
+		require.Equal(t, newSpec("/Users/{userId}"), oas)
+	})
+
+	t.Run("paths are lowercased keeping path parameters names", func(t *testing.T) {
+		oas, err := normalizeOASPathsCase(newSpec("/Users/{userId}/Orders", "/health"), config.EnvironmentVariables{CaseInsensitiveRouting: true})
+		require.NoError(t, err)
+		require.Equal(t, newSpec("/users/{userId}/orders", "/health"), oas)
+	})
+
+	t.Run("fails on paths differing only in case", func(t *testing.T) {
+		_, err := normalizeOASPathsCase(newSpec("/Users", "/users"), config.EnvironmentVariables{CaseInsensitiveRouting: true})
+		require.ErrorIs(t, err, ErrInvalidRondConfig)
+	})
+}
+
+func TestLowercasePathTemplate(t *testing.T) {
+	require.Equal(t, "/users/{userId}/orders/{orderId}", LowercasePathTemplate("/Users/{userId}/ORDERS/{orderId}"))
+	require.Equal(t, "/files/*", LowercasePathTemplate("/Files/*"))
+}
+
 func TestLoadOAS(t *testing.T) {
 	log, _ := test.NewNullLogger()
 
@@ -261,6 +362,131 @@ func TestLoadOAS(t *testing.T) {
 		}, openApiSpec.Paths)
 	})
 
+	t.Run("sends the configured headers fetching the OAS", func(t *testing.T) {
+		log, hook := test.NewNullLogger()
+		log.SetLevel(logrus.DebugLevel)
+		envs := config.EnvironmentVariables{
+			TargetServiceHost:       "localhost:3000",
+			TargetServiceOASPath:    "/documentation/json",
+			TargetServiceOASHeaders: map[string]string{"Authorization": "Bearer my-secret-token", "X-Tenant": "acme"},
+		}
+
+		defer gock.Off()
+		gock.New("http://localhost:3000").
+			Get("/documentation/json").
+			MatchHeader("Accept", "application/json").
+			MatchHeader("Authorization", "Bearer my-secret-token").
+			MatchHeader("X-Tenant", "acme").
+			Reply(200).
+			File("../mocks/simplifiedMock.json")
+
+		openApiSpec, err := LoadOASFromFileOrNetwork(log, envs)
+		require.True(t, gock.IsDone(), "Mock has not been invoked")
+		require.NoError(t, err)
+		require.Contains(t, openApiSpec.Paths, "/users/")
+
+		for _, entry := range hook.AllEntries() {
+			formatted, err := entry.String()
+			require.NoError(t, err)
+			require.NotContains(t, formatted, "my-secret-token")
+		}
+		require.Equal(t, []string{"Authorization", "X-Tenant"}, hook.AllEntries()[0].Data["oasHeaderKeys"])
+	})
+
+	t.Run("retries the OAS fetch with backoff", func(t *testing.T) {
+		cachePath := filepath.Join(t.TempDir(), "oas.json")
+		envs := config.EnvironmentVariables{
+			TargetServiceHost:    "localhost:3000",
+			TargetServiceOASPath: "/documentation/json",
+			OASFetchMaxRetries:   2,
+			OASFetchBackoffMs:    1,
+			OASCachePath:         cachePath,
+		}
+
+		defer gock.Off()
+		gock.New("http://localhost:3000").
+			Get("/documentation/json").
+			Times(2).
+			Reply(http.StatusServiceUnavailable)
+		gock.New("http://localhost:3000").
+			Get("/documentation/json").
+			Reply(200).
+			File("../mocks/simplifiedMock.json")
+
+		openApiSpec, err := LoadOASFromFileOrNetwork(log, envs)
+		require.True(t, gock.IsDone(), "Mock has not been invoked")
+		require.NoError(t, err)
+		require.Contains(t, openApiSpec.Paths, "/users/")
+
+		cachedOAS, err := LoadOASFile(cachePath)
+		require.NoError(t, err)
+		require.Equal(t, openApiSpec, cachedOAS)
+	})
+
+	t.Run("falls back to the cached OAS after the last retry", func(t *testing.T) {
+		cachePath := filepath.Join(t.TempDir(), "oas.json")
+		envs := config.EnvironmentVariables{
+			TargetServiceHost:    "localhost:3000",
+			TargetServiceOASPath: "/documentation/json",
+			OASFetchMaxRetries:   1,
+			OASFetchBackoffMs:    1,
+		}
+
+		defer gock.Off()
+		gock.New("http://localhost:3000").
+			Get("/documentation/json").
+			Times(2).
+			Reply(http.StatusServiceUnavailable)
+
+		_, err := LoadOASFromFileOrNetwork(log, envs)
+		require.True(t, gock.IsDone(), "Mock has not been invoked")
+		require.ErrorIs(t, err, ErrRequestFailed)
+
+		envs.OASCachePath = cachePath
+		gock.New("http://localhost:3000").
+			Get("/documentation/json").
+			Times(2).
+			Reply(http.StatusServiceUnavailable)
+		_, err = LoadOASFromFileOrNetwork(log, envs)
+		require.ErrorContains(t, err, "cached OAS not available")
+
+		document, err := os.ReadFile("../mocks/simplifiedMock.json")
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(cachePath, document, 0600))
+		gock.New("http://localhost:3000").
+			Get("/documentation/json").
+			Times(2).
+			Reply(http.StatusServiceUnavailable)
+		openApiSpec, err := LoadOASFromFileOrNetwork(log, envs)
+		require.True(t, gock.IsDone(), "Mock has not been invoked")
+		require.NoError(t, err)
+		require.Contains(t, openApiSpec.Paths, "/users/")
+	})
+
+	t.Run("reads the OAS from a local file", func(t *testing.T) {
+		workingDirectory, err := os.Getwd()
+		require.NoError(t, err)
+		require.NoError(t, os.Chdir(".."))
+		defer os.Chdir(workingDirectory)
+		fixturePath, err := filepath.Abs("mocks/simplifiedMock.json")
+		require.NoError(t, err)
+
+		expectedOAS, err := LoadOASFile(fixturePath)
+		require.NoError(t, err)
+		for _, oasPath := range []string{"file://./mocks/simplifiedMock.json", "file://" + fixturePath, "mocks/simplifiedMock.json"} {
+			envs := config.EnvironmentVariables{
+				TargetServiceHost:    "localhost:3000",
+				TargetServiceOASPath: oasPath,
+			}
+			openApiSpec, err := LoadOASFromFileOrNetwork(log, envs)
+			require.NoError(t, err, oasPath)
+			require.Equal(t, expectedOAS, openApiSpec, oasPath)
+		}
+
+		_, err = LoadOASFromFileOrNetwork(log, config.EnvironmentVariables{TargetServiceOASPath: "file://./mocks/missing.json"})
+		require.ErrorIs(t, err, utils.ErrFileLoadFailed)
+	})
+
 	t.Run("expect to throw if TargetServiceOASPath or APIPermissionsFilePath is not set", func(t *testing.T) {
 		envs := config.EnvironmentVariables{
 			TargetServiceHost: "localhost:3000",
@@ -394,6 +620,391 @@ func TestFindPermission(t *testing.T) {
 		require.Equal(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_commit"}}, found)
 		require.NoError(t, err)
 	})
+
+	t.Run("shadow policy", func(t *testing.T) {
+		permission := RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_export", ShadowPolicy: "new_allow_export"}}
+		oas := &OpenAPISpec{Paths: OpenAPIPaths{"/export": PathVerbs{"get": VerbConfig{PermissionV2: &permission}}}}
+		OASRouter := oas.PrepareOASRouter()
+
+		found, err := oas.FindPermission(OASRouter, "/export", "GET")
+		require.NoError(t, err)
+		require.Equal(t, permission, found)
+	})
+}
+
+func TestFindPermissionWithIgnoredResponseBody(t *testing.T) {
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/export": PathVerbs{
+				"get": VerbConfig{
+					PermissionV2: &RondConfig{
+						RequestFlow:  RequestFlow{PolicyName: "allow_export"},
+						ResponseFlow: ResponseFlow{PolicyName: "check_export", IgnoreBody: true},
+					},
+				},
+			},
+		},
+	}
+	OASRouter := oas.PrepareOASRouter()
+
+	found, err := oas.FindPermission(OASRouter, "/export", "GET")
+	require.NoError(t, err)
+	require.Equal(t, RondConfig{
+		RequestFlow:  RequestFlow{PolicyName: "allow_export"},
+		ResponseFlow: ResponseFlow{PolicyName: "check_export", IgnoreBody: true},
+	}, found)
+}
+
+func TestFindPermissionWithMixedPathVariables(t *testing.T) {
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/users/{userId}/posts/:postId": PathVerbs{
+				"get": VerbConfig{
+					PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_post"}},
+				},
+			},
+			"/tenants/:tenantId/projects/{projectId}/envs/:envId": PathVerbs{
+				"get": VerbConfig{
+					PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_env"}},
+				},
+			},
+		},
+	}
+	OASRouter := oas.PrepareOASRouter()
+
+	found, err := oas.FindPermission(OASRouter, "/users/u1/posts/p1", "GET")
+	require.NoError(t, err)
+	require.Equal(t, "allow_post", found.RequestFlow.PolicyName)
+
+	found, err = oas.FindPermission(OASRouter, "/tenants/t1/projects/p1/envs/e1", "GET")
+	require.NoError(t, err)
+	require.Equal(t, "allow_env", found.RequestFlow.PolicyName)
+}
+
+func TestFindPermissionWithVersions(t *testing.T) {
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/api": PathVerbs{
+				"get": VerbConfig{
+					PermissionV2: &RondConfig{
+						RequestFlow:              RequestFlow{PolicyName: "allow_v1"},
+						ContentNegotiationPolicy: "api_version",
+						Versions: map[string]*RondConfig{
+							"v2": {RequestFlow: RequestFlow{PolicyName: "allow_v2"}},
+						},
+					},
+				},
+			},
+		},
+	}
+	OASRouter := oas.PrepareOASRouter()
+
+	found, err := oas.FindPermission(OASRouter, "/api", "GET")
+	require.NoError(t, err)
+	require.Equal(t, "api_version", found.ContentNegotiationPolicy)
+	require.Equal(t, map[string]*RondConfig{
+		"v2": {RequestFlow: RequestFlow{PolicyName: "allow_v2"}},
+	}, found.Versions)
+}
+
+func TestRondConfigForVersion(t *testing.T) {
+	v2Config := &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_v2"}}
+	rondConfig := &RondConfig{
+		RequestFlow: RequestFlow{PolicyName: "allow_v1"},
+		Versions:    map[string]*RondConfig{"v2": v2Config},
+	}
+
+	t.Run("returns the version configuration", func(t *testing.T) {
+		require.Equal(t, v2Config, rondConfig.ForVersion("v2"))
+	})
+
+	t.Run("falls back to the default configuration", func(t *testing.T) {
+		require.Equal(t, rondConfig, rondConfig.ForVersion("v3"))
+		require.Equal(t, rondConfig, rondConfig.ForVersion(""))
+	})
+}
+
+func TestFindPermissionHeadMethod(t *testing.T) {
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/users": PathVerbs{
+				"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_get"}}},
+			},
+			"/head": PathVerbs{
+				"get":  VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_get"}}},
+				"head": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_head"}}},
+			},
+			"/all": PathVerbs{
+				"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_get"}}},
+				"all": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_all"}}},
+			},
+			"/write": PathVerbs{
+				"post": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_post"}}},
+			},
+		},
+	}
+	OASRouter := oas.PrepareOASRouter()
+
+	t.Run("HEAD uses the GET permission", func(t *testing.T) {
+		found, err := oas.FindPermission(OASRouter, "/users", http.MethodHead)
+		require.NoError(t, err)
+		require.Equal(t, "allow_get", found.RequestFlow.PolicyName)
+	})
+
+	t.Run("explicit HEAD permission takes precedence", func(t *testing.T) {
+		found, err := oas.FindPermission(OASRouter, "/head", http.MethodHead)
+		require.NoError(t, err)
+		require.Equal(t, "allow_head", found.RequestFlow.PolicyName)
+	})
+
+	t.Run("all permission takes precedence", func(t *testing.T) {
+		found, err := oas.FindPermission(OASRouter, "/all", http.MethodHead)
+		require.NoError(t, err)
+		require.Equal(t, "allow_all", found.RequestFlow.PolicyName)
+	})
+
+	t.Run("HEAD is not found without GET", func(t *testing.T) {
+		_, err := oas.FindPermission(OASRouter, "/write", http.MethodHead)
+		require.ErrorIs(t, err, ErrNotFoundOASDefinition)
+	})
+}
+
+func TestAllowedMethods(t *testing.T) {
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/users/{userId}": PathVerbs{
+				"get":    VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow"}}},
+				"delete": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow"}}},
+			},
+			"/public": PathVerbs{
+				"get": VerbConfig{
+					PermissionV2: &RondConfig{
+						RequestFlow: RequestFlow{PolicyName: "allow"},
+						Options:     PermissionOptions{ProxyUnknownMethods: true},
+					},
+				},
+			},
+		},
+	}
+	OASRouter := oas.PrepareOASRouter()
+
+	t.Run("returns the methods defined for the path", func(t *testing.T) {
+		allowedMethods, proxyUnknownMethods := oas.AllowedMethods(OASRouter, "/users/u1")
+		require.Equal(t, []string{http.MethodGet, http.MethodDelete, http.MethodHead}, allowedMethods)
+		require.False(t, proxyUnknownMethods)
+	})
+
+	t.Run("returns whether unknown methods must be proxied", func(t *testing.T) {
+		allowedMethods, proxyUnknownMethods := oas.AllowedMethods(OASRouter, "/public")
+		require.Equal(t, []string{http.MethodGet, http.MethodHead}, allowedMethods)
+		require.True(t, proxyUnknownMethods)
+	})
+
+	t.Run("returns no methods for unknown paths", func(t *testing.T) {
+		allowedMethods, proxyUnknownMethods := oas.AllowedMethods(OASRouter, "/unknown")
+		require.Empty(t, allowedMethods)
+		require.False(t, proxyUnknownMethods)
+	})
+}
+
+func TestIsKnownPath(t *testing.T) {
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/users/{userId}": PathVerbs{
+				"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow"}}},
+			},
+			"/users/{userId}/groups": PathVerbs{
+				"delete": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow"}}},
+			},
+			"/users/me/settings": PathVerbs{
+				"post": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow"}}},
+			},
+			"/files/*": PathVerbs{
+				"all": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow"}}},
+			},
+		},
+	}
+	knownPathsRouter := oas.PrepareKnownPathsRouter()
+	OASRouter := oas.PrepareOASRouter()
+
+	for _, path := range []string{"/users/u1", "/users/me", "/users/me/groups", "/users/me/settings", "/files/a/b"} {
+		t.Run(fmt.Sprintf("%s is known", path), func(t *testing.T) {
+			require.True(t, oas.IsKnownPath(knownPathsRouter, path))
+			allowedMethods, _ := oas.AllowedMethods(OASRouter, path)
+			require.NotEmpty(t, allowedMethods, "the path has allowed methods")
+		})
+	}
+
+	for _, path := range []string{"/users", "/users/u1/settings", "/unknown"} {
+		t.Run(fmt.Sprintf("%s is unknown", path), func(t *testing.T) {
+			require.False(t, oas.IsKnownPath(knownPathsRouter, path))
+			allowedMethods, _ := oas.AllowedMethods(OASRouter, path)
+			require.Empty(t, allowedMethods, "the path has no allowed methods")
+		})
+	}
+}
+
+func TestValidateOASSpec(t *testing.T) {
+	t.Run("ignoreBody with response policy", func(t *testing.T) {
+		err := validateOASSpec(&OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/export": PathVerbs{
+					"get": VerbConfig{
+						PermissionV2: &RondConfig{
+							RequestFlow:  RequestFlow{PolicyName: "allow_export"},
+							ResponseFlow: ResponseFlow{PolicyName: "check_export", IgnoreBody: true},
+						},
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("ignoreBody without response policy", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/export":{"get":{"x-rond":{"requestFlow":{"policyName":"allow_export"},"responseFlow":{"ignoreBody":true}}}}}}`), utils.ErrFileLoadFailed)
+		require.ErrorIs(t, err, utils.ErrFileLoadFailed)
+		require.Contains(t, err.Error(), "responseFlow.ignoreBody requires responseFlow.policyName")
+	})
+
+	t.Run("path level configuration overridden by an operation", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/export":{"x-rond":{"requestFlow":{"policyName":"allow_export"},"responseFlow":{"policyName":"check_export","ignoreBody":true}},"get":{"x-rond":{"responseFlow":{"ignoreBody":true}}}}}}`), utils.ErrFileLoadFailed)
+		require.ErrorIs(t, err, utils.ErrFileLoadFailed)
+		require.Contains(t, err.Error(), "get /export: responseFlow.ignoreBody requires responseFlow.policyName")
+	})
+
+	t.Run("invalid path level configuration", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/export":{"x-rond":{"requestFlow":{"policyName":"allow_export"},"options":{"mode":"permissive"}},"get":{},"post":{"x-rond":{"options":{"mode":"enforce"}}}}}}`), utils.ErrFileLoadFailed)
+		require.ErrorIs(t, err, utils.ErrFileLoadFailed)
+		require.Contains(t, err.Error(), "get /export: unknown options.mode permissive")
+	})
+
+	t.Run("malformed path level configuration", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/export":{"x-rond":"allow_export","get":{}}}}`), utils.ErrFileLoadFailed)
+		require.ErrorIs(t, err, utils.ErrFileLoadFailed)
+		require.Contains(t, err.Error(), "path item x-rond")
+	})
+
+	t.Run("known policy mode", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/export":{"get":{"x-rond":{"requestFlow":{"policyName":"allow_export"},"options":{"mode":"log-only"}}}}}}`), utils.ErrFileLoadFailed)
+		require.NoError(t, err)
+	})
+
+	t.Run("unknown policy mode", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/export":{"get":{"x-rond":{"requestFlow":{"policyName":"allow_export"},"options":{"mode":"permissive"}}}}}}`), utils.ErrFileLoadFailed)
+		require.ErrorIs(t, err, utils.ErrFileLoadFailed)
+		require.Contains(t, err.Error(), "unknown options.mode permissive")
+	})
+
+	t.Run("shadow policy", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/export":{"get":{"x-rond":{"requestFlow":{"policyName":"allow_export","shadowPolicy":"new_allow_export"}}}}}}`), utils.ErrFileLoadFailed)
+		require.NoError(t, err)
+	})
+
+	t.Run("shadow policy with query generation", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/export":{"get":{"x-rond":{"requestFlow":{"policyName":"allow_export","generateQuery":true,"shadowPolicy":"new_allow_export"}}}}}}`), utils.ErrFileLoadFailed)
+		require.ErrorIs(t, err, utils.ErrFileLoadFailed)
+		require.Contains(t, err.Error(), "requestFlow.shadowPolicy is not supported with requestFlow.generateQuery")
+	})
+
+	t.Run("known CORS passthrough mode", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/export":{"get":{"x-rond":{"requestFlow":{"policyName":"allow_export"},"options":{"corsPassthrough":"respond"}}}}}}`), utils.ErrFileLoadFailed)
+		require.NoError(t, err)
+	})
+
+	t.Run("unknown CORS passthrough mode", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/export":{"get":{"x-rond":{"requestFlow":{"policyName":"allow_export"},"options":{"corsPassthrough":"always"}}}}}}`), utils.ErrFileLoadFailed)
+		require.ErrorIs(t, err, utils.ErrFileLoadFailed)
+		require.Contains(t, err.Error(), "unknown options.corsPassthrough always")
+	})
+
+	t.Run("policy module", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/export":{"get":{"x-rond":{"requestFlow":{"policyName":"allow_export"},"options":{"policyModule":"team-a.rego"}}}}}}`), utils.ErrFileLoadFailed)
+		require.NoError(t, err)
+	})
+
+	t.Run("policy module not a rego file", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/export":{"get":{"x-rond":{"requestFlow":{"policyName":"allow_export"},"options":{"policyModule":"team-a.json"}}}}}}`), utils.ErrFileLoadFailed)
+		require.ErrorIs(t, err, utils.ErrFileLoadFailed)
+		require.Contains(t, err.Error(), "options.policyModule team-a.json is not a rego file")
+	})
+
+	t.Run("negative request timeout", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/export":{"get":{"x-rond":{"requestFlow":{"policyName":"allow_export"},"options":{"requestTimeoutMs":-1}}}}}}`), utils.ErrFileLoadFailed)
+		require.ErrorIs(t, err, utils.ErrFileLoadFailed)
+		require.Contains(t, err.Error(), "options.requestTimeoutMs -1 must not be negative")
+	})
+
+	t.Run("route priority", func(t *testing.T) {
+		oas, err := deserializeSpec([]byte(`{"paths":{"/users/{id}":{"get":{"x-rond":{"requestFlow":{"policyName":"allow_user"}},"x-rond-priority":10}}}}`), utils.ErrFileLoadFailed)
+		require.NoError(t, err)
+		require.Equal(t, 10, oas.Paths["/users/{id}"]["get"].PermissionV2.Priority)
+	})
+
+	t.Run("versions with content negotiation policy", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/api":{"get":{"x-rond":{"requestFlow":{"policyName":"allow_v1"},"contentNegotiationPolicy":"api_version","versions":{"v2":{"requestFlow":{"policyName":"allow_v2"}}}}}}}}`), utils.ErrFileLoadFailed)
+		require.NoError(t, err)
+	})
+
+	t.Run("versions without content negotiation policy", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/api":{"get":{"x-rond":{"requestFlow":{"policyName":"allow_v1"},"versions":{"v2":{"requestFlow":{"policyName":"allow_v2"}}}}}}}}`), utils.ErrFileLoadFailed)
+		require.ErrorIs(t, err, utils.ErrFileLoadFailed)
+		require.Contains(t, err.Error(), "versions require contentNegotiationPolicy")
+	})
+
+	t.Run("version without request policy", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/api":{"get":{"x-rond":{"requestFlow":{"policyName":"allow_v1"},"contentNegotiationPolicy":"api_version","versions":{"v2":{"options":{"mode":"off"}}}}}}}}`), utils.ErrFileLoadFailed)
+		require.ErrorIs(t, err, utils.ErrFileLoadFailed)
+		require.Contains(t, err.Error(), "versions.v2 requires requestFlow.policyName")
+	})
+
+	t.Run("version with unknown policy mode", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/api":{"get":{"x-rond":{"requestFlow":{"policyName":"allow_v1"},"contentNegotiationPolicy":"api_version","versions":{"v2":{"requestFlow":{"policyName":"allow_v2"},"options":{"mode":"permissive"}}}}}}}}`), utils.ErrFileLoadFailed)
+		require.ErrorIs(t, err, utils.ErrFileLoadFailed)
+		require.Contains(t, err.Error(), "versions.v2: unknown options.mode permissive")
+	})
+}
+
+func TestPolicyMode(t *testing.T) {
+	t.Run("route mode takes precedence", func(t *testing.T) {
+		require.Equal(t, "off", PermissionOptions{Mode: "off"}.PolicyMode("log-only"))
+	})
+
+	t.Run("default mode is used when route has no mode", func(t *testing.T) {
+		require.Equal(t, "log-only", PermissionOptions{}.PolicyMode("log-only"))
+	})
+
+	t.Run("enforce when no mode is set", func(t *testing.T) {
+		require.Equal(t, "enforce", PermissionOptions{}.PolicyMode(""))
+	})
+}
+
+func TestCORSPassthroughMode(t *testing.T) {
+	t.Run("route mode takes precedence", func(t *testing.T) {
+		require.Equal(t, "off", PermissionOptions{CORSPassthrough: "off"}.CORSPassthroughMode("respond"))
+	})
+
+	t.Run("default mode is used when route has no mode", func(t *testing.T) {
+		require.Equal(t, "proxy", PermissionOptions{}.CORSPassthroughMode("proxy"))
+	})
+
+	t.Run("off when no mode is set", func(t *testing.T) {
+		require.Equal(t, "off", PermissionOptions{}.CORSPassthroughMode(""))
+	})
+}
+
+func TestRequestTimeout(t *testing.T) {
+	t.Run("route timeout takes precedence", func(t *testing.T) {
+		require.Equal(t, 2*time.Second, PermissionOptions{RequestTimeoutMs: 2000}.RequestTimeout(60000))
+	})
+
+	t.Run("default timeout is used when route has no timeout", func(t *testing.T) {
+		require.Equal(t, time.Minute, PermissionOptions{}.RequestTimeout(60000))
+	})
+
+	t.Run("no timeout when none is set", func(t *testing.T) {
+		require.Zero(t, PermissionOptions{}.RequestTimeout(0))
+	})
 }
 
 func TestGetXPermission(t *testing.T) {
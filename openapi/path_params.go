@@ -0,0 +1,70 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// WildcardPathParamKey is the reserved path parameter holding the part of the path
+// matched by the trailing wildcard of a route, e.g. a/b for /files/* and /files/a/b.
+const WildcardPathParamKey = "*"
+
+// PathParams returns the path variables of the route matched by the request. For
+// wildcard routes the remaining path suffix is provided under WildcardPathParamKey.
+func PathParams(req *http.Request) map[string]string {
+	pathParams := map[string]string{}
+	for name, value := range mux.Vars(req) {
+		pathParams[name] = value
+	}
+
+	if suffix, ok := wildcardPathSuffix(req); ok {
+		pathParams[WildcardPathParamKey] = suffix
+	}
+
+	if len(pathParams) == 0 {
+		return nil
+	}
+	return pathParams
+}
+
+func wildcardPathSuffix(req *http.Request) (string, bool) {
+	route := mux.CurrentRoute(req)
+	if route == nil {
+		return "", false
+	}
+	pathRegexp, err := route.GetPathRegexp()
+	// Full path routes are anchored at the end, prefix routes are not.
+	if err != nil || strings.HasSuffix(pathRegexp, "$") {
+		return "", false
+	}
+
+	// The route has already matched the request: the match is case insensitive so
+	// that paths restored after case insensitive routing are handled too.
+	matcher, err := regexp.Compile("(?i)" + pathRegexp)
+	if err != nil {
+		return "", false
+	}
+	path := req.URL.EscapedPath()
+	match := matcher.FindStringIndex(path)
+	if match == nil {
+		return "", false
+	}
+	return strings.TrimPrefix(path[match[1]:], "/"), true
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathParams(t *testing.T) {
+	pathParamsForRoute := func(t *testing.T, registerRoute func(router *mux.Router) *mux.Route, path string) map[string]string {
+		t.Helper()
+		var pathParams map[string]string
+		invoked := false
+		router := mux.NewRouter().UseEncodedPath()
+		registerRoute(router).HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			invoked = true
+			pathParams = PathParams(req)
+		})
+
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		require.True(t, invoked, "route not matched")
+		return pathParams
+	}
+
+	t.Run("no params outside the router", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+		require.Nil(t, PathParams(req))
+	})
+
+	t.Run("no params for static route", func(t *testing.T) {
+		pathParams := pathParamsForRoute(t, func(router *mux.Router) *mux.Route {
+			return router.Path("/hello")
+		}, "/hello")
+		require.Nil(t, pathParams)
+	})
+
+	t.Run("templated route", func(t *testing.T) {
+		pathParams := pathParamsForRoute(t, func(router *mux.Router) *mux.Route {
+			return router.Path("/projects/{projectId}/envs/{envId}")
+		}, "/projects/p1/envs/dev")
+		require.Equal(t, map[string]string{"projectId": "p1", "envId": "dev"}, pathParams)
+	})
+
+	t.Run("wildcard route provides the remaining suffix", func(t *testing.T) {
+		pathParams := pathParamsForRoute(t, func(router *mux.Router) *mux.Route {
+			return router.PathPrefix("/projects/{projectId}/files/")
+		}, "/projects/p1/files/docs/readme.md")
+		require.Equal(t, map[string]string{
+			"projectId":          "p1",
+			WildcardPathParamKey: "docs/readme.md",
+		}, pathParams)
+	})
+
+	t.Run("wildcard route with empty suffix", func(t *testing.T) {
+		pathParams := pathParamsForRoute(t, func(router *mux.Router) *mux.Route {
+			return router.PathPrefix("/files/")
+		}, "/files/")
+		require.Equal(t, map[string]string{WildcardPathParamKey: ""}, pathParams)
+	})
+
+	t.Run("wildcard suffix keeps path encoding", func(t *testing.T) {
+		pathParams := pathParamsForRoute(t, func(router *mux.Router) *mux.Route {
+			return router.PathPrefix("/files/")
+		}, "/files/a%2Fb/c")
+		require.Equal(t, map[string]string{WildcardPathParamKey: "a%2Fb/c"}, pathParams)
+	})
+}
@@ -0,0 +1,172 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The matchType of a path item sets how the requested paths are matched against it: the
+// exact paths are the default ones, while the prefix paths match all the paths under them
+// and the regex paths are regular expressions matched against the whole requested path.
+const (
+	PathMatchTypeExact  = "exact"
+	PathMatchTypePrefix = "prefix"
+	PathMatchTypeRegex  = "regex"
+)
+
+var PathMatchTypes = []string{PathMatchTypeExact, PathMatchTypePrefix, PathMatchTypeRegex}
+
+// matchTypeField is the field of the path items holding their matchType.
+const matchTypeField = "matchType"
+
+// PathPattern is a path of the OAS matched as a prefix or as a regular expression.
+type PathPattern struct {
+	// Path is the path of the OAS, as written in the paths object.
+	Path      string
+	MatchType string
+	regex     *regexp.Regexp
+}
+
+// Match reports whether the requested path matches the pattern.
+func (pattern PathPattern) Match(path string) bool {
+	return pattern.regex.MatchString(path)
+}
+
+// PathPatterns returns the paths matched as a prefix or as a regular expression, in
+// precedence order: the prefix ones come before the regex ones and, for each match type,
+// the longer patterns come first.
+func (oas *OpenAPISpec) PathPatterns() []PathPattern {
+	return oas.pathPatterns
+}
+
+// IsPathPattern reports whether the path of the OAS is not matched exactly.
+func (oas *OpenAPISpec) IsPathPattern(path string) bool {
+	matchType := oas.MatchTypes[path]
+	return matchType != "" && matchType != PathMatchTypeExact
+}
+
+// parsePathMatchTypes reads the matchType of the path items of the spec, only the ones
+// not matched exactly are returned.
+func parsePathMatchTypes(spec []byte) (map[string]string, error) {
+	var pathItems struct {
+		Paths map[string]struct {
+			MatchType string `json:"matchType"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(spec, &pathItems); err != nil {
+		return nil, err
+	}
+	var matchTypes map[string]string
+	for path, pathItem := range pathItems.Paths {
+		if pathItem.MatchType == "" || pathItem.MatchType == PathMatchTypeExact {
+			continue
+		}
+		if matchTypes == nil {
+			matchTypes = map[string]string{}
+		}
+		matchTypes[path] = pathItem.MatchType
+	}
+	return matchTypes, nil
+}
+
+// compilePathPatterns compiles the paths not matched exactly, failing on the first invalid
+// one. With case-insensitive routing the regular expressions ignore the case, since the
+// requested paths are lowercased.
+func (oas *OpenAPISpec) compilePathPatterns(caseInsensitive bool) error {
+	var patterns []PathPattern
+	for path, matchType := range oas.MatchTypes {
+		var expression string
+		switch matchType {
+		case PathMatchTypeExact:
+			continue
+		case PathMatchTypePrefix:
+			expression = prefixPathExpression(path)
+		case PathMatchTypeRegex:
+			// the regex is anchored, so that it can not match only a part of the path
+			expression = "^(?:" + path + ")$"
+			if caseInsensitive {
+				expression = "(?i)" + expression
+			}
+		default:
+			return fmt.Errorf("%w: path %s: unknown matchType %s, must be one of %s", ErrInvalidRondConfig, path, matchType, strings.Join(PathMatchTypes, ", "))
+		}
+		regex, err := regexp.Compile(expression)
+		if err != nil {
+			return fmt.Errorf("%w: path %s: invalid regex: %s", ErrInvalidRondConfig, path, err.Error())
+		}
+		patterns = append(patterns, PathPattern{Path: path, MatchType: matchType, regex: regex})
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if patterns[i].MatchType != patterns[j].MatchType {
+			return patterns[i].MatchType == PathMatchTypePrefix
+		}
+		if len(patterns[i].Path) != len(patterns[j].Path) {
+			return len(patterns[i].Path) > len(patterns[j].Path)
+		}
+		return patterns[i].Path < patterns[j].Path
+	})
+	oas.pathPatterns = patterns
+	return nil
+}
+
+// prefixPathExpression returns the regular expression matching the path and all the paths
+// under it, the path parameters match a single path segment.
+func prefixPathExpression(path string) string {
+	segments := strings.Split(strings.TrimSuffix(ConvertPathVariablesToColons(path), "/"), "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = "[^/]+"
+			continue
+		}
+		segments[i] = regexp.QuoteMeta(segment)
+	}
+	return "^" + strings.Join(segments, "/") + "(/.*)?$"
+}
+
+// findPatternVerbConfig returns the configuration of the method of the first path pattern
+// matching the path. As for the exact paths, the all method entry applies to the methods not
+// explicitly defined and HEAD requests are authorized as GET ones, unless defined.
+func (oas *OpenAPISpec) findPatternVerbConfig(path, method string) (VerbConfig, bool) {
+	for _, pattern := range oas.pathPatterns {
+		if !pattern.Match(path) {
+			continue
+		}
+		if verbConfig, ok := verbConfigForMethod(oas.Paths[pattern.Path], method); ok {
+			return verbConfig, true
+		}
+	}
+	return VerbConfig{}, false
+}
+
+// verbConfigForMethod returns the configuration of the method among the verbs of a path.
+func verbConfigForMethod(verbs PathVerbs, method string) (VerbConfig, bool) {
+	for _, verb := range []string{strings.ToLower(method), AllHTTPMethod} {
+		if verbConfig, ok := verbs[verb]; ok && verbConfig.PermissionV2 != nil {
+			return verbConfig, true
+		}
+	}
+	if method == http.MethodHead {
+		if verbConfig, ok := verbs[strings.ToLower(http.MethodGet)]; ok && verbConfig.PermissionV2 != nil {
+			return verbConfig, true
+		}
+	}
+	return VerbConfig{}, false
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/utils"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathPatterns(t *testing.T) {
+	oas, err := LoadOASFile("../mocks/pathPatternsConfig.json")
+	require.NoError(t, err)
+
+	t.Run("sorts the patterns by precedence", func(t *testing.T) {
+		paths := []string{}
+		for _, pattern := range oas.PathPatterns() {
+			paths = append(paths, pattern.Path)
+		}
+		require.Equal(t, []string{
+			"/projects/{projectId}/files",
+			"/projects",
+			"^/projects/[^/]+/files/.+/download$",
+			"^/archive/[^/]+/files/.+/download$",
+			"^/archive/.+$",
+		}, paths)
+		require.False(t, oas.IsPathPattern("/health"))
+		require.False(t, oas.IsPathPattern("/projects/{projectId}"))
+	})
+
+	OASRouter := oas.PrepareOASRouter()
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		expectedPolicy string
+	}{
+		{name: "exact path wins over prefix and regex", method: http.MethodGet, path: "/projects/p1", expectedPolicy: "get_project"},
+		{name: "explicit exact match type", method: http.MethodGet, path: "/health", expectedPolicy: "health"},
+		{name: "prefix matches the path itself", method: http.MethodGet, path: "/projects/p1/files", expectedPolicy: "project_files_prefix"},
+		{name: "longer prefix wins", method: http.MethodPost, path: "/projects/p1/files/a", expectedPolicy: "project_files_prefix"},
+		{name: "prefix wins over regex", method: http.MethodGet, path: "/projects/p1/files/a/b/download", expectedPolicy: "project_files_prefix"},
+		{name: "prefix matches whole segments only", method: http.MethodGet, path: "/projects/p1/filesystem", expectedPolicy: "projects_prefix"},
+		{name: "shorter prefix", method: http.MethodGet, path: "/projects/p1/members", expectedPolicy: "projects_prefix"},
+		{name: "longer regex wins", method: http.MethodGet, path: "/archive/a1/files/x/y/download", expectedPolicy: "download_archived_file"},
+		{name: "shorter regex", method: http.MethodGet, path: "/archive/a1/files/x", expectedPolicy: "archive"},
+		{name: "HEAD is authorized as GET", method: http.MethodHead, path: "/archive/a1", expectedPolicy: "archive"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			permission, err := oas.FindPermission(OASRouter, testCase.path, testCase.method)
+			require.NoError(t, err)
+			require.Equal(t, testCase.expectedPolicy, permission.RequestFlow.PolicyName)
+		})
+	}
+
+	t.Run("fails for methods not defined", func(t *testing.T) {
+		_, err := oas.FindPermission(OASRouter, "/archive/a1", http.MethodPost)
+		require.ErrorIs(t, err, ErrNotFoundOASDefinition)
+		_, err = oas.FindPermission(OASRouter, "/other", http.MethodGet)
+		require.ErrorIs(t, err, ErrNotFoundOASDefinition)
+	})
+
+	t.Run("lists the methods of the matching pattern", func(t *testing.T) {
+		allowedMethods, _ := oas.AllowedMethods(OASRouter, "/archive/a1")
+		require.Equal(t, []string{http.MethodGet, http.MethodHead}, allowedMethods)
+	})
+
+	t.Run("the paths matching a pattern are known", func(t *testing.T) {
+		knownPathsRouter := oas.PrepareKnownPathsRouter()
+		require.True(t, oas.IsKnownPath(knownPathsRouter, "/archive/a1"))
+		require.False(t, oas.IsKnownPath(knownPathsRouter, "/other"))
+	})
+}
+
+func TestPathPatternsValidation(t *testing.T) {
+	t.Run("invalid regex", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"^/files/(.+$":{"matchType":"regex","get":{"x-rond":{"requestFlow":{"policyName":"allow"}}}}}}`), utils.ErrFileLoadFailed)
+		require.ErrorIs(t, err, utils.ErrFileLoadFailed)
+		require.Contains(t, err.Error(), "path ^/files/(.+$: invalid regex")
+	})
+
+	t.Run("unknown match type", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/files/**":{"matchType":"glob","get":{"x-rond":{"requestFlow":{"policyName":"allow"}}}}}}`), utils.ErrFileLoadFailed)
+		require.ErrorIs(t, err, utils.ErrFileLoadFailed)
+		require.Contains(t, err.Error(), "path /files/**: unknown matchType glob, must be one of exact, prefix, regex")
+	})
+
+	t.Run("unanchored regex matches the whole path", func(t *testing.T) {
+		oas, err := deserializeSpec([]byte(`{"paths":{"/files/[a-z]+":{"matchType":"regex","get":{"x-rond":{"requestFlow":{"policyName":"allow"}}}}}}`), utils.ErrFileLoadFailed)
+		require.NoError(t, err)
+
+		OASRouter := oas.PrepareOASRouter()
+		permission, err := oas.FindPermission(OASRouter, "/files/abc", http.MethodGet)
+		require.NoError(t, err)
+		require.Equal(t, "allow", permission.RequestFlow.PolicyName)
+
+		for _, path := range []string{"/admin/files/abc", "/files/abc/delete", "/files/ABC"} {
+			_, err = oas.FindPermission(OASRouter, path, http.MethodGet)
+			require.Error(t, err, path)
+		}
+	})
+
+	t.Run("regex alternatives are anchored as a whole", func(t *testing.T) {
+		oas, err := deserializeSpec([]byte(`{"paths":{"/files|/docs":{"matchType":"regex","get":{"x-rond":{"requestFlow":{"policyName":"allow"}}}}}}`), utils.ErrFileLoadFailed)
+		require.NoError(t, err)
+
+		OASRouter := oas.PrepareOASRouter()
+		_, err = oas.FindPermission(OASRouter, "/docs", http.MethodGet)
+		require.NoError(t, err)
+		_, err = oas.FindPermission(OASRouter, "/files/secret", http.MethodGet)
+		require.Error(t, err)
+	})
+
+	t.Run("regex ignores the case with case-insensitive routing", func(t *testing.T) {
+		oas, err := deserializeSpec([]byte(`{"paths":{"^/Files/[A-Z]+$":{"matchType":"regex","get":{"x-rond":{"requestFlow":{"policyName":"allow"}}}},"/Docs":{"matchType":"prefix","get":{"x-rond":{"requestFlow":{"policyName":"docs"}}}}}}`), utils.ErrFileLoadFailed)
+		require.NoError(t, err)
+		oas, err = normalizeOASPathsCase(oas, config.EnvironmentVariables{CaseInsensitiveRouting: true})
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"^/Files/[A-Z]+$": PathMatchTypeRegex, "/docs": PathMatchTypePrefix}, oas.MatchTypes)
+
+		OASRouter := oas.PrepareOASRouter()
+		permission, err := oas.FindPermission(OASRouter, "/files/abc", http.MethodGet)
+		require.NoError(t, err)
+		require.Equal(t, "allow", permission.RequestFlow.PolicyName)
+		permission, err = oas.FindPermission(OASRouter, "/docs/intro", http.MethodGet)
+		require.NoError(t, err)
+		require.Equal(t, "docs", permission.RequestFlow.PolicyName)
+	})
+}
@@ -0,0 +1,216 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var matchPathParameters = regexp.MustCompile(`/(\{\w+\}|:\w+)`)
+
+// NormalizePathTemplate replaces the path parameters with positional placeholders, so
+// that the paths matching the same requests have the same template regardless of the
+// names of their parameters: /resources/{id} and /resources/:resourceId are both
+// normalized to /resources/{0}.
+func NormalizePathTemplate(path string) string {
+	position := 0
+	return matchPathParameters.ReplaceAllStringFunc(path, func(string) string {
+		placeholder := fmt.Sprintf("/{%d}", position)
+		position++
+		return placeholder
+	})
+}
+
+// RoutePaths returns the paths of the OAS in the order they are routed: the paths with a
+// higher x-rond priority come first, the others in reverse lexicographic order. When more
+// paths match the same request, the first one is used.
+func (oas *OpenAPISpec) RoutePaths() []string {
+	paths := make([]string, 0, len(oas.Paths))
+	priorities := oas.routePriorities()
+	for path := range oas.Paths {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if priorities[paths[i]] != priorities[paths[j]] {
+			return priorities[paths[i]] > priorities[paths[j]]
+		}
+		return paths[i] > paths[j]
+	})
+	return paths
+}
+
+// routePriorities returns the priority of the route of each path, which is the highest
+// x-rond priority of its operations.
+func (oas *OpenAPISpec) routePriorities() map[string]int {
+	priorities := make(map[string]int, len(oas.Paths))
+	for path, verbs := range oas.Paths {
+		for _, verbConfig := range verbs {
+			if verbConfig.PermissionV2 == nil {
+				continue
+			}
+			if priority, ok := priorities[path]; !ok || verbConfig.PermissionV2.Priority > priority {
+				priorities[path] = verbConfig.PermissionV2.Priority
+			}
+		}
+	}
+	return priorities
+}
+
+// priorityRoute is an exact path of the OAS, matched by its path segments.
+type priorityRoute struct {
+	path     string
+	priority int
+	segments []string
+}
+
+// prioritizedRoutes returns the exact paths in route order, or nil when no path sets an
+// x-rond priority, since the OAS router already matches them as the service router does.
+func (oas *OpenAPISpec) prioritizedRoutes() []priorityRoute {
+	priorities := oas.routePriorities()
+	prioritized := false
+	for _, priority := range priorities {
+		prioritized = prioritized || priority != 0
+	}
+	if !prioritized {
+		return nil
+	}
+	routes := []priorityRoute{}
+	for _, path := range oas.RoutePaths() {
+		if oas.IsPathPattern(path) {
+			continue
+		}
+		routes = append(routes, priorityRoute{
+			path:     path,
+			priority: priorities[path],
+			segments: strings.Split(ConvertPathVariablesToColons(path), "/"),
+		})
+	}
+	return routes
+}
+
+// match reports whether the requested path matches the route: the path parameters match a
+// single path segment, while a trailing wildcard matches all the remaining ones.
+func (route priorityRoute) match(path string) bool {
+	segments := strings.Split(path, "/")
+	for i, routeSegment := range route.segments {
+		if i == len(route.segments)-1 && strings.HasPrefix(routeSegment, "*") {
+			return len(segments) >= len(route.segments)
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if strings.HasPrefix(routeSegment, ":") {
+			if segments[i] == "" {
+				return false
+			}
+			continue
+		}
+		if routeSegment != segments[i] {
+			return false
+		}
+	}
+	return len(segments) == len(route.segments)
+}
+
+// findPriorityVerbConfig returns the configuration of the method of the first route with a
+// priority higher than the one matched by the OAS router, which prefers the static paths
+// to the parametric ones regardless of their x-rond priority.
+func (oas *OpenAPISpec) findPriorityVerbConfig(path, method string, routedPriority int) (VerbConfig, bool) {
+	for _, route := range oas.priorityRoutes {
+		if route.priority <= routedPriority {
+			break
+		}
+		if !route.match(path) {
+			continue
+		}
+		if verbConfig, ok := verbConfigForMethod(oas.Paths[route.path], method); ok {
+			return verbConfig, true
+		}
+	}
+	return VerbConfig{}, false
+}
+
+// PathConflict lists the paths of the OAS registered for the same method and the same
+// normalized template: only the first one is routed, the others are shadowed.
+type PathConflict struct {
+	Method string
+	Paths  []string
+}
+
+// PathConflicts returns the paths of the OAS shadowed by other ones differing only in the
+// names of their path parameters, such as /resources/{id} and /resources/{resourceId}.
+func (oas *OpenAPISpec) PathConflicts() []PathConflict {
+	registrations := map[string]*PathConflict{}
+	conflicts := []*PathConflict{}
+	for _, path := range oas.RoutePaths() {
+		if oas.IsPathPattern(path) {
+			continue
+		}
+		template := NormalizePathTemplate(cleanWildcard(path))
+		for _, method := range pathMethods(oas.Paths[path]) {
+			key := method + " " + template
+			registration, ok := registrations[key]
+			if !ok {
+				registrations[key] = &PathConflict{Method: method, Paths: []string{path}}
+				continue
+			}
+			registration.Paths = append(registration.Paths, path)
+			if len(registration.Paths) == 2 {
+				conflicts = append(conflicts, registration)
+			}
+		}
+	}
+
+	result := make([]PathConflict, 0, len(conflicts))
+	for _, conflict := range conflicts {
+		result = append(result, *conflict)
+	}
+	return result
+}
+
+// LogPathConflicts warns about the paths of the OAS shadowed by other ones.
+func (oas *OpenAPISpec) LogPathConflicts(log logrus.FieldLogger) {
+	for _, conflict := range oas.PathConflicts() {
+		log.WithFields(logrus.Fields{
+			"method":        conflict.Method,
+			"routedPath":    conflict.Paths[0],
+			"shadowedPaths": conflict.Paths[1:],
+		}).Warn("OAS paths differing only in path parameter names, the shadowed paths are never matched")
+	}
+}
+
+// pathMethods returns the methods defined for a path, sorted, with the all method
+// expanded to the supported ones.
+func pathMethods(verbs PathVerbs) []string {
+	methods := []string{}
+	for verb := range verbs {
+		if verb == AllHTTPMethod {
+			for _, method := range OasSupportedHTTPMethods {
+				if _, ok := verbs[strings.ToLower(method)]; !ok {
+					methods = append(methods, method)
+				}
+			}
+			continue
+		}
+		methods = append(methods, strings.ToUpper(verb))
+	}
+	sort.Strings(methods)
+	return methods
+}
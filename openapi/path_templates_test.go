@@ -0,0 +1,174 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizePathTemplate(t *testing.T) {
+	require.Equal(t, "/resources/{0}", NormalizePathTemplate("/resources/{id}"))
+	require.Equal(t, "/resources/{0}", NormalizePathTemplate("/resources/:resourceId"))
+	require.Equal(t, "/resources/{0}/children/{1}", NormalizePathTemplate("/resources/{resourceId}/children/{childId}"))
+	require.Equal(t, "/resources/{0}.json", NormalizePathTemplate("/resources/{id}.json"))
+	require.Equal(t, "/files/*param", NormalizePathTemplate("/files/*param"))
+}
+
+func TestPathConflicts(t *testing.T) {
+	withPolicy := func(policies map[string]string) PathVerbs {
+		verbs := PathVerbs{}
+		for method, policy := range policies {
+			verbs[method] = VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: policy}}}
+		}
+		return verbs
+	}
+
+	t.Run("paths with different parameter names and shapes", func(t *testing.T) {
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/resources/{id}":                    withPolicy(map[string]string{"get": "get_resource"}),
+				"/resources/{resourceId}/children":   withPolicy(map[string]string{"get": "list_children"}),
+				"/resources/:rid/children/{childId}": withPolicy(map[string]string{"get": "get_child"}),
+			},
+		}
+		require.Empty(t, oas.PathConflicts())
+
+		OASRouter := oas.PrepareOASRouter()
+		for path, expectedPolicy := range map[string]string{
+			"/resources/r1":             "get_resource",
+			"/resources/r1/children":    "list_children",
+			"/resources/r1/children/c1": "get_child",
+		} {
+			permission, err := oas.FindPermission(OASRouter, path, http.MethodGet)
+			require.NoError(t, err, path)
+			require.Equal(t, expectedPolicy, permission.RequestFlow.PolicyName, path)
+		}
+	})
+
+	t.Run("paths differing only in parameter names", func(t *testing.T) {
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/resources/{id}":         withPolicy(map[string]string{"get": "get_resource", "delete": "delete_resource"}),
+				"/resources/{resourceId}": withPolicy(map[string]string{"get": "get_resource_by_id", "patch": "patch_resource"}),
+				"/resources/:name":        withPolicy(map[string]string{"all": "any_resource"}),
+			},
+		}
+		require.Equal(t, []PathConflict{
+			{Method: http.MethodGet, Paths: []string{"/resources/{resourceId}", "/resources/{id}", "/resources/:name"}},
+			{Method: http.MethodDelete, Paths: []string{"/resources/{id}", "/resources/:name"}},
+			{Method: http.MethodPatch, Paths: []string{"/resources/{resourceId}", "/resources/:name"}},
+		}, oas.PathConflicts())
+
+		OASRouter := oas.PrepareOASRouter()
+		for method, expectedPolicy := range map[string]string{
+			http.MethodGet:    "get_resource_by_id",
+			http.MethodHead:   "get_resource_by_id",
+			http.MethodPatch:  "patch_resource",
+			http.MethodDelete: "delete_resource",
+			http.MethodPost:   "any_resource",
+		} {
+			permission, err := oas.FindPermission(OASRouter, "/resources/r1", method)
+			require.NoError(t, err, method)
+			require.Equal(t, expectedPolicy, permission.RequestFlow.PolicyName, method)
+		}
+	})
+
+	t.Run("higher priority paths are routed", func(t *testing.T) {
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/resources/{id}":         PathVerbs{"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "get_resource"}, Priority: 1}}},
+				"/resources/{resourceId}": withPolicy(map[string]string{"get": "get_resource_by_id"}),
+			},
+		}
+		require.Equal(t, []PathConflict{
+			{Method: http.MethodGet, Paths: []string{"/resources/{id}", "/resources/{resourceId}"}},
+		}, oas.PathConflicts())
+
+		permission, err := oas.FindPermission(oas.PrepareOASRouter(), "/resources/r1", http.MethodGet)
+		require.NoError(t, err)
+		require.Equal(t, "get_resource", permission.RequestFlow.PolicyName)
+	})
+
+	t.Run("higher priority parametric paths win over the static ones", func(t *testing.T) {
+		withPriority := func(policy string, priority int) PathVerbs {
+			return PathVerbs{"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: policy}, Priority: priority}}}
+		}
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/users/me":          withPriority("allow_me", 0),
+				"/users/{id}":        withPriority("allow_user", 10),
+				"/users/{id}/orders": withPriority("allow_orders", 0),
+				"/files/*":           withPriority("allow_files", 5),
+				"/files/readme":      withPriority("allow_readme", 0),
+			},
+		}
+		OASRouter := oas.PrepareOASRouter()
+		for path, expectedPolicy := range map[string]string{
+			"/users/me":        "allow_user",
+			"/users/42":        "allow_user",
+			"/users/42/orders": "allow_orders",
+			"/files/readme":    "allow_files",
+			"/files/a/b":       "allow_files",
+		} {
+			permission, err := oas.FindPermission(OASRouter, path, http.MethodGet)
+			require.NoError(t, err, path)
+			require.Equal(t, expectedPolicy, permission.RequestFlow.PolicyName, path)
+		}
+
+		_, err := oas.FindPermission(OASRouter, "/users/me", http.MethodPost)
+		require.ErrorIs(t, err, ErrNotFoundOASDefinition)
+	})
+
+	t.Run("lower priority paths keep the OAS router precedence", func(t *testing.T) {
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/users/me":   PathVerbs{"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_me"}, Priority: 5}}},
+				"/users/{id}": PathVerbs{"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_user"}, Priority: -1}}},
+			},
+		}
+		OASRouter := oas.PrepareOASRouter()
+		permission, err := oas.FindPermission(OASRouter, "/users/me", http.MethodGet)
+		require.NoError(t, err)
+		require.Equal(t, "allow_me", permission.RequestFlow.PolicyName)
+		permission, err = oas.FindPermission(OASRouter, "/users/42", http.MethodGet)
+		require.NoError(t, err)
+		require.Equal(t, "allow_user", permission.RequestFlow.PolicyName)
+	})
+
+	t.Run("logs the shadowed paths", func(t *testing.T) {
+		log, hook := test.NewNullLogger()
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/resources/{id}":         withPolicy(map[string]string{"get": "get_resource"}),
+				"/resources/{resourceId}": withPolicy(map[string]string{"get": "get_resource_by_id"}),
+			},
+		}
+		oas.LogPathConflicts(log)
+
+		require.Len(t, hook.AllEntries(), 1)
+		entry := hook.LastEntry()
+		require.Equal(t, logrus.WarnLevel, entry.Level)
+		require.Equal(t, logrus.Fields{
+			"method":        http.MethodGet,
+			"routedPath":    "/resources/{resourceId}",
+			"shadowedPaths": []string{"/resources/{id}"},
+		}, entry.Data)
+	})
+}
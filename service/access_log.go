@@ -0,0 +1,160 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/internal/utils"
+
+	"github.com/gorilla/mux"
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const combinedLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessLogResponseWriter records the status code and the number of bytes of the response.
+// It implements http.Flusher and http.Hijacker, so that streamed responses and upgraded
+// connections keep working through it.
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	statusCode   int
+	bytesWritten int
+	hijacked     bool
+}
+
+func (w *accessLogResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *accessLogResponseWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytesWritten += n
+	return n, err
+}
+
+func (w *accessLogResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.statusCode == 0 {
+			w.statusCode = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+func (w *accessLogResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// status returns the status code sent to the client: the handlers writing nothing
+// respond with 200, while hijacked connections have switched protocol.
+func (w *accessLogResponseWriter) status() int {
+	if w.statusCode != 0 {
+		return w.statusCode
+	}
+	if w.hijacked {
+		return http.StatusSwitchingProtocols
+	}
+	return http.StatusOK
+}
+
+// accessLogMiddleware logs an entry for each served request, in the configured
+// ACCESS_LOG_FORMAT, except for the paths starting with one of ACCESS_LOG_EXCLUDED_PATHS.
+func accessLogMiddleware(env config.EnvironmentVariables) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, excludedPath := range env.AccessLogExcludedPathsList {
+				if strings.HasPrefix(r.URL.Path, excludedPath) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			start := time.Now()
+			ctx, upstreamDuration := utils.WithUpstreamDuration(r.Context())
+			recorder := &accessLogResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(recorder, r.WithContext(ctx))
+			duration := time.Since(start)
+
+			// only the user resolved evaluating the policies is logged, never the raw header
+			user, _ := mongoclient.ResolvedUser(r.Context())
+			userID := user.UserID
+			logger := glogger.Get(r.Context()).WithFields(logrus.Fields{
+				"durationMs":         duration.Milliseconds(),
+				"upstreamDurationMs": upstreamDuration.Get().Milliseconds(),
+			})
+			if env.AccessLogFormat == config.AccessLogFormatCombined {
+				logger.Info(combinedLogLine(r, env, userID, recorder, start))
+				return
+			}
+			logger.WithFields(logrus.Fields{
+				"method": utils.SanitizeString(r.Method),
+				"path":   utils.SanitizeString(r.URL.Path),
+				"status": recorder.status(),
+				"bytes":  recorder.bytesWritten,
+				"userId": utils.SanitizeString(userID),
+			}).Info("access log")
+		})
+	}
+}
+
+// combinedLogLine formats the request in the Apache combined log format.
+func combinedLogLine(r *http.Request, env config.EnvironmentVariables, userID string, recorder *accessLogResponseWriter, start time.Time) string {
+	bytesWritten := "-"
+	if recorder.bytesWritten > 0 {
+		bytesWritten = strconv.Itoa(recorder.bytesWritten)
+	}
+	return fmt.Sprintf("%s - %s [%s] %q %d %s %q %q",
+		utils.ClientIP(r, env.TrustedProxiesNetworks),
+		combinedLogValue(userID),
+		start.Format(combinedLogTimeFormat),
+		fmt.Sprintf("%s %s %s", r.Method, r.URL.RequestURI(), r.Proto),
+		recorder.status(),
+		bytesWritten,
+		combinedLogValue(r.Referer()),
+		combinedLogValue(r.UserAgent()),
+	)
+}
+
+func combinedLogValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return utils.SanitizeString(value)
+}
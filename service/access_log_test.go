@@ -0,0 +1,199 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/rond-authz/rond/core"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/openapi"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLogMiddleware(t *testing.T) {
+	opa := &core.OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow { true }
+`,
+	}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow"}},
+				},
+			},
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	setupRouter := func(t *testing.T, format string, userIDSources ...config.UserIDSource) (http.Handler, *test.Hook) {
+		t.Helper()
+		log, hook := test.NewNullLogger()
+		env := config.EnvironmentVariables{
+			TargetServiceHost:          serverURL.Host,
+			UserIdHeader:               "miauserid",
+			UserIDSources:              userIDSources,
+			AccessLogFormat:            format,
+			AccessLogExcludedPathsList: []string{"/-/"},
+			PassThroughNonJSON:         true,
+		}
+		ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+		var mongoClient *mongoclient.MongoClient
+		evaluatorsMap, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, env)
+		require.NoError(t, err, "unexpected error")
+		router, err := SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+		require.NoError(t, err, "unexpected error")
+		return router, hook
+	}
+
+	accessLogEntries := func(hook *test.Hook, messagePattern string) []*logrus.Entry {
+		entries := []*logrus.Entry{}
+		for _, entry := range hook.AllEntries() {
+			if regexp.MustCompile(messagePattern).MatchString(entry.Message) {
+				entries = append(entries, entry)
+			}
+		}
+		return entries
+	}
+
+	t.Run("logs the request in json format", func(t *testing.T) {
+		router, hook := setupRouter(t, config.AccessLogFormatJSON)
+		req := httptest.NewRequest(http.MethodGet, "/users", nil)
+		req.Header.Set("miauserid", "user1")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		entries := accessLogEntries(hook, "^access log$")
+		require.Len(t, entries, 1)
+		require.Equal(t, http.MethodGet, entries[0].Data["method"])
+		require.Equal(t, "/users", entries[0].Data["path"])
+		require.Equal(t, http.StatusAccepted, entries[0].Data["status"])
+		require.Equal(t, len(`{"ok":true}`), entries[0].Data["bytes"])
+		require.Equal(t, "user1", entries[0].Data["userId"])
+		require.Contains(t, entries[0].Data, "durationMs")
+		require.Contains(t, entries[0].Data, "upstreamDurationMs")
+	})
+
+	t.Run("logs only the resolved user", func(t *testing.T) {
+		router, hook := setupRouter(t, config.AccessLogFormatJSON, config.UserIDSource{Type: config.UserIDSourceJWTClaim})
+		req := httptest.NewRequest(http.MethodGet, "/users", nil)
+		req.Header.Set("miauserid", "forged-user")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		entries := accessLogEntries(hook, "^access log$")
+		require.Len(t, entries, 1)
+		require.Equal(t, "", entries[0].Data["userId"], "the header is not a configured source")
+	})
+
+	t.Run("logs no user without policy evaluation", func(t *testing.T) {
+		router, hook := setupRouter(t, config.AccessLogFormatJSON)
+		req := httptest.NewRequest(http.MethodGet, "/unknown", nil)
+		req.Header.Set("miauserid", "user1")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		entries := accessLogEntries(hook, "^access log$")
+		require.Len(t, entries, 1)
+		require.Equal(t, http.StatusNotFound, entries[0].Data["status"])
+		require.Equal(t, "", entries[0].Data["userId"])
+	})
+
+	t.Run("logs the request in combined format", func(t *testing.T) {
+		router, hook := setupRouter(t, config.AccessLogFormatCombined)
+		req := httptest.NewRequest(http.MethodGet, "/users?page=1", nil)
+		req.Header.Set("miauserid", "user1")
+		req.Header.Set("User-Agent", "test-agent")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		entries := accessLogEntries(hook, `^192\.0\.2\.1 - user1 \[[^\]]+\] "GET /users\?page=1 HTTP/1\.1" 202 11 "-" "test-agent"$`)
+		require.Len(t, entries, 1)
+		require.Contains(t, entries[0].Data, "upstreamDurationMs")
+	})
+
+	t.Run("excluded paths are not logged", func(t *testing.T) {
+		router, hook := setupRouter(t, config.AccessLogFormatJSON)
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/-/healthz", nil))
+
+		require.Empty(t, accessLogEntries(hook, "^access log$"))
+	})
+
+	t.Run("access log is disabled by default", func(t *testing.T) {
+		router, hook := setupRouter(t, config.AccessLogFormatOff)
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users", nil))
+
+		require.Empty(t, accessLogEntries(hook, "^access log$"))
+	})
+}
+
+func TestAccessLogResponseWriter(t *testing.T) {
+	t.Run("records status and bytes", func(t *testing.T) {
+		recorder := &accessLogResponseWriter{ResponseWriter: httptest.NewRecorder()}
+		require.Equal(t, http.StatusOK, recorder.status())
+
+		recorder.WriteHeader(http.StatusNotFound)
+		recorder.WriteHeader(http.StatusInternalServerError)
+		recorder.Write([]byte("not found"))
+		require.Equal(t, http.StatusNotFound, recorder.status())
+		require.Equal(t, 9, recorder.bytesWritten)
+	})
+
+	t.Run("preserves http.Flusher", func(t *testing.T) {
+		underlying := httptest.NewRecorder()
+		var writer http.ResponseWriter = &accessLogResponseWriter{ResponseWriter: underlying}
+		flusher, ok := writer.(http.Flusher)
+		require.True(t, ok)
+		flusher.Flush()
+		require.True(t, underlying.Flushed)
+	})
+
+	t.Run("preserves http.Hijacker", func(t *testing.T) {
+		var writer http.ResponseWriter = &accessLogResponseWriter{ResponseWriter: httptest.NewRecorder()}
+		hijacker, ok := writer.(http.Hijacker)
+		require.True(t, ok)
+		_, _, err := hijacker.Hijack()
+		require.EqualError(t, err, "response writer does not support hijacking")
+
+		server := httptest.NewServer(accessLogMiddleware(config.EnvironmentVariables{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n\r\n")
+			rw.Flush()
+		})))
+		defer server.Close()
+
+		resp, err := http.Get(server.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	})
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/metrics"
+
+	"github.com/gorilla/mux"
+	"github.com/mia-platform/glogger/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const allowedPathPrefixSuffix = "/*"
+
+// setupAllowedPathsRoutes registers the ALLOWED_PATHS patterns, which are always proxied
+// without policy evaluation. The router must not evaluate policies, and the routes must be
+// registered ahead of the ones handled by rbacHandler.
+func setupAllowedPathsRoutes(router *mux.Router, env config.EnvironmentVariables) {
+	for _, pattern := range env.AllowedPathPatterns {
+		if env.Standalone {
+			pattern = fmt.Sprintf("%s%s", env.PathPrefixStandalone, pattern)
+		}
+		router.MatcherFunc(allowedPathMatcher(pattern)).HandlerFunc(allowedPathHandler(pattern))
+	}
+}
+
+// allowedPathMatcher matches the request paths against the glob pattern; a trailing /*
+// matches all the paths under the prefix. Paths that are not clean never match, so that
+// encoded dot segments cannot reach paths outside the pattern.
+func allowedPathMatcher(pattern string) mux.MatcherFunc {
+	isPrefix := strings.HasSuffix(pattern, allowedPathPrefixSuffix)
+	prefix := strings.TrimSuffix(pattern, allowedPathPrefixSuffix)
+	prefixSegments := strings.Count(prefix, "/")
+
+	return func(r *http.Request, _ *mux.RouteMatch) bool {
+		requestPath := r.URL.Path
+		if cleanPath := path.Clean(requestPath); cleanPath != requestPath && cleanPath+"/" != requestPath {
+			return false
+		}
+		if matched, _ := path.Match(pattern, requestPath); matched {
+			return true
+		}
+		if !isPrefix {
+			return false
+		}
+		// the request path is split after the prefix segments, that must match the prefix
+		segments := strings.SplitN(requestPath, "/", prefixSegments+2)
+		if len(segments) < prefixSegments+2 {
+			return false
+		}
+		matched, _ := path.Match(prefix, strings.Join(segments[:prefixSegments+1], "/"))
+		return matched
+	}
+}
+
+func allowedPathHandler(pattern string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if m, err := metrics.GetFromContext(r.Context()); err == nil {
+			m.AllowedPathRequests.With(prometheus.Labels{"pattern": pattern}).Inc()
+		}
+		glogger.Get(r.Context()).WithField("allowedPath", pattern).Debug("request proxied without policy evaluation")
+		alwaysProxyHandler(w, r)
+	}
+}
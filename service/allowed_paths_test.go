@@ -0,0 +1,142 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/rond-authz/rond/core"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/metrics"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/openapi"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowedPathMatcher(t *testing.T) {
+	testCases := []struct {
+		pattern     string
+		requestPath string
+		expected    bool
+	}{
+		{pattern: "/favicon.ico", requestPath: "/favicon.ico", expected: true},
+		{pattern: "/favicon.ico", requestPath: "/favicon.ico/other", expected: false},
+		{pattern: "/public/*", requestPath: "/public/logo.png", expected: true},
+		{pattern: "/public/*", requestPath: "/public/assets/logo.png", expected: true},
+		{pattern: "/public/*", requestPath: "/public/", expected: true},
+		{pattern: "/public/*", requestPath: "/public", expected: false},
+		{pattern: "/public/*", requestPath: "/publicity/logo.png", expected: false},
+		{pattern: "/public/*", requestPath: "/public/../admin", expected: false},
+		{pattern: "/.well-known/*", requestPath: "/.well-known/openid-configuration", expected: true},
+		{pattern: "/tenants/*/public/*", requestPath: "/tenants/t1/public/a/b", expected: true},
+		{pattern: "/tenants/*/public/*", requestPath: "/tenants/t1/private/a", expected: false},
+		{pattern: "/docs/*.html", requestPath: "/docs/index.html", expected: true},
+		{pattern: "/docs/*.html", requestPath: "/docs/nested/index.html", expected: false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.pattern+" "+testCase.requestPath, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.URL.Path = testCase.requestPath
+
+			require.Equal(t, testCase.expected, allowedPathMatcher(testCase.pattern)(req, nil))
+		})
+	}
+}
+
+func TestSetupRouterAllowedPaths(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+
+	opa := &core.OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+deny_all { false }
+`,
+	}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/public/private": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "deny_all"}},
+				},
+			},
+			"/users": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "deny_all"}},
+				},
+			},
+		},
+	}
+
+	var mongoClient *mongoclient.MongoClient
+	evaluatorsMap, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, config.EnvironmentVariables{})
+	require.NoError(t, err, "unexpected error")
+
+	var invokedPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		invokedPath = r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	env := config.EnvironmentVariables{
+		TargetServiceHost:   serverURL.Host,
+		ExposeMetrics:       true,
+		AllowedPathPatterns: []string{"/favicon.ico", "/public/*"},
+	}
+	router, err := SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+	require.NoError(t, err, "unexpected error")
+
+	t.Run("proxies allowed paths without policy evaluation", func(t *testing.T) {
+		for _, requestPath := range []string{"/favicon.ico", "/public/logo.png", "/public/private"} {
+			invokedPath = ""
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, requestPath, nil))
+
+			require.Equal(t, http.StatusOK, w.Result().StatusCode)
+			require.Equal(t, requestPath, invokedPath)
+		}
+	})
+
+	t.Run("evaluates policies on the other paths", func(t *testing.T) {
+		invokedPath = ""
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users", nil))
+
+		require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+		require.Empty(t, invokedPath)
+	})
+
+	t.Run("counts the requests proxied without policy evaluation", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, metrics.MetricsRoutePath, nil))
+
+		body, err := io.ReadAll(w.Result().Body)
+		require.NoError(t, err)
+		require.Contains(t, string(body), `rond_allowed_path_requests_total{pattern="/favicon.ico"} 1`)
+		require.Contains(t, string(body), `rond_allowed_path_requests_total{pattern="/public/*"} 2`)
+	})
+}
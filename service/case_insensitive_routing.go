@@ -0,0 +1,127 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mia-platform/glogger/v2"
+)
+
+type originalRequestPathKey struct{}
+
+type originalRequestPath struct {
+	Path    string
+	RawPath string
+}
+
+// CaseInsensitiveRoutingHandler lowercases the request path before the router matches it
+// against the routes, which are registered lowercase when CASE_INSENSITIVE_ROUTING is set.
+// The original path is restored once the route is matched.
+func CaseInsensitiveRoutingHandler(router http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), originalRequestPathKey{}, originalRequestPath{
+			Path:    r.URL.Path,
+			RawPath: r.URL.RawPath,
+		})
+		r = r.WithContext(ctx)
+		r.URL.Path = strings.ToLower(r.URL.Path)
+		r.URL.RawPath = strings.ToLower(r.URL.RawPath)
+		router.ServeHTTP(w, r)
+	})
+}
+
+// restoreOriginalRequestPathMiddleware restores the path lowercased by CaseInsensitiveRoutingHandler,
+// so that policies and the target service see the path as sent by the client. Path
+// variables are extracted again from the original path to keep their case.
+func restoreOriginalRequestPathMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		original, ok := r.Context().Value(originalRequestPathKey{}).(originalRequestPath)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		escapedLowercasePath := r.URL.EscapedPath()
+		r.URL.Path = original.Path
+		r.URL.RawPath = original.RawPath
+
+		if vars := originalPathVars(r, escapedLowercasePath); vars != nil {
+			r = mux.SetURLVars(r, vars)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func originalPathVars(r *http.Request, escapedLowercasePath string) map[string]string {
+	route := mux.CurrentRoute(r)
+	if route == nil || len(mux.Vars(r)) == 0 {
+		return nil
+	}
+	pathRegexp, err := route.GetPathRegexp()
+	if err != nil {
+		return nil
+	}
+	pathTemplate, err := route.GetPathTemplate()
+	if err != nil {
+		return nil
+	}
+	varNames := pathTemplateVarNames(pathTemplate)
+	matcher, err := regexp.Compile("(?i)" + pathRegexp)
+	if err != nil {
+		return nil
+	}
+
+	matches := matcher.FindStringSubmatch(r.URL.EscapedPath())
+	if len(matches) != len(varNames)+1 {
+		glogger.Get(r.Context()).WithField("path", escapedLowercasePath).Warn("failed path variables extraction from original path")
+		return nil
+	}
+
+	vars := mux.Vars(r)
+	for i, name := range varNames {
+		if _, ok := vars[name]; ok {
+			vars[name] = matches[i+1]
+		}
+	}
+	return vars
+}
+
+// pathTemplateVarNames returns the names of the variables of a mux path template,
+// in the order they appear, e.g. id for {id} or {id:[0-9]+}.
+func pathTemplateVarNames(pathTemplate string) []string {
+	varNames := []string{}
+	level, start := 0, 0
+	for i, char := range pathTemplate {
+		switch char {
+		case '{':
+			if level == 0 {
+				start = i + 1
+			}
+			level++
+		case '}':
+			level--
+			if level == 0 {
+				name, _, _ := strings.Cut(pathTemplate[start:i], ":")
+				varNames = append(varNames, name)
+			}
+		}
+	}
+	return varNames
+}
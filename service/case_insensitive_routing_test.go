@@ -0,0 +1,129 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/rond-authz/rond/core"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/openapi"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaseInsensitiveRouting(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+
+	opa := &core.OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+users_policy {
+	input.request.path == "/USERS/AbC"
+	input.request.pathParams.userId == "AbC"
+}
+orders_policy { false }
+`,
+	}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users/{userId}": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "users_policy"}},
+				},
+			},
+			"/orders": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "orders_policy"}},
+				},
+			},
+		},
+	}
+
+	var mongoClient *mongoclient.MongoClient
+	evaluatorsMap, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, config.EnvironmentVariables{})
+	require.NoError(t, err, "unexpected error")
+
+	var invokedPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		invokedPath = r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	t.Run("matches mixed-case requests and evaluates policies on the original path", func(t *testing.T) {
+		invokedPath = ""
+		env := config.EnvironmentVariables{
+			TargetServiceHost:      serverURL.Host,
+			CaseInsensitiveRouting: true,
+		}
+		router, err := SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+		require.NoError(t, err, "unexpected error")
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/USERS/AbC", nil)
+		CaseInsensitiveRoutingHandler(router).ServeHTTP(w, req)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Equal(t, "/USERS/AbC", invokedPath, "target service should receive the original path")
+	})
+
+	t.Run("uses the policy of the matched route", func(t *testing.T) {
+		invokedPath = ""
+		env := config.EnvironmentVariables{
+			TargetServiceHost:      serverURL.Host,
+			CaseInsensitiveRouting: true,
+		}
+		router, err := SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+		require.NoError(t, err, "unexpected error")
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/ORDERS", nil)
+		CaseInsensitiveRoutingHandler(router).ServeHTTP(w, req)
+
+		require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+		require.Empty(t, invokedPath)
+	})
+
+	t.Run("mixed-case requests do not match without case-insensitive routing", func(t *testing.T) {
+		invokedPath = ""
+		env := config.EnvironmentVariables{TargetServiceHost: serverURL.Host}
+		router, err := SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+		require.NoError(t, err, "unexpected error")
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/USERS/AbC", nil)
+		router.ServeHTTP(w, req)
+
+		require.NotEqual(t, http.StatusOK, w.Result().StatusCode)
+		require.Empty(t, invokedPath)
+	})
+}
+
+func TestPathTemplateVarNames(t *testing.T) {
+	require.Equal(t, []string{}, pathTemplateVarNames("/users"))
+	require.Equal(t, []string{"userId", "orderId"}, pathTemplateVarNames("/users/{userId}/orders/{orderId}"))
+	require.Equal(t, []string{"id"}, pathTemplateVarNames("/items/{id:[0-9]{3}}"))
+}
@@ -0,0 +1,190 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rond-authz/rond/internal/config"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AuthorizationServer implements the Envoy external authorization gRPC service, used by the
+// service meshes calling the authorization sidecars through gRPC in standalone mode.
+// The checked requests are served by the standalone HTTP handler, so that they are routed
+// and evaluated as the HTTP ones, with the same policies evaluators and module.
+type AuthorizationServer struct {
+	authv3.UnimplementedAuthorizationServer
+
+	env     config.EnvironmentVariables
+	handler http.Handler
+}
+
+func NewAuthorizationServer(env config.EnvironmentVariables, handler http.Handler) *AuthorizationServer {
+	return &AuthorizationServer{env: env, handler: handler}
+}
+
+// NewGRPCServer returns the gRPC server exposing the AuthorizationServer of the handler.
+func NewGRPCServer(env config.EnvironmentVariables, handler http.Handler) *grpc.Server {
+	server := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(server, NewAuthorizationServer(env, handler))
+	return server
+}
+
+func (server *AuthorizationServer) Check(ctx context.Context, checkRequest *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	req, err := server.newHTTPRequest(ctx, checkRequest.GetAttributes())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid check request: %s", err.Error())
+	}
+
+	recorder := &checkResponseRecorder{header: http.Header{}}
+	server.handler.ServeHTTP(recorder, req)
+	return recorder.checkResponse(), nil
+}
+
+// newHTTPRequest builds the request served by the handler from the attributes of the checked one.
+func (server *AuthorizationServer) newHTTPRequest(ctx context.Context, attributes *authv3.AttributeContext) (*http.Request, error) {
+	httpAttributes := attributes.GetRequest().GetHttp()
+	if httpAttributes == nil {
+		return nil, fmt.Errorf("missing HTTP request attributes")
+	}
+	if !strings.HasPrefix(httpAttributes.GetPath(), "/") {
+		return nil, fmt.Errorf("invalid path %q", httpAttributes.GetPath())
+	}
+
+	body := httpAttributes.GetRawBody()
+	if len(body) == 0 {
+		body = []byte(httpAttributes.GetBody())
+	}
+	// the policies are evaluated on the routes registered under the standalone path prefix, as for
+	// the requests checked through HTTP, which also keeps the management routes out of reach
+	target := server.env.PathPrefixStandalone + httpAttributes.GetPath()
+	req, err := http.NewRequestWithContext(ctx, httpAttributes.GetMethod(), target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range httpAttributes.GetHeaders() {
+		// the HTTP/2 pseudo-headers are already mapped to the request method, path and host
+		if strings.HasPrefix(key, ":") {
+			continue
+		}
+		req.Header.Set(key, value)
+	}
+	req.Host = httpAttributes.GetHost()
+	if socketAddress := attributes.GetSource().GetAddress().GetSocketAddress(); socketAddress != nil {
+		req.RemoteAddr = net.JoinHostPort(socketAddress.GetAddress(), strconv.Itoa(int(socketAddress.GetPortValue())))
+	}
+	return req, nil
+}
+
+// checkResponseRecorder records the response of the handler to build the check response.
+type checkResponseRecorder struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (recorder *checkResponseRecorder) Header() http.Header {
+	return recorder.header
+}
+
+func (recorder *checkResponseRecorder) WriteHeader(statusCode int) {
+	if recorder.statusCode == 0 {
+		recorder.statusCode = statusCode
+	}
+}
+
+func (recorder *checkResponseRecorder) Write(data []byte) (int, error) {
+	recorder.WriteHeader(http.StatusOK)
+	return recorder.body.Write(data)
+}
+
+func (recorder *checkResponseRecorder) checkResponse() *authv3.CheckResponse {
+	statusCode := recorder.statusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+
+	if statusCode >= 200 && statusCode < 300 {
+		// the headers of an allowed request are added to the one forwarded upstream, without
+		// overriding its content headers
+		header := recorder.header.Clone()
+		header.Del("Content-Type")
+		header.Del("Content-Length")
+		return &authv3.CheckResponse{
+			Status: &rpcstatus.Status{Code: int32(codes.OK)},
+			HttpResponse: &authv3.CheckResponse_OkResponse{
+				OkResponse: &authv3.OkHttpResponse{Headers: headerValueOptions(header)},
+			},
+		}
+	}
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(deniedStatusCode(statusCode)), Message: http.StatusText(statusCode)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(statusCode)},
+				Headers: headerValueOptions(recorder.header),
+				Body:    recorder.body.String(),
+			},
+		},
+	}
+}
+
+func headerValueOptions(header http.Header) []*corev3.HeaderValueOption {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	options := make([]*corev3.HeaderValueOption, 0, len(keys))
+	for _, key := range keys {
+		options = append(options, &corev3.HeaderValueOption{
+			Header:       &corev3.HeaderValue{Key: strings.ToLower(key), Value: strings.Join(header.Values(key), ",")},
+			AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+		})
+	}
+	return options
+}
+
+// deniedStatusCode maps the status code of a denied request to the gRPC one of the check.
+func deniedStatusCode(statusCode int) codes.Code {
+	switch {
+	case statusCode == http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case statusCode == http.StatusNotFound:
+		return codes.NotFound
+	case statusCode == http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case statusCode >= 500:
+		return codes.Internal
+	default:
+		return codes.PermissionDenied
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/rond-authz/rond/core"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/openapi"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newAuthorizationClient(t *testing.T, env config.EnvironmentVariables, handler http.Handler) authv3.AuthorizationClient {
+	t.Helper()
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := NewGRPCServer(env, handler)
+	//#nosec G104 -- Serve returns when the server is stopped
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return authv3.NewAuthorizationClient(conn)
+}
+
+func newCheckRequest(method, path string, headers map[string]string) *authv3.CheckRequest {
+	return &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Source: &authv3.AttributeContext_Peer{
+				Address: &corev3.Address{
+					Address: &corev3.Address_SocketAddress{
+						SocketAddress: &corev3.SocketAddress{
+							Address:       "10.0.0.1",
+							PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: 41234},
+						},
+					},
+				},
+			},
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Method:  method,
+					Path:    path,
+					Host:    "api.example.com",
+					Headers: headers,
+				},
+			},
+		},
+	}
+}
+
+func TestAuthorizationServerCheck(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+
+	opa := &core.OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow_users {
+	input.request.method == "GET"
+	input.request.path == "/eval/users/42"
+	input.request.pathParams.userId == "42"
+	get_header("x-role", input.request.headers) == "admin"
+}
+deny_orders { false }
+`,
+	}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users/{userId}": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow_users"}},
+				},
+			},
+			"/orders": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "deny_orders"}},
+				},
+			},
+		},
+	}
+	env := config.EnvironmentVariables{
+		Standalone:             true,
+		StandaloneGRPC:         true,
+		PathPrefixStandalone:   "/eval",
+		BindingsCrudServiceURL: "http://crud-service",
+		ServiceVersion:         "latest",
+	}
+
+	var mongoClient *mongoclient.MongoClient
+	evaluators, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, env)
+	require.NoError(t, err)
+	router, err := SetupRouter(log, env, opa, oas, evaluators, mongoClient)
+	require.NoError(t, err)
+	client := newAuthorizationClient(t, env, router)
+
+	t.Run("returns OK for an allowed request", func(t *testing.T) {
+		response, err := client.Check(context.Background(), newCheckRequest(http.MethodGet, "/users/42", map[string]string{
+			":authority": "api.example.com",
+			"x-role":     "admin",
+		}))
+		require.NoError(t, err)
+		require.Equal(t, int32(codes.OK), response.GetStatus().GetCode())
+		require.NotNil(t, response.GetOkResponse())
+	})
+
+	t.Run("denies a request forbidden by the policy", func(t *testing.T) {
+		response, err := client.Check(context.Background(), newCheckRequest(http.MethodGet, "/users/42", map[string]string{
+			"x-role": "guest",
+		}))
+		require.NoError(t, err)
+		require.Equal(t, int32(codes.PermissionDenied), response.GetStatus().GetCode())
+		require.Equal(t, typev3.StatusCode_Forbidden, response.GetDeniedResponse().GetStatus().GetCode())
+		require.Contains(t, response.GetDeniedResponse().GetBody(), "You do not have permissions to access this feature")
+
+		response, err = client.Check(context.Background(), newCheckRequest(http.MethodGet, "/orders", nil))
+		require.NoError(t, err)
+		require.Equal(t, int32(codes.PermissionDenied), response.GetStatus().GetCode())
+	})
+
+	t.Run("does not expose the management routes", func(t *testing.T) {
+		response, err := client.Check(context.Background(), newCheckRequest(http.MethodGet, "/-/ready", nil))
+		require.NoError(t, err)
+		require.Equal(t, int32(codes.NotFound), response.GetStatus().GetCode())
+	})
+
+	t.Run("rejects a check request without HTTP attributes", func(t *testing.T) {
+		_, err := client.Check(context.Background(), &authv3.CheckRequest{})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
@@ -15,10 +15,16 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/rond-authz/rond/core"
 	"github.com/rond-authz/rond/internal/config"
@@ -26,14 +32,23 @@ import (
 	"github.com/rond-authz/rond/internal/opatranslator"
 	"github.com/rond-authz/rond/internal/utils"
 	"github.com/rond-authz/rond/openapi"
+	"github.com/rond-authz/rond/usersignature"
 
 	"github.com/mia-platform/glogger/v2"
+	"github.com/open-policy-agent/opa/ast"
 	"github.com/sirupsen/logrus"
 )
 
 const URL_SCHEME = "http"
 const BASE_ROW_FILTER_HEADER_KEY = "acl_rows"
 
+const (
+	wwwAuthenticateHeaderKey = "WWW-Authenticate"
+	wwwAuthenticateChallenge = `Bearer realm="rond"`
+	xForwardedHostHeaderKey  = "X-Forwarded-Host"
+	xForwardedProtoHeaderKey = "X-Forwarded-Proto"
+)
+
 func ReverseProxyOrResponse(
 	logger *logrus.Entry,
 	env config.EnvironmentVariables,
@@ -43,11 +58,9 @@ func ReverseProxyOrResponse(
 	partialResultsEvaluators core.PartialResultsEvaluators,
 ) {
 	if env.Standalone {
+		setRequestPolicyResponseHeader(env, w.Header(), permission)
 		if permission.RequestFlow.GenerateQuery {
-			queryHeaderKey := BASE_ROW_FILTER_HEADER_KEY
-			if permission.RequestFlow.QueryOptions.HeaderName != "" {
-				queryHeaderKey = permission.RequestFlow.QueryOptions.HeaderName
-			}
+			queryHeaderKey := getQueryHeaderKey(permission)
 			securityQuery := req.Header.Get(queryHeaderKey)
 			w.Header().Set(queryHeaderKey, securityQuery)
 		}
@@ -61,6 +74,9 @@ func ReverseProxyOrResponse(
 }
 
 func rbacHandler(w http.ResponseWriter, req *http.Request) {
+	// the user is retrieved once and shared by the request and the response flows, the cache
+	// is usually injected by the router so that the access log reads the resolved user too
+	req = req.WithContext(mongoclient.WithUserCache(req.Context()))
 	requestContext := req.Context()
 	logger := glogger.Get(requestContext)
 
@@ -84,12 +100,101 @@ func rbacHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err := EvaluateRequest(req, env, w, partialResultEvaluators, permission); err != nil {
+	if permission.ContentNegotiationPolicy != "" {
+		if permission, err = versionedPermission(req, env, partialResultEvaluators, permission); err != nil {
+			utils.FailResponseWithCode(w, http.StatusInternalServerError, "content negotiation policy evaluation failed", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		req = req.WithContext(openapi.WithXPermission(req.Context(), permission))
+	}
+
+	if isPolicyTraceRequested(req, env) {
+		tracePolicyHandler(w, req, env, permission, partialResultEvaluators)
+		return
+	}
+
+	// while the target service is failing, the requests are rejected without retrieving the
+	// user bindings and evaluating the policies
+	if circuitOpenError := core.GetCircuitBreaker(requestContext).Rejects(); circuitOpenError != nil && !env.Standalone {
+		failCircuitOpen(logger, w, circuitOpenError)
 		return
 	}
+
+	policyMode := permission.Options.PolicyMode(env.DefaultPolicyMode)
+	logger = logger.WithField("policyMode", policyMode)
+	// the request context is read again since it may hold the permission of the negotiated version
+	req = req.WithContext(glogger.WithLogger(req.Context(), logger))
+
+	// the shadow policy is evaluated once the response is written, so that it adds no latency
+	var startShadowEvaluation func()
+	defer func() {
+		if startShadowEvaluation != nil {
+			startShadowEvaluation()
+		}
+	}()
+
+	switch policyMode {
+	case config.PolicyModeOff:
+		logger.Debug("policy evaluation skipped")
+	case config.PolicyModeLogOnly:
+		input, allowed := evaluateRequestInLogOnlyMode(logger, req, env, partialResultEvaluators, permission)
+		startShadowEvaluation = shadowPolicyEvaluation(req.Context(), env, partialResultEvaluators, permission, input, allowed)
+	default:
+		input, err := evaluateRequest(req, env, w, partialResultEvaluators, permission)
+		startShadowEvaluation = shadowPolicyEvaluation(req.Context(), env, partialResultEvaluators, permission, input, err == nil)
+		if err != nil {
+			return
+		}
+	}
 	ReverseProxyOrResponse(logger, env, w, req, permission, partialResultEvaluators)
 }
 
+// versionedPermission returns the configuration of the API version selected by the
+// content negotiation policy, falling back to the default one.
+func versionedPermission(
+	req *http.Request,
+	env config.EnvironmentVariables,
+	partialResultsEvaluators core.PartialResultsEvaluators,
+	permission *openapi.RondConfig,
+) (*openapi.RondConfig, error) {
+	logger := glogger.Get(req.Context())
+	version, err := core.EvaluateContentNegotiationPolicy(req.Context(), req, env, partialResultsEvaluators, core.RequestEvaluatorKey(req.Context(), permission.Options.PolicyModule, permission.ContentNegotiationPolicy))
+	if err != nil {
+		logger.WithField("error", logrus.Fields{
+			"policyName": permission.ContentNegotiationPolicy,
+			"message":    err.Error(),
+		}).Error("failed content negotiation policy evaluation")
+		return nil, err
+	}
+	logger.WithField("apiVersion", utils.SanitizeString(version)).Debug("API version selected")
+	return permission.ForVersion(version), nil
+}
+
+// evaluateRequestInLogOnlyMode evaluates the request policy only to record its decision:
+// the failure response is discarded and the generated query is not proxied. The policy
+// input and the decision are returned for the shadow policy evaluation.
+func evaluateRequestInLogOnlyMode(
+	logger *logrus.Entry,
+	req *http.Request,
+	env config.EnvironmentVariables,
+	partialResultsEvaluators core.PartialResultsEvaluators,
+	permission *openapi.RondConfig,
+) (ast.Value, bool) {
+	input, err := evaluateRequest(req, env, httptest.NewRecorder(), partialResultsEvaluators, permission)
+	if permission.RequestFlow.GenerateQuery {
+		req.Header.Del(getQueryHeaderKey(permission))
+	}
+	core.RecordLogOnlyDecision(req.Context(), logger, permission.RequestFlow.PolicyName, err == nil)
+	return input, err == nil
+}
+
+func getQueryHeaderKey(permission *openapi.RondConfig) string {
+	if permission.RequestFlow.QueryOptions.HeaderName != "" {
+		return permission.RequestFlow.QueryOptions.HeaderName
+	}
+	return BASE_ROW_FILTER_HEADER_KEY
+}
+
 func EvaluateRequest(
 	req *http.Request,
 	env config.EnvironmentVariables,
@@ -97,37 +202,69 @@ func EvaluateRequest(
 	partialResultsEvaluators core.PartialResultsEvaluators,
 	permission *openapi.RondConfig,
 ) error {
+	_, err := evaluateRequest(req, env, w, partialResultsEvaluators, permission)
+	return err
+}
+
+// evaluateRequest evaluates the request policy as EvaluateRequest, also returning the policy
+// input, or nil if the evaluation failed before the input was created.
+func evaluateRequest(
+	req *http.Request,
+	env config.EnvironmentVariables,
+	w http.ResponseWriter,
+	partialResultsEvaluators core.PartialResultsEvaluators,
+	permission *openapi.RondConfig,
+) (ast.Value, error) {
 	requestContext := req.Context()
 	logger := glogger.Get(requestContext)
 
 	userInfo, err := mongoclient.RetrieveUserBindingsAndRoles(logger, req, env)
 	if err != nil {
+		if utils.IsClientClosedRequest(requestContext) {
+			failClientClosedRequest(logger, w, err)
+			return nil, err
+		}
 		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed user bindings and roles retrieving")
 		utils.FailResponseWithCode(w, http.StatusInternalServerError, "user bindings retrieval failed", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
-		return err
+		return nil, err
+	}
+
+	if env.AuthenticationRequired && strings.TrimSpace(userInfo.UserID) == "" {
+		err := fmt.Errorf("missing user identity")
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("unauthenticated request")
+		w.Header().Set(wwwAuthenticateHeaderKey, wwwAuthenticateChallenge)
+		utils.FailResponseWithCode(w, http.StatusUnauthorized, err.Error(), utils.AUTHENTICATION_REQUIRED_ERROR_MESSAGE)
+		return nil, err
 	}
 
-	input, err := core.CreateRegoQueryInput(req, env, permission.Options.EnableResourcePermissionsMapOptimization, userInfo, nil)
+	evaluatorKey := core.RequestEvaluatorKey(requestContext, permission.Options.PolicyModule, permission.RequestFlow.PolicyName)
+	input, err := core.CreateParsedRegoQueryInput(req, env, partialResultsEvaluators.NeedsResourcePermissionsMap(evaluatorKey, permission.Options, env), userInfo, nil)
 	if err != nil {
 		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed rego query input creation")
 		utils.FailResponseWithCode(w, http.StatusInternalServerError, "RBAC input creation failed", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
-		return err
+		return nil, err
+	}
+	// only the inputs of the policies module can be replayed against a candidate module
+	if permission.Options.PolicyModule == "" {
+		if err := core.GetInputRecorder(requestContext).Record(permission.RequestFlow.PolicyName, input); err != nil {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed policy input recording")
+		}
 	}
 
 	var evaluatorAllowPolicy *core.OPAEvaluator
 	if !permission.RequestFlow.GenerateQuery {
-		evaluatorAllowPolicy, err = partialResultsEvaluators.GetEvaluatorFromPolicy(requestContext, permission.RequestFlow.PolicyName, input, env)
+		evaluatorAllowPolicy, err = partialResultsEvaluators.GetEvaluatorFromPolicyWithParsedInput(requestContext, evaluatorKey, input, env)
 		if err != nil {
 			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("cannot find policy evaluator")
 			utils.FailResponseWithCode(w, http.StatusInternalServerError, "failed partial evaluator retrieval", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
-			return err
+			return input, err
 		}
 	} else {
-		evaluatorAllowPolicy, err = core.CreateQueryEvaluator(requestContext, logger, req, env, permission.RequestFlow.PolicyName, input, nil)
+		evaluatorAllowPolicy, err = core.CreateQueryEvaluatorWithParsedInput(requestContext, logger, req, env, permission.RequestFlow.PolicyName, input)
 		if err != nil {
 			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("cannot create evaluator")
 			utils.FailResponseWithCode(w, http.StatusForbidden, "RBAC policy evaluator creation failed", utils.NO_PERMISSIONS_ERROR_MESSAGE)
-			return err
+			return input, err
 		}
 	}
 
@@ -138,17 +275,32 @@ func EvaluateRequest(
 			w.WriteHeader(http.StatusOK)
 			if _, err := w.Write([]byte("[]")); err != nil {
 				logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response write")
-				return err
+				return input, err
 			}
-			return err
+			return input, err
+		}
+		if utils.IsClientClosedRequest(requestContext) {
+			failClientClosedRequest(logger, w, err)
+			return input, err
+		}
+
+		denyReasons, reasonsErr := core.EvaluateDenyReasonsWithParsedInput(requestContext, permission.RequestFlow.PolicyName, input, env)
+		if reasonsErr != nil {
+			logger.WithField("error", logrus.Fields{"message": reasonsErr.Error()}).Warn("failed deny reasons evaluation")
 		}
 
 		logger.WithField("error", logrus.Fields{
-			"policyName": permission.RequestFlow.PolicyName,
-			"message":    err.Error(),
+			"policyName":  permission.RequestFlow.PolicyName,
+			"message":     err.Error(),
+			"denyReasons": denyReasons,
 		}).Error("RBAC policy evaluation failed")
-		utils.FailResponseWithCode(w, http.StatusForbidden, "RBAC policy evaluation failed", utils.NO_PERMISSIONS_ERROR_MESSAGE)
-		return err
+
+		technicalError := "RBAC policy evaluation failed"
+		if env.ExposeDenyReasons && len(denyReasons) > 0 {
+			technicalError = fmt.Sprintf("%s: %s", technicalError, strings.Join(denyReasons, ", "))
+		}
+		utils.FailResponseWithCode(w, http.StatusForbidden, technicalError, utils.NO_PERMISSIONS_ERROR_MESSAGE)
+		return input, err
 	}
 	var queryToProxy = []byte{}
 	if query != nil {
@@ -156,18 +308,14 @@ func EvaluateRequest(
 		if err != nil {
 			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("Error while marshaling row filter query")
 			utils.FailResponseWithCode(w, http.StatusForbidden, "Error while marshaling row filter query", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
-			return err
+			return input, err
 		}
 	}
 
-	queryHeaderKey := BASE_ROW_FILTER_HEADER_KEY
-	if permission.RequestFlow.QueryOptions.HeaderName != "" {
-		queryHeaderKey = permission.RequestFlow.QueryOptions.HeaderName
-	}
 	if query != nil {
-		req.Header.Set(queryHeaderKey, string(queryToProxy))
+		req.Header.Set(getQueryHeaderKey(permission), string(queryToProxy))
 	}
-	return nil
+	return input, nil
 }
 
 func ReverseProxy(
@@ -178,12 +326,28 @@ func ReverseProxy(
 	permission *openapi.RondConfig,
 	partialResultsEvaluators core.PartialResultsEvaluators,
 ) {
-	targetHostFromEnv := env.TargetServiceHost
+	// the timeout covers the whole proxying operation, and cancels the target service request
+	var routeOptions openapi.PermissionOptions
+	if permission != nil {
+		routeOptions = permission.Options
+	}
+	if timeout := routeOptions.RequestTimeout(env.DefaultRequestTimeoutMs); timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
 	proxy := httputil.ReverseProxy{
 		FlushInterval: -1,
+		ErrorHandler:  proxyErrorHandler(logger),
 		Director: func(req *http.Request) {
-			req.URL.Host = targetHostFromEnv
+			inboundHost := req.Host
+			req.URL.Host = env.GetUpstreamHost(req.URL.Path)
 			req.URL.Scheme = URL_SCHEME
+			rewritePathPrefix(env, req.URL)
+			setUpstreamHostHeader(env, req)
+			setForwardedHeaders(env, req, inboundHost)
+			setUserSignatureHeader(env, req, time.Now())
 			if _, ok := req.Header["User-Agent"]; !ok {
 				// explicitly disable User-Agent so it's not set to default value
 				req.Header.Set("User-Agent", "")
@@ -191,13 +355,25 @@ func ReverseProxy(
 		},
 	}
 
-	// Check on nil is performed to proxy the oas documentation path
-	if permission == nil || permission.ResponseFlow.PolicyName == "" {
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		setRequestPolicyResponseHeader(env, resp.Header, permission)
+		return nil
+	}
+
+	transport := core.GetCircuitBreaker(req.Context()).Transport(http.DefaultTransport)
+	// Check on nil is performed to proxy the oas documentation path. Without a response policy
+	// the body is passed through, unless it must be checked to be JSON.
+	if permission == nil || (permission.ResponseFlow.PolicyName == "" && env.PassThroughNonJSON) {
+		proxy.Transport = &core.UpstreamTransport{
+			RoundTripper: transport,
+			Logger:       logger,
+			Env:          env,
+		}
 		proxy.ServeHTTP(w, req)
 		return
 	}
 	proxy.Transport = core.NewOPATransport(
-		http.DefaultTransport,
+		transport,
 		req.Context(),
 		logger,
 		req,
@@ -208,6 +384,148 @@ func ReverseProxy(
 	proxy.ServeHTTP(w, req)
 }
 
+// setRequestPolicyResponseHeader reports the name of the request policy in the response of
+// the routes without a response policy, the response policies set it once evaluated. In
+// standalone mode no response policy is evaluated, so the request policy is always reported.
+func setRequestPolicyResponseHeader(env config.EnvironmentVariables, header http.Header, permission *openapi.RondConfig) {
+	if env.PolicyResponseHeader == "" || permission == nil || permission.RequestFlow.PolicyName == "" {
+		return
+	}
+	if permission.ResponseFlow.PolicyName != "" && !env.Standalone {
+		return
+	}
+	if permission.Options.PolicyMode(env.DefaultPolicyMode) == config.PolicyModeOff {
+		return
+	}
+	header.Set(env.PolicyResponseHeader, permission.RequestFlow.PolicyName)
+}
+
+// proxyErrorHandler replaces the default error handler of the reverse proxy, logging with
+// the request logger and not reporting the requests closed by the client as bad gateway.
+func proxyErrorHandler(logger *logrus.Entry) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, req *http.Request, err error) {
+		if utils.IsClientClosedRequest(req.Context()) {
+			failClientClosedRequest(logger, w, err)
+			return
+		}
+		var circuitOpenError *core.CircuitOpenError
+		if errors.As(err, &circuitOpenError) {
+			failCircuitOpen(logger, w, circuitOpenError)
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(req.Context().Err(), context.DeadlineExceeded) {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("target service request timed out")
+			utils.FailResponseWithCode(w, http.StatusGatewayTimeout, fmt.Sprintf("target service request interrupted: %s", err.Error()), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed target service request")
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// failCircuitOpen rejects the request while the target service circuit breaker is open.
+func failCircuitOpen(logger *logrus.Entry, w http.ResponseWriter, err *core.CircuitOpenError) {
+	logger.WithField("retryAfter", err.RetryAfterSeconds()).Warn("target service request rejected by the circuit breaker")
+	w.Header().Set("Retry-After", err.RetryAfterSeconds())
+	utils.FailResponseWithCode(w, http.StatusServiceUnavailable, err.Error(), "The service is temporarily unavailable, please try again later")
+}
+
+// failClientClosedRequest logs the request as closed by the client and sets its status code,
+// the response is never received by the client but it is reported by the access log.
+func failClientClosedRequest(logger *logrus.Entry, w http.ResponseWriter, err error) {
+	utils.LogClientClosedRequest(logger, err)
+	w.WriteHeader(utils.StatusClientClosedRequest)
+}
+
+// rewritePathPrefix replaces the PATH_REWRITE_FROM prefix of the URL forwarded to the target
+// service with PATH_REWRITE_TO. The request context, and so the router info and the policy
+// input, keeps the path requested by the client.
+func rewritePathPrefix(env config.EnvironmentVariables, url *url.URL) {
+	if env.PathRewriteFrom == "" {
+		return
+	}
+	from := strings.TrimSuffix(env.PathRewriteFrom, "/")
+	if url.Path != from && !strings.HasPrefix(url.Path, from+"/") {
+		return
+	}
+	to := strings.TrimSuffix(env.PathRewriteTo, "/")
+	url.Path = replacePathPrefix(url.Path, from, to)
+	if url.RawPath != "" {
+		url.RawPath = replacePathPrefix(url.RawPath, from, to)
+	}
+}
+
+func replacePathPrefix(path, from, to string) string {
+	rewritten := to + strings.TrimPrefix(path, from)
+	if !strings.HasPrefix(rewritten, "/") {
+		rewritten = "/" + rewritten
+	}
+	return rewritten
+}
+
+// setUpstreamHostHeader sets the Host header sent to the target service: the configured
+// TARGET_SERVICE_HOST_HEADER, or the client one with PRESERVE_HOST, otherwise the host
+// of the target service.
+func setUpstreamHostHeader(env config.EnvironmentVariables, req *http.Request) {
+	switch {
+	case env.TargetServiceHostHeader != "":
+		req.Host = env.TargetServiceHostHeader
+	case !env.PreserveHost:
+		req.Host = req.URL.Host
+	}
+}
+
+// setForwardedHeaders sets the X-Forwarded-Host and X-Forwarded-Proto headers from the
+// inbound request, the X-Forwarded-For one is appended by the reverse proxy. The values
+// set by a previous proxy are kept, unless TRUSTED_PROXIES is set and the request does
+// not come from one of them.
+func setForwardedHeaders(env config.EnvironmentVariables, req *http.Request, inboundHost string) {
+	keepForwarded := len(env.TrustedProxiesNetworks) == 0 || utils.FromTrustedProxy(req, env.TrustedProxiesNetworks)
+	if !keepForwarded || req.Header.Get(xForwardedHostHeaderKey) == "" {
+		req.Header.Set(xForwardedHostHeaderKey, inboundHost)
+	}
+	if !keepForwarded || req.Header.Get(xForwardedProtoHeaderKey) == "" {
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		req.Header.Set(xForwardedProtoHeaderKey, proto)
+	}
+	if !keepForwarded {
+		// the reverse proxy appends the address of the client
+		req.Header.Del(utils.XForwardedForHeaderKey)
+	}
+}
+
+// setUserSignatureHeader forwards the user resolved by rond to the target service when
+// USER_SIGNATURE_SECRET is set, replacing the user headers sent by the client, and signs it
+// together with the method and path of the request. Without a resolved user, e.g. with the
+// policy mode off, the user headers are removed. See the usersignature package for the
+// verification on the target service.
+func setUserSignatureHeader(env config.EnvironmentVariables, req *http.Request, now time.Time) {
+	if env.UserSignatureSecret == "" {
+		return
+	}
+	user, _ := mongoclient.ResolvedUser(req.Context())
+	setOrDeleteHeader(req.Header, env.UserIdHeader, user.UserID)
+	setOrDeleteHeader(req.Header, env.UserGroupsHeader, strings.Join(user.UserGroups, ","))
+	signature := usersignature.Sign(
+		now,
+		usersignature.RequestPayload(req, env.UserIdHeader, env.UserGroupsHeader),
+		env.UserSignatureSecret,
+		env.UserSignatureSecondarySecret,
+	)
+	req.Header.Set(env.UserSignatureHeader, signature)
+}
+
+func setOrDeleteHeader(header http.Header, key, value string) {
+	if value == "" {
+		header.Del(key)
+		return
+	}
+	header.Set(key, value)
+}
+
 func alwaysProxyHandler(w http.ResponseWriter, req *http.Request) {
 	requestContext := req.Context()
 	logger := glogger.Get(req.Context())
@@ -15,6 +15,7 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -25,6 +26,7 @@ import (
 	"net/url"
 	"reflect"
 	"strings"
+	"time"
 
 	"testing"
 
@@ -40,6 +42,7 @@ import (
 	"github.com/rond-authz/rond/internal/utils"
 	"github.com/rond-authz/rond/openapi"
 	"github.com/rond-authz/rond/types"
+	"github.com/rond-authz/rond/usersignature"
 
 	"github.com/gorilla/mux"
 	"github.com/mia-platform/glogger/v2"
@@ -48,6 +51,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/h2non/gock.v1"
 )
 
 func TestDirectProxyHandler(t *testing.T) {
@@ -97,7 +101,7 @@ func TestDirectProxyHandler(t *testing.T) {
 		}))
 		defer server.Close()
 
-		partialEvaluators, err := core.SetupEvaluators(ctx, nil, &oas, mockOPAModule, envs)
+		partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, &oas, mockOPAModule, envs)
 		require.NoError(t, err, "Unexpected error")
 
 		serverURL, _ := url.Parse(server.URL)
@@ -126,7 +130,7 @@ func TestDirectProxyHandler(t *testing.T) {
 		mockHeader := "CustomHeader"
 		mockHeaderValue := "mocked value"
 
-		partialEvaluators, err := core.SetupEvaluators(ctx, nil, &oas, mockOPAModule, envs)
+		partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, &oas, mockOPAModule, envs)
 		require.NoError(t, err, "Unexpected error")
 
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -161,7 +165,7 @@ func TestDirectProxyHandler(t *testing.T) {
 		invoked := false
 		mockBodySting := "I am a body"
 
-		partialEvaluators, err := core.SetupEvaluators(ctx, nil, &oas, mockOPAModule, envs)
+		partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, &oas, mockOPAModule, envs)
 		require.NoError(t, err, "Unexpected error")
 
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -180,7 +184,7 @@ func TestDirectProxyHandler(t *testing.T) {
 		serverURL, _ := url.Parse(server.URL)
 		ctx := createContext(t,
 			ctx,
-			config.EnvironmentVariables{TargetServiceHost: serverURL.Host},
+			config.EnvironmentVariables{TargetServiceHost: serverURL.Host, PassThroughNonJSON: true},
 			nil,
 			mockXPermission,
 			mockOPAModule,
@@ -210,7 +214,7 @@ func TestDirectProxyHandler(t *testing.T) {
 			todo { input.request.body.hello == "world" }`,
 		}
 
-		partialEvaluators, err := core.SetupEvaluators(ctx, nil, &oas, OPAModuleConfig, envs)
+		partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, &oas, OPAModuleConfig, envs)
 		require.NoError(t, err, "Unexpected error")
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			invoked = true
@@ -228,7 +232,7 @@ func TestDirectProxyHandler(t *testing.T) {
 		serverURL, _ := url.Parse(server.URL)
 		ctx := createContext(t,
 			context.Background(),
-			config.EnvironmentVariables{TargetServiceHost: serverURL.Host},
+			config.EnvironmentVariables{TargetServiceHost: serverURL.Host, PassThroughNonJSON: true},
 			nil,
 			&openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "todo"}},
 			OPAModuleConfig,
@@ -294,13 +298,13 @@ allow {
 
 		OPAModuleConfig := &core.OPAModuleConfig{Name: "mypolicy.rego", Content: policy}
 
-		partialEvaluators, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, OPAModuleConfig, envs)
+		partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, OPAModuleConfig, envs)
 		require.NoError(t, err, "Unexpected error")
 
 		serverURL, _ := url.Parse(server.URL)
 		ctx := createContext(t,
 			context.Background(),
-			config.EnvironmentVariables{TargetServiceHost: serverURL.Host},
+			config.EnvironmentVariables{TargetServiceHost: serverURL.Host, PassThroughNonJSON: true},
 			nil,
 			mockRondConfigWithQueryGen,
 			OPAModuleConfig,
@@ -366,11 +370,11 @@ allow {
 
 		OPAModuleConfig := &core.OPAModuleConfig{Name: "mypolicy.rego", Content: policy}
 
-		partialEvaluators, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, OPAModuleConfig, envs)
+		partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, OPAModuleConfig, envs)
 		require.NoError(t, err, "Unexpected error")
 		ctx := createContext(t,
 			context.Background(),
-			config.EnvironmentVariables{TargetServiceHost: serverURL.Host},
+			config.EnvironmentVariables{TargetServiceHost: serverURL.Host, PassThroughNonJSON: true},
 			nil,
 			mockRondConfigWithQueryGen,
 			OPAModuleConfig,
@@ -415,7 +419,7 @@ allow {
 
 		OPAModuleConfig := &core.OPAModuleConfig{Name: "mypolicy.rego", Content: policy}
 
-		partialEvaluators, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, OPAModuleConfig, envs)
+		partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, OPAModuleConfig, envs)
 		require.NoError(t, err, "Unexpected error")
 		ctx := createContext(t,
 			context.Background(),
@@ -463,7 +467,7 @@ allow {
 
 		OPAModuleConfig := &core.OPAModuleConfig{Name: "mypolicy.rego", Content: policy}
 
-		partialEvaluators, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, OPAModuleConfig, envs)
+		partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, OPAModuleConfig, envs)
 		require.NoError(t, err, "Unexpected error")
 		ctx := createContext(t,
 			context.Background(),
@@ -532,7 +536,7 @@ allow {
 
 		OPAModuleConfig := &core.OPAModuleConfig{Name: "mypolicy.rego", Content: policy}
 
-		partialEvaluators, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, OPAModuleConfig, envs)
+		partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, OPAModuleConfig, envs)
 		require.NoError(t, err, "Unexpected error")
 		ctx := createContext(t,
 			context.Background(),
@@ -571,7 +575,7 @@ allow {
 
 			serverURL, _ := url.Parse(server.URL)
 
-			partialEvaluators, err := core.SetupEvaluators(ctx, nil, &oas, mockOPAModule, envs)
+			partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, &oas, mockOPAModule, envs)
 			require.NoError(t, err, "Unexpected error")
 
 			ctx := createContext(t,
@@ -607,6 +611,7 @@ allow {
 					"matchedPath":   "/matched/path",
 					"method":        "GET",
 					"partialEval":   false,
+					"policyMode":    "enforce",
 					"policyName":    "todo",
 					"requestedPath": "/requested/path",
 				}, actualLog[0].Data)
@@ -647,7 +652,7 @@ allow {
 	employee.salary < 0
 }`,
 			}
-			partialEvaluators, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, OPAModuleConfig, envs)
+			partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, OPAModuleConfig, envs)
 			require.NoError(t, err, "Unexpected error")
 
 			ctx := createContext(t,
@@ -683,6 +688,7 @@ allow {
 					"matchedPath":   "/matched/path",
 					"method":        "GET",
 					"partialEval":   true,
+					"policyMode":    "enforce",
 					"policyName":    "allow",
 					"requestedPath": "/requested/path",
 				}, actualLog[0].Data)
@@ -702,6 +708,876 @@ allow {
 	})
 }
 
+func TestPolicyModes(t *testing.T) {
+	envs := config.EnvironmentVariables{}
+	OPAModuleConfig := &core.OPAModuleConfig{
+		Name: "mypolicy.rego",
+		Content: `package policies
+todo { input.request.method == "POST" }`,
+	}
+	oas := openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/api": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{
+						RequestFlow: openapi.RequestFlow{PolicyName: "todo"},
+					},
+				},
+			},
+		},
+	}
+	partialEvaluators, _, err := core.SetupEvaluators(context.Background(), nil, &oas, OPAModuleConfig, envs)
+	require.NoError(t, err, "Unexpected error")
+
+	runRequest := func(t *testing.T, env config.EnvironmentVariables, permission *openapi.RondConfig) (*httptest.ResponseRecorder, bool, context.Context, *test.Hook) {
+		t.Helper()
+		invoked := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		serverURL, _ := url.Parse(server.URL)
+		env.TargetServiceHost = serverURL.Host
+		ctx := createContext(t, context.Background(), env, nil, permission, OPAModuleConfig, partialEvaluators)
+
+		log, hook := test.NewNullLogger()
+		log.Level = logrus.TraceLevel
+		ctx = glogger.WithLogger(ctx, logrus.NewEntry(log))
+
+		r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+		require.NoError(t, err, "Unexpected error")
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+
+		return w, invoked, ctx, hook
+	}
+
+	t.Run("enforce mode blocks denied requests", func(t *testing.T) {
+		w, invoked, _, _ := runRequest(t, envs, &openapi.RondConfig{
+			RequestFlow: openapi.RequestFlow{PolicyName: "todo"},
+			Options:     openapi.PermissionOptions{Mode: config.PolicyModeEnforce},
+		})
+
+		require.False(t, invoked, "Handler was invoked.")
+		require.Equal(t, http.StatusForbidden, w.Result().StatusCode, "Unexpected status code.")
+	})
+
+	t.Run("log-only mode proxies denied requests and records the decision", func(t *testing.T) {
+		w, invoked, ctx, hook := runRequest(t, envs, &openapi.RondConfig{
+			RequestFlow: openapi.RequestFlow{PolicyName: "todo"},
+			Options:     openapi.PermissionOptions{Mode: config.PolicyModeLogOnly},
+		})
+
+		require.True(t, invoked, "Handler was not invoked.")
+		require.Equal(t, http.StatusOK, w.Result().StatusCode, "Unexpected status code.")
+
+		actualLog := findLogWithMessage(hook.AllEntries(), "log-only policy decision")
+		require.Len(t, actualLog, 1)
+		require.Equal(t, logrus.Fields{
+			"allowed":    false,
+			"policyMode": config.PolicyModeLogOnly,
+			"policyName": "todo",
+		}, actualLog[0].Data)
+
+		m, err := metrics.GetFromContext(ctx)
+		require.NoError(t, err)
+		require.Equal(t, float64(1), testutil.ToFloat64(m.PolicyLogOnlyDecisions.WithLabelValues("todo", "false")))
+	})
+
+	t.Run("off mode skips policy evaluation", func(t *testing.T) {
+		w, invoked, _, hook := runRequest(t, envs, &openapi.RondConfig{
+			RequestFlow: openapi.RequestFlow{PolicyName: "todo"},
+			Options:     openapi.PermissionOptions{Mode: config.PolicyModeOff},
+		})
+
+		require.True(t, invoked, "Handler was not invoked.")
+		require.Equal(t, http.StatusOK, w.Result().StatusCode, "Unexpected status code.")
+		require.Empty(t, findLogWithMessage(hook.AllEntries(), "policy evaluation completed"))
+	})
+
+	t.Run("route without mode uses the default policy mode", func(t *testing.T) {
+		w, invoked, _, _ := runRequest(t, config.EnvironmentVariables{DefaultPolicyMode: config.PolicyModeLogOnly}, &openapi.RondConfig{
+			RequestFlow: openapi.RequestFlow{PolicyName: "todo"},
+		})
+
+		require.True(t, invoked, "Handler was not invoked.")
+		require.Equal(t, http.StatusOK, w.Result().StatusCode, "Unexpected status code.")
+	})
+}
+
+func TestRequestBodyForwarding(t *testing.T) {
+	envs := config.EnvironmentVariables{}
+	OPAModuleConfig := &core.OPAModuleConfig{
+		Name: "mypolicy.rego",
+		Content: `package policies
+allow { input.request.body.name == "my-book" }
+filter_response [body] {
+	input.request.body.name == "my-book"
+	body := input.response.body
+}`,
+	}
+	permission := &openapi.RondConfig{
+		RequestFlow:  openapi.RequestFlow{PolicyName: "allow"},
+		ResponseFlow: openapi.ResponseFlow{PolicyName: "filter_response"},
+	}
+	oas := openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/api": openapi.PathVerbs{
+				"post": openapi.VerbConfig{PermissionV2: permission},
+			},
+		},
+	}
+	partialEvaluators, _, err := core.SetupEvaluators(context.Background(), nil, &oas, OPAModuleConfig, envs)
+	require.NoError(t, err, "Unexpected error")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(utils.ContentTypeHeaderKey, r.Header.Get(utils.ContentTypeHeaderKey))
+		io.Copy(w, r.Body)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	envs.TargetServiceHost = serverURL.Host
+	ctx := createContext(t, context.Background(), envs, nil, permission, OPAModuleConfig, partialEvaluators)
+
+	requestBody := `{"name":"my-book","pages":42}`
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://www.example.com:8080/api", bytes.NewReader([]byte(requestBody)))
+	require.NoError(t, err, "Unexpected error")
+	r.Header.Set(utils.ContentTypeHeaderKey, "application/json")
+	w := httptest.NewRecorder()
+
+	rbacHandler(w, r)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode, "Unexpected status code.")
+	require.JSONEq(t, requestBody, w.Body.String())
+}
+
+func TestUserRetrievedOncePerRequest(t *testing.T) {
+	envs := config.EnvironmentVariables{UserIdHeader: "miauserid"}
+	OPAModuleConfig := &core.OPAModuleConfig{
+		Name: "mypolicy.rego",
+		Content: `package policies
+allow { input.user.bindings[_].roles[_] == "reader" }
+filter_response [body] {
+	input.user.roles[_].roleId == "reader"
+	body := input.response.body
+}`,
+	}
+	permission := &openapi.RondConfig{
+		RequestFlow:  openapi.RequestFlow{PolicyName: "allow"},
+		ResponseFlow: openapi.ResponseFlow{PolicyName: "filter_response"},
+	}
+	oas := openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/api": openapi.PathVerbs{
+				"get": openapi.VerbConfig{PermissionV2: permission},
+			},
+		},
+	}
+	partialEvaluators, _, err := core.SetupEvaluators(context.Background(), nil, &oas, OPAModuleConfig, envs)
+	require.NoError(t, err, "Unexpected error")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(utils.ContentTypeHeaderKey, utils.JSONContentTypeHeader)
+		w.Write([]byte(`{"hello":"world"}`))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	envs.TargetServiceHost = serverURL.Host
+
+	bindingsRetrievals, rolesRetrievals := 0, 0
+	mongoClient := &mocks.MongoClientMock{
+		UserBindings: []types.Binding{{BindingID: "b1", Subjects: []string{"user1"}, Roles: []string{"reader"}}},
+		UserRoles:    []types.Role{{RoleID: "reader", Permissions: []string{"read"}}},
+		RetrieveUserBindingsExpectation: func(user *types.User) {
+			bindingsRetrievals++
+		},
+		RetrieveUserRolesExpectation: func(userRolesId []string) {
+			rolesRetrievals++
+		},
+	}
+	ctx := createContext(t, context.Background(), envs, mongoClient, permission, OPAModuleConfig, partialEvaluators)
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+	require.NoError(t, err, "Unexpected error")
+	r.Header.Set("miauserid", "user1")
+	w := httptest.NewRecorder()
+
+	rbacHandler(w, r)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode, "Unexpected status code.")
+	require.JSONEq(t, `{"hello":"world"}`, w.Body.String())
+	require.Equal(t, 1, bindingsRetrievals)
+	require.Equal(t, 1, rolesRetrievals)
+}
+
+func TestClientClosedRequest(t *testing.T) {
+	envs := config.EnvironmentVariables{UserIdHeader: "miauserid", TargetServiceHost: "targetservice.test"}
+	opaModuleConfig := &core.OPAModuleConfig{
+		Name: "mypolicy.rego",
+		Content: `package policies
+allow { true }
+filter_response [body] { body := input.response.body }`,
+	}
+	bindings := []types.Binding{{BindingID: "b1", Subjects: []string{"user1"}, Roles: []string{"reader"}}}
+	roles := []types.Role{{RoleID: "reader", Permissions: []string{"read"}}}
+
+	serveCancelledRequest := func(t *testing.T, permission *openapi.RondConfig, mongoClient *mocks.MongoClientMock, cancelAfter time.Duration) (*httptest.ResponseRecorder, *test.Hook) {
+		t.Helper()
+		oas := openapi.OpenAPISpec{
+			Paths: openapi.OpenAPIPaths{
+				"/api": openapi.PathVerbs{"get": openapi.VerbConfig{PermissionV2: permission}},
+			},
+		}
+		partialEvaluators, _, err := core.SetupEvaluators(context.Background(), nil, &oas, opaModuleConfig, envs)
+		require.NoError(t, err)
+
+		clientContext, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if mongoClient.RetrieveUserBindingsContext == nil {
+			time.AfterFunc(cancelAfter, cancel)
+		} else {
+			retrieveUserBindingsContext := mongoClient.RetrieveUserBindingsContext
+			mongoClient.RetrieveUserBindingsContext = func(ctx context.Context) {
+				cancel()
+				retrieveUserBindingsContext(ctx)
+			}
+		}
+
+		log, hook := test.NewNullLogger()
+		ctx := createContext(t, clientContext, envs, mongoClient, permission, opaModuleConfig, partialEvaluators)
+		ctx = glogger.WithLogger(ctx, logrus.NewEntry(log))
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+		require.NoError(t, err)
+		r.Header.Set("miauserid", "user1")
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+		return w, hook
+	}
+
+	requireClientClosedRequestLog := func(t *testing.T, hook *test.Hook) {
+		t.Helper()
+		for _, entry := range hook.AllEntries() {
+			require.NotEqual(t, logrus.ErrorLevel, entry.Level, entry.Message)
+		}
+		require.Equal(t, "client closed request", hook.LastEntry().Message)
+		require.Equal(t, utils.StatusClientClosedRequest, hook.LastEntry().Data["statusCode"])
+	}
+
+	t.Run("cancels the user bindings retrieval", func(t *testing.T) {
+		var mongoContext context.Context
+		mongoClient := &mocks.MongoClientMock{
+			UserBindingsError: context.Canceled,
+			RetrieveUserBindingsContext: func(ctx context.Context) {
+				mongoContext = ctx
+			},
+		}
+		permission := &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow"}}
+
+		w, hook := serveCancelledRequest(t, permission, mongoClient, 0)
+		require.Equal(t, utils.StatusClientClosedRequest, w.Result().StatusCode)
+		require.ErrorIs(t, mongoContext.Err(), context.Canceled)
+		requireClientClosedRequestLog(t, hook)
+	})
+
+	for _, testCase := range []struct {
+		name       string
+		permission *openapi.RondConfig
+	}{
+		{name: "aborts the upstream request", permission: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow"}}},
+		{name: "aborts the upstream request with response policy", permission: &openapi.RondConfig{
+			RequestFlow:  openapi.RequestFlow{PolicyName: "allow"},
+			ResponseFlow: openapi.ResponseFlow{PolicyName: "filter_response"},
+		}},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			defer gock.Off()
+			gock.New("http://targetservice.test").
+				Get("/api").
+				Reply(http.StatusOK).
+				Delay(5 * time.Second).
+				JSON(map[string]string{"hello": "world"})
+
+			mongoClient := &mocks.MongoClientMock{UserBindings: bindings, UserRoles: roles}
+			start := time.Now()
+			w, hook := serveCancelledRequest(t, testCase.permission, mongoClient, 100*time.Millisecond)
+			require.Less(t, time.Since(start), 5*time.Second, "upstream request not aborted")
+			require.True(t, gock.IsDone(), "upstream not called")
+			require.Equal(t, utils.StatusClientClosedRequest, w.Result().StatusCode)
+			requireClientClosedRequestLog(t, hook)
+		})
+	}
+}
+
+func TestUpstreamRouting(t *testing.T) {
+	envs := config.EnvironmentVariables{
+		UserIdHeader:      "miauserid",
+		TargetServiceHost: "targetservice.test",
+		UpstreamRoutes: []config.UpstreamRoute{
+			{PathPrefix: "/api/v1/admin", Host: "admin.test:8080"},
+			{PathPrefix: "/api/v1", Host: "v1.test:8080"},
+			{PathPrefix: "/api/v2", Host: "v2.test:8080"},
+		},
+	}
+	opaModuleConfig := &core.OPAModuleConfig{
+		Name: "mypolicy.rego",
+		Content: `package policies
+allow { input.request.upstreamHost == input.request.headers["X-Expected-Upstream"][0] }`,
+	}
+	permission := &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow"}}
+	oas := openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/api/v1/items":       openapi.PathVerbs{"get": openapi.VerbConfig{PermissionV2: permission}},
+			"/api/v1/admin/items": openapi.PathVerbs{"get": openapi.VerbConfig{PermissionV2: permission}},
+			"/api/v2/items":       openapi.PathVerbs{"get": openapi.VerbConfig{PermissionV2: permission}},
+			"/api/v3/items":       openapi.PathVerbs{"get": openapi.VerbConfig{PermissionV2: permission}},
+		},
+	}
+	partialEvaluators, _, err := core.SetupEvaluators(context.Background(), nil, &oas, opaModuleConfig, envs)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name             string
+		path             string
+		expectedUpstream string
+	}{
+		{name: "routes the first prefix to its upstream", path: "/api/v1/items", expectedUpstream: "v1.test:8080"},
+		{name: "routes the second prefix to its upstream", path: "/api/v2/items", expectedUpstream: "v2.test:8080"},
+		{name: "routes to the longest matching prefix", path: "/api/v1/admin/items", expectedUpstream: "admin.test:8080"},
+		{name: "falls back to the target service host", path: "/api/v3/items", expectedUpstream: "targetservice.test"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			defer gock.Off()
+			gock.New("http://" + testCase.expectedUpstream).
+				Get(testCase.path).
+				Reply(http.StatusOK).
+				JSON(map[string]string{"upstream": testCase.expectedUpstream})
+
+			ctx := createContext(t, context.Background(), envs, nil, permission, opaModuleConfig, partialEvaluators)
+			r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080"+testCase.path, nil)
+			require.NoError(t, err)
+			r.Header.Set("X-Expected-Upstream", testCase.expectedUpstream)
+			w := httptest.NewRecorder()
+
+			rbacHandler(w, r)
+			require.Equal(t, http.StatusOK, w.Result().StatusCode, w.Body.String())
+			require.True(t, gock.IsDone(), "upstream not called")
+			require.JSONEq(t, fmt.Sprintf(`{"upstream":"%s"}`, testCase.expectedUpstream), w.Body.String())
+		})
+	}
+}
+
+func TestReverseProxyHostAndForwardedHeaders(t *testing.T) {
+	var upstreamRequest *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequest = r
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	trustedProxies, err := utils.ParseTrustedProxies("10.0.0.0/8")
+	require.NoError(t, err)
+
+	proxy := func(t *testing.T, env config.EnvironmentVariables, req *http.Request) *http.Request {
+		t.Helper()
+		env.TargetServiceHost = serverURL.Host
+		log, _ := test.NewNullLogger()
+		w := httptest.NewRecorder()
+
+		ReverseProxy(logrus.NewEntry(log), env, w, req, nil, nil)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		return upstreamRequest
+	}
+
+	t.Run("preserves the client Host and sets the forwarding headers", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "http://public.example.com/api/foo", nil)
+		req.RemoteAddr = "192.168.1.10:12345"
+
+		upstream := proxy(t, config.EnvironmentVariables{PreserveHost: true}, req)
+		require.Equal(t, "public.example.com", upstream.Host)
+		require.Equal(t, "public.example.com", upstream.Header.Get("X-Forwarded-Host"))
+		require.Equal(t, "http", upstream.Header.Get("X-Forwarded-Proto"))
+		require.Equal(t, "192.168.1.10", upstream.Header.Get("X-Forwarded-For"))
+	})
+
+	t.Run("sends the target service host", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "https://public.example.com/api/foo", nil)
+
+		upstream := proxy(t, config.EnvironmentVariables{PreserveHost: false}, req)
+		require.Equal(t, serverURL.Host, upstream.Host)
+		require.Equal(t, "public.example.com", upstream.Header.Get("X-Forwarded-Host"))
+		require.Equal(t, "https", upstream.Header.Get("X-Forwarded-Proto"))
+	})
+
+	t.Run("sends the configured Host header", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "http://public.example.com/api/foo", nil)
+
+		upstream := proxy(t, config.EnvironmentVariables{PreserveHost: true, TargetServiceHostHeader: "internal.example.svc"}, req)
+		require.Equal(t, "internal.example.svc", upstream.Host)
+		require.Equal(t, "public.example.com", upstream.Header.Get("X-Forwarded-Host"))
+		require.Equal(t, "public.example.com", req.Host, "client request Host must not change")
+	})
+
+	t.Run("keeps the forwarding headers set by a previous proxy", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "http://internal.example.com/api/foo", nil)
+		req.RemoteAddr = "10.0.0.2:12345"
+		req.Header.Set("X-Forwarded-Host", "public.example.com")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+
+		upstream := proxy(t, config.EnvironmentVariables{PreserveHost: true}, req)
+		require.Equal(t, "public.example.com", upstream.Header.Get("X-Forwarded-Host"))
+		require.Equal(t, "https", upstream.Header.Get("X-Forwarded-Proto"))
+		require.Equal(t, "203.0.113.7, 10.0.0.2", upstream.Header.Get("X-Forwarded-For"))
+
+		upstream = proxy(t, config.EnvironmentVariables{PreserveHost: true, TrustedProxiesNetworks: trustedProxies}, req)
+		require.Equal(t, "public.example.com", upstream.Header.Get("X-Forwarded-Host"))
+		require.Equal(t, "203.0.113.7, 10.0.0.2", upstream.Header.Get("X-Forwarded-For"))
+	})
+
+	t.Run("replaces the forwarding headers set by untrusted clients", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "http://public.example.com/api/foo", nil)
+		req.RemoteAddr = "192.168.1.10:12345"
+		req.Header.Set("X-Forwarded-Host", "spoofed.example.com")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+
+		upstream := proxy(t, config.EnvironmentVariables{PreserveHost: true, TrustedProxiesNetworks: trustedProxies}, req)
+		require.Equal(t, "public.example.com", upstream.Header.Get("X-Forwarded-Host"))
+		require.Equal(t, "http", upstream.Header.Get("X-Forwarded-Proto"))
+		require.Equal(t, "192.168.1.10", upstream.Header.Get("X-Forwarded-For"))
+	})
+}
+
+func TestReverseProxyUserSignature(t *testing.T) {
+	var upstreamRequest *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server keeps using its request after the handler returns, so a clone is kept
+		upstreamRequest = r.Clone(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	proxy := func(t *testing.T, env config.EnvironmentVariables, req *http.Request) *http.Request {
+		t.Helper()
+		env.TargetServiceHost = serverURL.Host
+		env.UserIdHeader = "miauserid"
+		env.UserGroupsHeader = "miausergroups"
+		env.UserSignatureHeader = "x-rond-user-signature"
+		log, _ := test.NewNullLogger()
+		w := httptest.NewRecorder()
+
+		ReverseProxy(logrus.NewEntry(log), env, w, req, nil, nil)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		return upstreamRequest
+	}
+
+	resolveUser := func(t *testing.T, req *http.Request, userID, userGroups string) *http.Request {
+		t.Helper()
+		req = req.WithContext(mongoclient.WithUserCache(req.Context()))
+		resolvingRequest := req.Clone(req.Context())
+		resolvingRequest.Header.Set("miauserid", userID)
+		resolvingRequest.Header.Set("miausergroups", userGroups)
+		log, _ := test.NewNullLogger()
+		_, err := mongoclient.RetrieveUserBindingsAndRoles(logrus.NewEntry(log), resolvingRequest, config.EnvironmentVariables{UserIdHeader: "miauserid", UserGroupsHeader: "miausergroups"})
+		require.NoError(t, err)
+		return req
+	}
+
+	t.Run("signs the resolved user", func(t *testing.T) {
+		req := resolveUser(t, httptest.NewRequest(http.MethodGet, "/api/foo", nil), "user-1", "admin,users")
+		req.Header.Set("miauserid", "forged-user")
+		req.Header.Set("miausergroups", "forged-group")
+		req.Header.Set("x-rond-user-signature", "t=1,v1=abcd")
+
+		upstream := proxy(t, config.EnvironmentVariables{UserSignatureSecret: "new-key", UserSignatureSecondarySecret: "old-key"}, req)
+		require.Equal(t, "user-1", upstream.Header.Get("miauserid"))
+		require.Equal(t, "admin,users", upstream.Header.Get("miausergroups"))
+		require.NoError(t, usersignature.VerifyRequest(upstream, usersignature.VerifyOptions{Keys: []string{"new-key"}}))
+		require.NoError(t, usersignature.VerifyRequest(upstream, usersignature.VerifyOptions{Keys: []string{"old-key"}}))
+
+		upstream.Method = http.MethodDelete
+		require.ErrorIs(t, usersignature.VerifyRequest(upstream, usersignature.VerifyOptions{Keys: []string{"new-key"}}), usersignature.ErrInvalidSignature)
+	})
+
+	t.Run("removes the user headers without a resolved user", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/foo", nil)
+		req.Header.Set("miauserid", "forged-user")
+		req.Header.Set("miausergroups", "forged-group")
+
+		upstream := proxy(t, config.EnvironmentVariables{UserSignatureSecret: "new-key"}, req)
+		require.Empty(t, upstream.Header.Get("miauserid"))
+		require.Empty(t, upstream.Header.Get("miausergroups"))
+		require.NoError(t, usersignature.VerifyRequest(upstream, usersignature.VerifyOptions{Keys: []string{"new-key"}}))
+	})
+
+	t.Run("does not sign without a secret", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/foo", nil)
+		req.Header.Set("miauserid", "user-1")
+
+		upstream := proxy(t, config.EnvironmentVariables{}, req)
+		require.Empty(t, upstream.Header.Get("x-rond-user-signature"))
+	})
+}
+
+func TestReverseProxyPathRewrite(t *testing.T) {
+	var upstreamPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.EscapedPath()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	testCases := []struct {
+		name                 string
+		from                 string
+		to                   string
+		requestedPath        string
+		expectedUpstreamPath string
+	}{
+		{name: "replaces the prefix", from: "/api/v1", to: "/v1", requestedPath: "/api/v1/items", expectedUpstreamPath: "/v1/items"},
+		{name: "replaces the whole path", from: "/api/v1", to: "/v1", requestedPath: "/api/v1", expectedUpstreamPath: "/v1"},
+		{name: "removes the prefix", from: "/api/", to: "", requestedPath: "/api/items", expectedUpstreamPath: "/items"},
+		{name: "removes the whole path", from: "/api", to: "", requestedPath: "/api", expectedUpstreamPath: "/"},
+		{name: "adds a prefix", from: "/", to: "/internal", requestedPath: "/items", expectedUpstreamPath: "/internal/items"},
+		{name: "keeps encoded path", from: "/api/v1", to: "/v1", requestedPath: "/api/v1/a%2Fb", expectedUpstreamPath: "/v1/a%2Fb"},
+		{name: "does not rewrite paths only sharing the prefix", from: "/api/v1", to: "/v1", requestedPath: "/api/v10/items", expectedUpstreamPath: "/api/v10/items"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			env := config.EnvironmentVariables{
+				PathRewriteFrom:   testCase.from,
+				PathRewriteTo:     testCase.to,
+				TargetServiceHost: serverURL.Host,
+			}
+			log, _ := test.NewNullLogger()
+			req := httptest.NewRequest(http.MethodGet, testCase.requestedPath, nil)
+			w := httptest.NewRecorder()
+
+			ReverseProxy(logrus.NewEntry(log), env, w, req, nil, nil)
+
+			require.Equal(t, http.StatusOK, w.Result().StatusCode)
+			require.Equal(t, testCase.expectedUpstreamPath, upstreamPath)
+			require.Equal(t, testCase.requestedPath, req.URL.EscapedPath(), "client request path must not change")
+		})
+	}
+}
+
+func TestReverseProxyRequestTimeout(t *testing.T) {
+	upstreamCanceled := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			upstreamCanceled <- true
+		case <-time.After(200 * time.Millisecond):
+			upstreamCanceled <- false
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"report":"done"}`))
+		}
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	testCases := []struct {
+		name               string
+		defaultTimeoutMs   int
+		routeTimeoutMs     int
+		responsePolicy     string
+		expectedStatusCode int
+	}{
+		{name: "route timeout longer than the default one", defaultTimeoutMs: 50, routeTimeoutMs: 5000, expectedStatusCode: http.StatusOK},
+		{name: "route timeout shorter than the default one", defaultTimeoutMs: 5000, routeTimeoutMs: 50, expectedStatusCode: http.StatusGatewayTimeout},
+		{name: "default timeout without route timeout", defaultTimeoutMs: 50, expectedStatusCode: http.StatusGatewayTimeout},
+		{name: "no timeout", expectedStatusCode: http.StatusOK},
+		{name: "route timeout with response policy", routeTimeoutMs: 50, responsePolicy: "filter_response", expectedStatusCode: http.StatusGatewayTimeout},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			env := config.EnvironmentVariables{
+				TargetServiceHost:       serverURL.Host,
+				DefaultRequestTimeoutMs: testCase.defaultTimeoutMs,
+			}
+			permission := &openapi.RondConfig{
+				RequestFlow:  openapi.RequestFlow{PolicyName: "allow"},
+				ResponseFlow: openapi.ResponseFlow{PolicyName: testCase.responsePolicy},
+				Options:      openapi.PermissionOptions{RequestTimeoutMs: testCase.routeTimeoutMs},
+			}
+			log, _ := test.NewNullLogger()
+			req := httptest.NewRequest(http.MethodGet, "/reports", nil)
+			w := httptest.NewRecorder()
+
+			ReverseProxy(logrus.NewEntry(log), env, w, req, permission, nil)
+
+			require.Equal(t, testCase.expectedStatusCode, w.Result().StatusCode)
+			if testCase.expectedStatusCode == http.StatusGatewayTimeout {
+				require.Equal(t, "application/json", w.Result().Header.Get("Content-Type"))
+				var requestError types.RequestError
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &requestError))
+				require.Equal(t, http.StatusGatewayTimeout, requestError.StatusCode)
+				require.True(t, <-upstreamCanceled, "the target service request must be canceled")
+				return
+			}
+			require.False(t, <-upstreamCanceled)
+		})
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	envs := config.EnvironmentVariables{}
+	OPAModuleConfig := &core.OPAModuleConfig{
+		Name: "mypolicy.rego",
+		Content: `package policies
+api_version := "v3" {
+	contains(input.request.headersLower.accept, "application/vnd.example.v3+json")
+} else := "v2" {
+	contains(input.request.headersLower.accept, "application/vnd.example.v2+json")
+} else := "v1" {
+	contains(input.request.headersLower.accept, "application/vnd.example.v1+json")
+}
+allow_v1 { true }
+deny_v2 { false }
+allow_v3 { not input.request.headers["X-Secret"] }
+allow_default { true }`,
+	}
+	permission := &openapi.RondConfig{
+		RequestFlow:              openapi.RequestFlow{PolicyName: "allow_default"},
+		ContentNegotiationPolicy: "api_version",
+		Versions: map[string]*openapi.RondConfig{
+			"v1": {RequestFlow: openapi.RequestFlow{PolicyName: "allow_v1"}},
+			"v2": {RequestFlow: openapi.RequestFlow{PolicyName: "deny_v2"}},
+			"v3": {
+				RequestFlow: openapi.RequestFlow{PolicyName: "allow_v3"},
+				Options:     openapi.PermissionOptions{ExcludedInputHeaders: []string{"x-secret"}},
+			},
+		},
+	}
+	oas := openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/api": openapi.PathVerbs{
+				"get": openapi.VerbConfig{PermissionV2: permission},
+			},
+		},
+	}
+	partialEvaluators, _, err := core.SetupEvaluators(context.Background(), nil, &oas, OPAModuleConfig, envs)
+	require.NoError(t, err, "Unexpected error")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	envs.TargetServiceHost = serverURL.Host
+	ctx := createContext(t, context.Background(), envs, nil, permission, OPAModuleConfig, partialEvaluators)
+
+	testCases := []struct {
+		name           string
+		accept         string
+		expectedStatus int
+	}{
+		{name: "v1 policy allows the request", accept: "application/vnd.example.v1+json", expectedStatus: http.StatusOK},
+		{name: "v2 policy denies the request", accept: "application/vnd.example.v2+json", expectedStatus: http.StatusForbidden},
+		{name: "v3 excluded headers are removed from the policy input", accept: "application/vnd.example.v3+json", expectedStatus: http.StatusOK},
+		{name: "default policy is used for unknown versions", accept: "application/json", expectedStatus: http.StatusOK},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+			require.NoError(t, err, "Unexpected error")
+			r.Header.Set("Accept", testCase.accept)
+			r.Header.Set("X-Secret", "secret")
+			w := httptest.NewRecorder()
+
+			rbacHandler(w, r)
+
+			require.Equal(t, testCase.expectedStatus, w.Result().StatusCode, "Unexpected status code.")
+		})
+	}
+}
+
+func TestAuthenticationRequired(t *testing.T) {
+	oas := openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/api": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{
+						RequestFlow: openapi.RequestFlow{PolicyName: "todo"},
+					},
+				},
+			},
+		},
+	}
+	OPAModuleConfig := &core.OPAModuleConfig{Name: "mypolicy.rego", Content: `package policies
+todo { input.user.id == "" }
+todo { input.user.id == "user1" }`}
+
+	runRequest := func(t *testing.T, authenticationRequired bool, userID *string) (*httptest.ResponseRecorder, bool) {
+		t.Helper()
+		invoked := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+		serverURL, _ := url.Parse(server.URL)
+
+		env := config.EnvironmentVariables{
+			TargetServiceHost:      serverURL.Host,
+			UserIdHeader:           "miauserid",
+			AuthenticationRequired: authenticationRequired,
+		}
+		partialEvaluators, _, err := core.SetupEvaluators(context.Background(), nil, &oas, OPAModuleConfig, env)
+		require.NoError(t, err, "Unexpected error")
+
+		ctx := createContext(t, context.Background(), env, nil, &openapi.RondConfig{
+			RequestFlow: openapi.RequestFlow{PolicyName: "todo"},
+		}, OPAModuleConfig, partialEvaluators)
+
+		r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+		require.NoError(t, err, "Unexpected error")
+		if userID != nil {
+			r.Header.Set("miauserid", *userID)
+		}
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+		return w, invoked
+	}
+
+	requireUnauthorized := func(t *testing.T, w *httptest.ResponseRecorder, invoked bool) {
+		t.Helper()
+		require.False(t, invoked, "Handler was invoked.")
+		require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode, "Unexpected status code.")
+		require.Equal(t, `Bearer realm="rond"`, w.Result().Header.Get("WWW-Authenticate"))
+
+		var requestError types.RequestError
+		require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&requestError))
+		require.Equal(t, types.RequestError{
+			Error:      "missing user identity",
+			Message:    utils.AUTHENTICATION_REQUIRED_ERROR_MESSAGE,
+			StatusCode: http.StatusUnauthorized,
+		}, requestError)
+	}
+
+	t.Run("401 without identity header", func(t *testing.T) {
+		w, invoked := runRequest(t, true, nil)
+		requireUnauthorized(t, w, invoked)
+	})
+
+	t.Run("401 with blank identity header", func(t *testing.T) {
+		blank := "   "
+		w, invoked := runRequest(t, true, &blank)
+		requireUnauthorized(t, w, invoked)
+	})
+
+	t.Run("identified user reaches the policy evaluation", func(t *testing.T) {
+		userID := "user1"
+		w, invoked := runRequest(t, true, &userID)
+		require.True(t, invoked, "Handler was not invoked.")
+		require.Equal(t, http.StatusOK, w.Result().StatusCode, "Unexpected status code.")
+	})
+
+	t.Run("unauthenticated request reaches the policy evaluation with empty user id when not required", func(t *testing.T) {
+		w, invoked := runRequest(t, false, nil)
+		require.True(t, invoked, "Handler was not invoked.")
+		require.Equal(t, http.StatusOK, w.Result().StatusCode, "Unexpected status code.")
+		require.Empty(t, w.Result().Header.Get("WWW-Authenticate"))
+	})
+}
+
+func TestDenyReasons(t *testing.T) {
+	oas := openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/api": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{
+						RequestFlow: openapi.RequestFlow{PolicyName: "todo"},
+					},
+				},
+			},
+		},
+	}
+
+	runRequest := func(t *testing.T, env config.EnvironmentVariables, policy string) (*httptest.ResponseRecorder, *test.Hook) {
+		t.Helper()
+		OPAModuleConfig := &core.OPAModuleConfig{Name: "mypolicy.rego", Content: policy}
+		partialEvaluators, _, err := core.SetupEvaluators(context.Background(), nil, &oas, OPAModuleConfig, env)
+		require.NoError(t, err, "Unexpected error")
+
+		env.TargetServiceHost = "localhost:3000"
+		ctx := createContext(t, context.Background(), env, nil, &openapi.RondConfig{
+			RequestFlow: openapi.RequestFlow{PolicyName: "todo"},
+		}, OPAModuleConfig, partialEvaluators)
+
+		log, hook := test.NewNullLogger()
+		ctx = glogger.WithLogger(ctx, logrus.NewEntry(log))
+
+		r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+		require.NoError(t, err, "Unexpected error")
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+
+		require.Equal(t, http.StatusForbidden, w.Result().StatusCode, "Unexpected status code.")
+		return w, hook
+	}
+
+	policyWithReasons := `package policies
+todo { input.request.method == "POST" }
+todo_deny_reason["only POST requests are allowed"] { input.request.method != "POST" }`
+
+	t.Run("reasons are exposed to the client when enabled", func(t *testing.T) {
+		w, hook := runRequest(t, config.EnvironmentVariables{ExposeDenyReasons: true}, policyWithReasons)
+
+		var requestError types.RequestError
+		require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&requestError))
+		require.Equal(t, "RBAC policy evaluation failed: only POST requests are allowed", requestError.Error)
+		require.Equal(t, utils.NO_PERMISSIONS_ERROR_MESSAGE, requestError.Message)
+
+		actualLog := findLogWithMessage(hook.AllEntries(), "RBAC policy evaluation failed")
+		require.Len(t, actualLog, 1)
+		require.Equal(t, []string{"only POST requests are allowed"}, actualLog[0].Data["error"].(logrus.Fields)["denyReasons"])
+	})
+
+	t.Run("reasons are only logged when not exposed", func(t *testing.T) {
+		w, hook := runRequest(t, config.EnvironmentVariables{}, policyWithReasons)
+
+		var requestError types.RequestError
+		require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&requestError))
+		require.Equal(t, "RBAC policy evaluation failed", requestError.Error)
+
+		actualLog := findLogWithMessage(hook.AllEntries(), "RBAC policy evaluation failed")
+		require.Len(t, actualLog, 1)
+		require.Equal(t, []string{"only POST requests are allowed"}, actualLog[0].Data["error"].(logrus.Fields)["denyReasons"])
+	})
+
+	t.Run("policy without companion rule", func(t *testing.T) {
+		w, hook := runRequest(t, config.EnvironmentVariables{ExposeDenyReasons: true}, `package policies
+todo { input.request.method == "POST" }`)
+
+		var requestError types.RequestError
+		require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&requestError))
+		require.Equal(t, "RBAC policy evaluation failed", requestError.Error)
+
+		actualLog := findLogWithMessage(hook.AllEntries(), "RBAC policy evaluation failed")
+		require.Len(t, actualLog, 1)
+		require.Empty(t, actualLog[0].Data["error"].(logrus.Fields)["denyReasons"])
+	})
+}
+
 func TestStandaloneMode(t *testing.T) {
 	var envs = config.EnvironmentVariables{}
 
@@ -740,7 +1616,7 @@ func TestStandaloneMode(t *testing.T) {
 	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
 
 	t.Run("ok", func(t *testing.T) {
-		partialEvaluators, err := core.SetupEvaluators(ctx, nil, &oas, mockOPAModule, envs)
+		partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, &oas, mockOPAModule, envs)
 		require.NoError(t, err, "Unexpected error")
 		ctx := createContext(t,
 			context.Background(),
@@ -789,7 +1665,7 @@ allow {
 
 		body := strings.NewReader(mockBodySting)
 
-		partialEvaluators, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, mockOPAModule, envs)
+		partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, mockOPAModule, envs)
 		require.NoError(t, err, "Unexpected error")
 
 		ctx := createContext(t,
@@ -839,7 +1715,7 @@ allow {
 		mockBodySting := "I am a body"
 
 		body := strings.NewReader(mockBodySting)
-		partialEvaluators, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, mockOPAModule, envs)
+		partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, mockOPAModule, envs)
 		require.NoError(t, err, "Unexpected error")
 
 		ctx := createContext(t,
@@ -891,7 +1767,7 @@ allow {
 `
 
 		mockBodySting := "I am a body"
-		partialEvaluators, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, mockOPAModule, envs)
+		partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, &oasWithFilter, mockOPAModule, envs)
 		require.NoError(t, err, "Unexpected error")
 
 		body := strings.NewReader(mockBodySting)
@@ -991,7 +1867,7 @@ func TestPolicyEvaluationAndUserPolicyRequirements(t *testing.T) {
 					todo { count(input.request.headers["%s"]) != 0 }`, mockHeader),
 				}
 
-				partialEvaluators, err := core.SetupEvaluators(ctx, nil, oas, opaModule, envs)
+				partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, oas, opaModule, envs)
 				require.NoError(t, err, "Unexpected error")
 
 				ctx := createContext(t,
@@ -1035,7 +1911,7 @@ func TestPolicyEvaluationAndUserPolicyRequirements(t *testing.T) {
 					todo { get_header("x-backdoor", input.request.headers) == "mocked value" }`,
 				}
 
-				partialEvaluators, err := core.SetupEvaluators(ctx, nil, oas, opaModule, envs)
+				partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, oas, opaModule, envs)
 				require.NoError(t, err, "Unexpected error")
 
 				ctx := createContext(t,
@@ -1070,6 +1946,43 @@ func TestPolicyEvaluationAndUserPolicyRequirements(t *testing.T) {
 					require.Equal(t, http.StatusForbidden, w.Result().StatusCode, "Unexpected status code.")
 				})
 			})
+
+			t.Run("using headersLower agrees with get_header built-in function", func(t *testing.T) {
+				invoked = false
+				opaModule := &core.OPAModuleConfig{
+					Name: "example.rego",
+					Content: `package policies
+					todo {
+						input.request.headersLower["x-backdoor"] == "mocked value"
+						input.request.headersLower["x-backdoor"] == get_header("X-BACKDOOR", input.request.headers)
+						input.request.headersLowerJoined["accept"] == "text/html, application/json"
+					}`,
+				}
+
+				partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, oas, opaModule, envs)
+				require.NoError(t, err, "Unexpected error")
+
+				ctx := createContext(t,
+					context.Background(),
+					config.EnvironmentVariables{TargetServiceHost: serverURL.Host},
+					nil,
+					mockXPermission,
+					opaModule,
+					partialEvaluators,
+				)
+
+				w := httptest.NewRecorder()
+				r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+				require.NoError(t, err, "Unexpected error")
+
+				r.Header.Set(mockHeader, mockHeaderValue)
+				r.Header.Add("Accept", "text/html")
+				r.Header.Add("Accept", "application/json")
+
+				rbacHandler(w, r)
+				require.True(t, invoked, "Handler was not invoked.")
+				require.Equal(t, http.StatusOK, w.Result().StatusCode, "Unexpected status code.")
+			})
 		})
 
 		t.Run("policy on user infos works correctly", func(t *testing.T) {
@@ -1096,7 +2009,7 @@ func TestPolicyEvaluationAndUserPolicyRequirements(t *testing.T) {
 					input.clientType == "%s"
 				}`, mockedUserProperties["my"], mockedClientType),
 			}
-			partialEvaluators, err := core.SetupEvaluators(ctx, nil, oas, opaModule, envs)
+			partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, oas, opaModule, envs)
 			require.NoError(t, err, "Unexpected error")
 
 			ctx := createContext(t,
@@ -1180,7 +2093,7 @@ func TestPolicyEvaluationAndUserPolicyRequirements(t *testing.T) {
 				},
 			}
 
-			partialEvaluators, err := core.SetupEvaluators(ctx, nil, &oas, opaModule, envs)
+			partialEvaluators, _, err := core.SetupEvaluators(ctx, nil, &oas, opaModule, envs)
 			require.NoError(t, err, "Unexpected error")
 
 			ctx := createContext(t,
@@ -1270,7 +2183,7 @@ func TestPolicyEvaluationAndUserPolicyRequirements(t *testing.T) {
 
 			ctxForPartial := glogger.WithLogger(mongoclient.WithMongoClient(context.Background(), mongoclientMock), logrus.NewEntry(log))
 
-			mockPartialEvaluators, err := core.SetupEvaluators(ctxForPartial, mongoclientMock, oas, opaModule, envs)
+			mockPartialEvaluators, _, err := core.SetupEvaluators(ctxForPartial, mongoclientMock, oas, opaModule, envs)
 			require.NoError(t, err, "Unexpected error")
 
 			ctx := createContext(t,
@@ -1321,7 +2234,7 @@ func TestPolicyEvaluationAndUserPolicyRequirements(t *testing.T) {
 
 			ctxForPartial := glogger.WithLogger(mongoclient.WithMongoClient(context.Background(), mongoclientMock), logrus.NewEntry(log))
 
-			mockPartialEvaluators, err := core.SetupEvaluators(ctxForPartial, mongoclientMock, oas, opaModule, envs)
+			mockPartialEvaluators, _, err := core.SetupEvaluators(ctxForPartial, mongoclientMock, oas, opaModule, envs)
 			require.NoError(t, err, "Unexpected error")
 
 			ctx := createContext(t,
@@ -1411,7 +2324,7 @@ func TestPolicyEvaluationAndUserPolicyRequirements(t *testing.T) {
 
 			ctxForPartial := glogger.WithLogger(mongoclient.WithMongoClient(context.Background(), mongoclientMock), logrus.NewEntry(log))
 
-			mockPartialEvaluators, err := core.SetupEvaluators(ctxForPartial, mongoclientMock, oas, opaModule, envs)
+			mockPartialEvaluators, _, err := core.SetupEvaluators(ctxForPartial, mongoclientMock, oas, opaModule, envs)
 			require.NoError(t, err, "Unexpected error")
 
 			ctx := createContext(t,
@@ -1503,7 +2416,7 @@ func TestPolicyEvaluationAndUserPolicyRequirements(t *testing.T) {
 			mongoclientMock := &mocks.MongoClientMock{UserBindings: userBindings, UserRoles: userRoles}
 			ctxForPartial := glogger.WithLogger(mongoclient.WithMongoClient(context.Background(), mongoclientMock), logrus.NewEntry(log))
 
-			mockPartialEvaluators, err := core.SetupEvaluators(ctxForPartial, mongoclientMock, oas, opaModule, envs)
+			mockPartialEvaluators, _, err := core.SetupEvaluators(ctxForPartial, mongoclientMock, oas, opaModule, envs)
 			require.NoError(t, err, "Unexpected error")
 
 			serverURL, _ := url.Parse(server.URL)
@@ -1610,7 +2523,7 @@ func TestPolicyEvaluationAndUserPolicyRequirements(t *testing.T) {
 
 			ctxForPartial := glogger.WithLogger(mongoclient.WithMongoClient(context.Background(), mongoclientMock), logrus.NewEntry(log))
 
-			mockPartialEvaluators, err := core.SetupEvaluators(ctxForPartial, mongoclientMock, oas, opaModule, envs)
+			mockPartialEvaluators, _, err := core.SetupEvaluators(ctxForPartial, mongoclientMock, oas, opaModule, envs)
 			require.NoError(t, err, "Unexpected error")
 
 			serverURL, _ := url.Parse(server.URL)
@@ -1668,7 +2581,7 @@ func TestPolicyEvaluationAndUserPolicyRequirements(t *testing.T) {
 
 			ctxForPartial := glogger.WithLogger(mongoclient.WithMongoClient(context.Background(), mongoclientMock), logrus.NewEntry(log))
 
-			mockPartialEvaluators, err := core.SetupEvaluators(ctxForPartial, mongoclientMock, oas, opaModule, envs)
+			mockPartialEvaluators, _, err := core.SetupEvaluators(ctxForPartial, mongoclientMock, oas, opaModule, envs)
 			require.NoError(t, err, "Unexpected error")
 
 			ctx := createContext(t,
@@ -1732,7 +2645,7 @@ func TestPolicyEvaluationAndUserPolicyRequirements(t *testing.T) {
 
 			ctxForPartial := glogger.WithLogger(mongoclient.WithMongoClient(context.Background(), mongoclientMock), logrus.NewEntry(log))
 
-			mockPartialEvaluators, err := core.SetupEvaluators(ctxForPartial, mongoclientMock, oas, opaModule, envs)
+			mockPartialEvaluators, _, err := core.SetupEvaluators(ctxForPartial, mongoclientMock, oas, opaModule, envs)
 			require.NoError(t, err, "Unexpected error")
 
 			serverURL, _ := url.Parse(server.URL)
@@ -1823,7 +2736,7 @@ project.tenantId == "1234"
 
 		ctxForPartial := glogger.WithLogger(mongoclient.WithMongoClient(context.Background(), mongoMock), logrus.NewEntry(log))
 
-		mockPartialEvaluators, err := core.SetupEvaluators(ctxForPartial, mongoclientMock, oas, mockOPAModule, envs)
+		mockPartialEvaluators, _, err := core.SetupEvaluators(ctxForPartial, mongoclientMock, oas, mockOPAModule, envs)
 		require.NoError(t, err, "Unexpected error")
 
 		serverURL, _ := url.Parse(server.URL)
@@ -1869,7 +2782,7 @@ project.tenantId == "1234"
 
 		ctxForPartial := glogger.WithLogger(mongoclient.WithMongoClient(context.Background(), mongoMock), logrus.NewEntry(log))
 
-		mockPartialEvaluators, err := core.SetupEvaluators(ctxForPartial, mongoMock, oas, mockOPAModule, envs)
+		mockPartialEvaluators, _, err := core.SetupEvaluators(ctxForPartial, mongoMock, oas, mockOPAModule, envs)
 		require.NoError(t, err, "Unexpected error")
 
 		serverURL, _ := url.Parse(server.URL)
@@ -1915,7 +2828,7 @@ project.tenantId == "1234"
 
 		ctxForPartial := glogger.WithLogger(mongoclient.WithMongoClient(context.Background(), mongoMock), logrus.NewEntry(log))
 
-		mockPartialEvaluators, err := core.SetupEvaluators(ctxForPartial, mongoMock, oas, mockOPAModule, envs)
+		mockPartialEvaluators, _, err := core.SetupEvaluators(ctxForPartial, mongoMock, oas, mockOPAModule, envs)
 		require.NoError(t, err, "Unexpected error")
 
 		serverURL, _ := url.Parse(server.URL)
@@ -1941,7 +2854,7 @@ project.tenantId == "1234"
 }
 
 func BenchmarkEvaluateRequest(b *testing.B) {
-	moduleConfig, err := core.LoadRegoModule("../mocks/bench-policies")
+	moduleConfig, err := core.LoadRegoModule("../mocks/bench-policies", 0)
 	require.NoError(b, err, "Unexpected error")
 	permission := &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow_view_project"}}
 
@@ -1962,7 +2875,7 @@ func BenchmarkEvaluateRequest(b *testing.B) {
 	}
 
 	partialEvaluators := core.PartialResultsEvaluators{
-		permission.RequestFlow.PolicyName: core.PartialEvaluator{PartialEvaluator: &pr},
+		{PolicyName: permission.RequestFlow.PolicyName}: core.PartialEvaluator{PartialEvaluator: &pr},
 	}
 
 	envs := config.EnvironmentVariables{
@@ -2121,3 +3034,46 @@ func findLogWithMessage(logs []*logrus.Entry, message string) []*logrus.Entry {
 	}
 	return logToReturn
 }
+
+func TestReverseProxyCircuitBreaker(t *testing.T) {
+	upstreamCalls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	for _, responsePolicy := range []string{"", "filter_response"} {
+		t.Run(fmt.Sprintf("response policy %q", responsePolicy), func(t *testing.T) {
+			upstreamCalls = 0
+			env := config.EnvironmentVariables{TargetServiceHost: serverURL.Host}
+			permission := &openapi.RondConfig{
+				RequestFlow:  openapi.RequestFlow{PolicyName: "allow"},
+				ResponseFlow: openapi.ResponseFlow{PolicyName: responsePolicy},
+			}
+			log, _ := test.NewNullLogger()
+			logger := logrus.NewEntry(log)
+			breaker := core.NewCircuitBreaker(core.CircuitBreakerOptions{ConsecutiveFailures: 2, OpenDuration: time.Minute}, logger, nil)
+			ctx := core.WithCircuitBreaker(context.Background(), breaker)
+
+			for i := 0; i < 2; i++ {
+				w := httptest.NewRecorder()
+				ReverseProxy(logger, env, w, httptest.NewRequest(http.MethodGet, "/reports", nil).WithContext(ctx), permission, nil)
+				require.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+			}
+			require.Equal(t, core.CircuitBreakerOpen, breaker.State())
+
+			w := httptest.NewRecorder()
+			ReverseProxy(logger, env, w, httptest.NewRequest(http.MethodGet, "/reports", nil).WithContext(ctx), permission, nil)
+
+			require.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+			require.Equal(t, "60", w.Result().Header.Get("Retry-After"))
+			require.Equal(t, "application/json", w.Result().Header.Get("Content-Type"))
+			var requestError types.RequestError
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &requestError))
+			require.Equal(t, http.StatusServiceUnavailable, requestError.StatusCode)
+			require.Equal(t, 2, upstreamCalls, "the target service must not be called while the breaker is open")
+		})
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/rond-authz/rond/core"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/utils"
+
+	"github.com/gorilla/mux"
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const maxPolicyDiffBodyBytes = 10 << 20
+
+// PolicyDiffRequest is the body of the policy diff route. The recorded inputs are used
+// when no input is provided.
+type PolicyDiffRequest struct {
+	Module string               `json:"module"`
+	Inputs []core.RecordedInput `json:"inputs,omitempty"`
+}
+
+// isPolicyDiffAuthorized reports whether the request presents the policy diff secret as
+// bearer token.
+func isPolicyDiffAuthorized(req *http.Request, env config.EnvironmentVariables) bool {
+	secret := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return utils.SecretMatches(secret, env.PolicyDiffSecret)
+}
+
+// PolicyDiffRoute adds the route evaluating a candidate policies module against the live
+// one, to spot the decisions changed by a policies update before rolling it out. The
+// route is added only when POLICY_DIFF_SECRET is set.
+func PolicyDiffRoute(r *mux.Router, env config.EnvironmentVariables, opaModuleConfig *core.OPAModuleConfig, recorder *core.InputRecorder) {
+	if env.PolicyDiffSecret == "" || opaModuleConfig == nil {
+		return
+	}
+	r.HandleFunc(policyDiffRoutePath, func(w http.ResponseWriter, req *http.Request) {
+		logger := glogger.Get(req.Context())
+		if !isPolicyDiffAuthorized(req, env) {
+			utils.FailResponseWithCode(w, http.StatusUnauthorized, "invalid policy diff secret", utils.AUTHENTICATION_REQUIRED_ERROR_MESSAGE)
+			return
+		}
+
+		var diffRequest PolicyDiffRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxPolicyDiffBodyBytes)).Decode(&diffRequest); err != nil {
+			utils.FailResponseWithCode(w, http.StatusBadRequest, "invalid request body: "+err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		if diffRequest.Module == "" {
+			utils.FailResponseWithCode(w, http.StatusBadRequest, "missing candidate module", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		inputs := diffRequest.Inputs
+		if len(inputs) == 0 {
+			inputs = recorder.Inputs()
+		}
+
+		candidate := core.CandidatePolicyModule(opaModuleConfig, diffRequest.Module)
+		diff, err := core.DiffPolicies(req.Context(), opaModuleConfig, candidate, inputs, env)
+		if err != nil {
+			utils.FailResponseWithCode(w, http.StatusBadRequest, err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		logger.WithFields(logrus.Fields{
+			"candidateFingerprint": candidate.Fingerprint,
+			"evaluated":            diff.Evaluated,
+			"differences":          len(diff.Differences),
+		}).Info("policy diff computed")
+
+		body, err := json.Marshal(diff)
+		if err != nil {
+			utils.FailResponseWithCode(w, http.StatusInternalServerError, err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		w.Header().Add(utils.ContentTypeHeaderKey, utils.JSONContentTypeHeader)
+		if _, err := w.Write(body); err != nil {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response write")
+		}
+	}).Methods(http.MethodPost)
+}
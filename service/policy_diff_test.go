@@ -0,0 +1,116 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rond-authz/rond/core"
+	"github.com/rond-authz/rond/internal/config"
+
+	"github.com/gorilla/mux"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyDiffRoute(t *testing.T) {
+	opaModuleConfig := &core.OPAModuleConfig{
+		Name:    "policies.rego",
+		Content: "package policies\nallow { input.request.method == \"GET\" }",
+	}
+	env := config.EnvironmentVariables{PolicyDiffSecret: "diff-secret"}
+	candidateModule := "package policies\nallow { true }"
+
+	diffRequest := func(t *testing.T, router *mux.Router, secret string, body interface{}) *http.Response {
+		t.Helper()
+		bodyJSON, err := json.Marshal(body)
+		require.NoError(t, err)
+		request := httptest.NewRequest(http.MethodPost, "/-/policies/diff", strings.NewReader(string(bodyJSON)))
+		if secret != "" {
+			request.Header.Set("Authorization", "Bearer "+secret)
+		}
+		responseRecorder := httptest.NewRecorder()
+		router.ServeHTTP(responseRecorder, request)
+		return responseRecorder.Result()
+	}
+
+	t.Run("route not added without secret", func(t *testing.T) {
+		router := mux.NewRouter()
+		PolicyDiffRoute(router, config.EnvironmentVariables{}, opaModuleConfig, nil)
+
+		response := diffRequest(t, router, "diff-secret", PolicyDiffRequest{Module: candidateModule})
+		require.Equal(t, http.StatusNotFound, response.StatusCode)
+	})
+
+	t.Run("rejects invalid secret", func(t *testing.T) {
+		router := mux.NewRouter()
+		PolicyDiffRoute(router, env, opaModuleConfig, nil)
+
+		require.Equal(t, http.StatusUnauthorized, diffRequest(t, router, "", PolicyDiffRequest{Module: candidateModule}).StatusCode)
+		require.Equal(t, http.StatusUnauthorized, diffRequest(t, router, "wrong-secret", PolicyDiffRequest{Module: candidateModule}).StatusCode)
+	})
+
+	t.Run("compares the provided inputs", func(t *testing.T) {
+		router := mux.NewRouter()
+		PolicyDiffRoute(router, env, opaModuleConfig, nil)
+
+		response := diffRequest(t, router, "diff-secret", PolicyDiffRequest{
+			Module: candidateModule,
+			Inputs: []core.RecordedInput{
+				{Policy: "allow", Input: json.RawMessage(`{"request":{"method":"GET"}}`)},
+				{Policy: "allow", Input: json.RawMessage(`{"request":{"method":"POST"}}`)},
+			},
+		})
+		require.Equal(t, http.StatusOK, response.StatusCode)
+		body, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		var diff core.PolicyDiff
+		require.NoError(t, json.Unmarshal(body, &diff))
+		require.Equal(t, 2, diff.Evaluated)
+		require.Len(t, diff.Differences, 1)
+		require.False(t, diff.Differences[0].Live.Allowed)
+		require.True(t, diff.Differences[0].Candidate.Allowed)
+	})
+
+	t.Run("compares the recorded inputs", func(t *testing.T) {
+		recorder := core.NewInputRecorder(10, nil)
+		input, err := ast.ParseTerm(`{"request":{"method":"DELETE","body":{"some":"data"}}}`)
+		require.NoError(t, err)
+		require.NoError(t, recorder.Record("allow", input.Value))
+
+		router := mux.NewRouter()
+		PolicyDiffRoute(router, env, opaModuleConfig, recorder)
+
+		response := diffRequest(t, router, "diff-secret", PolicyDiffRequest{Module: candidateModule})
+		require.Equal(t, http.StatusOK, response.StatusCode)
+		var diff core.PolicyDiff
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&diff))
+		require.Equal(t, 1, diff.Evaluated)
+		require.Len(t, diff.Differences, 1)
+	})
+
+	t.Run("fails on invalid candidate module", func(t *testing.T) {
+		router := mux.NewRouter()
+		PolicyDiffRoute(router, env, opaModuleConfig, nil)
+
+		require.Equal(t, http.StatusBadRequest, diffRequest(t, router, "diff-secret", PolicyDiffRequest{Module: "package policies\nallow {"}).StatusCode)
+		require.Equal(t, http.StatusBadRequest, diffRequest(t, router, "diff-secret", PolicyDiffRequest{}).StatusCode)
+	})
+}
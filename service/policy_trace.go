@@ -0,0 +1,82 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rond-authz/rond/core"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/internal/utils"
+	"github.com/rond-authz/rond/openapi"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// isPolicyTraceRequested reports whether the request asks for the policy trace presenting
+// the configured secret. The trace header is always removed, so that the secret
+// is never proxied to the target service.
+func isPolicyTraceRequested(req *http.Request, env config.EnvironmentVariables) bool {
+	if env.PolicyTraceHeaderKey == "" || env.PolicyTraceSecret == "" {
+		return false
+	}
+	secret := req.Header.Get(env.PolicyTraceHeaderKey)
+	if secret == "" {
+		return false
+	}
+	req.Header.Del(env.PolicyTraceHeaderKey)
+	return utils.SecretMatches(secret, env.PolicyTraceSecret)
+}
+
+// tracePolicyHandler responds with the trace of the request flow policy evaluation,
+// together with its input document, instead of proxying the request.
+func tracePolicyHandler(w http.ResponseWriter, req *http.Request, env config.EnvironmentVariables, permission *openapi.RondConfig, partialResultsEvaluators core.PartialResultsEvaluators) {
+	logger := glogger.Get(req.Context())
+	logger.WithField("policyName", permission.RequestFlow.PolicyName).Info("policy trace requested")
+
+	userInfo, err := mongoclient.RetrieveUserBindingsAndRoles(logger, req, env)
+	if err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed user bindings and roles retrieving")
+		utils.FailResponseWithCode(w, http.StatusInternalServerError, "user bindings retrieval failed", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+
+	input, err := core.CreateParsedRegoQueryInput(req, env, partialResultsEvaluators.NeedsResourcePermissionsMap(core.RequestEvaluatorKey(req.Context(), permission.Options.PolicyModule, permission.RequestFlow.PolicyName), permission.Options, env), userInfo, nil)
+	if err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed rego query input creation")
+		utils.FailResponseWithCode(w, http.StatusInternalServerError, "RBAC input creation failed", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+
+	policyTrace, err := core.TracePolicyEvaluationWithParsedInput(req.Context(), permission.RequestFlow.PolicyName, permission.RequestFlow.GenerateQuery, input, env)
+	if err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed policy trace")
+		utils.FailResponseWithCode(w, http.StatusInternalServerError, "policy trace failed", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+
+	body, err := json.Marshal(policyTrace)
+	if err != nil {
+		utils.FailResponseWithCode(w, http.StatusInternalServerError, err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+	w.Header().Set(utils.ContentTypeHeaderKey, utils.JSONContentTypeHeader)
+	if _, err := w.Write(body); err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response write")
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/rond-authz/rond/core"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mocks"
+	"github.com/rond-authz/rond/openapi"
+	"github.com/rond-authz/rond/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyTrace(t *testing.T) {
+	opaModuleConfig := &core.OPAModuleConfig{
+		Name: "mypolicy.rego",
+		Content: `package policies
+allow { input.request.method == "GET" }`,
+	}
+	permission := &openapi.RondConfig{
+		RequestFlow: openapi.RequestFlow{PolicyName: "allow"},
+	}
+	oas := openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/api": openapi.PathVerbs{
+				"get": openapi.VerbConfig{PermissionV2: permission},
+			},
+		},
+	}
+	partialEvaluators, _, err := core.SetupEvaluators(context.Background(), nil, &oas, opaModuleConfig, config.EnvironmentVariables{})
+	require.NoError(t, err)
+
+	var proxiedHeaders http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedHeaders = r.Header.Clone()
+		w.Write([]byte("proxied"))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	runRequest := func(t *testing.T, env config.EnvironmentVariables, headers map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		proxiedHeaders = nil
+		env.TargetServiceHost = serverURL.Host
+		ctx := createContext(t, context.Background(), env, nil, permission, opaModuleConfig, partialEvaluators)
+
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+		require.NoError(t, err)
+		for key, value := range headers {
+			r.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		rbacHandler(w, r)
+		return w
+	}
+
+	traceEnv := config.EnvironmentVariables{
+		PolicyTraceHeaderKey: "x-rond-trace",
+		PolicyTraceSecret:    "the-secret",
+		PassThroughNonJSON:   true,
+	}
+
+	t.Run("returns the trace with header and secret", func(t *testing.T) {
+		w := runRequest(t, traceEnv, map[string]string{"x-rond-trace": "the-secret"})
+
+		require.Nil(t, proxiedHeaders, "request must not be proxied")
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Equal(t, "application/json", w.Result().Header.Get("Content-Type"))
+
+		var policyTrace core.PolicyTrace
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &policyTrace))
+		require.Equal(t, "allow", policyTrace.PolicyName)
+		require.True(t, policyTrace.Allowed)
+		require.NotEmpty(t, policyTrace.Trace)
+
+		var input core.Input
+		require.NoError(t, json.Unmarshal(policyTrace.Input, &input))
+		require.Equal(t, http.MethodGet, input.Request.Method)
+		require.NotContains(t, input.Request.Headers, "X-Rond-Trace", "the secret must not be part of the input")
+	})
+
+	t.Run("no trace is produced", func(t *testing.T) {
+		testCases := map[string]struct {
+			env     config.EnvironmentVariables
+			headers map[string]string
+		}{
+			"without header": {
+				env: traceEnv,
+			},
+			"with wrong secret": {
+				env:     traceEnv,
+				headers: map[string]string{"x-rond-trace": "wrong-secret"},
+			},
+			"with secret prefix": {
+				env:     traceEnv,
+				headers: map[string]string{"x-rond-trace": "the-secre"},
+			},
+			"when header is not configured": {
+				env:     config.EnvironmentVariables{PolicyTraceSecret: "the-secret", PassThroughNonJSON: true},
+				headers: map[string]string{"x-rond-trace": "the-secret"},
+			},
+			"when secret is not configured": {
+				env:     config.EnvironmentVariables{PolicyTraceHeaderKey: "x-rond-trace", PassThroughNonJSON: true},
+				headers: map[string]string{"x-rond-trace": ""},
+			},
+		}
+
+		for name, testCase := range testCases {
+			t.Run(name, func(t *testing.T) {
+				w := runRequest(t, testCase.env, testCase.headers)
+
+				require.Equal(t, http.StatusOK, w.Result().StatusCode)
+				require.Equal(t, "proxied", w.Body.String())
+				require.NotNil(t, proxiedHeaders)
+			})
+		}
+	})
+
+	t.Run("trace header is not proxied", func(t *testing.T) {
+		w := runRequest(t, traceEnv, map[string]string{"x-rond-trace": "wrong-secret"})
+
+		require.Equal(t, "proxied", w.Body.String())
+		require.Empty(t, proxiedHeaders.Get("x-rond-trace"))
+	})
+}
+
+func TestPolicyTraceResourcePermissionsMap(t *testing.T) {
+	opaModuleConfig := &core.OPAModuleConfig{
+		Name: "mypolicy.rego",
+		Content: `package policies
+reads_map { input.user.resourcePermissionsMap["read:project:p1"] }
+ignores_map { input.user.id == "user1" }`,
+	}
+	oas := openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/reads":   openapi.PathVerbs{"get": openapi.VerbConfig{PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "reads_map"}}}},
+			"/ignores": openapi.PathVerbs{"get": openapi.VerbConfig{PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "ignores_map"}}}},
+		},
+	}
+	env := config.EnvironmentVariables{
+		PolicyTraceHeaderKey:                     "x-rond-trace",
+		PolicyTraceSecret:                        "the-secret",
+		UserIdHeader:                             "miauserid",
+		EnableResourcePermissionsMapOptimization: true,
+	}
+	partialEvaluators, _, err := core.SetupEvaluators(context.Background(), nil, &oas, opaModuleConfig, env)
+	require.NoError(t, err)
+	mongoClient := &mocks.MongoClientMock{
+		UserRoles: []types.Role{{RoleID: "reader", Permissions: []string{"read"}}},
+		UserBindings: []types.Binding{
+			{BindingID: "b1", Roles: []string{"reader"}, Resource: &types.Resource{ResourceType: "project", ResourceID: "p1"}},
+		},
+	}
+
+	for policy, expectedMap := range map[string]core.PermissionsOnResourceMap{
+		"reads_map":   {"read:project:p1": true},
+		"ignores_map": nil,
+	} {
+		t.Run(policy, func(t *testing.T) {
+			permission := &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: policy}}
+			ctx := createContext(t, context.Background(), env, mongoClient, permission, opaModuleConfig, partialEvaluators)
+			r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+			require.NoError(t, err)
+			r.Header.Set("x-rond-trace", "the-secret")
+			r.Header.Set("miauserid", "user1")
+			w := httptest.NewRecorder()
+
+			rbacHandler(w, r)
+
+			require.Equal(t, http.StatusOK, w.Result().StatusCode)
+			var policyTrace core.PolicyTrace
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &policyTrace))
+			var input core.Input
+			require.NoError(t, json.Unmarshal(policyTrace.Input, &input))
+			require.Equal(t, expectedMap, input.User.ResourcePermissionsMap)
+		})
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/metrics"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/internal/utils"
+
+	"github.com/gorilla/mux"
+	"github.com/mia-platform/glogger/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// rateLimiterMaxKeys bounds the number of clients tracked by the rate limiter, the least
+// recently seen ones are forgotten first.
+const rateLimiterMaxKeys = 10000
+
+const (
+	rateLimitKeyTypeUser = "user"
+	rateLimitKeyTypeIP   = "ip"
+)
+
+type tokenBucket struct {
+	key      string
+	tokens   float64
+	lastSeen time.Time
+}
+
+// rateLimiter keeps a token bucket for each client. The buckets are held in a LRU list,
+// and the ones idle long enough to be full again are dropped, since they are equivalent
+// to new ones.
+type rateLimiter struct {
+	requestsPerSecond float64
+	burst             float64
+	maxKeys           int
+	now               func() time.Time
+
+	mtx     sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+func newRateLimiter(requestsPerSecond float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(requestsPerSecond)))
+	}
+	return &rateLimiter{
+		requestsPerSecond: requestsPerSecond,
+		burst:             float64(burst),
+		maxKeys:           rateLimiterMaxKeys,
+		now:               time.Now,
+		buckets:           make(map[string]*list.Element),
+		lru:               list.New(),
+	}
+}
+
+// allow takes a token from the bucket of the key. If the bucket is empty it returns
+// false, along with the time to wait for the next token.
+func (limiter *rateLimiter) allow(key string) (bool, time.Duration) {
+	limiter.mtx.Lock()
+	defer limiter.mtx.Unlock()
+
+	now := limiter.now()
+	limiter.expire(now)
+
+	var bucket *tokenBucket
+	if element, ok := limiter.buckets[key]; ok {
+		limiter.lru.MoveToFront(element)
+		bucket = element.Value.(*tokenBucket)
+		bucket.tokens = math.Min(limiter.burst, bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*limiter.requestsPerSecond)
+	} else {
+		if limiter.lru.Len() >= limiter.maxKeys {
+			limiter.remove(limiter.lru.Back())
+		}
+		bucket = &tokenBucket{key: key, tokens: limiter.burst}
+		limiter.buckets[key] = limiter.lru.PushFront(bucket)
+	}
+	bucket.lastSeen = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / limiter.requestsPerSecond * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// expire drops the least recently seen buckets which are full again.
+func (limiter *rateLimiter) expire(now time.Time) {
+	refillDuration := time.Duration(limiter.burst / limiter.requestsPerSecond * float64(time.Second))
+	for element := limiter.lru.Back(); element != nil; element = limiter.lru.Back() {
+		if now.Sub(element.Value.(*tokenBucket).lastSeen) < refillDuration {
+			return
+		}
+		limiter.remove(element)
+	}
+}
+
+func (limiter *rateLimiter) remove(element *list.Element) {
+	limiter.lru.Remove(element)
+	delete(limiter.buckets, element.Value.(*tokenBucket).key)
+}
+
+func (limiter *rateLimiter) len() int {
+	limiter.mtx.Lock()
+	defer limiter.mtx.Unlock()
+	return limiter.lru.Len()
+}
+
+// rateLimitKey returns the key identifying the client: the user id read from a verified
+// source, such as a JWT claim or an API key, or the client IP address for the other requests,
+// since the user id header is set by the client. The user id is resolved through the user
+// cache, so that it is not resolved again evaluating the policies.
+func rateLimitKey(r *http.Request, env config.EnvironmentVariables) (string, string) {
+	if mongoClient, err := mongoclient.GetMongoClientFromContext(r.Context()); err == nil {
+		userID, identitySource, err := mongoclient.ResolveUserID(r.Context(), r, env, mongoClient)
+		if err == nil && userID != "" && identitySource != config.UserIDSourceHeader {
+			return rateLimitKeyTypeUser, userID
+		}
+	}
+	return rateLimitKeyTypeIP, utils.ClientIP(r, env.TrustedProxiesNetworks)
+}
+
+// rateLimiterMiddleware rejects with 429 the requests of the clients exceeding the
+// configured REQUESTS_PER_SECOND, before their policies are evaluated.
+func rateLimiterMiddleware(env config.EnvironmentVariables, limiter *rateLimiter) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			keyType, key := rateLimitKey(r, env)
+			allowed, retryAfter := limiter.allow(keyType + ":" + key)
+			if allowed {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if m, err := metrics.GetFromContext(r.Context()); err == nil {
+				m.ThrottledRequests.With(prometheus.Labels{"key_type": keyType}).Inc()
+			}
+			glogger.Get(r.Context()).WithFields(logrus.Fields{
+				"keyType":             keyType,
+				"originalRequestPath": utils.SanitizeString(r.URL.Path),
+			}).Warn("request rate limit exceeded")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			utils.FailResponseWithCode(w, http.StatusTooManyRequests, "request rate limit exceeded", "Too many requests, please try again later")
+		})
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/rond-authz/rond/core"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/openapi"
+	"github.com/rond-authz/rond/types"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	newTestLimiter := func(requestsPerSecond float64, burst int) *rateLimiter {
+		limiter := newRateLimiter(requestsPerSecond, burst)
+		limiter.now = func() time.Time { return now }
+		return limiter
+	}
+
+	t.Run("allows burst and refills over time", func(t *testing.T) {
+		limiter := newTestLimiter(2, 3)
+		for i := 0; i < 3; i++ {
+			allowed, _ := limiter.allow("user:u1")
+			require.True(t, allowed)
+		}
+		allowed, retryAfter := limiter.allow("user:u1")
+		require.False(t, allowed)
+		require.Equal(t, 500*time.Millisecond, retryAfter)
+
+		allowed, _ = limiter.allow("user:u2")
+		require.True(t, allowed, "buckets are kept per key")
+
+		now = now.Add(500 * time.Millisecond)
+		allowed, _ = limiter.allow("user:u1")
+		require.True(t, allowed)
+		allowed, _ = limiter.allow("user:u1")
+		require.False(t, allowed)
+	})
+
+	t.Run("burst defaults to requests per second", func(t *testing.T) {
+		require.Equal(t, float64(3), newRateLimiter(2.5, 0).burst)
+		require.Equal(t, float64(1), newRateLimiter(0.5, 0).burst)
+	})
+
+	t.Run("drops buckets full again", func(t *testing.T) {
+		limiter := newTestLimiter(1, 2)
+		limiter.allow("user:u1")
+		limiter.allow("user:u2")
+		require.Equal(t, 2, limiter.len())
+
+		now = now.Add(2 * time.Second)
+		limiter.allow("user:u3")
+		require.Equal(t, 1, limiter.len())
+	})
+
+	t.Run("bounds the number of buckets", func(t *testing.T) {
+		limiter := newTestLimiter(1, 1)
+		limiter.maxKeys = 2
+		limiter.allow("user:u1")
+		limiter.allow("user:u2")
+		limiter.allow("user:u3")
+		require.Equal(t, 2, limiter.len())
+
+		allowed, _ := limiter.allow("user:u3")
+		require.False(t, allowed)
+		allowed, _ = limiter.allow("user:u1")
+		require.True(t, allowed, "least recently seen bucket is forgotten")
+	})
+}
+
+func TestSetupRouterRateLimiter(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+
+	opa := &core.OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow { true }
+`,
+	}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow"}},
+				},
+			},
+		},
+	}
+
+	var mongoClient *mongoclient.MongoClient
+	evaluatorsMap, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, config.EnvironmentVariables{})
+	require.NoError(t, err, "unexpected error")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	env := config.EnvironmentVariables{
+		TargetServiceHost:   serverURL.Host,
+		UserIdHeader:        "miauserid",
+		UserIDSources:       []config.UserIDSource{{Type: config.UserIDSourceJWTClaim}, {Type: config.UserIDSourceHeader}},
+		JWTVerifiedUpstream: true,
+		RequestsPerSecond:   0.5,
+		Burst:               2,
+		ExposeMetrics:       true,
+	}
+	router, err := SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+	require.NoError(t, err, "unexpected error")
+
+	// the user id is read from the sub claim of the token, verified upstream
+	serve := func(path, userID, remoteAddr string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if userID != "" {
+			claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"sub":%q}`, userID)))
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer eyJhbGciOiJIUzI1NiJ9.%s.signature", claims))
+		}
+		req.RemoteAddr = remoteAddr
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("responds 429 once the user exceeds the rate", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, serve("/users", "user1", "10.0.0.1:1234").Code)
+		require.Equal(t, http.StatusOK, serve("/users", "user1", "10.0.0.2:1234").Code)
+
+		w := serve("/users", "user1", "10.0.0.3:1234")
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+		require.Equal(t, "2", w.Header().Get("Retry-After"))
+		var requestError types.RequestError
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&requestError))
+		require.Equal(t, types.RequestError{
+			StatusCode: http.StatusTooManyRequests,
+			Error:      "request rate limit exceeded",
+			Message:    "Too many requests, please try again later",
+		}, requestError)
+
+		require.Equal(t, http.StatusOK, serve("/users", "user2", "10.0.0.1:1234").Code, "other users are not throttled")
+	})
+
+	t.Run("falls back to the client IP", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, serve("/users", "", "10.0.1.1:1234").Code)
+		require.Equal(t, http.StatusOK, serve("/users", "", "10.0.1.1:1234").Code)
+		require.Equal(t, http.StatusTooManyRequests, serve("/users", "", "10.0.1.1:1234").Code)
+		require.Equal(t, http.StatusOK, serve("/users", "", "10.0.1.2:1234").Code)
+	})
+
+	t.Run("keys the user id header on the client IP", func(t *testing.T) {
+		serveWithHeader := func(userID string) int {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/users", nil)
+			req.Header.Set("miauserid", userID)
+			req.RemoteAddr = "10.0.2.1:1234"
+			router.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		require.Equal(t, http.StatusOK, serveWithHeader("user1"))
+		require.Equal(t, http.StatusOK, serveWithHeader("user2"))
+		require.Equal(t, http.StatusTooManyRequests, serveWithHeader("user3"), "the header is set by the client")
+	})
+
+	t.Run("status and metrics routes are exempt", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			require.Equal(t, http.StatusOK, serve("/-/rbac-healthz", "user1", "10.0.0.1:1234").Code)
+		}
+
+		w := serve("/-/rond/metrics", "user1", "10.0.0.1:1234")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, w.Body.String(), fmt.Sprintf(`rond_throttled_requests_total{key_type="%s"} 1`, rateLimitKeyTypeUser))
+		require.Contains(t, w.Body.String(), fmt.Sprintf(`rond_throttled_requests_total{key_type="%s"} 2`, rateLimitKeyTypeIP))
+	})
+}
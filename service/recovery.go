@@ -0,0 +1,67 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/rond-authz/rond/internal/metrics"
+	"github.com/rond-authz/rond/internal/utils"
+
+	"github.com/gorilla/mux"
+	"github.com/mia-platform/glogger/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// recoveryMiddleware recovers the panics raised while serving the request, responding
+// with 500 instead of breaking the client connection. The stack trace is logged with
+// the request logger and the panic is counted by matched route. The request id, if any,
+// is set in the response with the configured header, so that clients can report it.
+func recoveryMiddleware(m metrics.Metrics, requestIDHeaderKey string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				}
+				// the reverse proxy aborts the response on purpose when the copy of the
+				// upstream body fails, the connection must be closed in that case.
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+
+				var matchedPath string
+				if route := mux.CurrentRoute(r); route != nil {
+					matchedPath, _ = route.GetPathTemplate()
+				}
+				m.Panics.With(prometheus.Labels{"http_route": matchedPath}).Inc()
+				glogger.Get(r.Context()).WithFields(logrus.Fields{
+					"error":       logrus.Fields{"message": fmt.Sprint(recovered)},
+					"stack":       string(debug.Stack()),
+					"matchedPath": matchedPath,
+				}).Error("panic while serving request")
+				if requestID := utils.GetRequestID(r.Context()); requestIDHeaderKey != "" && requestID != "" {
+					w.Header().Set(requestIDHeaderKey, requestID)
+				}
+				utils.FailResponseWithCode(w, http.StatusInternalServerError, "request handling panicked", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
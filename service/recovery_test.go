@@ -0,0 +1,95 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/metrics"
+	"github.com/rond-authz/rond/internal/utils"
+	"github.com/rond-authz/rond/types"
+
+	"github.com/gorilla/mux"
+	"github.com/mia-platform/glogger/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoveryMiddleware(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	m := metrics.SetupMetrics("test_rond")
+
+	router := mux.NewRouter()
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := glogger.WithLogger(r.Context(), logrus.NewEntry(log))
+			next.ServeHTTP(w, r.WithContext(utils.WithRequestID(ctx, "my-request-id")))
+		})
+	})
+	router.Use(recoveryMiddleware(m, "X-Request-Id"))
+	router.HandleFunc("/panic/{id}", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("panic") {
+		case "abort":
+			panic(http.ErrAbortHandler)
+		case "true":
+			panic("something went wrong")
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	t.Run("proxies requests without panics", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic/1", nil))
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Empty(t, w.Result().Header.Get("X-Request-Id"))
+		require.Equal(t, float64(0), testutil.ToFloat64(m.Panics.WithLabelValues("/panic/{id}")))
+	})
+
+	t.Run("responds 500 on panic", func(t *testing.T) {
+		hook.Reset()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic/1?panic=true", nil))
+
+		require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+		require.Equal(t, utils.JSONContentTypeHeader, w.Result().Header.Get(utils.ContentTypeHeaderKey))
+		require.Equal(t, "my-request-id", w.Result().Header.Get("X-Request-Id"))
+		var requestError types.RequestError
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &requestError))
+		require.Equal(t, types.RequestError{
+			StatusCode: http.StatusInternalServerError,
+			Error:      "request handling panicked",
+			Message:    "Internal server error, please try again later",
+		}, requestError)
+		require.Equal(t, float64(1), testutil.ToFloat64(m.Panics.WithLabelValues("/panic/{id}")))
+
+		entries := hook.AllEntries()
+		require.Len(t, entries, 1)
+		require.Equal(t, "panic while serving request", entries[0].Message)
+		require.Equal(t, "/panic/{id}", entries[0].Data["matchedPath"])
+		require.Contains(t, entries[0].Data["stack"], "runtime/debug.Stack")
+	})
+
+	t.Run("aborted handlers panic again", func(t *testing.T) {
+		require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/panic/1?panic=abort", nil))
+		})
+	})
+}
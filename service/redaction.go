@@ -0,0 +1,130 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const redactedValue = "[REDACTED]"
+
+// minRedactedLength is the length below which a secret fragment is not redacted, so
+// that short values as a cookie set to 1 do not hide unrelated parts of the logs.
+const minRedactedLength = 6
+
+// redactionSecretsKey is the context key of the secrets redacted from the log entries of
+// the request, see redactSensitiveHeadersMiddleware.
+type redactionSecretsKey struct{}
+
+// redactingFormatter replaces the secrets of the request in the formatted log entries,
+// whatever field or message they end up in. The secrets are read from the context of
+// the entry, so a single formatter is shared by all the requests.
+type redactingFormatter struct {
+	formatter logrus.Formatter
+}
+
+func (f redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	formatted, err := f.formatter.Format(entry)
+	if err != nil || entry.Context == nil {
+		return formatted, err
+	}
+	secrets, _ := entry.Context.Value(redactionSecretsKey{}).([][]byte)
+	for _, secret := range secrets {
+		if bytes.Contains(formatted, secret) {
+			formatted = bytes.ReplaceAll(formatted, secret, []byte(redactedValue))
+		}
+	}
+	return formatted, nil
+}
+
+// useRedactingFormatter wraps the formatter of the logger with the one redacting the
+// secrets of the requests.
+func useRedactingFormatter(log *logrus.Logger) {
+	if _, ok := log.Formatter.(redactingFormatter); !ok {
+		log.SetFormatter(redactingFormatter{formatter: log.Formatter})
+	}
+}
+
+// redactSensitiveHeadersMiddleware binds the values of the sensitive headers to the request
+// logger, so that they are redacted from every log entry of the request by the formatter
+// set with useRedactingFormatter. The request is not modified, so the values are still
+// proxied and provided to the policies.
+func redactSensitiveHeadersMiddleware(sensitiveHeaders []string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			secrets := sensitiveHeaderSecrets(r.Header, sensitiveHeaders)
+			if len(secrets) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx := context.WithValue(r.Context(), redactionSecretsKey{}, redactionSecrets(secrets))
+			logger := glogger.Get(ctx).WithContext(ctx)
+			next.ServeHTTP(w, r.WithContext(glogger.WithLogger(ctx, logger)))
+		})
+	}
+}
+
+// sensitiveHeaderSecrets returns the values of the sensitive headers, together with the
+// credentials of the authorization schemes and the values of the cookies, which can be
+// logged on their own.
+func sensitiveHeaderSecrets(headers http.Header, sensitiveHeaders []string) []string {
+	var secrets []string
+	addSecret := func(secret string) {
+		if secret = strings.TrimSpace(secret); len(secret) >= minRedactedLength {
+			secrets = append(secrets, secret)
+		}
+	}
+	for _, headerName := range sensitiveHeaders {
+		for _, value := range headers.Values(headerName) {
+			addSecret(value)
+			if _, credentials, found := strings.Cut(value, " "); found {
+				addSecret(credentials)
+			}
+			for _, cookie := range strings.Split(value, ";") {
+				if _, cookieValue, found := strings.Cut(cookie, "="); found {
+					addSecret(strings.Trim(cookieValue, `"`))
+				}
+			}
+		}
+	}
+	return secrets
+}
+
+// redactionSecrets returns the secrets to redact, together with their JSON escaped form.
+// The longest secrets come first, so that a secret containing another one is redacted whole.
+func redactionSecrets(secrets []string) [][]byte {
+	redacted := make([][]byte, 0, len(secrets)*2)
+	for _, secret := range secrets {
+		redacted = append(redacted, []byte(secret))
+		if escaped, err := json.Marshal(secret); err == nil {
+			if escapedSecret := escaped[1 : len(escaped)-1]; string(escapedSecret) != secret {
+				redacted = append(redacted, escapedSecret)
+			}
+		}
+	}
+	sort.SliceStable(redacted, func(i, j int) bool {
+		return len(redacted[i]) > len(redacted[j])
+	})
+	return redacted
+}
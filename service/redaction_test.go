@@ -0,0 +1,173 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/rond-authz/rond/core"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/openapi"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactSensitiveHeadersMiddleware(t *testing.T) {
+	setup := func(t *testing.T) (http.Handler, *bytes.Buffer) {
+		t.Helper()
+		output := &bytes.Buffer{}
+		log := logrus.New()
+		log.SetOutput(output)
+		log.SetFormatter(&logrus.JSONFormatter{})
+		useRedactingFormatter(log)
+
+		handler := redactSensitiveHeadersMiddleware([]string{"authorization", "cookie"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if authorization := r.Header.Get("Authorization"); authorization != "" {
+				require.Equal(t, "Bearer super-secret-token", authorization, "the request must not be modified")
+			}
+			logger := glogger.Get(r.Context())
+			require.Same(t, log, logger.Logger, "the requests share the base logger")
+			logger.WithField("headers", r.Header).Info("request headers")
+			logger.Infof("token %s and session %s", "super-secret-token", "session-value")
+			w.WriteHeader(http.StatusOK)
+		}))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler.ServeHTTP(w, r.WithContext(glogger.WithLogger(r.Context(), logrus.NewEntry(log).WithField("reqId", "request-id"))))
+		}), output
+	}
+
+	t.Run("redacts the sensitive headers from every log entry", func(t *testing.T) {
+		handler, output := setup(t)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer super-secret-token")
+		req.Header.Set("Cookie", `session="session-value"; theme=dark`)
+		req.Header.Set("X-Other", "visible-value")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.NotContains(t, output.String(), "super-secret-token")
+		require.NotContains(t, output.String(), "session-value")
+		require.Contains(t, output.String(), "[REDACTED]")
+		require.Contains(t, output.String(), "visible-value")
+		require.Contains(t, output.String(), `"reqId":"request-id"`, "the request logger fields are kept")
+	})
+
+	t.Run("redacts the whole value of the header before its credentials", func(t *testing.T) {
+		handler, output := setup(t)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer super-secret-token")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		require.Contains(t, output.String(), `"Authorization":["[REDACTED]"]`)
+		require.NotContains(t, output.String(), "Bearer")
+	})
+
+	t.Run("logs are unchanged without sensitive headers", func(t *testing.T) {
+		handler, output := setup(t)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Other", "visible-value")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		require.Contains(t, output.String(), "super-secret-token")
+		require.NotContains(t, output.String(), "[REDACTED]")
+	})
+}
+
+func TestSetupRouterRedactsSensitiveHeaders(t *testing.T) {
+	opa := &core.OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow {
+	print("request headers", input.request.headers)
+	input.request.headers.Authorization[0] == "Bearer super-secret-token"
+}
+allow_without_cookie {
+	not input.request.headers.Cookie
+}
+`,
+	}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow"}},
+				},
+			},
+			"/projects": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{
+						RequestFlow: openapi.RequestFlow{PolicyName: "allow_without_cookie"},
+						Options:     openapi.PermissionOptions{ExcludedInputHeaders: []string{"cookie"}},
+					},
+				},
+			},
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	output := &bytes.Buffer{}
+	log := logrus.New()
+	log.SetOutput(output)
+	log.SetLevel(logrus.DebugLevel)
+	env := config.EnvironmentVariables{
+		TargetServiceHost:    serverURL.Host,
+		LogLevel:             "debug",
+		OPALogLevel:          config.OPALogLevelDebug,
+		PassThroughNonJSON:   true,
+		SensitiveHeadersList: []string{"authorization", "cookie"},
+	}
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+	var mongoClient *mongoclient.MongoClient
+	evaluatorsMap, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, env)
+	require.NoError(t, err, "unexpected error")
+	router, err := SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+	require.NoError(t, err, "unexpected error")
+
+	t.Run("policies read the real values while logs are redacted", func(t *testing.T) {
+		output.Reset()
+		req := httptest.NewRequest(http.MethodGet, "/users", nil)
+		req.Header.Set("Authorization", "Bearer super-secret-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Contains(t, output.String(), "request headers")
+		require.NotContains(t, output.String(), "super-secret-token")
+		require.Contains(t, output.String(), "[REDACTED]")
+	})
+
+	t.Run("excluded headers are removed from the input", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/projects", nil)
+		req.Header.Set("Cookie", "session=session-value")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net/http"
+
+	"github.com/rond-authz/rond/internal/utils"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// gloggerRequestIDHeaderKey is the header read by the glogger middleware to set the reqId log field.
+const gloggerRequestIDHeaderKey = "X-Request-Id"
+
+// requestIDLoggerMiddleware reads the request id from the configured header, generating a new
+// one if missing, and saves it into the request context and headers, so that it is proxied to
+// the target service. The request logger is set up with the same id, so that every log entry
+// of the request can be correlated to it. If no header is configured, the id is only generated.
+func requestIDLoggerMiddleware(log *logrus.Logger, excludedPrefixes []string, headerKey string) mux.MiddlewareFunc {
+	loggerMiddleware := glogger.RequestMiddlewareLogger(log, excludedPrefixes)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var requestID string
+			if headerKey != "" {
+				requestID = r.Header.Get(headerKey)
+			}
+			if requestID == "" {
+				requestID = uuid.NewString()
+			}
+			if headerKey != "" {
+				r.Header.Set(headerKey, requestID)
+			}
+			r = r.WithContext(utils.WithRequestID(r.Context(), requestID))
+
+			// the logger middleware only reads its own header: it receives a copy of the request,
+			// so that the header is not proxied when a different one is configured.
+			loggerRequest := r.WithContext(r.Context())
+			loggerRequest.Header = r.Header.Clone()
+			loggerRequest.Header.Set(gloggerRequestIDHeaderKey, requestID)
+
+			loggerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, loggerRequest *http.Request) {
+				next.ServeHTTP(w, r.WithContext(loggerRequest.Context()))
+			})).ServeHTTP(w, loggerRequest)
+		})
+	}
+}
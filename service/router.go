@@ -19,8 +19,8 @@ import (
 	"fmt"
 	"net/http"
 	"path"
-	"sort"
 	"strings"
+	"time"
 
 	swagger "github.com/davidebianchi/gswagger"
 	"github.com/davidebianchi/gswagger/support/gorilla"
@@ -36,10 +36,11 @@ import (
 	"github.com/rond-authz/rond/types"
 
 	"github.com/gorilla/mux"
-	"github.com/mia-platform/glogger/v2"
 	"github.com/sirupsen/logrus"
 )
 
+const serviceName = "rönd"
+
 var routesToNotProxy = utils.Union(statusRoutes, []string{metrics.MetricsRoutePath})
 
 var revokeDefinitions = swagger.Definitions{
@@ -104,21 +105,84 @@ func SetupRouter(
 	policiesEvaluators core.PartialResultsEvaluators,
 	mongoClient *mongoclient.MongoClient,
 ) (*mux.Router, error) {
+	return SetupRouterWithOASStore(log, env, opaModuleConfig, core.NewOASStore(oas, policiesEvaluators), mongoClient)
+}
+
+// SetupRouterWithOASStore sets up the router evaluating the requests against the OAS and
+// evaluators held by the store, so that they can be refreshed while serving requests.
+func SetupRouterWithOASStore(
+	log *logrus.Logger,
+	env config.EnvironmentVariables,
+	opaModuleConfig *core.OPAModuleConfig,
+	oasStore *core.OASStore,
+	mongoClient *mongoclient.MongoClient,
+) (*mux.Router, error) {
+	errorRenderer, err := utils.NewErrorRenderer(env.ErrorResponseFormat)
+	if err != nil {
+		return nil, err
+	}
+	utils.SetErrorRenderer(errorRenderer)
+
 	router := mux.NewRouter().UseEncodedPath()
-	router.Use(glogger.RequestMiddlewareLogger(log, []string{"/-/"}))
-	serviceName := "rönd"
-	StatusRoutes(router, serviceName, env.ServiceVersion)
+	if env.StrictRouting {
+		router.NotFoundHandler = http.HandlerFunc(strictRoutingNotFoundHandler)
+	}
+	router.Use(requestIDLoggerMiddleware(log, []string{"/-/"}, env.RequestIDHeaderKey))
+	router.Use(mongoclient.UserCacheMiddleware)
+	if len(env.SensitiveHeadersList) > 0 {
+		useRedactingFormatter(log)
+		router.Use(redactSensitiveHeadersMiddleware(env.SensitiveHeadersList))
+	}
+	if env.AccessLogFormat != "" && env.AccessLogFormat != config.AccessLogFormatOff {
+		router.Use(accessLogMiddleware(env))
+	}
+	StatusRoutes(router, serviceName, env.ServiceVersion, ReadinessChecks(env, mongoClient, oasStore))
+	RegoFingerprintRoute(router, opaModuleConfig)
+	VersionRoute(router, env.ServiceVersion, opaModuleConfig)
+	MongoPoolRoute(router, mongoClient)
+	WarmupRoute(router, oasStore)
+	inputRecorder := core.NewInputRecorder(env.PolicyDiffRecordedInputs, env.SensitiveHeadersList)
+	PolicyDiffRoute(router, env, opaModuleConfig, inputRecorder)
 
 	registry := prometheus.NewRegistry()
 	m := metrics.SetupMetrics("rond")
+	if opaModuleConfig != nil {
+		m.PolicyModuleInfo.With(prometheus.Labels{"fingerprint": opaModuleConfig.Fingerprint}).Set(1)
+	}
 	if env.ExposeMetrics {
 		m.MustRegister(registry)
 		metrics.MetricsRoute(router, registry)
 	}
 	router.Use(metrics.RequestMiddleware(m))
+	router.Use(recoveryMiddleware(m, env.RequestIDHeaderKey))
 
 	router.Use(config.RequestMiddlewareEnvironments(env))
 
+	if env.CircuitBreakerEnabled() && !env.Standalone {
+		breaker := core.NewCircuitBreaker(core.CircuitBreakerOptions{
+			ConsecutiveFailures: env.CircuitBreakerConsecutiveFailures,
+			FailureRatio:        env.CircuitBreakerFailureRatio,
+			WindowSize:          env.CircuitBreakerWindowSize,
+			OpenDuration:        time.Duration(env.CircuitBreakerOpenDurationMs) * time.Millisecond,
+		}, logrus.NewEntry(log), m.CircuitBreakerState)
+		router.Use(core.CircuitBreakerInjectorMiddleware(breaker))
+	}
+
+	if mongoClient != nil {
+		var requestsMongoClient types.IMongoClient = mongoClient
+		if env.MongoRetryOnNetworkError {
+			requestsMongoClient = mongoclient.NewRetryingMongoClient(mongoClient, func() error {
+				return mongoClient.RenewConnection(log)
+			}, log)
+		}
+		router.Use(mongoclient.MongoClientInjectorMiddleware(requestsMongoClient))
+	}
+
+	if len(env.AllowedPathPatterns) > 0 {
+		log.WithField("allowedPaths", env.AllowedPathPatterns).Info("paths proxied without policy evaluation")
+		setupAllowedPathsRoutes(router, env)
+	}
+
 	evalRouter := router.NewRoute().Subrouter()
 	if env.Standalone {
 		router.Use(helpers.AddHeadersToProxyMiddleware(log, env.GetAdditionalHeadersToProxy()))
@@ -138,17 +202,22 @@ func SetupRouter(
 			return nil, err
 		}
 
-		// standalone routes
-		if _, err := swaggerRouter.AddRoute(http.MethodPost, "/revoke/bindings/resource/{resourceType}", revokeHandler, revokeDefinitions); err != nil {
+		// standalone routes, rejecting all the requests without their policy
+		for key, policy := range map[string]string{config.GrantPolicyEnvKey: env.GrantPolicy, config.RevokePolicyEnvKey: env.RevokePolicy} {
+			if policy == "" {
+				log.WithField("variable", key).Warn("standalone bindings API disabled: no policy configured")
+			}
+		}
+		if _, err := swaggerRouter.AddRoute(http.MethodPost, "/revoke/bindings/resource/{resourceType}", withStandalonePolicy(opaModuleConfig, env.RevokePolicy, revokeHandler), revokeDefinitions); err != nil {
 			return nil, err
 		}
-		if _, err := swaggerRouter.AddRoute(http.MethodPost, "/grant/bindings/resource/{resourceType}", grantHandler, grantDefinitions); err != nil {
+		if _, err := swaggerRouter.AddRoute(http.MethodPost, "/grant/bindings/resource/{resourceType}", withStandalonePolicy(opaModuleConfig, env.GrantPolicy, grantHandler), grantDefinitions); err != nil {
 			return nil, err
 		}
-		if _, err := swaggerRouter.AddRoute(http.MethodPost, "/revoke/bindings", revokeHandler, revokeDefinitions); err != nil {
+		if _, err := swaggerRouter.AddRoute(http.MethodPost, "/revoke/bindings", withStandalonePolicy(opaModuleConfig, env.RevokePolicy, revokeHandler), revokeDefinitions); err != nil {
 			return nil, err
 		}
-		if _, err := swaggerRouter.AddRoute(http.MethodPost, "/grant/bindings", grantHandler, grantDefinitions); err != nil {
+		if _, err := swaggerRouter.AddRoute(http.MethodPost, "/grant/bindings", withStandalonePolicy(opaModuleConfig, env.GrantPolicy, grantHandler), grantDefinitions); err != nil {
 			return nil, err
 		}
 
@@ -157,13 +226,29 @@ func SetupRouter(
 		}
 	}
 
-	evalRouter.Use(core.OPAMiddleware(opaModuleConfig, oas, &env, policiesEvaluators, routesToNotProxy))
+	if env.CaseInsensitiveRouting {
+		evalRouter.Use(restoreOriginalRequestPathMiddleware)
+	}
 
-	if mongoClient != nil {
-		evalRouter.Use(mongoclient.MongoClientInjectorMiddleware(mongoClient))
+	if env.RequestsPerSecond > 0 {
+		evalRouter.Use(rateLimiterMiddleware(env, newRateLimiter(env.RequestsPerSecond, env.Burst)))
+	}
+
+	evalRouter.Use(core.OPAMiddlewareWithOASStore(opaModuleConfig, oasStore, &env, routesToNotProxy))
+
+	if inputRecorder != nil {
+		evalRouter.Use(core.InputRecorderInjectorMiddleware(inputRecorder))
+	}
+
+	if env.EvaluatorCacheMaxSize > 0 {
+		evalRouter.Use(core.QueryEvaluatorCacheInjectorMiddleware(core.NewQueryEvaluatorCache(env.EvaluatorCacheMaxSize)))
+	}
+	if env.ResponseBodyCacheSize > 0 {
+		evalRouter.Use(core.ResponseBodyCacheInjectorMiddleware(core.NewResponseBodyCache(env.ResponseBodyCacheSize)))
 	}
 
-	setupRoutes(evalRouter, oas, env)
+	setupRoutes(evalRouter, oasStore, env)
+	oasStore.OAS().LogPathConflicts(log)
 
 	//#nosec G104 -- Produces a false positive
 	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
@@ -175,7 +260,8 @@ func SetupRouter(
 	return router, nil
 }
 
-func setupRoutes(router *mux.Router, oas *openapi.OpenAPISpec, env config.EnvironmentVariables) {
+func setupRoutes(router *mux.Router, oasStore *core.OASStore, env config.EnvironmentVariables) {
+	oas := oasStore.OAS()
 	var documentationPermission string
 	documentationPathInOAS := oas.Paths[env.TargetServiceOASPath]
 	if documentationPathInOAS != nil {
@@ -184,13 +270,8 @@ func setupRoutes(router *mux.Router, oas *openapi.OpenAPISpec, env config.Enviro
 		}
 	}
 
-	// NOTE: The following sort is required by mux router because it expects
-	// routes to be registered in the proper order
-	paths := make([]string, 0)
 	methods := make(map[string][]string, 0)
-
 	for path, pathMethods := range oas.Paths {
-		paths = append(paths, path)
 		for method := range pathMethods {
 			if method == openapi.AllHTTPMethod {
 				methods[path] = openapi.OasSupportedHTTPMethods
@@ -202,10 +283,16 @@ func setupRoutes(router *mux.Router, oas *openapi.OpenAPISpec, env config.Enviro
 
 			methods[path] = append(methods[path], strings.ToUpper(method))
 		}
+		// HEAD requests are served with the GET permission, unless explicitly defined
+		if utils.Contains(methods[path], http.MethodGet) && !utils.Contains(methods[path], http.MethodHead) {
+			methods[path] = append(methods[path], http.MethodHead)
+		}
 	}
-	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
-
-	for _, path := range paths {
+	// NOTE: mux router expects the routes to be registered in the proper order
+	for _, path := range oas.RoutePaths() {
+		if oas.IsPathPattern(path) {
+			continue
+		}
 		pathToRegister := path
 		if env.Standalone {
 			pathToRegister = fmt.Sprintf("%s%s", env.PathPrefixStandalone, path)
@@ -231,9 +318,25 @@ func setupRoutes(router *mux.Router, oas *openapi.OpenAPISpec, env config.Enviro
 	//        Maybe the code above can be cleaned.
 	// NOTE: this fallback route should be removed in v2, check out
 	// 			 issue [14](https://github.com/rond-authz/rond/issues/14) for further details.
+	//       With STRICT_ROUTING it only matches the paths defined in the OAS.
 	fallbackRoute := "/"
 	if env.Standalone {
 		fallbackRoute = fmt.Sprintf("%s/", path.Join(env.PathPrefixStandalone, fallbackRoute))
 	}
-	router.PathPrefix(fallbackRoute).HandlerFunc(rbacHandler)
+	// the prefix and regex paths are registered after the exact ones, in precedence order
+	for _, pattern := range oas.PathPatterns() {
+		prefix := fallbackRoute
+		if pattern.MatchType == openapi.PathMatchTypePrefix {
+			prefix = strings.TrimSuffix(pattern.Path, "/")
+			if env.Standalone {
+				prefix = fmt.Sprintf("%s%s", env.PathPrefixStandalone, prefix)
+			}
+		}
+		router.PathPrefix(openapi.ConvertPathVariablesToBrackets(prefix)).MatcherFunc(pathPatternMatcher(pattern, env)).HandlerFunc(rbacHandler).Methods(methods[pattern.Path]...)
+	}
+	route := router.PathPrefix(fallbackRoute)
+	if env.StrictRouting {
+		route = route.MatcherFunc(knownPathMatcher(oasStore, env))
+	}
+	route.HandlerFunc(rbacHandler)
 }
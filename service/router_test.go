@@ -27,6 +27,7 @@ import (
 	"github.com/rond-authz/rond/internal/config"
 	"github.com/rond-authz/rond/internal/metrics"
 	"github.com/rond-authz/rond/internal/mocks"
+	"github.com/rond-authz/rond/internal/mongoclient"
 	"github.com/rond-authz/rond/openapi"
 	"github.com/rond-authz/rond/types"
 	"github.com/sirupsen/logrus"
@@ -59,7 +60,7 @@ func TestSetupRoutes(t *testing.T) {
 		}
 		expectedPaths := []string{"/", "/-/check-up", "/-/healthz", "/-/metrics", "/-/ready", "/bar", "/documentation/json", "/foo", "/foo/bar"}
 
-		setupRoutes(router, oas, envs)
+		setupRoutes(router, core.NewOASStore(oas, nil), envs)
 
 		foundPaths := make([]string, 0)
 		router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
@@ -93,7 +94,7 @@ func TestSetupRoutes(t *testing.T) {
 		expectedPaths := []string{"/", "/-/ready", "/-/healthz", "/-/check-up", "/foo/", "/foo/bar/", "/foo/bar/nested", "/foo/bar/{barId}", "/documentation/json"}
 		sort.Strings(expectedPaths)
 
-		setupRoutes(router, oas, envs)
+		setupRoutes(router, core.NewOASStore(oas, nil), envs)
 
 		foundPaths := make([]string, 0)
 		router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
@@ -110,6 +111,121 @@ func TestSetupRoutes(t *testing.T) {
 		require.Equal(t, expectedPaths, foundPaths)
 	})
 
+	t.Run("registers the routes with higher priority first", func(t *testing.T) {
+		withPriority := func(policy string, priority int) openapi.PathVerbs {
+			return openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{
+						RequestFlow: openapi.RequestFlow{PolicyName: policy},
+						Priority:    priority,
+					},
+				},
+			}
+		}
+		matchedPath := func(t *testing.T, oas *openapi.OpenAPISpec, path string) string {
+			t.Helper()
+			router := mux.NewRouter()
+			setupRoutes(router, core.NewOASStore(oas, nil), envs)
+
+			var match mux.RouteMatch
+			require.True(t, router.Match(httptest.NewRequest(http.MethodGet, path, nil), &match))
+			template, err := match.Route.GetPathTemplate()
+			require.NoError(t, err)
+			return template
+		}
+
+		oas := &openapi.OpenAPISpec{
+			Paths: openapi.OpenAPIPaths{
+				"/users/me":     withPriority("allow_me", 0),
+				"/users/{id}":   withPriority("allow_user", 10),
+				"/users/export": withPriority("allow_export", 0),
+			},
+		}
+		require.Equal(t, "/users/{id}", matchedPath(t, oas, "/users/me"))
+		require.Equal(t, "/users/{id}", matchedPath(t, oas, "/users/export"))
+
+		oas.Paths["/users/{id}"] = withPriority("allow_user", 0)
+		oas.Paths["/users/me"] = withPriority("allow_me", 5)
+		require.Equal(t, "/users/me", matchedPath(t, oas, "/users/me"))
+		require.Equal(t, "/users/{id}", matchedPath(t, oas, "/users/42"))
+	})
+
+	t.Run("registers the prefix and regex paths before the fallback route", func(t *testing.T) {
+		oas, err := openapi.LoadOASFile("../mocks/pathPatternsConfig.json")
+		require.NoError(t, err)
+		router := mux.NewRouter()
+		setupRoutes(router, core.NewOASStore(oas, nil), envs)
+
+		routes := []*mux.Route{}
+		router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+			routes = append(routes, route)
+			return nil
+		})
+		fallbackRoute := routes[len(routes)-1]
+
+		matchedPath := func(t *testing.T, method, path string) string {
+			t.Helper()
+			var match mux.RouteMatch
+			require.True(t, router.Match(httptest.NewRequest(method, path, nil), &match))
+			require.NotSame(t, fallbackRoute, match.Route)
+			template, err := match.Route.GetPathTemplate()
+			require.NoError(t, err)
+			return template
+		}
+		require.Equal(t, "/projects/{projectId}", matchedPath(t, http.MethodGet, "/projects/p1"))
+		require.Equal(t, "/projects/{projectId}/files", matchedPath(t, http.MethodPost, "/projects/p1/files/a/b/download"))
+		require.Equal(t, "/projects", matchedPath(t, http.MethodGet, "/projects/p1/filesystem"))
+		require.Equal(t, "/", matchedPath(t, http.MethodHead, "/archive/a1/files/x/download"))
+
+		var match mux.RouteMatch
+		require.True(t, router.Match(httptest.NewRequest(http.MethodPost, "/projects/p1/filesystem", nil), &match))
+		require.Same(t, fallbackRoute, match.Route)
+	})
+
+	t.Run("routes the paths differing in parameter names to their own configuration", func(t *testing.T) {
+		withPolicy := func(policy string) openapi.PathVerbs {
+			return openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: policy}},
+				},
+			}
+		}
+		oas := &openapi.OpenAPISpec{
+			Paths: openapi.OpenAPIPaths{
+				"/resources/{id}":                  withPolicy("get_resource"),
+				"/resources/{resourceId}/children": withPolicy("list_children"),
+				"/items/{id}":                      withPolicy("get_item"),
+				"/items/{itemId}":                  withPolicy("get_item_by_id"),
+			},
+		}
+		router := mux.NewRouter()
+		setupRoutes(router, core.NewOASStore(oas, nil), envs)
+		OASRouter := oas.PrepareOASRouter()
+
+		testCases := []struct {
+			path             string
+			expectedTemplate string
+			expectedVars     map[string]string
+			expectedPolicy   string
+		}{
+			{path: "/resources/r1", expectedTemplate: "/resources/{id}", expectedVars: map[string]string{"id": "r1"}, expectedPolicy: "get_resource"},
+			{path: "/resources/r1/children", expectedTemplate: "/resources/{resourceId}/children", expectedVars: map[string]string{"resourceId": "r1"}, expectedPolicy: "list_children"},
+			{path: "/items/i1", expectedTemplate: "/items/{itemId}", expectedVars: map[string]string{"itemId": "i1"}, expectedPolicy: "get_item_by_id"},
+		}
+		for _, testCase := range testCases {
+			var match mux.RouteMatch
+			require.True(t, router.Match(httptest.NewRequest(http.MethodGet, testCase.path, nil), &match), testCase.path)
+			template, err := match.Route.GetPathTemplate()
+			require.NoError(t, err)
+			require.Equal(t, testCase.expectedTemplate, template)
+			require.Equal(t, testCase.expectedVars, match.Vars)
+
+			permission, err := oas.FindPermission(OASRouter, testCase.path, http.MethodGet)
+			require.NoError(t, err)
+			require.Equal(t, testCase.expectedPolicy, permission.RequestFlow.PolicyName)
+		}
+	})
+
 	t.Run("expect to register route correctly in standalone mode", func(t *testing.T) {
 		envs := config.EnvironmentVariables{
 			TargetServiceOASPath: "/documentation/json",
@@ -129,7 +245,7 @@ func TestSetupRoutes(t *testing.T) {
 		expectedPaths := []string{"/validate/", "/validate/documentation/json", "/validate/foo/", "/validate/foo/bar/", "/validate/foo/bar/nested", "/validate/foo/bar/{barId}"}
 		sort.Strings(expectedPaths)
 
-		setupRoutes(router, oas, envs)
+		setupRoutes(router, core.NewOASStore(oas, nil), envs)
 
 		foundPaths := make([]string, 0)
 		router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
@@ -161,6 +277,18 @@ func TestConvertPathVariables(t *testing.T) {
 		{Path: "/endpoint-1/:id/upsert", ConvertedPath: "/endpoint-1/{id}/upsert"},
 		{Path: "/external-endpoint/:id", ConvertedPath: "/external-endpoint/{id}"},
 		{Path: "/:another/external-endpoint", ConvertedPath: "/{another}/external-endpoint"},
+		{Path: "/users/{id}", ConvertedPath: "/users/{id}"},
+		{Path: "/users/:id", ConvertedPath: "/users/{id}"},
+		{Path: "/users/{id}/posts/:postId", ConvertedPath: "/users/{id}/posts/{postId}"},
+		{Path: "/users/:id/posts/{postId}", ConvertedPath: "/users/{id}/posts/{postId}"},
+		{Path: "/tenants/:tenantId/projects/{projectId}/envs/:envId/logs", ConvertedPath: "/tenants/{tenantId}/projects/{projectId}/envs/{envId}/logs"},
+		{Path: "/reports/{reportId}.json", ConvertedPath: "/reports/{reportId}.json"},
+		{Path: "/schedules/at-12:30", ConvertedPath: "/schedules/at-12:30"},
+		{Path: "/files/{name", ConvertedPath: "/files/%7Bname"},
+		{Path: "/files/name}", ConvertedPath: "/files/name%7D"},
+		{Path: "/search/{}", ConvertedPath: "/search/%7B%7D"},
+		{Path: "/search/{not a param}", ConvertedPath: "/search/%7Bnot a param%7D"},
+		{Path: "/templates/{{name}}", ConvertedPath: "/templates/%7B{name}%7D"},
 	}
 
 	t.Run("convert correctly paths", func(t *testing.T) {
@@ -169,6 +297,31 @@ func TestConvertPathVariables(t *testing.T) {
 			require.Equal(t, path.ConvertedPath, convertedPath, "Path not converted correctly.")
 		}
 	})
+
+	t.Run("converted paths are routed", func(t *testing.T) {
+		testCases := []struct {
+			path         string
+			requestPath  string
+			expectedVars map[string]string
+		}{
+			{path: "/users/{id}/posts/:postId", requestPath: "/users/u1/posts/p1", expectedVars: map[string]string{"id": "u1", "postId": "p1"}},
+			{path: "/tenants/:tenantId/projects/{projectId}/envs/:envId", requestPath: "/tenants/t1/projects/p1/envs/e1", expectedVars: map[string]string{"tenantId": "t1", "projectId": "p1", "envId": "e1"}},
+			{path: "/search/{}", requestPath: "/search/%7B%7D", expectedVars: map[string]string{}},
+			{path: "/templates/{{name}}", requestPath: "/templates/%7Bwelcome%7D", expectedVars: map[string]string{"name": "welcome"}},
+		}
+
+		for _, testCase := range testCases {
+			t.Run(testCase.path, func(t *testing.T) {
+				router := mux.NewRouter().UseEncodedPath()
+				router.HandleFunc(openapi.ConvertPathVariablesToBrackets(testCase.path), func(w http.ResponseWriter, r *http.Request) {})
+
+				req := httptest.NewRequest(http.MethodGet, testCase.requestPath, nil)
+				var match mux.RouteMatch
+				require.True(t, router.Match(req, &match), "Route not found")
+				require.Equal(t, testCase.expectedVars, match.Vars)
+			})
+		}
+	})
 }
 
 func TestConvertPathVariables2(t *testing.T) {
@@ -252,7 +405,7 @@ func TestSetupRoutesIntegration(t *testing.T) {
 	log, _ := test.NewNullLogger()
 	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
 
-	mockPartialEvaluators, _ := core.SetupEvaluators(ctx, nil, oas, mockOPAModule, envs)
+	mockPartialEvaluators, _, _ := core.SetupEvaluators(ctx, nil, oas, mockOPAModule, envs)
 	t.Run("invokes known API", func(t *testing.T) {
 		var invoked bool
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -264,7 +417,7 @@ func TestSetupRoutesIntegration(t *testing.T) {
 		defer server.Close()
 
 		router := mux.NewRouter()
-		setupRoutes(router, oas, envs)
+		setupRoutes(router, core.NewOASStore(oas, nil), envs)
 
 		serverURL, _ := url.Parse(server.URL)
 		ctx := createContext(t,
@@ -301,7 +454,7 @@ func TestSetupRoutesIntegration(t *testing.T) {
 		defer server.Close()
 
 		router := mux.NewRouter()
-		setupRoutes(router, oas, envs)
+		setupRoutes(router, core.NewOASStore(oas, nil), envs)
 
 		serverURL, _ := url.Parse(server.URL)
 		ctx := createContext(t,
@@ -333,9 +486,9 @@ func TestSetupRoutesIntegration(t *testing.T) {
 			Content: `package policies
 		todo { false }`,
 		}
-		mockPartialEvaluators, _ := core.SetupEvaluators(ctx, nil, oas, mockOPAModule, envs)
+		mockPartialEvaluators, _, _ := core.SetupEvaluators(ctx, nil, oas, mockOPAModule, envs)
 		router := mux.NewRouter()
-		setupRoutes(router, oas, envs)
+		setupRoutes(router, core.NewOASStore(oas, nil), envs)
 
 		ctx := createContext(t,
 			ctx,
@@ -364,10 +517,10 @@ func TestSetupRoutesIntegration(t *testing.T) {
 		var mockOPAModule = &core.OPAModuleConfig{
 			Content: "FAILING POLICY!!!!",
 		}
-		mockPartialEvaluators, _ := core.SetupEvaluators(ctx, nil, oas, mockOPAModule, envs)
+		mockPartialEvaluators, _, _ := core.SetupEvaluators(ctx, nil, oas, mockOPAModule, envs)
 
 		router := mux.NewRouter()
-		setupRoutes(router, oas, envs)
+		setupRoutes(router, core.NewOASStore(oas, nil), envs)
 
 		ctx := createContext(t,
 			context.Background(),
@@ -402,7 +555,7 @@ func TestSetupRoutesIntegration(t *testing.T) {
 		defer server.Close()
 
 		router := mux.NewRouter()
-		setupRoutes(router, oas, envs)
+		setupRoutes(router, core.NewOASStore(oas, nil), envs)
 
 		serverURL, _ := url.Parse(server.URL)
 		ctx := createContext(t,
@@ -439,7 +592,7 @@ func TestSetupRoutesIntegration(t *testing.T) {
 		defer server.Close()
 
 		router := mux.NewRouter()
-		setupRoutes(router, oas, envs)
+		setupRoutes(router, core.NewOASStore(oas, nil), envs)
 
 		serverURL, _ := url.Parse(server.URL)
 		ctx := createContext(t,
@@ -466,8 +619,469 @@ func TestSetupRoutesIntegration(t *testing.T) {
 	})
 }
 
+func TestSetupRouterHeadRequests(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+
+	opa := &core.OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow { true }
+deny { false }
+filter_response [body] { body := input.response.body }
+`,
+	}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{
+						RequestFlow:  openapi.RequestFlow{PolicyName: "allow"},
+						ResponseFlow: openapi.ResponseFlow{PolicyName: "filter_response"},
+					},
+				},
+			},
+			"/private": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "deny"}},
+				},
+			},
+		},
+	}
+
+	var mongoClient *mongoclient.MongoClient
+	evaluatorsMap, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, config.EnvironmentVariables{})
+	require.NoError(t, err, "unexpected error")
+
+	var invokedMethod string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		invokedMethod = r.Method
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Total-Count", "2")
+		w.Write([]byte(`[{"name":"u1"},{"name":"u2"}]`))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	router, err := SetupRouter(log, config.EnvironmentVariables{TargetServiceHost: serverURL.Host}, opa, oas, evaluatorsMap, mongoClient)
+	require.NoError(t, err, "unexpected error")
+
+	t.Run("HEAD request is authorized with the GET policy and forwarded as HEAD", func(t *testing.T) {
+		invokedMethod = ""
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/users", nil))
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Equal(t, http.MethodHead, invokedMethod)
+		require.Equal(t, "2", w.Result().Header.Get("X-Total-Count"))
+		require.Equal(t, "application/json", w.Result().Header.Get("Content-Type"))
+		require.Empty(t, w.Body.Bytes())
+	})
+
+	t.Run("HEAD request is denied by the GET policy", func(t *testing.T) {
+		invokedMethod = ""
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/private", nil))
+
+		require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+		require.Empty(t, invokedMethod, "target service must not be contacted")
+	})
+}
+
+func TestSetupRouterRoutePriority(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+
+	opa := &core.OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow_user { true }
+allow_me { false }
+`,
+	}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users/me": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow_me"}},
+				},
+			},
+			"/users/{id}": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow_user"}, Priority: 10},
+				},
+			},
+		},
+	}
+
+	var mongoClient *mongoclient.MongoClient
+	evaluatorsMap, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, config.EnvironmentVariables{})
+	require.NoError(t, err, "unexpected error")
+
+	invoked := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		invoked = true
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	router, err := SetupRouter(log, config.EnvironmentVariables{TargetServiceHost: serverURL.Host, PolicyResponseHeader: "X-Rond-Policy", PassThroughNonJSON: true}, opa, oas, evaluatorsMap, mongoClient)
+	require.NoError(t, err, "unexpected error")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/me", nil))
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode, "the policy of the higher priority route must run")
+	require.Equal(t, "allow_user", w.Result().Header.Get("X-Rond-Policy"))
+	require.True(t, invoked)
+}
+
+func TestSetupRouterPolicyResponseHeader(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+
+	opa := &core.OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow { true }
+filter_response [body] { body := input.response.body }
+`,
+	}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{
+						RequestFlow:  openapi.RequestFlow{PolicyName: "allow"},
+						ResponseFlow: openapi.ResponseFlow{PolicyName: "filter_response"},
+					},
+				},
+			},
+			"/files": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow"}},
+				},
+			},
+		},
+	}
+
+	var mongoClient *mongoclient.MongoClient
+	evaluatorsMap, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, config.EnvironmentVariables{})
+	require.NoError(t, err, "unexpected error")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	t.Run("request policy of a proxied route without response policy", func(t *testing.T) {
+		env := config.EnvironmentVariables{TargetServiceHost: serverURL.Host, PolicyResponseHeader: "X-Rond-Policy", PassThroughNonJSON: true}
+		router, err := SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+		require.NoError(t, err, "unexpected error")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files", nil))
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Equal(t, "allow", w.Result().Header.Get("X-Rond-Policy"))
+		require.Equal(t, "content", w.Body.String())
+	})
+
+	t.Run("request policy in standalone mode", func(t *testing.T) {
+		env := config.EnvironmentVariables{Standalone: true, PathPrefixStandalone: "/eval", ServiceVersion: "latest", PolicyResponseHeader: "X-Rond-Policy"}
+		router, err := SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+		require.NoError(t, err, "unexpected error")
+
+		for _, path := range []string{"/eval/files", "/eval/users"} {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+			require.Equal(t, http.StatusOK, w.Result().StatusCode, path)
+			require.Equal(t, "allow", w.Result().Header.Get("X-Rond-Policy"), path)
+		}
+	})
+
+	t.Run("no header when disabled", func(t *testing.T) {
+		router, err := SetupRouter(log, config.EnvironmentVariables{TargetServiceHost: serverURL.Host, PassThroughNonJSON: true}, opa, oas, evaluatorsMap, mongoClient)
+		require.NoError(t, err, "unexpected error")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files", nil))
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.NotContains(t, w.Result().Header, "X-Rond-Policy")
+	})
+}
+
+func TestSetupRouterMethodNotAllowed(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+
+	opa := &core.OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow { true }
+`,
+	}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow"}},
+				},
+			},
+			"/public": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{
+						RequestFlow: openapi.RequestFlow{PolicyName: "allow"},
+						Options:     openapi.PermissionOptions{ProxyUnknownMethods: true},
+					},
+				},
+			},
+		},
+	}
+
+	var mongoClient *mongoclient.MongoClient
+	evaluatorsMap, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, config.EnvironmentVariables{})
+	require.NoError(t, err, "unexpected error")
+
+	var invoked bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		invoked = true
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	router, err := SetupRouter(log, config.EnvironmentVariables{TargetServiceHost: serverURL.Host}, opa, oas, evaluatorsMap, mongoClient)
+	require.NoError(t, err, "unexpected error")
+
+	t.Run("responds 405 on a method not defined for the path", func(t *testing.T) {
+		invoked = false
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/users", nil))
+
+		require.Equal(t, http.StatusMethodNotAllowed, w.Result().StatusCode)
+		require.Equal(t, "GET, HEAD", w.Result().Header.Get("Allow"))
+		require.False(t, invoked, "target service must not be contacted")
+	})
+
+	t.Run("proxies a method not defined for a path opted out", func(t *testing.T) {
+		invoked = false
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/public", nil))
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.True(t, invoked, "target service must be contacted")
+	})
+}
+
+func TestSetupRouterCORSPassthrough(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+
+	opa := &core.OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow { true }
+deny { false }
+`,
+	}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow"}},
+				},
+			},
+			"/private": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{
+						RequestFlow: openapi.RequestFlow{PolicyName: "allow"},
+						Options:     openapi.PermissionOptions{CORSPassthrough: config.CORSPassthroughOff},
+					},
+				},
+			},
+			"/declared": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow"}},
+				},
+				"options": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "deny"}},
+				},
+			},
+		},
+	}
+
+	var mongoClient *mongoclient.MongoClient
+	evaluatorsMap, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, config.EnvironmentVariables{})
+	require.NoError(t, err, "unexpected error")
+
+	var invokedMethods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		invokedMethods = append(invokedMethods, r.Method)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	newPreflight := func(path string) *http.Request {
+		req := httptest.NewRequest(http.MethodOptions, path, nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		return req
+	}
+
+	t.Run("responds to preflight and proxies the actual request", func(t *testing.T) {
+		invokedMethods = nil
+		env := config.EnvironmentVariables{
+			TargetServiceHost:      serverURL.Host,
+			CORSPassthrough:        config.CORSPassthroughRespond,
+			CORSAllowedOriginsList: []string{"https://app.example.com"},
+		}
+		router, err := SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+		require.NoError(t, err, "unexpected error")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newPreflight("/users"))
+		require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+		require.Equal(t, "https://app.example.com", w.Result().Header.Get("Access-Control-Allow-Origin"))
+		require.Equal(t, "GET, HEAD", w.Result().Header.Get("Access-Control-Allow-Methods"))
+		require.Empty(t, invokedMethods, "target service must not be contacted by the preflight")
+
+		w = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/users", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Equal(t, []string{http.MethodGet}, invokedMethods)
+	})
+
+	t.Run("proxies preflight and the actual request", func(t *testing.T) {
+		invokedMethods = nil
+		env := config.EnvironmentVariables{
+			TargetServiceHost: serverURL.Host,
+			CORSPassthrough:   config.CORSPassthroughProxy,
+		}
+		router, err := SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+		require.NoError(t, err, "unexpected error")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newPreflight("/users"))
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users", nil))
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Equal(t, []string{http.MethodOptions, http.MethodGet}, invokedMethods)
+	})
+
+	t.Run("route option overrides the passthrough mode", func(t *testing.T) {
+		invokedMethods = nil
+		env := config.EnvironmentVariables{
+			TargetServiceHost: serverURL.Host,
+			CORSPassthrough:   config.CORSPassthroughProxy,
+		}
+		router, err := SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+		require.NoError(t, err, "unexpected error")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newPreflight("/private"))
+		require.Equal(t, http.StatusMethodNotAllowed, w.Result().StatusCode)
+		require.Empty(t, invokedMethods)
+	})
+
+	t.Run("non-preflight OPTIONS requests are evaluated", func(t *testing.T) {
+		invokedMethods = nil
+		env := config.EnvironmentVariables{
+			TargetServiceHost: serverURL.Host,
+			CORSPassthrough:   config.CORSPassthroughProxy,
+		}
+		router, err := SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+		require.NoError(t, err, "unexpected error")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/users", nil))
+		require.Equal(t, http.StatusMethodNotAllowed, w.Result().StatusCode)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/declared", nil))
+		require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, newPreflight("/declared"))
+		require.Equal(t, http.StatusForbidden, w.Result().StatusCode, "preflight of a path defining OPTIONS is evaluated")
+		require.Empty(t, invokedMethods)
+	})
+}
+
+func TestSetupRouterLazyEvaluatorInit(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+	env := config.EnvironmentVariables{LazyEvaluatorInit: true}
+
+	opa := &core.OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow { true }
+allow_orders { true }
+`,
+	}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow"}},
+				},
+			},
+			"/orders": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow_orders"}},
+				},
+			},
+		},
+	}
+
+	var mongoClient *mongoclient.MongoClient
+	evaluatorsMap, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, env)
+	require.NoError(t, err, "unexpected error")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	env.TargetServiceHost = serverURL.Host
+	router, err := SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+	require.NoError(t, err, "unexpected error")
+
+	t.Run("first request compiles the evaluator of the route", func(t *testing.T) {
+		require.False(t, evaluatorsMap.Compiled(core.EvaluatorKey{PolicyName: "allow"}))
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users", nil))
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.True(t, evaluatorsMap.Compiled(core.EvaluatorKey{PolicyName: "allow"}))
+		require.False(t, evaluatorsMap.Compiled(core.EvaluatorKey{PolicyName: "allow_orders"}))
+	})
+
+	t.Run("warmup compiles all the evaluators", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/warmup", nil))
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.JSONEq(t, `{"evaluators":2}`, w.Body.String())
+		require.True(t, evaluatorsMap.Compiled(core.EvaluatorKey{PolicyName: "allow_orders"}))
+	})
+}
+
 func TestRoutesToNotProxy(t *testing.T) {
-	require.Equal(t, routesToNotProxy, []string{"/-/rbac-healthz", "/-/rbac-ready", "/-/rbac-check-up", "/-/rond/metrics"})
+	require.Equal(t, routesToNotProxy, []string{"/-/rbac-healthz", "/-/rbac-ready", "/-/rbac-check-up", "/_status/rego-fingerprint", "/_status/mongo-pool", "/-/warmup", "/-/rbac-version", "/-/policies/diff", "/-/rond/metrics"})
 }
 
 func prepareOASFromFile(t *testing.T, filePath string) *openapi.OpenAPISpec {
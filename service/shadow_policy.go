@@ -0,0 +1,188 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/rond-authz/rond/core"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/metrics"
+	"github.com/rond-authz/rond/openapi"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	shadowOutcomeAgree    = "agree"
+	shadowOutcomeDisagree = "disagree"
+	shadowOutcomeError    = "error"
+	shadowOutcomeSkipped  = "skipped"
+
+	// shadowPolicyTimeout bounds a shadow evaluation, which is detached from the request.
+	shadowPolicyTimeout = 10 * time.Second
+)
+
+// shadowEvaluations runs the shadow policy evaluations in background with bounded
+// concurrency: when all the slots are busy the evaluation is skipped, so that the shadow
+// policies never queue up nor slow down the requests.
+type shadowEvaluations struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+var shadowPolicyEvaluations = newShadowEvaluations(runtime.GOMAXPROCS(0))
+
+func newShadowEvaluations(concurrency int) *shadowEvaluations {
+	return &shadowEvaluations{slots: make(chan struct{}, concurrency)}
+}
+
+// run starts fn in background if a slot is free, and reports whether it was started.
+func (evaluations *shadowEvaluations) run(fn func()) bool {
+	select {
+	case evaluations.slots <- struct{}{}:
+	default:
+		return false
+	}
+	evaluations.wg.Add(1)
+	go func() {
+		defer func() {
+			<-evaluations.slots
+			evaluations.wg.Done()
+		}()
+		fn()
+	}()
+	return true
+}
+
+// wait blocks until the running evaluations are completed.
+func (evaluations *shadowEvaluations) wait() {
+	evaluations.wg.Wait()
+}
+
+// detachedContext keeps the values of the request context, but is never canceled
+// when the request is completed.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// shadowPolicyEvaluation returns the function starting the evaluation of the shadow policy
+// of the route with the input of the request policy, to be called once the response is
+// written. It returns nil if the route has no shadow policy or the request policy was not
+// evaluated.
+func shadowPolicyEvaluation(
+	ctx context.Context,
+	env config.EnvironmentVariables,
+	partialResultsEvaluators core.PartialResultsEvaluators,
+	permission *openapi.RondConfig,
+	input ast.Value,
+	allowed bool,
+) func() {
+	shadowPolicy := permission.RequestFlow.ShadowPolicy
+	if shadowPolicy == "" || input == nil {
+		return nil
+	}
+	return func() {
+		ctx := detachedContext{ctx}
+		evaluatorKey := core.RequestEvaluatorKey(ctx, permission.Options.PolicyModule, shadowPolicy)
+		started := shadowPolicyEvaluations.run(func() {
+			ctx, cancel := context.WithTimeout(ctx, shadowPolicyTimeout)
+			defer cancel()
+			shadowAllowed, err := evaluateShadowPolicy(ctx, env, partialResultsEvaluators, evaluatorKey, input)
+			recordShadowDecision(ctx, permission, allowed, shadowAllowed, err)
+		})
+		if !started {
+			recordShadowDecision(ctx, permission, allowed, false, errShadowEvaluationSkipped)
+		}
+	}
+}
+
+var errShadowEvaluationSkipped = errors.New("too many shadow policy evaluations running")
+
+func evaluateShadowPolicy(
+	ctx context.Context,
+	env config.EnvironmentVariables,
+	partialResultsEvaluators core.PartialResultsEvaluators,
+	evaluatorKey core.EvaluatorKey,
+	input ast.Value,
+) (allowed bool, err error) {
+	// a failing shadow policy must never affect the service
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("shadow policy evaluation panicked: %v", recovered)
+		}
+	}()
+	evaluator, err := partialResultsEvaluators.GetEvaluatorFromPolicyWithParsedInput(ctx, evaluatorKey, input, env)
+	if err != nil {
+		return false, err
+	}
+	_, err = evaluator.Evaluate(glogger.Get(ctx))
+	return err == nil, nil
+}
+
+// recordShadowDecision logs and counts whether the shadow policy takes the same decision
+// of the request policy.
+func recordShadowDecision(ctx context.Context, permission *openapi.RondConfig, allowed, shadowAllowed bool, err error) {
+	logger := glogger.Get(ctx)
+	fields := logrus.Fields{
+		"policyName":   permission.RequestFlow.PolicyName,
+		"shadowPolicy": permission.RequestFlow.ShadowPolicy,
+		"allowed":      allowed,
+	}
+	outcome := shadowOutcomeAgree
+	switch {
+	case errors.Is(err, errShadowEvaluationSkipped):
+		outcome = shadowOutcomeSkipped
+		logger.WithFields(fields).Warn("shadow policy evaluation skipped")
+	case err != nil:
+		outcome = shadowOutcomeError
+		fields["error"] = logrus.Fields{"message": err.Error()}
+		logger.WithFields(fields).Warn("failed shadow policy evaluation")
+	default:
+		if allowed != shadowAllowed {
+			outcome = shadowOutcomeDisagree
+		}
+		fields["shadowAllowed"] = shadowAllowed
+		fields["agree"] = allowed == shadowAllowed
+		logger.WithFields(fields).Info("shadow policy decision")
+	}
+
+	m, err := metrics.GetFromContext(ctx)
+	if err != nil {
+		return
+	}
+	var route string
+	if routerInfo, err := openapi.GetRouterInfo(ctx); err == nil {
+		route = routerInfo.MatchedPath
+	}
+	m.PolicyShadowDecisions.With(prometheus.Labels{
+		"http_route":    route,
+		"policy_name":   permission.RequestFlow.PolicyName,
+		"shadow_policy": permission.RequestFlow.ShadowPolicy,
+		"outcome":       outcome,
+	}).Inc()
+}
@@ -0,0 +1,199 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/rond-authz/rond/core"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/metrics"
+	"github.com/rond-authz/rond/openapi"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShadowPolicy(t *testing.T) {
+	envs := config.EnvironmentVariables{}
+	opaModuleConfig := &core.OPAModuleConfig{
+		Name: "mypolicy.rego",
+		Content: `package policies
+allow { input.request.method == "POST" }
+new_allow { true }`,
+	}
+	oas := openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/api": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{
+						RequestFlow: openapi.RequestFlow{PolicyName: "allow", ShadowPolicy: "new_allow"},
+					},
+				},
+			},
+		},
+	}
+	partialEvaluators, _, err := core.SetupEvaluators(context.Background(), nil, &oas, opaModuleConfig, envs)
+	require.NoError(t, err)
+
+	type result struct {
+		statusCode int
+		header     http.Header
+		body       string
+		invoked    bool
+		ctx        context.Context
+		hook       *test.Hook
+	}
+	runRequest := func(t *testing.T, method string, permission *openapi.RondConfig) result {
+		t.Helper()
+		invoked := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			w.Header().Set("x-upstream", "yes")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"ok":true}`))
+		}))
+		defer server.Close()
+
+		env := envs
+		serverURL, _ := url.Parse(server.URL)
+		env.TargetServiceHost = serverURL.Host
+		ctx := createContext(t, context.Background(), env, nil, permission, opaModuleConfig, partialEvaluators)
+
+		log, hook := test.NewNullLogger()
+		ctx = glogger.WithLogger(ctx, logrus.NewEntry(log))
+
+		r, err := http.NewRequestWithContext(ctx, method, "http://www.example.com:8080/api", nil)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+		shadowPolicyEvaluations.wait()
+
+		body, err := io.ReadAll(w.Result().Body)
+		require.NoError(t, err)
+		return result{
+			statusCode: w.Result().StatusCode,
+			header:     w.Result().Header,
+			body:       string(body),
+			invoked:    invoked,
+			ctx:        ctx,
+			hook:       hook,
+		}
+	}
+
+	t.Run("the client response is the same with and without shadow policy", func(t *testing.T) {
+		testCases := []struct {
+			name   string
+			method string
+			mode   string
+		}{
+			{name: "allowed request", method: http.MethodPost},
+			{name: "denied request", method: http.MethodGet},
+			{name: "denied request in log-only mode", method: http.MethodGet, mode: config.PolicyModeLogOnly},
+		}
+		for _, testCase := range testCases {
+			t.Run(testCase.name, func(t *testing.T) {
+				options := openapi.PermissionOptions{Mode: testCase.mode}
+				withoutShadow := runRequest(t, testCase.method, &openapi.RondConfig{
+					RequestFlow: openapi.RequestFlow{PolicyName: "allow"},
+					Options:     options,
+				})
+				withShadow := runRequest(t, testCase.method, &openapi.RondConfig{
+					RequestFlow: openapi.RequestFlow{PolicyName: "allow", ShadowPolicy: "new_allow"},
+					Options:     options,
+				})
+
+				require.Equal(t, withoutShadow.statusCode, withShadow.statusCode)
+				require.Equal(t, withoutShadow.header, withShadow.header)
+				require.Equal(t, withoutShadow.body, withShadow.body)
+				require.Equal(t, withoutShadow.invoked, withShadow.invoked)
+				require.Len(t, findLogWithMessage(withShadow.hook.AllEntries(), "shadow policy decision"), 1)
+				require.Empty(t, findLogWithMessage(withoutShadow.hook.AllEntries(), "shadow policy decision"))
+			})
+		}
+	})
+
+	t.Run("records the disagreement", func(t *testing.T) {
+		res := runRequest(t, http.MethodGet, &openapi.RondConfig{
+			RequestFlow: openapi.RequestFlow{PolicyName: "allow", ShadowPolicy: "new_allow"},
+		})
+		require.Equal(t, http.StatusForbidden, res.statusCode)
+
+		actualLog := findLogWithMessage(res.hook.AllEntries(), "shadow policy decision")
+		require.Len(t, actualLog, 1)
+		require.Equal(t, logrus.Fields{
+			"policyMode":    config.PolicyModeEnforce,
+			"policyName":    "allow",
+			"shadowPolicy":  "new_allow",
+			"allowed":       false,
+			"shadowAllowed": true,
+			"agree":         false,
+		}, actualLog[0].Data)
+
+		m, err := metrics.GetFromContext(res.ctx)
+		require.NoError(t, err)
+		require.Equal(t, float64(1), testutil.ToFloat64(m.PolicyShadowDecisions.WithLabelValues("/matched/path", "allow", "new_allow", "disagree")))
+	})
+
+	t.Run("records the agreement", func(t *testing.T) {
+		res := runRequest(t, http.MethodPost, &openapi.RondConfig{
+			RequestFlow: openapi.RequestFlow{PolicyName: "allow", ShadowPolicy: "new_allow"},
+		})
+		require.Equal(t, http.StatusOK, res.statusCode)
+
+		m, err := metrics.GetFromContext(res.ctx)
+		require.NoError(t, err)
+		require.Equal(t, float64(1), testutil.ToFloat64(m.PolicyShadowDecisions.WithLabelValues("/matched/path", "allow", "new_allow", "agree")))
+	})
+
+	t.Run("records the failed shadow evaluation without affecting the request", func(t *testing.T) {
+		res := runRequest(t, http.MethodPost, &openapi.RondConfig{
+			RequestFlow: openapi.RequestFlow{PolicyName: "allow", ShadowPolicy: "missing_allow"},
+		})
+		require.Equal(t, http.StatusOK, res.statusCode)
+		require.True(t, res.invoked)
+		require.Len(t, findLogWithMessage(res.hook.AllEntries(), "failed shadow policy evaluation"), 1)
+
+		m, err := metrics.GetFromContext(res.ctx)
+		require.NoError(t, err)
+		require.Equal(t, float64(1), testutil.ToFloat64(m.PolicyShadowDecisions.WithLabelValues("/matched/path", "allow", "missing_allow", "error")))
+	})
+
+	t.Run("skips the shadow evaluation when too many are running", func(t *testing.T) {
+		evaluations := shadowPolicyEvaluations
+		shadowPolicyEvaluations = newShadowEvaluations(0)
+		defer func() { shadowPolicyEvaluations = evaluations }()
+
+		res := runRequest(t, http.MethodPost, &openapi.RondConfig{
+			RequestFlow: openapi.RequestFlow{PolicyName: "allow", ShadowPolicy: "new_allow"},
+		})
+		require.Equal(t, http.StatusOK, res.statusCode)
+		require.Len(t, findLogWithMessage(res.hook.AllEntries(), "shadow policy evaluation skipped"), 1)
+
+		m, err := metrics.GetFromContext(res.ctx)
+		require.NoError(t, err)
+		require.Equal(t, float64(1), testutil.ToFloat64(m.PolicyShadowDecisions.WithLabelValues("/matched/path", "allow", "new_allow", "skipped")))
+	})
+}
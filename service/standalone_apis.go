@@ -15,13 +15,22 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"reflect"
+	"strings"
+	"time"
 
+	"github.com/rond-authz/rond/core"
 	"github.com/rond-authz/rond/internal/config"
 	"github.com/rond-authz/rond/internal/crudclient"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	internaltypes "github.com/rond-authz/rond/internal/types"
 	"github.com/rond-authz/rond/internal/utils"
+	"github.com/rond-authz/rond/openapi"
 	"github.com/rond-authz/rond/types"
 
 	"github.com/google/uuid"
@@ -33,6 +42,11 @@ import (
 // TODO: handle pagination!
 const BINDINGS_MAX_PAGE_SIZE = 200
 
+const (
+	validationErrorCodeRequired    = "required"
+	validationErrorCodeInvalidType = "invalid_type"
+)
+
 type RevokeRequestBody struct {
 	Subjects    []string `json:"subjects,omitempty"`
 	Groups      []string `json:"groups,omitempty"`
@@ -52,18 +66,32 @@ func revokeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	reqBody := RevokeRequestBody{}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		utils.FailResponseWithCode(w, http.StatusInternalServerError, err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+	if !decodeRequestBody(w, r, &reqBody) {
 		return
 	}
 
 	resourceType := mux.Vars(r)["resourceType"]
 	if resourceType != "" && len(reqBody.ResourceIDs) == 0 {
-		utils.FailResponseWithCode(w, http.StatusBadRequest, "empty resources list", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+		utils.FailResponseWithValidationErrors(w, "empty resources list", utils.GENERIC_BUSINESS_ERROR_MESSAGE, []internaltypes.ValidationErrorDetail{
+			{Field: "resourceIds", Message: "must contain at least one resource id", Code: validationErrorCodeRequired},
+		})
 		return
 	}
 	if len(reqBody.Subjects) == 0 && len(reqBody.Groups) == 0 {
-		utils.FailResponseWithCode(w, http.StatusBadRequest, "empty subjects and groups lists", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+		utils.FailResponseWithValidationErrors(w, "empty subjects and groups lists", utils.GENERIC_BUSINESS_ERROR_MESSAGE,
+			requiredOneOfValidationErrors("subjects", "groups"),
+		)
+		return
+	}
+
+	mongoClient, err := bindingsMongoClient(r.Context(), env)
+	if err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed MongoDB client retrieval")
+		utils.FailResponseWithCode(w, http.StatusInternalServerError, err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+	if mongoClient != nil {
+		revokeBindingsOnMongo(w, r, env, mongoClient, resourceType, reqBody)
 		return
 	}
 
@@ -170,34 +198,31 @@ func grantHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	reqBody := GrantRequestBody{}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		utils.FailResponseWithCode(w, http.StatusInternalServerError, err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+	if !decodeRequestBody(w, r, &reqBody) {
 		return
 	}
 
 	resourceType := mux.Vars(r)["resourceType"]
 	if resourceType != "" && reqBody.ResourceID == "" {
-		utils.FailResponseWithCode(w, http.StatusBadRequest, "missing resource id", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+		utils.FailResponseWithValidationErrors(w, "missing resource id", utils.GENERIC_BUSINESS_ERROR_MESSAGE, []internaltypes.ValidationErrorDetail{
+			{Field: "resourceId", Message: "must not be empty", Code: validationErrorCodeRequired},
+		})
 		return
 	}
 
 	if len(reqBody.Groups) == 0 && len(reqBody.Permissions) == 0 && len(reqBody.Subjects) == 0 && len(reqBody.Roles) == 0 {
-		utils.FailResponseWithCode(w, http.StatusBadRequest, "missing body fields, one of groups, permissions, subjects or roles is required", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
-		return
-	}
-
-	client, err := crudclient.New(env.BindingsCrudServiceURL)
-	if err != nil {
-		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed crud setup")
-		utils.FailResponseWithCode(w, http.StatusInternalServerError, err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+		utils.FailResponseWithValidationErrors(w, "missing body fields, one of groups, permissions, subjects or roles is required", utils.GENERIC_BUSINESS_ERROR_MESSAGE,
+			requiredOneOfValidationErrors("groups", "permissions", "subjects", "roles"),
+		)
 		return
 	}
 
 	bindingToCreate := types.Binding{
-		BindingID: uuid.New().String(),
-		Groups:    reqBody.Groups,
-		Roles:     reqBody.Roles,
-		Subjects:  reqBody.Subjects,
+		BindingID:   uuid.New().String(),
+		Groups:      reqBody.Groups,
+		Roles:       reqBody.Roles,
+		Subjects:    reqBody.Subjects,
+		Permissions: reqBody.Permissions,
 	}
 
 	if resourceType != "" {
@@ -207,6 +232,24 @@ func grantHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	mongoClient, err := bindingsMongoClient(r.Context(), env)
+	if err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed MongoDB client retrieval")
+		utils.FailResponseWithCode(w, http.StatusInternalServerError, err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+	if mongoClient != nil {
+		grantBindingOnMongo(w, r, env, mongoClient, bindingToCreate)
+		return
+	}
+
+	client, err := crudclient.New(env.BindingsCrudServiceURL)
+	if err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed crud setup")
+		utils.FailResponseWithCode(w, http.StatusInternalServerError, err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+
 	var bindingIDCreated types.BindingCreateResponse
 	if err := client.Post(r.Context(), &bindingToCreate, &bindingIDCreated); err != nil {
 		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed crud request")
@@ -237,7 +280,245 @@ func grantHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// bindingsMongoClient returns the MongoDB client used to write the bindings, which is
+// set only if the bindings are not managed by the CRUD service.
+func bindingsMongoClient(ctx context.Context, env config.EnvironmentVariables) (types.IMongoClient, error) {
+	if env.BindingsCrudServiceURL != "" {
+		return nil, nil
+	}
+	return mongoclient.GetMongoClientFromContext(ctx)
+}
+
+func revokeBindingsOnMongo(w http.ResponseWriter, r *http.Request, env config.EnvironmentVariables, mongoClient types.IMongoClient, resourceType string, reqBody RevokeRequestBody) {
+	logger := glogger.Get(r.Context())
+
+	filter := buildBindingsFilter(resourceType, reqBody.ResourceIDs, reqBody.Subjects, reqBody.Groups)
+	bindings, err := mongoClient.FindBindings(r.Context(), filter)
+	if err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed bindings search")
+		utils.FailResponseWithCode(w, http.StatusInternalServerError, "failed MongoDB query for finding bindings", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+
+	bindingsToPatch, bindingsToDelete := prepareBindings(bindings, reqBody)
+	bindingsBefore := make(map[string]types.Binding, len(bindings))
+	for _, binding := range bindings {
+		bindingsBefore[binding.BindingID] = binding
+	}
+
+	var deletedBindings int64
+	var modifiedBindings int64
+
+	if len(bindingsToDelete) > 0 {
+		if deletedBindings, err = mongoClient.DeleteBindings(r.Context(), bindingIDs(bindingsToDelete)); err != nil {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed bindings deletion")
+			utils.FailResponseWithCode(w, http.StatusInternalServerError, "failed MongoDB query for deleting unused bindings", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		logger.WithField("deletedBindings", deletedBindings).Debug("binding deletion finished")
+
+		entries := make([]types.AuditEntry, 0, len(bindingsToDelete))
+		for _, binding := range bindingsToDelete {
+			before := bindingsBefore[binding.BindingID]
+			entries = append(entries, newAuditEntry(r, types.AuditOperationRevoke, &before, nil))
+		}
+		writeAuditEntries(r, mongoClient, entries)
+	}
+
+	if len(bindingsToPatch) > 0 {
+		if modifiedBindings, err = mongoClient.UpdateBindingsSubjects(r.Context(), bindingsToPatch); err != nil {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed bindings update")
+			utils.FailResponseWithCode(
+				w,
+				http.StatusInternalServerError,
+				fmt.Sprintf("failed MongoDB query to modify existing bindings. removed bindings: %d", deletedBindings),
+				utils.GENERIC_BUSINESS_ERROR_MESSAGE,
+			)
+			return
+		}
+		logger.WithField("updatedBindings", modifiedBindings).Debug("binding updated finished")
+
+		entries := make([]types.AuditEntry, 0, len(bindingsToPatch))
+		for i := range bindingsToPatch {
+			before := bindingsBefore[bindingsToPatch[i].BindingID]
+			entries = append(entries, newAuditEntry(r, types.AuditOperationRevoke, &before, &bindingsToPatch[i]))
+		}
+		writeAuditEntries(r, mongoClient, entries)
+	}
+
+	responseBytes, err := json.Marshal(RevokeResponseBody{
+		DeletedBindings:  int(deletedBindings),
+		ModifiedBindings: int(modifiedBindings),
+	})
+	if err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed response body")
+		utils.FailResponseWithCode(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("failed response body creation. removed bindings: %d, modified bindings: %d", deletedBindings, modifiedBindings),
+			utils.GENERIC_BUSINESS_ERROR_MESSAGE,
+		)
+		return
+	}
+	if _, err := w.Write(responseBytes); err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response write")
+	}
+}
+
+func grantBindingOnMongo(w http.ResponseWriter, r *http.Request, env config.EnvironmentVariables, mongoClient types.IMongoClient, bindingToCreate types.Binding) {
+	logger := glogger.Get(r.Context())
+
+	if err := mongoClient.UpsertBinding(r.Context(), bindingToCreate); err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed binding upsert")
+		utils.FailResponseWithCode(w, http.StatusInternalServerError, "failed MongoDB query for creating bindings", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+	logger.WithField("createdBindingId", utils.SanitizeString(bindingToCreate.BindingID)).Debug("created bindings")
+	// the binding id is generated on grant, so there is no binding before the change
+	writeAuditEntries(r, mongoClient, []types.AuditEntry{
+		newAuditEntry(r, types.AuditOperationGrant, nil, &bindingToCreate),
+	})
+
+	responseBytes, err := json.Marshal(GrantResponseBody{BindingID: bindingToCreate.BindingID})
+	if err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed response body")
+		utils.FailResponseWithCode(w, http.StatusInternalServerError, "failed response body creation", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+	if _, err := w.Write(responseBytes); err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response write")
+	}
+}
+
+// newAuditEntry returns the audit entry of a binding change, whose actor is the user resolved
+// evaluating the policy of the API.
+func newAuditEntry(r *http.Request, operation string, before, after *types.Binding) types.AuditEntry {
+	user, _ := mongoclient.ResolvedUser(r.Context())
+	return types.AuditEntry{
+		Operation:     operation,
+		Actor:         user.UserID,
+		Before:        before,
+		After:         after,
+		Timestamp:     time.Now().UTC(),
+		CorrelationID: utils.GetRequestID(r.Context()),
+	}
+}
+
+// writeAuditEntries writes the audit entries of the bindings changes. The changes are already
+// applied, so a failed write is only logged.
+func writeAuditEntries(r *http.Request, mongoClient types.IMongoClient, entries []types.AuditEntry) {
+	if err := mongoClient.InsertAuditEntries(r.Context(), entries); err != nil {
+		glogger.Get(r.Context()).WithFields(logrus.Fields{
+			"error":        logrus.Fields{"message": err.Error()},
+			"auditEntries": len(entries),
+		}).Error("failed bindings audit write")
+	}
+}
+
+// withStandalonePolicy protects the standalone API handler with the policy, evaluated with the
+// request and the user bindings as input. Without a policy all the requests are rejected, since
+// the API would let anyone change the bindings.
+func withStandalonePolicy(opaModuleConfig *core.OPAModuleConfig, policyName string, handler http.HandlerFunc) func(http.ResponseWriter, *http.Request) {
+	if policyName == "" {
+		return func(w http.ResponseWriter, r *http.Request) {
+			glogger.Get(r.Context()).Warn("standalone API request rejected: no policy configured")
+			utils.FailResponseWithCode(w, http.StatusForbidden, "no policy configured for the API", utils.NO_PERMISSIONS_ERROR_MESSAGE)
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := glogger.Get(r.Context()).WithField("policyName", policyName)
+		env, err := config.GetEnv(r.Context())
+		if err != nil {
+			utils.FailResponseWithCode(w, http.StatusInternalServerError, err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+
+		// the user resolved for the policy is the actor of the audit entries
+		r = r.WithContext(mongoclient.WithUserCache(r.Context()))
+		userInfo, err := mongoclient.RetrieveUserBindingsAndRoles(logger, r, env)
+		if err != nil {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed user bindings and roles retrieving")
+			utils.FailResponseWithCode(w, http.StatusInternalServerError, "user bindings retrieval failed", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+
+		input, err := core.CreateParsedRegoQueryInput(r, env, false, userInfo, nil)
+		if err != nil {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed rego query input creation")
+			utils.FailResponseWithCode(w, http.StatusInternalServerError, "RBAC input creation failed", utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+
+		ctx := openapi.WithRouterInfo(logger, r.Context(), r)
+		evaluator := core.NewOPAEvaluatorWithParsedInput(ctx, policyName, opaModuleConfig, input, env)
+		if _, err := evaluator.Evaluate(logger); err != nil {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("RBAC policy evaluation failed")
+			utils.FailResponseWithCode(w, http.StatusForbidden, "RBAC policy evaluation failed", utils.NO_PERMISSIONS_ERROR_MESSAGE)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// decodeRequestBody decodes the JSON request body, writing the failure response if it is not valid.
+// The body fields with an unexpected type are reported as validation errors.
+func decodeRequestBody(w http.ResponseWriter, r *http.Request, reqBody interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(reqBody)
+	if err == nil {
+		return true
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		utils.FailResponseWithValidationErrors(w, "invalid request body", utils.GENERIC_BUSINESS_ERROR_MESSAGE, []internaltypes.ValidationErrorDetail{
+			{
+				Field:   typeErr.Field,
+				Message: fmt.Sprintf("expected %s, got %s", jsonTypeName(typeErr.Type), typeErr.Value),
+				Code:    validationErrorCodeInvalidType,
+			},
+		})
+		return false
+	}
+	// the body is missing, malformed or truncated by the client
+	utils.FailResponseWithCode(w, http.StatusBadRequest, "invalid request body: "+err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+	return false
+}
+
+// jsonTypeName returns the JSON name of the type, to be shown to clients instead of the Go type.
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	default:
+		return "number"
+	}
+}
+
+func requiredOneOfValidationErrors(fields ...string) []internaltypes.ValidationErrorDetail {
+	message := fmt.Sprintf("one of %s is required", strings.Join(fields, ", "))
+	validationErrors := make([]internaltypes.ValidationErrorDetail, 0, len(fields))
+	for _, field := range fields {
+		validationErrors = append(validationErrors, internaltypes.ValidationErrorDetail{
+			Field:   field,
+			Message: message,
+			Code:    validationErrorCodeRequired,
+		})
+	}
+	return validationErrors
+}
+
 func buildQuery(resourceType string, resourceIDs []string, subjects []string, groups []string) ([]byte, error) {
+	return json.Marshal(buildBindingsFilter(resourceType, resourceIDs, subjects, groups))
+}
+
+// buildBindingsFilter builds the MongoDB filter of the bindings of the resources
+// with at least one of the subjects or groups.
+func buildBindingsFilter(resourceType string, resourceIDs []string, subjects []string, groups []string) map[string]interface{} {
 	queryPartForSubjectOrGroups := map[string]interface{}{
 		"$or": []map[string]interface{}{},
 	}
@@ -254,10 +535,10 @@ func buildQuery(resourceType string, resourceIDs []string, subjects []string, gr
 	}
 
 	if resourceType == "" {
-		return json.Marshal(queryPartForSubjectOrGroups)
+		return queryPartForSubjectOrGroups
 	}
 
-	query := map[string]interface{}{
+	return map[string]interface{}{
 		"$and": []map[string]interface{}{
 			{
 				"resource.resourceType": resourceType,
@@ -266,19 +547,20 @@ func buildQuery(resourceType string, resourceIDs []string, subjects []string, gr
 			queryPartForSubjectOrGroups,
 		},
 	}
-
-	return json.Marshal(query)
 }
 
-func buildQueryForBindingsToDelete(bindingsToDelete []types.Binding) ([]byte, error) {
-	bindingsIds := make([]string, len(bindingsToDelete))
-	for i := 0; i < len(bindingsToDelete); i++ {
-		bindingsIds[i] = bindingsToDelete[i].BindingID
+func bindingIDs(bindings []types.Binding) []string {
+	bindingsIds := make([]string, len(bindings))
+	for i := 0; i < len(bindings); i++ {
+		bindingsIds[i] = bindings[i].BindingID
 	}
+	return bindingsIds
+}
 
+func buildQueryForBindingsToDelete(bindingsToDelete []types.Binding) ([]byte, error) {
 	query := map[string]interface{}{
 		"bindingId": map[string]interface{}{
-			"$in": bindingsIds,
+			"$in": bindingIDs(bindingsToDelete),
 		},
 	}
 	return json.Marshal(query)
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -26,13 +27,22 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/rond-authz/rond/core"
 	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mocks"
+	"github.com/rond-authz/rond/internal/utils"
 	"github.com/rond-authz/rond/types"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/h2non/gock.v1"
 )
 
 func TestRevokeHandler(t *testing.T) {
+	defer gock.Off()
+
 	ctx := createContext(t,
 		context.Background(),
 		config.EnvironmentVariables{BindingsCrudServiceURL: "http://crud-service/bindings/"},
@@ -55,6 +65,41 @@ func TestRevokeHandler(t *testing.T) {
 		revokeHandler(w, req)
 
 		require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+		var response types.RequestError
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.Equal(t, []types.ValidationErrorDetail{
+			{Field: "subjects", Message: "one of subjects, groups is required", Code: "required"},
+			{Field: "groups", Message: "one of subjects, groups is required", Code: "required"},
+		}, response.ValidationErrors)
+	})
+
+	t.Run("400 on body fields with unexpected type", func(t *testing.T) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", bytes.NewBufferString(`{"subjects":"piero","resourceIds":["mike"]}`))
+		require.NoError(t, err, "unexpected error")
+		w := httptest.NewRecorder()
+
+		revokeHandler(w, req)
+
+		require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+		var response types.RequestError
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.Equal(t, "invalid request body", response.Error)
+		require.Equal(t, []types.ValidationErrorDetail{
+			{Field: "subjects", Message: "expected array, got string", Code: "invalid_type"},
+		}, response.ValidationErrors)
+	})
+
+	t.Run("400 on malformed body", func(t *testing.T) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", bytes.NewBufferString(`{"subjects":["piero"`))
+		require.NoError(t, err, "unexpected error")
+		w := httptest.NewRecorder()
+
+		revokeHandler(w, req)
+
+		require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+		var response types.RequestError
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.Equal(t, "invalid request body: unexpected EOF", response.Error)
 	})
 
 	t.Run("400 on missing resourceIds from body if resourceType request param is present", func(t *testing.T) {
@@ -510,6 +555,8 @@ func TestRevokeHandler(t *testing.T) {
 }
 
 func TestGrantHandler(t *testing.T) {
+	defer gock.Off()
+
 	ctx := createContext(t,
 		context.Background(),
 		config.EnvironmentVariables{BindingsCrudServiceURL: "http://crud-service/bindings/"},
@@ -530,6 +577,14 @@ func TestGrantHandler(t *testing.T) {
 		grantHandler(w, req)
 
 		require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+		var response types.RequestError
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.Len(t, response.ValidationErrors, 4)
+		require.Equal(t, types.ValidationErrorDetail{
+			Field:   "groups",
+			Message: "one of groups, permissions, subjects, roles is required",
+			Code:    "required",
+		}, response.ValidationErrors[0])
 	})
 
 	t.Run("400 on missing resourceId from body if resourceType request param is present", func(t *testing.T) {
@@ -549,6 +604,11 @@ func TestGrantHandler(t *testing.T) {
 		grantHandler(w, req)
 
 		require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+		var response types.RequestError
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.Equal(t, []types.ValidationErrorDetail{
+			{Field: "resourceId", Message: "must not be empty", Code: "required"},
+		}, response.ValidationErrors)
 	})
 
 	t.Run("performs correct API invocation insert bindings only on subject", func(t *testing.T) {
@@ -711,6 +771,301 @@ func TestGrantHandler(t *testing.T) {
 	})
 }
 
+func TestRevokeHandlerWithMongo(t *testing.T) {
+	env := config.EnvironmentVariables{}
+
+	t.Run("deletes and updates the bindings on MongoDB", func(t *testing.T) {
+		mongoClient := &mocks.MongoClientMock{
+			FindBindingsExpectation: func(filter map[string]interface{}) {
+				require.Equal(t, map[string]interface{}{
+					"$and": []map[string]interface{}{
+						{
+							"resource.resourceType": "my-resource",
+							"resource.resourceId":   map[string]interface{}{"$in": []string{"mike"}},
+						},
+						{
+							"$or": []map[string]interface{}{
+								{"subjects": map[string]interface{}{"$in": []string{"piero"}}},
+							},
+						},
+					},
+				}, filter)
+			},
+			FindBindingsResult: []types.Binding{
+				{
+					BindingID: "bindingToDelete",
+					Subjects:  []string{"piero"},
+					Resource:  &types.Resource{ResourceType: "my-resource", ResourceID: "mike"},
+				},
+				{
+					BindingID: "bindingToUpdate",
+					Subjects:  []string{"piero", "ignazio"},
+					Resource:  &types.Resource{ResourceType: "my-resource", ResourceID: "mike"},
+				},
+			},
+			DeleteBindingsExpectation: func(bindingIDs []string) {
+				require.Equal(t, []string{"bindingToDelete"}, bindingIDs)
+			},
+			UpdateBindingsSubjectsExpectation: func(bindings []types.Binding) {
+				require.Len(t, bindings, 1)
+				require.Equal(t, "bindingToUpdate", bindings[0].BindingID)
+				require.Equal(t, []string{"ignazio"}, bindings[0].Subjects)
+			},
+		}
+		ctx := createContext(t, context.Background(), env, mongoClient, nil, nil, nil)
+
+		reqBody := setupRevokeRequestBody(t, RevokeRequestBody{
+			Subjects:    []string{"piero"},
+			Groups:      []string{},
+			ResourceIDs: []string{"mike"},
+		})
+		req := requestWithParams(t, ctx, http.MethodPost, "/", bytes.NewBuffer(reqBody), map[string]string{
+			"resourceType": "my-resource",
+		})
+		w := httptest.NewRecorder()
+
+		revokeHandler(w, req)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		var response RevokeResponseBody
+		err := json.NewDecoder(w.Body).Decode(&response)
+		require.NoError(t, err)
+		require.Equal(t, RevokeResponseBody{DeletedBindings: 1, ModifiedBindings: 1}, response)
+	})
+
+	t.Run("writes the audit entries of the deleted and updated bindings", func(t *testing.T) {
+		env := config.EnvironmentVariables{UserIdHeader: "miauserid"}
+		bindingToDelete := types.Binding{
+			BindingID: "bindingToDelete",
+			Subjects:  []string{"piero"},
+			Resource:  &types.Resource{ResourceType: "my-resource", ResourceID: "mike"},
+		}
+		bindingToUpdate := types.Binding{
+			BindingID: "bindingToUpdate",
+			Subjects:  []string{"piero", "ignazio"},
+			Groups:    []string{"admin"},
+			Resource:  &types.Resource{ResourceType: "my-resource", ResourceID: "mike"},
+		}
+		var auditEntries []types.AuditEntry
+		mongoClient := &mocks.MongoClientMock{
+			FindBindingsResult: []types.Binding{bindingToDelete, bindingToUpdate},
+			InsertAuditEntriesExpectation: func(entries []types.AuditEntry) {
+				auditEntries = append(auditEntries, entries...)
+			},
+		}
+		ctx := utils.WithRequestID(createContext(t, context.Background(), env, mongoClient, nil, nil, nil), "request-id")
+
+		reqBody := setupRevokeRequestBody(t, RevokeRequestBody{Subjects: []string{"piero"}, ResourceIDs: []string{"mike"}})
+		req := requestWithParams(t, ctx, http.MethodPost, "/", bytes.NewBuffer(reqBody), map[string]string{
+			"resourceType": "my-resource",
+		})
+		req.Header.Set("miauserid", "the-actor")
+		w := httptest.NewRecorder()
+
+		withStandalonePolicy(allowAllModuleConfig, "allow", revokeHandler)(w, req)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Len(t, auditEntries, 2)
+		for _, entry := range auditEntries {
+			require.Equal(t, types.AuditOperationRevoke, entry.Operation)
+			require.Equal(t, "the-actor", entry.Actor)
+			require.Equal(t, "request-id", entry.CorrelationID)
+			require.False(t, entry.Timestamp.IsZero())
+		}
+		require.Equal(t, &bindingToDelete, auditEntries[0].Before)
+		require.Nil(t, auditEntries[0].After)
+		require.Equal(t, &bindingToUpdate, auditEntries[1].Before)
+		require.Equal(t, &types.Binding{
+			BindingID: "bindingToUpdate",
+			Subjects:  []string{"ignazio"},
+			Groups:    []string{"admin"},
+			Resource:  &types.Resource{ResourceType: "my-resource", ResourceID: "mike"},
+		}, auditEntries[1].After)
+	})
+
+	t.Run("500 on MongoDB find error", func(t *testing.T) {
+		mongoClient := &mocks.MongoClientMock{FindBindingsError: errors.New("some error")}
+		ctx := createContext(t, context.Background(), env, mongoClient, nil, nil, nil)
+
+		reqBody := setupRevokeRequestBody(t, RevokeRequestBody{Subjects: []string{"piero"}})
+		req := requestWithParams(t, ctx, http.MethodPost, "/", bytes.NewBuffer(reqBody), nil)
+		w := httptest.NewRecorder()
+
+		revokeHandler(w, req)
+
+		require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+	})
+}
+
+func TestGrantHandlerWithMongo(t *testing.T) {
+	env := config.EnvironmentVariables{}
+
+	t.Run("upserts the binding on MongoDB", func(t *testing.T) {
+		var upsertedBinding types.Binding
+		mongoClient := &mocks.MongoClientMock{
+			UpsertBindingExpectation: func(binding types.Binding) {
+				upsertedBinding = binding
+			},
+		}
+		ctx := createContext(t, context.Background(), env, mongoClient, nil, nil, nil)
+
+		reqBody := setupGrantRequestBody(t, GrantRequestBody{
+			Subjects:    []string{"piero"},
+			ResourceID:  "projectID",
+			Roles:       []string{"editor"},
+			Permissions: []string{"project.view"},
+		})
+		req := requestWithParams(t, ctx, http.MethodPost, "/", bytes.NewBuffer(reqBody), map[string]string{
+			"resourceType": "my-resource",
+		})
+		w := httptest.NewRecorder()
+
+		grantHandler(w, req)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		var response GrantResponseBody
+		err := json.NewDecoder(w.Body).Decode(&response)
+		require.NoError(t, err)
+		require.Equal(t, upsertedBinding.BindingID, response.BindingID)
+
+		upsertedBinding.BindingID = "REDACTED"
+		require.Equal(t, types.Binding{
+			BindingID:   "REDACTED",
+			Roles:       []string{"editor"},
+			Subjects:    []string{"piero"},
+			Permissions: []string{"project.view"},
+			Resource: &types.Resource{
+				ResourceType: "my-resource",
+				ResourceID:   "projectID",
+			},
+		}, upsertedBinding)
+	})
+
+	t.Run("writes the audit entry of the created binding", func(t *testing.T) {
+		env := config.EnvironmentVariables{UserIdHeader: "miauserid"}
+		var upsertedBinding types.Binding
+		var auditEntries []types.AuditEntry
+		mongoClient := &mocks.MongoClientMock{
+			UpsertBindingExpectation: func(binding types.Binding) {
+				upsertedBinding = binding
+			},
+			InsertAuditEntriesExpectation: func(entries []types.AuditEntry) {
+				auditEntries = append(auditEntries, entries...)
+			},
+		}
+		ctx := utils.WithRequestID(createContext(t, context.Background(), env, mongoClient, nil, nil, nil), "request-id")
+
+		reqBody := setupGrantRequestBody(t, GrantRequestBody{Subjects: []string{"piero"}, Roles: []string{"editor"}})
+		req := requestWithParams(t, ctx, http.MethodPost, "/", bytes.NewBuffer(reqBody), nil)
+		req.Header.Set("miauserid", "the-actor")
+		w := httptest.NewRecorder()
+
+		withStandalonePolicy(allowAllModuleConfig, "allow", grantHandler)(w, req)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Len(t, auditEntries, 1)
+		entry := auditEntries[0]
+		require.Equal(t, types.AuditOperationGrant, entry.Operation)
+		require.Equal(t, "the-actor", entry.Actor)
+		require.Equal(t, "request-id", entry.CorrelationID)
+		require.False(t, entry.Timestamp.IsZero())
+		require.Nil(t, entry.Before)
+		require.Equal(t, &upsertedBinding, entry.After)
+	})
+
+	t.Run("audit write error does not fail the grant", func(t *testing.T) {
+		log, hook := test.NewNullLogger()
+		upserted := false
+		mongoClient := &mocks.MongoClientMock{
+			UpsertBindingExpectation: func(binding types.Binding) {
+				upserted = true
+			},
+			InsertAuditEntriesError: errors.New("audit error"),
+		}
+		ctx := glogger.WithLogger(createContext(t, context.Background(), env, mongoClient, nil, nil, nil), logrus.NewEntry(log))
+
+		reqBody := setupGrantRequestBody(t, GrantRequestBody{Subjects: []string{"piero"}, Roles: []string{"editor"}})
+		req := requestWithParams(t, ctx, http.MethodPost, "/", bytes.NewBuffer(reqBody), nil)
+		w := httptest.NewRecorder()
+
+		grantHandler(w, req)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.True(t, upserted)
+		require.Equal(t, "failed bindings audit write", hook.LastEntry().Message)
+		require.Equal(t, logrus.Fields{"message": "audit error"}, hook.LastEntry().Data["error"])
+	})
+
+	t.Run("500 on MongoDB upsert error", func(t *testing.T) {
+		mongoClient := &mocks.MongoClientMock{UpsertBindingError: errors.New("some error")}
+		ctx := createContext(t, context.Background(), env, mongoClient, nil, nil, nil)
+
+		reqBody := setupGrantRequestBody(t, GrantRequestBody{Subjects: []string{"piero"}, Roles: []string{"editor"}})
+		req := requestWithParams(t, ctx, http.MethodPost, "/", bytes.NewBuffer(reqBody), nil)
+		w := httptest.NewRecorder()
+
+		grantHandler(w, req)
+
+		require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+	})
+}
+
+// allowAllModuleConfig lets the standalone APIs resolve the user, which is the audit actor.
+var allowAllModuleConfig = &core.OPAModuleConfig{
+	Name: "example.rego",
+	Content: `package policies
+	allow { true }`,
+}
+
+func TestWithStandalonePolicy(t *testing.T) {
+	opaModuleConfig := &core.OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		grant_allowed {
+			input.request.headers["X-Allowed"][0] == "true"
+		}`,
+	}
+	env := config.EnvironmentVariables{}
+	okHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	t.Run("403 if the policy is not set", func(t *testing.T) {
+		ctx := createContext(t, context.Background(), env, nil, nil, opaModuleConfig, nil)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Allowed", "true")
+		w := httptest.NewRecorder()
+
+		withStandalonePolicy(opaModuleConfig, "", okHandler)(w, req)
+
+		require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+	})
+
+	t.Run("calls the handler if the policy allows the request", func(t *testing.T) {
+		ctx := createContext(t, context.Background(), env, nil, nil, opaModuleConfig, nil)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Allowed", "true")
+		w := httptest.NewRecorder()
+
+		withStandalonePolicy(opaModuleConfig, "grant_allowed", okHandler)(w, req)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+
+	t.Run("403 if the policy denies the request", func(t *testing.T) {
+		ctx := createContext(t, context.Background(), env, nil, nil, opaModuleConfig, nil)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", nil)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+
+		withStandalonePolicy(opaModuleConfig, "grant_allowed", okHandler)(w, req)
+
+		require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+	})
+}
+
 func TestBindingsToUpdate(t *testing.T) {
 	t.Run("expect to generate correct bindings to update", func(t *testing.T) {
 		bindingsFromCrud := []types.Binding{
@@ -0,0 +1,65 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/rond-authz/rond/internal/utils"
+
+	"github.com/gorilla/mux"
+)
+
+var errSetupInProgress = errors.New("service setup in progress")
+
+// StartupHandler serves the status routes while the service is being set up, reporting it
+// as not ready, so that the probes are answered while the OAS is being fetched. Once the
+// setup completes, the requests are served by the handler set with Ready.
+type StartupHandler struct {
+	mtx     sync.RWMutex
+	handler http.Handler
+}
+
+// NewStartupHandler returns the handler of the service before its setup completes.
+func NewStartupHandler(serviceVersion string) *StartupHandler {
+	router := mux.NewRouter()
+	StatusRoutes(router, serviceName, serviceVersion, []ReadinessCheck{{
+		Name: "setup",
+		Check: func(ctx context.Context) error {
+			return errSetupInProgress
+		},
+	}})
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		utils.FailResponseWithCode(w, http.StatusServiceUnavailable, errSetupInProgress.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+	})
+	return &StartupHandler{handler: router}
+}
+
+// Ready replaces the startup routes with the handler of the service.
+func (h *StartupHandler) Ready(handler http.Handler) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.handler = handler
+}
+
+func (h *StartupHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.mtx.RLock()
+	handler := h.handler
+	h.mtx.RUnlock()
+	handler.ServeHTTP(w, req)
+}
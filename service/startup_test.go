@@ -0,0 +1,52 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartupHandler(t *testing.T) {
+	t.Run("reports the service as not ready until the setup completes", func(t *testing.T) {
+		handler := NewStartupHandler("0.0.0")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/rbac-healthz", nil))
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/rbac-ready", nil))
+		require.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/", nil))
+		require.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	})
+
+	t.Run("delegates to the service handler once ready", func(t *testing.T) {
+		handler := NewStartupHandler("0.0.0")
+		handler.Ready(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/rbac-ready", nil))
+		require.Equal(t, http.StatusTeapot, w.Result().StatusCode)
+	})
+}
@@ -15,20 +15,85 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mia-platform/glogger/v2"
+	"github.com/rond-authz/rond/core"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mongoclient"
 	"github.com/rond-authz/rond/internal/utils"
 	"github.com/sirupsen/logrus"
 )
 
 // StatusResponse type.
 type StatusResponse struct {
-	Status  string `json:"status"`
-	Name    string `json:"name"`
-	Version string `json:"version"`
+	Status  string                      `json:"status"`
+	Name    string                      `json:"name"`
+	Version string                      `json:"version"`
+	Checks  map[string]DependencyStatus `json:"checks,omitempty"`
+}
+
+// DependencyStatus is the result of a readiness check.
+type DependencyStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ReadinessCheck verifies that a dependency of the service is reachable.
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// readinessCheckTimeout bounds the time spent by all the readiness checks, which must
+// answer before the probe timeout.
+const readinessCheckTimeout = 1 * time.Second
+
+// ReadinessChecks returns the enabled readiness checks: MongoDB is verified only if configured,
+// while the target service is never verified in standalone mode. With PRE_WARM_ON_STARTUP
+// the service is ready once the policy evaluators are pre-warmed.
+func ReadinessChecks(env config.EnvironmentVariables, mongoClient *mongoclient.MongoClient, oasStore *core.OASStore) []ReadinessCheck {
+	checks := []ReadinessCheck{}
+	if env.PreWarmOnStartup && oasStore != nil {
+		checks = append(checks, ReadinessCheck{Name: "policyEvaluators", Check: oasStore.PreWarmCheck})
+	}
+	if env.ReadinessCheckMongo && mongoClient != nil {
+		checks = append(checks, ReadinessCheck{Name: "mongo", Check: mongoClient.Ping})
+	}
+	if env.ReadinessCheckTarget && !env.Standalone && env.TargetServiceHost != "" {
+		checks = append(checks, ReadinessCheck{Name: "targetService", Check: targetServiceCheck(env)})
+	}
+	return checks
+}
+
+// targetServiceCheck verifies the target service is reachable requesting its OAS path,
+// or its root path when the OAS is read from a local file.
+func targetServiceCheck(env config.EnvironmentVariables) func(ctx context.Context) error {
+	targetPath := env.TargetServiceOASPath
+	if _, ok := env.GetLocalOASFilePath(); ok {
+		targetPath = "/"
+	}
+	targetURL := fmt.Sprintf("%s://%s%s", URL_SCHEME, env.TargetServiceHost, targetPath)
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, targetURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		return nil
+	}
 }
 
 func handleStatusRoutes(w http.ResponseWriter, serviceName, serviceVersion string) (*StatusResponse, []byte) {
@@ -47,7 +112,15 @@ func handleStatusRoutes(w http.ResponseWriter, serviceName, serviceVersion strin
 	return &status, body
 }
 
-var statusRoutes = []string{"/-/rbac-healthz", "/-/rbac-ready", "/-/rbac-check-up"}
+const (
+	regoFingerprintRoutePath = "/_status/rego-fingerprint"
+	mongoPoolRoutePath       = "/_status/mongo-pool"
+	warmupRoutePath          = "/-/warmup"
+	versionRoutePath         = "/-/rbac-version"
+	policyDiffRoutePath      = "/-/policies/diff"
+)
+
+var statusRoutes = []string{"/-/rbac-healthz", "/-/rbac-ready", "/-/rbac-check-up", regoFingerprintRoutePath, mongoPoolRoutePath, warmupRoutePath, versionRoutePath, policyDiffRoutePath}
 
 func handleStatusEndpoint(serviceName, serviceVersion string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
@@ -59,12 +132,156 @@ func handleStatusEndpoint(serviceName, serviceVersion string) func(http.Response
 	}
 }
 
-// StatusRoutes add status routes to router.
-func StatusRoutes(r *mux.Router, serviceName, serviceVersion string) {
+// handleReadinessEndpoint responds with the status of every readiness check, and with
+// 503 status code if any of them fails.
+func handleReadinessEndpoint(serviceName, serviceVersion string, readinessChecks []ReadinessCheck) func(http.ResponseWriter, *http.Request) {
+	if len(readinessChecks) == 0 {
+		return handleStatusEndpoint(serviceName, serviceVersion)
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		logger := glogger.Get(req.Context())
+		ctx, cancel := context.WithTimeout(req.Context(), readinessCheckTimeout)
+		defer cancel()
+
+		status := StatusResponse{
+			Status:  "OK",
+			Name:    serviceName,
+			Version: serviceVersion,
+			Checks:  map[string]DependencyStatus{},
+		}
+		for _, readinessCheck := range readinessChecks {
+			if err := readinessCheck.Check(ctx); err != nil {
+				logger.WithFields(logrus.Fields{
+					"dependency": readinessCheck.Name,
+					"error":      logrus.Fields{"message": err.Error()},
+				}).Warn("readiness check failed")
+				status.Status = "KO"
+				status.Checks[readinessCheck.Name] = DependencyStatus{Status: "KO", Error: err.Error()}
+				continue
+			}
+			status.Checks[readinessCheck.Name] = DependencyStatus{Status: "OK"}
+		}
+
+		body, err := json.Marshal(&status)
+		if err != nil {
+			utils.FailResponseWithCode(w, http.StatusInternalServerError, err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		w.Header().Add(utils.ContentTypeHeaderKey, utils.JSONContentTypeHeader)
+		if status.Status != "OK" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if _, err := w.Write(body); err != nil {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response write")
+		}
+	}
+}
+
+// StatusRoutes add status routes to router. The healthz route is a cheap liveness check,
+// while the ready route also runs the readiness checks.
+func StatusRoutes(r *mux.Router, serviceName, serviceVersion string, readinessChecks []ReadinessCheck) {
 	statusEndpointHandler := handleStatusEndpoint(serviceName, serviceVersion)
 	r.HandleFunc("/-/rbac-healthz", statusEndpointHandler)
 
-	r.HandleFunc("/-/rbac-ready", statusEndpointHandler)
+	r.HandleFunc("/-/rbac-ready", handleReadinessEndpoint(serviceName, serviceVersion, readinessChecks))
 
 	r.HandleFunc("/-/rbac-check-up", statusEndpointHandler)
 }
+
+// RegoFingerprintResponse type.
+type RegoFingerprintResponse struct {
+	Fingerprint string `json:"fingerprint"`
+}
+
+// RegoFingerprintRoute adds the route exposing the fingerprint of the loaded rego module.
+func RegoFingerprintRoute(r *mux.Router, opaModuleConfig *core.OPAModuleConfig) {
+	r.HandleFunc(regoFingerprintRoutePath, func(w http.ResponseWriter, req *http.Request) {
+		response := RegoFingerprintResponse{}
+		if opaModuleConfig != nil {
+			response.Fingerprint = opaModuleConfig.Fingerprint
+		}
+		body, err := json.Marshal(response)
+		if err != nil {
+			utils.FailResponseWithCode(w, http.StatusInternalServerError, err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		w.Header().Add(utils.ContentTypeHeaderKey, utils.JSONContentTypeHeader)
+		if _, err := w.Write(body); err != nil {
+			logger := glogger.Get(req.Context())
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response write")
+		}
+	}).Methods(http.MethodGet)
+}
+
+// VersionResponse type.
+type VersionResponse struct {
+	Version           string `json:"version"`
+	PolicyFingerprint string `json:"policyFingerprint"`
+}
+
+// VersionRoute adds the route exposing the service version along with the fingerprint
+// of the loaded rego module, to check which policies build each instance runs.
+func VersionRoute(r *mux.Router, serviceVersion string, opaModuleConfig *core.OPAModuleConfig) {
+	r.HandleFunc(versionRoutePath, func(w http.ResponseWriter, req *http.Request) {
+		response := VersionResponse{Version: serviceVersion}
+		if opaModuleConfig != nil {
+			response.PolicyFingerprint = opaModuleConfig.Fingerprint
+		}
+		body, err := json.Marshal(response)
+		if err != nil {
+			utils.FailResponseWithCode(w, http.StatusInternalServerError, err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		w.Header().Add(utils.ContentTypeHeaderKey, utils.JSONContentTypeHeader)
+		if _, err := w.Write(body); err != nil {
+			logger := glogger.Get(req.Context())
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response write")
+		}
+	}).Methods(http.MethodGet)
+}
+
+// MongoPoolRoute adds the route exposing the usage of the MongoDB connection pool,
+// the statistics are all zero when MongoDB is not configured.
+func MongoPoolRoute(r *mux.Router, mongoClient *mongoclient.MongoClient) {
+	r.HandleFunc(mongoPoolRoutePath, func(w http.ResponseWriter, req *http.Request) {
+		body, err := json.Marshal(mongoClient.PoolStats())
+		if err != nil {
+			utils.FailResponseWithCode(w, http.StatusInternalServerError, err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		w.Header().Add(utils.ContentTypeHeaderKey, utils.JSONContentTypeHeader)
+		if _, err := w.Write(body); err != nil {
+			logger := glogger.Get(req.Context())
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response write")
+		}
+	}).Methods(http.MethodGet)
+}
+
+// WarmupResponse type.
+type WarmupResponse struct {
+	Evaluators int `json:"evaluators"`
+}
+
+// WarmupRoute adds the route computing synchronously the policy evaluators whose creation
+// is deferred to the first request by LAZY_EVALUATOR_INIT. The evaluators are read from the
+// store on each request, so that the ones of a refreshed OAS are computed.
+func WarmupRoute(r *mux.Router, oasStore *core.OASStore) {
+	r.HandleFunc(warmupRoutePath, func(w http.ResponseWriter, req *http.Request) {
+		logger := glogger.Get(req.Context())
+		policiesEvaluators := oasStore.Evaluators()
+		if err := policiesEvaluators.Warmup(); err != nil {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("policy evaluators warm-up failed")
+			utils.FailResponseWithCode(w, http.StatusInternalServerError, err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		body, err := json.Marshal(WarmupResponse{Evaluators: len(policiesEvaluators)})
+		if err != nil {
+			utils.FailResponseWithCode(w, http.StatusInternalServerError, err.Error(), utils.GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		w.Header().Add(utils.ContentTypeHeaderKey, utils.JSONContentTypeHeader)
+		if _, err := w.Write(body); err != nil {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response write")
+		}
+	}).Methods(http.MethodGet)
+}
@@ -20,6 +20,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/mia-platform/glogger/v2"
@@ -38,7 +39,7 @@ func TestStatusRoutes(testCase *testing.T) {
 	testRouter := mux.NewRouter()
 	serviceName := "my-service-name"
 	serviceVersion := "0.0.0"
-	StatusRoutes(testRouter, serviceName, serviceVersion)
+	StatusRoutes(testRouter, serviceName, serviceVersion, nil)
 
 	testCase.Run("/-/rbac-healthz - ok", func(t *testing.T) {
 		expectedResponse := fmt.Sprintf("{\"status\":\"OK\",\"name\":\"%s\",\"version\":\"%s\"}", serviceName, serviceVersion)
@@ -89,6 +90,250 @@ func TestStatusRoutes(testCase *testing.T) {
 	})
 }
 
+func TestRegoFingerprintRoute(t *testing.T) {
+	testRouter := mux.NewRouter()
+	RegoFingerprintRoute(testRouter, &core.OPAModuleConfig{
+		Name:        "policies.rego",
+		Content:     "package policies",
+		Fingerprint: "some-fingerprint",
+	})
+
+	t.Run("returns the module fingerprint", func(t *testing.T) {
+		responseRecorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/_status/rego-fingerprint", nil)
+
+		testRouter.ServeHTTP(responseRecorder, request)
+		require.Equal(t, http.StatusOK, responseRecorder.Result().StatusCode)
+		require.Equal(t, "application/json", responseRecorder.Result().Header.Get("Content-Type"))
+		body, err := io.ReadAll(responseRecorder.Result().Body)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"fingerprint":"some-fingerprint"}`, string(body))
+	})
+
+	t.Run("only GET is allowed", func(t *testing.T) {
+		responseRecorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/_status/rego-fingerprint", nil)
+
+		testRouter.ServeHTTP(responseRecorder, request)
+		require.Equal(t, http.StatusMethodNotAllowed, responseRecorder.Result().StatusCode)
+	})
+}
+
+func TestVersionRoute(t *testing.T) {
+	testRouter := mux.NewRouter()
+	VersionRoute(testRouter, "1.6.0", &core.OPAModuleConfig{
+		Name:        "policies.rego",
+		Content:     "package policies",
+		Fingerprint: "some-fingerprint",
+	})
+
+	t.Run("returns the service version and the module fingerprint", func(t *testing.T) {
+		responseRecorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/-/rbac-version", nil)
+
+		testRouter.ServeHTTP(responseRecorder, request)
+		require.Equal(t, http.StatusOK, responseRecorder.Result().StatusCode)
+		require.Equal(t, "application/json", responseRecorder.Result().Header.Get("Content-Type"))
+		body, err := io.ReadAll(responseRecorder.Result().Body)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"version":"1.6.0","policyFingerprint":"some-fingerprint"}`, string(body))
+	})
+}
+
+func TestMongoPoolRoute(t *testing.T) {
+	testRouter := mux.NewRouter()
+	var mongoClient *mongoclient.MongoClient
+	MongoPoolRoute(testRouter, mongoClient)
+
+	t.Run("returns empty stats without MongoDB", func(t *testing.T) {
+		responseRecorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/_status/mongo-pool", nil)
+
+		testRouter.ServeHTTP(responseRecorder, request)
+		require.Equal(t, http.StatusOK, responseRecorder.Result().StatusCode)
+		require.Equal(t, "application/json", responseRecorder.Result().Header.Get("Content-Type"))
+		body, err := io.ReadAll(responseRecorder.Result().Body)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"checkedOut":0,"available":0}`, string(body))
+	})
+
+	t.Run("only GET is allowed", func(t *testing.T) {
+		responseRecorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/_status/mongo-pool", nil)
+
+		testRouter.ServeHTTP(responseRecorder, request)
+		require.Equal(t, http.StatusMethodNotAllowed, responseRecorder.Result().StatusCode)
+	})
+}
+
+func TestWarmupRoute(t *testing.T) {
+	opaModuleConfig := &core.OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow_users { true }
+allow_orders { true }`,
+	}
+	setupEvaluators := func(t *testing.T, policyName string) (*openapi.OpenAPISpec, core.PartialResultsEvaluators) {
+		t.Helper()
+		oas := &openapi.OpenAPISpec{
+			Paths: openapi.OpenAPIPaths{
+				"/resources": openapi.PathVerbs{
+					"get": openapi.VerbConfig{PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: policyName}}},
+				},
+			},
+		}
+		evaluators, _, err := core.SetupEvaluators(context.Background(), nil, oas, opaModuleConfig, config.EnvironmentVariables{LazyEvaluatorInit: true})
+		require.NoError(t, err)
+		return oas, evaluators
+	}
+
+	oasStore := core.NewOASStore(setupEvaluators(t, "allow_users"))
+	testRouter := mux.NewRouter()
+	WarmupRoute(testRouter, oasStore)
+
+	refreshedOAS, refreshedEvaluators := setupEvaluators(t, "allow_orders")
+	oasStore.Replace(refreshedOAS, refreshedEvaluators)
+
+	responseRecorder := httptest.NewRecorder()
+	testRouter.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, "/-/warmup", nil))
+	require.Equal(t, http.StatusOK, responseRecorder.Result().StatusCode)
+	require.JSONEq(t, `{"evaluators":1}`, responseRecorder.Body.String())
+	require.True(t, refreshedEvaluators.Compiled(core.EvaluatorKey{PolicyName: "allow_orders"}))
+}
+
+func TestReadinessRoute(t *testing.T) {
+	serviceName := "my-service-name"
+	serviceVersion := "0.0.0"
+
+	t.Run("not ready until MongoDB is reachable", func(t *testing.T) {
+		mongoReachable := false
+		testRouter := mux.NewRouter()
+		StatusRoutes(testRouter, serviceName, serviceVersion, []ReadinessCheck{
+			{
+				Name: "mongo",
+				Check: func(ctx context.Context) error {
+					if !mongoReachable {
+						return fmt.Errorf("server selection timeout")
+					}
+					return nil
+				},
+			},
+		})
+
+		t.Run("ready before mongo", func(t *testing.T) {
+			responseRecorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, "/-/rbac-ready", nil)
+			testRouter.ServeHTTP(responseRecorder, request)
+
+			require.Equal(t, http.StatusServiceUnavailable, responseRecorder.Result().StatusCode)
+			require.Equal(t, "application/json", responseRecorder.Result().Header.Get("Content-Type"))
+			body, err := io.ReadAll(responseRecorder.Result().Body)
+			require.NoError(t, err)
+			require.JSONEq(t, `{
+				"status": "KO",
+				"name": "my-service-name",
+				"version": "0.0.0",
+				"checks": {"mongo": {"status": "KO", "error": "server selection timeout"}}
+			}`, string(body))
+		})
+
+		t.Run("healthz does not verify mongo", func(t *testing.T) {
+			responseRecorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, "/-/rbac-healthz", nil)
+			testRouter.ServeHTTP(responseRecorder, request)
+
+			require.Equal(t, http.StatusOK, responseRecorder.Result().StatusCode)
+		})
+
+		t.Run("ready after mongo", func(t *testing.T) {
+			mongoReachable = true
+			responseRecorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, "/-/rbac-ready", nil)
+			testRouter.ServeHTTP(responseRecorder, request)
+
+			require.Equal(t, http.StatusOK, responseRecorder.Result().StatusCode)
+			body, err := io.ReadAll(responseRecorder.Result().Body)
+			require.NoError(t, err)
+			require.JSONEq(t, `{
+				"status": "OK",
+				"name": "my-service-name",
+				"version": "0.0.0",
+				"checks": {"mongo": {"status": "OK"}}
+			}`, string(body))
+		})
+	})
+
+	t.Run("verifies the target service OAS path", func(t *testing.T) {
+		var requestedMethod, requestedPath string
+		targetStatusCode := http.StatusOK
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestedMethod = r.Method
+			requestedPath = r.URL.Path
+			w.WriteHeader(targetStatusCode)
+		}))
+		defer server.Close()
+		serverURL, err := url.Parse(server.URL)
+		require.NoError(t, err)
+
+		testRouter := mux.NewRouter()
+		StatusRoutes(testRouter, serviceName, serviceVersion, ReadinessChecks(config.EnvironmentVariables{
+			TargetServiceHost:    serverURL.Host,
+			TargetServiceOASPath: "/documentation/json",
+			ReadinessCheckTarget: true,
+		}, nil, nil))
+
+		responseRecorder := httptest.NewRecorder()
+		testRouter.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, "/-/rbac-ready", nil))
+		require.Equal(t, http.StatusOK, responseRecorder.Result().StatusCode)
+		require.Equal(t, http.MethodHead, requestedMethod)
+		require.Equal(t, "/documentation/json", requestedPath)
+
+		targetStatusCode = http.StatusBadGateway
+		responseRecorder = httptest.NewRecorder()
+		testRouter.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, "/-/rbac-ready", nil))
+		require.Equal(t, http.StatusServiceUnavailable, responseRecorder.Result().StatusCode)
+		body, err := io.ReadAll(responseRecorder.Result().Body)
+		require.NoError(t, err)
+		require.Contains(t, string(body), `"targetService":{"status":"KO","error":"unexpected status code 502"}`)
+	})
+}
+
+func TestReadinessChecks(t *testing.T) {
+	checkNames := func(checks []ReadinessCheck) []string {
+		names := []string{}
+		for _, check := range checks {
+			names = append(names, check.Name)
+		}
+		return names
+	}
+
+	t.Run("mongo check is skipped if MongoDB is not configured", func(t *testing.T) {
+		checks := ReadinessChecks(config.EnvironmentVariables{ReadinessCheckMongo: true}, nil, nil)
+		require.Empty(t, checks)
+	})
+
+	t.Run("target service check is enabled by env", func(t *testing.T) {
+		env := config.EnvironmentVariables{TargetServiceHost: "my-service:4444"}
+		require.Empty(t, checkNames(ReadinessChecks(env, nil, nil)))
+
+		env.ReadinessCheckTarget = true
+		require.Equal(t, []string{"targetService"}, checkNames(ReadinessChecks(env, nil, nil)))
+	})
+
+	t.Run("policy evaluators check is enabled by the pre-warm", func(t *testing.T) {
+		oasStore := core.NewOASStore(&openapi.OpenAPISpec{}, core.PartialResultsEvaluators{})
+		require.Empty(t, ReadinessChecks(config.EnvironmentVariables{}, nil, oasStore))
+
+		env := config.EnvironmentVariables{PreWarmOnStartup: true}
+		require.Equal(t, []string{"policyEvaluators"}, checkNames(ReadinessChecks(env, nil, oasStore)))
+	})
+
+	t.Run("target service check is skipped in standalone mode", func(t *testing.T) {
+		env := config.EnvironmentVariables{Standalone: true, TargetServiceHost: "my-service:4444", ReadinessCheckTarget: true}
+		require.Empty(t, ReadinessChecks(env, nil, nil))
+	})
+}
+
 func TestStatusRoutesIntegration(t *testing.T) {
 	envs := config.EnvironmentVariables{}
 	log, _ := test.NewNullLogger()
@@ -113,7 +358,7 @@ test_policy { true }
 	}
 
 	var mongoClient *mongoclient.MongoClient
-	evaluatorsMap, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, envs)
+	evaluatorsMap, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, envs)
 	require.NoError(t, err, "unexpected error")
 
 	t.Run("non standalone", func(t *testing.T) {
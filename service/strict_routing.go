@@ -0,0 +1,72 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rond-authz/rond/core"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/utils"
+	"github.com/rond-authz/rond/openapi"
+
+	"github.com/gorilla/mux"
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// knownPathMatcher matches the requests whose path is defined in the OAS, whatever the
+// method. With STRICT_ROUTING the fallback route is restricted by this matcher, so that
+// only the methods not defined for a known path reach the OPAMiddleware, which rejects
+// or proxies them.
+func knownPathMatcher(oasStore *core.OASStore, env config.EnvironmentVariables) mux.MatcherFunc {
+	return func(r *http.Request, _ *mux.RouteMatch) bool {
+		return oasStore.KnownPath(oasRequestPath(r, env))
+	}
+}
+
+// pathPatternMatcher matches the requests whose path matches the prefix or regex path of the OAS.
+func pathPatternMatcher(pattern openapi.PathPattern, env config.EnvironmentVariables) mux.MatcherFunc {
+	return func(r *http.Request, _ *mux.RouteMatch) bool {
+		return pattern.Match(oasRequestPath(r, env))
+	}
+}
+
+// oasRequestPath returns the requested path as defined in the OAS, without the standalone
+// path prefix and lowercased with case-insensitive routing.
+func oasRequestPath(r *http.Request, env config.EnvironmentVariables) string {
+	path := r.URL.EscapedPath()
+	if env.Standalone {
+		path = strings.Replace(path, env.PathPrefixStandalone, "", 1)
+	}
+	if env.CaseInsensitiveRouting {
+		path = strings.ToLower(path)
+	}
+	return path
+}
+
+// strictRoutingNotFoundHandler responds to the requests not matching any route when
+// STRICT_ROUTING is set, so that they never reach the target service.
+func strictRoutingNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	errorMessage := "The request doesn't match any known API"
+	technicalError := fmt.Sprintf("%s: %s %s", openapi.ErrNotFoundOASDefinition, utils.SanitizeString(r.Method), utils.SanitizeString(r.URL.Path))
+	glogger.Get(r.Context()).WithFields(logrus.Fields{
+		"originalRequestPath": utils.SanitizeString(r.URL.Path),
+		"method":              utils.SanitizeString(r.Method),
+	}).Warn(errorMessage)
+	utils.FailResponseWithCode(w, http.StatusNotFound, technicalError, errorMessage)
+}
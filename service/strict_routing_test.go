@@ -0,0 +1,165 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/rond-authz/rond/core"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/openapi"
+	"github.com/rond-authz/rond/types"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStrictRouting(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+
+	opa := &core.OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow { true }
+`,
+	}
+	oas := &openapi.OpenAPISpec{
+		Paths: openapi.OpenAPIPaths{
+			"/users": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{RequestFlow: openapi.RequestFlow{PolicyName: "allow"}},
+				},
+			},
+			"/public": openapi.PathVerbs{
+				"get": openapi.VerbConfig{
+					PermissionV2: &openapi.RondConfig{
+						RequestFlow: openapi.RequestFlow{PolicyName: "allow"},
+						Options:     openapi.PermissionOptions{ProxyUnknownMethods: true},
+					},
+				},
+			},
+		},
+	}
+
+	var mongoClient *mongoclient.MongoClient
+	evaluatorsMap, _, err := core.SetupEvaluators(ctx, mongoClient, oas, opa, config.EnvironmentVariables{})
+	require.NoError(t, err, "unexpected error")
+
+	var invokedPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		invokedPath = r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	env := config.EnvironmentVariables{
+		TargetServiceHost:    serverURL.Host,
+		TargetServiceOASPath: "/documentation/json",
+		StrictRouting:        true,
+	}
+	router, err := SetupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+	require.NoError(t, err, "unexpected error")
+
+	t.Run("responds 404 on unknown paths", func(t *testing.T) {
+		invokedPath = ""
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+
+		require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+		var requestError types.RequestError
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&requestError))
+		require.Equal(t, types.RequestError{
+			StatusCode: http.StatusNotFound,
+			Error:      "not found oas definition: GET /unknown",
+			Message:    "The request doesn't match any known API",
+		}, requestError)
+		require.Empty(t, invokedPath, "target service must not be contacted")
+	})
+
+	t.Run("proxies known paths", func(t *testing.T) {
+		invokedPath = ""
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users", nil))
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Equal(t, "/users", invokedPath)
+	})
+
+	t.Run("responds 405 on a method not defined for a known path", func(t *testing.T) {
+		invokedPath = ""
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/users", nil))
+
+		require.Equal(t, http.StatusMethodNotAllowed, w.Result().StatusCode)
+		require.Equal(t, "GET, HEAD", w.Result().Header.Get("Allow"))
+		require.Empty(t, invokedPath, "target service must not be contacted")
+	})
+
+	t.Run("proxies a method not defined for a path opted out", func(t *testing.T) {
+		invokedPath = ""
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/public", nil))
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Equal(t, "/public", invokedPath)
+	})
+
+	t.Run("proxies the documentation path", func(t *testing.T) {
+		invokedPath = ""
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/documentation/json", nil))
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Equal(t, "/documentation/json", invokedPath)
+	})
+
+	t.Run("exposes status routes", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/rbac-healthz", nil))
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+
+	t.Run("responds 404 on unknown paths in standalone mode", func(t *testing.T) {
+		standaloneEnv := env
+		standaloneEnv.Standalone = true
+		standaloneEnv.PathPrefixStandalone = "/eval"
+		standaloneEnv.ServiceVersion = "latest"
+		router, err := SetupRouter(log, standaloneEnv, opa, oas, evaluatorsMap, mongoClient)
+		require.NoError(t, err, "unexpected error")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/eval/unknown", nil))
+		require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/eval/users", nil))
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi/json", nil))
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+}
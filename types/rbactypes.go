@@ -16,13 +16,15 @@ package types
 
 import (
 	"context"
+	"time"
 )
 
 type User struct {
-	UserID       string
-	UserGroups   []string
-	UserRoles    []Role
-	UserBindings []Binding
+	UserID         string
+	UserGroups     []string
+	UserRoles      []Role
+	UserBindings   []Binding
+	IdentitySource string
 }
 
 type MongoClientContextKey struct{}
@@ -33,13 +35,19 @@ type Resource struct {
 }
 
 type Binding struct {
-	Resource          *Resource `bson:"resource" json:"resource,omitempty"`
-	BindingID         string    `bson:"bindingId" json:"bindingId"`
-	CRUDDocumentState string    `bson:"__STATE__" json:"-"`
-	Groups            []string  `bson:"groups" json:"groups,omitempty"`
-	Subjects          []string  `bson:"subjects" json:"subjects,omitempty"`
-	Permissions       []string  `bson:"permissions" json:"permissions,omitempty"`
-	Roles             []string  `bson:"roles" json:"roles,omitempty"`
+	Resource          *Resource  `bson:"resource" json:"resource,omitempty"`
+	BindingID         string     `bson:"bindingId" json:"bindingId"`
+	CRUDDocumentState string     `bson:"__STATE__" json:"-"`
+	Groups            []string   `bson:"groups" json:"groups,omitempty"`
+	Subjects          []string   `bson:"subjects" json:"subjects,omitempty"`
+	Permissions       []string   `bson:"permissions" json:"permissions,omitempty"`
+	Roles             []string   `bson:"roles" json:"roles,omitempty"`
+	ExpiresAt         *time.Time `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+}
+
+// IsExpired reports whether the binding has an expiration date before now.
+func (binding Binding) IsExpired(now time.Time) bool {
+	return binding.ExpiresAt != nil && binding.ExpiresAt.Before(now)
 }
 
 type BindingFilter struct {
@@ -55,6 +63,23 @@ type BindingCreateResponse struct {
 	ObjectID string `json:"_id"`
 }
 
+const (
+	AuditOperationGrant  = "grant"
+	AuditOperationRevoke = "revoke"
+)
+
+// AuditEntry records a change to a binding made through the grant and revoke APIs, with the
+// binding before and after the change: Before is nil for a created binding, After is nil for
+// a deleted one.
+type AuditEntry struct {
+	Operation     string    `bson:"operation" json:"operation"`
+	Actor         string    `bson:"actor" json:"actor"`
+	Before        *Binding  `bson:"before" json:"before"`
+	After         *Binding  `bson:"after" json:"after"`
+	Timestamp     time.Time `bson:"timestamp" json:"timestamp"`
+	CorrelationID string    `bson:"correlationId" json:"correlationId"`
+}
+
 type Role struct {
 	RoleID            string   `bson:"roleId" json:"roleId"`
 	CRUDDocumentState string   `bson:"__STATE__" json:"-"`
@@ -72,10 +97,26 @@ type IMongoClient interface {
 
 	FindOne(ctx context.Context, collectionName string, query map[string]interface{}) (interface{}, error)
 	FindMany(ctx context.Context, collectionName string, query map[string]interface{}) ([]interface{}, error)
+	FindAggregate(ctx context.Context, collectionName string, pipeline []interface{}) ([]interface{}, error)
+
+	FindBindings(ctx context.Context, filter map[string]interface{}) ([]Binding, error)
+	UpsertBinding(ctx context.Context, binding Binding) error
+	DeleteBindings(ctx context.Context, bindingIDs []string) (int64, error)
+	UpdateBindingsSubjects(ctx context.Context, bindings []Binding) (int64, error)
+
+	InsertAuditEntries(ctx context.Context, entries []AuditEntry) error
 }
 
 type RequestError struct {
-	Error      string `json:"error"`
-	Message    string `json:"message"`
-	StatusCode int    `json:"statusCode"`
+	Error            string                  `json:"error"`
+	Message          string                  `json:"message"`
+	StatusCode       int                     `json:"statusCode"`
+	ValidationErrors []ValidationErrorDetail `json:"validationErrors,omitempty"`
+}
+
+// ValidationErrorDetail describes why a field of the request body is not valid.
+type ValidationErrorDetail struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+	Code    string `json:"code"`
 }
@@ -0,0 +1,213 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package usersignature signs the user headers forwarded by rond to the target service,
+// and lets the target service verify that they were not set by a client reaching it directly.
+//
+// The signature header has the form
+//
+//	t=<unix timestamp>,v1=<hex signature>[,v1=<hex signature>]
+//
+// where each signature is the HMAC-SHA256 of the payload
+//
+//	<unix timestamp>\n<method>\n<escaped path>\n<user id header value>\n<user groups header value>
+//
+// binding the user to the request it was resolved for, so that a signature can not be
+// replayed on other requests of the tolerance window.
+//
+// computed with one of the configured keys. During a key rotation rond signs with both the
+// primary and the secondary key, so target services configured with either of them accept
+// the request.
+package usersignature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultHeader is the header set by rond when USER_SIGNATURE_HEADER is not set.
+	DefaultHeader = "x-rond-user-signature"
+	// DefaultUserIDHeader and DefaultUserGroupsHeader are the rond defaults of
+	// USER_ID_HEADER_KEY and USER_GROUPS_HEADER_KEY.
+	DefaultUserIDHeader     = "miauserid"
+	DefaultUserGroupsHeader = "miausergroups"
+	// DefaultTolerance is the allowed clock skew between rond and the target service.
+	DefaultTolerance = 5 * time.Minute
+
+	timestampKey = "t"
+	signatureKey = "v1"
+)
+
+var (
+	ErrMissingSignature   = errors.New("missing user signature")
+	ErrMalformedSignature = errors.New("malformed user signature")
+	ErrExpiredSignature   = errors.New("user signature timestamp outside tolerance")
+	ErrInvalidSignature   = errors.New("invalid user signature")
+	ErrNoKeys             = errors.New("no user signature keys")
+)
+
+// Payload is the signed data of a request: the user headers forwarded to the target
+// service together with the request method and escaped path.
+type Payload struct {
+	Method     string
+	Path       string
+	UserID     string
+	UserGroups string
+}
+
+// RequestPayload returns the payload of the request, reading the user from its headers.
+func RequestPayload(req *http.Request, userIDHeader, userGroupsHeader string) Payload {
+	return Payload{
+		Method:     req.Method,
+		Path:       req.URL.EscapedPath(),
+		UserID:     req.Header.Get(userIDHeader),
+		UserGroups: req.Header.Get(userGroupsHeader),
+	}
+}
+
+// Sign returns the signature header value of the payload at the given time, with
+// a signature for each of the non empty keys.
+func Sign(timestamp time.Time, payload Payload, keys ...string) string {
+	unix := timestamp.Unix()
+	parts := []string{fmt.Sprintf("%s=%d", timestampKey, unix)}
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s=%s", signatureKey, hex.EncodeToString(computeMAC(key, unix, payload))))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Verify checks the signature header value against the payload. The value is accepted
+// when its timestamp is within tolerance from now, in both directions, and one of its
+// signatures matches one of the keys.
+func Verify(value string, payload Payload, now time.Time, tolerance time.Duration, keys ...string) error {
+	if value == "" {
+		return ErrMissingSignature
+	}
+	timestamp, signatures, err := parse(value)
+	if err != nil {
+		return err
+	}
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew > tolerance || skew < -tolerance {
+		return ErrExpiredSignature
+	}
+
+	validKeys := 0
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		validKeys++
+		expected := computeMAC(key, timestamp, payload)
+		for _, signature := range signatures {
+			if hmac.Equal(expected, signature) {
+				return nil
+			}
+		}
+	}
+	if validKeys == 0 {
+		return ErrNoKeys
+	}
+	return ErrInvalidSignature
+}
+
+// VerifyOptions configures VerifyRequest, the empty fields take the rond defaults.
+type VerifyOptions struct {
+	// Keys are the accepted keys, usually the primary and, during a rotation, the secondary one.
+	Keys             []string
+	Header           string
+	UserIDHeader     string
+	UserGroupsHeader string
+	Tolerance        time.Duration
+	Now              func() time.Time
+}
+
+// VerifyRequest checks the signature of the user headers, method and path of a request
+// proxied by rond.
+func VerifyRequest(req *http.Request, options VerifyOptions) error {
+	header := valueOrDefault(options.Header, DefaultHeader)
+	userIDHeader := valueOrDefault(options.UserIDHeader, DefaultUserIDHeader)
+	userGroupsHeader := valueOrDefault(options.UserGroupsHeader, DefaultUserGroupsHeader)
+	tolerance := options.Tolerance
+	if tolerance == 0 {
+		tolerance = DefaultTolerance
+	}
+	now := time.Now
+	if options.Now != nil {
+		now = options.Now
+	}
+
+	return Verify(
+		req.Header.Get(header),
+		RequestPayload(req, userIDHeader, userGroupsHeader),
+		now(),
+		tolerance,
+		options.Keys...,
+	)
+}
+
+func parse(value string) (int64, [][]byte, error) {
+	var timestamp int64
+	hasTimestamp := false
+	signatures := make([][]byte, 0)
+	for _, part := range strings.Split(value, ",") {
+		key, partValue, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			return 0, nil, ErrMalformedSignature
+		}
+		switch key {
+		case timestampKey:
+			parsed, err := strconv.ParseInt(partValue, 10, 64)
+			if err != nil || hasTimestamp {
+				return 0, nil, ErrMalformedSignature
+			}
+			timestamp = parsed
+			hasTimestamp = true
+		case signatureKey:
+			signature, err := hex.DecodeString(partValue)
+			if err != nil {
+				return 0, nil, ErrMalformedSignature
+			}
+			signatures = append(signatures, signature)
+		}
+	}
+	if !hasTimestamp || len(signatures) == 0 {
+		return 0, nil, ErrMalformedSignature
+	}
+	return timestamp, signatures, nil
+}
+
+func computeMAC(key string, timestamp int64, payload Payload) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%d\n%s\n%s\n%s\n%s", timestamp, payload.Method, payload.Path, payload.UserID, payload.UserGroups)
+	return mac.Sum(nil)
+}
+
+func valueOrDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usersignature
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	payload := Payload{Method: http.MethodGet, Path: "/users", UserID: "user-1", UserGroups: "admin,users"}
+	withPayload := func(update func(*Payload)) Payload {
+		modified := payload
+		update(&modified)
+		return modified
+	}
+
+	t.Run("accepts the signed payload", func(t *testing.T) {
+		signature := Sign(now, payload, "primary")
+
+		require.NoError(t, Verify(signature, payload, now, DefaultTolerance, "primary"))
+	})
+
+	t.Run("rejects modified payloads", func(t *testing.T) {
+		signature := Sign(now, payload, "primary")
+
+		require.ErrorIs(t, Verify(signature, withPayload(func(p *Payload) { p.UserID = "user-2" }), now, DefaultTolerance, "primary"), ErrInvalidSignature)
+		require.ErrorIs(t, Verify(signature, withPayload(func(p *Payload) { p.UserGroups = "users" }), now, DefaultTolerance, "primary"), ErrInvalidSignature)
+		require.ErrorIs(t, Verify(signature, withPayload(func(p *Payload) { p.Method = http.MethodDelete }), now, DefaultTolerance, "primary"), ErrInvalidSignature)
+		require.ErrorIs(t, Verify(signature, withPayload(func(p *Payload) { p.Path = "/admin" }), now, DefaultTolerance, "primary"), ErrInvalidSignature)
+		// the separator keeps the user id and the groups apart
+		require.ErrorIs(t, Verify(signature, withPayload(func(p *Payload) { p.UserID, p.UserGroups = "user-1\nadmin,users", "" }), now, DefaultTolerance, "primary"), ErrInvalidSignature)
+	})
+
+	t.Run("rejects an unknown key", func(t *testing.T) {
+		signature := Sign(now, payload, "primary")
+
+		require.ErrorIs(t, Verify(signature, payload, now, DefaultTolerance, "other"), ErrInvalidSignature)
+		require.ErrorIs(t, Verify(signature, payload, now, DefaultTolerance), ErrNoKeys)
+	})
+
+	t.Run("handles the key rotation", func(t *testing.T) {
+		signature := Sign(now, payload, "new-key", "old-key")
+
+		require.NoError(t, Verify(signature, payload, now, DefaultTolerance, "old-key"))
+		require.NoError(t, Verify(signature, payload, now, DefaultTolerance, "new-key"))
+		require.NoError(t, Verify(Sign(now, payload, "new-key"), payload, now, DefaultTolerance, "new-key", "old-key"))
+	})
+
+	t.Run("tolerates the clock skew", func(t *testing.T) {
+		signature := Sign(now, payload, "primary")
+
+		require.NoError(t, Verify(signature, payload, now.Add(time.Minute), 2*time.Minute, "primary"))
+		require.NoError(t, Verify(signature, payload, now.Add(-time.Minute), 2*time.Minute, "primary"))
+		require.ErrorIs(t, Verify(signature, payload, now.Add(3*time.Minute), 2*time.Minute, "primary"), ErrExpiredSignature)
+		require.ErrorIs(t, Verify(signature, payload, now.Add(-3*time.Minute), 2*time.Minute, "primary"), ErrExpiredSignature)
+	})
+
+	t.Run("rejects malformed signatures", func(t *testing.T) {
+		require.ErrorIs(t, Verify("", payload, now, DefaultTolerance, "primary"), ErrMissingSignature)
+
+		testCases := []string{
+			"v1=abcd",
+			"t=1700000000",
+			"t=not-a-number,v1=abcd",
+			"t=1700000000,v1=not-hex",
+			"t=1700000000,t=1700000000,v1=abcd",
+			"t=1700000000,v1",
+		}
+		for _, value := range testCases {
+			require.ErrorIs(t, Verify(value, payload, now, DefaultTolerance, "primary"), ErrMalformedSignature, value)
+		}
+	})
+}
+
+func TestVerifyRequest(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	t.Run("uses the rond default headers", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/users", nil)
+		req.Header.Set(DefaultUserIDHeader, "user-1")
+		req.Header.Set(DefaultUserGroupsHeader, "users")
+		req.Header.Set(DefaultHeader, Sign(now, Payload{Method: http.MethodGet, Path: "/users", UserID: "user-1", UserGroups: "users"}, "primary"))
+
+		err := VerifyRequest(req, VerifyOptions{Keys: []string{"primary"}, Now: func() time.Time { return now }})
+		require.NoError(t, err)
+
+		req.Header.Set(DefaultUserGroupsHeader, "admin")
+		err = VerifyRequest(req, VerifyOptions{Keys: []string{"primary"}, Now: func() time.Time { return now }})
+		require.ErrorIs(t, err, ErrInvalidSignature)
+	})
+
+	t.Run("binds the signature to the method and path", func(t *testing.T) {
+		signature := Sign(now, Payload{Method: http.MethodGet, Path: "/users", UserID: "user-1"}, "primary")
+		for _, req := range []*http.Request{
+			httptest.NewRequest(http.MethodDelete, "/users", nil),
+			httptest.NewRequest(http.MethodGet, "/admin", nil),
+		} {
+			req.Header.Set(DefaultUserIDHeader, "user-1")
+			req.Header.Set(DefaultHeader, signature)
+
+			err := VerifyRequest(req, VerifyOptions{Keys: []string{"primary"}, Now: func() time.Time { return now }})
+			require.ErrorIs(t, err, ErrInvalidSignature)
+		}
+	})
+
+	t.Run("uses the configured headers", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("x-user", "user-1")
+		req.Header.Set("x-groups", "users")
+		req.Header.Set("x-signature", Sign(now, Payload{Method: http.MethodGet, Path: "/", UserID: "user-1", UserGroups: "users"}, "primary"))
+
+		err := VerifyRequest(req, VerifyOptions{
+			Keys:             []string{"primary"},
+			Header:           "x-signature",
+			UserIDHeader:     "x-user",
+			UserGroupsHeader: "x-groups",
+			Tolerance:        time.Second,
+			Now:              func() time.Time { return now.Add(2 * time.Second) },
+		})
+		require.ErrorIs(t, err, ErrExpiredSignature)
+	})
+
+	t.Run("rejects unsigned requests", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(DefaultUserIDHeader, "user-1")
+
+		require.ErrorIs(t, VerifyRequest(req, VerifyOptions{Keys: []string{"primary"}}), ErrMissingSignature)
+	})
+}